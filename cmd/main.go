@@ -5,13 +5,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/coreseekdev/texere/pkg/admin"
+	"github.com/coreseekdev/texere/pkg/contents"
+	"github.com/coreseekdev/texere/pkg/metrics"
 	"github.com/coreseekdev/texere/pkg/session"
 	"github.com/coreseekdev/texere/pkg/transport"
 )
@@ -23,8 +28,27 @@ type UserInfoData struct {
 }
 
 func main() {
+	// Structured JSON logs; every component tags its records, so they can be
+	// filtered by client_id, session_id or trace_id
+	var level slog.Level
+	level.UnmarshalText([]byte(os.Getenv("TEXERE_LOG_LEVEL")))
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	transport.SetLogContent(os.Getenv("TEXERE_LOG_CONTENT") == "1")
+
 	// Create components
-	auth := session.NewTokenAuthenticator()
+	var auth session.Authenticator = session.NewTokenAuthenticator()
+	if keyFile := os.Getenv("TEXERE_JWT_KEYS"); keyFile != "" {
+		// Signed tokens from a JSON Web Key Set, e.g. shared with an SSO gateway
+		jwtAuth, err := session.NewJWTAuthenticator(session.JWTConfig{
+			KeyFile:  keyFile,
+			Issuer:   os.Getenv("TEXERE_JWT_ISSUER"),
+			Audience: strings.Fields(os.Getenv("TEXERE_JWT_AUDIENCE")),
+		})
+		if err != nil {
+			log.Fatalf("Failed to load JWT keys: %v", err)
+		}
+		auth = jwtAuth
+	}
 	content := session.NewMemoryContentStorage()
 
 	// Initialize test files with Chinese and emoji content
@@ -33,6 +57,12 @@ func main() {
 	// Create protocol handler
 	protocolHandler := transport.NewProtocolHandler(content, auth)
 
+	// Evict clients that stop heartbeating and clean up idle sessions
+	protocolHandler.SetLifecycleConfig(transport.DefaultLifecycleConfig())
+
+	// Stop clients flooding the server with messages or huge operations
+	protocolHandler.SetRateLimitConfig(transport.DefaultRateLimitConfig())
+
 	// Create a single HTTP mux for all routes
 	mux := http.NewServeMux()
 
@@ -46,6 +76,44 @@ func main() {
 	// Setup HTTP routes (edit page, etc.)
 	setupHTTPRoutes(mux, protocolHandler, content, auth)
 
+	// Session history, shared with the checkpoints of the contents API
+	checkpoints := transport.NewMemoryHistoryService(false)
+
+	// Prometheus metrics of operations, broadcasts, send queues, history
+	// writes and rope pools
+	registry := metrics.NewRegistry()
+	transport.DescribeMetrics(registry)
+	metrics.DescribeRope(registry)
+	registry.Register(protocolHandler.Collect, metrics.RopePools, metrics.RopeEditStats(protocolHandler.EditMetrics()))
+	protocolHandler.SetMetrics(registry)
+	protocolHandler.Registry().Use(transport.MetricsMiddleware(registry))
+	protocolHandler.SetHistoryListener(transport.InstrumentHistory(checkpoints, registry))
+	mux.Handle("/metrics", registry.Handler())
+
+	// Jupyter-compatible contents API; writes to open files become operations
+	contentsHandler := contents.NewHandler(content, auth)
+	contentsHandler.SetHistory(checkpoints)
+	contentsHandler.SetLiveEditor(protocolHandler)
+	contentsHandler.Register(mux)
+
+	// Session admin API for users with the admin role. The token of the
+	// demo administrator is only written to a file readable by its owner,
+	// never to the logs.
+	admin.NewHandler(protocolHandler, auth).Register(mux)
+	if tokenAuth, ok := auth.(*session.TokenAuthenticator); ok {
+		if tokenFile := os.Getenv("TEXERE_ADMIN_TOKEN_FILE"); tokenFile != "" {
+			tokenAuth.AddUser(&session.UserInfo{UserID: "admin", Name: "Administrator", Roles: []string{admin.AdminRole}})
+			token, err := tokenAuth.GenerateToken(context.Background(), "admin")
+			if err == nil {
+				err = os.WriteFile(tokenFile, []byte(token+"\n"), 0600)
+			}
+			if err != nil {
+				log.Fatalf("Failed to write the admin API token: %v", err)
+			}
+			log.Printf("Admin API token written to %s", tokenFile)
+		}
+	}
+
 	// Create single HTTP server
 	server := &http.Server{
 		Addr:    ":8080",
@@ -63,6 +131,8 @@ func main() {
 		defer cancel()
 		server.Shutdown(ctx)
 		wsServer.Close()
+		protocolHandler.Close()
+		checkpoints.Close()
 		os.Exit(0)
 	}()
 
@@ -245,16 +315,22 @@ func handleEditPage(content session.ContentStorage, auth session.Authenticator)
 			return
 		}
 
-	// Validate token and get user info
-	_, userData, err := authenticateAndGetUser(auth, r.Context(), token)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-	}
+		// The WebSocket only accepts valid tokens
+		if valid, _ := auth.ValidateToken(r.Context(), token); !valid {
+			http.Redirect(w, r, "/edit", http.StatusFound)
+			return
+		}
 
-	// Render HTML page with inline CSS/JS
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	fmt.Fprint(w, renderEditorPage(token, userData.Color))
+		// Validate token and get user info
+		_, userData, err := authenticateAndGetUser(auth, r.Context(), token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		// Render HTML page with inline CSS/JS
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, renderEditorPage(token, userData.Color))
 	}
 }
 
@@ -275,6 +351,14 @@ func handleCreateToken(auth session.Authenticator) http.HandlerFunc {
 			return
 		}
 
+		// Tokens of administrators are not handed out to anyone who asks
+		if tokenAuth, ok := auth.(*session.TokenAuthenticator); ok {
+			if user, err := tokenAuth.GetUser(req.UserID); err == nil && admin.IsAdmin(user) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
 		// Generate token
 		token, err := auth.GenerateToken(r.Context(), req.UserID)
 		if err != nil {
@@ -780,6 +864,9 @@ func renderEditorPage(token, userColor string) string {
     <script>
         // Configuration
         const TOKEN = "` + token + `";
+        // Random per page, so the token never shows up in URLs or to other clients
+        const CLIENT_ID = "client-" + Array.from(crypto.getRandomValues(new Uint8Array(8)),
+            b => b.toString(16).padStart(2, "0")).join("");
         const USER_COLOR = "` + userColor + `";
         const WS_URL = "ws://localhost:8080/ws";
         const CURRENT_FILE = "test1.txt";
@@ -822,7 +909,7 @@ func renderEditorPage(token, userColor string) string {
 
         // WebSocket Connection
         function connectWebSocket() {
-            ws = new WebSocket(WS_URL + "?client_id=" + TOKEN);
+            ws = new WebSocket(WS_URL + "?client_id=" + CLIENT_ID, ["texere", "texere.token." + TOKEN]);
 
             ws.onopen = () => {
                 setConnected(true);
@@ -861,9 +948,13 @@ func renderEditorPage(token, userColor string) string {
 
         // Message Handler
         function handleMessage(msg) {
-            const protocolMsg = msg.metadata?.protocol_message;
+            // Version 1 envelopes wrap the protocol message
+            const protocolMsg = msg.metadata?.protocol_message ?? msg;
 
             switch (protocolMsg?.type) {
+                case "welcome":
+                    console.log("[Welcome] Protocol version", protocolMsg.data.protocol_version);
+                    break;
                 case "snapshot":
                     handleSnapshot(protocolMsg.data);
                     break;
@@ -885,6 +976,10 @@ func renderEditorPage(token, userColor string) string {
                 case "error":
                     handleError(protocolMsg.data);
                     break;
+                case "session_closed":
+                    console.warn("[SessionClosed]", protocolMsg.data);
+                    showToast("会话已关闭: " + (protocolMsg.data.reason || "") + " ⚠️", "error");
+                    break;
                 default:
                     console.log("Unknown message type:", protocolMsg?.type, msg);
             }
@@ -903,7 +998,7 @@ func renderEditorPage(token, userColor string) string {
 
             // Update username display
             if (username) {
-                username.textContent = TOKEN;
+                username.textContent = CLIENT_ID;
             }
 
             // Build clients map
@@ -1018,7 +1113,7 @@ func renderEditorPage(token, userColor string) string {
 
             const message = {
                 type: "operation",
-                client_id: TOKEN,
+                client_id: CLIENT_ID,
                 doc_id: currentFile,
                 timestamp: Date.now(),
                 metadata: {
@@ -1046,7 +1141,7 @@ func renderEditorPage(token, userColor string) string {
 
             const message = {
                 type: "heartbeat",
-                client_id: TOKEN,
+                client_id: CLIENT_ID,
                 timestamp: Date.now(),
                 metadata: {
                     protocol_message: {
@@ -1268,7 +1363,7 @@ func renderEditorPage(token, userColor string) string {
 
             const message = {
                 type: "operation",
-                client_id: TOKEN,
+                client_id: CLIENT_ID,
                 doc_id: filePath,
                 timestamp: Date.now(),
                 metadata: {
@@ -1328,11 +1423,11 @@ func getRandomColor() string {
 		"#FF6B6B", // Red
 		"#4ECDC4", // Green
 		"#45B7D1", // Blue
-	"#FFA07A", // Orange
-	"#9B59B6", // Gray
-	"#E91E63", // Pink
-	"#00BCD4", // Cyan
-	"#FF9800", // Amber
+		"#FFA07A", // Orange
+		"#9B59B6", // Gray
+		"#E91E63", // Pink
+		"#00BCD4", // Cyan
+		"#FF9800", // Amber
 		"#795548", // Brown
 		"#607D8B", // Blue Grey
 		"#9C27B0", // Purple
@@ -1341,10 +1436,10 @@ func getRandomColor() string {
 		"#795548", // Brown
 		"#8BC34A", // Light Green
 		"#03A9F4", // Light Blue
-	"#CDDC39", // Lime
-	"#FFEB3B", // Yellow
-	"#9C27B0", // Purple
-	"#FF9800", // Orange
+		"#CDDC39", // Lime
+		"#FFEB3B", // Yellow
+		"#9C27B0", // Purple
+		"#FF9800", // Orange
 	}
 
 	return colors[rand.Intn(len(colors))]
@@ -0,0 +1,326 @@
+// Package admin serves an HTTP API for operators to inspect and manage the
+// live edit sessions of a node.
+//
+// Routes, relative to /api/admin:
+//
+//	GET    /sessions                        List sessions with reader/writer counts
+//	GET    /sessions/{id}                   Clients, revision and snapshot state
+//	DELETE /sessions/{id}?reason=           Save and close a session
+//	POST   /sessions/{id}/snapshot          Snapshot recent changes to history
+//	POST   /sessions/{id}/save              Save the content to storage
+//	GET    /sessions/{id}/operations?limit= Recent operations with their authors
+//	DELETE /sessions/{id}/clients/{client}?reason=  Kick a client and close its connection
+//	GET    /backpressure                    Send queue metrics of each connected client
+//
+// Every request needs a token, as an "Authorization: Bearer" header or the
+// "token" query parameter, of a user with the AdminRole role.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreseekdev/texere/pkg/concordia"
+	"github.com/coreseekdev/texere/pkg/session"
+	"github.com/coreseekdev/texere/pkg/transport"
+)
+
+// APIPrefix is the URL path the handler serves.
+const APIPrefix = "/api/admin"
+
+// AdminRole is the role a user needs to use the admin API.
+const AdminRole = "admin"
+
+// SessionSummary is a session in the session list.
+type SessionSummary struct {
+	SessionID   string `json:"session_id"`
+	FilePath    string `json:"file_path"`
+	ContentType string `json:"content_type"`
+	Revision    int64  `json:"revision"`
+	ReaderCount int    `json:"reader_count"`
+	WriterCount int    `json:"writer_count"`
+	ClientCount int    `json:"client_count"`
+	CreatedAt   int64  `json:"created_at"`
+	UpdatedAt   int64  `json:"updated_at"`
+}
+
+// ClientDetails is a client of a session.
+type ClientDetails struct {
+	ClientID  string                `json:"client_id"`
+	UserID    string                `json:"user_id,omitempty"`
+	Name      string                `json:"name,omitempty"`
+	ReadOnly  bool                  `json:"read_only"`
+	IsEditing bool                  `json:"is_editing"`
+	CRDT      bool                  `json:"crdt"`
+	LastSeen  int64                 `json:"last_seen"`
+	Selection *transport.CursorData `json:"selection,omitempty"`
+}
+
+// SessionDetails is the state of one session.
+type SessionDetails struct {
+	SessionSummary
+	Size     int                     `json:"size"` // Content length in bytes
+	Clients  []ClientDetails         `json:"clients"`
+	Snapshot *transport.SnapshotInfo `json:"snapshot"`
+	Version  concordia.VersionVector `json:"version_vector"`
+}
+
+// Handler serves the admin API.
+type Handler struct {
+	protocol *transport.ProtocolHandler
+	auth     session.Authenticator
+	logger   *slog.Logger
+}
+
+// NewHandler creates an admin API handler for the sessions of protocol.
+// Users are authenticated with auth; without one every request is refused.
+func NewHandler(protocol *transport.ProtocolHandler, auth session.Authenticator) *Handler {
+	return &Handler{protocol: protocol, auth: auth}
+}
+
+// SetLogger sets the logger the handler records administrator actions
+// with. Call it before serving; it defaults to slog.Default().
+func (h *Handler) SetLogger(logger *slog.Logger) {
+	h.logger = logger
+}
+
+// log returns the logger of the handler.
+func (h *Handler) log() *slog.Logger {
+	logger := h.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger.With(transport.LogKeyComponent, "admin")
+}
+
+// Register registers the handler with mux under APIPrefix.
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.Handle(APIPrefix+"/", h)
+}
+
+// ServeHTTP authenticates and routes an admin API request.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, err := h.authenticate(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, APIPrefix), "/"), "/")
+	if len(segments) == 1 && segments[0] == "backpressure" && r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, h.protocol.BackpressureStats())
+		return
+	}
+	if segments[0] != "sessions" {
+		writeError(w, fmt.Errorf("%w: %s", session.ErrNotFound, r.URL.Path))
+		return
+	}
+
+	switch {
+	case len(segments) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, h.sessions())
+	case len(segments) == 2 && r.Method == http.MethodGet:
+		h.handleSession(w, segments[1])
+	case len(segments) == 2 && r.Method == http.MethodDelete:
+		h.handleClose(w, r, user, segments[1])
+	case len(segments) == 3 && segments[2] == "snapshot" && r.Method == http.MethodPost:
+		h.handleSnapshot(w, user, segments[1])
+	case len(segments) == 3 && segments[2] == "save" && r.Method == http.MethodPost:
+		h.handleSave(w, user, segments[1])
+	case len(segments) == 3 && segments[2] == "operations" && r.Method == http.MethodGet:
+		h.handleOperations(w, r, segments[1])
+	case len(segments) == 4 && segments[2] == "clients" && r.Method == http.MethodDelete:
+		h.handleKick(w, r, user, segments[1], segments[3])
+	default:
+		writeError(w, fmt.Errorf("%w: %s %s", session.ErrNotFound, r.Method, r.URL.Path))
+	}
+}
+
+// authenticate returns the user of a request if it may use the admin API.
+func (h *Handler) authenticate(r *http.Request) (*session.UserInfo, error) {
+	token := r.URL.Query().Get("token")
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	if h.auth == nil || token == "" {
+		return nil, session.ErrUnauthorized
+	}
+
+	user, err := h.auth.Authenticate(r.Context(), token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", session.ErrUnauthorized, err)
+	}
+	if IsAdmin(user) {
+		return user, nil
+	}
+	return nil, fmt.Errorf("%w: %s is not an administrator", session.ErrForbidden, user.UserID)
+}
+
+// IsAdmin reports whether a user has the AdminRole role.
+func IsAdmin(user *session.UserInfo) bool {
+	for _, role := range user.Roles {
+		if role == AdminRole {
+			return true
+		}
+	}
+	return false
+}
+
+// sessions lists the open sessions by file path.
+func (h *Handler) sessions() []SessionSummary {
+	sessions := h.protocol.Sessions()
+	summaries := make([]SessionSummary, 0, len(sessions))
+	for _, es := range sessions {
+		summaries = append(summaries, summarize(es))
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].FilePath < summaries[j].FilePath
+	})
+	return summaries
+}
+
+// handleSession returns the state of a session.
+func (h *Handler) handleSession(w http.ResponseWriter, sessionID string) {
+	es := h.protocol.Session(sessionID)
+	if es == nil {
+		writeError(w, transport.ErrSessionNotFound)
+		return
+	}
+
+	clients := es.GetClients()
+	details := &SessionDetails{
+		SessionSummary: summarize(es),
+		Size:           len(es.GetContent()),
+		Clients:        make([]ClientDetails, 0, len(clients)),
+		Snapshot:       es.GetSnapshotInfo(),
+		Version:        es.Version(),
+	}
+	for _, client := range clients {
+		details.Clients = append(details.Clients, ClientDetails{
+			ClientID:  client.ClientID,
+			UserID:    client.UserID,
+			Name:      client.Name,
+			ReadOnly:  client.ReadOnly,
+			IsEditing: client.IsEditing,
+			CRDT:      client.CRDT,
+			LastSeen:  client.LastSeen,
+			Selection: client.Selection,
+		})
+	}
+	sort.Slice(details.Clients, func(i, j int) bool {
+		return details.Clients[i].ClientID < details.Clients[j].ClientID
+	})
+	writeJSON(w, http.StatusOK, details)
+}
+
+// handleSnapshot snapshots the recent changes of a session.
+func (h *Handler) handleSnapshot(w http.ResponseWriter, user *session.UserInfo, sessionID string) {
+	info, err := h.protocol.SnapshotSession(sessionID, "admin:"+user.UserID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.log().Info("session snapshotted", "user_id", user.UserID, transport.LogKeySession, sessionID,
+		transport.LogKeyRevision, info.SnapshotVersion)
+	writeJSON(w, http.StatusOK, info)
+}
+
+// handleSave saves the content of a session.
+func (h *Handler) handleSave(w http.ResponseWriter, user *session.UserInfo, sessionID string) {
+	if err := h.protocol.SaveSession(sessionID); err != nil {
+		writeError(w, err)
+		return
+	}
+	h.log().Info("session saved", "user_id", user.UserID, transport.LogKeySession, sessionID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleClose saves and closes a session.
+func (h *Handler) handleClose(w http.ResponseWriter, r *http.Request, user *session.UserInfo, sessionID string) {
+	if err := h.protocol.CloseSession(sessionID, r.URL.Query().Get("reason")); err != nil {
+		writeError(w, err)
+		return
+	}
+	h.log().Info("session closed", "user_id", user.UserID, transport.LogKeySession, sessionID,
+		"reason", r.URL.Query().Get("reason"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleOperations returns the op log of a session.
+func (h *Handler) handleOperations(w http.ResponseWriter, r *http.Request, sessionID string) {
+	es := h.protocol.Session(sessionID)
+	if es == nil {
+		writeError(w, transport.ErrSessionNotFound)
+		return
+	}
+
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			writeError(w, fmt.Errorf("%w: invalid limit %q", session.ErrInvalidRequest, value))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"session_id": sessionID,
+		"revision":   es.GetCurrentVersion(),
+		"operations": es.OpLog(limit),
+	})
+}
+
+// handleKick removes a client from a session.
+func (h *Handler) handleKick(w http.ResponseWriter, r *http.Request, user *session.UserInfo, sessionID, clientID string) {
+	if err := h.protocol.KickClient(sessionID, clientID, r.URL.Query().Get("reason")); err != nil {
+		writeError(w, err)
+		return
+	}
+	h.log().Info("client kicked", "user_id", user.UserID, transport.LogKeySession, sessionID, transport.LogKeyClient, clientID,
+		"reason", r.URL.Query().Get("reason"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// summarize returns the list entry of a session.
+func summarize(es *transport.EditSession) SessionSummary {
+	info := es.GetSessionInfo()
+	return SessionSummary{
+		SessionID:   info.SessionID,
+		FilePath:    info.FilePath,
+		ContentType: es.ContentType(),
+		Revision:    info.Revision,
+		ReaderCount: info.ReaderCount,
+		WriterCount: info.WriterCount,
+		ClientCount: es.ClientCount(),
+		CreatedAt:   info.CreatedAt,
+		UpdatedAt:   info.UpdatedAt,
+	}
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeError writes an error as {"message", "reason"}. SessionErrors
+// have their status code; unknown sessions and clients are 404.
+func writeError(w http.ResponseWriter, err error) {
+	status, reason := http.StatusInternalServerError, "internal_error"
+	var sessionErr *session.SessionError
+	var transportErr *transport.TransportError
+	switch {
+	case errors.As(err, &sessionErr):
+		status, reason = sessionErr.StatusCode(), sessionErr.Code
+	case errors.Is(err, transport.ErrSessionNotFound), errors.Is(err, transport.ErrClientNotFound):
+		errors.As(err, &transportErr)
+		status, reason = http.StatusNotFound, transportErr.Code
+	}
+	writeJSON(w, status, map[string]string{"message": err.Error(), "reason": reason})
+}
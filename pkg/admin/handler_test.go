@@ -0,0 +1,197 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreseekdev/texere/pkg/session"
+	"github.com/coreseekdev/texere/pkg/transport"
+	"github.com/gorilla/websocket"
+)
+
+// testServer runs a protocol handler and the admin API, and returns an
+// admin token, a user token and the server URL.
+func testServer(t *testing.T, storage session.ContentStorage) (*transport.ProtocolHandler, string, string, string) {
+	t.Helper()
+	protocol := transport.NewProtocolHandler(storage, nil)
+	t.Cleanup(protocol.Close)
+	wsServer := transport.NewWebSocketServer("")
+	protocol.SetServer(wsServer)
+
+	auth := session.NewTokenAuthenticator()
+	auth.AddUser(&session.UserInfo{UserID: "ops", Roles: []string{AdminRole}})
+	adminToken, _ := auth.GenerateToken(context.Background(), "ops")
+	userToken, _ := auth.GenerateToken(context.Background(), "someone")
+
+	mux := http.NewServeMux()
+	wsServer.RegisterHandler(mux)
+	NewHandler(protocol, auth).Register(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return protocol, adminToken, userToken, server.URL
+}
+
+// dial connects a client and starts editing path.
+func dial(t *testing.T, url, clientID, path string) (*websocket.Conn, string) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws?protocol=2&client_id="+clientID, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	pm, _ := transport.NewProtocolMessage(transport.MessageTypeStartEditing, "", &transport.StartEditingData{FilePath: path})
+	conn.WriteJSON(pm)
+	var snapshot transport.SnapshotData
+	read(t, conn, transport.MessageTypeSnapshot, &snapshot)
+	return conn, snapshot.SessionID
+}
+
+// read reads messages until one of msgType and decodes its data.
+func read(t *testing.T, conn *websocket.Conn, msgType transport.MessageType, data interface{}) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var pm transport.ProtocolMessage
+		if err := conn.ReadJSON(&pm); err != nil {
+			t.Fatalf("Expected %s, got %v", msgType, err)
+		}
+		if pm.Type == msgType {
+			json.Unmarshal(pm.Data, data)
+			return
+		}
+	}
+}
+
+// call sends an admin request and decodes a JSON response into out.
+func call(t *testing.T, method, url, token string, out interface{}) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+// TestHandler_Auth tests that only administrators can use the API.
+func TestHandler_Auth(t *testing.T) {
+	_, adminToken, userToken, url := testServer(t, nil)
+
+	if code := call(t, "GET", url+"/api/admin/sessions", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", code)
+	}
+	if code := call(t, "GET", url+"/api/admin/sessions", "bogus", nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with an invalid token, got %d", code)
+	}
+	if code := call(t, "GET", url+"/api/admin/sessions", userToken, nil); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a user, got %d", code)
+	}
+	if code := call(t, "GET", url+"/api/admin/backpressure", userToken, nil); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a user's backpressure request, got %d", code)
+	}
+	if code := call(t, "GET", url+"/api/admin/sessions?token="+adminToken, "", nil); code != http.StatusOK {
+		t.Errorf("Expected 200 for an administrator, got %d", code)
+	}
+}
+
+// TestHandler_Sessions tests inspecting, snapshotting, kicking and closing.
+func TestHandler_Sessions(t *testing.T) {
+	storage := session.NewMemoryContentStorage()
+	_, token, _, url := testServer(t, storage)
+	alice, sessionID := dial(t, url, "alice", "/doc.txt")
+	bob, _ := dial(t, url, "bob", "/doc.txt")
+
+	pm, _ := transport.NewProtocolMessage(transport.MessageTypeOperation, "", &transport.OperationData{
+		SessionID: sessionID,
+		Operation: []interface{}{"hello"},
+	})
+	alice.WriteJSON(pm)
+	var ack transport.AckData
+	read(t, alice, transport.MessageTypeAck, &ack)
+
+	var sessions []SessionSummary
+	call(t, "GET", url+"/api/admin/sessions", token, &sessions)
+	if len(sessions) != 1 || sessions[0].SessionID != sessionID || sessions[0].WriterCount != 2 || sessions[0].Revision != 1 {
+		t.Fatalf("Expected one session with 2 writers at revision 1, got %+v", sessions)
+	}
+
+	var stats transport.BackpressureStats
+	call(t, "GET", url+"/api/admin/backpressure", token, &stats)
+	if len(stats.Clients) != 2 || stats.Clients[0].ClientID != "alice" || stats.Clients[1].ClientID != "bob" {
+		t.Errorf("Expected the queues of alice and bob, got %+v", stats.Clients)
+	}
+
+	var details SessionDetails
+	call(t, "GET", url+"/api/admin/sessions/"+sessionID, token, &details)
+	if len(details.Clients) != 2 || details.Clients[0].ClientID != "alice" || details.Size != 5 || details.Snapshot.RecentChangeCount != 1 {
+		t.Errorf("Expected alice and bob with one recent change, got %+v", details)
+	}
+
+	var opLog struct {
+		Operations []transport.OpLogEntry `json:"operations"`
+	}
+	call(t, "GET", url+"/api/admin/sessions/"+sessionID+"/operations?limit=10", token, &opLog)
+	if len(opLog.Operations) != 1 || opLog.Operations[0].ClientID != "alice" || opLog.Operations[0].Revision != 1 {
+		t.Errorf("Expected alice's operation, got %+v", opLog.Operations)
+	}
+
+	var snapshot transport.SnapshotInfo
+	if code := call(t, "POST", url+"/api/admin/sessions/"+sessionID+"/snapshot", token, &snapshot); code != http.StatusOK || snapshot.SnapshotVersion != 1 {
+		t.Errorf("Expected a snapshot at version 1, got %d %+v", code, snapshot)
+	}
+
+	if code := call(t, "DELETE", url+"/api/admin/sessions/"+sessionID+"/clients/bob?reason=bye", token, nil); code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+	var kicked transport.ErrorData
+	read(t, bob, transport.MessageTypeError, &kicked)
+	if kicked.Code != "kicked" || kicked.Message != "bye" {
+		t.Errorf("Expected a kicked error, got %+v", kicked)
+	}
+	bob.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := bob.ReadMessage(); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Error("Expected bob's connection to be closed")
+			}
+			break
+		}
+	}
+	var left transport.UserLeftData
+	read(t, alice, transport.MessageTypeUserLeft, &left)
+	if left.ClientID != "bob" {
+		t.Errorf("Expected bob to leave, got %s", left.ClientID)
+	}
+	if code := call(t, "DELETE", url+"/api/admin/sessions/"+sessionID+"/clients/bob", token, nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a client that left, got %d", code)
+	}
+
+	if code := call(t, "DELETE", url+"/api/admin/sessions/"+sessionID+"?reason=maintenance", token, nil); code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+	var closed transport.SessionClosedData
+	read(t, alice, transport.MessageTypeSessionClosed, &closed)
+	if closed.SessionID != sessionID || closed.Reason != "maintenance" {
+		t.Errorf("Expected session_closed for maintenance, got %+v", closed)
+	}
+	if saved, err := storage.Get(context.Background(), "/doc.txt", nil); err != nil || saved.Content != "hello" {
+		t.Errorf("Expected the content to be saved, got %+v (%v)", saved, err)
+	}
+	if code := call(t, "GET", url+"/api/admin/sessions/"+sessionID, token, nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a closed session, got %d", code)
+	}
+}
@@ -0,0 +1,259 @@
+package concordia
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ========== Hybrid Logical Clock ==========
+
+// ErrClockOffset is returned when a remote timestamp is further ahead of
+// the local wall clock than the clock's maximum offset allows.
+var ErrClockOffset = errors.New("remote clock too far ahead")
+
+// HLCTime is a hybrid logical clock timestamp: a wall-clock time plus a
+// logical counter that orders events within the same wall time.
+//
+// HLC timestamps stay close to physical time, so they can be shown to
+// users and used for "undo to 10 minutes ago", but unlike wall-clock
+// times they never go backwards and always order an event after the
+// events it has seen.
+type HLCTime struct {
+	Wall    int64  `json:"wall"`    // Unix nanoseconds
+	Logical uint32 `json:"logical"` // Counter within Wall
+}
+
+// Compare returns -1, 0 or +1 if t is before, equal to or after other.
+func (t HLCTime) Compare(other HLCTime) int {
+	switch {
+	case t.Wall < other.Wall:
+		return -1
+	case t.Wall > other.Wall:
+		return 1
+	case t.Logical < other.Logical:
+		return -1
+	case t.Logical > other.Logical:
+		return 1
+	}
+	return 0
+}
+
+// Before returns true if t is before other.
+func (t HLCTime) Before(other HLCTime) bool {
+	return t.Compare(other) < 0
+}
+
+// IsZero returns true for the zero timestamp.
+func (t HLCTime) IsZero() bool {
+	return t.Wall == 0 && t.Logical == 0
+}
+
+// Time returns the wall-clock part of t.
+func (t HLCTime) Time() time.Time {
+	return time.Unix(0, t.Wall)
+}
+
+// String returns "wall.logical".
+func (t HLCTime) String() string {
+	return fmt.Sprintf("%d.%d", t.Wall, t.Logical)
+}
+
+// HybridClock issues HLC timestamps for one site.
+// It is safe for concurrent use.
+type HybridClock struct {
+	mu        sync.Mutex
+	now       func() time.Time
+	last      HLCTime
+	maxOffset time.Duration
+}
+
+// NewHybridClock creates a clock reading physical time from now.
+// A nil now uses time.Now.
+func NewHybridClock(now func() time.Time) *HybridClock {
+	if now == nil {
+		now = time.Now
+	}
+	return &HybridClock{now: now}
+}
+
+// SetMaxOffset sets how far ahead of the local wall clock a remote
+// timestamp may be; Update rejects timestamps further ahead.
+// 0 (the default) accepts any timestamp.
+func (c *HybridClock) SetMaxOffset(offset time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxOffset = offset
+}
+
+// Now returns a timestamp for a local event.
+func (c *HybridClock) Now() HLCTime {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wall := c.now().UnixNano()
+	if wall > c.last.Wall {
+		c.last = HLCTime{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Update merges a timestamp received from another site and returns a
+// timestamp for the receive event, which is after both.
+func (c *HybridClock) Update(remote HLCTime) (HLCTime, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wall := c.now().UnixNano()
+	if c.maxOffset > 0 && remote.Wall-wall > int64(c.maxOffset) {
+		return HLCTime{}, fmt.Errorf("%w: %v", ErrClockOffset, time.Duration(remote.Wall-wall))
+	}
+
+	next := HLCTime{Wall: wall}
+	if c.last.Wall > next.Wall {
+		next.Wall = c.last.Wall
+	}
+	if remote.Wall > next.Wall {
+		next.Wall = remote.Wall
+	}
+
+	switch {
+	case next.Wall == c.last.Wall && next.Wall == remote.Wall:
+		next.Logical = c.last.Logical
+		if remote.Logical > next.Logical {
+			next.Logical = remote.Logical
+		}
+		next.Logical++
+	case next.Wall == c.last.Wall:
+		next.Logical = c.last.Logical + 1
+	case next.Wall == remote.Wall:
+		next.Logical = remote.Logical + 1
+	}
+	c.last = next
+	return next, nil
+}
+
+// Last returns the most recent timestamp issued.
+func (c *HybridClock) Last() HLCTime {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+// observe moves the clock forward to at least t, e.g. after loading a
+// history that was written by a clock that ran ahead.
+func (c *HybridClock) observe(t HLCTime) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last.Before(t) {
+		c.last = t
+	}
+}
+
+// ========== Version Vectors ==========
+
+// Causality is the causal relation between two events.
+type Causality int
+
+const (
+	CausalEqual      Causality = iota // Same event, or the same knowledge
+	CausalBefore                      // The first happened before the second
+	CausalAfter                       // The first happened after the second
+	CausalConcurrent                  // Neither has seen the other
+)
+
+// String returns the name of the relation.
+func (c Causality) String() string {
+	switch c {
+	case CausalEqual:
+		return "equal"
+	case CausalBefore:
+		return "before"
+	case CausalAfter:
+		return "after"
+	default:
+		return "concurrent"
+	}
+}
+
+// VersionVector counts, per site, the revisions a site has seen.
+//
+// The version vector of a revision counts the revisions its site had
+// seen when committing it, itself included. Comparing two vectors tells
+// whether one revision happened before the other or whether they are
+// concurrent, which a Lamport time cannot.
+type VersionVector map[string]uint64
+
+// Clone returns a copy of v.
+func (v VersionVector) Clone() VersionVector {
+	clone := make(VersionVector, len(v))
+	for site, n := range v {
+		clone[site] = n
+	}
+	return clone
+}
+
+// Get returns the count of site.
+func (v VersionVector) Get(site string) uint64 {
+	return v[site]
+}
+
+// Increment increments the count of site and returns it.
+func (v VersionVector) Increment(site string) uint64 {
+	v[site]++
+	return v[site]
+}
+
+// Merge raises every count of v to at least the count in other.
+func (v VersionVector) Merge(other VersionVector) {
+	for site, n := range other {
+		if n > v[site] {
+			v[site] = n
+		}
+	}
+}
+
+// Descends returns true if v has seen everything other has.
+func (v VersionVector) Descends(other VersionVector) bool {
+	for site, n := range other {
+		if v[site] < n {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare returns the causal relation of v to other.
+func (v VersionVector) Compare(other VersionVector) Causality {
+	descends, descended := v.Descends(other), other.Descends(v)
+	switch {
+	case descends && descended:
+		return CausalEqual
+	case descended:
+		return CausalBefore
+	case descends:
+		return CausalAfter
+	default:
+		return CausalConcurrent
+	}
+}
+
+// String returns the counts sorted by site, e.g. "{a:2 b:1}".
+func (v VersionVector) String() string {
+	sites := make([]string, 0, len(v))
+	for site := range v {
+		sites = append(sites, site)
+	}
+	sort.Strings(sites)
+
+	parts := make([]string, len(sites))
+	for i, site := range sites {
+		parts[i] = fmt.Sprintf("%s:%d", site, v[site])
+	}
+	return "{" + strings.Join(parts, " ") + "}"
+}
@@ -0,0 +1,85 @@
+package concordia
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTime is a wall clock that only moves when told to.
+type fakeTime struct {
+	now time.Time
+}
+
+func (f *fakeTime) Now() time.Time {
+	return f.now
+}
+
+func TestHybridClock_Now(t *testing.T) {
+	wall := &fakeTime{now: time.Unix(100, 0)}
+	clock := NewHybridClock(wall.Now)
+
+	first := clock.Now()
+	assert.Equal(t, HLCTime{Wall: wall.now.UnixNano()}, first)
+
+	// The wall clock stands still: the logical counter orders events
+	second := clock.Now()
+	assert.True(t, first.Before(second))
+	assert.Equal(t, uint32(1), second.Logical)
+
+	// The wall clock goes backwards: time never does
+	wall.now = time.Unix(90, 0)
+	third := clock.Now()
+	assert.True(t, second.Before(third))
+	assert.Equal(t, first.Wall, third.Wall)
+
+	wall.now = time.Unix(101, 0)
+	assert.Equal(t, HLCTime{Wall: wall.now.UnixNano()}, clock.Now())
+}
+
+func TestHybridClock_Update(t *testing.T) {
+	wall := &fakeTime{now: time.Unix(100, 0)}
+	clock := NewHybridClock(wall.Now)
+	local := clock.Now()
+
+	// A remote clock ahead of ours pulls us forward
+	remote := HLCTime{Wall: time.Unix(105, 0).UnixNano(), Logical: 3}
+	received, err := clock.Update(remote)
+	require.NoError(t, err)
+	assert.Equal(t, HLCTime{Wall: remote.Wall, Logical: 4}, received)
+	assert.True(t, received.Before(clock.Now()))
+
+	// A remote clock behind ours still moves the counter
+	received, err = clock.Update(local)
+	require.NoError(t, err)
+	assert.Equal(t, remote.Wall, received.Wall)
+	assert.Equal(t, uint32(6), received.Logical)
+
+	clock.SetMaxOffset(time.Second)
+	_, err = clock.Update(HLCTime{Wall: time.Unix(200, 0).UnixNano()})
+	assert.ErrorIs(t, err, ErrClockOffset)
+	assert.Equal(t, received, clock.Last(), "rejected time is not merged")
+}
+
+func TestVersionVector_Compare(t *testing.T) {
+	base := VersionVector{"a": 1, "b": 1}
+	after := VersionVector{"a": 2, "b": 1}
+	other := VersionVector{"a": 1, "b": 2}
+
+	assert.Equal(t, CausalEqual, base.Compare(base.Clone()))
+	assert.Equal(t, CausalBefore, base.Compare(after))
+	assert.Equal(t, CausalAfter, after.Compare(base))
+	assert.Equal(t, CausalConcurrent, after.Compare(other))
+	assert.Equal(t, CausalBefore, VersionVector{}.Compare(base), "missing sites count as 0")
+
+	merged := after.Clone()
+	merged.Merge(other)
+	assert.Equal(t, VersionVector{"a": 2, "b": 2}, merged)
+	assert.True(t, merged.Descends(after))
+	assert.True(t, merged.Descends(other))
+	assert.Equal(t, uint64(3), merged.Increment("a"))
+	assert.Equal(t, "{a:3 b:2}", merged.String())
+	assert.Equal(t, VersionVector{"a": 2, "b": 1}, after, "clones are independent")
+}
@@ -0,0 +1,397 @@
+package concordia
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/rope"
+)
+
+// ========== Rich-Text Document ==========
+
+// FormatRun is a range of text sharing the same formatting attributes.
+// Unformatted text is reported as a run with nil Attributes.
+type FormatRun struct {
+	Start      int             `json:"start"`
+	End        int             `json:"end"`
+	Attributes ot.AttributeMap `json:"attributes,omitempty"`
+}
+
+// Len returns the number of characters in the run.
+func (r FormatRun) Len() int {
+	return r.End - r.Start
+}
+
+// formatRun is the internal run-length encoding of formatting.
+type formatRun struct {
+	length int
+	attrs  ot.AttributeMap
+}
+
+// RichDocument stores rich text as a rope plus a tree of formatting runs.
+//
+// The text lives in the rope, so large documents keep the rope's
+// structural sharing and cheap edits. Formatting is kept separately as
+// runs that cover the whole document; adjacent runs always have
+// different attributes. The runs are stored like a rope too, in a
+// persistent tree indexed by position, so an edit only copies the runs
+// around the positions it touches. Edits arrive as ot.Delta values,
+// which change text and formatting together, or as plain ot.Operation
+// values, whose inserted text is unformatted.
+//
+// Example:
+//
+//	doc := concordia.NewRichDocument(rope.New("Hello World"))
+//	err := doc.ApplyDelta(ot.NewDelta().Retain(6, nil).Retain(5, ot.AttributeMap{"bold": true}))
+//	doc.AttributesAt(7) // {"bold": true}
+type RichDocument struct {
+	mu   sync.RWMutex
+	rope *rope.Rope
+	runs *runNode
+}
+
+// NewRichDocument creates a rich document with unformatted text.
+func NewRichDocument(r *rope.Rope) *RichDocument {
+	if r == nil {
+		r = rope.Empty()
+	}
+	doc := &RichDocument{rope: r}
+	if n := r.Length(); n > 0 {
+		doc.runs = newRunNode(formatRun{length: n})
+	}
+	return doc
+}
+
+// NewRichDocumentFromDelta creates a rich document from a document Delta,
+// i.e. one that consists of inserts only.
+func NewRichDocumentFromDelta(delta *ot.Delta) (*RichDocument, error) {
+	if !delta.IsDocument() {
+		return nil, fmt.Errorf("delta is not a document: %s", delta.String())
+	}
+
+	var runs []formatRun
+	for _, op := range delta.Ops() {
+		runs = appendRun(runs, op.Length(), op.Attributes)
+	}
+	return &RichDocument{rope: rope.New(delta.Text()), runs: buildRunTree(runs)}, nil
+}
+
+// Rope returns the current document text.
+func (d *RichDocument) Rope() *rope.Rope {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.rope
+}
+
+// String returns the current document text.
+func (d *RichDocument) String() string {
+	return d.Rope().String()
+}
+
+// Length returns the document length in characters.
+func (d *RichDocument) Length() int {
+	return d.Rope().Length()
+}
+
+// Runs returns the formatting runs covering the document, in order.
+func (d *RichDocument) Runs() []FormatRun {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	result := make([]FormatRun, 0, d.runs.size())
+	pos := 0
+	walkRuns(d.runs, func(run formatRun) {
+		result = append(result, FormatRun{Start: pos, End: pos + run.length, Attributes: run.attrs.Clone()})
+		pos += run.length
+	})
+	return result
+}
+
+// AttributesAt returns the attributes of the character at pos.
+// Returns nil if the character is unformatted or pos is out of range.
+func (d *RichDocument) AttributesAt(pos int) ot.AttributeMap {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	n := d.runs
+	if pos < 0 || pos >= n.len() {
+		return nil
+	}
+	for {
+		if left := n.left.len(); pos < left {
+			n = n.left
+		} else if pos -= left; pos < n.run.length {
+			return n.run.attrs.Clone()
+		} else {
+			pos -= n.run.length
+			n = n.right
+		}
+	}
+}
+
+// IsFormatted reports whether any text in the document has attributes.
+func (d *RichDocument) IsFormatted() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.runs != nil && d.runs.formatted
+}
+
+// ToDelta returns the document as a Delta of formatted inserts.
+func (d *RichDocument) ToDelta() *ot.Delta {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	delta := ot.NewDelta()
+	pos := 0
+	walkRuns(d.runs, func(run formatRun) {
+		if text, err := d.rope.Slice(pos, pos+run.length); err == nil {
+			delta.Insert(text, run.attrs)
+		}
+		pos += run.length
+	})
+	return delta
+}
+
+// ApplyDelta applies a rich-text Delta, updating text and formatting.
+// The Delta may be shorter than the document; the rest is kept as is.
+func (d *RichDocument) ApplyDelta(delta *ot.Delta) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	length := d.rope.Length()
+	if delta.BaseLength() > length {
+		return fmt.Errorf("%w: delta covers %d characters, document has %d",
+			ot.ErrInvalidBaseLength, delta.BaseLength(), length)
+	}
+
+	// Retained runs without new attributes are moved over as whole
+	// subtrees; the old tree is left intact in case the edit fails.
+	cs := rope.NewChangeSet(length)
+	var runs *runNode
+	old := d.runs
+
+	for _, op := range delta.Ops() {
+		switch op.Type() {
+		case ot.OpRetain:
+			cs.Retain(op.Retain)
+			var retained *runNode
+			retained, old = splitRuns(old, op.Retain)
+			if len(op.Attributes) > 0 {
+				retained = formatRuns(retained, op.Attributes)
+			}
+			runs = joinRuns(runs, retained)
+		case ot.OpInsert:
+			cs.Insert(op.Insert)
+			if n := utf8.RuneCountInString(op.Insert); n > 0 {
+				runs = joinRuns(runs, newRunNode(formatRun{length: n, attrs: ot.ComposeAttributes(nil, op.Attributes, false)}))
+			}
+		case ot.OpDelete:
+			cs.Delete(op.Delete)
+			_, old = splitRuns(old, op.Delete)
+		}
+	}
+
+	// Implicit trailing retain
+	if rest := length - delta.BaseLength(); rest > 0 {
+		cs.Retain(rest)
+		runs = joinRuns(runs, old)
+	}
+
+	result, err := cs.Apply(d.rope)
+	if err != nil {
+		return err
+	}
+
+	d.rope = result
+	d.runs = runs
+	return nil
+}
+
+// ApplyOperation applies a plain-text OT operation.
+// Inserted text is unformatted; formatting of retained text is kept.
+func (d *RichDocument) ApplyOperation(op *ot.Operation) error {
+	if op.BaseLength() != d.Length() {
+		return ot.ErrInvalidBaseLength
+	}
+	return d.ApplyDelta(ot.DeltaFromOperation(op))
+}
+
+// appendRun appends a run, merging it with the last run if the attributes match.
+func appendRun(runs []formatRun, length int, attrs ot.AttributeMap) []formatRun {
+	if length <= 0 {
+		return runs
+	}
+	if n := len(runs); n > 0 && runs[n-1].attrs.Equals(attrs) {
+		runs[n-1].length += length
+		return runs
+	}
+	return append(runs, formatRun{length: length, attrs: attrs.Clone()})
+}
+
+// ========== Run Tree ==========
+
+// runNode is a node of the treap holding the formatting runs of a
+// RichDocument. Nodes are ordered by position and augmented with the
+// length of their subtree, so a position is found in O(log n) like in a
+// rope. The tree is persistent: split and merge copy the nodes on their
+// path instead of changing them, so versions share unchanged subtrees.
+type runNode struct {
+	run       formatRun
+	priority  uint64
+	length    int  // characters in the subtree
+	count     int  // runs in the subtree
+	formatted bool // whether any run of the subtree has attributes
+	left      *runNode
+	right     *runNode
+}
+
+func newRunNode(run formatRun) *runNode {
+	n := &runNode{run: run, priority: rand.Uint64()}
+	n.update()
+	return n
+}
+
+func (n *runNode) update() {
+	n.length = n.run.length + n.left.len() + n.right.len()
+	n.count = 1 + n.left.size() + n.right.size()
+	n.formatted = len(n.run.attrs) > 0 ||
+		(n.left != nil && n.left.formatted) || (n.right != nil && n.right.formatted)
+}
+
+// len returns the number of characters in the subtree; n may be nil.
+func (n *runNode) len() int {
+	if n == nil {
+		return 0
+	}
+	return n.length
+}
+
+// size returns the number of runs in the subtree; n may be nil.
+func (n *runNode) size() int {
+	if n == nil {
+		return 0
+	}
+	return n.count
+}
+
+// with returns a copy of n with other children.
+func (n *runNode) with(left, right *runNode) *runNode {
+	cp := &runNode{run: n.run, priority: n.priority, left: left, right: right}
+	cp.update()
+	return cp
+}
+
+// splitRuns splits a tree into the runs before pos and the rest, splitting
+// the run that contains pos in two.
+func splitRuns(n *runNode, pos int) (*runNode, *runNode) {
+	if n == nil || pos <= 0 {
+		return nil, n
+	}
+	if pos >= n.length {
+		return n, nil
+	}
+
+	left := n.left.len()
+	switch {
+	case pos <= left:
+		l, r := splitRuns(n.left, pos)
+		return l, n.with(r, n.right)
+	case pos >= left+n.run.length:
+		l, r := splitRuns(n.right, pos-left-n.run.length)
+		return n.with(n.left, l), r
+	default:
+		offset := pos - left
+		head := newRunNode(formatRun{length: offset, attrs: n.run.attrs})
+		tail := newRunNode(formatRun{length: n.run.length - offset, attrs: n.run.attrs})
+		return mergeRuns(n.left, head), mergeRuns(tail, n.right)
+	}
+}
+
+// mergeRuns concatenates two trees.
+func mergeRuns(a, b *runNode) *runNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.priority > b.priority {
+		return a.with(a.left, mergeRuns(a.right, b))
+	}
+	return b.with(mergeRuns(a, b.left), b.right)
+}
+
+// joinRuns concatenates two trees, merging the runs that meet if their
+// attributes match.
+func joinRuns(a, b *runNode) *runNode {
+	if a == nil || b == nil {
+		return mergeRuns(a, b)
+	}
+
+	last := a
+	for last.right != nil {
+		last = last.right
+	}
+	first := b
+	for first.left != nil {
+		first = first.left
+	}
+	if !last.run.attrs.Equals(first.run.attrs) {
+		return mergeRuns(a, b)
+	}
+
+	a, _ = splitRuns(a, a.length-last.run.length)
+	_, b = splitRuns(b, first.run.length)
+	joined := newRunNode(formatRun{length: last.run.length + first.run.length, attrs: last.run.attrs})
+	return mergeRuns(mergeRuns(a, joined), b)
+}
+
+// formatRuns returns a tree of the runs of n with attrs composed onto them.
+func formatRuns(n *runNode, attrs ot.AttributeMap) *runNode {
+	runs := make([]formatRun, 0, n.size())
+	walkRuns(n, func(run formatRun) {
+		runs = appendRun(runs, run.length, ot.ComposeAttributes(run.attrs, attrs, false))
+	})
+	return buildRunTree(runs)
+}
+
+// buildRunTree builds a tree of runs in O(n) using the standard Cartesian
+// tree construction.
+func buildRunTree(runs []formatRun) *runNode {
+	stack := make([]*runNode, 0, 32)
+	for _, run := range runs {
+		node := &runNode{run: run, priority: rand.Uint64()}
+		var last *runNode
+		for len(stack) > 0 && stack[len(stack)-1].priority < node.priority {
+			last = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			last.update()
+		}
+		node.left = last
+		if len(stack) > 0 {
+			stack[len(stack)-1].right = node
+		}
+		stack = append(stack, node)
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		stack[i].update()
+	}
+	if len(stack) == 0 {
+		return nil
+	}
+	return stack[0]
+}
+
+// walkRuns calls fn for the runs of a tree in order.
+func walkRuns(n *runNode, fn func(formatRun)) {
+	if n == nil {
+		return
+	}
+	walkRuns(n.left, fn)
+	fn(n.run)
+	walkRuns(n.right, fn)
+}
@@ -0,0 +1,169 @@
+package concordia
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/rope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRichDocument_ApplyDelta(t *testing.T) {
+	doc := NewRichDocument(rope.New("Hello World"))
+	assert.False(t, doc.IsFormatted())
+
+	// Bold "World"
+	require.NoError(t, doc.ApplyDelta(ot.NewDelta().Retain(6, nil).Retain(5, ot.AttributeMap{"bold": true})))
+	assert.True(t, doc.IsFormatted())
+	assert.Equal(t, []FormatRun{
+		{Start: 0, End: 6},
+		{Start: 6, End: 11, Attributes: ot.AttributeMap{"bold": true}},
+	}, doc.Runs())
+
+	// Insert a heading-formatted prefix and delete "Hello "
+	delta := ot.NewDelta().Insert("Title\n", ot.AttributeMap{"header": 1.0}).Delete(6)
+	require.NoError(t, doc.ApplyDelta(delta))
+	assert.Equal(t, "Title\nWorld", doc.String())
+	assert.Equal(t, ot.AttributeMap{"header": 1.0}, doc.AttributesAt(0))
+	assert.Equal(t, ot.AttributeMap{"bold": true}, doc.AttributesAt(6))
+	assert.Nil(t, doc.AttributesAt(100))
+
+	expected := ot.NewDelta().Insert("Title\n", ot.AttributeMap{"header": 1.0}).Insert("World", ot.AttributeMap{"bold": true})
+	assert.True(t, expected.Equals(doc.ToDelta()), "got %s", doc.ToDelta())
+
+	// Removing the attribute merges runs back together
+	require.NoError(t, doc.ApplyDelta(ot.NewDelta().Retain(6, ot.AttributeMap{"header": nil}).Retain(5, ot.AttributeMap{"bold": nil})))
+	assert.Equal(t, []FormatRun{{Start: 0, End: 11}}, doc.Runs())
+	assert.False(t, doc.IsFormatted())
+}
+
+func TestRichDocument_MatchesDeltaCompose(t *testing.T) {
+	base := ot.NewDelta().Insert("ab", ot.AttributeMap{"italic": true}).Insert("cdef", nil)
+	doc, err := NewRichDocumentFromDelta(base)
+	require.NoError(t, err)
+
+	change := ot.NewDelta().Retain(1, nil).Delete(2).Retain(2, ot.AttributeMap{"link": "https://example.com"}).Insert("!", nil)
+	require.NoError(t, doc.ApplyDelta(change))
+
+	assert.True(t, base.Compose(change).Equals(doc.ToDelta()), "got %s", doc.ToDelta())
+}
+
+func TestRichDocument_ApplyOperation(t *testing.T) {
+	doc, err := NewRichDocumentFromDelta(ot.NewDelta().Insert("bold", ot.AttributeMap{"bold": true}))
+	require.NoError(t, err)
+
+	require.NoError(t, doc.ApplyOperation(ot.NewBuilder().Retain(4).Insert(" text").Build()))
+	assert.Equal(t, "bold text", doc.String())
+	assert.Equal(t, []FormatRun{
+		{Start: 0, End: 4, Attributes: ot.AttributeMap{"bold": true}},
+		{Start: 4, End: 9},
+	}, doc.Runs())
+
+	assert.Error(t, doc.ApplyOperation(ot.NewBuilder().Retain(3).Build()))
+}
+
+func TestRichDocument_Errors(t *testing.T) {
+	_, err := NewRichDocumentFromDelta(ot.NewDelta().Retain(1, nil))
+	assert.Error(t, err)
+
+	doc := NewRichDocument(rope.New("abc"))
+	err = doc.ApplyDelta(ot.NewDelta().Retain(5, ot.AttributeMap{"bold": true}))
+	assert.ErrorIs(t, err, ot.ErrInvalidBaseLength)
+	assert.Equal(t, "abc", doc.String(), "document untouched on failure")
+}
+
+func TestRichDocument_RandomDeltas(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	// Removing attributes (nil values) only makes sense when retaining
+	attrs := []ot.AttributeMap{nil, {"bold": true}, {"italic": true}, {"link": "https://example.com"}, {"bold": nil}}
+	inserted := attrs[:len(attrs)-1]
+
+	base := ot.NewDelta().Insert("The quick brown fox jumps over the lazy dog", nil)
+	doc, err := NewRichDocumentFromDelta(base)
+	require.NoError(t, err)
+
+	for i := 0; i < 500; i++ {
+		length := doc.Length()
+		change := ot.NewDelta()
+		for pos := 0; pos < length; {
+			n := 1 + rng.Intn(length-pos)
+			switch rng.Intn(3) {
+			case 0:
+				change.Retain(n, attrs[rng.Intn(len(attrs))])
+			case 1:
+				change.Delete(n)
+			case 2:
+				change.Insert("ab", inserted[rng.Intn(len(inserted))])
+				continue
+			}
+			pos += n
+		}
+		if rng.Intn(2) == 0 {
+			change.Insert("xyz", inserted[rng.Intn(len(inserted))])
+		}
+
+		require.NoError(t, doc.ApplyDelta(change))
+		base = base.Compose(change)
+		require.True(t, base.Equals(doc.ToDelta()), "step %d: expected %s, got %s", i, base, doc.ToDelta())
+
+		runs := doc.Runs()
+		for j := 1; j < len(runs); j++ {
+			require.False(t, runs[j-1].Attributes.Equals(runs[j].Attributes), "step %d: adjacent runs %v", i, runs)
+		}
+	}
+}
+
+func TestRichDocument_ManyRuns(t *testing.T) {
+	const n = 10000
+	doc := NewRichDocument(rope.New(strings.Repeat("ab", n)))
+
+	// Bold every other character
+	format := ot.NewDelta()
+	for i := 0; i < n; i++ {
+		format.Retain(1, nil).Retain(1, ot.AttributeMap{"bold": true})
+	}
+	require.NoError(t, doc.ApplyDelta(format))
+	assert.Len(t, doc.Runs(), 2*n)
+	assert.Less(t, runDepth(doc.runs), 100, "tree should stay balanced")
+
+	// A small edit keeps the untouched subtrees
+	before := doc.runs
+	require.NoError(t, doc.ApplyDelta(ot.NewDelta().Retain(n, nil).Insert("!", nil)))
+	assert.Nil(t, doc.AttributesAt(n))
+	assert.Equal(t, ot.AttributeMap{"bold": true}, doc.AttributesAt(n+2))
+	assert.Equal(t, 2*n+1, doc.runs.len())
+	assert.Equal(t, 2*n, before.size(), "old tree is unchanged")
+	assert.True(t, sharesSubtree(doc.runs, before.left) || sharesSubtree(doc.runs, before.right))
+}
+
+func TestRichDocument_FailedDeltaKeepsRuns(t *testing.T) {
+	doc, err := NewRichDocumentFromDelta(ot.NewDelta().Insert("ab", ot.AttributeMap{"bold": true}).Insert("cd", nil))
+	require.NoError(t, err)
+	runs := doc.Runs()
+
+	assert.Error(t, doc.ApplyDelta(ot.NewDelta().Retain(1, ot.AttributeMap{"italic": true}).Delete(10)))
+	assert.Equal(t, runs, doc.Runs())
+}
+
+// runDepth returns the height of a run tree.
+func runDepth(n *runNode) int {
+	if n == nil {
+		return 0
+	}
+	l, r := runDepth(n.left), runDepth(n.right)
+	if l > r {
+		return l + 1
+	}
+	return r + 1
+}
+
+// sharesSubtree reports whether sub is a node of the tree n.
+func sharesSubtree(n, sub *runNode) bool {
+	if n == nil || sub == nil {
+		return false
+	}
+	return n == sub || sharesSubtree(n.left, sub) || sharesSubtree(n.right, sub)
+}
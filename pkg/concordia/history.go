@@ -2,6 +2,7 @@ package concordia
 
 import (
 	"sync"
+	"time"
 
 	"github.com/coreseekdev/texere/pkg/ot"
 	"github.com/coreseekdev/texere/pkg/rope"
@@ -14,21 +15,84 @@ type LamportTime int64
 
 // Revision represents a single revision in the undo/redo history tree.
 type Revision struct {
-	parent    int             // Index of parent revision (for undo)
-	lastChild int             // Index of last child revision (for redo)
-	operation *ot.Operation   // Forward operation (redo)
-	inversion *ot.Operation   // Inverted operation (undo)
-	lamport   LamportTime     // Lamport timestamp (logical clock)
+	parent    int           // Index of parent revision (for undo)
+	lastChild int           // Index of last child revision (for redo)
+	operation *ot.Operation // Forward operation (redo)
+	inversion *ot.Operation // Inverted operation (undo)
+	lamport   LamportTime   // Lamport timestamp (logical clock)
+	timestamp time.Time     // Wall-clock commit time
+	amends    *Revision     // First version of this revision, if edits were grouped into it
+	site      string        // Site that committed the revision
+	hlc       HLCTime       // Hybrid logical clock time of the commit
+	version   VersionVector // Revisions the site had seen, this one included
+}
+
+// Parent returns the index of the parent revision, or a negative value
+// for a root revision.
+func (r *Revision) Parent() int {
+	return r.parent
+}
+
+// LastChild returns the index of the most recently committed child
+// revision, or -1 if there is none.
+func (r *Revision) LastChild() int {
+	return r.lastChild
+}
+
+// Operation returns the forward (redo) operation.
+func (r *Revision) Operation() *ot.Operation {
+	return r.operation
+}
+
+// Inversion returns the inverted (undo) operation.
+func (r *Revision) Inversion() *ot.Operation {
+	return r.inversion
+}
+
+// Lamport returns the Lamport timestamp of the revision.
+func (r *Revision) Lamport() LamportTime {
+	return r.lamport
+}
+
+// Timestamp returns the wall-clock time the revision was committed.
+func (r *Revision) Timestamp() time.Time {
+	return r.timestamp
+}
+
+// Site returns the site that committed the revision.
+func (r *Revision) Site() string {
+	return r.site
+}
+
+// HLC returns the hybrid logical clock time of the revision.
+func (r *Revision) HLC() HLCTime {
+	return r.hlc
+}
+
+// Version returns the version vector of the revision. The returned
+// vector must not be modified.
+func (r *Revision) Version() VersionVector {
+	return r.version
+}
+
+// Stamp returns the site, HLC time and version vector of the revision,
+// for sending it to other sites.
+func (r *Revision) Stamp() RevisionStamp {
+	return RevisionStamp{Site: r.site, HLC: r.hlc, Version: r.version.Clone()}
 }
 
 // History manages a tree of document revisions for undo/redo.
 // Unlike a simple stack, this allows non-linear history (branching).
 type History struct {
 	mu        sync.RWMutex
-	revisions []*Revision // All revisions in chronological order
-	current   int         // Index of current revision
-	maxSize   int         // Maximum history size (0 = unlimited)
-	lamport   LamportTime // Current Lamport timestamp
+	revisions []*Revision     // All revisions in chronological order
+	current   int             // Index of current revision
+	maxSize   int             // Maximum history size (0 = unlimited)
+	lamport   LamportTime     // Current Lamport timestamp
+	grouper   *ot.UndoGrouper // Undo grouping (nil = one revision per commit)
+	site      string          // Site of local commits
+	clock     *HybridClock    // Hybrid logical clock of this site
+	version   VersionVector   // Revisions committed or received, per site
 }
 
 // NewHistory creates a new empty history.
@@ -37,6 +101,9 @@ func NewHistory() *History {
 		revisions: make([]*Revision, 0, 128),
 		current:   -1,
 		maxSize:   1000, // Default max revisions
+		site:      DefaultSite,
+		clock:     NewHybridClock(nil),
+		version:   make(VersionVector),
 	}
 }
 
@@ -57,8 +124,15 @@ func (h *History) MaxSize() int {
 }
 
 // CommitRevision adds a new revision to the history.
-// The revision becomes a child of the current revision.
+// The revision becomes a child of the current revision, unless the undo
+// group policy merges the edit into the current revision.
 func (h *History) CommitRevision(operation *ot.Operation, original *rope.Rope) {
+	h.CommitRevisionAt(operation, original, time.Now())
+}
+
+// CommitRevisionAt adds a new revision committed at the given time.
+// Used when replaying edits whose commit time is already known.
+func (h *History) CommitRevisionAt(operation *ot.Operation, original *rope.Rope, timestamp time.Time) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
@@ -72,14 +146,30 @@ func (h *History) CommitRevision(operation *ot.Operation, original *rope.Rope) {
 	// Create inversion for undo
 	inversion := operation.Invert(original.String())
 
-	revision := &Revision{
+	if h.grouper != nil && h.grouper.Next(ot.UndoEdit{Operation: operation, Time: timestamp}) {
+		if h.amendCurrent(operation, inversion, timestamp) {
+			return
+		}
+	}
+
+	h.version.Increment(h.site)
+	h.appendRevision(&Revision{
 		parent:    h.current,
 		lastChild: -1,
 		operation: operation,
 		inversion: inversion,
 		lamport:   h.lamport,
-	}
+		timestamp: timestamp,
+		site:      h.site,
+		hlc:       h.clock.Now(),
+		version:   h.version.Clone(),
+	})
+}
 
+// appendRevision adds a revision as a child of the current revision and
+// moves to it.
+// Caller must hold the write lock.
+func (h *History) appendRevision(revision *Revision) {
 	// Add to revisions
 	h.revisions = append(h.revisions, revision)
 	newIndex := len(h.revisions) - 1
@@ -143,6 +233,7 @@ func (h *History) Undo() *ot.Operation {
 
 	current := h.revisions[h.current]
 	h.current = current.parent
+	h.breakGroup()
 
 	result := current.inversion
 	h.mu.Unlock()
@@ -162,6 +253,7 @@ func (h *History) Redo() *ot.Operation {
 			return nil
 		}
 		h.current = 0
+		h.breakGroup()
 		result := h.revisions[0].operation
 		h.mu.Unlock()
 		return result
@@ -181,6 +273,7 @@ func (h *History) Redo() *ot.Operation {
 
 	nextIndex := current.lastChild
 	h.current = nextIndex
+	h.breakGroup()
 
 	result := h.revisions[nextIndex].operation
 	h.mu.Unlock()
@@ -258,6 +351,7 @@ func (h *History) Clear() {
 
 	h.revisions = make([]*Revision, 0, 128)
 	h.current = -1
+	h.breakGroup()
 }
 
 // prune removes old revisions if the history exceeds maxSize.
@@ -324,6 +418,7 @@ func (h *History) GotoRevision(index int) *ot.Operation {
 	// Simplified: Just return the operation from target
 	// In a real implementation, you'd compute the full path
 	h.current = index
+	h.breakGroup()
 
 	if index >= 0 {
 		return h.revisions[index].operation
@@ -375,6 +470,7 @@ func (h *History) Earlier(steps int) *ot.Operation {
 
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	h.breakGroup()
 
 	// Undo step by step
 	var result *ot.Operation = nil
@@ -418,6 +514,7 @@ func (h *History) Later(steps int) *ot.Operation {
 
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	h.breakGroup()
 
 	// Redo step by step
 	var result *ot.Operation = nil
@@ -554,12 +651,11 @@ func (h *History) buildOperationToRevision(targetIdx int) *ot.Operation {
 	}
 
 	// Compose all operations
-	// First apply undo path in reverse, then redo path
+	// First apply undo path (current revision first), then redo path
 	var composed *ot.Operation = nil
 
 	// Compose undo path
-	for i := len(undoPath) - 1; i >= 0; i-- {
-		op := undoPath[i]
+	for _, op := range undoPath {
 		if composed == nil {
 			composed = op
 		} else {
@@ -579,6 +675,7 @@ func (h *History) buildOperationToRevision(targetIdx int) *ot.Operation {
 	// Move to target
 	oldCurrent := h.current
 	h.current = targetIdx
+	h.breakGroup()
 
 	if composed != nil {
 		return composed
@@ -707,6 +804,9 @@ func (h *History) ToRoot() *History {
 		current:   -1,
 		maxSize:   h.maxSize,
 		lamport:   h.lamport,
+		site:      h.site,
+		clock:     h.clock,
+		version:   h.version.Clone(),
 	}
 }
 
@@ -725,6 +825,9 @@ func (h *History) ToTip() *History {
 		current:   tipIdx,
 		maxSize:   h.maxSize,
 		lamport:   h.lamport,
+		site:      h.site,
+		clock:     h.clock,
+		version:   h.version.Clone(),
 	}
 }
 
@@ -742,6 +845,10 @@ func (h *History) Clone() *History {
 			operation: rev.operation,
 			inversion: rev.inversion,
 			lamport:   rev.lamport,
+			timestamp: rev.timestamp,
+			site:      rev.site,
+			hlc:       rev.hlc,
+			version:   rev.version,
 		}
 	}
 
@@ -750,5 +857,118 @@ func (h *History) Clone() *History {
 		current:   h.current,
 		maxSize:   h.maxSize,
 		lamport:   h.lamport,
+		site:      h.site,
+		clock:     h.clock,
+		version:   h.version.Clone(),
+	}
+}
+
+// ========== Wall-Clock Navigation ==========
+
+// RevisionAt returns the index of the revision that was current at time t:
+// the last revision committed at or before t, on any branch.
+// Returns -1 (the root) if t is before the first revision.
+func (h *History) RevisionAt(t time.Time) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.revisionAt(t)
+}
+
+// revisionAt implements RevisionAt. Caller must hold the lock.
+func (h *History) revisionAt(t time.Time) int {
+	for i := len(h.revisions) - 1; i >= 0; i-- {
+		if !h.revisions[i].timestamp.After(t) {
+			return i
+		}
 	}
+	return -1
+}
+
+// EarlierBy moves back in history, like Vim's :earlier.
+//
+// A step request undoes that many revisions along the current branch.
+// A time request jumps to the state the document was in the given
+// duration before the current revision was committed, which may be on a
+// different branch.
+//
+// Returns the composed operation that transforms the current document
+// into the target state, or nil if there is nothing to undo.
+func (h *History) EarlierBy(req *rope.UndoRequest) *ot.Operation {
+	if req == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.current < 0 {
+		return nil
+	}
+
+	target := h.current
+	switch req.Kind {
+	case rope.UndoSteps:
+		for i := 0; i < req.Steps && target >= 0; i++ {
+			target = h.revisions[target].parent
+		}
+	case rope.UndoTimePeriod:
+		target = h.revisionAt(h.revisions[h.current].timestamp.Add(-req.Duration))
+		if target > h.current {
+			target = h.current
+		}
+	}
+	if target < -1 {
+		target = -1
+	}
+
+	return h.buildOperationToRevision(target)
+}
+
+// LaterBy moves forward in history, like Vim's :later.
+//
+// A step request redoes that many revisions along the last-child links.
+// A time request jumps to the state the document was in the given
+// duration after the current revision was committed (or after the first
+// revision, at the root), which may be on a different branch.
+//
+// Returns the composed operation that transforms the current document
+// into the target state, or nil if there is nothing to redo.
+func (h *History) LaterBy(req *rope.UndoRequest) *ot.Operation {
+	if req == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.revisions) == 0 {
+		return nil
+	}
+
+	target := h.current
+	switch req.Kind {
+	case rope.UndoSteps:
+		for i := 0; i < req.Steps; i++ {
+			if target < 0 {
+				target = 0
+				continue
+			}
+			next := h.revisions[target].lastChild
+			if next < 0 {
+				break
+			}
+			target = next
+		}
+	case rope.UndoTimePeriod:
+		from := h.revisions[0].timestamp
+		if h.current >= 0 {
+			from = h.revisions[h.current].timestamp
+		}
+		target = h.revisionAt(from.Add(req.Duration))
+		if target < h.current {
+			target = h.current
+		}
+	}
+
+	return h.buildOperationToRevision(target)
 }
@@ -0,0 +1,236 @@
+package concordia
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/rope"
+)
+
+// ========== Multi-Site History ==========
+
+// DefaultSite is the site of a new History, and of revisions loaded from
+// histories written before sites were recorded.
+const DefaultSite = "local"
+
+// ErrCausalOrder is returned when a remote revision depends on revisions
+// the history has not received yet.
+var ErrCausalOrder = errors.New("revision received out of causal order")
+
+// RevisionStamp identifies a revision across sites: the site that
+// committed it, its HLC time and its version vector.
+type RevisionStamp struct {
+	Site    string        `json:"site"`
+	HLC     HLCTime       `json:"hlc"`
+	Version VersionVector `json:"version"`
+}
+
+// SetSite sets the site of revisions committed locally from now on.
+// Every replica editing the same document needs its own site.
+func (h *History) SetSite(site string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.site = site
+	h.breakGroup()
+}
+
+// Site returns the site of revisions committed locally.
+func (h *History) Site() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.site
+}
+
+// Clock returns the hybrid logical clock that stamps local revisions.
+func (h *History) Clock() *HybridClock {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.clock
+}
+
+// SetClock replaces the hybrid logical clock, e.g. with one reading a
+// fake time in tests.
+func (h *History) SetClock(clock *HybridClock) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	clock.observe(h.clock.Last())
+	h.clock = clock
+}
+
+// Version returns the version vector of the history: the revisions of
+// every site it has committed or received.
+func (h *History) Version() VersionVector {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.version.Clone()
+}
+
+// CommitRemoteRevision adds a revision committed by another site.
+// The operation must already be transformed to apply to the current
+// document, like the operation of CommitRevision.
+//
+// Revisions of each site must be received in causal order: a revision
+// whose version vector counts revisions the history has not seen
+// returns ErrCausalOrder. Revisions already received are ignored.
+//
+// Example:
+//
+//	stamp := remoteRevision.Stamp() // sent along with the operation
+//	err := history.CommitRemoteRevision(transformed, doc, stamp)
+func (h *History) CommitRemoteRevision(operation *ot.Operation, original *rope.Rope, stamp RevisionStamp) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if stamp.Site == "" || stamp.Site == h.site {
+		return fmt.Errorf("%w: revision from site %q", ErrCausalOrder, stamp.Site)
+	}
+	seq := stamp.Version[stamp.Site]
+	if seq <= h.version[stamp.Site] {
+		return nil
+	}
+	if seq != h.version[stamp.Site]+1 {
+		return fmt.Errorf("%w: %s:%d after %s:%d", ErrCausalOrder, stamp.Site, seq, stamp.Site, h.version[stamp.Site])
+	}
+	for site, n := range stamp.Version {
+		if site != stamp.Site && n > h.version[site] {
+			return fmt.Errorf("%w: %s:%d depends on %s:%d", ErrCausalOrder, stamp.Site, seq, site, n)
+		}
+	}
+	if _, err := h.clock.Update(stamp.HLC); err != nil {
+		return err
+	}
+
+	h.version.Merge(stamp.Version)
+	h.lamport++
+	h.breakGroup()
+	if operation == nil || operation.IsNoop() {
+		return nil
+	}
+
+	h.appendRevision(&Revision{
+		parent:    h.current,
+		lastChild: -1,
+		operation: operation,
+		inversion: operation.Invert(original.String()),
+		lamport:   h.lamport,
+		timestamp: stampTime(stamp.HLC),
+		site:      stamp.Site,
+		hlc:       stamp.HLC,
+		version:   stamp.Version.Clone(),
+	})
+	return nil
+}
+
+// RevisionCausality returns the causal relation of revision a to
+// revision b.
+func (h *History) RevisionCausality(a, b int) Causality {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if a < 0 || a >= len(h.revisions) || b < 0 || b >= len(h.revisions) {
+		return CausalConcurrent
+	}
+	return h.revisions[a].version.Compare(h.revisions[b].version)
+}
+
+// HappenedBefore returns true if revision b had seen revision a when it
+// was committed.
+func (h *History) HappenedBefore(a, b int) bool {
+	return h.RevisionCausality(a, b) == CausalBefore
+}
+
+// Frontier returns the causal frontier: the indices of the revisions no
+// other revision has seen, in chronological order. A single index means
+// the history is linear at the tip; several indices are concurrent heads
+// a merge has to combine.
+func (h *History) Frontier() []int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	// Only the newest revision of each site can be a head
+	latest := make(map[string]int)
+	for i, rev := range h.revisions {
+		latest[rev.site] = i
+	}
+
+	var frontier []int
+	for i, rev := range h.revisions {
+		if latest[rev.site] != i {
+			continue
+		}
+		head := true
+		for _, j := range latest {
+			if j != i && h.revisions[j].version.Compare(rev.version) == CausalAfter {
+				head = false
+				break
+			}
+		}
+		if head {
+			frontier = append(frontier, i)
+		}
+	}
+	return frontier
+}
+
+// MissedBy returns the indices of the revisions a site with version
+// vector seen has not seen, in chronological order. Pruned revisions
+// are not included.
+func (h *History) MissedBy(seen VersionVector) []int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var missed []int
+	for i, rev := range h.revisions {
+		if rev.version[rev.site] > seen[rev.site] {
+			missed = append(missed, i)
+		}
+	}
+	return missed
+}
+
+// ConcurrentWith returns the indices of the revisions concurrent with
+// the revision at index: those that neither had seen it nor were seen by
+// it.
+func (h *History) ConcurrentWith(index int) []int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if index < 0 || index >= len(h.revisions) {
+		return nil
+	}
+	version := h.revisions[index].version
+
+	var concurrent []int
+	for i, rev := range h.revisions {
+		if i != index && rev.version.Compare(version) == CausalConcurrent {
+			concurrent = append(concurrent, i)
+		}
+	}
+	return concurrent
+}
+
+// RevisionsSince returns the indices of the revisions committed after
+// the HLC time t, in chronological order.
+func (h *History) RevisionsSince(t HLCTime) []int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var since []int
+	for i, rev := range h.revisions {
+		if t.Before(rev.hlc) {
+			since = append(since, i)
+		}
+	}
+	return since
+}
+
+// stampTime returns the wall-clock time of an HLC time, for revisions
+// that have no commit time.
+func stampTime(t HLCTime) time.Time {
+	if t.IsZero() {
+		return time.Time{}
+	}
+	return t.Time()
+}
@@ -0,0 +1,180 @@
+package concordia
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// siteEditor returns an editor whose history commits as site.
+func siteEditor(t *testing.T, site, text string) *historyEditor {
+	e := newHistoryEditor(t, text)
+	e.history.SetSite(site)
+	return e
+}
+
+// receive commits a revision of another site, transformed against the
+// local operations it has not seen.
+func (e *historyEditor) receive(op *ot.Operation, stamp RevisionStamp, concurrent ...*ot.Operation) {
+	for _, local := range concurrent {
+		var err error
+		op, _, err = ot.Transform(op, local)
+		require.NoError(e.t, err)
+	}
+	next, err := ApplyOperation(e.doc, op)
+	require.NoError(e.t, err)
+	require.NoError(e.t, e.history.CommitRemoteRevision(op, e.doc, stamp))
+	e.doc = next
+}
+
+// last returns the operation and stamp of the newest revision.
+func (e *historyEditor) last() (*ot.Operation, RevisionStamp) {
+	rev := e.history.GetRevision(e.history.RevisionCount() - 1)
+	return rev.Operation(), rev.Stamp()
+}
+
+// concurrentSites builds two sites that both saw alice's "Hello" and
+// then edited concurrently: alice appended "!", bob prepended ">".
+// Alice has received bob's edit; bob has not received alice's.
+func concurrentSites(t *testing.T) (alice, bob *historyEditor) {
+	alice, bob = siteEditor(t, "alice", ""), siteEditor(t, "bob", "")
+	alice.insert(0, "Hello")
+	bob.receive(alice.last())
+
+	alice.insert(5, "!")
+	aliceOp, _ := alice.last()
+	bob.insert(0, ">")
+	bobOp, bobStamp := bob.last()
+	alice.receive(bobOp, bobStamp, aliceOp)
+	return alice, bob
+}
+
+func TestHistory_LocalStamps(t *testing.T) {
+	e := siteEditor(t, "alice", "")
+	e.insert(0, "a")
+	e.insert(1, "b")
+
+	first, second := e.history.GetRevision(0), e.history.GetRevision(1)
+	assert.Equal(t, "alice", first.Site())
+	assert.Equal(t, VersionVector{"alice": 1}, first.Version())
+	assert.Equal(t, VersionVector{"alice": 2}, second.Version())
+	assert.True(t, first.HLC().Before(second.HLC()))
+	assert.True(t, e.history.HappenedBefore(0, 1))
+	assert.Equal(t, []int{1}, e.history.Frontier())
+	assert.Equal(t, VersionVector{"alice": 2}, e.history.Version())
+}
+
+func TestHistory_CommitRemoteRevision(t *testing.T) {
+	alice, bob := concurrentSites(t)
+	assert.Equal(t, ">Hello!", alice.doc.String())
+	assert.Equal(t, VersionVector{"alice": 2, "bob": 1}, alice.history.Version())
+	assert.Equal(t, VersionVector{"alice": 1, "bob": 1}, bob.history.Version())
+
+	// The remote revision is ordered after what alice had seen of it
+	remote := alice.history.GetRevision(2)
+	assert.Equal(t, "bob", remote.Site())
+	assert.True(t, alice.history.GetRevision(1).HLC().Before(alice.history.Clock().Last()))
+
+	// Bob's edit and alice's "!" are concurrent; both follow "Hello"
+	assert.Equal(t, CausalConcurrent, alice.history.RevisionCausality(1, 2))
+	assert.True(t, alice.history.HappenedBefore(0, 2))
+	assert.Equal(t, []int{2}, alice.history.ConcurrentWith(1))
+	assert.Equal(t, []int{1, 2}, alice.history.Frontier())
+
+	// A local edit after the merge sees both heads
+	alice.insert(0, "#")
+	assert.Equal(t, []int{3}, alice.history.Frontier())
+	assert.Equal(t, VersionVector{"alice": 3, "bob": 1}, alice.history.GetRevision(3).Version())
+}
+
+func TestHistory_MissedBy(t *testing.T) {
+	alice, bob := concurrentSites(t)
+
+	missed := alice.history.MissedBy(bob.history.Version())
+	assert.Equal(t, []int{1}, missed, "bob has not seen alice's \"!\"")
+	assert.Empty(t, alice.history.MissedBy(alice.history.Version()))
+	assert.Equal(t, []int{0, 1, 2}, alice.history.MissedBy(nil))
+
+	// Catching bob up from MissedBy converges both sites
+	for _, i := range missed {
+		rev := alice.history.GetRevision(i)
+		bobOp, _ := bob.last()
+		bob.receive(rev.Operation(), rev.Stamp(), bobOp)
+	}
+	assert.Equal(t, alice.doc.String(), bob.doc.String())
+	assert.Equal(t, alice.history.Version(), bob.history.Version())
+}
+
+func TestHistory_RemoteCausalOrder(t *testing.T) {
+	alice, bob := siteEditor(t, "alice", ""), siteEditor(t, "bob", "")
+	alice.insert(0, "a")
+	first, firstStamp := alice.last()
+	alice.insert(1, "b")
+	second, secondStamp := alice.last()
+
+	// Alice's second revision depends on her first
+	err := bob.history.CommitRemoteRevision(second, bob.doc, secondStamp)
+	assert.ErrorIs(t, err, ErrCausalOrder)
+	assert.Equal(t, 0, bob.history.RevisionCount())
+
+	bob.receive(first, firstStamp)
+	bob.receive(second, secondStamp)
+	assert.Equal(t, "ab", bob.doc.String())
+
+	// Duplicates are ignored, and a site can't receive its own revisions
+	require.NoError(t, bob.history.CommitRemoteRevision(second, bob.doc, secondStamp))
+	assert.Equal(t, 2, bob.history.RevisionCount())
+	err = alice.history.CommitRemoteRevision(second, alice.doc, secondStamp)
+	assert.ErrorIs(t, err, ErrCausalOrder)
+}
+
+func TestHistory_GroupingKeepsVersion(t *testing.T) {
+	e := siteEditor(t, "alice", "")
+	e.history.BeginGroup()
+	e.insert(0, "a")
+	e.insert(1, "b")
+	e.history.EndGroup()
+
+	require.Equal(t, 1, e.history.RevisionCount())
+	assert.Equal(t, VersionVector{"alice": 1}, e.history.GetRevision(0).Version())
+	assert.Equal(t, VersionVector{"alice": 1}, e.history.Version())
+}
+
+func TestHistory_CausalRoundTrip(t *testing.T) {
+	alice, _ := concurrentSites(t)
+
+	data, err := json.Marshal(alice.history)
+	require.NoError(t, err)
+	fromJSON := NewHistory()
+	require.NoError(t, json.Unmarshal(data, fromJSON))
+	assertSameHistory(t, alice.history, fromJSON)
+
+	data, err = alice.history.MarshalBinary()
+	require.NoError(t, err)
+	fromBinary, err := LoadHistory(bytes.NewReader(data), alice.doc)
+	require.NoError(t, err)
+	assertSameHistory(t, alice.history, fromBinary)
+	assert.Equal(t, []int{1, 2}, fromBinary.Frontier())
+
+	// The restored clock does not go back in time
+	assert.True(t, alice.history.Clock().Last().Before(fromBinary.Clock().Now()))
+}
+
+func TestHistory_MigrateUnstampedRevisions(t *testing.T) {
+	v2 := `{"version": 2, "current": 1, "lamport": 2, "max_size": 10, "revisions": [
+		{"parent": -1, "last_child": 1, "lamport": 1, "timestamp": 1000, "operation": ["a"], "inversion": [-1]},
+		{"parent": 0, "last_child": -1, "lamport": 2, "timestamp": 2000, "operation": [1, "b"], "inversion": [1, -1]}
+	]}`
+
+	h := NewHistory()
+	require.NoError(t, json.Unmarshal([]byte(v2), h))
+	assert.Equal(t, DefaultSite, h.Site())
+	assert.Equal(t, VersionVector{DefaultSite: 2}, h.Version())
+	assert.Equal(t, VersionVector{DefaultSite: 1}, h.GetRevision(0).Version())
+	assert.Equal(t, HLCTime{Wall: 2000}, h.GetRevision(1).HLC())
+	assert.Equal(t, []int{1}, h.Frontier())
+}
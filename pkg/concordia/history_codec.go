@@ -0,0 +1,835 @@
+package concordia
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/rope"
+)
+
+// ========== History Serialization ==========
+
+// HistoryFormatVersion is the version of the History encodings written
+// by this package. Decoders reject data with a newer version.
+//
+// Version 2 added amend records for grouped edits. Version 3 added stamp
+// and clock records with sites, HLC times and version vectors.
+const HistoryFormatVersion = 3
+
+// historyMagic starts every binary history stream.
+var historyMagic = []byte("TXHL")
+
+// Binary record tags.
+const (
+	recordRevision byte = 'R' // A committed revision
+	recordState    byte = 'S' // Revision count, current index and clocks
+	recordAmend    byte = 'A' // Replaces the newest revision after grouping
+	recordStamp    byte = 'T' // Site, HLC time and version vector of the newest revision
+	recordClock    byte = 'C' // Site, HLC time and version vector of the history
+)
+
+// Operation component tags in the binary encoding.
+const (
+	componentRetain byte = iota
+	componentInsert
+	componentDelete
+)
+
+var (
+	// ErrInvalidHistory is returned when encoded history data is malformed
+	// or its revision tree is inconsistent.
+	ErrInvalidHistory = errors.New("invalid history data")
+
+	// ErrHistoryVersion is returned when encoded history data was written
+	// by a newer, unsupported format version.
+	ErrHistoryVersion = errors.New("unsupported history format version")
+
+	// ErrHistoryMismatch is returned when a history does not belong to the
+	// document it is validated against.
+	ErrHistoryMismatch = errors.New("history does not match document")
+)
+
+// ---------- JSON ----------
+
+// historyJSON is the JSON encoding of a History.
+type historyJSON struct {
+	Version   int            `json:"version"`
+	Current   int            `json:"current"`
+	Lamport   LamportTime    `json:"lamport"`
+	MaxSize   int            `json:"max_size"`
+	Site      string         `json:"site,omitempty"`
+	Clock     *HLCTime       `json:"clock,omitempty"`
+	Vector    VersionVector  `json:"version_vector,omitempty"`
+	Revisions []revisionJSON `json:"revisions"`
+}
+
+// revisionJSON is the JSON encoding of a Revision.
+// Operations use the ot.js array format: [5, "Hello", -3].
+type revisionJSON struct {
+	Parent    int           `json:"parent"`
+	LastChild int           `json:"last_child"`
+	Lamport   LamportTime   `json:"lamport"`
+	Timestamp int64         `json:"timestamp,omitempty"` // Unix nanoseconds
+	Operation []interface{} `json:"operation"`
+	Inversion []interface{} `json:"inversion"`
+	Site      string        `json:"site,omitempty"`
+	HLC       *HLCTime      `json:"hlc,omitempty"`
+	Vector    VersionVector `json:"version_vector,omitempty"`
+}
+
+// historyClocks holds the causality state of a history being decoded.
+type historyClocks struct {
+	site    string
+	hlc     HLCTime
+	version VersionVector
+}
+
+// MarshalJSON encodes the complete revision tree as versioned JSON.
+func (h *History) MarshalJSON() ([]byte, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	clock := h.clock.Last()
+	data := historyJSON{
+		Version:   HistoryFormatVersion,
+		Current:   h.current,
+		Lamport:   h.lamport,
+		MaxSize:   h.maxSize,
+		Site:      h.site,
+		Clock:     &clock,
+		Vector:    h.version,
+		Revisions: make([]revisionJSON, len(h.revisions)),
+	}
+	for i, rev := range h.revisions {
+		hlc := rev.hlc
+		data.Revisions[i] = revisionJSON{
+			Parent:    rev.parent,
+			LastChild: rev.lastChild,
+			Lamport:   rev.lamport,
+			Timestamp: unixNano(rev.timestamp),
+			Operation: rev.operation.ToJSON(),
+			Inversion: rev.inversion.ToJSON(),
+			Site:      rev.site,
+			HLC:       &hlc,
+			Vector:    rev.version,
+		}
+	}
+	return json.Marshal(data)
+}
+
+// UnmarshalJSON decodes a revision tree written by MarshalJSON and
+// replaces the contents of the history.
+//
+// The tree structure is checked; use Validate to check it against the
+// document as well.
+func (h *History) UnmarshalJSON(data []byte) error {
+	var decoded historyJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidHistory, err)
+	}
+	if decoded.Version > HistoryFormatVersion {
+		return fmt.Errorf("%w: %d", ErrHistoryVersion, decoded.Version)
+	}
+
+	revisions := make([]*Revision, len(decoded.Revisions))
+	for i, r := range decoded.Revisions {
+		operation, err := operationFromJSON(r.Operation)
+		if err != nil {
+			return fmt.Errorf("%w: revision %d: %v", ErrInvalidHistory, i, err)
+		}
+		inversion, err := operationFromJSON(r.Inversion)
+		if err != nil {
+			return fmt.Errorf("%w: revision %d: %v", ErrInvalidHistory, i, err)
+		}
+		revisions[i] = &Revision{
+			parent:    r.Parent,
+			lastChild: r.LastChild,
+			operation: operation,
+			inversion: inversion,
+			lamport:   r.Lamport,
+			timestamp: fromUnixNano(r.Timestamp),
+			site:      r.Site,
+			version:   r.Vector,
+		}
+		if r.HLC != nil {
+			revisions[i].hlc = *r.HLC
+		}
+	}
+
+	var clocks *historyClocks
+	if decoded.Clock != nil {
+		clocks = &historyClocks{site: decoded.Site, hlc: *decoded.Clock, version: decoded.Vector}
+	}
+	return h.restore(revisions, decoded.Current, decoded.Lamport, decoded.MaxSize, clocks)
+}
+
+// operationFromJSON decodes an ot.js array, accepting the float64
+// numbers produced by encoding/json.
+func operationFromJSON(ops []interface{}) (*ot.Operation, error) {
+	converted := make([]interface{}, len(ops))
+	for i, op := range ops {
+		if f, ok := op.(float64); ok {
+			converted[i] = int(f)
+		} else {
+			converted[i] = op
+		}
+	}
+	return ot.FromJSON(converted)
+}
+
+// ---------- Binary ----------
+
+// MarshalBinary encodes the complete revision tree in the binary history
+// format, the same format HistoryWriter appends to.
+//
+// Layout: the magic "TXHL" and a version byte, followed by a revision
+// and a stamp record per revision and final clock and state records.
+// Stamp and clock records are separate so that a HistoryWriter can append
+// them to streams written by version 2. Parent links are stored
+// relative to the revision, so records stay valid when old revisions are
+// pruned; last-child links are rebuilt while decoding.
+func (h *History) MarshalBinary() ([]byte, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	buf := appendHistoryHeader(nil)
+	for i, rev := range h.revisions {
+		buf = appendRevisionRecord(buf, i, rev)
+	}
+	buf = appendStateRecord(buf, h)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a binary history stream and replaces the
+// contents of the history. The stream may contain records appended by
+// a HistoryWriter after the initial snapshot.
+//
+// The tree structure is checked; use Validate to check it against the
+// document as well.
+func (h *History) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+
+	magic := make([]byte, len(historyMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, historyMagic) {
+		return fmt.Errorf("%w: bad magic", ErrInvalidHistory)
+	}
+	version, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("%w: missing version", ErrInvalidHistory)
+	}
+	if version > HistoryFormatVersion {
+		return fmt.Errorf("%w: %d", ErrHistoryVersion, version)
+	}
+
+	var revisions []*Revision
+	var clocks *historyClocks
+	current, lamport, maxSize := -1, LamportTime(0), 0
+	hasState := false
+
+	for r.Len() > 0 {
+		tag, _ := r.ReadByte()
+		switch tag {
+		case recordRevision:
+			rev, err := readRevisionRecord(r, len(revisions))
+			if err != nil {
+				return err
+			}
+			index := len(revisions)
+			if rev.parent >= 0 {
+				revisions[rev.parent].lastChild = index
+			}
+			revisions = append(revisions, rev)
+
+		case recordAmend:
+			if len(revisions) == 0 {
+				return fmt.Errorf("%w: amend record without a revision", ErrInvalidHistory)
+			}
+			index := len(revisions) - 1
+			rev, err := readRevisionRecord(r, index)
+			if err != nil {
+				return err
+			}
+			if rev.parent != revisions[index].parent {
+				return fmt.Errorf("%w: amend record changes parent of revision %d", ErrInvalidHistory, index)
+			}
+			revisions[index] = rev
+
+		case recordStamp:
+			if len(revisions) == 0 {
+				return fmt.Errorf("%w: stamp record without a revision", ErrInvalidHistory)
+			}
+			stamp, err := readClocks(r)
+			if err != nil {
+				return err
+			}
+			rev := revisions[len(revisions)-1]
+			rev.site, rev.hlc, rev.version = stamp.site, stamp.hlc, stamp.version
+
+		case recordClock:
+			if clocks, err = readClocks(r); err != nil {
+				return err
+			}
+
+		case recordState:
+			count, offset, clock, size, err := readStateRecord(r)
+			if err != nil {
+				return err
+			}
+			if count > len(revisions) {
+				return fmt.Errorf("%w: state references %d revisions, have %d", ErrInvalidHistory, count, len(revisions))
+			}
+			if offset > count {
+				return fmt.Errorf("%w: current revision out of range", ErrInvalidHistory)
+			}
+			revisions = trimRevisions(revisions, len(revisions)-count)
+			current = -1
+			if offset > 0 {
+				current = count - offset
+			}
+			lamport, maxSize = clock, size
+			hasState = true
+
+		default:
+			return fmt.Errorf("%w: unknown record %q", ErrInvalidHistory, tag)
+		}
+	}
+
+	if !hasState {
+		return fmt.Errorf("%w: missing state record", ErrInvalidHistory)
+	}
+	return h.restore(revisions, current, lamport, maxSize, clocks)
+}
+
+// appendHistoryHeader appends the magic and version.
+func appendHistoryHeader(buf []byte) []byte {
+	buf = append(buf, historyMagic...)
+	return append(buf, HistoryFormatVersion)
+}
+
+// appendRevisionRecord appends the revision at index and its stamp.
+// A pruned (negative) parent is written as a root.
+func appendRevisionRecord(buf []byte, index int, rev *Revision) []byte {
+	buf = append(buf, recordRevision)
+	parent := uint64(0)
+	if rev.parent >= 0 {
+		parent = uint64(index - rev.parent)
+	}
+	buf = binary.AppendUvarint(buf, parent)
+	buf = binary.AppendVarint(buf, int64(rev.lamport))
+	buf = binary.AppendVarint(buf, unixNano(rev.timestamp))
+	buf = appendOperation(buf, rev.operation)
+	buf = appendOperation(buf, rev.inversion)
+
+	buf = append(buf, recordStamp)
+	return appendClocks(buf, rev.site, rev.hlc, rev.version)
+}
+
+// appendAmendRecord appends a record replacing the revision at index,
+// which must be the newest revision written.
+func appendAmendRecord(buf []byte, index int, rev *Revision) []byte {
+	start := len(buf)
+	buf = appendRevisionRecord(buf, index, rev)
+	buf[start] = recordAmend
+	return buf
+}
+
+// appendStateRecord appends the clock record, then the revision count,
+// current revision and clocks. The current revision is stored as its
+// distance from the end (0 = root) so it is independent of pruning.
+func appendStateRecord(buf []byte, h *History) []byte {
+	buf = append(buf, recordClock)
+	buf = appendClocks(buf, h.site, h.clock.Last(), h.version)
+
+	buf = append(buf, recordState)
+	count := len(h.revisions)
+	offset := 0
+	if h.current >= 0 {
+		offset = count - h.current
+	}
+	buf = binary.AppendUvarint(buf, uint64(count))
+	buf = binary.AppendUvarint(buf, uint64(offset))
+	buf = binary.AppendVarint(buf, int64(h.lamport))
+	return binary.AppendVarint(buf, int64(h.maxSize))
+}
+
+// appendClocks appends a site, an HLC time and a version vector sorted
+// by site.
+func appendClocks(buf []byte, site string, hlc HLCTime, version VersionVector) []byte {
+	buf = appendString(buf, site)
+	buf = binary.AppendVarint(buf, hlc.Wall)
+	buf = binary.AppendUvarint(buf, uint64(hlc.Logical))
+
+	sites := make([]string, 0, len(version))
+	for s := range version {
+		sites = append(sites, s)
+	}
+	sort.Strings(sites)
+	buf = binary.AppendUvarint(buf, uint64(len(sites)))
+	for _, s := range sites {
+		buf = appendString(buf, s)
+		buf = binary.AppendUvarint(buf, version[s])
+	}
+	return buf
+}
+
+// appendString appends a length-prefixed string.
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// appendOperation appends an operation as a component count followed by
+// tagged components.
+func appendOperation(buf []byte, op *ot.Operation) []byte {
+	ops := op.ToJSON()
+	buf = binary.AppendUvarint(buf, uint64(len(ops)))
+	for _, c := range ops {
+		switch v := c.(type) {
+		case int:
+			if v > 0 {
+				buf = append(buf, componentRetain)
+				buf = binary.AppendUvarint(buf, uint64(v))
+			} else {
+				buf = append(buf, componentDelete)
+				buf = binary.AppendUvarint(buf, uint64(-v))
+			}
+		case string:
+			buf = append(buf, componentInsert)
+			buf = binary.AppendUvarint(buf, uint64(len(v)))
+			buf = append(buf, v...)
+		}
+	}
+	return buf
+}
+
+// readRevisionRecord reads a revision record for the revision at index.
+func readRevisionRecord(r *bytes.Reader, index int) (*Revision, error) {
+	distance, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	if distance > uint64(index) {
+		return nil, fmt.Errorf("%w: revision %d has parent before the first revision", ErrInvalidHistory, index)
+	}
+	lamport, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	timestamp, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	operation, err := readOperation(r)
+	if err != nil {
+		return nil, err
+	}
+	inversion, err := readOperation(r)
+	if err != nil {
+		return nil, err
+	}
+
+	parent := -1
+	if distance > 0 {
+		parent = index - int(distance)
+	}
+	return &Revision{
+		parent:    parent,
+		lastChild: -1,
+		operation: operation,
+		inversion: inversion,
+		lamport:   LamportTime(lamport),
+		timestamp: fromUnixNano(timestamp),
+	}, nil
+}
+
+// readStateRecord reads a state record.
+func readStateRecord(r *bytes.Reader) (count, offset int, lamport LamportTime, maxSize int, err error) {
+	var values [2]uint64
+	for i := range values {
+		if values[i], err = binary.ReadUvarint(r); err != nil {
+			return 0, 0, 0, 0, truncated(err)
+		}
+	}
+	clock, err := binary.ReadVarint(r)
+	if err != nil {
+		return 0, 0, 0, 0, truncated(err)
+	}
+	size, err := binary.ReadVarint(r)
+	if err != nil {
+		return 0, 0, 0, 0, truncated(err)
+	}
+	return int(values[0]), int(values[1]), LamportTime(clock), int(size), nil
+}
+
+// readClocks reads the fields written by appendClocks.
+func readClocks(r *bytes.Reader) (*historyClocks, error) {
+	site, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+	wall, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	logical, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	if n > uint64(r.Len()) {
+		return nil, fmt.Errorf("%w: version vector length %d exceeds data", ErrInvalidHistory, n)
+	}
+
+	version := make(VersionVector, n)
+	for i := uint64(0); i < n; i++ {
+		s, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		if version[s], err = binary.ReadUvarint(r); err != nil {
+			return nil, truncated(err)
+		}
+	}
+	return &historyClocks{
+		site:    site,
+		hlc:     HLCTime{Wall: wall, Logical: uint32(logical)},
+		version: version,
+	}, nil
+}
+
+// readString reads a string written by appendString.
+func readString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", truncated(err)
+	}
+	if n > uint64(r.Len()) {
+		return "", truncated(io.ErrUnexpectedEOF)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", truncated(err)
+	}
+	return string(b), nil
+}
+
+// readOperation reads an operation written by appendOperation.
+func readOperation(r *bytes.Reader) (*ot.Operation, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	if n > uint64(r.Len()) {
+		return nil, fmt.Errorf("%w: operation length %d exceeds data", ErrInvalidHistory, n)
+	}
+
+	builder := ot.NewBuilder()
+	for i := uint64(0); i < n; i++ {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return nil, truncated(err)
+		}
+		value, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, truncated(err)
+		}
+		switch tag {
+		case componentRetain:
+			builder.Retain(int(value))
+		case componentDelete:
+			builder.Delete(int(value))
+		case componentInsert:
+			if value > uint64(r.Len()) {
+				return nil, truncated(io.ErrUnexpectedEOF)
+			}
+			text := make([]byte, value)
+			if _, err := io.ReadFull(r, text); err != nil {
+				return nil, truncated(err)
+			}
+			builder.Insert(string(text))
+		default:
+			return nil, fmt.Errorf("%w: unknown component %d", ErrInvalidHistory, tag)
+		}
+	}
+	return builder.Build(), nil
+}
+
+// unixNano returns t in Unix nanoseconds, or 0 for the zero time.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano is the inverse of unixNano.
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// truncated wraps a read error as invalid history data.
+func truncated(err error) error {
+	return fmt.Errorf("%w: truncated record: %v", ErrInvalidHistory, err)
+}
+
+// trimRevisions drops the n oldest revisions and shifts the links of the
+// remaining ones, like History.prune.
+func trimRevisions(revisions []*Revision, n int) []*Revision {
+	if n <= 0 {
+		return revisions
+	}
+	revisions = revisions[n:]
+	for _, rev := range revisions {
+		if rev.parent >= 0 {
+			rev.parent -= n
+			if rev.parent < 0 {
+				rev.parent = -1
+			}
+		}
+		if rev.lastChild >= 0 {
+			rev.lastChild -= n
+		}
+	}
+	return revisions
+}
+
+// ---------- Loading and validation ----------
+
+// restore replaces the history contents after checking the tree structure.
+//
+// Revisions written before version 3 have no stamps; they are attributed
+// to DefaultSite in commit order. A nil clocks is rebuilt from the
+// revisions.
+func (h *History) restore(revisions []*Revision, current int, lamport LamportTime, maxSize int, clocks *historyClocks) error {
+	if err := checkRevisionTree(revisions, current); err != nil {
+		return err
+	}
+
+	if clocks == nil {
+		clocks = &historyClocks{site: DefaultSite}
+	}
+	if clocks.site == "" {
+		clocks.site = DefaultSite
+	}
+	version := make(VersionVector)
+	hlc := clocks.hlc
+	var count uint64
+	for _, rev := range revisions {
+		if rev.version == nil {
+			count++
+			rev.site = DefaultSite
+			rev.hlc = HLCTime{Wall: unixNano(rev.timestamp)}
+			rev.version = VersionVector{DefaultSite: count}
+		}
+		version.Merge(rev.version)
+		if hlc.Before(rev.hlc) {
+			hlc = rev.hlc
+		}
+	}
+	version.Merge(clocks.version)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.revisions = revisions
+	h.current = current
+	h.breakGroup()
+	h.lamport = lamport
+	h.maxSize = maxSize
+	h.site = clocks.site
+	h.version = version
+	h.clock.observe(hlc)
+	return nil
+}
+
+// checkRevisionTree checks parent/last-child links and operation lengths.
+func checkRevisionTree(revisions []*Revision, current int) error {
+	if current < -1 || current >= len(revisions) {
+		return fmt.Errorf("%w: current revision %d out of range", ErrInvalidHistory, current)
+	}
+
+	for i, rev := range revisions {
+		if rev.operation == nil || rev.inversion == nil {
+			return fmt.Errorf("%w: revision %d is missing an operation", ErrInvalidHistory, i)
+		}
+		if rev.parent >= i {
+			return fmt.Errorf("%w: revision %d has parent %d", ErrInvalidHistory, i, rev.parent)
+		}
+		if rev.lastChild >= 0 {
+			if rev.lastChild <= i || rev.lastChild >= len(revisions) || revisions[rev.lastChild].parent != i {
+				return fmt.Errorf("%w: revision %d has invalid last child %d", ErrInvalidHistory, i, rev.lastChild)
+			}
+		}
+		if rev.inversion.BaseLength() != rev.operation.TargetLength() ||
+			rev.inversion.TargetLength() != rev.operation.BaseLength() {
+			return fmt.Errorf("%w: revision %d inversion does not match its operation", ErrInvalidHistory, i)
+		}
+		if rev.parent >= 0 && revisions[rev.parent].operation.TargetLength() != rev.operation.BaseLength() {
+			return fmt.Errorf("%w: revision %d does not apply after its parent", ErrInvalidHistory, i)
+		}
+	}
+	return nil
+}
+
+// Validate checks that the history belongs to doc, the document at the
+// current revision.
+//
+// It undoes every revision from the current one back to the root,
+// checking that each inversion applies, that redoing the revision's
+// operation restores the text, and that the inversion is the inverse of
+// the operation.
+func (h *History) Validate(doc *rope.Rope) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if err := checkRevisionTree(h.revisions, h.current); err != nil {
+		return err
+	}
+	if doc == nil {
+		doc = rope.Empty()
+	}
+
+	for i := h.current; i >= 0; i = h.revisions[i].parent {
+		rev := h.revisions[i]
+		before, err := ApplyOperation(doc, rev.inversion)
+		if err != nil {
+			return fmt.Errorf("%w: revision %d: %v", ErrHistoryMismatch, i, err)
+		}
+		after, err := ApplyOperation(before, rev.operation)
+		if err != nil || after.String() != doc.String() || !rev.operation.Invert(before.String()).Equals(rev.inversion) {
+			return fmt.Errorf("%w: revision %d", ErrHistoryMismatch, i)
+		}
+		doc = before
+	}
+	return nil
+}
+
+// LoadHistory reads a binary history stream written by MarshalBinary or
+// HistoryWriter and validates it against doc, the current document.
+func LoadHistory(r io.Reader, doc *rope.Rope) (*History, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	h := NewHistory()
+	if err := h.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	if err := h.Validate(doc); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// ---------- Incremental append ----------
+
+// HistoryWriter persists a History incrementally.
+//
+// The first Sync of a writer created by NewHistoryWriter writes a full
+// snapshot; every later Sync appends only the revisions committed since
+// the previous one, plus a state record. The result is a single binary
+// stream that LoadHistory reads back, so the undo tree can be kept in a
+// file next to the document and appended to as edits happen.
+//
+// Example:
+//
+//	f, _ := os.OpenFile(path+".history", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+//	w := concordia.NewHistoryWriter(f, history)
+//	// after each edit or undo/redo:
+//	err := w.Sync()
+type HistoryWriter struct {
+	w       io.Writer
+	history *History
+	header  bool      // Header has been written
+	last    *Revision // Last revision written
+	state   []byte    // Last state record written
+}
+
+// NewHistoryWriter creates a writer for a new stream; the first Sync
+// writes the header and all revisions.
+func NewHistoryWriter(w io.Writer, h *History) *HistoryWriter {
+	return &HistoryWriter{w: w, history: h}
+}
+
+// NewHistoryAppender creates a writer that appends to an existing stream
+// from which h was loaded with LoadHistory.
+func NewHistoryAppender(w io.Writer, h *History) *HistoryWriter {
+	hw := &HistoryWriter{w: w, history: h, header: true}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if n := len(h.revisions); n > 0 {
+		hw.last = h.revisions[n-1]
+	}
+	hw.state = appendStateRecord(nil, h)
+	return hw
+}
+
+// Sync writes revisions committed since the last Sync and the current
+// state. Nothing is written if the history has not changed.
+func (hw *HistoryWriter) Sync() error {
+	h := hw.history
+	h.mu.RLock()
+
+	var buf []byte
+	if !hw.header {
+		buf = appendHistoryHeader(buf)
+	}
+
+	// Revisions are chronological: everything after the last written
+	// revision is new. If edits were grouped into it since, it is amended.
+	// If it was pruned or cleared, all revisions are new.
+	start := 0
+	if hw.last != nil {
+		for i := len(h.revisions) - 1; i >= 0; i-- {
+			rev := h.revisions[i]
+			if rev == hw.last {
+				start = i + 1
+				break
+			}
+			if rev.amends != nil && (rev.amends == hw.last || rev.amends == hw.last.amends) {
+				buf = appendAmendRecord(buf, i, rev)
+				start = i + 1
+				break
+			}
+		}
+	}
+	for i := start; i < len(h.revisions); i++ {
+		buf = appendRevisionRecord(buf, i, h.revisions[i])
+	}
+
+	state := appendStateRecord(nil, h)
+	n := len(h.revisions)
+	var last *Revision
+	if n > 0 {
+		last = h.revisions[n-1]
+	}
+	h.mu.RUnlock()
+
+	if hw.header && start == n && last == hw.last && bytes.Equal(state, hw.state) {
+		return nil
+	}
+	buf = append(buf, state...)
+
+	if _, err := hw.w.Write(buf); err != nil {
+		return err
+	}
+	hw.header = true
+	hw.last = last
+	hw.state = state
+	return nil
+}
@@ -0,0 +1,179 @@
+package concordia
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/rope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// historyEditor commits edits to a History the way an editor would.
+type historyEditor struct {
+	t       *testing.T
+	doc     *rope.Rope
+	history *History
+}
+
+func newHistoryEditor(t *testing.T, text string) *historyEditor {
+	return &historyEditor{t: t, doc: rope.New(text), history: NewHistory()}
+}
+
+func (e *historyEditor) insert(pos int, text string) {
+	op := ot.NewBuilder().Retain(pos).Insert(text).Retain(e.doc.Length() - pos).Build()
+	e.apply(op, true)
+}
+
+func (e *historyEditor) apply(op *ot.Operation, commit bool) {
+	next, err := ApplyOperation(e.doc, op)
+	require.NoError(e.t, err)
+	if commit {
+		e.history.CommitRevision(op, e.doc)
+	}
+	e.doc = next
+}
+
+func (e *historyEditor) undo() {
+	e.apply(e.history.Undo(), false)
+}
+
+// assertSameHistory checks that two histories have the same tree.
+func assertSameHistory(t *testing.T, expected, actual *History) {
+	require.Equal(t, expected.RevisionCount(), actual.RevisionCount())
+	assert.Equal(t, expected.CurrentIndex(), actual.CurrentIndex())
+	assert.Equal(t, expected.MaxSize(), actual.MaxSize())
+	for i := 0; i < expected.RevisionCount(); i++ {
+		e, a := expected.GetRevision(i), actual.GetRevision(i)
+		assert.Equal(t, e.Parent(), a.Parent(), "parent of %d", i)
+		assert.Equal(t, e.LastChild(), a.LastChild(), "last child of %d", i)
+		assert.Equal(t, e.Lamport(), a.Lamport(), "lamport of %d", i)
+		assert.True(t, e.Timestamp().Equal(a.Timestamp()), "timestamp of %d", i)
+		assert.True(t, e.Operation().Equals(a.Operation()), "operation of %d", i)
+		assert.True(t, e.Inversion().Equals(a.Inversion()), "inversion of %d", i)
+		assert.Equal(t, e.Stamp(), a.Stamp(), "stamp of %d", i)
+	}
+	assert.Equal(t, expected.Site(), actual.Site())
+	assert.Equal(t, expected.Version(), actual.Version())
+}
+
+// branchingEditor builds a history with a branch: "Hello" -> " World"
+// is undone and replaced by "!" -> "?", and "?" is undone.
+func branchingEditor(t *testing.T) *historyEditor {
+	e := newHistoryEditor(t, "Hello")
+	e.insert(5, " World")
+	e.undo()
+	e.insert(5, "!")
+	e.insert(6, "?")
+	e.undo()
+	return e
+}
+
+func TestHistory_JSONRoundTrip(t *testing.T) {
+	e := branchingEditor(t)
+
+	data, err := json.Marshal(e.history)
+	require.NoError(t, err)
+
+	restored := NewHistory()
+	require.NoError(t, json.Unmarshal(data, restored))
+	assertSameHistory(t, e.history, restored)
+	require.NoError(t, restored.Validate(e.doc))
+
+	// The restored tree redoes the same edit
+	assert.True(t, e.history.Redo().Equals(restored.Redo()))
+}
+
+func TestHistory_BinaryRoundTrip(t *testing.T) {
+	e := branchingEditor(t)
+
+	data, err := e.history.MarshalBinary()
+	require.NoError(t, err)
+
+	restored, err := LoadHistory(bytes.NewReader(data), e.doc)
+	require.NoError(t, err)
+	assertSameHistory(t, e.history, restored)
+	assert.Equal(t, LamportTime(2), restored.LamportAt())
+
+	// Undo the restored tree back to the original text
+	doc := e.doc
+	for restored.CanUndo() {
+		doc, err = ApplyOperation(doc, restored.Undo())
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "Hello", doc.String())
+}
+
+func TestHistory_ValidateAgainstDocument(t *testing.T) {
+	e := branchingEditor(t)
+	data, err := e.history.MarshalBinary()
+	require.NoError(t, err)
+
+	_, err = LoadHistory(bytes.NewReader(data), rope.New("Hello?"))
+	assert.ErrorIs(t, err, ErrHistoryMismatch, "same length, different text")
+
+	_, err = LoadHistory(bytes.NewReader(data), rope.New("Hi"))
+	assert.ErrorIs(t, err, ErrHistoryMismatch)
+}
+
+func TestHistory_DecodeErrors(t *testing.T) {
+	e := branchingEditor(t)
+	data, err := e.history.MarshalBinary()
+	require.NoError(t, err)
+
+	h := NewHistory()
+	assert.ErrorIs(t, h.UnmarshalBinary([]byte("nope")), ErrInvalidHistory)
+	assert.ErrorIs(t, h.UnmarshalBinary(data[:len(data)-2]), ErrInvalidHistory)
+
+	future := append([]byte(nil), data...)
+	future[4] = HistoryFormatVersion + 1
+	assert.ErrorIs(t, h.UnmarshalBinary(future), ErrHistoryVersion)
+
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"version": 99}`), h), ErrHistoryVersion)
+	bad := `{"version": 1, "current": 0, "revisions": [{"parent": 3, "last_child": -1, "operation": [1], "inversion": [1]}]}`
+	assert.ErrorIs(t, json.Unmarshal([]byte(bad), h), ErrInvalidHistory)
+}
+
+func TestHistoryWriter_IncrementalAppend(t *testing.T) {
+	e := newHistoryEditor(t, "")
+	e.history.SetMaxSize(3)
+
+	var file bytes.Buffer
+	w := NewHistoryWriter(&file, e.history)
+	require.NoError(t, w.Sync())
+
+	for i, text := range []string{"a", "b", "c", "d", "e"} {
+		e.insert(i, text)
+		require.NoError(t, w.Sync())
+	}
+	e.undo()
+	require.NoError(t, w.Sync())
+
+	size := file.Len()
+	require.NoError(t, w.Sync())
+	assert.Equal(t, size, file.Len(), "unchanged history appends nothing")
+
+	restored, err := LoadHistory(bytes.NewReader(file.Bytes()), e.doc)
+	require.NoError(t, err)
+	assertSameHistory(t, e.history, restored)
+
+	// Continue appending to the loaded stream
+	appender := NewHistoryAppender(&file, restored)
+	next, err := ApplyOperation(e.doc, ot.NewBuilder().Retain(4).Insert("!").Build())
+	require.NoError(t, err)
+	restored.CommitRevision(ot.NewBuilder().Retain(4).Insert("!").Build(), e.doc)
+	require.NoError(t, appender.Sync())
+
+	reloaded, err := LoadHistory(bytes.NewReader(file.Bytes()), next)
+	require.NoError(t, err)
+	assertSameHistory(t, restored, reloaded)
+
+	// Clearing the history is persisted too
+	restored.Clear()
+	require.NoError(t, appender.Sync())
+	empty, err := LoadHistory(bytes.NewReader(file.Bytes()), next)
+	require.NoError(t, err)
+	assert.True(t, empty.IsEmpty())
+}
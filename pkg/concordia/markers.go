@@ -0,0 +1,121 @@
+package concordia
+
+import (
+	"sync"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/rope"
+)
+
+// ChangeSetFromOperation converts an ot.Operation into an equivalent rope.ChangeSet.
+// This lets rope-level position tracking (markers, selections) follow OT edits.
+func ChangeSetFromOperation(op *ot.Operation) *rope.ChangeSet {
+	if op == nil {
+		return rope.NewChangeSet(0)
+	}
+
+	cs := rope.NewChangeSet(op.BaseLength())
+	for _, item := range op.ToJSON() {
+		switch v := item.(type) {
+		case int:
+			if v > 0 {
+				cs.Retain(v)
+			} else if v < 0 {
+				cs.Delete(-v)
+			}
+		case string:
+			cs.Insert(v)
+		}
+	}
+	return cs
+}
+
+// ========== Marked Document ==========
+
+// MarkedDocument is a rope document with an attached marker registry.
+//
+// Every edit applied through ApplyOperation or ApplyChangeSet also maps the
+// registered markers (bookmarks, diagnostics, comment anchors), so they stay
+// attached to the same text. Markers whose text is deleted entirely are
+// removed and returned to the caller.
+//
+// Example:
+//
+//	doc := concordia.NewMarkedDocument(rope.New("Hello World"))
+//	m := doc.Markers().Add(rope.MarkerComment, 6, 11, rope.AssocAfter, rope.AssocBefore, nil)
+//	orphaned, err := doc.ApplyOperation(op)
+type MarkedDocument struct {
+	mu      sync.RWMutex
+	rope    *rope.Rope
+	markers *rope.MarkerTree
+}
+
+// NewMarkedDocument creates a marked document for the given rope.
+func NewMarkedDocument(r *rope.Rope) *MarkedDocument {
+	if r == nil {
+		r = rope.Empty()
+	}
+	return &MarkedDocument{
+		rope:    r,
+		markers: rope.NewMarkerTree(),
+	}
+}
+
+// Rope returns the current document content.
+func (d *MarkedDocument) Rope() *rope.Rope {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.rope
+}
+
+// Markers returns the marker registry attached to this document.
+func (d *MarkedDocument) Markers() *rope.MarkerTree {
+	return d.markers
+}
+
+// ApplyChangeSet applies a changeset to the document and maps all markers.
+// Returns the markers whose ranges were deleted.
+func (d *MarkedDocument) ApplyChangeSet(cs *rope.ChangeSet) ([]*rope.Marker, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := cs.Apply(d.rope)
+	if err != nil {
+		return nil, err
+	}
+
+	d.rope = result
+	return d.markers.ApplyChangeSet(cs), nil
+}
+
+// ApplyOperation applies an OT operation to the document and maps all markers.
+// Returns the markers whose ranges were deleted.
+func (d *MarkedDocument) ApplyOperation(op *ot.Operation) ([]*rope.Marker, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := ApplyOperation(d.rope, op)
+	if err != nil {
+		return nil, err
+	}
+
+	d.rope = result
+	return d.markers.ApplyChangeSet(ChangeSetFromOperation(op)), nil
+}
+
+// MarkerText returns the text currently covered by the marker with the given ID.
+func (d *MarkedDocument) MarkerText(id rope.MarkerID) (string, bool) {
+	m := d.markers.Get(id)
+	if m == nil {
+		return "", false
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	text, err := d.rope.Slice(m.Start, m.End)
+	if err != nil {
+		return "", false
+	}
+	return text, true
+}
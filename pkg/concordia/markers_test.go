@@ -0,0 +1,57 @@
+package concordia
+
+import (
+	"testing"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/rope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeSetFromOperation(t *testing.T) {
+	op := ot.NewBuilder().Retain(6).Delete(5).Insert("Go").Build()
+	cs := ChangeSetFromOperation(op)
+
+	assert.Equal(t, 11, cs.LenBefore())
+	assert.Equal(t, 8, cs.LenAfter())
+
+	result, err := cs.Apply(rope.New("Hello World"))
+	require.NoError(t, err)
+	assert.Equal(t, "Hello Go", result.String())
+}
+
+func TestMarkedDocument_ApplyOperation(t *testing.T) {
+	doc := NewMarkedDocument(rope.New("Hello World"))
+	world := doc.Markers().Add(rope.MarkerComment, 6, 11, rope.AssocAfter, rope.AssocBefore, nil)
+	hello := doc.Markers().Add(rope.MarkerComment, 0, 5, rope.AssocAfter, rope.AssocBefore, nil)
+
+	// Insert at the front shifts both markers
+	orphaned, err := doc.ApplyOperation(ot.NewBuilder().Insert("Oh, ").Retain(11).Build())
+	require.NoError(t, err)
+	assert.Empty(t, orphaned)
+
+	text, ok := doc.MarkerText(world.ID)
+	require.True(t, ok)
+	assert.Equal(t, "World", text)
+
+	// Deleting "Hello " orphans the hello marker
+	orphaned, err = doc.ApplyOperation(ot.NewBuilder().Retain(4).Delete(6).Retain(5).Build())
+	require.NoError(t, err)
+	require.Len(t, orphaned, 1)
+	assert.Equal(t, hello.ID, orphaned[0].ID)
+
+	text, ok = doc.MarkerText(world.ID)
+	require.True(t, ok)
+	assert.Equal(t, "World", text)
+	assert.Equal(t, "Oh, World", doc.Rope().String())
+}
+
+func TestMarkedDocument_ApplyOperationLengthMismatch(t *testing.T) {
+	doc := NewMarkedDocument(rope.New("abc"))
+	doc.Markers().AddPoint(rope.MarkerBookmark, 1, rope.AssocBefore, nil)
+
+	_, err := doc.ApplyOperation(ot.NewBuilder().Retain(10).Build())
+	assert.Error(t, err)
+	assert.Equal(t, 1, doc.Markers().Get(1).Start, "markers untouched on failure")
+}
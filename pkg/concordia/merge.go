@@ -0,0 +1,201 @@
+package concordia
+
+import (
+	"sort"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/rope"
+)
+
+// ========== Three-Way Merge ==========
+
+// MergeConflict is a region that both sides changed differently.
+// The merged text keeps the remote version at [Start, End).
+type MergeConflict struct {
+	Start  int    `json:"start"`  // Start of the region in the merged text (characters)
+	End    int    `json:"end"`    // End of the region (exclusive)
+	Base   string `json:"base"`   // Common ancestor text of the region
+	Local  string `json:"local"`  // Local version of the region
+	Remote string `json:"remote"` // Remote version of the region
+}
+
+// MergeResult is the result of a three-way merge.
+type MergeResult struct {
+	Merged    *rope.Rope      // Merged document
+	Operation *ot.Operation   // Transforms remote into Merged
+	Conflicts []MergeConflict // Regions left as in remote
+}
+
+// HasConflicts returns true if some changes could not be merged.
+func (r *MergeResult) HasConflicts() bool {
+	return len(r.Conflicts) > 0
+}
+
+// mergeHunk replaces base[start:end) with text.
+type mergeHunk struct {
+	start, end int
+	text       string
+	local      bool
+}
+
+// Merge3 merges the changes from base to local into remote.
+//
+// Both sides are diffed against base with rope.DiffLines, line by line and
+// then character by character. Changes made by only one side are merged;
+// changes both sides made identically are merged once. Changes that
+// overlap are conflicts: the merged text keeps the remote version, and the
+// region is reported in Conflicts.
+//
+// The resulting Operation applies to remote, so it can be sent to a live
+// session like any other edit.
+//
+// Example:
+//
+//	result := Merge3(downloaded, edited, live)
+//	live, _ = ApplyOperation(live, result.Operation)
+//	for _, c := range result.Conflicts {
+//	    fmt.Printf("conflict at %d-%d: %q vs %q\n", c.Start, c.End, c.Local, c.Remote)
+//	}
+func Merge3(base, local, remote *rope.Rope) *MergeResult {
+	baseText := []rune(base.String())
+
+	hunks := append(changeHunks(rope.DiffLines(base, local), true),
+		changeHunks(rope.DiffLines(base, remote), false)...)
+	sort.SliceStable(hunks, func(i, j int) bool {
+		if hunks[i].start != hunks[j].start {
+			return hunks[i].start < hunks[j].start
+		}
+		return hunks[i].end < hunks[j].end
+	})
+
+	result := &MergeResult{}
+	builder := ot.NewBuilder()
+	var merged []rune
+	pos := 0
+
+	for i := 0; i < len(hunks); {
+		// Collect the hunks that touch the first one
+		start, end := hunks[i].start, hunks[i].end
+		j := i + 1
+		for j < len(hunks) && touches(start, end, hunks[j]) {
+			if hunks[j].end > end {
+				end = hunks[j].end
+			}
+			j++
+		}
+		group := hunks[i:j]
+		i = j
+
+		unchanged := baseText[pos:start]
+		merged = append(merged, unchanged...)
+		builder.Retain(len(unchanged))
+		pos = end
+
+		region := baseText[start:end]
+		localText := applyHunks(region, start, group, true)
+		remoteText := applyHunks(region, start, group, false)
+		same := string(localText) == string(remoteText)
+
+		switch {
+		case hasSide(group, false) && !hasSide(group, true):
+			// Remote change only: already in remote
+			builder.Retain(len(remoteText))
+			merged = append(merged, remoteText...)
+		case same || !hasSide(group, false):
+			// Local change only, or the same change on both sides
+			if !same {
+				builder.Delete(len(region))
+				builder.Insert(string(localText))
+			} else {
+				builder.Retain(len(remoteText))
+			}
+			merged = append(merged, localText...)
+		default:
+			result.Conflicts = append(result.Conflicts, MergeConflict{
+				Start:  len(merged),
+				End:    len(merged) + len(remoteText),
+				Base:   string(region),
+				Local:  string(localText),
+				Remote: string(remoteText),
+			})
+			builder.Retain(len(remoteText))
+			merged = append(merged, remoteText...)
+		}
+	}
+
+	rest := baseText[pos:]
+	merged = append(merged, rest...)
+	builder.Retain(len(rest))
+
+	result.Merged = rope.New(string(merged))
+	result.Operation = builder.Build()
+	return result
+}
+
+// changeHunks splits a changeset into hunks of base text replacements.
+func changeHunks(cs *rope.ChangeSet, local bool) []mergeHunk {
+	var hunks []mergeHunk
+	var current *mergeHunk
+	pos := 0
+
+	it := cs.ChangesIterator()
+	for info := it.Next(); info != nil; info = it.Next() {
+		op := info.Operation
+		if op.OpType == rope.OpRetain {
+			if current != nil {
+				hunks = append(hunks, *current)
+				current = nil
+			}
+			pos += op.Length
+			continue
+		}
+		if current == nil {
+			current = &mergeHunk{start: pos, end: pos, local: local}
+		}
+		if op.OpType == rope.OpDelete {
+			pos += op.Length
+			current.end = pos
+		} else {
+			current.text += op.Text
+		}
+	}
+	if current != nil {
+		hunks = append(hunks, *current)
+	}
+	return hunks
+}
+
+// touches reports whether h overlaps the region [start, end). A hunk that
+// starts where the region ends also touches it if either of them is an
+// insertion there, since the two could be ordered either way.
+func touches(start, end int, h mergeHunk) bool {
+	if h.start < end {
+		return true
+	}
+	return h.start == end && (h.start == h.end || start == end)
+}
+
+// applyHunks applies one side's hunks to region, which starts at offset in base.
+func applyHunks(region []rune, offset int, hunks []mergeHunk, local bool) []rune {
+	var out []rune
+	pos := offset
+	for _, h := range hunks {
+		if h.local != local {
+			continue
+		}
+		out = append(out, region[pos-offset:h.start-offset]...)
+		out = append(out, []rune(h.text)...)
+		pos = h.end
+	}
+	return append(out, region[pos-offset:]...)
+}
+
+// hasSide reports whether any hunk belongs to the given side.
+func hasSide(hunks []mergeHunk, local bool) bool {
+	for _, h := range hunks {
+		if h.local == local {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package concordia
+
+import (
+	"testing"
+
+	"github.com/coreseekdev/texere/pkg/rope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const mergeBase = "title\nfirst line\nsecond line\nthird line\n"
+
+// assertMerge checks that the merge operation turns remote into the merged text.
+func assertMerge(t *testing.T, local, remote, expected string) *MergeResult {
+	t.Helper()
+	result := Merge3(rope.New(mergeBase), rope.New(local), rope.New(remote))
+	assert.Equal(t, expected, result.Merged.String())
+
+	applied, err := ApplyOperation(rope.New(remote), result.Operation)
+	require.NoError(t, err)
+	assert.Equal(t, expected, applied.String())
+	return result
+}
+
+func TestMerge3_NonOverlapping(t *testing.T) {
+	result := assertMerge(t,
+		"title\nfirst line, edited offline\nsecond line\nthird line\n",
+		"Title\nfirst line\nsecond line\nthird line\nadded live\n",
+		"Title\nfirst line, edited offline\nsecond line\nthird line\nadded live\n")
+	assert.False(t, result.HasConflicts())
+
+	// Both sides made the same change
+	result = assertMerge(t,
+		"title\nfirst line\nline two\nthird line\n",
+		"title\nfirst line\nline two\nthird line\n",
+		"title\nfirst line\nline two\nthird line\n")
+	assert.False(t, result.HasConflicts())
+	assert.True(t, result.Operation.IsNoop())
+
+	// No local changes
+	result = assertMerge(t, mergeBase, "live\n", "live\n")
+	assert.True(t, result.Operation.IsNoop())
+}
+
+func TestMerge3_Conflicts(t *testing.T) {
+	result := assertMerge(t,
+		"title\nfirst line\nsecond line (offline)\nthird line\nlocal end\n",
+		"title!\nfirst line\nsecond line (live)\nthird line\n",
+		"title!\nfirst line\nsecond line (live)\nthird line\nlocal end\n")
+
+	require.Len(t, result.Conflicts, 1)
+	c := result.Conflicts[0]
+	// Changed lines are refined to characters: only the insertions conflict
+	assert.Equal(t, "", c.Base)
+	assert.Equal(t, " (offline)", c.Local)
+	assert.Equal(t, " (live)", c.Remote)
+	assert.Equal(t, c.Remote, result.Merged.String()[c.Start:c.End], "conflict region holds the remote text")
+
+	// Insertions at the same place conflict
+	result = assertMerge(t,
+		"local\n"+mergeBase,
+		"remote\n"+mergeBase,
+		"remote\n"+mergeBase)
+	require.Len(t, result.Conflicts, 1)
+	assert.Equal(t, "local\n", result.Conflicts[0].Local)
+}
@@ -0,0 +1,531 @@
+package concordia
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/rope"
+	"github.com/google/uuid"
+)
+
+// ========== Jupyter Notebook Document ==========
+
+// Cell types defined by nbformat 4.
+const (
+	CellTypeCode     = "code"
+	CellTypeMarkdown = "markdown"
+	CellTypeRaw      = "raw"
+)
+
+var (
+	// ErrCellNotFound is returned when a cell ID does not exist in the notebook.
+	ErrCellNotFound = errors.New("cell not found")
+
+	// ErrNotCodeCell is returned when outputs are set on a non-code cell.
+	ErrNotCodeCell = errors.New("cell is not a code cell")
+
+	// ErrUnsupportedNotebook is returned for notebooks that are not nbformat 4.
+	ErrUnsupportedNotebook = errors.New("unsupported notebook format")
+)
+
+// NotebookCell is a snapshot of a notebook cell.
+//
+// It is also used to describe new cells for InsertCell; Metadata,
+// Outputs and ExecutionCount are raw nbformat JSON and may be empty.
+type NotebookCell struct {
+	ID             string          `json:"id"`
+	CellType       string          `json:"cell_type"`
+	Source         string          `json:"source"`
+	Metadata       json.RawMessage `json:"metadata,omitempty"`
+	Outputs        json.RawMessage `json:"outputs,omitempty"`
+	ExecutionCount json.RawMessage `json:"execution_count,omitempty"`
+}
+
+// OutputUpdate replaces the outputs of a code cell.
+//
+// Outputs are last-writer-wins: an update is applied only if it is newer
+// than the one that produced the current outputs. Updates with the same
+// Timestamp are ordered by ClientID so every replica picks the same winner.
+type OutputUpdate struct {
+	Outputs        json.RawMessage `json:"outputs"`
+	ExecutionCount json.RawMessage `json:"execution_count,omitempty"` // Unchanged if empty
+	Timestamp      int64           `json:"timestamp"`                 // Unix milliseconds of the execution
+	ClientID       string          `json:"client_id"`
+}
+
+// newerThan reports whether u wins over an update stamped (timestamp, clientID).
+func (u OutputUpdate) newerThan(timestamp int64, clientID string) bool {
+	if u.Timestamp != timestamp {
+		return u.Timestamp > timestamp
+	}
+	return u.ClientID > clientID
+}
+
+// notebookCell is the editable state of a cell.
+type notebookCell struct {
+	id       string
+	cellType string
+	source   *rope.Rope
+
+	// Serialization details kept for lossless round trips
+	fields       map[string]json.RawMessage // Keys other than id, cell_type and source
+	sourceIsList bool                       // Source was stored as a list of lines
+	emitID       bool                       // Cell had an "id" key (nbformat >= 4.5)
+
+	// Last-writer-wins stamp of the current outputs
+	outputsTimestamp int64
+	outputsClientID  string
+}
+
+// snapshot returns the exported view of the cell.
+func (c *notebookCell) snapshot() NotebookCell {
+	return NotebookCell{
+		ID:             c.id,
+		CellType:       c.cellType,
+		Source:         c.source.String(),
+		Metadata:       c.fields["metadata"],
+		Outputs:        c.fields["outputs"],
+		ExecutionCount: c.fields["execution_count"],
+	}
+}
+
+// Notebook is a collaborative model of a Jupyter notebook (nbformat 4).
+//
+// Each cell source is a rope edited with ot.Operation, addressed by the
+// cell's ID so text edits are unaffected by concurrent cell insertions,
+// moves and deletions. Cell outputs are replaced as a whole with
+// last-writer-wins semantics (see OutputUpdate). Everything the model
+// does not edit (notebook metadata, attachments, unknown keys) is kept
+// as raw JSON, so Marshal reproduces files written by Jupyter byte for byte.
+//
+// Example:
+//
+//	nb, err := concordia.ParseNotebook(data)
+//	id := nb.Cells()[0].ID
+//	err = nb.ApplyCellOperation(id, ot.NewBuilder().Insert("import os\n").Retain(n).Build())
+//	data, err = nb.Marshal()
+type Notebook struct {
+	mu     sync.RWMutex
+	fields map[string]json.RawMessage // Top-level keys other than cells
+	cells  []*notebookCell
+	index  map[string]*notebookCell
+}
+
+// NewNotebook creates an empty nbformat 4.5 notebook.
+func NewNotebook() *Notebook {
+	return &Notebook{
+		fields: map[string]json.RawMessage{
+			"metadata":       json.RawMessage("{}"),
+			"nbformat":       json.RawMessage("4"),
+			"nbformat_minor": json.RawMessage("5"),
+		},
+		index: make(map[string]*notebookCell),
+	}
+}
+
+// ParseNotebook parses an .ipynb file.
+//
+// Returns ErrUnsupportedNotebook if the file is not nbformat 4.
+// Cells without an ID (nbformat < 4.5) are assigned one; it is used
+// for addressing only and is not written back by Marshal.
+func ParseNotebook(data []byte) (*Notebook, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("invalid notebook: %w", err)
+	}
+
+	var major int
+	if err := json.Unmarshal(fields["nbformat"], &major); err != nil || major != 4 {
+		return nil, ErrUnsupportedNotebook
+	}
+
+	var rawCells []map[string]json.RawMessage
+	if raw, ok := fields["cells"]; ok {
+		if err := json.Unmarshal(raw, &rawCells); err != nil {
+			return nil, fmt.Errorf("invalid notebook cells: %w", err)
+		}
+	}
+	delete(fields, "cells")
+
+	nb := &Notebook{
+		fields: fields,
+		cells:  make([]*notebookCell, 0, len(rawCells)),
+		index:  make(map[string]*notebookCell, len(rawCells)),
+	}
+	for i, raw := range rawCells {
+		cell, err := parseCell(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cell %d: %w", i, err)
+		}
+		if cell.id == "" || nb.index[cell.id] != nil {
+			cell.id = uuid.New().String()
+		}
+		nb.cells = append(nb.cells, cell)
+		nb.index[cell.id] = cell
+	}
+	return nb, nil
+}
+
+// parseCell parses a single nbformat cell.
+func parseCell(raw map[string]json.RawMessage) (*notebookCell, error) {
+	cell := &notebookCell{fields: raw}
+
+	if err := json.Unmarshal(raw["cell_type"], &cell.cellType); err != nil {
+		return nil, fmt.Errorf("invalid cell_type: %w", err)
+	}
+	delete(raw, "cell_type")
+
+	if rawID, ok := raw["id"]; ok {
+		if err := json.Unmarshal(rawID, &cell.id); err != nil {
+			return nil, fmt.Errorf("invalid id: %w", err)
+		}
+		cell.emitID = true
+		delete(raw, "id")
+	}
+
+	source := ""
+	if rawSource, ok := raw["source"]; ok {
+		var lines []string
+		if err := json.Unmarshal(rawSource, &source); err != nil {
+			if err := json.Unmarshal(rawSource, &lines); err != nil {
+				return nil, fmt.Errorf("invalid source: %w", err)
+			}
+			source = strings.Join(lines, "")
+			cell.sourceIsList = true
+		}
+		delete(raw, "source")
+	}
+	cell.source = rope.New(source)
+
+	return cell, nil
+}
+
+// Len returns the number of cells.
+func (nb *Notebook) Len() int {
+	nb.mu.RLock()
+	defer nb.mu.RUnlock()
+	return len(nb.cells)
+}
+
+// Clone returns a copy of the notebook that can be changed without
+// affecting nb. Cell sources are ropes and are shared until edited.
+func (nb *Notebook) Clone() *Notebook {
+	nb.mu.RLock()
+	defer nb.mu.RUnlock()
+
+	clone := &Notebook{
+		fields: make(map[string]json.RawMessage, len(nb.fields)),
+		cells:  make([]*notebookCell, len(nb.cells)),
+		index:  make(map[string]*notebookCell, len(nb.index)),
+	}
+	for k, v := range nb.fields {
+		clone.fields[k] = v
+	}
+	for i, c := range nb.cells {
+		cell := *c
+		cell.fields = make(map[string]json.RawMessage, len(c.fields))
+		for k, v := range c.fields {
+			cell.fields[k] = v
+		}
+		clone.cells[i] = &cell
+		clone.index[cell.id] = &cell
+	}
+	return clone
+}
+
+// Cells returns snapshots of all cells in order.
+func (nb *Notebook) Cells() []NotebookCell {
+	nb.mu.RLock()
+	defer nb.mu.RUnlock()
+
+	result := make([]NotebookCell, len(nb.cells))
+	for i, c := range nb.cells {
+		result[i] = c.snapshot()
+	}
+	return result
+}
+
+// Cell returns a snapshot of the cell with the given ID.
+func (nb *Notebook) Cell(id string) (NotebookCell, bool) {
+	nb.mu.RLock()
+	defer nb.mu.RUnlock()
+
+	c, ok := nb.index[id]
+	if !ok {
+		return NotebookCell{}, false
+	}
+	return c.snapshot(), true
+}
+
+// CellIndex returns the position of a cell, or -1 if it does not exist.
+func (nb *Notebook) CellIndex(id string) int {
+	nb.mu.RLock()
+	defer nb.mu.RUnlock()
+	return nb.indexOf(id)
+}
+
+// CellSource returns the source rope of a cell.
+func (nb *Notebook) CellSource(id string) (*rope.Rope, bool) {
+	nb.mu.RLock()
+	defer nb.mu.RUnlock()
+
+	c, ok := nb.index[id]
+	if !ok {
+		return nil, false
+	}
+	return c.source, true
+}
+
+// indexOf returns the position of a cell. Caller must hold the lock.
+func (nb *Notebook) indexOf(id string) int {
+	for i, c := range nb.cells {
+		if c.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// ApplyCellOperation applies a text operation to a cell's source.
+//
+// The operation's base length must match the source length in characters.
+func (nb *Notebook) ApplyCellOperation(id string, op *ot.Operation) error {
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+
+	c, ok := nb.index[id]
+	if !ok {
+		return ErrCellNotFound
+	}
+
+	source, err := ApplyOperation(c.source, op)
+	if err != nil {
+		return err
+	}
+	c.source = source
+	return nil
+}
+
+// InsertCell inserts a cell at index and returns its ID.
+//
+// The index is clamped to the cell list, so inserts computed against an
+// older cell list still land in a valid position. A new ID is generated
+// if cell.ID is empty or already in use.
+func (nb *Notebook) InsertCell(index int, cell NotebookCell) (string, error) {
+	switch cell.CellType {
+	case CellTypeCode, CellTypeMarkdown, CellTypeRaw:
+	default:
+		return "", fmt.Errorf("invalid cell type %q", cell.CellType)
+	}
+
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+
+	c := &notebookCell{
+		id:           cell.ID,
+		cellType:     cell.CellType,
+		source:       rope.New(cell.Source),
+		fields:       make(map[string]json.RawMessage),
+		sourceIsList: true,
+		emitID:       nb.supportsCellIDs(),
+	}
+	if c.id == "" || nb.index[c.id] != nil {
+		c.id = uuid.New().String()
+	}
+
+	c.fields["metadata"] = rawOrDefault(cell.Metadata, "{}")
+	if c.cellType == CellTypeCode {
+		c.fields["outputs"] = rawOrDefault(cell.Outputs, "[]")
+		c.fields["execution_count"] = rawOrDefault(cell.ExecutionCount, "null")
+	}
+
+	index = clampIndex(index, len(nb.cells))
+	nb.cells = append(nb.cells, nil)
+	copy(nb.cells[index+1:], nb.cells[index:])
+	nb.cells[index] = c
+	nb.index[c.id] = c
+
+	return c.id, nil
+}
+
+// DeleteCell removes a cell.
+func (nb *Notebook) DeleteCell(id string) error {
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+
+	i := nb.indexOf(id)
+	if i < 0 {
+		return ErrCellNotFound
+	}
+	nb.cells = append(nb.cells[:i], nb.cells[i+1:]...)
+	delete(nb.index, id)
+	return nil
+}
+
+// MoveCell moves a cell so that it ends up at index.
+// The index is clamped to the cell list.
+func (nb *Notebook) MoveCell(id string, index int) error {
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+
+	from := nb.indexOf(id)
+	if from < 0 {
+		return ErrCellNotFound
+	}
+
+	c := nb.cells[from]
+	nb.cells = append(nb.cells[:from], nb.cells[from+1:]...)
+	index = clampIndex(index, len(nb.cells))
+	nb.cells = append(nb.cells, nil)
+	copy(nb.cells[index+1:], nb.cells[index:])
+	nb.cells[index] = c
+	return nil
+}
+
+// SetOutputs replaces the outputs of a code cell if the update wins
+// last-writer-wins ordering.
+//
+// Returns true if the update was applied, false if a newer update was
+// already applied.
+func (nb *Notebook) SetOutputs(id string, update OutputUpdate) (bool, error) {
+	var outputs []json.RawMessage
+	if err := json.Unmarshal(update.Outputs, &outputs); err != nil {
+		return false, fmt.Errorf("invalid outputs: %w", err)
+	}
+
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+
+	c, ok := nb.index[id]
+	if !ok {
+		return false, ErrCellNotFound
+	}
+	if c.cellType != CellTypeCode {
+		return false, ErrNotCodeCell
+	}
+	if !update.newerThan(c.outputsTimestamp, c.outputsClientID) {
+		return false, nil
+	}
+
+	c.fields["outputs"] = append(json.RawMessage(nil), update.Outputs...)
+	if len(update.ExecutionCount) > 0 {
+		c.fields["execution_count"] = append(json.RawMessage(nil), update.ExecutionCount...)
+	}
+	c.outputsTimestamp = update.Timestamp
+	c.outputsClientID = update.ClientID
+	return true, nil
+}
+
+// supportsCellIDs reports whether the notebook format includes cell IDs.
+// Caller must hold the lock.
+func (nb *Notebook) supportsCellIDs() bool {
+	if len(nb.cells) > 0 {
+		return nb.cells[0].emitID
+	}
+	var minor int
+	if err := json.Unmarshal(nb.fields["nbformat_minor"], &minor); err != nil {
+		return false
+	}
+	return minor >= 5
+}
+
+// Marshal serializes the notebook as nbformat 4 JSON.
+//
+// The output uses Jupyter's layout: one-space indentation, sorted keys,
+// no HTML escaping and a trailing newline.
+func (nb *Notebook) Marshal() ([]byte, error) {
+	nb.mu.RLock()
+	defer nb.mu.RUnlock()
+
+	cells := make([]map[string]json.RawMessage, len(nb.cells))
+	for i, c := range nb.cells {
+		m := make(map[string]json.RawMessage, len(c.fields)+3)
+		for k, v := range c.fields {
+			m[k] = v
+		}
+
+		var err error
+		if m["cell_type"], err = marshalRaw(c.cellType); err != nil {
+			return nil, err
+		}
+		if c.emitID {
+			if m["id"], err = marshalRaw(c.id); err != nil {
+				return nil, err
+			}
+		}
+		var source interface{} = c.source.String()
+		if c.sourceIsList {
+			source = splitLines(c.source.String())
+		}
+		if m["source"], err = marshalRaw(source); err != nil {
+			return nil, err
+		}
+		cells[i] = m
+	}
+
+	doc := make(map[string]interface{}, len(nb.fields)+1)
+	for k, v := range nb.fields {
+		doc[k] = v
+	}
+	doc["cells"] = cells
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", " ")
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// marshalRaw encodes v without HTML escaping.
+func marshalRaw(v interface{}) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// splitLines splits text into lines that keep their line endings,
+// the multiline string format of nbformat.
+func splitLines(text string) []string {
+	lines := []string{}
+	for len(text) > 0 {
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			lines = append(lines, text)
+			break
+		}
+		lines = append(lines, text[:i+1])
+		text = text[i+1:]
+	}
+	return lines
+}
+
+// rawOrDefault returns raw, or def if raw is empty.
+func rawOrDefault(raw json.RawMessage, def string) json.RawMessage {
+	if len(raw) == 0 {
+		return json.RawMessage(def)
+	}
+	return append(json.RawMessage(nil), raw...)
+}
+
+// clampIndex limits index to [0, n].
+func clampIndex(index, n int) int {
+	if index < 0 {
+		return 0
+	}
+	if index > n {
+		return n
+	}
+	return index
+}
@@ -0,0 +1,192 @@
+package concordia
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testNotebook is laid out the way Jupyter writes .ipynb files.
+const testNotebook = `{
+ "cells": [
+  {
+   "cell_type": "markdown",
+   "id": "intro",
+   "metadata": {},
+   "source": [
+    "# Title\n",
+    "Some <b>text</b> & more"
+   ]
+  },
+  {
+   "cell_type": "code",
+   "execution_count": 3,
+   "id": "load",
+   "metadata": {
+    "tags": [
+     "setup"
+    ]
+   },
+   "outputs": [
+    {
+     "name": "stdout",
+     "output_type": "stream",
+     "text": [
+      "1.50\n"
+     ]
+    }
+   ],
+   "source": [
+    "x = 1.5\n",
+    "print(f\"{x:.2f}\")"
+   ]
+  }
+ ],
+ "metadata": {
+  "kernelspec": {
+   "display_name": "Python 3",
+   "language": "python",
+   "name": "python3"
+  }
+ },
+ "nbformat": 4,
+ "nbformat_minor": 5
+}
+`
+
+func TestNotebook_RoundTrip(t *testing.T) {
+	nb, err := ParseNotebook([]byte(testNotebook))
+	require.NoError(t, err)
+
+	cells := nb.Cells()
+	require.Len(t, cells, 2)
+	assert.Equal(t, "intro", cells[0].ID)
+	assert.Equal(t, CellTypeMarkdown, cells[0].CellType)
+	assert.Equal(t, "# Title\nSome <b>text</b> & more", cells[0].Source)
+	assert.JSONEq(t, `3`, string(cells[1].ExecutionCount))
+
+	data, err := nb.Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, testNotebook, string(data))
+}
+
+func TestNotebook_LegacyCellsWithoutIDs(t *testing.T) {
+	legacy := `{"cells": [{"cell_type": "raw", "metadata": {}, "source": "plain"}], "metadata": {}, "nbformat": 4, "nbformat_minor": 2}`
+	nb, err := ParseNotebook([]byte(legacy))
+	require.NoError(t, err)
+
+	id := nb.Cells()[0].ID
+	assert.NotEmpty(t, id, "cells are addressable without stored IDs")
+
+	_, err = nb.InsertCell(1, NotebookCell{CellType: CellTypeMarkdown, Source: "new"})
+	require.NoError(t, err)
+
+	data, err := nb.Marshal()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"cells": [
+		{"cell_type": "raw", "metadata": {}, "source": "plain"},
+		{"cell_type": "markdown", "metadata": {}, "source": ["new"]}
+	], "metadata": {}, "nbformat": 4, "nbformat_minor": 2}`, string(data))
+
+	_, err = ParseNotebook([]byte(`{"cells": [], "nbformat": 3}`))
+	assert.ErrorIs(t, err, ErrUnsupportedNotebook)
+}
+
+func TestNotebook_CellOperations(t *testing.T) {
+	nb, err := ParseNotebook([]byte(testNotebook))
+	require.NoError(t, err)
+
+	// Text edits address cells by ID
+	op := ot.NewBuilder().Retain(8).Insert("import math\n").Retain(17).Build()
+	require.NoError(t, nb.ApplyCellOperation("load", op))
+	cell, ok := nb.Cell("load")
+	require.True(t, ok)
+	assert.Equal(t, "x = 1.5\nimport math\nprint(f\"{x:.2f}\")", cell.Source)
+
+	assert.ErrorIs(t, nb.ApplyCellOperation("missing", op), ErrCellNotFound)
+	assert.ErrorIs(t, nb.ApplyCellOperation("load", op), ot.ErrInvalidBaseLength)
+
+	// Insert, move and delete cells
+	id, err := nb.InsertCell(100, NotebookCell{CellType: CellTypeCode, Source: "y = 2"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, nb.CellIndex(id), "index is clamped")
+
+	require.NoError(t, nb.MoveCell(id, 0))
+	require.NoError(t, nb.DeleteCell("intro"))
+	assert.ErrorIs(t, nb.DeleteCell("intro"), ErrCellNotFound)
+
+	ids := []string{}
+	for _, c := range nb.Cells() {
+		ids = append(ids, c.ID)
+	}
+	assert.Equal(t, []string{id, "load"}, ids)
+
+	_, err = nb.InsertCell(0, NotebookCell{CellType: "widget"})
+	assert.Error(t, err)
+
+	data, err := nb.Marshal()
+	require.NoError(t, err)
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &doc))
+	first := doc["cells"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, id, first["id"])
+	assert.Equal(t, []interface{}{}, first["outputs"])
+	assert.Nil(t, first["execution_count"])
+}
+
+func TestNotebook_OutputsLastWriterWins(t *testing.T) {
+	nb, err := ParseNotebook([]byte(testNotebook))
+	require.NoError(t, err)
+
+	newer := OutputUpdate{Outputs: json.RawMessage(`[]`), ExecutionCount: json.RawMessage(`5`), Timestamp: 200, ClientID: "a"}
+	older := OutputUpdate{Outputs: json.RawMessage(`[{"output_type": "stream", "name": "stdout", "text": "old"}]`), Timestamp: 100, ClientID: "b"}
+
+	applied, err := nb.SetOutputs("load", newer)
+	require.NoError(t, err)
+	assert.True(t, applied)
+
+	applied, err = nb.SetOutputs("load", older)
+	require.NoError(t, err)
+	assert.False(t, applied, "older execution does not overwrite newer outputs")
+
+	// Same timestamp: higher client ID wins on every replica
+	tie := OutputUpdate{Outputs: json.RawMessage(`[]`), ExecutionCount: json.RawMessage(`6`), Timestamp: 200, ClientID: "c"}
+	applied, err = nb.SetOutputs("load", tie)
+	require.NoError(t, err)
+	assert.True(t, applied)
+
+	cell, _ := nb.Cell("load")
+	assert.JSONEq(t, `[]`, string(cell.Outputs))
+	assert.JSONEq(t, `6`, string(cell.ExecutionCount))
+
+	_, err = nb.SetOutputs("intro", newer)
+	assert.ErrorIs(t, err, ErrNotCodeCell)
+	_, err = nb.SetOutputs("load", OutputUpdate{Outputs: json.RawMessage(`{}`), Timestamp: 300})
+	assert.Error(t, err)
+}
+
+func TestNotebook_Clone(t *testing.T) {
+	nb, err := ParseNotebook([]byte(testNotebook))
+	require.NoError(t, err)
+	original, err := nb.Marshal()
+	require.NoError(t, err)
+
+	clone := nb.Clone()
+	require.NoError(t, clone.ApplyCellOperation("load", ot.NewBuilder().Insert("# ").Retain(25).Build()))
+	_, err = clone.SetOutputs("load", OutputUpdate{Outputs: json.RawMessage(`[]`), Timestamp: 100, ClientID: "a"})
+	require.NoError(t, err)
+	require.NoError(t, clone.DeleteCell("intro"))
+
+	data, err := nb.Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, string(original), string(data), "changes to the clone do not reach the original")
+	assert.Equal(t, 1, clone.Len())
+
+	// The clone keeps the output stamps of the original
+	applied, err := clone.Clone().SetOutputs("load", OutputUpdate{Outputs: json.RawMessage(`[]`), Timestamp: 50, ClientID: "b"})
+	require.NoError(t, err)
+	assert.False(t, applied)
+}
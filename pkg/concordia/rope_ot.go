@@ -156,6 +156,35 @@ func DeleteOperation(doc *rope.Rope, from, to int) *ot.Operation {
 	return builder.Build()
 }
 
+// DiffOperation creates an ot.Operation that transforms a into b, using
+// rope.Diff to skip the parts of the two ropes that are shared.
+//
+// Example:
+//
+//	op := DiffOperation(saved, current)
+//	restored, _ := ApplyOperation(saved, op) // same text as current
+func DiffOperation(a, b *rope.Rope) *ot.Operation {
+	return OperationFromChangeSet(rope.Diff(a, b))
+}
+
+// OperationFromChangeSet converts a rope.ChangeSet into an equivalent ot.Operation.
+// It is the inverse of ChangeSetFromOperation.
+func OperationFromChangeSet(cs *rope.ChangeSet) *ot.Operation {
+	builder := ot.NewBuilder()
+	it := cs.ChangesIterator()
+	for info := it.Next(); info != nil; info = it.Next() {
+		switch info.Operation.OpType {
+		case rope.OpRetain:
+			builder.Retain(info.Operation.Length)
+		case rope.OpDelete:
+			builder.Delete(info.Operation.Length)
+		case rope.OpInsert:
+			builder.Insert(info.Operation.Text)
+		}
+	}
+	return builder.Build()
+}
+
 // ========== Rope OT Integration ==========
 
 // ApplyOperation applies an OT operation to the rope and returns a new Rope.
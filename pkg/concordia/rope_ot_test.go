@@ -0,0 +1,28 @@
+package concordia
+
+import (
+	"testing"
+
+	"github.com/coreseekdev/texere/pkg/rope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffOperation(t *testing.T) {
+	saved := rope.New("Hello World")
+	current, err := saved.Replace(6, 11, "Gophers")
+	require.NoError(t, err)
+	current, err = current.Insert(0, "> ")
+	require.NoError(t, err)
+
+	op := DiffOperation(saved, current)
+	assert.Equal(t, saved.Length(), op.BaseLength())
+
+	result, err := ApplyOperation(saved, op)
+	require.NoError(t, err)
+	assert.Equal(t, "> Hello Gophers", result.String())
+
+	// Round trip through ChangeSetFromOperation
+	assert.True(t, op.Equals(OperationFromChangeSet(ChangeSetFromOperation(op))))
+	assert.True(t, DiffOperation(current, current).IsNoop())
+}
@@ -2,6 +2,7 @@ package concordia
 
 import (
 	"testing"
+	"time"
 
 	"github.com/coreseekdev/texere/pkg/ot"
 	"github.com/coreseekdev/texere/pkg/rope"
@@ -164,6 +165,75 @@ func TestHistory_LamportTimestamps(t *testing.T) {
 	}
 }
 
+func TestHistory_WallClockNavigation(t *testing.T) {
+	history := NewHistory()
+	doc := rope.New("")
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	commit := func(text string, at time.Duration) {
+		op := ot.NewBuilder().Retain(doc.Length()).Insert(text).Build()
+		history.CommitRevisionAt(op, doc, start.Add(at))
+		var err error
+		if doc, err = ApplyOperation(doc, op); err != nil {
+			t.Fatalf("Failed to apply operation: %v", err)
+		}
+	}
+	apply := func(op *ot.Operation) {
+		if op == nil {
+			t.Fatal("Expected an operation")
+		}
+		var err error
+		if doc, err = ApplyOperation(doc, op); err != nil {
+			t.Fatalf("Failed to apply navigation: %v", err)
+		}
+	}
+
+	// Branch: "a" "b" at 0m/5m, undo "b", then "c" at 20m and "d" at 30m
+	commit("a", 0)
+	commit("b", 5*time.Minute)
+	apply(history.Undo())
+	commit("c", 20*time.Minute)
+	commit("d", 30*time.Minute)
+
+	// 10 minutes before 30m is the state after "b", on the other branch
+	apply(history.EarlierBy(rope.EarlierRequest(25 * time.Minute)))
+	if doc.String() != "ab" {
+		t.Errorf("Expected %q after :earlier 25m, got %q", "ab", doc.String())
+	}
+	if history.CurrentIndex() != 1 {
+		t.Errorf("Expected current index 1, got %d", history.CurrentIndex())
+	}
+
+	// 15 minutes after 5m crosses back to "c"
+	apply(history.LaterBy(rope.LaterRequest(15 * time.Minute)))
+	if doc.String() != "ac" {
+		t.Errorf("Expected %q after :later 15m, got %q", "ac", doc.String())
+	}
+
+	// Before the first revision is the root
+	apply(history.EarlierBy(rope.EarlierRequest(time.Hour)))
+	if doc.String() != "" || !history.AtRoot() {
+		t.Errorf("Expected empty root document, got %q", doc.String())
+	}
+	if history.EarlierBy(rope.EarlierRequest(time.Hour)) != nil {
+		t.Error("Expected nil at root")
+	}
+
+	// Step requests follow the current branch
+	apply(history.LaterBy(rope.NewUndoSteps(3)))
+	if doc.String() != "acd" {
+		t.Errorf("Expected %q after :later 3, got %q", "acd", doc.String())
+	}
+	apply(history.EarlierBy(rope.NewUndoSteps(2)))
+	if doc.String() != "a" {
+		t.Errorf("Expected %q after :earlier 2, got %q", "a", doc.String())
+	}
+
+	if got := history.RevisionAt(start.Add(25 * time.Minute)); got != 2 {
+		t.Errorf("Expected revision 2 at 25m, got %d", got)
+	}
+}
+
 // ========== Operation Application Tests ==========
 
 func TestOperation_ApplyInsert(t *testing.T) {
@@ -211,8 +281,8 @@ func TestOperation_ApplyReplace(t *testing.T) {
 
 	// Replace "world" with "gophers"
 	builder := ot.NewBuilder()
-	builder.Retain(6)        // "hello "
-	builder.Delete(5)        // "world"
+	builder.Retain(6)         // "hello "
+	builder.Delete(5)         // "world"
 	builder.Insert("gophers") // replacement
 	op := builder.Build()
 
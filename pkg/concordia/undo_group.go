@@ -0,0 +1,143 @@
+package concordia
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/rope"
+)
+
+// ========== Undo Grouping ==========
+
+// WordBoundaryPolicy groups typing until a new word starts: an insert that
+// begins with a word character after an insert that ended with whitespace
+// or punctuation starts a new undo group. Edits that are not inserts are
+// left to the other policies.
+//
+// Typing "hello world" gives two undo steps, "hello " and "world".
+func WordBoundaryPolicy() ot.GroupPolicy {
+	wb := rope.NewWordBoundary(nil)
+	return ot.GroupPolicyFunc(func(prev, next ot.UndoEdit) bool {
+		before, after := insertedText(prev.Operation), insertedText(next.Operation)
+		if before == "" || after == "" {
+			return true
+		}
+		last, _ := utf8.DecodeLastRuneInString(before)
+		first, _ := utf8.DecodeRuneInString(after)
+		return wb.IsWordChar(last) || !wb.IsWordChar(first)
+	})
+}
+
+// DefaultGroupPolicy groups adjacent typing or deleting made within window
+// of each other, breaking at word boundaries.
+func DefaultGroupPolicy(window time.Duration) ot.GroupPolicy {
+	return ot.AllOf(ot.TimeWindowPolicy(window), ot.AdjacentEditsPolicy(), WordBoundaryPolicy())
+}
+
+// insertedText returns the text inserted by op.
+func insertedText(op *ot.Operation) string {
+	var sb strings.Builder
+	for _, component := range op.ToJSON() {
+		if s, ok := component.(string); ok {
+			sb.WriteString(s)
+		}
+	}
+	return sb.String()
+}
+
+// SetGroupPolicy sets the policy CommitRevision uses to merge edits into
+// the current revision, so they are undone in one step. A nil policy (the
+// default) gives one revision per commit.
+//
+// Example:
+//
+//	h.SetGroupPolicy(concordia.DefaultGroupPolicy(time.Second))
+func (h *History) SetGroupPolicy(policy ot.GroupPolicy) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.groups().SetPolicy(policy)
+}
+
+// BeginGroup starts an explicit undo group: revisions committed until
+// EndGroup are merged into one.
+func (h *History) BeginGroup() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.groups().BeginGroup()
+}
+
+// EndGroup ends an explicit undo group.
+func (h *History) EndGroup() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.groups().EndGroup()
+}
+
+// BreakGroup makes the next commit create a new revision.
+func (h *History) BreakGroup() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.breakGroup()
+}
+
+// groups returns the grouper, creating it on first use.
+// Caller must hold the write lock.
+func (h *History) groups() *ot.UndoGrouper {
+	if h.grouper == nil {
+		h.grouper = ot.NewUndoGrouper(nil)
+	}
+	return h.grouper
+}
+
+// breakGroup ends the current group after navigation.
+// Caller must hold the write lock.
+func (h *History) breakGroup() {
+	if h.grouper != nil {
+		h.grouper.Break()
+	}
+}
+
+// amendCurrent merges an edit into the current revision if it is the
+// newest revision and has no children. The revision is replaced rather
+// than modified, so history writers see the change. It keeps its site
+// and version vector; only its HLC time moves forward.
+// Caller must hold the write lock.
+func (h *History) amendCurrent(operation, inversion *ot.Operation, timestamp time.Time) bool {
+	if h.current < 0 || h.current != len(h.revisions)-1 {
+		return false
+	}
+	tip := h.revisions[h.current]
+	if tip.lastChild >= 0 || tip.site != h.site {
+		return false
+	}
+
+	composed, err := ot.Compose(tip.operation, operation)
+	if err != nil {
+		return false
+	}
+	// Undoing the group undoes the newest edit first
+	undo, err := ot.Compose(inversion, tip.inversion)
+	if err != nil {
+		return false
+	}
+	original := tip
+	if tip.amends != nil {
+		original = tip.amends
+	}
+
+	h.revisions[h.current] = &Revision{
+		parent:    tip.parent,
+		lastChild: -1,
+		operation: composed,
+		inversion: undo,
+		lamport:   h.lamport,
+		timestamp: timestamp,
+		amends:    original,
+		site:      tip.site,
+		hlc:       h.clock.Now(),
+		version:   tip.version,
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package concordia
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// typeText inserts text one character at a time, like a user typing.
+func (e *historyEditor) typeText(pos int, text string) {
+	for i := range text {
+		e.insert(pos+i, text[i:i+1])
+	}
+}
+
+func TestHistory_GroupPolicy(t *testing.T) {
+	e := newHistoryEditor(t, "")
+	e.history.SetGroupPolicy(DefaultGroupPolicy(time.Minute))
+
+	e.typeText(0, "hello world.")
+	assert.Equal(t, 2, e.history.RevisionCount(), "one revision per word")
+
+	e.undo()
+	assert.Equal(t, "hello ", e.doc.String())
+	e.undo()
+	assert.Equal(t, "", e.doc.String())
+
+	// Redo, then type: the next word is not merged into the redone revision
+	e.apply(e.history.Redo(), false)
+	e.typeText(6, "there")
+	assert.Equal(t, 3, e.history.RevisionCount())
+	e.undo()
+	assert.Equal(t, "hello ", e.doc.String())
+}
+
+func TestHistory_ExplicitGroup(t *testing.T) {
+	e := newHistoryEditor(t, "a")
+	e.history.BeginGroup()
+	e.insert(0, "(")
+	e.insert(2, ")")
+	e.history.EndGroup()
+	e.insert(3, "!")
+
+	assert.Equal(t, "(a)!", e.doc.String())
+	assert.Equal(t, 2, e.history.RevisionCount())
+	e.undo()
+	e.undo()
+	assert.Equal(t, "a", e.doc.String())
+	assert.False(t, e.history.CanUndo())
+}
+
+func TestHistoryWriter_GroupedEdits(t *testing.T) {
+	e := newHistoryEditor(t, "")
+	e.history.SetGroupPolicy(ot.AdjacentEditsPolicy())
+
+	var file bytes.Buffer
+	w := NewHistoryWriter(&file, e.history)
+	for i, text := range []string{"a", "b", "c"} {
+		e.insert(i, text)
+		require.NoError(t, w.Sync())
+	}
+	e.insert(0, ">")
+	e.insert(4, "d")
+	require.NoError(t, w.Sync())
+
+	restored, err := LoadHistory(bytes.NewReader(file.Bytes()), e.doc)
+	require.NoError(t, err)
+	assertSameHistory(t, e.history, restored)
+	assert.Equal(t, 3, restored.RevisionCount())
+}
@@ -0,0 +1,876 @@
+// Package contents serves the Jupyter contents REST API, checkpoints
+// included, on top of a session.ContentStorage.
+//
+// Routes, relative to /api/contents:
+//
+//	GET    /{path}                   Get a file or list a directory
+//	PUT    /{path}                   Save a file, notebook or directory
+//	PATCH  /{path}                   Rename, body {"path": "new/path"}
+//	POST   /{dir}                    Create an untitled file, or copy one with {"copy_from": "path"}
+//	DELETE /{path}                   Delete
+//	GET    /{path}/checkpoints       List checkpoints
+//	POST   /{path}/checkpoints       Create a checkpoint
+//	POST   /{path}/checkpoints/{id}  Restore a checkpoint
+//	DELETE /{path}/checkpoints/{id}  Delete a checkpoint
+//
+// Requests are authenticated with a bearer token, or a token query
+// parameter, and answered with 401 without a valid one. An Authorizer
+// set with SetAuthorizer decides which paths a user may read or change;
+// requests for other paths are answered with 403.
+//
+// Errors are JSON {"message", "reason"} bodies with the status of
+// session.SessionError.StatusCode. Writes to files that are open in a
+// live edit session are applied as operations, see LiveEditor.
+package contents
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreseekdev/texere/pkg/session"
+	"github.com/coreseekdev/texere/pkg/transport"
+)
+
+// APIPrefix is the URL path the handler serves.
+const APIPrefix = "/api/contents"
+
+// Author is recorded as the author of operations and checkpoints made
+// through the contents API.
+const Author = "contents-api"
+
+// emptyNotebook is the content of new notebooks.
+const emptyNotebook = `{"cells":[],"metadata":{},"nbformat":4,"nbformat_minor":5}`
+
+var (
+	// ErrCheckpointsDisabled is returned by checkpoint endpoints when no
+	// history service is set.
+	ErrCheckpointsDisabled = &session.SessionError{Code: "not_implemented", Message: "checkpoints are not enabled"}
+
+	// ErrCheckpointDeletion is returned when deleting a checkpoint; the
+	// history service keeps every snapshot.
+	ErrCheckpointDeletion = &session.SessionError{Code: "not_implemented", Message: "checkpoints cannot be deleted"}
+)
+
+// LiveEditor gives access to the files open in live edit sessions.
+// *transport.ProtocolHandler implements it.
+type LiveEditor interface {
+	// ReadContent returns the content of a file's live session. live is
+	// false if the file has no live session.
+	ReadContent(filePath string) (content string, live bool)
+
+	// WriteContent applies a write of a whole file to its live session
+	// as an operation. live is false if the file has no live session.
+	WriteContent(filePath, content, author string) (revision int64, live bool, err error)
+}
+
+// Authorizer reports whether a user may access a path. write is set for
+// requests that change the path, or create, copy or rename to it.
+type Authorizer func(user *session.UserInfo, contentPath string, write bool) bool
+
+// Handler serves the contents API.
+type Handler struct {
+	mu             sync.Mutex
+	storage        session.ContentStorage
+	auth           session.Authenticator
+	authorize      Authorizer
+	history        transport.HistoryService
+	live           LiveEditor
+	sessionIDFunc  func(filePath string) string
+	nextCheckpoint map[string]int64 // history session ID -> next checkpoint version
+}
+
+// NewHandler creates a contents API handler over storage. Users are
+// authenticated with auth; without one every request is refused.
+func NewHandler(storage session.ContentStorage, auth session.Authenticator) *Handler {
+	return &Handler{
+		storage:        storage,
+		auth:           auth,
+		sessionIDFunc:  transport.ClusterSessionID,
+		nextCheckpoint: make(map[string]int64),
+	}
+}
+
+// SetHistory enables checkpoints, stored as snapshots in history.
+func (h *Handler) SetHistory(history transport.HistoryService) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.history = history
+}
+
+// SetSessionIDFunc sets the history session ID checkpoints of a file are
+// stored under. Defaults to transport.ClusterSessionID, so checkpoints sit
+// next to the snapshots of cluster-mode sessions.
+func (h *Handler) SetSessionIDFunc(fn func(filePath string) string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sessionIDFunc = fn
+}
+
+// SetLiveEditor sets the live sessions writes are applied to.
+func (h *Handler) SetLiveEditor(live LiveEditor) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.live = live
+}
+
+// SetAuthorizer sets who may access which paths. Without one every
+// authenticated user may read and change every path.
+func (h *Handler) SetAuthorizer(authorize Authorizer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.authorize = authorize
+}
+
+// Register registers the handler with mux under APIPrefix.
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.Handle(APIPrefix, h)
+	mux.Handle(APIPrefix+"/", h)
+}
+
+// ServeHTTP authenticates and routes a contents API request.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, err := h.authenticate(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	contentPath, err := cleanPath(strings.TrimPrefix(r.URL.Path, APIPrefix))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	filePath, id, isCheckpoint := checkpointPath(contentPath)
+	if !isCheckpoint {
+		filePath = contentPath
+	}
+	if err := h.checkAccess(user, filePath, r.Method != http.MethodGet); err != nil {
+		writeError(w, err)
+		return
+	}
+	if isCheckpoint {
+		h.serveCheckpoints(w, r, filePath, id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.handleGet(w, r, contentPath)
+	case http.MethodPut:
+		h.handlePut(w, r, contentPath)
+	case http.MethodPatch:
+		h.handlePatch(w, r, user, contentPath)
+	case http.MethodPost:
+		h.handlePost(w, r, user, contentPath)
+	case http.MethodDelete:
+		h.handleDelete(w, r, contentPath)
+	default:
+		methodNotAllowed(w, "GET, PUT, PATCH, POST, DELETE")
+	}
+}
+
+// authenticate returns the user of a request's token.
+func (h *Handler) authenticate(r *http.Request) (*session.UserInfo, error) {
+	token := r.URL.Query().Get("token")
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	if h.auth == nil || token == "" {
+		return nil, session.ErrUnauthorized
+	}
+	user, err := h.auth.Authenticate(r.Context(), token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", session.ErrUnauthorized, err)
+	}
+	return user, nil
+}
+
+// checkAccess returns ErrForbidden if the authorizer denies a user access
+// to a path.
+func (h *Handler) checkAccess(user *session.UserInfo, contentPath string, write bool) error {
+	h.mu.Lock()
+	authorize := h.authorize
+	h.mu.Unlock()
+
+	if authorize != nil && !authorize(user, contentPath, write) {
+		return fmt.Errorf("%w: %s may not access %s", session.ErrForbidden, user.UserID, contentPath)
+	}
+	return nil
+}
+
+// ========== Contents ==========
+
+// handleGet returns a file, or a directory with its listing.
+func (h *Handler) handleGet(w http.ResponseWriter, r *http.Request, contentPath string) {
+	model, err := h.model(r.Context(), contentPath, r.URL.Query().Get("content") != "0")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, model)
+}
+
+// handlePut saves a file, notebook or directory, creating it if needed.
+func (h *Handler) handlePut(w http.ResponseWriter, r *http.Request, contentPath string) {
+	ctx := r.Context()
+	if contentPath == "" {
+		writeError(w, fmt.Errorf("%w: cannot save the root directory", session.ErrInvalidRequest))
+		return
+	}
+	req, err := decodeRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	exists, err := h.storage.CheckExists(ctx, contentPath)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if req.Type == TypeDirectory {
+		err = h.storage.CreateDirectory(ctx, contentPath)
+	} else {
+		var content, format string
+		if content, format, err = decodeContent(req); err == nil {
+			err = h.write(ctx, contentPath, req.Type, format, content)
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if !exists {
+		status = http.StatusCreated
+	}
+	h.writeModel(w, ctx, status, contentPath)
+}
+
+// handlePatch renames a file or directory.
+func (h *Handler) handlePatch(w http.ResponseWriter, r *http.Request, user *session.UserInfo, contentPath string) {
+	ctx := r.Context()
+	req, err := decodeRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	newPath, err := cleanPath(req.Path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if contentPath == "" || newPath == "" {
+		writeError(w, fmt.Errorf("%w: cannot rename the root directory", session.ErrInvalidRequest))
+		return
+	}
+	if err := h.checkAccess(user, newPath, true); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if newPath != contentPath {
+		if exists, err := h.storage.CheckExists(ctx, newPath); err != nil || exists {
+			if err == nil {
+				err = fmt.Errorf("%w: %s", session.ErrAlreadyExists, newPath)
+			}
+			writeError(w, err)
+			return
+		}
+		if err := h.checkNotLive(contentPath); err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := h.storage.Rename(ctx, contentPath, newPath); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	h.writeModel(w, ctx, http.StatusOK, newPath)
+}
+
+// handlePost creates an untitled file, notebook or directory in a
+// directory, or copies a file into it.
+func (h *Handler) handlePost(w http.ResponseWriter, r *http.Request, user *session.UserInfo, dir string) {
+	ctx := r.Context()
+	stored, err := h.stat(ctx, dir)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if stored.Type != TypeDirectory {
+		writeError(w, fmt.Errorf("%w: %s is not a directory", session.ErrInvalidRequest, dir))
+		return
+	}
+	req, err := decodeRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var target string
+	if req.CopyFrom != "" {
+		target, err = h.copy(ctx, user, req.CopyFrom, dir)
+	} else {
+		target, err = h.create(ctx, dir, req)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", APIPrefix+"/"+target)
+	h.writeModel(w, ctx, http.StatusCreated, target)
+}
+
+// copy copies a file into dir as "name-Copy1.ext", "name-Copy2.ext", ...
+func (h *Handler) copy(ctx context.Context, user *session.UserInfo, copyFrom, dir string) (string, error) {
+	from, err := cleanPath(copyFrom)
+	if err != nil {
+		return "", err
+	}
+	if err := h.checkAccess(user, from, false); err != nil {
+		return "", err
+	}
+	stored, content, err := h.read(ctx, from)
+	if err != nil {
+		return "", err
+	}
+
+	ext := path.Ext(from)
+	stem := strings.TrimSuffix(path.Base("/"+from), ext)
+	target, err := h.uniqueName(ctx, dir, stem+"-Copy", "", ext, 1)
+	if err != nil {
+		return "", err
+	}
+	return target, h.write(ctx, target, stored.Type, stored.Format, content)
+}
+
+// create creates an untitled file, notebook or directory in dir.
+func (h *Handler) create(ctx context.Context, dir string, req *request) (string, error) {
+	switch req.Type {
+	case TypeDirectory:
+		target, err := h.uniqueName(ctx, dir, "Untitled Folder", " ", "", 0)
+		if err != nil {
+			return "", err
+		}
+		return target, h.storage.CreateDirectory(ctx, target)
+	case TypeNotebook:
+		target, err := h.uniqueName(ctx, dir, "Untitled", "", ".ipynb", 0)
+		if err != nil {
+			return "", err
+		}
+		return target, h.write(ctx, target, TypeNotebook, FormatJSON, emptyNotebook)
+	case TypeFile:
+		target, err := h.uniqueName(ctx, dir, "untitled", "", req.Ext, 0)
+		if err != nil {
+			return "", err
+		}
+		return target, h.write(ctx, target, TypeFile, FormatText, "")
+	default:
+		return "", fmt.Errorf("%w: unknown type %q", session.ErrInvalidRequest, req.Type)
+	}
+}
+
+// handleDelete deletes a file or directory.
+func (h *Handler) handleDelete(w http.ResponseWriter, r *http.Request, contentPath string) {
+	ctx := r.Context()
+	if contentPath == "" {
+		writeError(w, fmt.Errorf("%w: cannot delete the root directory", session.ErrInvalidRequest))
+		return
+	}
+	if _, err := h.stat(ctx, contentPath); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := h.checkNotLive(contentPath); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := h.storage.Delete(ctx, contentPath); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ========== Checkpoints ==========
+
+// serveCheckpoints routes a checkpoint request. id is empty for the
+// checkpoint collection of a file.
+func (h *Handler) serveCheckpoints(w http.ResponseWriter, r *http.Request, filePath, id string) {
+	h.mu.Lock()
+	history := h.history
+	h.mu.Unlock()
+	if history == nil {
+		writeError(w, ErrCheckpointsDisabled)
+		return
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		checkpoints, err := h.checkpoints(r.Context(), history, filePath)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, checkpoints)
+	case id == "" && r.Method == http.MethodPost:
+		checkpoint, err := h.createCheckpoint(r.Context(), history, filePath)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, checkpoint)
+	case id != "" && r.Method == http.MethodPost:
+		if err := h.restoreCheckpoint(r.Context(), history, filePath, id); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case id != "" && r.Method == http.MethodDelete:
+		writeError(w, ErrCheckpointDeletion)
+	case id == "":
+		methodNotAllowed(w, "GET, POST")
+	default:
+		methodNotAllowed(w, "POST, DELETE")
+	}
+}
+
+// checkpoints lists the checkpoints of a file, oldest first.
+func (h *Handler) checkpoints(ctx context.Context, history transport.HistoryService, filePath string) ([]*Checkpoint, error) {
+	if _, _, err := h.read(ctx, filePath); err != nil {
+		return nil, err
+	}
+	infos, err := history.ListSnapshots(ctx, h.sessionID(filePath))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].SnapshotVersion < infos[j].SnapshotVersion
+	})
+
+	checkpoints := make([]*Checkpoint, 0, len(infos))
+	for _, info := range infos {
+		checkpoints = append(checkpoints, &Checkpoint{
+			ID:           strconv.FormatInt(info.SnapshotVersion, 10),
+			LastModified: formatTime(info.LastSnapshotTime),
+		})
+	}
+	return checkpoints, nil
+}
+
+// createCheckpoint snapshots the current content of a file, including
+// edits of its live session.
+func (h *Handler) createCheckpoint(ctx context.Context, history transport.HistoryService, filePath string) (*Checkpoint, error) {
+	_, content, err := h.read(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	sessionID := h.sessionID(filePath)
+	infos, err := history.ListSnapshots(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshots are stored asynchronously; don't reuse a version handed
+	// out before it is listed
+	version := int64(0)
+	for _, info := range infos {
+		if info.SnapshotVersion >= version {
+			version = info.SnapshotVersion + 1
+		}
+	}
+	h.mu.Lock()
+	if next := h.nextCheckpoint[sessionID]; next > version {
+		version = next
+	}
+	h.nextCheckpoint[sessionID] = version + 1
+	h.mu.Unlock()
+
+	now := time.Now().Unix()
+	err = history.OnSnapshot(&transport.HistoryEvent{
+		SessionID: sessionID,
+		FilePath:  filePath,
+		EventType: "snapshot",
+		VersionID: version,
+		Content:   content,
+		CreatedAt: now,
+		CreatedBy: Author,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Checkpoint{ID: strconv.FormatInt(version, 10), LastModified: formatTime(now)}, nil
+}
+
+// restoreCheckpoint writes the content of a checkpoint back to its file.
+func (h *Handler) restoreCheckpoint(ctx context.Context, history transport.HistoryService, filePath, id string) error {
+	version, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid checkpoint id %q", session.ErrInvalidRequest, id)
+	}
+	stored, _, err := h.read(ctx, filePath)
+	if err != nil {
+		return err
+	}
+	snapshot, err := history.GetSnapshot(ctx, h.sessionID(filePath), version)
+	if err != nil {
+		return fmt.Errorf("%w: checkpoint %s of %s: %v", session.ErrNotFound, id, filePath, err)
+	}
+	return h.write(ctx, filePath, stored.Type, stored.Format, snapshot.Content)
+}
+
+// sessionID returns the history session ID of a file's checkpoints.
+func (h *Handler) sessionID(filePath string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sessionIDFunc(filePath)
+}
+
+// ========== Storage ==========
+
+// liveEditor returns the live editor, or nil.
+func (h *Handler) liveEditor() LiveEditor {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.live
+}
+
+// stat returns the stored model of a path. The root and directories that
+// only exist as the parent of other content are directories.
+func (h *Handler) stat(ctx context.Context, contentPath string) (*session.ContentModel, error) {
+	if contentPath == "" {
+		return &session.ContentModel{Type: TypeDirectory}, nil
+	}
+	stored, err := h.storage.Get(ctx, contentPath, nil)
+	if err == nil {
+		return stored, nil
+	}
+	if !isNotFound(err) {
+		return nil, err
+	}
+
+	items, listErr := h.storage.List(ctx, contentPath)
+	if listErr != nil {
+		return nil, listErr
+	}
+	for _, item := range items {
+		if strings.HasPrefix(item.Path, contentPath+"/") {
+			return &session.ContentModel{Type: TypeDirectory, Created: item.Modified, Modified: item.Modified}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", err, contentPath)
+}
+
+// read returns the stored model of a file and its current content, which
+// is the content of its live session if it has one.
+func (h *Handler) read(ctx context.Context, filePath string) (*session.ContentModel, string, error) {
+	stored, err := h.stat(ctx, filePath)
+	if err != nil {
+		return nil, "", err
+	}
+	if stored.Type == TypeDirectory {
+		return nil, "", fmt.Errorf("%w: %s is a directory", session.ErrInvalidRequest, filePath)
+	}
+	if live := h.liveEditor(); live != nil {
+		if content, ok := live.ReadContent(filePath); ok {
+			return stored, content, nil
+		}
+	}
+	return stored, stored.Content, nil
+}
+
+// write saves a file. If the file is open in a live session the write is
+// also applied to the session as an operation, so connected editors
+// receive it rather than overwriting it with their next save. Only text
+// files can be written while they are live. The live session is only
+// written once the file is saved, and the save is undone if the session
+// rejects the write, so the two never disagree.
+func (h *Handler) write(ctx context.Context, filePath, contentType, format, content string) error {
+	live := h.liveEditor()
+	writeLive := live != nil && contentType != TypeNotebook && format == FormatText
+	if live != nil && !writeLive {
+		if _, ok := live.ReadContent(filePath); ok {
+			return fmt.Errorf("%w: %s is open in a live session", session.ErrConflict, filePath)
+		}
+	}
+
+	model := &session.ContentModel{
+		Name:     path.Base("/" + filePath),
+		Type:     contentType,
+		Format:   format,
+		Content:  content,
+		Size:     int64(len(content)),
+		Metadata: make(map[string]interface{}),
+	}
+	existing, err := h.storage.Get(ctx, filePath, nil)
+	if err == nil {
+		if existing.Type == TypeDirectory {
+			return fmt.Errorf("%w: %s is a directory", session.ErrInvalidRequest, filePath)
+		}
+		model.Created = existing.Created
+		model.MimeType = existing.MimeType
+		model.ReadOnly = existing.ReadOnly
+	} else {
+		existing = nil
+	}
+	if model.ReadOnly {
+		return fmt.Errorf("%w: %s is read-only", session.ErrPermissionDenied, filePath)
+	}
+	options := &session.SaveOptions{Overwrite: true, CreateParents: true}
+	if _, err := h.storage.Save(ctx, filePath, model, options); err != nil {
+		return err
+	}
+	if !writeLive {
+		return nil
+	}
+
+	if _, _, err := live.WriteContent(filePath, content, Author); err != nil {
+		if existing != nil {
+			h.storage.Save(ctx, filePath, existing, options)
+		} else {
+			h.storage.Delete(ctx, filePath)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkNotLive returns a conflict if a file is open in a live session.
+func (h *Handler) checkNotLive(filePath string) error {
+	if live := h.liveEditor(); live != nil {
+		if _, ok := live.ReadContent(filePath); ok {
+			return fmt.Errorf("%w: %s is open in a live session", session.ErrConflict, filePath)
+		}
+	}
+	return nil
+}
+
+// model returns the API model of a path. Directories list their children
+// if withContent is set; files have the content of their live session.
+func (h *Handler) model(ctx context.Context, contentPath string, withContent bool) (*Model, error) {
+	stored, err := h.stat(ctx, contentPath)
+	if err != nil {
+		return nil, err
+	}
+	model := newModel(contentPath, stored, withContent)
+
+	if model.Type == TypeDirectory {
+		if withContent {
+			if model.Content, err = h.list(ctx, contentPath); err != nil {
+				return nil, err
+			}
+			format := FormatJSON
+			model.Format = &format
+		}
+		return model, nil
+	}
+
+	if live := h.liveEditor(); live != nil && (stored.Format == "" || stored.Format == FormatText) {
+		if content, ok := live.ReadContent(contentPath); ok {
+			size := int64(len(content))
+			model.Size = &size
+			if withContent {
+				model.Content = content
+			}
+		}
+	}
+	return model, nil
+}
+
+// list returns the children of a directory, sorted by name.
+func (h *Handler) list(ctx context.Context, dir string) ([]*Model, error) {
+	items, err := h.storage.List(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+
+	children := make(map[string]*Model)
+	for _, item := range items {
+		rel := strings.TrimPrefix(item.Path, prefix)
+		if item.Path == dir || rel == item.Path && prefix != "" {
+			continue
+		}
+		name, _, nested := strings.Cut(rel, "/")
+		if !nested {
+			children[name] = newItemModel(item)
+		} else if _, ok := children[name]; !ok {
+			// Parents of nested content are directories even if they
+			// were never created
+			children[name] = newItemModel(&session.ContentItem{
+				Path:     joinPath(dir, name),
+				Type:     TypeDirectory,
+				Modified: item.Modified,
+			})
+		}
+	}
+
+	models := make([]*Model, 0, len(children))
+	for _, model := range children {
+		models = append(models, model)
+	}
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].Name < models[j].Name
+	})
+	return models, nil
+}
+
+// uniqueName returns the path of the first name in dir that doesn't
+// exist: stem+ext for n == 0, then stem+sep+n+ext counting up from first.
+func (h *Handler) uniqueName(ctx context.Context, dir, stem, sep, ext string, first int) (string, error) {
+	for n := first; ; n++ {
+		name := stem + ext
+		if n > 0 {
+			name = stem + sep + strconv.Itoa(n) + ext
+		}
+		target := joinPath(dir, name)
+		exists, err := h.storage.CheckExists(ctx, target)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return target, nil
+		}
+	}
+}
+
+// writeModel writes the model of a path without its content.
+func (h *Handler) writeModel(w http.ResponseWriter, ctx context.Context, status int, contentPath string) {
+	model, err := h.model(ctx, contentPath, false)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, status, model)
+}
+
+// ========== Helpers ==========
+
+// cleanPath converts a URL or request path to a content path: relative,
+// without leading or trailing slashes. "" is the root directory.
+func cleanPath(p string) (string, error) {
+	p = strings.Trim(p, "/")
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." || segment == "." {
+			return "", fmt.Errorf("%w: invalid path %q", session.ErrInvalidRequest, p)
+		}
+	}
+	return p, nil
+}
+
+// checkpointPath splits "{path}/checkpoints" and "{path}/checkpoints/{id}".
+func checkpointPath(contentPath string) (filePath, id string, ok bool) {
+	segments := strings.Split(contentPath, "/")
+	n := len(segments)
+	switch {
+	case n >= 2 && segments[n-1] == "checkpoints":
+		return strings.Join(segments[:n-1], "/"), "", true
+	case n >= 3 && segments[n-2] == "checkpoints":
+		return strings.Join(segments[:n-2], "/"), segments[n-1], true
+	}
+	return "", "", false
+}
+
+// decodeRequest decodes a request body. An empty body is an empty
+// request; the type defaults to file.
+func decodeRequest(r *http.Request) (*request, error) {
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%w: %v", session.ErrInvalidRequest, err)
+	}
+	if req.Type == "" {
+		req.Type = TypeFile
+	}
+	return &req, nil
+}
+
+// decodeContent returns the content of a saved file or notebook as stored,
+// and its format.
+func decodeContent(req *request) (content, format string, err error) {
+	switch req.Type {
+	case TypeNotebook:
+		if len(req.Content) == 0 || string(req.Content) == "null" {
+			return emptyNotebook, FormatJSON, nil
+		}
+		var notebook map[string]interface{}
+		if err := json.Unmarshal(req.Content, &notebook); err != nil {
+			return "", "", fmt.Errorf("%w: notebook content must be a JSON object", session.ErrInvalidRequest)
+		}
+		return string(req.Content), FormatJSON, nil
+	case TypeFile:
+		format = req.Format
+		if format == "" {
+			format = FormatText
+		}
+		if format != FormatText && format != FormatBase64 {
+			return "", "", fmt.Errorf("%w: unknown format %q", session.ErrInvalidRequest, format)
+		}
+		if len(req.Content) > 0 {
+			if err := json.Unmarshal(req.Content, &content); err != nil {
+				return "", "", fmt.Errorf("%w: file content must be a string", session.ErrInvalidRequest)
+			}
+		}
+		if format == FormatBase64 {
+			if _, err := base64.StdEncoding.DecodeString(content); err != nil {
+				return "", "", fmt.Errorf("%w: invalid base64 content", session.ErrInvalidRequest)
+			}
+		}
+		return content, format, nil
+	default:
+		return "", "", fmt.Errorf("%w: unknown type %q", session.ErrInvalidRequest, req.Type)
+	}
+}
+
+// formatTime formats Unix seconds like Jupyter timestamps.
+func formatTime(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+// isNotFound returns true if err maps to 404.
+func isNotFound(err error) bool {
+	var sessionErr *session.SessionError
+	return errors.As(err, &sessionErr) && sessionErr.StatusCode() == http.StatusNotFound
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeError writes an error in the Jupyter format, with the status of
+// its SessionError; other errors are internal errors.
+func writeError(w http.ResponseWriter, err error) {
+	status, reason := http.StatusInternalServerError, "internal_error"
+	var sessionErr *session.SessionError
+	if errors.As(err, &sessionErr) {
+		status, reason = sessionErr.StatusCode(), sessionErr.Code
+	}
+	writeJSON(w, status, map[string]string{"message": err.Error(), "reason": reason})
+}
+
+// methodNotAllowed writes a 405 listing the allowed methods.
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"message": "method not allowed", "reason": "method_not_allowed"})
+}
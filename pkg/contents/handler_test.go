@@ -0,0 +1,301 @@
+package contents
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreseekdev/texere/pkg/session"
+	"github.com/coreseekdev/texere/pkg/transport"
+)
+
+// do sends a request to the handler and decodes a JSON response into out.
+func do(t *testing.T, h *Handler, method, path, body string, out interface{}) int {
+	t.Helper()
+	mux := http.NewServeMux()
+	h.Register(mux)
+
+	token, _ := h.auth.GenerateToken(context.Background(), "tester")
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if out != nil && rec.Body.Len() > 0 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: failed to decode %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+// TestHandler_Contents tests saving, reading, listing, renaming, copying and deleting.
+func TestHandler_Contents(t *testing.T) {
+	h := NewHandler(session.NewMemoryContentStorage(), session.NewTokenAuthenticator())
+
+	var model Model
+	if code := do(t, h, "PUT", "/api/contents/docs/a.txt", `{"type":"file","format":"text","content":"hello"}`, &model); code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", code)
+	}
+	if model.Name != "a.txt" || model.Path != "docs/a.txt" || model.Content != nil || *model.Size != 5 {
+		t.Errorf("Expected a.txt of 5 bytes without content, got %+v", model)
+	}
+	if code := do(t, h, "PUT", "/api/contents/docs/a.txt", `{"content":"hello world"}`, nil); code != http.StatusOK {
+		t.Errorf("Expected 200 for an update, got %d", code)
+	}
+
+	do(t, h, "GET", "/api/contents/docs/a.txt", "", &model)
+	if model.Content != "hello world" || *model.Format != FormatText || *model.MimeType != "text/plain" {
+		t.Errorf("Expected text content, got %+v", model)
+	}
+	if do(t, h, "GET", "/api/contents/docs/a.txt?content=0", "", &model); model.Content != nil || model.Format != nil {
+		t.Errorf("Expected no content, got %+v", model)
+	}
+
+	// docs was never created but holds a file
+	var root struct {
+		Type    string   `json:"type"`
+		Content []*Model `json:"content"`
+	}
+	do(t, h, "GET", "/api/contents", "", &root)
+	if root.Type != TypeDirectory || len(root.Content) != 1 || root.Content[0].Path != "docs" || root.Content[0].Type != TypeDirectory {
+		t.Errorf("Expected the root to list the docs directory, got %+v", root)
+	}
+
+	notebook := `{"cells":[{"cell_type":"code","source":"1"}],"metadata":{},"nbformat":4,"nbformat_minor":5}`
+	do(t, h, "PUT", "/api/contents/docs/n.ipynb", `{"type":"notebook","content":`+notebook+`}`, nil)
+	var nb struct {
+		Format  string                 `json:"format"`
+		Content map[string]interface{} `json:"content"`
+	}
+	do(t, h, "GET", "/api/contents/docs/n.ipynb", "", &nb)
+	if nb.Format != FormatJSON || nb.Content["nbformat"] != float64(4) {
+		t.Errorf("Expected the notebook as JSON, got %+v", nb)
+	}
+
+	// Rename, refusing to overwrite
+	var errBody struct{ Message, Reason string }
+	if code := do(t, h, "PATCH", "/api/contents/docs/a.txt", `{"path":"docs/n.ipynb"}`, &errBody); code != http.StatusConflict || errBody.Reason != "already_exists" {
+		t.Errorf("Expected 409 already_exists, got %d %+v", code, errBody)
+	}
+	if code := do(t, h, "PATCH", "/api/contents/docs/a.txt", `{"path":"docs/b.txt"}`, &model); code != http.StatusOK || model.Name != "b.txt" {
+		t.Errorf("Expected b.txt, got %d %+v", code, model)
+	}
+
+	// Create and copy
+	if code := do(t, h, "POST", "/api/contents/docs", `{"type":"file","ext":".md"}`, &model); code != http.StatusCreated || model.Path != "docs/untitled.md" {
+		t.Errorf("Expected docs/untitled.md, got %d %+v", code, model)
+	}
+	if do(t, h, "POST", "/api/contents/docs", `{"type":"file","ext":".md"}`, &model); model.Path != "docs/untitled1.md" {
+		t.Errorf("Expected docs/untitled1.md, got %s", model.Path)
+	}
+	if do(t, h, "POST", "/api/contents", `{"copy_from":"docs/b.txt"}`, &model); model.Path != "b-Copy1.txt" {
+		t.Errorf("Expected b-Copy1.txt, got %s", model.Path)
+	}
+	if do(t, h, "GET", "/api/contents/b-Copy1.txt", "", &model); model.Content != "hello world" {
+		t.Errorf("Expected the copied content, got %v", model.Content)
+	}
+
+	if code := do(t, h, "DELETE", "/api/contents/docs/b.txt", "", nil); code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", code)
+	}
+	if code := do(t, h, "GET", "/api/contents/docs/b.txt", "", &errBody); code != http.StatusNotFound || errBody.Reason != "not_found" {
+		t.Errorf("Expected 404 not_found, got %d %+v", code, errBody)
+	}
+	if code := do(t, h, "PATCH", "/api/contents/docs/n.ipynb", `{"path":"../secret"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a relative path, got %d", code)
+	}
+}
+
+// TestHandler_Checkpoints tests creating, listing and restoring checkpoints.
+func TestHandler_Checkpoints(t *testing.T) {
+	h := NewHandler(session.NewMemoryContentStorage(), session.NewTokenAuthenticator())
+	do(t, h, "PUT", "/api/contents/c.txt", `{"content":"first"}`, nil)
+
+	if code := do(t, h, "POST", "/api/contents/c.txt/checkpoints", "", nil); code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 without a history service, got %d", code)
+	}
+
+	history := transport.NewMemoryHistoryService(true)
+	defer history.Close()
+	h.SetHistory(history)
+
+	var first, second Checkpoint
+	if code := do(t, h, "POST", "/api/contents/c.txt/checkpoints", "", &first); code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", code)
+	}
+	do(t, h, "PUT", "/api/contents/c.txt", `{"content":"second"}`, nil)
+	do(t, h, "POST", "/api/contents/c.txt/checkpoints", "", &second)
+	if first.ID != "0" || second.ID != "1" {
+		t.Errorf("Expected checkpoints 0 and 1, got %s and %s", first.ID, second.ID)
+	}
+
+	var checkpoints []*Checkpoint
+	for i := 0; i < 100 && len(checkpoints) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		do(t, h, "GET", "/api/contents/c.txt/checkpoints", "", &checkpoints)
+	}
+	if !reflect.DeepEqual(checkpoints, []*Checkpoint{&first, &second}) {
+		t.Fatalf("Expected both checkpoints, got %v", checkpoints)
+	}
+
+	do(t, h, "PUT", "/api/contents/c.txt", `{"content":"third"}`, nil)
+	if code := do(t, h, "POST", "/api/contents/c.txt/checkpoints/0", "", nil); code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+	var model Model
+	if do(t, h, "GET", "/api/contents/c.txt", "", &model); model.Content != "first" {
+		t.Errorf("Expected the restored content, got %v", model.Content)
+	}
+
+	if code := do(t, h, "POST", "/api/contents/c.txt/checkpoints/7", "", nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown checkpoint, got %d", code)
+	}
+	if code := do(t, h, "DELETE", "/api/contents/c.txt/checkpoints/0", "", nil); code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 for deleting a checkpoint, got %d", code)
+	}
+}
+
+// liveEditor is a LiveEditor with one file open.
+type liveEditor struct {
+	filePath string
+	content  string
+	writes   int
+	err      error // Returned by WriteContent if set
+}
+
+func (e *liveEditor) ReadContent(filePath string) (string, bool) {
+	return e.content, filePath == e.filePath
+}
+
+func (e *liveEditor) WriteContent(filePath, content, author string) (int64, bool, error) {
+	if filePath != e.filePath {
+		return 0, false, nil
+	}
+	if e.err != nil {
+		return 0, true, e.err
+	}
+	e.content = content
+	e.writes++
+	return int64(e.writes), true, nil
+}
+
+// TestHandler_LiveSession tests that files open in live sessions are written through the session.
+func TestHandler_LiveSession(t *testing.T) {
+	h := NewHandler(session.NewMemoryContentStorage(), session.NewTokenAuthenticator())
+	do(t, h, "PUT", "/api/contents/live.txt", `{"content":"saved"}`, nil)
+
+	editor := &liveEditor{filePath: "live.txt", content: "saved, then edited"}
+	h.SetLiveEditor(editor)
+
+	var model Model
+	if do(t, h, "GET", "/api/contents/live.txt", "", &model); model.Content != "saved, then edited" {
+		t.Errorf("Expected the live content, got %v", model.Content)
+	}
+
+	do(t, h, "PUT", "/api/contents/live.txt", `{"content":"from rest"}`, nil)
+	if editor.writes != 1 || editor.content != "from rest" {
+		t.Errorf("Expected one write to the session, got %d with %q", editor.writes, editor.content)
+	}
+
+	if code := do(t, h, "PUT", "/api/contents/live.txt", `{"format":"base64","content":"AAE="}`, nil); code != http.StatusConflict {
+		t.Errorf("Expected 409 for a binary write, got %d", code)
+	}
+	if code := do(t, h, "DELETE", "/api/contents/live.txt", "", nil); code != http.StatusConflict {
+		t.Errorf("Expected 409 for deleting a live file, got %d", code)
+	}
+
+	// A write the session rejects is not saved either
+	editor.err = &session.SessionError{Code: "document_too_large", Message: "too large"}
+	do(t, h, "PUT", "/api/contents/live.txt", `{"content":"rejected"}`, nil)
+	if stored, _ := h.storage.Get(context.Background(), "live.txt", nil); stored.Content != "from rest" {
+		t.Errorf("Expected the stored content to be kept, got %q", stored.Content)
+	}
+	editor.err = nil
+
+	// Read-only files are refused before the session is written
+	stored, _ := h.storage.Get(context.Background(), "live.txt", nil)
+	stored.ReadOnly = true
+	h.storage.Save(context.Background(), "live.txt", stored, &session.SaveOptions{Overwrite: true})
+	if code := do(t, h, "PUT", "/api/contents/live.txt", `{"content":"read-only"}`, nil); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a read-only file, got %d", code)
+	}
+	if editor.writes != 1 || editor.content != "from rest" {
+		t.Errorf("Expected the session to be untouched, got %d writes with %q", editor.writes, editor.content)
+	}
+}
+
+// TestHandler_Authorizer tests that the authorizer decides which paths a
+// user may read and change.
+func TestHandler_Authorizer(t *testing.T) {
+	h := NewHandler(session.NewMemoryContentStorage(), session.NewTokenAuthenticator())
+	do(t, h, "PUT", "/api/contents/shared/notes.txt", `{"content":"notes"}`, nil)
+	do(t, h, "PUT", "/api/contents/private/secret.txt", `{"content":"secret"}`, nil)
+
+	// Only shared/ may be read or changed
+	h.SetAuthorizer(func(user *session.UserInfo, contentPath string, write bool) bool {
+		if user.UserID != "tester" {
+			return false
+		}
+		return strings.HasPrefix(contentPath, "shared")
+	})
+
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", "/api/contents/shared/notes.txt", "", http.StatusOK},
+		{"PUT", "/api/contents/shared/notes.txt", `{"content":"more notes"}`, http.StatusOK},
+		{"GET", "/api/contents/private/secret.txt", "", http.StatusForbidden},
+		{"PUT", "/api/contents/private/secret.txt", `{"content":"leaked"}`, http.StatusForbidden},
+		{"DELETE", "/api/contents/private/secret.txt", "", http.StatusForbidden},
+		{"GET", "/api/contents/private/secret.txt/checkpoints", "", http.StatusForbidden},
+		{"PATCH", "/api/contents/shared/notes.txt", `{"path":"private/notes.txt"}`, http.StatusForbidden},
+		{"POST", "/api/contents/shared", `{"copy_from":"private/secret.txt"}`, http.StatusForbidden},
+		{"POST", "/api/contents/shared", `{"copy_from":"shared/notes.txt"}`, http.StatusCreated},
+	} {
+		if code := do(t, h, tc.method, tc.path, tc.body, nil); code != tc.code {
+			t.Errorf("%s %s: expected %d, got %d", tc.method, tc.path, tc.code, code)
+		}
+	}
+}
+
+// TestHandler_Authentication tests that requests need a valid token.
+func TestHandler_Authentication(t *testing.T) {
+	auth := session.NewTokenAuthenticator()
+	h := NewHandler(session.NewMemoryContentStorage(), auth)
+	mux := http.NewServeMux()
+	h.Register(mux)
+	token, _ := auth.GenerateToken(context.Background(), "alice")
+
+	for _, tc := range []struct {
+		name, path, header string
+		code               int
+	}{
+		{"no token", "/api/contents/", "", http.StatusUnauthorized},
+		{"invalid token", "/api/contents/", "Bearer bogus", http.StatusUnauthorized},
+		{"bearer token", "/api/contents/", "Bearer " + token, http.StatusOK},
+		{"query token", "/api/contents/?token=" + token, "", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.code, rec.Code)
+		}
+	}
+
+	anonymous := NewHandler(session.NewMemoryContentStorage(), nil)
+	rec := httptest.NewRecorder()
+	anonymous.ServeHTTP(rec, httptest.NewRequest("GET", "/api/contents/?token="+token, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without an authenticator, got %d", rec.Code)
+	}
+}
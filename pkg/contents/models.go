@@ -0,0 +1,135 @@
+package contents
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+
+	"github.com/coreseekdev/texere/pkg/session"
+)
+
+// ========== Models ==========
+
+// Content types and formats of the Jupyter contents API.
+const (
+	TypeFile      = "file"
+	TypeDirectory = "directory"
+	TypeNotebook  = "notebook"
+
+	FormatText   = "text"
+	FormatBase64 = "base64"
+	FormatJSON   = "json"
+)
+
+// Model is a file, notebook or directory as returned by the Jupyter
+// contents API. Content, Format and MimeType are null when the content
+// was not requested; Size is null for directories.
+type Model struct {
+	Name         string      `json:"name"`
+	Path         string      `json:"path"`
+	Type         string      `json:"type"`
+	Writable     bool        `json:"writable"`
+	Created      string      `json:"created"`
+	LastModified string      `json:"last_modified"`
+	Size         *int64      `json:"size"`
+	MimeType     *string     `json:"mimetype"`
+	Content      interface{} `json:"content"`
+	Format       *string     `json:"format"`
+}
+
+// Checkpoint is a saved version of a file.
+type Checkpoint struct {
+	ID           string `json:"id"`
+	LastModified string `json:"last_modified"`
+}
+
+// request is the body of PUT, PATCH and POST requests.
+type request struct {
+	Path     string          `json:"path"`
+	Type     string          `json:"type"`
+	Format   string          `json:"format"`
+	Content  json.RawMessage `json:"content"`
+	CopyFrom string          `json:"copy_from"`
+	Ext      string          `json:"ext"`
+}
+
+// newModel converts a stored content model to its API model. The content
+// is included if withContent is set.
+func newModel(contentPath string, stored *session.ContentModel, withContent bool) *Model {
+	model := &Model{
+		Name:         path.Base("/" + contentPath),
+		Path:         contentPath,
+		Type:         stored.Type,
+		Writable:     !stored.ReadOnly,
+		Created:      stored.Created,
+		LastModified: stored.Modified,
+	}
+	if model.Type == "" {
+		model.Type = TypeFile
+	}
+	if model.Type == TypeDirectory {
+		return model
+	}
+
+	size := stored.Size
+	model.Size = &size
+	if !withContent {
+		return model
+	}
+
+	format := stored.Format
+	if format == "" {
+		format = FormatText
+	}
+	if model.Type == TypeNotebook {
+		format = FormatJSON
+		model.Content = json.RawMessage(stored.Content)
+		if !json.Valid([]byte(stored.Content)) {
+			model.Content = nil
+		}
+	} else {
+		model.Content = stored.Content
+		model.MimeType = mimeType(stored, format)
+	}
+	model.Format = &format
+	return model
+}
+
+// newItemModel converts a directory listing entry to its API model.
+func newItemModel(item *session.ContentItem) *Model {
+	return newModel(item.Path, &session.ContentModel{
+		Type:     item.Type,
+		Size:     item.Size,
+		Created:  item.Modified,
+		Modified: item.Modified,
+		MimeType: item.MimeType,
+	}, false)
+}
+
+// mimeType returns the MIME type of a file, defaulting by format.
+func mimeType(stored *session.ContentModel, format string) *string {
+	mime := stored.MimeType
+	if mime == "" {
+		mime = "text/plain"
+		if format == FormatBase64 {
+			mime = "application/octet-stream"
+		}
+	}
+	return &mime
+}
+
+// parentDir returns the directory containing contentPath; "" is the root.
+func parentDir(contentPath string) string {
+	if i := strings.LastIndex(contentPath, "/"); i >= 0 {
+		return contentPath[:i]
+	}
+	return ""
+}
+
+// joinPath joins a directory and a name; the root is "".
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
@@ -0,0 +1,178 @@
+package crdt
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+)
+
+// Bridge lets CRDT peers and OT clients edit the same document.
+//
+// The server keeps a CRDT replica of the document next to its OT state.
+// Updates from CRDT peers are applied to the replica and turned into
+// ot.Operations for OT clients; operations from OT clients are applied
+// to the replica and turned into updates for CRDT peers. Every edit of
+// the document must go through the bridge, in the order the server
+// applies it, so that the replica and the OT document stay the same.
+//
+// Positions are counted in runes, which matches ot.js positions for text
+// in the Basic Multilingual Plane.
+//
+// Example:
+//
+//	bridge := crdt.NewBridge(session.GetContent())
+//
+//	// From a CRDT peer
+//	op, _ := bridge.ApplyUpdate(update)
+//
+//	// From an ot.js client
+//	update, _ := bridge.ApplyOperation(op)
+type Bridge struct {
+	doc *Doc
+}
+
+// NewBridge creates a bridge for a document with the given content.
+// The replica gets a new client ID; CRDT peers must sync with it, see
+// Doc.EncodeStateAsUpdate, before they edit.
+func NewBridge(content string) *Bridge {
+	doc := NewDoc(NewClientID())
+	doc.Insert(0, content)
+	return &Bridge{doc: doc}
+}
+
+// Doc returns the server's replica.
+func (b *Bridge) Doc() *Doc {
+	return b.doc
+}
+
+// ApplyUpdate applies an update from a CRDT peer and returns the
+// equivalent operation on the document before the update.
+// The operation is nil if the visible text did not change.
+func (b *Bridge) ApplyUpdate(update []byte) (*ot.Operation, error) {
+	items, ds, err := decodeUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+
+	b.doc.mu.Lock()
+	defer b.doc.mu.Unlock()
+
+	length := b.doc.text.Length()
+	changes := b.doc.applyUpdate(items, ds)
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	return changesToOperation(length, changes), nil
+}
+
+// ApplyOperation applies an operation from an OT client and returns the
+// update to send to CRDT peers.
+func (b *Bridge) ApplyOperation(op *ot.Operation) ([]byte, error) {
+	d := b.doc
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if op.BaseLength() != d.text.Length() {
+		return nil, ot.ErrInvalidBaseLength
+	}
+
+	before := d.stateVector()
+	ds := make(deleteSet)
+	pos := 0
+	for _, component := range op.ToJSON() {
+		switch v := component.(type) {
+		case int:
+			if v > 0 {
+				pos += v
+			} else if err := d.delete(pos, -v, ds); err != nil {
+				return nil, err
+			}
+		case string:
+			if err := d.insert(pos, v); err != nil {
+				return nil, err
+			}
+			pos += utf8.RuneCountInString(v)
+		default:
+			return nil, fmt.Errorf("crdt: unexpected operation component %T", component)
+		}
+	}
+	return d.encodeUpdate(before, ds), nil
+}
+
+// piece is a part of the text during changesToOperation: either a range
+// of the original text or inserted text.
+type piece struct {
+	start  int    // Start in the original text; -1 for inserted text
+	length int    // Length in characters
+	text   []rune // Inserted text
+}
+
+// changesToOperation turns sequential changes of a text of the given
+// length into a single operation.
+func changesToOperation(length int, changes []Change) *ot.Operation {
+	pieces := []piece{{start: 0, length: length}}
+	for _, c := range changes {
+		pieces = splitPieces(pieces, c.Pos)
+		pieces = splitPieces(pieces, c.Pos+c.Delete)
+
+		// Replace the pieces in [Pos, Pos+Delete) with the inserted text
+		var out []piece
+		pos := 0
+		inserted := false
+		for _, p := range pieces {
+			if pos == c.Pos && !inserted {
+				if c.Insert != "" {
+					text := []rune(c.Insert)
+					out = append(out, piece{start: -1, length: len(text), text: text})
+				}
+				inserted = true
+			}
+			if pos < c.Pos || pos >= c.Pos+c.Delete {
+				out = append(out, p)
+			}
+			pos += p.length
+		}
+		if !inserted && c.Insert != "" {
+			text := []rune(c.Insert)
+			out = append(out, piece{start: -1, length: len(text), text: text})
+		}
+		pieces = out
+	}
+
+	builder := ot.NewBuilder()
+	pos := 0
+	for _, p := range pieces {
+		if p.start < 0 {
+			builder.Insert(string(p.text))
+			continue
+		}
+		builder.Delete(p.start - pos)
+		builder.Retain(p.length)
+		pos = p.start + p.length
+	}
+	builder.Delete(length - pos)
+	return builder.Build()
+}
+
+// splitPieces splits the piece spanning pos so that a piece starts there.
+func splitPieces(pieces []piece, pos int) []piece {
+	offset := 0
+	for i, p := range pieces {
+		if pos > offset && pos < offset+p.length {
+			n := pos - offset
+			left, right := p, p
+			left.length = n
+			right.length = p.length - n
+			if p.start < 0 {
+				left.text, right.text = p.text[:n], p.text[n:]
+			} else {
+				right.start = p.start + n
+			}
+			out := append(append(append([]piece{}, pieces[:i]...), left, right), pieces[i+1:]...)
+			return out
+		}
+		offset += p.length
+	}
+	return pieces
+}
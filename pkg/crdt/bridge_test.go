@@ -0,0 +1,108 @@
+package crdt
+
+import (
+	"testing"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBridge_UpdateToOperation(t *testing.T) {
+	bridge := NewBridge("Hello World")
+	content := "Hello World"
+
+	peer := NewDoc(1)
+	syncDocs(t, peer, bridge.Doc())
+
+	// Several changes in one update become one operation
+	before := peer.StateVector()
+	peer.Delete(0, 5)
+	peer.Insert(0, "Goodbye")
+	peer.Insert(peer.Length(), "!")
+	update := peer.EncodeStateAsUpdate(before)
+
+	op, err := bridge.ApplyUpdate(update)
+	require.NoError(t, err)
+	assert.Equal(t, len(content), op.BaseLength())
+	content, err = op.Apply(content)
+	require.NoError(t, err)
+	assert.Equal(t, "Goodbye World!", content)
+	assert.Equal(t, content, bridge.Doc().String())
+
+	// An update without visible changes yields no operation
+	op, err = bridge.ApplyUpdate(update)
+	require.NoError(t, err)
+	assert.Nil(t, op)
+}
+
+func TestBridge_OperationToUpdate(t *testing.T) {
+	bridge := NewBridge("Hello World")
+	peer := NewDoc(1)
+	syncDocs(t, peer, bridge.Doc())
+
+	// An ot.js client replaces "World" with "Gophers"
+	op := ot.NewBuilder().Retain(6).Delete(5).Insert("Gophers").Build()
+	update, err := bridge.ApplyOperation(op)
+	require.NoError(t, err)
+
+	_, err = peer.ApplyUpdate(update)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello Gophers", peer.String())
+
+	_, err = bridge.ApplyOperation(ot.NewBuilder().Retain(3).Build())
+	assert.ErrorIs(t, err, ot.ErrInvalidBaseLength)
+}
+
+func TestBridge_ConcurrentPeers(t *testing.T) {
+	bridge := NewBridge("line\n")
+	content := "line\n"
+	phone := NewDoc(1)
+	syncDocs(t, phone, bridge.Doc())
+
+	// The phone edits offline while an OT client edits on the server
+	offline := phone.StateVector()
+	phone.Insert(0, "first ")
+	phone.Insert(phone.Length(), "offline\n")
+
+	op := ot.NewBuilder().Retain(5).Insert("online\n").Build()
+	content, _ = op.Apply(content)
+	update, err := bridge.ApplyOperation(op)
+	require.NoError(t, err)
+
+	// The phone comes back: both sides merge
+	op, err = bridge.ApplyUpdate(phone.EncodeStateAsUpdate(offline))
+	require.NoError(t, err)
+	content, err = op.Apply(content)
+	require.NoError(t, err)
+	_, err = phone.ApplyUpdate(update)
+	require.NoError(t, err)
+
+	assert.Equal(t, bridge.Doc().String(), content)
+	assert.Equal(t, bridge.Doc().String(), phone.String())
+	assert.Contains(t, content, "first line\n")
+}
+
+func TestChangesToOperation(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		changes []Change
+		want    string
+	}{
+		{"insert", "abc", []Change{{Pos: 1, Insert: "X"}}, "aXbc"},
+		{"delete inserted", "abc", []Change{{Pos: 1, Insert: "XYZ"}, {Pos: 2, Delete: 1}}, "aXZbc"},
+		{"delete across", "abcdef", []Change{{Pos: 2, Insert: "X"}, {Pos: 1, Delete: 3}, {Pos: 0, Insert: "<"}}, "<adef"},
+		{"append", "ab", []Change{{Pos: 2, Insert: "c"}, {Pos: 3, Insert: "d"}}, "abcd"},
+		{"empty", "", []Change{{Pos: 0, Insert: "x"}}, "x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op := changesToOperation(len(tt.text), tt.changes)
+			result, err := op.Apply(tt.text)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, result)
+		})
+	}
+}
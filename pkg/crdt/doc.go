@@ -0,0 +1,591 @@
+// Package crdt implements a sequence CRDT for plain text.
+//
+// Unlike OT, a CRDT does not need a central server to order edits: every
+// replica can edit offline and exchange updates in any order, and all
+// replicas that have seen the same updates have the same text.
+//
+// The algorithm is YATA, as used by Yjs. Every character has a unique ID
+// (client, clock) and remembers its left and right neighbours at the time
+// it was inserted. Concurrent insertions at the same place are ordered by
+// those origins and the client IDs. Consecutive characters typed by one
+// client are stored as a single item.
+//
+// The visible text is stored in a rope.Rope; items only hold lengths.
+// Deleted text is dropped immediately, and its items stay in the list as
+// tombstones so that later insertions can still refer to them.
+//
+// Example:
+//
+//	alice := crdt.NewDoc(1)
+//	bob := crdt.NewDoc(2)
+//
+//	update, _ := alice.Insert(0, "Hello")
+//	bob.ApplyUpdate(update)
+//
+//	// Offline edits, exchanged later
+//	u1, _ := alice.Insert(5, "!")
+//	u2, _ := bob.Insert(5, " World")
+//	alice.ApplyUpdate(u2)
+//	bob.ApplyUpdate(u1)
+//	// Both now read "Hello World!" or "Hello! World"
+package crdt
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coreseekdev/texere/pkg/rope"
+)
+
+var (
+	// ErrOutOfRange is returned when an edit position is outside the text.
+	ErrOutOfRange = errors.New("crdt: position out of range")
+
+	// ErrInvalidUpdate is returned when an update or state vector cannot be decoded.
+	ErrInvalidUpdate = errors.New("crdt: invalid update")
+)
+
+// ID identifies a character: the client that inserted it and the
+// client's clock when it did. Each client's clock counts the characters
+// it has inserted.
+type ID struct {
+	Client uint64
+	Clock  uint64
+}
+
+// NewClientID returns a random client ID.
+// Each replica needs its own ID; reusing one corrupts documents.
+func NewClientID() uint64 {
+	return rand.New(rand.NewSource(time.Now().UnixNano())).Uint64()
+}
+
+// Change is a change of the visible text, caused by applying an update.
+// Changes apply one after the other: Pos refers to the text after the
+// previous change.
+type Change struct {
+	Pos    int    // Position in characters
+	Delete int    // Number of characters deleted at Pos
+	Insert string // Text inserted at Pos
+}
+
+// item is a run of characters inserted by one client with consecutive clocks.
+type item struct {
+	id          ID
+	length      int
+	origin      *ID // Last character to the left when inserted; nil at the start
+	rightOrigin *ID // First character to the right when inserted; nil at the end
+	deleted     bool
+	left, right *item
+}
+
+// lastID returns the ID of the item's last character.
+func (it *item) lastID() ID {
+	return ID{Client: it.id.Client, Clock: it.id.Clock + uint64(it.length) - 1}
+}
+
+// itemRecord is an item as transmitted in an update.
+type itemRecord struct {
+	id          ID
+	length      int
+	origin      *ID
+	rightOrigin *ID
+	deleted     bool
+	content     string // Text of a visible item
+}
+
+// Doc is a replica of a CRDT text document.
+// It is safe for concurrent use.
+type Doc struct {
+	mu      sync.Mutex
+	client  uint64
+	start   *item              // First item in document order
+	clients map[uint64][]*item // Items of each client, sorted by clock
+	text    *rope.Rope         // Visible text
+
+	pendingItems   []itemRecord // Items waiting for missing dependencies
+	pendingDeletes deleteSet    // Deletions of items not received yet
+}
+
+// NewDoc creates an empty document for the given client.
+func NewDoc(client uint64) *Doc {
+	return &Doc{
+		client:         client,
+		clients:        make(map[uint64][]*item),
+		text:           rope.New(""),
+		pendingDeletes: make(deleteSet),
+	}
+}
+
+// ClientID returns the client ID of this replica.
+func (d *Doc) ClientID() uint64 {
+	return d.client
+}
+
+// Text returns the visible text.
+func (d *Doc) Text() *rope.Rope {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.text
+}
+
+// String returns the visible text as a string.
+func (d *Doc) String() string {
+	return d.Text().String()
+}
+
+// Length returns the length of the visible text in characters.
+func (d *Doc) Length() int {
+	return d.Text().Length()
+}
+
+// Insert inserts text at pos and returns the update to send to other replicas.
+func (d *Doc) Insert(pos int, text string) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	before := d.stateVector()
+	if err := d.insert(pos, text); err != nil {
+		return nil, err
+	}
+	return d.encodeUpdate(before, nil), nil
+}
+
+// Delete deletes length characters at pos and returns the update to send
+// to other replicas.
+func (d *Doc) Delete(pos, length int) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ds := make(deleteSet)
+	if err := d.delete(pos, length, ds); err != nil {
+		return nil, err
+	}
+	return d.encodeUpdate(d.stateVector(), ds), nil
+}
+
+// ApplyUpdate applies an update from another replica and returns the
+// resulting changes of the visible text.
+//
+// Updates may arrive in any order and more than once. Parts of an update
+// that depend on updates not received yet are kept until those arrive.
+func (d *Doc) ApplyUpdate(update []byte) ([]Change, error) {
+	items, ds, err := decodeUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.applyUpdate(items, ds), nil
+}
+
+// applyUpdate integrates decoded items and deletions.
+func (d *Doc) applyUpdate(items []itemRecord, ds deleteSet) []Change {
+	d.pendingItems = append(d.pendingItems, items...)
+	d.pendingDeletes.merge(ds)
+
+	changes := d.integratePending()
+	return append(changes, d.applyPendingDeletes()...)
+}
+
+// Pending returns true if some received updates wait for missing ones.
+func (d *Doc) Pending() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.pendingItems) > 0 || len(d.pendingDeletes) > 0
+}
+
+// GC compacts tombstones: runs of deleted characters that were inserted
+// together are merged into a single item. Returns the number of items removed.
+func (d *Doc) GC() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	removed := 0
+	for it := d.start; it != nil; {
+		if it.deleted && d.tryMerge(it) {
+			removed++
+			continue
+		}
+		it = it.right
+	}
+	return removed
+}
+
+// ItemCount returns the number of items, including tombstones.
+func (d *Doc) ItemCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := 0
+	for _, items := range d.clients {
+		n += len(items)
+	}
+	return n
+}
+
+// ========== Local Edits ==========
+
+// insert inserts text at pos as the local client.
+func (d *Doc) insert(pos int, text string) error {
+	if text == "" {
+		return nil
+	}
+	left, right, err := d.position(pos)
+	if err != nil {
+		return err
+	}
+
+	rec := itemRecord{
+		id:      ID{Client: d.client, Clock: d.clock(d.client)},
+		length:  utf8.RuneCountInString(text),
+		content: text,
+	}
+	if left != nil {
+		origin := left.lastID()
+		rec.origin = &origin
+	}
+	if right != nil {
+		rightOrigin := right.id
+		rec.rightOrigin = &rightOrigin
+	}
+	d.integrate(rec)
+	return nil
+}
+
+// delete deletes length visible characters at pos and records them in ds.
+func (d *Doc) delete(pos, length int, ds deleteSet) error {
+	if length <= 0 {
+		return nil
+	}
+	if pos < 0 || pos+length > d.text.Length() {
+		return ErrOutOfRange
+	}
+
+	_, it, err := d.position(pos)
+	if err != nil {
+		return err
+	}
+	for remaining := length; it != nil && remaining > 0; it = it.right {
+		if it.deleted {
+			continue
+		}
+		if remaining < it.length {
+			d.split(it, remaining)
+		}
+		it.deleted = true
+		ds.add(it.id.Client, it.id.Clock, uint64(it.length))
+		remaining -= it.length
+	}
+
+	text, err := d.text.Delete(pos, pos+length)
+	if err != nil {
+		return err
+	}
+	d.text = text
+	return nil
+}
+
+// position finds the items around visible position pos: left is the
+// visible item ending at pos, right the item after it. An item that
+// spans pos is split.
+func (d *Doc) position(pos int) (left, right *item, err error) {
+	if pos < 0 || pos > d.text.Length() {
+		return nil, nil, ErrOutOfRange
+	}
+	right = d.start
+	for count := pos; right != nil && count > 0; left, right = right, right.right {
+		if right.deleted {
+			continue
+		}
+		if count < right.length {
+			d.split(right, count)
+		}
+		count -= right.length
+	}
+	return left, right, nil
+}
+
+// ========== Integration ==========
+
+// integratePending integrates the pending items whose dependencies are known.
+func (d *Doc) integratePending() []Change {
+	sort.SliceStable(d.pendingItems, func(i, j int) bool {
+		a, b := d.pendingItems[i].id, d.pendingItems[j].id
+		if a.Client != b.Client {
+			return a.Client < b.Client
+		}
+		return a.Clock < b.Clock
+	})
+
+	var changes []Change
+	for progress := true; progress; {
+		progress = false
+		pending := d.pendingItems[:0]
+		for _, rec := range d.pendingItems {
+			clock := d.clock(rec.id.Client)
+			switch {
+			case rec.id.Clock+uint64(rec.length) <= clock:
+				// Already integrated
+				progress = true
+			case rec.id.Clock > clock || !d.knows(rec.origin) || !d.knows(rec.rightOrigin):
+				pending = append(pending, rec)
+			default:
+				if change, ok := d.integrate(trimRecord(rec, clock)); ok {
+					changes = append(changes, change)
+				}
+				progress = true
+			}
+		}
+		d.pendingItems = pending
+	}
+	return changes
+}
+
+// trimRecord drops the characters of rec before clock, which are known.
+func trimRecord(rec itemRecord, clock uint64) itemRecord {
+	if rec.id.Clock >= clock {
+		return rec
+	}
+	offset := int(clock - rec.id.Clock)
+	rec.origin = &ID{Client: rec.id.Client, Clock: clock - 1}
+	rec.id.Clock = clock
+	rec.length -= offset
+	if !rec.deleted {
+		rec.content = string([]rune(rec.content)[offset:])
+	}
+	return rec
+}
+
+// integrate inserts an item whose dependencies are known into the list,
+// resolving conflicts with concurrent insertions between its origins.
+// Returns the change of the visible text, if any.
+func (d *Doc) integrate(rec itemRecord) (Change, bool) {
+	it := &item{
+		id:          rec.id,
+		length:      rec.length,
+		origin:      rec.origin,
+		rightOrigin: rec.rightOrigin,
+		deleted:     rec.deleted,
+	}
+
+	var left, right *item
+	if rec.origin != nil {
+		left = d.cleanEnd(*rec.origin)
+	}
+	if rec.rightOrigin != nil {
+		right = d.cleanStart(*rec.rightOrigin)
+	}
+
+	// Skip over concurrent insertions that belong before this item
+	o := d.start
+	if left != nil {
+		o = left.right
+	}
+	conflicting := make(map[*item]bool)
+	beforeOrigin := make(map[*item]bool)
+	for ; o != nil && o != right; o = o.right {
+		beforeOrigin[o] = true
+		conflicting[o] = true
+		if sameID(it.origin, o.origin) {
+			if o.id.Client < it.id.Client {
+				left = o
+				conflicting = make(map[*item]bool)
+			} else if sameID(it.rightOrigin, o.rightOrigin) {
+				break
+			}
+		} else if o.origin != nil && beforeOrigin[d.find(*o.origin)] {
+			if !conflicting[d.find(*o.origin)] {
+				left = o
+				conflicting = make(map[*item]bool)
+			}
+		} else {
+			break
+		}
+	}
+
+	// Link after left
+	it.left = left
+	if left != nil {
+		it.right = left.right
+		left.right = it
+	} else {
+		it.right = d.start
+		d.start = it
+	}
+	if it.right != nil {
+		it.right.left = it
+	}
+	d.clients[it.id.Client] = append(d.clients[it.id.Client], it)
+
+	var change Change
+	if !it.deleted {
+		change = Change{Pos: d.visibleIndex(it), Insert: rec.content}
+		text, err := d.text.Insert(change.Pos, rec.content)
+		if err == nil {
+			d.text = text
+		}
+	}
+	if left != nil {
+		d.tryMerge(left)
+	}
+	return change, !it.deleted
+}
+
+// applyPendingDeletes deletes the pending ranges of known items.
+func (d *Doc) applyPendingDeletes() []Change {
+	var changes []Change
+	remaining := make(deleteSet)
+	for client, ranges := range d.pendingDeletes {
+		known := d.clock(client)
+		for _, r := range ranges {
+			end := r.clock + r.length
+			if end > known {
+				from := r.clock
+				if known > from {
+					from = known
+				}
+				remaining.add(client, from, end-from)
+				end = known
+			}
+			for clock := r.clock; clock < end; {
+				it := d.cleanStart(ID{Client: client, Clock: clock})
+				if it.id.Clock+uint64(it.length) > end {
+					d.split(it, int(end-it.id.Clock))
+				}
+				if !it.deleted {
+					pos := d.visibleIndex(it)
+					if text, err := d.text.Delete(pos, pos+it.length); err == nil {
+						d.text = text
+					}
+					it.deleted = true
+					changes = append(changes, Change{Pos: pos, Delete: it.length})
+				}
+				clock = it.id.Clock + uint64(it.length)
+			}
+		}
+	}
+	d.pendingDeletes = remaining
+	return changes
+}
+
+// ========== Item Store ==========
+
+// clock returns the next clock of client: the number of its characters known.
+func (d *Doc) clock(client uint64) uint64 {
+	items := d.clients[client]
+	if len(items) == 0 {
+		return 0
+	}
+	last := items[len(items)-1]
+	return last.id.Clock + uint64(last.length)
+}
+
+// knows returns true if the character id has been integrated; nil is always known.
+func (d *Doc) knows(id *ID) bool {
+	return id == nil || id.Clock < d.clock(id.Client)
+}
+
+// index returns the position of the item containing id in its client's items.
+func (d *Doc) index(id ID) int {
+	items := d.clients[id.Client]
+	return sort.Search(len(items), func(i int) bool {
+		return items[i].id.Clock+uint64(items[i].length) > id.Clock
+	})
+}
+
+// find returns the item containing the character id, which must be known.
+func (d *Doc) find(id ID) *item {
+	return d.clients[id.Client][d.index(id)]
+}
+
+// cleanStart returns the item starting at id, splitting the item containing it.
+func (d *Doc) cleanStart(id ID) *item {
+	it := d.find(id)
+	if id.Clock > it.id.Clock {
+		return d.split(it, int(id.Clock-it.id.Clock))
+	}
+	return it
+}
+
+// cleanEnd returns the item ending at id, splitting the item containing it.
+func (d *Doc) cleanEnd(id ID) *item {
+	it := d.find(id)
+	if id.Clock < it.lastID().Clock {
+		d.split(it, int(id.Clock-it.id.Clock)+1)
+	}
+	return it
+}
+
+// split splits it after offset characters and returns the right part.
+func (d *Doc) split(it *item, offset int) *item {
+	right := &item{
+		id:          ID{Client: it.id.Client, Clock: it.id.Clock + uint64(offset)},
+		length:      it.length - offset,
+		origin:      &ID{Client: it.id.Client, Clock: it.id.Clock + uint64(offset) - 1},
+		rightOrigin: it.rightOrigin,
+		deleted:     it.deleted,
+		left:        it,
+		right:       it.right,
+	}
+	if it.right != nil {
+		it.right.left = right
+	}
+	it.right = right
+	it.length = offset
+
+	items := d.clients[it.id.Client]
+	i := d.index(it.id) + 1
+	items = append(items, nil)
+	copy(items[i+1:], items[i:])
+	items[i] = right
+	d.clients[it.id.Client] = items
+	return right
+}
+
+// tryMerge merges it with the item to its right if the two could have
+// been inserted as one. Returns true if they were merged.
+func (d *Doc) tryMerge(it *item) bool {
+	right := it.right
+	if right == nil || right.id.Client != it.id.Client ||
+		right.id.Clock != it.id.Clock+uint64(it.length) ||
+		right.deleted != it.deleted ||
+		right.origin == nil || *right.origin != it.lastID() ||
+		!sameID(it.rightOrigin, right.rightOrigin) {
+		return false
+	}
+
+	items := d.clients[it.id.Client]
+	i := d.index(right.id)
+	d.clients[it.id.Client] = append(items[:i], items[i+1:]...)
+
+	it.length += right.length
+	it.right = right.right
+	if it.right != nil {
+		it.right.left = it
+	}
+	return true
+}
+
+// visibleIndex returns the visible position of it.
+func (d *Doc) visibleIndex(target *item) int {
+	pos := 0
+	for it := d.start; it != nil && it != target; it = it.right {
+		if !it.deleted {
+			pos += it.length
+		}
+	}
+	return pos
+}
+
+// sameID compares two optional IDs.
+func sameID(a, b *ID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,213 @@
+package crdt
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncDocs sends everything src has to dst.
+func syncDocs(t *testing.T, dst, src *Doc) {
+	t.Helper()
+	_, err := dst.ApplyUpdate(src.EncodeStateAsUpdate(dst.StateVector()))
+	require.NoError(t, err)
+}
+
+func TestDoc_InsertDelete(t *testing.T) {
+	doc := NewDoc(1)
+	_, err := doc.Insert(0, "Hello World")
+	require.NoError(t, err)
+	_, err = doc.Insert(5, ",")
+	require.NoError(t, err)
+	_, err = doc.Delete(6, 6)
+	require.NoError(t, err)
+	_, err = doc.Insert(6, " Gophers")
+	require.NoError(t, err)
+	assert.Equal(t, "Hello, Gophers", doc.String())
+
+	_, err = doc.Insert(100, "x")
+	assert.ErrorIs(t, err, ErrOutOfRange)
+	_, err = doc.Delete(10, 10)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+}
+
+func TestDoc_ApplyUpdate(t *testing.T) {
+	alice, bob := NewDoc(1), NewDoc(2)
+
+	update, err := alice.Insert(0, "Hello")
+	require.NoError(t, err)
+	changes, err := bob.ApplyUpdate(update)
+	require.NoError(t, err)
+	assert.Equal(t, []Change{{Pos: 0, Insert: "Hello"}}, changes)
+
+	update, err = bob.Delete(1, 3)
+	require.NoError(t, err)
+	changes, err = alice.ApplyUpdate(update)
+	require.NoError(t, err)
+	assert.Equal(t, []Change{{Pos: 1, Delete: 3}}, changes)
+	assert.Equal(t, "Ho", alice.String())
+
+	// Duplicates are ignored
+	changes, err = alice.ApplyUpdate(update)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+}
+
+func TestDoc_ConcurrentInserts(t *testing.T) {
+	alice, bob := NewDoc(1), NewDoc(2)
+	update, _ := alice.Insert(0, "ac")
+	bob.ApplyUpdate(update)
+
+	u1, _ := alice.Insert(1, "X")
+	u2, _ := bob.Insert(1, "Y")
+	alice.ApplyUpdate(u2)
+	bob.ApplyUpdate(u1)
+
+	assert.Equal(t, alice.String(), bob.String())
+	assert.Equal(t, "aXYc", alice.String(), "lower client ID goes first")
+}
+
+func TestDoc_OutOfOrder(t *testing.T) {
+	alice, bob := NewDoc(1), NewDoc(2)
+	u1, _ := alice.Insert(0, "Hello")
+	u2, _ := alice.Insert(5, " World")
+	u3, _ := alice.Delete(0, 6)
+
+	_, err := bob.ApplyUpdate(u3)
+	require.NoError(t, err)
+	_, err = bob.ApplyUpdate(u2)
+	require.NoError(t, err)
+	assert.Equal(t, "", bob.String())
+	assert.True(t, bob.Pending())
+
+	_, err = bob.ApplyUpdate(u1)
+	require.NoError(t, err)
+	assert.Equal(t, "World", bob.String())
+	assert.False(t, bob.Pending())
+}
+
+func TestDoc_StateVectorSync(t *testing.T) {
+	server, phone := NewDoc(1), NewDoc(2)
+	server.Insert(0, "shared notes\n")
+	syncDocs(t, phone, server)
+
+	// The phone edits offline while the server keeps changing
+	phone.Insert(13, "written on the train\n")
+	phone.Delete(0, 7)
+	server.Insert(0, "# ")
+
+	sv, err := DecodeStateVector(phone.StateVector().Encode())
+	require.NoError(t, err)
+	assert.Equal(t, phone.StateVector(), sv)
+
+	_, err = phone.ApplyUpdate(server.EncodeStateAsUpdate(sv))
+	require.NoError(t, err)
+	syncDocs(t, server, phone)
+
+	assert.Equal(t, "# notes\nwritten on the train\n", server.String())
+	assert.Equal(t, server.String(), phone.String())
+}
+
+func TestDoc_InvalidUpdate(t *testing.T) {
+	doc := NewDoc(1)
+	update, _ := NewDoc(2).Insert(0, "abc")
+
+	_, err := doc.ApplyUpdate(update[:len(update)-2])
+	assert.ErrorIs(t, err, ErrInvalidUpdate)
+	_, err = doc.ApplyUpdate(append([]byte{99}, update[1:]...))
+	assert.ErrorIs(t, err, ErrInvalidUpdate)
+	_, err = DecodeStateVector([]byte{5})
+	assert.ErrorIs(t, err, ErrInvalidUpdate)
+}
+
+func TestDoc_GC(t *testing.T) {
+	alice, bob := NewDoc(1), NewDoc(2)
+	alice.Insert(0, "abcdef")
+	syncDocs(t, bob, alice)
+
+	// Deleting every other character splits the item
+	for i := 0; i < 3; i++ {
+		alice.Delete(i, 1)
+	}
+	assert.Equal(t, "bdf", alice.String())
+	assert.Equal(t, 6, alice.ItemCount())
+
+	alice.Delete(0, 3)
+	assert.Equal(t, 5, alice.GC())
+	assert.Equal(t, 1, alice.ItemCount())
+
+	// The compacted replica still syncs both ways
+	bob.Insert(3, "X")
+	syncDocs(t, alice, bob)
+	syncDocs(t, bob, alice)
+	assert.Equal(t, "X", alice.String())
+	assert.Equal(t, "X", bob.String())
+}
+
+func TestDoc_Typing(t *testing.T) {
+	doc := NewDoc(1)
+	for i, r := range "typed one by one" {
+		doc.Insert(i, string(r))
+	}
+	assert.Equal(t, 1, doc.ItemCount(), "consecutive characters share an item")
+
+	update := doc.EncodeStateAsUpdate(nil)
+	assert.Less(t, len(update), 30)
+}
+
+func TestDoc_RandomConvergence(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	alphabet := []rune("abcé 中\n")
+
+	for round := 0; round < 50; round++ {
+		docs := []*Doc{NewDoc(1), NewDoc(2), NewDoc(3)}
+		var updates [][]byte
+
+		for step := 0; step < 40; step++ {
+			doc := docs[rng.Intn(len(docs))]
+			length := doc.Length()
+			var update []byte
+			var err error
+			if length == 0 || rng.Intn(3) > 0 {
+				text := make([]rune, rng.Intn(4)+1)
+				for i := range text {
+					text[i] = alphabet[rng.Intn(len(alphabet))]
+				}
+				update, err = doc.Insert(rng.Intn(length+1), string(text))
+			} else {
+				pos := rng.Intn(length)
+				update, err = doc.Delete(pos, rng.Intn(length-pos)+1)
+			}
+			require.NoError(t, err)
+			updates = append(updates, update)
+
+			// Deliver some updates early, in random order
+			if rng.Intn(4) == 0 {
+				target := docs[rng.Intn(len(docs))]
+				_, err := target.ApplyUpdate(updates[rng.Intn(len(updates))])
+				require.NoError(t, err)
+			}
+			if rng.Intn(10) == 0 {
+				doc.GC()
+			}
+		}
+
+		for _, doc := range docs {
+			for _, i := range rng.Perm(len(updates)) {
+				_, err := doc.ApplyUpdate(updates[i])
+				require.NoError(t, err)
+			}
+			assert.False(t, doc.Pending())
+		}
+		for _, doc := range docs[1:] {
+			require.Equal(t, docs[0].String(), doc.String(), "round %d", round)
+		}
+
+		// A new replica catches up from a full update
+		fresh := NewDoc(4)
+		syncDocs(t, fresh, docs[1])
+		require.Equal(t, docs[0].String(), fresh.String())
+	}
+}
@@ -0,0 +1,359 @@
+package crdt
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// updateVersion is the version byte of the update encoding.
+const updateVersion = 1
+
+// Item flags in the update encoding.
+const (
+	flagOrigin      = 1 << 0
+	flagRightOrigin = 1 << 1
+	flagDeleted     = 1 << 2
+)
+
+// StateVector maps each client to the number of its characters a replica
+// has received. Two replicas exchange state vectors to find out which
+// updates the other one is missing.
+type StateVector map[uint64]uint64
+
+// StateVector returns the state vector of this replica.
+func (d *Doc) StateVector() StateVector {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stateVector()
+}
+
+func (d *Doc) stateVector() StateVector {
+	sv := make(StateVector, len(d.clients))
+	for client := range d.clients {
+		sv[client] = d.clock(client)
+	}
+	return sv
+}
+
+// EncodeStateAsUpdate encodes everything this replica has that a replica
+// with state vector sv is missing, plus all deletions. A nil sv encodes
+// the whole document.
+//
+// Example:
+//
+//	// Sync a peer that comes back online
+//	update := server.EncodeStateAsUpdate(peerStateVector)
+func (d *Doc) EncodeStateAsUpdate(sv StateVector) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.encodeUpdate(sv, d.deleteSet())
+}
+
+// Encode encodes a state vector.
+func (sv StateVector) Encode() []byte {
+	clients := make([]uint64, 0, len(sv))
+	for client := range sv {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] < clients[j] })
+
+	buf := binary.AppendUvarint(nil, uint64(len(clients)))
+	for _, client := range clients {
+		buf = binary.AppendUvarint(buf, client)
+		buf = binary.AppendUvarint(buf, sv[client])
+	}
+	return buf
+}
+
+// DecodeStateVector decodes a state vector encoded with StateVector.Encode.
+func DecodeStateVector(data []byte) (StateVector, error) {
+	dec := &decoder{buf: data}
+	n := dec.uvarint()
+	sv := make(StateVector)
+	for i := uint64(0); i < n && dec.err == nil; i++ {
+		client := dec.uvarint()
+		sv[client] = dec.uvarint()
+	}
+	if dec.err != nil || dec.pos != len(data) {
+		return nil, ErrInvalidUpdate
+	}
+	return sv, nil
+}
+
+// ========== Updates ==========
+//
+// An update is encoded as:
+//
+//	version byte
+//	uvarint  number of clients
+//	per client:
+//	    uvarint client, uvarint first clock, uvarint number of items
+//	    per item (clocks follow on from the previous item):
+//	        byte flags, [origin], [right origin], uvarint length,
+//	        [uvarint byte length, text] unless deleted
+//	uvarint  number of clients with deletions
+//	per client:
+//	    uvarint client, uvarint number of ranges
+//	    per range: uvarint clock, uvarint length
+//
+// IDs are encoded as uvarint client, uvarint clock.
+
+// encodeUpdate encodes the items missing from sv and the deletions in ds.
+func (d *Doc) encodeUpdate(sv StateVector, ds deleteSet) []byte {
+	var clients []uint64
+	for client := range d.clients {
+		if d.clock(client) > sv[client] {
+			clients = append(clients, client)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] < clients[j] })
+
+	// Visible positions, to read the text of the items from the rope
+	var offsets map[*item]int
+	if len(clients) > 0 {
+		offsets = make(map[*item]int)
+		pos := 0
+		for it := d.start; it != nil; it = it.right {
+			offsets[it] = pos
+			if !it.deleted {
+				pos += it.length
+			}
+		}
+	}
+
+	buf := []byte{updateVersion}
+	buf = binary.AppendUvarint(buf, uint64(len(clients)))
+	for _, client := range clients {
+		clock := sv[client]
+		items := d.clients[client][d.index(ID{Client: client, Clock: clock}):]
+		buf = binary.AppendUvarint(buf, client)
+		buf = binary.AppendUvarint(buf, clock)
+		buf = binary.AppendUvarint(buf, uint64(len(items)))
+
+		for _, it := range items {
+			rec := itemRecord{
+				id:          it.id,
+				length:      it.length,
+				origin:      it.origin,
+				rightOrigin: it.rightOrigin,
+				deleted:     it.deleted,
+			}
+			offset := 0
+			if clock > it.id.Clock {
+				offset = int(clock - it.id.Clock)
+				rec.origin = &ID{Client: client, Clock: clock - 1}
+				rec.length -= offset
+			}
+			if !it.deleted {
+				start := offsets[it] + offset
+				rec.content, _ = d.text.Slice(start, start+rec.length)
+			}
+			buf = appendItem(buf, rec)
+		}
+	}
+	return ds.appendTo(buf)
+}
+
+// appendItem encodes an item record.
+func appendItem(buf []byte, rec itemRecord) []byte {
+	var flags byte
+	if rec.origin != nil {
+		flags |= flagOrigin
+	}
+	if rec.rightOrigin != nil {
+		flags |= flagRightOrigin
+	}
+	if rec.deleted {
+		flags |= flagDeleted
+	}
+	buf = append(buf, flags)
+	if rec.origin != nil {
+		buf = appendID(buf, *rec.origin)
+	}
+	if rec.rightOrigin != nil {
+		buf = appendID(buf, *rec.rightOrigin)
+	}
+	buf = binary.AppendUvarint(buf, uint64(rec.length))
+	if !rec.deleted {
+		buf = binary.AppendUvarint(buf, uint64(len(rec.content)))
+		buf = append(buf, rec.content...)
+	}
+	return buf
+}
+
+func appendID(buf []byte, id ID) []byte {
+	buf = binary.AppendUvarint(buf, id.Client)
+	return binary.AppendUvarint(buf, id.Clock)
+}
+
+// decodeUpdate decodes the items and deletions of an update.
+func decodeUpdate(data []byte) ([]itemRecord, deleteSet, error) {
+	dec := &decoder{buf: data}
+	if dec.byte() != updateVersion {
+		return nil, nil, ErrInvalidUpdate
+	}
+
+	var items []itemRecord
+	clients := dec.uvarint()
+	for i := uint64(0); i < clients && dec.err == nil; i++ {
+		client := dec.uvarint()
+		clock := dec.uvarint()
+		n := dec.uvarint()
+		for j := uint64(0); j < n && dec.err == nil; j++ {
+			rec := itemRecord{id: ID{Client: client, Clock: clock}}
+			flags := dec.byte()
+			if flags&flagOrigin != 0 {
+				id := dec.id()
+				rec.origin = &id
+			}
+			if flags&flagRightOrigin != 0 {
+				id := dec.id()
+				rec.rightOrigin = &id
+			}
+			rec.length = int(dec.uvarint())
+			rec.deleted = flags&flagDeleted != 0
+			if !rec.deleted {
+				rec.content = dec.string()
+			}
+			if rec.length <= 0 {
+				dec.fail()
+			}
+			clock += uint64(rec.length)
+			items = append(items, rec)
+		}
+	}
+
+	ds := make(deleteSet)
+	clients = dec.uvarint()
+	for i := uint64(0); i < clients && dec.err == nil; i++ {
+		client := dec.uvarint()
+		n := dec.uvarint()
+		for j := uint64(0); j < n && dec.err == nil; j++ {
+			clock := dec.uvarint()
+			ds.add(client, clock, dec.uvarint())
+		}
+	}
+
+	if dec.err != nil || dec.pos != len(data) {
+		return nil, nil, ErrInvalidUpdate
+	}
+	return items, ds, nil
+}
+
+// decoder reads varint-encoded values and remembers the first error.
+type decoder struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = ErrInvalidUpdate
+	}
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || d.pos >= len(d.buf) {
+		d.fail()
+		return 0
+	}
+	b := d.buf[d.pos]
+	d.pos++
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf[d.pos:])
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+func (d *decoder) id() ID {
+	client := d.uvarint()
+	return ID{Client: client, Clock: d.uvarint()}
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil || n > uint64(len(d.buf)-d.pos) {
+		d.fail()
+		return ""
+	}
+	s := string(d.buf[d.pos : d.pos+int(n)])
+	d.pos += int(n)
+	return s
+}
+
+// ========== Delete Sets ==========
+
+// deleteRange is a range of deleted clocks of one client.
+type deleteRange struct {
+	clock  uint64
+	length uint64
+}
+
+// deleteSet holds deleted ranges per client.
+type deleteSet map[uint64][]deleteRange
+
+// add adds a range, merging it with the last one if they are adjacent.
+func (ds deleteSet) add(client, clock, length uint64) {
+	if length == 0 {
+		return
+	}
+	ranges := ds[client]
+	if n := len(ranges); n > 0 && ranges[n-1].clock+ranges[n-1].length == clock {
+		ranges[n-1].length += length
+		return
+	}
+	ds[client] = append(ranges, deleteRange{clock: clock, length: length})
+}
+
+// merge adds the ranges of other.
+func (ds deleteSet) merge(other deleteSet) {
+	for client, ranges := range other {
+		for _, r := range ranges {
+			ds.add(client, r.clock, r.length)
+		}
+	}
+}
+
+// appendTo encodes the delete set.
+func (ds deleteSet) appendTo(buf []byte) []byte {
+	clients := make([]uint64, 0, len(ds))
+	for client := range ds {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] < clients[j] })
+
+	buf = binary.AppendUvarint(buf, uint64(len(clients)))
+	for _, client := range clients {
+		buf = binary.AppendUvarint(buf, client)
+		buf = binary.AppendUvarint(buf, uint64(len(ds[client])))
+		for _, r := range ds[client] {
+			buf = binary.AppendUvarint(buf, r.clock)
+			buf = binary.AppendUvarint(buf, r.length)
+		}
+	}
+	return buf
+}
+
+// deleteSet returns the deletions of all items.
+func (d *Doc) deleteSet() deleteSet {
+	ds := make(deleteSet)
+	for client, items := range d.clients {
+		for _, it := range items {
+			if it.deleted {
+				ds.add(client, it.id.Clock, uint64(it.length))
+			}
+		}
+	}
+	return ds
+}
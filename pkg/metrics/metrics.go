@@ -0,0 +1,335 @@
+// Package metrics records counters, gauges and histograms behind a small
+// Recorder interface, and exposes them in the Prometheus text format
+// without depending on the Prometheus client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Kind is the type of a metric.
+type Kind int
+
+const (
+	Counter Kind = iota
+	Gauge
+	Histogram
+)
+
+// String returns the Prometheus type name of a kind.
+func (k Kind) String() string {
+	switch k {
+	case Counter:
+		return "counter"
+	case Gauge:
+		return "gauge"
+	default:
+		return "histogram"
+	}
+}
+
+// Bucket boundaries for histograms.
+var (
+	// LatencyBuckets are in seconds, from 100µs to 5s.
+	LatencyBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+	// SizeBuckets are in bytes, from 64B to 16MB.
+	SizeBuckets = []float64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+	// CountBuckets are for small counts such as broadcast recipients.
+	CountBuckets = []float64{0, 1, 2, 5, 10, 20, 50, 100}
+)
+
+// Label is a metric label.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// L returns a label.
+func L(name, value string) Label {
+	return Label{Name: name, Value: value}
+}
+
+// Recorder receives measurements. Implementations must be safe for
+// concurrent use.
+type Recorder interface {
+	// Add adds delta to a counter.
+	Add(name string, delta float64, labels ...Label)
+	// Set sets a gauge.
+	Set(name string, value float64, labels ...Label)
+	// Observe records a value in a histogram.
+	Observe(name string, value float64, labels ...Label)
+}
+
+// Nop is a Recorder that discards everything.
+var Nop Recorder = nop{}
+
+type nop struct{}
+
+func (nop) Add(string, float64, ...Label)     {}
+func (nop) Set(string, float64, ...Label)     {}
+func (nop) Observe(string, float64, ...Label) {}
+
+// Collector reports metrics that are read at scrape time, such as queue
+// depths, rather than recorded as they happen.
+type Collector func(r Recorder)
+
+// ========== Registry ==========
+
+// Registry is a Recorder that keeps metrics in memory and writes them in
+// the Prometheus text format. Metrics are created on first use; Describe
+// sets their help text and histogram buckets.
+type Registry struct {
+	mu         sync.Mutex
+	families   map[string]*family
+	help       map[string]string
+	buckets    map[string][]float64
+	collectors []Collector
+}
+
+// family is a metric and its series by label set.
+type family struct {
+	name    string
+	kind    Kind
+	buckets []float64
+	series  map[string]*series
+}
+
+// series is a metric with one set of labels.
+type series struct {
+	labels string // Formatted and sorted, without braces
+	value  float64
+	counts []uint64 // Per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		families: make(map[string]*family),
+		help:     make(map[string]string),
+		buckets:  make(map[string][]float64),
+	}
+}
+
+// Describe sets the help text of a metric and, for histograms, its
+// buckets. Histograms without buckets use LatencyBuckets.
+func (r *Registry) Describe(name, help string, buckets ...float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.help[name] = help
+	if len(buckets) > 0 {
+		r.buckets[name] = append([]float64(nil), buckets...)
+	}
+}
+
+// Register adds collectors that run on every scrape.
+func (r *Registry) Register(collectors ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, collectors...)
+}
+
+// Add adds delta to a counter.
+func (r *Registry) Add(name string, delta float64, labels ...Label) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.series(name, Counter, labels); s != nil {
+		s.value += delta
+	}
+}
+
+// Set sets a gauge.
+func (r *Registry) Set(name string, value float64, labels ...Label) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.series(name, Gauge, labels); s != nil {
+		s.value = value
+	}
+}
+
+// Observe records a value in a histogram.
+func (r *Registry) Observe(name string, value float64, labels ...Label) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.series(name, Histogram, labels)
+	if s == nil {
+		return
+	}
+	f := r.families[name]
+	if i := sort.SearchFloat64s(f.buckets, value); i < len(f.buckets) {
+		s.counts[i]++
+	}
+	s.sum += value
+	s.count++
+}
+
+// series returns the series of a metric, creating both as needed. It
+// returns nil if the metric exists with another kind.
+// Must be called with the lock held.
+func (r *Registry) series(name string, kind Kind, labels []Label) *series {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, kind: kind, series: make(map[string]*series)}
+		if kind == Histogram {
+			f.buckets = r.buckets[name]
+			if f.buckets == nil {
+				f.buckets = LatencyBuckets
+			}
+		}
+		r.families[name] = f
+	}
+	if f.kind != kind {
+		return nil
+	}
+
+	key := formatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: key}
+		if kind == Histogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// WritePrometheus runs the collectors and writes every metric in the
+// Prometheus text exposition format, sorted by name.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	// Collected metrics go to a fresh registry so series that disappeared,
+	// such as closed sessions, are not reported forever.
+	collected := NewRegistry()
+	r.mu.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	for name, buckets := range r.buckets {
+		collected.buckets[name] = buckets
+	}
+	r.mu.Unlock()
+	for _, collect := range collectors {
+		collect(collected)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	families := make([]*family, 0, len(r.families)+len(collected.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	for name, f := range collected.families {
+		if _, ok := r.families[name]; !ok {
+			families = append(families, f)
+		}
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw, r.help[f.name])
+	}
+	return bw.Flush()
+}
+
+// Handler returns an HTTP handler serving the metrics for Prometheus.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.WritePrometheus(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// write writes a family with its HELP and TYPE lines.
+func (f *family) write(w *bufio.Writer, help string) {
+	if help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(help))
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != Histogram {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, braces(s.labels), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, braces(joinLabels(s.labels, `le="`+formatFloat(bound)+`"`)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, braces(joinLabels(s.labels, `le="+Inf"`)), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, braces(s.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, braces(s.labels), s.count)
+	}
+}
+
+// formatLabels formats labels sorted by name as name="value" pairs.
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	sorted := append([]Label(nil), labels...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	pairs := make([]string, len(sorted))
+	for i, label := range sorted {
+		pairs[i] = label.Name + `="` + escapeLabel(label.Value) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+// joinLabels appends a formatted pair to formatted labels.
+func joinLabels(labels, pair string) string {
+	if labels == "" {
+		return pair
+	}
+	return labels + "," + pair
+}
+
+// braces wraps formatted labels in braces, if there are any.
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// formatFloat formats a sample value.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
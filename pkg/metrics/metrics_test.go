@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRegistry_WritePrometheus tests the text exposition of each kind of metric.
+func TestRegistry_WritePrometheus(t *testing.T) {
+	r := NewRegistry()
+	r.Describe("requests_total", "Requests served.")
+	r.Describe("latency_seconds", "Request latency.", 0.1, 1)
+
+	r.Add("requests_total", 1, L("path", "/a"))
+	r.Add("requests_total", 2, L("path", "/a"))
+	r.Add("requests_total", 1, L("path", `say "hi"`+"\n"))
+	r.Set("temperature", 21.5)
+	r.Observe("latency_seconds", 0.05, L("path", "/a"))
+	r.Observe("latency_seconds", 0.5, L("path", "/a"))
+	r.Observe("latency_seconds", 2, L("path", "/a"))
+	r.Set("requests_total", 7) // Wrong kind, ignored
+
+	var out strings.Builder
+	if err := r.WritePrometheus(&out); err != nil {
+		t.Fatalf("WritePrometheus failed: %v", err)
+	}
+
+	expected := `# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{path="/a",le="0.1"} 1
+latency_seconds_bucket{path="/a",le="1"} 2
+latency_seconds_bucket{path="/a",le="+Inf"} 3
+latency_seconds_sum{path="/a"} 2.55
+latency_seconds_count{path="/a"} 3
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{path="/a"} 3
+requests_total{path="say \"hi\"\n"} 1
+# TYPE temperature gauge
+temperature 21.5
+`
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, out.String())
+	}
+}
+
+// TestRegistry_Collectors tests that collected series are read on every scrape.
+func TestRegistry_Collectors(t *testing.T) {
+	r := NewRegistry()
+	sessions := []string{"a", "b"}
+	r.Register(func(rec Recorder) {
+		for _, id := range sessions {
+			rec.Set("clients", 1, L("session", id))
+		}
+	})
+
+	var first, second strings.Builder
+	r.WritePrometheus(&first)
+	sessions = sessions[:1]
+	r.WritePrometheus(&second)
+
+	if !strings.Contains(first.String(), `clients{session="b"} 1`) {
+		t.Errorf("Expected session b in the first scrape, got:\n%s", first.String())
+	}
+	if strings.Contains(second.String(), `session="b"`) {
+		t.Errorf("Expected session b to be gone, got:\n%s", second.String())
+	}
+}
+
+// TestRegistry_Handler tests the HTTP handler.
+func TestRegistry_Handler(t *testing.T) {
+	r := NewRegistry()
+	r.Add("up", 1)
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Expected the Prometheus content type, got %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "up 1\n") {
+		t.Errorf("Expected the up counter, got %q", rec.Body.String())
+	}
+}
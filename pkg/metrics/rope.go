@@ -0,0 +1,52 @@
+package metrics
+
+import "github.com/coreseekdev/texere/pkg/rope"
+
+// Rope metric names.
+const (
+	RopePoolAcquires    = "texere_rope_pool_acquires_total"
+	RopePoolAllocations = "texere_rope_pool_allocations_total"
+	RopePoolHitRatio    = "texere_rope_pool_hit_ratio"
+	RopeEdits           = "texere_rope_edits_total"
+	RopeEditChars       = "texere_rope_edit_chars_total"
+)
+
+// DescribeRope describes the rope metrics in a registry.
+func DescribeRope(r *Registry) {
+	r.Describe(RopePoolAcquires, "Objects taken from the rope pools.")
+	r.Describe(RopePoolAllocations, "Objects the rope pools had to allocate.")
+	r.Describe(RopePoolHitRatio, "Fraction of rope pool acquires served by reuse.")
+	r.Describe(RopeEdits, "Edits recorded by the rope edit metrics, by kind.")
+	r.Describe(RopeEditChars, "Characters inserted and deleted by recorded edits.")
+}
+
+// RopePools reports the rope node and buffer pool statistics.
+func RopePools(r Recorder) {
+	stats := rope.GetPoolStats()
+	pools := []struct {
+		name                  string
+		acquires, allocations uint64
+	}{
+		{"leaf", stats.LeafAcquires, stats.LeafAllocations},
+		{"internal", stats.InternalAcquires, stats.InternalAllocations},
+		{"buffer", stats.BufferAcquires, stats.BufferAllocations},
+	}
+	for _, pool := range pools {
+		label := L("pool", pool.name)
+		r.Add(RopePoolAcquires, float64(pool.acquires), label)
+		r.Add(RopePoolAllocations, float64(pool.allocations), label)
+		r.Set(RopePoolHitRatio, rope.HitRate(pool.acquires, pool.allocations), label)
+	}
+}
+
+// RopeEditStats returns a collector reporting edits recorded in em.
+func RopeEditStats(em *rope.EditMetrics) Collector {
+	return func(r Recorder) {
+		stats := em.Stats()
+		r.Add(RopeEdits, float64(stats["total_inserts"]), L("kind", "insert"))
+		r.Add(RopeEdits, float64(stats["total_deletes"]), L("kind", "delete"))
+		r.Add(RopeEdits, float64(stats["total_replaces"]), L("kind", "replace"))
+		r.Add(RopeEditChars, float64(stats["total_chars_inserted"]), L("kind", "insert"))
+		r.Add(RopeEditChars, float64(stats["total_chars_deleted"]), L("kind", "delete"))
+	}
+}
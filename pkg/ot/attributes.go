@@ -0,0 +1,161 @@
+package ot
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// AttributeMap holds the formatting attributes of a rich-text op.
+//
+// It follows the Quill Delta model: keys are attribute names ("bold",
+// "link", "header", ...) and values are any JSON value. A key that maps
+// to nil is an explicit null, which removes that attribute when the op
+// is composed onto existing text. A missing key leaves the attribute
+// untouched.
+type AttributeMap map[string]interface{}
+
+// Clone returns a shallow copy of the map, or nil for an empty map.
+func (a AttributeMap) Clone() AttributeMap {
+	if len(a) == 0 {
+		return nil
+	}
+	result := make(AttributeMap, len(a))
+	for k, v := range a {
+		result[k] = v
+	}
+	return result
+}
+
+// Equals reports whether two attribute maps hold the same keys and values.
+// A nil map and an empty map are equal.
+func (a AttributeMap) Equals(other AttributeMap) bool {
+	if len(a) != len(other) {
+		return false
+	}
+	for k, v := range a {
+		ov, ok := other[k]
+		if !ok || !reflect.DeepEqual(v, ov) {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns a stable string representation for debugging.
+func (a AttributeMap) String() string {
+	keys := make([]string, 0, len(a))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%v", k, a[k])
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// ComposeAttributes combines attributes a followed by b.
+//
+// Values in b override values in a. When keepNull is false, explicit
+// nulls are dropped from the result; this is the case when the result
+// describes inserted text rather than a retain.
+//
+// Corresponds to Quill's AttributeMap.compose.
+//
+// Example:
+//
+//	ComposeAttributes(AttributeMap{"bold": true}, AttributeMap{"italic": true}, false)
+//	// {"bold": true, "italic": true}
+//	ComposeAttributes(AttributeMap{"bold": true}, AttributeMap{"bold": nil}, false)
+//	// nil
+func ComposeAttributes(a, b AttributeMap, keepNull bool) AttributeMap {
+	result := make(AttributeMap, len(a)+len(b))
+	for k, v := range b {
+		if v == nil && !keepNull {
+			continue
+		}
+		result[k] = v
+	}
+	for k, v := range a {
+		if _, ok := b[k]; !ok {
+			result[k] = v
+		}
+	}
+	return result.Clone()
+}
+
+// DiffAttributes returns the attributes that turn a into b.
+// Keys present in a but missing from b are set to nil.
+//
+// Corresponds to Quill's AttributeMap.diff.
+func DiffAttributes(a, b AttributeMap) AttributeMap {
+	result := make(AttributeMap)
+	for k, v := range a {
+		bv, ok := b[k]
+		if !ok {
+			result[k] = nil
+		} else if !reflect.DeepEqual(v, bv) {
+			result[k] = bv
+		}
+	}
+	for k, v := range b {
+		if _, ok := a[k]; !ok {
+			result[k] = v
+		}
+	}
+	return result.Clone()
+}
+
+// InvertAttributes returns the attributes that undo applying attr to text
+// formatted with base.
+//
+// Corresponds to Quill's AttributeMap.invert.
+//
+// Example:
+//
+//	InvertAttributes(AttributeMap{"bold": true}, AttributeMap{"italic": true})
+//	// {"bold": nil}
+func InvertAttributes(attr, base AttributeMap) AttributeMap {
+	result := make(AttributeMap)
+	for k, bv := range base {
+		if v, ok := attr[k]; ok && !reflect.DeepEqual(v, bv) {
+			result[k] = bv
+		}
+	}
+	for k := range attr {
+		if _, ok := base[k]; !ok {
+			result[k] = nil
+		}
+	}
+	return result.Clone()
+}
+
+// TransformAttributes transforms attributes b against concurrent attributes a.
+//
+// If priority is true, a is considered to have happened first, so keys
+// set by a win and are removed from b. Otherwise b is returned unchanged.
+//
+// Corresponds to Quill's AttributeMap.transform.
+func TransformAttributes(a, b AttributeMap, priority bool) AttributeMap {
+	if len(a) == 0 {
+		return b.Clone()
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	if !priority {
+		return b.Clone()
+	}
+
+	result := make(AttributeMap)
+	for k, v := range b {
+		if _, ok := a[k]; !ok {
+			result[k] = v
+		}
+	}
+	return result.Clone()
+}
@@ -0,0 +1,67 @@
+package ot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAttributes_Compose tests attribute composition.
+// Corresponds to quill-delta test/attributes.js: compose()
+func TestAttributes_Compose(t *testing.T) {
+	attrs := AttributeMap{"bold": true, "color": "red"}
+
+	assert.Equal(t, attrs, ComposeAttributes(nil, attrs, false))
+	assert.Equal(t, attrs, ComposeAttributes(attrs, nil, false))
+	assert.Equal(t, AttributeMap{"bold": true, "color": "red", "italic": true},
+		ComposeAttributes(attrs, AttributeMap{"italic": true}, false))
+	assert.Equal(t, AttributeMap{"bold": false, "color": "red"},
+		ComposeAttributes(attrs, AttributeMap{"bold": false}, false))
+	assert.Equal(t, AttributeMap{"color": "red"},
+		ComposeAttributes(attrs, AttributeMap{"bold": nil}, false))
+	assert.Equal(t, AttributeMap{"bold": nil, "color": "red"},
+		ComposeAttributes(attrs, AttributeMap{"bold": nil}, true))
+	assert.Nil(t, ComposeAttributes(attrs, AttributeMap{"bold": nil, "color": nil}, false))
+}
+
+// TestAttributes_Diff tests attribute diffing.
+// Corresponds to quill-delta test/attributes.js: diff()
+func TestAttributes_Diff(t *testing.T) {
+	format := AttributeMap{"bold": true, "color": "red"}
+
+	assert.Equal(t, format, DiffAttributes(nil, format))
+	assert.Equal(t, AttributeMap{"bold": nil, "color": nil}, DiffAttributes(format, nil))
+	assert.Nil(t, DiffAttributes(format, format))
+	assert.Equal(t, AttributeMap{"color": "blue"},
+		DiffAttributes(format, AttributeMap{"bold": true, "color": "blue"}))
+}
+
+// TestAttributes_Invert tests attribute inversion.
+// Corresponds to quill-delta test/attributes.js: invert()
+func TestAttributes_Invert(t *testing.T) {
+	attrs := AttributeMap{"bold": true}
+	base := AttributeMap{"italic": true}
+	assert.Equal(t, AttributeMap{"bold": nil}, InvertAttributes(attrs, base))
+
+	attrs = AttributeMap{"bold": nil}
+	base = AttributeMap{"bold": true}
+	assert.Equal(t, AttributeMap{"bold": true}, InvertAttributes(attrs, base))
+
+	attrs = AttributeMap{"color": "red"}
+	base = AttributeMap{"color": "blue"}
+	assert.Equal(t, base, InvertAttributes(attrs, base))
+
+	assert.Nil(t, InvertAttributes(nil, base))
+}
+
+// TestAttributes_Transform tests attribute transformation.
+// Corresponds to quill-delta test/attributes.js: transform()
+func TestAttributes_Transform(t *testing.T) {
+	left := AttributeMap{"bold": true, "color": "red", "font": nil}
+	right := AttributeMap{"color": "blue", "font": "serif", "italic": true}
+
+	assert.Equal(t, left, TransformAttributes(nil, left, false))
+	assert.Nil(t, TransformAttributes(left, nil, false))
+	assert.Equal(t, AttributeMap{"italic": true}, TransformAttributes(left, right, true))
+	assert.Equal(t, right, TransformAttributes(left, right, false))
+}
@@ -0,0 +1,507 @@
+package ot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrEmbedNotSupported is returned when a Delta contains a non-text insert.
+var ErrEmbedNotSupported = errors.New("delta: embed inserts are not supported")
+
+// DeltaOp is a single rich-text op in a Delta.
+//
+// Exactly one of Insert, Retain or Delete is set. Insert and Retain may
+// carry formatting attributes; a Retain with attributes formats the text
+// it skips over.
+//
+// The JSON form matches the Quill Delta format:
+//
+//	{"insert": "Hello", "attributes": {"bold": true}}
+//	{"retain": 5, "attributes": {"link": null}}
+//	{"delete": 3}
+//
+// Lengths are counted in Unicode code points, matching the rope package.
+type DeltaOp struct {
+	Insert     string       `json:"insert,omitempty"`
+	Retain     int          `json:"retain,omitempty"`
+	Delete     int          `json:"delete,omitempty"`
+	Attributes AttributeMap `json:"attributes,omitempty"`
+}
+
+// Type returns the operation type of this op.
+func (o DeltaOp) Type() OperationType {
+	switch {
+	case o.Delete > 0:
+		return OpDelete
+	case o.Retain > 0:
+		return OpRetain
+	default:
+		return OpInsert
+	}
+}
+
+// Length returns the number of characters this op covers.
+func (o DeltaOp) Length() int {
+	switch {
+	case o.Delete > 0:
+		return o.Delete
+	case o.Retain > 0:
+		return o.Retain
+	default:
+		return utf8.RuneCountInString(o.Insert)
+	}
+}
+
+// String returns a string representation for debugging.
+func (o DeltaOp) String() string {
+	var s string
+	switch o.Type() {
+	case OpDelete:
+		s = fmt.Sprintf("delete %d", o.Delete)
+	case OpRetain:
+		s = fmt.Sprintf("retain %d", o.Retain)
+	default:
+		s = fmt.Sprintf("insert '%s'", o.Insert)
+	}
+	if len(o.Attributes) > 0 {
+		s += " " + o.Attributes.String()
+	}
+	return s
+}
+
+// UnmarshalJSON decodes a Quill Delta op, rejecting embeds and malformed ops.
+func (o *DeltaOp) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Insert     json.RawMessage `json:"insert"`
+		Retain     *int            `json:"retain"`
+		Delete     *int            `json:"delete"`
+		Attributes AttributeMap    `json:"attributes"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	set := 0
+	*o = DeltaOp{Attributes: raw.Attributes}
+	if raw.Insert != nil {
+		set++
+		if err := json.Unmarshal(raw.Insert, &o.Insert); err != nil {
+			return ErrEmbedNotSupported
+		}
+		if o.Insert == "" {
+			return fmt.Errorf("delta: empty insert")
+		}
+	}
+	if raw.Retain != nil {
+		set++
+		if *raw.Retain <= 0 {
+			return fmt.Errorf("delta: retain must be positive, got %d", *raw.Retain)
+		}
+		o.Retain = *raw.Retain
+	}
+	if raw.Delete != nil {
+		set++
+		if *raw.Delete <= 0 {
+			return fmt.Errorf("delta: delete must be positive, got %d", *raw.Delete)
+		}
+		o.Delete = *raw.Delete
+	}
+	if set != 1 {
+		return fmt.Errorf("delta: op must have exactly one of insert, retain or delete")
+	}
+	if o.Delete > 0 && len(o.Attributes) > 0 {
+		return fmt.Errorf("delta: delete cannot have attributes")
+	}
+	return nil
+}
+
+// Delta is a rich-text operation compatible with the Quill Delta model.
+//
+// Unlike Operation, each insert and retain may carry formatting attributes,
+// so a Delta can both edit text and change its formatting. A Delta made of
+// inserts only describes a whole document.
+//
+// Trailing retains without attributes are implicit: a Delta may be shorter
+// than the document it is applied to, and the rest of the document is kept.
+//
+// Example:
+//
+//	doc := NewDelta().Insert("Hello World", nil)
+//	bold := NewDelta().Retain(6, nil).Retain(5, AttributeMap{"bold": true})
+//	result := doc.Compose(bold)
+//	// [{"insert": "Hello "}, {"insert": "World", "attributes": {"bold": true}}]
+type Delta struct {
+	ops []DeltaOp
+}
+
+// NewDelta creates a new empty Delta.
+func NewDelta() *Delta {
+	return &Delta{ops: make([]DeltaOp, 0, 8)}
+}
+
+// NewDeltaFromOps creates a Delta from a list of ops, normalizing them.
+func NewDeltaFromOps(ops []DeltaOp) *Delta {
+	d := NewDelta()
+	for _, op := range ops {
+		d.push(op)
+	}
+	return d
+}
+
+// Insert appends an insert op with optional attributes.
+func (d *Delta) Insert(text string, attrs AttributeMap) *Delta {
+	if text == "" {
+		return d
+	}
+	return d.push(DeltaOp{Insert: text, Attributes: attrs})
+}
+
+// Retain appends a retain op with optional attributes.
+func (d *Delta) Retain(n int, attrs AttributeMap) *Delta {
+	if n <= 0 {
+		return d
+	}
+	return d.push(DeltaOp{Retain: n, Attributes: attrs})
+}
+
+// Delete appends a delete op.
+func (d *Delta) Delete(n int) *Delta {
+	if n <= 0 {
+		return d
+	}
+	return d.push(DeltaOp{Delete: n})
+}
+
+// push appends an op, merging it with the previous op where possible.
+//
+// Like Builder.Insert, an insert directly after a delete is moved before
+// it, so equivalent deltas have one canonical form.
+//
+// Corresponds to Quill's Delta.push.
+func (d *Delta) push(op DeltaOp) *Delta {
+	op.Attributes = op.Attributes.Clone()
+	if op.Type() == OpDelete {
+		op.Attributes = nil
+	}
+
+	index := len(d.ops)
+	if index > 0 {
+		last := &d.ops[index-1]
+		if op.Type() == OpDelete && last.Type() == OpDelete {
+			last.Delete += op.Delete
+			return d
+		}
+		if last.Type() == OpDelete && op.Type() == OpInsert {
+			index--
+			if index == 0 {
+				d.ops = append([]DeltaOp{op}, d.ops...)
+				return d
+			}
+			last = &d.ops[index-1]
+		}
+		if op.Attributes.Equals(last.Attributes) {
+			if op.Type() == OpInsert && last.Type() == OpInsert {
+				last.Insert += op.Insert
+				return d
+			}
+			if op.Type() == OpRetain && last.Type() == OpRetain {
+				last.Retain += op.Retain
+				return d
+			}
+		}
+	}
+
+	if index == len(d.ops) {
+		d.ops = append(d.ops, op)
+	} else {
+		d.ops = append(d.ops, DeltaOp{})
+		copy(d.ops[index+1:], d.ops[index:])
+		d.ops[index] = op
+	}
+	return d
+}
+
+// Chop removes a trailing retain without attributes, which is a no-op.
+func (d *Delta) Chop() *Delta {
+	if n := len(d.ops); n > 0 {
+		last := d.ops[n-1]
+		if last.Type() == OpRetain && len(last.Attributes) == 0 {
+			d.ops = d.ops[:n-1]
+		}
+	}
+	return d
+}
+
+// Ops returns a copy of the ops in this Delta.
+func (d *Delta) Ops() []DeltaOp {
+	result := make([]DeltaOp, len(d.ops))
+	for i, op := range d.ops {
+		op.Attributes = op.Attributes.Clone()
+		result[i] = op
+	}
+	return result
+}
+
+// BaseLength returns the minimum length of a document this Delta applies to.
+func (d *Delta) BaseLength() int {
+	length := 0
+	for _, op := range d.ops {
+		if op.Type() != OpInsert {
+			length += op.Length()
+		}
+	}
+	return length
+}
+
+// TargetLength returns the length of the covered part of the document
+// after applying this Delta. For a document Delta this is the text length.
+func (d *Delta) TargetLength() int {
+	length := 0
+	for _, op := range d.ops {
+		if op.Type() != OpDelete {
+			length += op.Length()
+		}
+	}
+	return length
+}
+
+// IsDocument reports whether this Delta consists of inserts only.
+func (d *Delta) IsDocument() bool {
+	for _, op := range d.ops {
+		if op.Type() != OpInsert {
+			return false
+		}
+	}
+	return true
+}
+
+// IsNoop returns true if this Delta changes neither text nor formatting.
+func (d *Delta) IsNoop() bool {
+	for _, op := range d.ops {
+		if op.Type() != OpRetain || len(op.Attributes) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Text returns the inserted text of a document Delta.
+func (d *Delta) Text() string {
+	var b strings.Builder
+	for _, op := range d.ops {
+		if op.Type() == OpInsert {
+			b.WriteString(op.Insert)
+		}
+	}
+	return b.String()
+}
+
+// Equals checks if two deltas have the same ops.
+func (d *Delta) Equals(other *Delta) bool {
+	if len(d.ops) != len(other.ops) {
+		return false
+	}
+	for i := range d.ops {
+		a, b := d.ops[i], other.ops[i]
+		if a.Insert != b.Insert || a.Retain != b.Retain || a.Delete != b.Delete {
+			return false
+		}
+		if !a.Attributes.Equals(b.Attributes) {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns a string representation of the Delta for debugging.
+//
+// Example output: "retain 5, insert 'Hello' {bold=true}, delete 3"
+func (d *Delta) String() string {
+	parts := make([]string, len(d.ops))
+	for i, op := range d.ops {
+		parts[i] = op.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// MarshalJSON encodes the Delta in Quill format: {"ops": [...]}.
+func (d *Delta) MarshalJSON() ([]byte, error) {
+	ops := d.ops
+	if ops == nil {
+		ops = []DeltaOp{}
+	}
+	return json.Marshal(struct {
+		Ops []DeltaOp `json:"ops"`
+	}{ops})
+}
+
+// UnmarshalJSON decodes a Delta from Quill format.
+// Both {"ops": [...]} and a bare array of ops are accepted.
+func (d *Delta) UnmarshalJSON(data []byte) error {
+	var ops []DeltaOp
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal(data, &ops); err != nil {
+			return err
+		}
+	} else {
+		var wrapper struct {
+			Ops []DeltaOp `json:"ops"`
+		}
+		if err := json.Unmarshal(data, &wrapper); err != nil {
+			return err
+		}
+		ops = wrapper.Ops
+	}
+
+	*d = *NewDeltaFromOps(ops)
+	return nil
+}
+
+// Apply applies this Delta to a document Delta and returns the new document.
+//
+// Returns:
+//   - the resulting document Delta
+//   - an error if doc is not a document or is shorter than this Delta's base length
+func (d *Delta) Apply(doc *Delta) (*Delta, error) {
+	if !doc.IsDocument() {
+		return nil, fmt.Errorf("delta: can only apply to a document delta")
+	}
+	if d.BaseLength() > doc.TargetLength() {
+		return nil, ErrInvalidBaseLength
+	}
+	return doc.Compose(d), nil
+}
+
+// ToOperation converts this Delta into a plain-text Operation, dropping
+// all attributes. The implicit trailing retain is made explicit so the
+// result applies to a document of baseLength characters.
+//
+// Returns an error if the Delta covers more than baseLength characters.
+func (d *Delta) ToOperation(baseLength int) (*Operation, error) {
+	if d.BaseLength() > baseLength {
+		return nil, ErrInvalidBaseLength
+	}
+
+	builder := NewBuilder()
+	for _, op := range d.ops {
+		switch op.Type() {
+		case OpRetain:
+			builder.Retain(op.Retain)
+		case OpInsert:
+			builder.Insert(op.Insert)
+		case OpDelete:
+			builder.Delete(op.Delete)
+		}
+	}
+	builder.Retain(baseLength - d.BaseLength())
+	return builder.Build(), nil
+}
+
+// DeltaFromOperation converts a plain-text Operation into a Delta without
+// attributes.
+func DeltaFromOperation(op *Operation) *Delta {
+	d := NewDelta()
+	for _, o := range op.ops {
+		switch v := o.(type) {
+		case RetainOp:
+			d.Retain(int(v), nil)
+		case InsertOp:
+			d.Insert(string(v), nil)
+		case DeleteOp:
+			d.Delete(-int(v))
+		}
+	}
+	return d.Chop()
+}
+
+// ========== Delta Iterator ==========
+
+// deltaIterator walks the ops of a Delta, splitting them on demand.
+// Past the end it yields an infinite retain, which models the implicit
+// trailing retain of a Delta.
+type deltaIterator struct {
+	ops    []DeltaOp
+	index  int
+	offset int // Offset (in characters) into the current op
+}
+
+func newDeltaIterator(ops []DeltaOp) *deltaIterator {
+	return &deltaIterator{ops: ops}
+}
+
+// hasNext reports whether there are ops left.
+func (it *deltaIterator) hasNext() bool {
+	return it.index < len(it.ops)
+}
+
+// peekType returns the type of the next op; OpRetain past the end.
+func (it *deltaIterator) peekType() OperationType {
+	if !it.hasNext() {
+		return OpRetain
+	}
+	return it.ops[it.index].Type()
+}
+
+// peekLength returns the remaining length of the next op.
+func (it *deltaIterator) peekLength() int {
+	if !it.hasNext() {
+		return math.MaxInt
+	}
+	return it.ops[it.index].Length() - it.offset
+}
+
+// next returns up to n characters of the next op and advances past them.
+func (it *deltaIterator) next(n int) DeltaOp {
+	if !it.hasNext() {
+		return DeltaOp{Retain: math.MaxInt}
+	}
+
+	op := it.ops[it.index]
+	length := op.Length()
+	offset := it.offset
+	if n >= length-offset {
+		n = length - offset
+		it.index++
+		it.offset = 0
+	} else {
+		it.offset += n
+	}
+
+	switch op.Type() {
+	case OpDelete:
+		return DeltaOp{Delete: n}
+	case OpRetain:
+		return DeltaOp{Retain: n, Attributes: op.Attributes}
+	default:
+		return DeltaOp{Insert: sliceRunes(op.Insert, offset, offset+n), Attributes: op.Attributes}
+	}
+}
+
+// nextOp returns the rest of the next op.
+func (it *deltaIterator) nextOp() DeltaOp {
+	return it.next(math.MaxInt)
+}
+
+// sliceRunes returns s[start:end] with indices counted in runes.
+func sliceRunes(s string, start, end int) string {
+	if start == 0 && end >= utf8.RuneCountInString(s) {
+		return s
+	}
+	i, from, to := 0, len(s), len(s)
+	for pos := range s {
+		if i == start {
+			from = pos
+		}
+		if i == end {
+			to = pos
+			break
+		}
+		i++
+	}
+	return s[from:to]
+}
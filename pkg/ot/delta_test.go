@@ -0,0 +1,236 @@
+package ot
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var bold = AttributeMap{"bold": true}
+var italic = AttributeMap{"italic": true}
+
+// TestDelta_PushMerges tests that adjacent ops are merged into canonical form.
+func TestDelta_PushMerges(t *testing.T) {
+	d := NewDelta().Insert("a", bold).Insert("b", bold).Insert("c", nil)
+	assert.Equal(t, []DeltaOp{
+		{Insert: "ab", Attributes: bold},
+		{Insert: "c"},
+	}, d.Ops())
+
+	// Insert after delete is moved before it
+	d = NewDelta().Retain(1, nil).Delete(2).Insert("x", nil)
+	assert.Equal(t, []DeltaOp{{Retain: 1}, {Insert: "x"}, {Delete: 2}}, d.Ops())
+
+	d = NewDelta().Delete(2).Insert("x", nil)
+	assert.Equal(t, []DeltaOp{{Insert: "x"}, {Delete: 2}}, d.Ops())
+
+	// Trailing plain retain is chopped
+	d = NewDelta().Insert("x", nil).Retain(3, nil).Chop()
+	assert.Equal(t, []DeltaOp{{Insert: "x"}}, d.Ops())
+}
+
+// TestDelta_Lengths tests base/target length tracking in code points.
+func TestDelta_Lengths(t *testing.T) {
+	d := NewDelta().Retain(2, nil).Insert("héllo", nil).Delete(3)
+	assert.Equal(t, 5, d.BaseLength())
+	assert.Equal(t, 7, d.TargetLength())
+	assert.False(t, d.IsDocument())
+	assert.True(t, NewDelta().Insert("x", nil).IsDocument())
+	assert.True(t, NewDelta().Retain(3, nil).IsNoop())
+	assert.False(t, NewDelta().Retain(3, bold).IsNoop())
+}
+
+// TestDelta_JSON tests JSON round-trips in Quill Delta format.
+func TestDelta_JSON(t *testing.T) {
+	d := NewDelta().Retain(5, AttributeMap{"link": nil}).Insert("Hi", bold).Delete(3)
+
+	data, err := json.Marshal(d)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ops":[{"retain":5,"attributes":{"link":null}},{"insert":"Hi","attributes":{"bold":true}},{"delete":3}]}`, string(data))
+
+	var decoded Delta
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.True(t, d.Equals(&decoded), "got %s", decoded.String())
+
+	// Bare arrays are accepted too
+	require.NoError(t, json.Unmarshal([]byte(`[{"insert":"a"},{"insert":"b"}]`), &decoded))
+	assert.Equal(t, []DeltaOp{{Insert: "ab"}}, decoded.Ops())
+
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"ops":[{"insert":{"image":"x.png"}}]}`), &decoded), ErrEmbedNotSupported)
+	assert.Error(t, json.Unmarshal([]byte(`{"ops":[{"retain":1,"delete":1}]}`), &decoded))
+	assert.Error(t, json.Unmarshal([]byte(`{"ops":[{"retain":-1}]}`), &decoded))
+}
+
+// TestDelta_Compose tests composing text edits and formatting.
+func TestDelta_Compose(t *testing.T) {
+	doc := NewDelta().Insert("Hello World", nil)
+
+	// Format "World" bold
+	result := doc.Compose(NewDelta().Retain(6, nil).Retain(5, bold))
+	assert.Equal(t, []DeltaOp{{Insert: "Hello "}, {Insert: "World", Attributes: bold}}, result.Ops())
+
+	// Remove bold, add italic
+	result = result.Compose(NewDelta().Retain(6, nil).Retain(5, AttributeMap{"bold": nil, "italic": true}))
+	assert.Equal(t, []DeltaOp{{Insert: "Hello "}, {Insert: "World", Attributes: italic}}, result.Ops())
+
+	// Retains keep nulls so they still remove attributes later
+	a := NewDelta().Retain(3, AttributeMap{"bold": nil})
+	b := NewDelta().Retain(3, italic)
+	assert.Equal(t, []DeltaOp{{Retain: 3, Attributes: AttributeMap{"bold": nil, "italic": true}}}, a.Compose(b).Ops())
+
+	// Deleting inserted text cancels out
+	ins := NewDelta().Retain(1, nil).Insert("abc", nil)
+	del := NewDelta().Retain(1, nil).Delete(3)
+	assert.True(t, ins.Compose(del).IsNoop())
+}
+
+// TestDelta_Apply tests applying a Delta to a document.
+func TestDelta_Apply(t *testing.T) {
+	doc := NewDelta().Insert("Hello", nil)
+
+	result, err := NewDelta().Retain(5, nil).Insert(" World", bold).Apply(doc)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello World", result.Text())
+
+	_, err = NewDelta().Retain(10, nil).Apply(doc)
+	assert.ErrorIs(t, err, ErrInvalidBaseLength)
+
+	_, err = NewDelta().Apply(NewDelta().Retain(1, nil))
+	assert.Error(t, err)
+}
+
+// TestDelta_Transform tests transforming concurrent deltas.
+func TestDelta_Transform(t *testing.T) {
+	a := NewDelta().Insert("A", nil)
+	b := NewDelta().Insert("B", nil)
+
+	// a has priority: its insert goes first
+	assert.Equal(t, []DeltaOp{{Retain: 1}, {Insert: "B"}}, a.Transform(b, true).Ops())
+	assert.Equal(t, []DeltaOp{{Insert: "B"}}, a.Transform(b, false).Ops())
+
+	// Conflicting formatting: the prioritized side wins
+	fa := NewDelta().Retain(3, AttributeMap{"color": "red"})
+	fb := NewDelta().Retain(3, AttributeMap{"color": "blue", "bold": true})
+	assert.Equal(t, []DeltaOp{{Retain: 3, Attributes: bold}}, fa.Transform(fb, true).Ops())
+	assert.Equal(t, fb.Ops(), fa.Transform(fb, false).Ops())
+
+	// Concurrent deletes of the same text
+	d := NewDelta().Retain(1, nil).Delete(2)
+	assert.True(t, d.Transform(d, true).IsNoop())
+}
+
+// TestDelta_TransformPosition tests mapping cursor positions.
+func TestDelta_TransformPosition(t *testing.T) {
+	d := NewDelta().Retain(2, nil).Insert("xx", nil)
+	assert.Equal(t, 1, d.TransformPosition(1, false))
+	assert.Equal(t, 4, d.TransformPosition(2, false))
+	assert.Equal(t, 2, d.TransformPosition(2, true))
+	assert.Equal(t, 5, d.TransformPosition(3, false))
+
+	d = NewDelta().Retain(1, nil).Delete(3)
+	assert.Equal(t, 1, d.TransformPosition(2, false))
+	assert.Equal(t, 2, d.TransformPosition(5, false))
+}
+
+// TestDelta_Invert tests that inverting restores text and formatting.
+func TestDelta_Invert(t *testing.T) {
+	base := NewDelta().Insert("Hello ", nil).Insert("World", italic)
+	change := NewDelta().Retain(2, nil).Delete(4).Retain(5, AttributeMap{"bold": true, "italic": nil}).Insert("!", nil)
+
+	result := base.Compose(change)
+	assert.Equal(t, "HeWorld!", result.Text())
+
+	inverted := change.Invert(base)
+	assert.True(t, base.Equals(result.Compose(inverted)), "got %s", result.Compose(inverted).String())
+}
+
+// TestDelta_OperationConversion tests conversion to and from plain operations.
+func TestDelta_OperationConversion(t *testing.T) {
+	d := NewDelta().Retain(6, nil).Delete(5).Insert("Go", bold)
+	op, err := d.ToOperation(11)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{6, "Go", -5}, op.ToJSON())
+
+	_, err = d.ToOperation(3)
+	assert.ErrorIs(t, err, ErrInvalidBaseLength)
+
+	back := DeltaFromOperation(NewBuilder().Retain(2).Insert("x").Retain(3).Build())
+	assert.Equal(t, []DeltaOp{{Retain: 2}, {Insert: "x"}}, back.Ops())
+}
+
+// randomDocument generates a random document Delta with formatting.
+func randomDocument() *Delta {
+	d := NewDelta()
+	for i := rand.Intn(5); i >= 0; i-- {
+		d.Insert(randomString(rand.Intn(6)+1), randomAttributes(false))
+	}
+	return d
+}
+
+// randomAttributes generates a random attribute map, optionally with nulls.
+func randomAttributes(allowNull bool) AttributeMap {
+	attrs := AttributeMap{}
+	for _, key := range []string{"bold", "italic", "color"} {
+		switch rand.Intn(4) {
+		case 0:
+			attrs[key] = true
+		case 1:
+			if allowNull {
+				attrs[key] = nil
+			}
+		}
+	}
+	return attrs
+}
+
+// randomDelta generates a random Delta that applies to a document of length n.
+func randomDelta(n int) *Delta {
+	d := NewDelta()
+	for n > 0 {
+		k := rand.Intn(n) + 1
+		switch rand.Intn(4) {
+		case 0:
+			d.Retain(k, nil)
+			n -= k
+		case 1:
+			d.Retain(k, randomAttributes(true))
+			n -= k
+		case 2:
+			d.Delete(k)
+			n -= k
+		default:
+			d.Insert(randomString(rand.Intn(4)+1), randomAttributes(false))
+		}
+	}
+	if rand.Intn(2) == 0 {
+		d.Insert(randomString(2), nil)
+	}
+	return d.Chop()
+}
+
+// TestDelta_RandomConvergence tests compose/transform/invert on random deltas.
+func TestDelta_RandomConvergence(t *testing.T) {
+	for i := 0; i < 500; i++ {
+		doc := randomDocument()
+		n := doc.TargetLength()
+		a := randomDelta(n)
+		b := randomDelta(n)
+
+		aPrime := b.Transform(a, false)
+		bPrime := a.Transform(b, true)
+
+		left := doc.Compose(a).Compose(bPrime)
+		right := doc.Compose(b).Compose(aPrime)
+		require.True(t, left.Equals(right), "a=%s b=%s: %s != %s", a, b, left, right)
+
+		// Compose is associative with the document
+		assert.True(t, doc.Compose(a.Compose(bPrime)).Equals(left))
+
+		// Invert restores the document
+		restored := doc.Compose(a).Compose(a.Invert(doc))
+		require.True(t, restored.Equals(doc), "a=%s: %s != %s", a, restored, doc)
+	}
+}
@@ -0,0 +1,195 @@
+package ot
+
+// Compose combines this Delta with other, which is applied after it.
+//
+// For deltas A and B, A.Compose(B) creates C such that applying C has
+// the same effect as applying A and then B, including formatting.
+// Unlike Compose for Operations, lengths do not have to match: the
+// shorter Delta is padded with its implicit trailing retain.
+//
+// Corresponds to Quill's Delta.compose.
+//
+// Example:
+//
+//	a := NewDelta().Insert("Hello", nil)
+//	b := NewDelta().Retain(5, AttributeMap{"bold": true}).Insert("!", nil)
+//	c := a.Compose(b)
+//	// [{"insert": "Hello", "attributes": {"bold": true}}, {"insert": "!"}]
+func (d *Delta) Compose(other *Delta) *Delta {
+	thisIter := newDeltaIterator(d.ops)
+	otherIter := newDeltaIterator(other.ops)
+	result := NewDelta()
+
+	for thisIter.hasNext() || otherIter.hasNext() {
+		// Inserts from other happen before anything in this delta
+		if otherIter.peekType() == OpInsert {
+			result.push(otherIter.nextOp())
+			continue
+		}
+
+		// Deletes from this delta happen before anything in other
+		if thisIter.peekType() == OpDelete {
+			result.push(thisIter.nextOp())
+			continue
+		}
+
+		length := min(thisIter.peekLength(), otherIter.peekLength())
+		thisOp := thisIter.next(length)
+		otherOp := otherIter.next(length)
+
+		switch otherOp.Type() {
+		case OpRetain:
+			op := DeltaOp{Retain: length}
+			if thisOp.Type() == OpInsert {
+				op = DeltaOp{Insert: thisOp.Insert}
+			}
+			op.Attributes = ComposeAttributes(thisOp.Attributes, otherOp.Attributes, thisOp.Type() == OpRetain)
+			result.push(op)
+
+		case OpDelete:
+			// Deleting retained text is kept; deleting inserted text cancels out
+			if thisOp.Type() == OpRetain {
+				result.push(otherOp)
+			}
+		}
+	}
+
+	return result.Chop()
+}
+
+// Transform transforms other against this Delta, which happened concurrently.
+//
+// The result can be applied after this Delta to get the effect of other.
+// If priority is true, this Delta is considered to have happened first:
+// its inserts win ties at the same position and its attributes win
+// conflicting formatting.
+//
+// To transform a pair like Transform does for Operations:
+//
+//	aPrime := b.Transform(a, false)
+//	bPrime := a.Transform(b, true)
+//	// a.Compose(bPrime) equals b.Compose(aPrime)
+//
+// Corresponds to Quill's Delta.transform.
+func (d *Delta) Transform(other *Delta, priority bool) *Delta {
+	thisIter := newDeltaIterator(d.ops)
+	otherIter := newDeltaIterator(other.ops)
+	result := NewDelta()
+
+	for thisIter.hasNext() || otherIter.hasNext() {
+		if thisIter.peekType() == OpInsert && (priority || otherIter.peekType() != OpInsert) {
+			result.Retain(thisIter.nextOp().Length(), nil)
+			continue
+		}
+
+		if otherIter.peekType() == OpInsert {
+			result.push(otherIter.nextOp())
+			continue
+		}
+
+		length := min(thisIter.peekLength(), otherIter.peekLength())
+		thisOp := thisIter.next(length)
+		otherOp := otherIter.next(length)
+
+		switch {
+		case thisOp.Type() == OpDelete:
+			// Our delete either makes their delete redundant or removes their retain
+			continue
+		case otherOp.Type() == OpDelete:
+			result.push(otherOp)
+		default:
+			result.Retain(length, TransformAttributes(thisOp.Attributes, otherOp.Attributes, priority))
+		}
+	}
+
+	return result.Chop()
+}
+
+// TransformPosition maps a cursor position through this Delta.
+//
+// If priority is true, an insert at exactly the position is considered to
+// have happened after the cursor was placed, so the cursor does not move.
+//
+// Corresponds to Quill's Delta.transformPosition.
+func (d *Delta) TransformPosition(index int, priority bool) int {
+	iter := newDeltaIterator(d.ops)
+	offset := 0
+
+	for iter.hasNext() && offset <= index {
+		length := iter.peekLength()
+		opType := iter.peekType()
+		iter.nextOp()
+
+		if opType == OpDelete {
+			index -= min(length, index-offset)
+			continue
+		}
+		if opType == OpInsert && (offset < index || !priority) {
+			index += length
+		}
+		offset += length
+	}
+
+	return index
+}
+
+// Invert creates the inverse of this Delta.
+//
+// The inverse, when applied to the result of this Delta, restores the
+// original document text and formatting. This is used for implementing undo.
+//
+// Parameters:
+//   - base: the document Delta before this Delta was applied
+//
+// Returns:
+//   - the inverse Delta
+//
+// Corresponds to Quill's Delta.invert.
+func (d *Delta) Invert(base *Delta) *Delta {
+	inverted := NewDelta()
+	baseIndex := 0
+
+	for _, op := range d.ops {
+		switch {
+		case op.Type() == OpInsert:
+			inverted.Delete(op.Length())
+
+		case op.Type() == OpRetain && len(op.Attributes) == 0:
+			inverted.Retain(op.Retain, nil)
+			baseIndex += op.Retain
+
+		default:
+			length := op.Length()
+			for _, baseOp := range base.Slice(baseIndex, baseIndex+length).ops {
+				if op.Type() == OpDelete {
+					inverted.push(baseOp)
+				} else {
+					inverted.Retain(baseOp.Length(), InvertAttributes(op.Attributes, baseOp.Attributes))
+				}
+			}
+			baseIndex += length
+		}
+	}
+
+	return inverted.Chop()
+}
+
+// Slice returns the ops covering characters [start, end) of this Delta.
+func (d *Delta) Slice(start, end int) *Delta {
+	iter := newDeltaIterator(d.ops)
+	result := NewDelta()
+	index := 0
+
+	for index < end && iter.hasNext() {
+		var op DeltaOp
+		if index < start {
+			op = iter.next(start - index)
+		} else {
+			op = iter.next(end - index)
+			result.push(op)
+		}
+		index += op.Length()
+	}
+
+	return result
+}
@@ -0,0 +1,365 @@
+// Package json0 implements operational transformation for JSON documents.
+//
+// It is a Go port of the json0 OT type from ShareDB (ottypes/json0).
+// An operation is a list of components; each component addresses a value
+// in the document by path and applies one instruction to it:
+//
+//   - object insert, delete and replace (oi, od)
+//   - list insert, delete, replace and move (li, ld, lm)
+//   - number add (na)
+//   - embedded subtype operations (t, o) on strings, using ot.Operation
+//
+// Documents are plain Go values as produced by encoding/json:
+// map[string]interface{}, []interface{}, float64, string, bool and nil.
+//
+// Example:
+//
+//	doc := map[string]interface{}{"tags": []interface{}{"a"}}
+//	op := json0.NewOperation(json0.ListInsert(json0.Path{"tags", 1}, "b"))
+//	result, err := op.Apply(doc)
+//	// result == {"tags": ["a", "b"]}
+package json0
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+)
+
+// SubtypeText is the subtype name for embedded text operations.
+// The component's O field holds an ot.Operation applied to the string at P.
+const SubtypeText = "text"
+
+// Path addresses a value in a JSON document.
+// Elements are string keys for objects and int indices for lists.
+type Path []interface{}
+
+// clone returns a copy of the path.
+func (p Path) clone() Path {
+	result := make(Path, len(p))
+	copy(result, p)
+	return result
+}
+
+// index returns the path element at i as a list index.
+func (p Path) index(i int) (int, bool) {
+	n, ok := p[i].(int)
+	return n, ok
+}
+
+// Value wraps a JSON value carried by a component.
+// A nil *Value means the instruction is absent; &Value{V: nil} is JSON null.
+type Value struct {
+	V interface{}
+}
+
+// clone returns a deep copy of the value.
+func (v *Value) clone() *Value {
+	if v == nil {
+		return nil
+	}
+	return &Value{V: cloneValue(v.V)}
+}
+
+// Component is a single instruction of a json0 operation.
+//
+// Exactly one instruction group is set: NA, LI/LD, LM, OI/OD or T/O.
+// LI and LD together replace a list element; OI and OD together replace
+// an object value.
+type Component struct {
+	P  Path          // Path of the affected value
+	NA *float64      // Number add
+	LI *Value        // List insert
+	LD *Value        // List delete
+	LM *int          // List move: P's last element moves to this index
+	OI *Value        // Object insert
+	OD *Value        // Object delete
+	T  string        // Subtype name, see SubtypeText
+	O  *ot.Operation // Subtype operation
+}
+
+// NumberAdd creates a component that adds n to the number at path.
+func NumberAdd(path Path, n float64) Component {
+	return Component{P: path, NA: &n}
+}
+
+// ListInsert creates a component that inserts value at a list index.
+func ListInsert(path Path, value interface{}) Component {
+	return Component{P: path, LI: &Value{V: value}}
+}
+
+// ListDelete creates a component that deletes the list element old.
+func ListDelete(path Path, old interface{}) Component {
+	return Component{P: path, LD: &Value{V: old}}
+}
+
+// ListReplace creates a component that replaces the list element old with value.
+func ListReplace(path Path, old, value interface{}) Component {
+	return Component{P: path, LD: &Value{V: old}, LI: &Value{V: value}}
+}
+
+// ListMove creates a component that moves a list element to index to.
+func ListMove(path Path, to int) Component {
+	return Component{P: path, LM: &to}
+}
+
+// ObjectInsert creates a component that sets a new object key.
+func ObjectInsert(path Path, value interface{}) Component {
+	return Component{P: path, OI: &Value{V: value}}
+}
+
+// ObjectDelete creates a component that deletes the object key holding old.
+func ObjectDelete(path Path, old interface{}) Component {
+	return Component{P: path, OD: &Value{V: old}}
+}
+
+// ObjectReplace creates a component that replaces the object value old with value.
+func ObjectReplace(path Path, old, value interface{}) Component {
+	return Component{P: path, OD: &Value{V: old}, OI: &Value{V: value}}
+}
+
+// TextEdit creates a component that applies a text operation to the string at path.
+func TextEdit(path Path, op *ot.Operation) Component {
+	return Component{P: path, T: SubtypeText, O: op}
+}
+
+// clone returns a deep copy of the component.
+func (c Component) clone() Component {
+	result := Component{
+		P:  c.P.clone(),
+		LI: c.LI.clone(),
+		LD: c.LD.clone(),
+		OI: c.OI.clone(),
+		OD: c.OD.clone(),
+		T:  c.T,
+		O:  c.O, // ot.Operation is immutable
+	}
+	if c.NA != nil {
+		na := *c.NA
+		result.NA = &na
+	}
+	if c.LM != nil {
+		lm := *c.LM
+		result.LM = &lm
+	}
+	return result
+}
+
+// isSubtype reports whether the component is a subtype operation.
+func (c Component) isSubtype() bool {
+	return c.T != ""
+}
+
+// operandLength returns the path length of the value the component operates on.
+// Number adds and subtype ops operate on the value at P itself; everything
+// else operates on the container of P's last element.
+func (c Component) operandLength() int {
+	if c.NA != nil || c.isSubtype() {
+		return len(c.P) + 1
+	}
+	return len(c.P)
+}
+
+// validate checks that the component has a valid instruction.
+func (c Component) validate() error {
+	groups := 0
+	if c.NA != nil {
+		groups++
+	}
+	if c.LI != nil || c.LD != nil {
+		groups++
+	}
+	if c.LM != nil {
+		groups++
+	}
+	if c.OI != nil || c.OD != nil {
+		groups++
+	}
+	if c.isSubtype() {
+		groups++
+		if c.T != SubtypeText {
+			return fmt.Errorf("json0: unknown subtype %q", c.T)
+		}
+		if c.O == nil {
+			return fmt.Errorf("json0: subtype component missing operation")
+		}
+	}
+	if groups != 1 {
+		return fmt.Errorf("json0: component at %s must have exactly one instruction", pathString(c.P))
+	}
+
+	for i, elem := range c.P {
+		switch elem.(type) {
+		case string, int:
+		default:
+			return fmt.Errorf("json0: invalid path element %v (%T) at %d", elem, elem, i)
+		}
+	}
+	if c.LI != nil || c.LD != nil || c.LM != nil {
+		if len(c.P) == 0 {
+			return fmt.Errorf("json0: list component requires a path")
+		}
+		if _, ok := c.P.index(len(c.P) - 1); !ok {
+			return fmt.Errorf("json0: list component path must end with an index")
+		}
+	}
+	return nil
+}
+
+// MarshalJSON encodes the component in json0 format.
+func (c Component) MarshalJSON() ([]byte, error) {
+	m := map[string]interface{}{"p": c.P}
+	if c.P == nil {
+		m["p"] = []interface{}{}
+	}
+	if c.NA != nil {
+		m["na"] = *c.NA
+	}
+	if c.LI != nil {
+		m["li"] = c.LI.V
+	}
+	if c.LD != nil {
+		m["ld"] = c.LD.V
+	}
+	if c.LM != nil {
+		m["lm"] = *c.LM
+	}
+	if c.OI != nil {
+		m["oi"] = c.OI.V
+	}
+	if c.OD != nil {
+		m["od"] = c.OD.V
+	}
+	if c.isSubtype() {
+		m["t"] = c.T
+		if c.O != nil {
+			m["o"] = c.O.ToJSON()
+		}
+	}
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON decodes a component from json0 format.
+func (c *Component) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*c = Component{}
+
+	rawPath, ok := raw["p"]
+	if !ok {
+		return fmt.Errorf("json0: missing path")
+	}
+	var path []interface{}
+	if err := json.Unmarshal(rawPath, &path); err != nil {
+		return fmt.Errorf("json0: invalid path: %w", err)
+	}
+	c.P = make(Path, len(path))
+	for i, elem := range path {
+		switch v := elem.(type) {
+		case string:
+			c.P[i] = v
+		case float64:
+			if v != math.Trunc(v) || v < 0 {
+				return fmt.Errorf("json0: invalid path index %v", v)
+			}
+			c.P[i] = int(v)
+		default:
+			return fmt.Errorf("json0: invalid path element %v", elem)
+		}
+	}
+
+	value := func(key string) (*Value, error) {
+		rawValue, ok := raw[key]
+		if !ok {
+			return nil, nil
+		}
+		var v interface{}
+		if err := json.Unmarshal(rawValue, &v); err != nil {
+			return nil, err
+		}
+		return &Value{V: v}, nil
+	}
+
+	var err error
+	if c.LI, err = value("li"); err != nil {
+		return err
+	}
+	if c.LD, err = value("ld"); err != nil {
+		return err
+	}
+	if c.OI, err = value("oi"); err != nil {
+		return err
+	}
+	if c.OD, err = value("od"); err != nil {
+		return err
+	}
+	if rawNA, ok := raw["na"]; ok {
+		var na float64
+		if err := json.Unmarshal(rawNA, &na); err != nil {
+			return fmt.Errorf("json0: invalid na: %w", err)
+		}
+		c.NA = &na
+	}
+	if rawLM, ok := raw["lm"]; ok {
+		var lm int
+		if err := json.Unmarshal(rawLM, &lm); err != nil {
+			return fmt.Errorf("json0: invalid lm: %w", err)
+		}
+		c.LM = &lm
+	}
+	if rawT, ok := raw["t"]; ok {
+		if err := json.Unmarshal(rawT, &c.T); err != nil {
+			return fmt.Errorf("json0: invalid subtype: %w", err)
+		}
+		if rawO, ok := raw["o"]; ok {
+			if c.O, err = textOperationFromJSON(rawO); err != nil {
+				return err
+			}
+		}
+	}
+
+	return c.validate()
+}
+
+// textOperationFromJSON decodes an ot.Operation in ot.js format: [5, "Hello", -3].
+func textOperationFromJSON(data json.RawMessage) (*ot.Operation, error) {
+	var items []interface{}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("json0: invalid text operation: %w", err)
+	}
+	for i, item := range items {
+		if f, ok := item.(float64); ok {
+			items[i] = int(f)
+		}
+	}
+	op, err := ot.FromJSON(items)
+	if err != nil {
+		return nil, fmt.Errorf("json0: invalid text operation: %w", err)
+	}
+	return op, nil
+}
+
+// cloneValue returns a deep copy of a JSON value.
+func cloneValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			result[k] = cloneValue(e)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(t))
+		for i, e := range t {
+			result[i] = cloneValue(e)
+		}
+		return result
+	default:
+		return v
+	}
+}
@@ -0,0 +1,330 @@
+package json0
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// parse decodes a JSON literal for test fixtures.
+func parse(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	require.NoError(t, json.Unmarshal([]byte(s), &v))
+	return v
+}
+
+// parseOp decodes a json0 operation literal for test fixtures.
+func parseOp(t *testing.T, s string) *Operation {
+	t.Helper()
+	var op Operation
+	require.NoError(t, json.Unmarshal([]byte(s), &op))
+	return &op
+}
+
+// apply applies op to doc and fails the test on error.
+func apply(t *testing.T, doc interface{}, op *Operation) interface{} {
+	t.Helper()
+	result, err := op.Apply(doc)
+	require.NoError(t, err, "apply %s", op)
+	return result
+}
+
+// TestOperation_JSON tests round-tripping operations through json0 JSON.
+func TestOperation_JSON(t *testing.T) {
+	op := NewOperation(
+		ObjectInsert(Path{"a"}, map[string]interface{}{"b": 1.0}),
+		ListReplace(Path{"list", 0}, nil, "x"),
+		ListMove(Path{"list", 1}, 0),
+		NumberAdd(Path{"n"}, 2),
+		TextEdit(Path{"s"}, ot.NewBuilder().Retain(1).Insert("hi").Delete(2).Build()),
+	)
+
+	data, err := json.Marshal(op)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"p":["a"],"oi":{"b":1}},
+		{"p":["list",0],"ld":null,"li":"x"},
+		{"p":["list",1],"lm":0},
+		{"p":["n"],"na":2},
+		{"p":["s"],"t":"text","o":[1,"hi",-2]}
+	]`, string(data))
+
+	decoded := parseOp(t, string(data))
+	again, err := json.Marshal(decoded)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(data), string(again))
+
+	var bad Operation
+	assert.Error(t, json.Unmarshal([]byte(`[{"p":["a"]}]`), &bad))
+	assert.Error(t, json.Unmarshal([]byte(`[{"p":["a"],"oi":1,"na":1}]`), &bad))
+	assert.Error(t, json.Unmarshal([]byte(`[{"p":["a"],"t":"rich","o":[]}]`), &bad))
+	assert.Error(t, json.Unmarshal([]byte(`[{"p":["a"],"li":1}]`), &bad))
+}
+
+// TestOperation_Apply tests each instruction.
+// Corresponds to ottypes/json0 test/json0.coffee: sanity
+func TestOperation_Apply(t *testing.T) {
+	doc := parse(t, `{"n":1,"list":["a","b","c"],"obj":{"k":"v"},"s":"hello"}`)
+
+	assert.Equal(t, 4.0, apply(t, doc, parseOp(t, `[{"p":["n"],"na":3}]`)).(map[string]interface{})["n"])
+	assert.Equal(t, parse(t, `["a","x","b","c"]`), apply(t, doc, parseOp(t, `[{"p":["list",1],"li":"x"}]`)).(map[string]interface{})["list"])
+	assert.Equal(t, parse(t, `["a","c"]`), apply(t, doc, parseOp(t, `[{"p":["list",1],"ld":"b"}]`)).(map[string]interface{})["list"])
+	assert.Equal(t, parse(t, `["a","x","c"]`), apply(t, doc, parseOp(t, `[{"p":["list",1],"ld":"b","li":"x"}]`)).(map[string]interface{})["list"])
+	assert.Equal(t, parse(t, `["c","a","b"]`), apply(t, doc, parseOp(t, `[{"p":["list",2],"lm":0}]`)).(map[string]interface{})["list"])
+	assert.Equal(t, parse(t, `["b","c","a"]`), apply(t, doc, parseOp(t, `[{"p":["list",0],"lm":2}]`)).(map[string]interface{})["list"])
+	assert.Equal(t, parse(t, `{"k":"v","x":[]}`), apply(t, doc, parseOp(t, `[{"p":["obj","x"],"oi":[]}]`)).(map[string]interface{})["obj"])
+	assert.Equal(t, parse(t, `{}`), apply(t, doc, parseOp(t, `[{"p":["obj","k"],"od":"v"}]`)).(map[string]interface{})["obj"])
+	assert.Equal(t, "hi there", apply(t, doc, parseOp(t, `[{"p":["s"],"t":"text","o":[1,"i there",-4]}]`)).(map[string]interface{})["s"])
+
+	// Replacing the root
+	assert.Equal(t, "new", apply(t, doc, parseOp(t, `[{"p":[],"od":null,"oi":"new"}]`)))
+
+	// The input document is never modified
+	assert.Equal(t, parse(t, `{"n":1,"list":["a","b","c"],"obj":{"k":"v"},"s":"hello"}`), doc)
+
+	// Errors
+	for _, s := range []string{
+		`[{"p":["missing","x"],"oi":1}]`,
+		`[{"p":["obj",0],"li":1}]`,
+		`[{"p":["list","k"],"oi":1}]`,
+		`[{"p":["s"],"na":1}]`,
+		`[{"p":["n"],"t":"text","o":[1]}]`,
+		`[{"p":["list",5],"ld":"x"}]`,
+	} {
+		_, err := parseOp(t, s).Apply(doc)
+		assert.Error(t, err, s)
+	}
+
+	// Operations built in code skip the decoder's path checks
+	for _, c := range []Component{
+		ListInsert(Path{"list", -1}, "x"),
+		ListDelete(Path{"list", -1}, "c"),
+		ListReplace(Path{"list", -1}, "c", "x"),
+		ListMove(Path{"list", -1}, 0),
+	} {
+		_, err := NewOperation(c).Apply(doc)
+		assert.ErrorIs(t, err, ErrInvalidPath, c.P)
+	}
+}
+
+// TestOperation_Invert tests that inverting restores the document.
+func TestOperation_Invert(t *testing.T) {
+	doc := parse(t, `{"n":1,"list":["a","b","c"],"s":"hello"}`)
+	op := parseOp(t, `[
+		{"p":["n"],"na":5},
+		{"p":["list",0],"lm":2},
+		{"p":["list",1],"ld":"c"},
+		{"p":["s"],"t":"text","o":[5," world"]},
+		{"p":["extra"],"oi":{"x":true}}
+	]`)
+
+	result := apply(t, doc, op)
+	inverse, err := op.Invert(doc)
+	require.NoError(t, err)
+	assert.Equal(t, doc, apply(t, result, inverse))
+}
+
+// TestCompose tests merging of adjacent components.
+// Corresponds to ottypes/json0 test/json0.coffee: compose
+func TestCompose(t *testing.T) {
+	compose := func(a, b string) string {
+		op, err := Compose(parseOp(t, a), parseOp(t, b))
+		require.NoError(t, err)
+		return op.String()
+	}
+
+	assert.JSONEq(t, `[{"p":["a"],"na":3}]`, compose(`[{"p":["a"],"na":1}]`, `[{"p":["a"],"na":2}]`))
+	assert.JSONEq(t, `[]`, compose(`[{"p":["a"],"oi":1}]`, `[{"p":["a"],"od":1}]`))
+	assert.JSONEq(t, `[{"p":["a"],"od":1}]`, compose(`[{"p":["a"],"od":1,"oi":2}]`, `[{"p":["a"],"od":2}]`))
+	assert.JSONEq(t, `[{"p":["a"],"od":1,"oi":3}]`, compose(`[{"p":["a"],"od":1}]`, `[{"p":["a"],"oi":3}]`))
+	assert.JSONEq(t, `[]`, compose(`[{"p":[1],"li":"x"}]`, `[{"p":[1],"ld":"x"}]`))
+	assert.JSONEq(t, `[{"p":[1],"ld":"y"}]`, compose(`[{"p":[1],"ld":"y","li":"x"}]`, `[{"p":[1],"ld":"x"}]`))
+	assert.JSONEq(t, `[{"p":["s"],"t":"text","o":["ab"]}]`,
+		compose(`[{"p":["s"],"t":"text","o":["a"]}]`, `[{"p":["s"],"t":"text","o":[1,"b"]}]`))
+	assert.JSONEq(t, `[{"p":["a"],"na":1},{"p":["b"],"na":2}]`, compose(`[{"p":["a"],"na":1}]`, `[{"p":["b"],"na":2}]`))
+}
+
+// TestTransform tests transforming concurrent components.
+// Corresponds to ottypes/json0 test/json0.coffee: transform
+func TestTransform(t *testing.T) {
+	transform := func(a, b string) (string, string) {
+		aPrime, bPrime, err := Transform(parseOp(t, a), parseOp(t, b))
+		require.NoError(t, err)
+		return aPrime.String(), bPrime.String()
+	}
+
+	// li vs. li: left wins
+	a, b := transform(`[{"p":[1],"li":"a"}]`, `[{"p":[1],"li":"b"}]`)
+	assert.JSONEq(t, `[{"p":[1],"li":"a"}]`, a)
+	assert.JSONEq(t, `[{"p":[2],"li":"b"}]`, b)
+
+	// ld vs. ld of the same element
+	a, b = transform(`[{"p":[1],"ld":"x"}]`, `[{"p":[1],"ld":"x"}]`)
+	assert.JSONEq(t, `[]`, a)
+	assert.JSONEq(t, `[]`, b)
+
+	// Edits below a deleted element are dropped; the delete captures them
+	a, b = transform(`[{"p":["x"],"od":{"n":1}}]`, `[{"p":["x","n"],"na":2}]`)
+	assert.JSONEq(t, `[{"p":["x"],"od":{"n":3}}]`, a)
+	assert.JSONEq(t, `[]`, b)
+
+	// oi vs. oi: left wins and replaces right's value
+	a, b = transform(`[{"p":["k"],"oi":"l"}]`, `[{"p":["k"],"oi":"r"}]`)
+	assert.JSONEq(t, `[{"p":["k"],"od":"r","oi":"l"}]`, a)
+	assert.JSONEq(t, `[]`, b)
+
+	// Moves shift indices of other components
+	a, b = transform(`[{"p":[0],"lm":2}]`, `[{"p":[0],"na":1}]`)
+	assert.JSONEq(t, `[{"p":[0],"lm":2}]`, a)
+	assert.JSONEq(t, `[{"p":[2],"na":1}]`, b)
+
+	// Text edits on the same string use ot.Transform
+	a, b = transform(`[{"p":["s"],"t":"text","o":["A",3]}]`, `[{"p":["s"],"t":"text","o":["B",3]}]`)
+	assert.JSONEq(t, `[{"p":["s"],"t":"text","o":["A",4]}]`, a)
+	assert.JSONEq(t, `[{"p":["s"],"t":"text","o":[1,"B",3]}]`, b)
+
+	// Text base length mismatch is an error
+	_, _, err := Transform(parseOp(t, `[{"p":["s"],"t":"text","o":[3]}]`), parseOp(t, `[{"p":["s"],"t":"text","o":[4]}]`))
+	assert.Error(t, err)
+}
+
+// randomPath picks a random existing path in doc, including the root.
+func randomPath(doc interface{}) Path {
+	path := Path{}
+	elem := doc
+	for rand.Intn(3) != 0 {
+		switch v := elem.(type) {
+		case map[string]interface{}:
+			if len(v) == 0 {
+				return path
+			}
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			k := keys[rand.Intn(len(keys))]
+			path = append(path, k)
+			elem = v[k]
+		case []interface{}:
+			if len(v) == 0 {
+				return path
+			}
+			i := rand.Intn(len(v))
+			path = append(path, i)
+			elem = v[i]
+		default:
+			return path
+		}
+	}
+	return path
+}
+
+// randomLeaf generates a random small JSON value.
+func randomLeaf() interface{} {
+	switch rand.Intn(4) {
+	case 0:
+		return float64(rand.Intn(10))
+	case 1:
+		return fmt.Sprintf("s%d", rand.Intn(10))
+	case 2:
+		return []interface{}{float64(rand.Intn(3))}
+	default:
+		return map[string]interface{}{"k": float64(rand.Intn(3))}
+	}
+}
+
+// randomComponent generates a random component that applies to doc.
+func randomComponent(doc interface{}) (Component, bool) {
+	path := randomPath(doc)
+	elem := valueAt(doc, path)
+
+	switch v := elem.(type) {
+	case float64:
+		return NumberAdd(path, float64(rand.Intn(5)+1)), true
+	case string:
+		n := len(v)
+		b := ot.NewBuilder()
+		pos := rand.Intn(n + 1)
+		b.Retain(pos)
+		if rand.Intn(2) == 0 && pos < n {
+			b.Delete(1)
+			b.Retain(n - pos - 1)
+		} else {
+			b.Insert("x")
+			b.Retain(n - pos)
+		}
+		return TextEdit(path, b.Build()), true
+	case []interface{}:
+		switch {
+		case len(v) == 0 || rand.Intn(4) == 0:
+			return ListInsert(append(path, rand.Intn(len(v)+1)), randomLeaf()), true
+		case rand.Intn(3) == 0:
+			i := rand.Intn(len(v))
+			return ListDelete(append(path, i), cloneValue(v[i])), true
+		case rand.Intn(2) == 0:
+			i := rand.Intn(len(v))
+			return ListReplace(append(path, i), cloneValue(v[i]), randomLeaf()), true
+		default:
+			return ListMove(append(path, rand.Intn(len(v))), rand.Intn(len(v))), true
+		}
+	case map[string]interface{}:
+		key := fmt.Sprintf("k%d", rand.Intn(4))
+		old, exists := v[key]
+		switch {
+		case !exists:
+			return ObjectInsert(append(path, key), randomLeaf()), true
+		case rand.Intn(2) == 0:
+			return ObjectDelete(append(path, key), cloneValue(old)), true
+		default:
+			return ObjectReplace(append(path, key), cloneValue(old), randomLeaf()), true
+		}
+	}
+	return Component{}, false
+}
+
+// randomOperation generates a random operation of up to three components.
+func randomOperation(t *testing.T, doc interface{}) *Operation {
+	var components []Component
+	current := cloneValue(doc)
+	for i := rand.Intn(3); i >= 0; i-- {
+		c, ok := randomComponent(current)
+		if !ok {
+			continue
+		}
+		var err error
+		current, err = applyComponent(current, c)
+		require.NoError(t, err)
+		components = append(components, c)
+	}
+	return NewOperation(components...)
+}
+
+// TestTransform_RandomConvergence tests transform, compose and invert on random ops.
+func TestTransform_RandomConvergence(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		doc := parse(t, `{"k0":[1,"ab",{"k":1}],"k1":{"k2":"hello","k3":5},"k2":["x","y","z"]}`)
+		a := randomOperation(t, doc)
+		b := randomOperation(t, doc)
+
+		aPrime, bPrime, err := Transform(a, b)
+		require.NoError(t, err, "a=%s b=%s", a, b)
+
+		left := apply(t, apply(t, doc, a), bPrime)
+		right := apply(t, apply(t, doc, b), aPrime)
+		require.Equal(t, left, right, "a=%s b=%s a'=%s b'=%s", a, b, aPrime, bPrime)
+
+		composed, err := Compose(a, bPrime)
+		require.NoError(t, err)
+		require.Equal(t, left, apply(t, doc, composed), "compose a=%s b'=%s", a, bPrime)
+
+		inverse, err := a.Invert(doc)
+		require.NoError(t, err)
+		require.Equal(t, doc, apply(t, apply(t, doc, a), inverse), "invert a=%s", a)
+	}
+}
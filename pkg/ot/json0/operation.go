@@ -0,0 +1,474 @@
+package json0
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+)
+
+var (
+	// ErrInvalidPath is returned when a component's path does not exist in the document.
+	ErrInvalidPath = errors.New("json0: path invalid")
+
+	// ErrNotList is returned when a list instruction targets a non-list value.
+	ErrNotList = errors.New("json0: referenced element not a list")
+
+	// ErrNotObject is returned when an object instruction targets a non-object value.
+	ErrNotObject = errors.New("json0: referenced element not an object")
+
+	// ErrNotNumber is returned when a number add targets a non-number value.
+	ErrNotNumber = errors.New("json0: referenced element not a number")
+
+	// ErrNotString is returned when a text subtype targets a non-string value.
+	ErrNotString = errors.New("json0: referenced element not a string")
+)
+
+// Operation is an immutable list of json0 components, applied in order.
+//
+// The structure corresponds to an op of ShareDB's json0 type. Like
+// ot.Operation, it supports Apply, Invert, Compose and Transform.
+type Operation struct {
+	components []Component
+}
+
+// NewOperation creates an operation from components.
+//
+// Example:
+//
+//	op := json0.NewOperation(
+//	    json0.ObjectInsert(json0.Path{"title"}, "Notes"),
+//	    json0.NumberAdd(json0.Path{"count"}, 1),
+//	)
+func NewOperation(components ...Component) *Operation {
+	op := &Operation{components: make([]Component, len(components))}
+	for i, c := range components {
+		op.components[i] = c.clone()
+	}
+	return op
+}
+
+// Components returns a copy of the operation's components.
+func (op *Operation) Components() []Component {
+	result := make([]Component, len(op.components))
+	for i, c := range op.components {
+		result[i] = c.clone()
+	}
+	return result
+}
+
+// Len returns the number of components.
+func (op *Operation) Len() int {
+	return len(op.components)
+}
+
+// IsNoop returns true if the operation has no components.
+func (op *Operation) IsNoop() bool {
+	return len(op.components) == 0
+}
+
+// Validate checks that every component is well formed.
+func (op *Operation) Validate() error {
+	for _, c := range op.components {
+		if err := c.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String returns a string representation for debugging.
+func (op *Operation) String() string {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return fmt.Sprintf("<invalid json0 op: %v>", err)
+	}
+	return string(data)
+}
+
+// MarshalJSON encodes the operation as a json0 component list.
+func (op *Operation) MarshalJSON() ([]byte, error) {
+	if op.components == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(op.components)
+}
+
+// UnmarshalJSON decodes the operation from a json0 component list.
+func (op *Operation) UnmarshalJSON(data []byte) error {
+	var components []Component
+	if err := json.Unmarshal(data, &components); err != nil {
+		return err
+	}
+	op.components = components
+	return nil
+}
+
+// Apply applies this operation to a JSON document.
+//
+// The document is not modified; a new document is returned.
+//
+// Parameters:
+//   - doc: the document, as decoded by encoding/json
+//
+// Returns:
+//   - the transformed document
+//   - an error if a component cannot be applied
+func (op *Operation) Apply(doc interface{}) (interface{}, error) {
+	if err := op.Validate(); err != nil {
+		return nil, err
+	}
+
+	result := cloneValue(doc)
+	for _, c := range op.components {
+		var err error
+		if result, err = applyComponent(result, c); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Invert creates the inverse of this operation.
+//
+// The inverse, when applied to the result of this operation, returns the
+// original document. Deleted values are taken from the components
+// themselves; the document is only needed to invert text subtype edits.
+//
+// Parameters:
+//   - doc: the document before this operation was applied
+//
+// Returns:
+//   - the inverse operation
+//   - an error if the operation cannot be applied to doc
+func (op *Operation) Invert(doc interface{}) (*Operation, error) {
+	if err := op.Validate(); err != nil {
+		return nil, err
+	}
+
+	n := len(op.components)
+	inverse := &Operation{components: make([]Component, n)}
+	current := cloneValue(doc)
+
+	for i, c := range op.components {
+		ic := Component{P: c.P.clone()}
+		switch {
+		case c.isSubtype():
+			str, ok := valueAt(current, c.P).(string)
+			if !ok {
+				return nil, ErrNotString
+			}
+			ic.T = c.T
+			ic.O = c.O.Invert(str)
+		case c.NA != nil:
+			na := -*c.NA
+			ic.NA = &na
+		case c.LM != nil:
+			lm, _ := c.P.index(len(c.P) - 1)
+			ic.P[len(ic.P)-1] = *c.LM
+			ic.LM = &lm
+		default:
+			ic.LI, ic.LD = c.LD.clone(), c.LI.clone()
+			ic.OI, ic.OD = c.OD.clone(), c.OI.clone()
+		}
+		inverse.components[n-1-i] = ic
+
+		var err error
+		if current, err = applyComponent(current, c); err != nil {
+			return nil, err
+		}
+	}
+
+	return inverse, nil
+}
+
+// Compose combines two consecutive operations into a single operation.
+//
+// The result has the same effect as applying operation1 and then
+// operation2. Adjacent components on the same path are merged where
+// possible: number adds are summed, text edits are composed with
+// ot.Compose, and an insert followed by a delete of the same value cancels.
+//
+// Returns an error if an embedded text composition fails.
+func Compose(operation1, operation2 *Operation) (*Operation, error) {
+	if err := operation1.Validate(); err != nil {
+		return nil, err
+	}
+	if err := operation2.Validate(); err != nil {
+		return nil, err
+	}
+
+	dest := operation1.Components()
+	for _, c := range operation2.components {
+		var err error
+		if dest, err = appendComponent(dest, c); err != nil {
+			return nil, err
+		}
+	}
+	return &Operation{components: dest}, nil
+}
+
+// appendComponent appends c to dest, merging it with the last component
+// where possible.
+//
+// Corresponds to json0's append.
+func appendComponent(dest []Component, c Component) ([]Component, error) {
+	c = c.clone()
+	if len(dest) == 0 {
+		return append(dest, c), nil
+	}
+
+	last := &dest[len(dest)-1]
+	if !pathMatches(c.P, last.P) {
+		return append(dest, c), nil
+	}
+
+	switch {
+	case c.isSubtype() && last.isSubtype() && c.T == last.T:
+		composed, err := ot.Compose(last.O, c.O)
+		if err != nil {
+			return nil, err
+		}
+		last.O = composed
+
+	case last.NA != nil && c.NA != nil:
+		na := *last.NA + *c.NA
+		last.NA = &na
+
+	case last.LI != nil && c.LI == nil && c.LD != nil && reflect.DeepEqual(c.LD.V, last.LI.V):
+		// Insert immediately followed by delete becomes a noop
+		if last.LD != nil {
+			// Leave the delete part of the replace
+			last.LI = nil
+		} else {
+			dest = dest[:len(dest)-1]
+		}
+
+	case last.OD != nil && last.OI == nil && c.OI != nil && c.OD == nil:
+		last.OI = c.OI
+
+	case last.OI != nil && c.OD != nil:
+		// The last component inserted something that c deletes or replaces
+		if c.OI != nil {
+			last.OI = c.OI
+		} else if last.OD != nil {
+			last.OI = nil
+		} else {
+			dest = dest[:len(dest)-1]
+		}
+
+	case c.LM != nil && pathElemEqual(c.P[len(c.P)-1], *c.LM):
+		// Moving an element to where it already is does nothing
+
+	default:
+		dest = append(dest, c)
+	}
+
+	return dest, nil
+}
+
+// applyComponent applies a single component to doc in place and returns
+// the new root. doc must be owned by the caller.
+func applyComponent(doc interface{}, c Component) (interface{}, error) {
+	container := map[string]interface{}{"data": doc}
+
+	var parent interface{}
+	var parentKey interface{}
+	var elem interface{} = container
+	var key interface{} = "data"
+
+	for _, p := range c.P {
+		child, ok := getChild(elem, key)
+		if !ok {
+			return nil, ErrInvalidPath
+		}
+		parent, parentKey = elem, key
+		elem, key = child, p
+	}
+
+	switch {
+	case c.isSubtype():
+		value, _ := getChild(elem, key)
+		str, ok := value.(string)
+		if !ok {
+			return nil, ErrNotString
+		}
+		result, err := c.O.Apply(str)
+		if err != nil {
+			return nil, err
+		}
+		if !setChild(elem, key, result) {
+			return nil, ErrInvalidPath
+		}
+
+	case c.NA != nil:
+		value, _ := getChild(elem, key)
+		n, ok := toFloat(value)
+		if !ok {
+			return nil, ErrNotNumber
+		}
+		if !setChild(elem, key, n+*c.NA) {
+			return nil, ErrInvalidPath
+		}
+
+	case c.LI != nil || c.LD != nil || c.LM != nil:
+		list, ok := elem.([]interface{})
+		if !ok {
+			return nil, ErrNotList
+		}
+		index, ok := key.(int)
+		if !ok || index < 0 {
+			return nil, ErrInvalidPath
+		}
+
+		switch {
+		case c.LI != nil && c.LD != nil:
+			if index >= len(list) {
+				return nil, ErrInvalidPath
+			}
+			list[index] = cloneValue(c.LI.V)
+		case c.LI != nil:
+			if index > len(list) {
+				return nil, ErrInvalidPath
+			}
+			list = append(list, nil)
+			copy(list[index+1:], list[index:])
+			list[index] = cloneValue(c.LI.V)
+		case c.LD != nil:
+			if index >= len(list) {
+				return nil, ErrInvalidPath
+			}
+			list = append(list[:index], list[index+1:]...)
+		default:
+			to := *c.LM
+			if index >= len(list) || to < 0 || to >= len(list) {
+				return nil, ErrInvalidPath
+			}
+			if to != index {
+				e := list[index]
+				list = append(list[:index], list[index+1:]...)
+				list = append(list, nil)
+				copy(list[to+1:], list[to:])
+				list[to] = e
+			}
+		}
+		setChild(parent, parentKey, list)
+
+	default:
+		obj, ok := elem.(map[string]interface{})
+		if !ok {
+			return nil, ErrNotObject
+		}
+		k, ok := key.(string)
+		if !ok {
+			return nil, ErrInvalidPath
+		}
+		if c.OI != nil {
+			obj[k] = cloneValue(c.OI.V)
+		} else {
+			delete(obj, k)
+		}
+	}
+
+	return container["data"], nil
+}
+
+// getChild returns the child of a container at key.
+func getChild(container, key interface{}) (interface{}, bool) {
+	switch v := container.(type) {
+	case map[string]interface{}:
+		k, ok := key.(string)
+		if !ok {
+			return nil, false
+		}
+		child, ok := v[k]
+		return child, ok
+	case []interface{}:
+		i, ok := key.(int)
+		if !ok || i < 0 || i >= len(v) {
+			return nil, false
+		}
+		return v[i], true
+	}
+	return nil, false
+}
+
+// setChild replaces the child of a container at key.
+func setChild(container, key, value interface{}) bool {
+	switch v := container.(type) {
+	case map[string]interface{}:
+		k, ok := key.(string)
+		if !ok {
+			return false
+		}
+		v[k] = value
+		return true
+	case []interface{}:
+		i, ok := key.(int)
+		if !ok || i < 0 || i >= len(v) {
+			return false
+		}
+		v[i] = value
+		return true
+	}
+	return false
+}
+
+// valueAt returns the value at path, or nil if it does not exist.
+func valueAt(doc interface{}, path Path) interface{} {
+	elem := doc
+	for _, p := range path {
+		child, ok := getChild(elem, p)
+		if !ok {
+			return nil
+		}
+		elem = child
+	}
+	return elem
+}
+
+// toFloat converts a JSON number to float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// pathMatches reports whether two paths are identical.
+func pathMatches(p1, p2 Path) bool {
+	if len(p1) != len(p2) {
+		return false
+	}
+	for i := range p1 {
+		if !pathElemEqual(p1[i], p2[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// pathElemEqual compares two path elements.
+func pathElemEqual(a, b interface{}) bool {
+	return a == b
+}
+
+// pathString formats a path for error messages.
+func pathString(p Path) string {
+	parts := make([]string, len(p))
+	for i, e := range p {
+		parts[i] = fmt.Sprint(e)
+	}
+	return "/" + strings.Join(parts, "/")
+}
@@ -0,0 +1,417 @@
+package json0
+
+import (
+	"github.com/coreseekdev/texere/pkg/ot"
+)
+
+// side identifies which of two concurrent operations a component belongs to.
+// The left side wins ties, e.g. two inserts at the same list index.
+type side int
+
+const (
+	left side = iota
+	right
+)
+
+// Transform transforms two concurrent operations against each other.
+//
+// Given operations that were applied concurrently to the same document,
+// Transform produces operation1' and operation2' such that:
+//
+//	apply(apply(S, A), B') = apply(apply(S, B), A')
+//
+// operation1 wins ties: its list inserts at the same index come first,
+// and its object inserts at the same key overwrite operation2's.
+//
+// Returns an error if an embedded text transform fails, or a deleted
+// value cannot be updated to reflect the other operation.
+func Transform(operation1, operation2 *Operation) (*Operation, *Operation, error) {
+	if err := operation1.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if err := operation2.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	left, right, err := transformX(operation1.components, operation2.components)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Operation{components: left}, &Operation{components: right}, nil
+}
+
+// transformX transforms leftOp and rightOp against each other.
+//
+// Corresponds to transformX in ShareDB's bootstrapTransform.
+func transformX(leftOp, rightOp []Component) ([]Component, []Component, error) {
+	var newRightOp []Component
+
+	for _, rc := range rightOp {
+		rightComponent := &rc
+
+		// Generate newLeftOp by composing leftOp by rightComponent
+		var newLeftOp []Component
+		k := 0
+		for k < len(leftOp) {
+			var nextC []Component
+			var err error
+			if newLeftOp, err = transformComponent(newLeftOp, leftOp[k], *rightComponent, left); err != nil {
+				return nil, nil, err
+			}
+			if nextC, err = transformComponent(nextC, *rightComponent, leftOp[k], right); err != nil {
+				return nil, nil, err
+			}
+			k++
+
+			if len(nextC) == 1 {
+				rightComponent = &nextC[0]
+				continue
+			}
+
+			if len(nextC) == 0 {
+				for _, c := range leftOp[k:] {
+					if newLeftOp, err = appendComponent(newLeftOp, c); err != nil {
+						return nil, nil, err
+					}
+				}
+			} else {
+				// Recurse
+				l, r, err := transformX(leftOp[k:], nextC)
+				if err != nil {
+					return nil, nil, err
+				}
+				for _, c := range l {
+					if newLeftOp, err = appendComponent(newLeftOp, c); err != nil {
+						return nil, nil, err
+					}
+				}
+				for _, c := range r {
+					if newRightOp, err = appendComponent(newRightOp, c); err != nil {
+						return nil, nil, err
+					}
+				}
+			}
+			rightComponent = nil
+			break
+		}
+
+		if rightComponent != nil {
+			var err error
+			if newRightOp, err = appendComponent(newRightOp, *rightComponent); err != nil {
+				return nil, nil, err
+			}
+		}
+		leftOp = newLeftOp
+	}
+
+	return leftOp, newRightOp, nil
+}
+
+// transformComponent transforms c so it applies to a document with otherC
+// applied, and appends the result to dest.
+//
+// Corresponds to json0's transformComponent.
+func transformComponent(dest []Component, c, otherC Component, s side) ([]Component, error) {
+	c = c.clone()
+	common, hasCommon := commonLength(otherC, c)
+	common2, hasCommon2 := commonLength(c, otherC)
+	cplength := c.operandLength()
+	otherCplength := otherC.operandLength()
+
+	// If c is deleting something that otherC changes, update the deleted
+	// value so c stays invertible.
+	if hasCommon2 && otherCplength > cplength && pathElemEqual(at(c.P, common2), at(otherC.P, common2)) {
+		if c.LD != nil || c.OD != nil {
+			oc := otherC.clone()
+			oc.P = oc.P[cplength:]
+			if c.LD != nil {
+				v, err := applyComponent(cloneValue(c.LD.V), oc)
+				if err != nil {
+					return nil, err
+				}
+				c.LD = &Value{V: v}
+			} else {
+				v, err := applyComponent(cloneValue(c.OD.V), oc)
+				if err != nil {
+					return nil, err
+				}
+				c.OD = &Value{V: v}
+			}
+		}
+	}
+
+	if hasCommon {
+		commonOperand := cplength == otherCplength
+		same := pathElemEqual(at(c.P, common), at(otherC.P, common))
+
+		switch {
+		case otherC.isSubtype():
+			if c.isSubtype() && c.T == otherC.T {
+				res, err := transformText(c.O, otherC.O, s)
+				if err != nil {
+					return nil, err
+				}
+				if !res.IsNoop() {
+					c.O = res
+					return appendComponent(dest, c)
+				}
+				return dest, nil
+			}
+
+		case otherC.NA != nil:
+			// Number adds commute with everything
+
+		case otherC.LI != nil && otherC.LD != nil:
+			if same {
+				if !commonOperand {
+					return dest, nil
+				} else if c.LD != nil {
+					// We're both replacing one element with another, only one can survive
+					if c.LI != nil && s == left {
+						c.LD = otherC.LI.clone()
+					} else {
+						return dest, nil
+					}
+				}
+			}
+
+		case otherC.LI != nil:
+			if c.LI != nil && c.LD == nil && commonOperand && same {
+				// In li vs. li, left wins
+				if s == right {
+					shift(c.P, common, 1)
+				}
+			} else if o, p, ok := indices(otherC.P, c.P, common); ok && o <= p {
+				shift(c.P, common, 1)
+			}
+
+			if c.LM != nil && commonOperand {
+				// otherC edits the same list we edit
+				if o, ok := index(otherC.P, common); ok && o <= *c.LM {
+					*c.LM++
+				}
+			}
+
+		case otherC.LD != nil:
+			if c.LM != nil && commonOperand {
+				if same {
+					// They deleted the thing we're trying to move
+					return dest, nil
+				}
+				// otherC edits the same list we edit
+				p, from, _ := indices(otherC.P, c.P, common)
+				to := *c.LM
+				if p < to || (p == to && from < to) {
+					*c.LM--
+				}
+			}
+
+			if o, p, ok := indices(otherC.P, c.P, common); ok && o < p {
+				shift(c.P, common, -1)
+			} else if same {
+				if otherCplength < cplength {
+					// We're below the deleted element
+					return dest, nil
+				} else if c.LD != nil {
+					if c.LI != nil {
+						// We're replacing, they're deleting: we become an insert
+						c.LD = nil
+					} else {
+						// We're trying to delete the same element
+						return dest, nil
+					}
+				}
+			}
+
+		case otherC.LM != nil:
+			if c.LM != nil && cplength == otherCplength {
+				// lm vs. lm
+				from, otherFrom, _ := indices(c.P, otherC.P, common)
+				to, otherTo := *c.LM, *otherC.LM
+				if otherFrom != otherTo {
+					if from == otherFrom {
+						// They moved it, tie break
+						if s == left {
+							c.P[common] = otherTo
+							if from == to {
+								*c.LM = otherTo
+							}
+						} else {
+							return dest, nil
+						}
+					} else {
+						// They moved around it
+						if from > otherFrom {
+							shift(c.P, common, -1)
+						}
+						if from > otherTo {
+							shift(c.P, common, 1)
+						} else if from == otherTo && otherFrom > otherTo {
+							shift(c.P, common, 1)
+							if from == to {
+								*c.LM++
+							}
+						}
+
+						// Where am I going to put it?
+						if to > otherFrom {
+							*c.LM--
+						} else if to == otherFrom && to > from {
+							*c.LM--
+						}
+						if to > otherTo {
+							*c.LM++
+						} else if to == otherTo {
+							// If we're both moving in the same direction, tie break
+							if (otherTo > otherFrom && to > from) || (otherTo < otherFrom && to < from) {
+								if s == right {
+									*c.LM++
+								}
+							} else {
+								if to > from {
+									*c.LM++
+								} else if to == otherFrom {
+									*c.LM--
+								}
+							}
+						}
+					}
+				}
+			} else if c.LI != nil && c.LD == nil && commonOperand {
+				// li
+				from, p, ok := indices(otherC.P, c.P, common)
+				to := *otherC.LM
+				if ok && p > from {
+					shift(c.P, common, -1)
+				}
+				if ok && p > to {
+					shift(c.P, common, 1)
+				}
+			} else {
+				// ld, ld+li, na, oi, od, oi+od, subtypes and any li beneath the lm
+				// care about where their item is after the move
+				from, p, ok := indices(otherC.P, c.P, common)
+				to := *otherC.LM
+				if ok {
+					if p == from {
+						c.P[common] = to
+					} else {
+						if p > from {
+							shift(c.P, common, -1)
+						}
+						if p > to {
+							shift(c.P, common, 1)
+						} else if p == to && from > to {
+							shift(c.P, common, 1)
+						}
+					}
+				}
+			}
+
+		case otherC.OI != nil && otherC.OD != nil:
+			if same {
+				if c.OI != nil && commonOperand {
+					// We inserted where someone else replaced
+					if s == right {
+						// Left wins
+						return dest, nil
+					}
+					// We win, make our op replace what they inserted
+					c.OD = otherC.OI.clone()
+				} else {
+					// Noop if the other component is deleting the same object (or any parent)
+					return dest, nil
+				}
+			}
+
+		case otherC.OI != nil:
+			if c.OI != nil && same {
+				// Left wins if we try to insert at the same place
+				if s == right {
+					return dest, nil
+				}
+				var err error
+				if dest, err = appendComponent(dest, Component{P: c.P.clone(), OD: otherC.OI.clone()}); err != nil {
+					return nil, err
+				}
+			}
+
+		case otherC.OD != nil:
+			if same {
+				if !commonOperand {
+					return dest, nil
+				}
+				if c.OI != nil {
+					c.OD = nil
+				} else {
+					return dest, nil
+				}
+			}
+		}
+	}
+
+	return appendComponent(dest, c)
+}
+
+// transformText transforms the text operation a against b.
+// The left side's inserts win ties.
+func transformText(a, b *ot.Operation, s side) (*ot.Operation, error) {
+	if s == left {
+		aPrime, _, err := ot.Transform(a, b)
+		return aPrime, err
+	}
+	_, aPrime, err := ot.Transform(b, a)
+	return aPrime, err
+}
+
+// commonLength returns the length of the common path prefix of a and b's
+// operands, or false if b's operand is not inside a's.
+//
+// Corresponds to json0's commonLengthForOps.
+func commonLength(a, b Component) (int, bool) {
+	alen := a.operandLength()
+	blen := b.operandLength()
+	if alen == 0 {
+		return -1, true
+	}
+	if blen == 0 {
+		return 0, false
+	}
+
+	alen--
+	blen--
+	for i := 0; i < alen; i++ {
+		if i >= blen || !pathElemEqual(a.P[i], b.P[i]) {
+			return 0, false
+		}
+	}
+	return alen, true
+}
+
+// at returns the path element at i, or nil if it is out of range.
+func at(p Path, i int) interface{} {
+	if i < 0 || i >= len(p) {
+		return nil
+	}
+	return p[i]
+}
+
+// index returns the path element at i as a list index.
+func index(p Path, i int) (int, bool) {
+	n, ok := at(p, i).(int)
+	return n, ok
+}
+
+// indices returns the list indices of two paths at i.
+func indices(p1, p2 Path, i int) (int, int, bool) {
+	a, ok1 := index(p1, i)
+	b, ok2 := index(p2, i)
+	return a, b, ok1 && ok2
+}
+
+// shift adds delta to the list index at i.
+func shift(p Path, i, delta int) {
+	if n, ok := index(p, i); ok {
+		p[i] = n + delta
+	}
+}
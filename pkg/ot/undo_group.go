@@ -0,0 +1,153 @@
+package ot
+
+import (
+	"sync"
+	"time"
+)
+
+// UndoEdit describes a local edit offered to an undo grouping policy.
+type UndoEdit struct {
+	Operation *Operation // Forward operation that was applied
+	Time      time.Time  // When the edit was applied
+}
+
+// GroupPolicy decides whether an edit joins the undo group of the
+// previous edit, so that both are undone in one step.
+type GroupPolicy interface {
+	ShouldGroup(prev, next UndoEdit) bool
+}
+
+// GroupPolicyFunc adapts a function to the GroupPolicy interface.
+type GroupPolicyFunc func(prev, next UndoEdit) bool
+
+// ShouldGroup calls f(prev, next).
+func (f GroupPolicyFunc) ShouldGroup(prev, next UndoEdit) bool {
+	return f(prev, next)
+}
+
+// TimeWindowPolicy groups edits made within window of each other.
+//
+// Example:
+//
+//	policy := ot.TimeWindowPolicy(500 * time.Millisecond)
+func TimeWindowPolicy(window time.Duration) GroupPolicy {
+	return GroupPolicyFunc(func(prev, next UndoEdit) bool {
+		gap := next.Time.Sub(prev.Time)
+		return gap >= 0 && gap <= window
+	})
+}
+
+// AdjacentEditsPolicy groups consecutive inserts that continue each other
+// and consecutive deletes made with backspace or the delete key, using
+// Operation.ShouldBeComposedWith.
+func AdjacentEditsPolicy() GroupPolicy {
+	return GroupPolicyFunc(func(prev, next UndoEdit) bool {
+		return prev.Operation.ShouldBeComposedWith(next.Operation)
+	})
+}
+
+// AllOf groups edits only if every policy groups them.
+//
+// Example:
+//
+//	policy := ot.AllOf(ot.TimeWindowPolicy(time.Second), ot.AdjacentEditsPolicy())
+func AllOf(policies ...GroupPolicy) GroupPolicy {
+	return GroupPolicyFunc(func(prev, next UndoEdit) bool {
+		for _, p := range policies {
+			if !p.ShouldGroup(prev, next) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// UndoGrouper tracks undo groups for an undo implementation.
+//
+// Edits are grouped by the policy, or explicitly between BeginGroup and
+// EndGroup. UndoManager and concordia.History both use an UndoGrouper,
+// so a policy behaves the same with either undo implementation.
+//
+// A nil policy never groups; only explicit groups apply.
+type UndoGrouper struct {
+	mu     sync.Mutex
+	policy GroupPolicy
+	depth  int       // Nesting depth of explicit groups
+	fresh  bool      // Next edit starts a new group
+	last   *UndoEdit // Previous edit
+}
+
+// NewUndoGrouper creates a grouper with the given policy.
+func NewUndoGrouper(policy GroupPolicy) *UndoGrouper {
+	return &UndoGrouper{policy: policy, fresh: true}
+}
+
+// SetPolicy replaces the grouping policy.
+func (g *UndoGrouper) SetPolicy(policy GroupPolicy) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.policy = policy
+}
+
+// BeginGroup starts an explicit group: every edit until the matching
+// EndGroup is undone in one step. Groups may be nested; only the
+// outermost one counts.
+func (g *UndoGrouper) BeginGroup() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.depth == 0 {
+		g.fresh = true
+	}
+	g.depth++
+}
+
+// EndGroup ends an explicit group. The next edit starts a new group.
+func (g *UndoGrouper) EndGroup() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.depth == 0 {
+		return
+	}
+	g.depth--
+	if g.depth == 0 {
+		g.fresh = true
+	}
+}
+
+// InGroup returns true between BeginGroup and EndGroup.
+func (g *UndoGrouper) InGroup() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.depth > 0
+}
+
+// Break makes the next edit start a new group, e.g. after undo, redo or
+// a cursor jump. It does not end an explicit group.
+func (g *UndoGrouper) Break() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.depth == 0 {
+		g.fresh = true
+	}
+}
+
+// Next records an edit and reports whether it joins the previous edit's group.
+func (g *UndoGrouper) Next(edit UndoEdit) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	prev := g.last
+	g.last = &edit
+
+	if g.fresh {
+		g.fresh = false
+		return false
+	}
+	if g.depth > 0 {
+		return true
+	}
+	if prev == nil || g.policy == nil {
+		return false
+	}
+	return g.policy.ShouldGroup(*prev, edit)
+}
@@ -0,0 +1,91 @@
+package ot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestUndoGrouper_Policies tests policy-based and explicit grouping.
+func TestUndoGrouper_Policies(t *testing.T) {
+	start := time.Unix(0, 0)
+	edit := func(op *Operation, offset time.Duration) UndoEdit {
+		return UndoEdit{Operation: op, Time: start.Add(offset)}
+	}
+	typeA := NewBuilder().Insert("a").Build()
+	typeB := NewBuilder().Retain(1).Insert("b").Build()
+	typeFar := NewBuilder().Insert("c").Retain(2).Build()
+
+	g := NewUndoGrouper(AllOf(TimeWindowPolicy(time.Second), AdjacentEditsPolicy()))
+	assert.False(t, g.Next(edit(typeA, 0)), "first edit starts a group")
+	assert.True(t, g.Next(edit(typeB, 500*time.Millisecond)))
+	assert.False(t, g.Next(edit(typeFar, 600*time.Millisecond)), "not adjacent")
+	assert.False(t, g.Next(edit(typeA, 5*time.Second)), "outside the window")
+
+	g.Break()
+	assert.False(t, g.Next(edit(typeB, 5*time.Second)))
+
+	// Explicit groups ignore the policy, and nest
+	g.BeginGroup()
+	g.BeginGroup()
+	assert.False(t, g.Next(edit(typeA, time.Hour)))
+	g.EndGroup()
+	assert.True(t, g.InGroup())
+	assert.True(t, g.Next(edit(typeFar, 2*time.Hour)))
+	g.EndGroup()
+	assert.False(t, g.Next(edit(typeB, 2*time.Hour)), "a group ends its undo step")
+
+	assert.False(t, NewUndoGrouper(nil).Next(edit(typeA, 0)))
+}
+
+// TestUndoManager_Record tests grouped undo with UndoManager.
+func TestUndoManager_Record(t *testing.T) {
+	doc := ""
+	um := NewUndoManager(10)
+	um.SetGroupPolicy(AdjacentEditsPolicy())
+
+	typeText := func(pos int, text string) {
+		op := NewBuilder().Retain(pos).Insert(text).Retain(len(doc) - pos).Build()
+		inverse := op.Invert(doc)
+		var err error
+		doc, err = op.Apply(doc)
+		require.NoError(t, err)
+		um.Record(op, inverse)
+	}
+	undo := func() {
+		require.NoError(t, um.PerformUndo(func(op *Operation) {
+			inverse := op.Invert(doc)
+			var err error
+			doc, err = op.Apply(doc)
+			require.NoError(t, err)
+			um.Record(op, inverse)
+		}))
+	}
+
+	typeText(0, "H")
+	typeText(1, "i")
+	typeText(0, ">")
+	assert.Equal(t, ">Hi", doc)
+	assert.Equal(t, 2, um.UndoStackLength())
+
+	um.BeginGroup()
+	typeText(3, " there")
+	typeText(0, "[")
+	um.EndGroup()
+	assert.Equal(t, 3, um.UndoStackLength())
+
+	undo()
+	assert.Equal(t, ">Hi", doc)
+	assert.Equal(t, 1, um.RedoStackLength())
+
+	// Typing after undo starts a new step even if adjacent
+	typeText(3, "!")
+	typeText(4, "!")
+	assert.Equal(t, 3, um.UndoStackLength())
+	undo()
+	undo()
+	undo()
+	assert.Equal(t, "", doc)
+}
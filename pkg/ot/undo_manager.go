@@ -2,6 +2,7 @@ package ot
 
 import (
 	"sync"
+	"time"
 )
 
 // UndoManagerState represents the current state of the undo manager.
@@ -45,6 +46,7 @@ type UndoManager struct {
 	dontCompose bool
 	undoStack   []*Operation
 	redoStack   []*Operation
+	grouper     *UndoGrouper
 }
 
 // NewUndoManager creates a new undo manager.
@@ -67,6 +69,7 @@ func NewUndoManager(maxItems int) *UndoManager {
 		state:     StateNormal,
 		undoStack: make([]*Operation, 0, maxItems),
 		redoStack: make([]*Operation, 0, maxItems),
+		grouper:   NewUndoGrouper(nil),
 	}
 }
 
@@ -135,6 +138,77 @@ func (um *UndoManager) Add(operation *Operation, compose bool) {
 	}
 }
 
+// SetGroupPolicy sets the policy Record uses to group edits into one
+// undo step. A nil policy (the default) gives one step per edit.
+//
+// Example:
+//
+//	um.SetGroupPolicy(AllOf(TimeWindowPolicy(time.Second), AdjacentEditsPolicy()))
+func (um *UndoManager) SetGroupPolicy(policy GroupPolicy) {
+	um.grouper.SetPolicy(policy)
+}
+
+// BeginGroup starts an explicit undo group: edits recorded until EndGroup
+// are undone in one step.
+func (um *UndoManager) BeginGroup() {
+	um.grouper.BeginGroup()
+}
+
+// EndGroup ends an explicit undo group.
+func (um *UndoManager) EndGroup() {
+	um.grouper.EndGroup()
+}
+
+// BreakGroup makes the next recorded edit start a new undo step.
+func (um *UndoManager) BreakGroup() {
+	um.grouper.Break()
+}
+
+// Record adds a locally applied edit to the undo stack, grouping it with
+// the previous edit according to the group policy.
+//
+// Unlike Add, Record takes both the applied operation, which the policy
+// inspects, and its inverse, which is pushed. Inside PerformUndo or
+// PerformRedo it behaves like Add(inverse, false).
+//
+// Example:
+//
+//	op := NewBuilder().Retain(5).Insert("!").Build()
+//	inverse := op.Invert(doc)
+//	doc, _ = op.Apply(doc)
+//	um.Record(op, inverse)
+func (um *UndoManager) Record(operation, inverse *Operation) {
+	um.mu.Lock()
+	state := um.state
+	um.mu.Unlock()
+	if state != StateNormal {
+		um.Add(inverse, false)
+		return
+	}
+
+	group := um.grouper.Next(UndoEdit{Operation: operation, Time: time.Now()})
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if group && len(um.undoStack) > 0 {
+		// Undoing the group undoes the newest edit first
+		lastOp := um.undoStack[len(um.undoStack)-1]
+		if composedOp, err := Compose(inverse, lastOp); err == nil {
+			um.undoStack[len(um.undoStack)-1] = composedOp
+			um.redoStack = um.redoStack[:0]
+			return
+		}
+	}
+
+	um.undoStack = append(um.undoStack, inverse)
+	if len(um.undoStack) > um.maxItems {
+		um.undoStack = um.undoStack[1:]
+	}
+	um.dontCompose = false
+	um.redoStack = um.redoStack[:0]
+}
+
 // Transform transforms both undo and redo stacks against a remote operation.
 //
 // This should be called when a remote operation is received, before applying
@@ -231,6 +305,7 @@ func (um *UndoManager) PerformUndo(fn func(op *Operation)) error {
 	}
 
 	um.state = StateUndoing
+	um.grouper.Break()
 
 	// Pop the last operation
 	op := um.undoStack[len(um.undoStack)-1]
@@ -281,6 +356,7 @@ func (um *UndoManager) PerformRedo(fn func(op *Operation)) error {
 	}
 
 	um.state = StateRedoing
+	um.grouper.Break()
 
 	// Pop the last operation
 	op := um.redoStack[len(um.redoStack)-1]
@@ -338,6 +414,7 @@ func (um *UndoManager) Clear() {
 
 	um.undoStack = um.undoStack[:0]
 	um.redoStack = um.redoStack[:0]
+	um.grouper.Break()
 }
 
 // UndoStackLength returns the number of operations in the undo stack.
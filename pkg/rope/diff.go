@@ -0,0 +1,428 @@
+package rope
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// ========== Structural Diff ==========
+
+// Diff computes a ChangeSet that transforms a into b.
+//
+// The diff works on the rope structure rather than flattened strings:
+//   - subtrees shared by both trees (the same node, as left behind by
+//     Insert and Delete) are retained without descending into them
+//   - the subtrees that differ are opened one level at a time and their
+//     children matched again, down to the leaves
+//   - the remaining chunks are matched by chunk hash, and a Myers diff
+//     runs only on the characters of chunks that changed
+//
+// When b was made by editing a, this visits the nodes on the paths to the
+// edits and their siblings, and reads only the text of the edited chunks:
+// the cost grows with the number and size of the edits and the depth of
+// the tree, not with the size of the document. Ropes that share no nodes
+// are opened down to their leaves, which are matched by chunk hash; for
+// two results of NewChunked only the chunks around the edits differ.
+//
+// Example:
+//
+//	old := rope.New("Hello World")
+//	edited, _ := old.Replace(6, 11, "Gophers")
+//	cs := rope.Diff(old, edited)
+//	result, _ := cs.Apply(old) // "Hello Gophers"
+func Diff(a, b *Rope) *ChangeSet {
+	d := &differ{cs: NewChangeSet(a.Length())}
+	d.diffNodes(rootNodes(a), rootNodes(b))
+	d.cs.fuse()
+	return d.cs
+}
+
+// DiffLines computes a ChangeSet that transforms a into b by matching
+// whole lines first and then diffing the characters of the lines that
+// changed. Unlike Diff, an edit never matches characters across line
+// boundaries, so separate edits stay in separate hunks, as a three-way
+// merge needs.
+//
+// Example:
+//
+//	cs := rope.DiffLines(base, local)
+func DiffLines(a, b *Rope) *ChangeSet {
+	d := &differ{cs: NewChangeSet(a.Length())}
+
+	if a.root == b.root {
+		d.retain(a.Length())
+		return d.cs
+	}
+
+	linesA, linesB := splitLines(a.String()), splitLines(b.String())
+
+	posA, posB := 0, 0
+	for _, s := range commonSpans(linesA, linesB, 0, 0, nil) {
+		d.diffText(strings.Join(linesA[posA:s.a], ""), strings.Join(linesB[posB:s.b], ""))
+		for _, line := range linesA[s.a : s.a+s.n] {
+			d.retain(utf8.RuneCountInString(line))
+		}
+		posA, posB = s.a+s.n, s.b+s.n
+	}
+	d.diffText(strings.Join(linesA[posA:], ""), strings.Join(linesB[posB:], ""))
+
+	d.cs.fuse()
+	return d.cs
+}
+
+// splitLines splits text after each line break.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// differ accumulates the ChangeSet produced by Diff.
+type differ struct {
+	cs *ChangeSet
+}
+
+func (d *differ) retain(n int) {
+	if n > 0 {
+		d.cs.Retain(n)
+	}
+}
+
+func (d *differ) delete(n int) {
+	if n > 0 {
+		d.cs.Delete(n)
+	}
+}
+
+func (d *differ) insert(text string) {
+	if text != "" {
+		d.cs.Insert(text)
+	}
+}
+
+// rootNodes returns the root of a rope as a node list for diffNodes.
+func rootNodes(r *Rope) []RopeNode {
+	if r == nil || r.root == nil || r.Length() == 0 {
+		return nil
+	}
+	return []RopeNode{r.root}
+}
+
+// diffNodes matches two sequences of subtrees: shared nodes are retained
+// whole, and the runs between them are diffed by diffSubtrees.
+func (d *differ) diffNodes(a, b []RopeNode) {
+	if !sharesNode(a, b) {
+		// Nothing to match at this level; Myers would only pay for
+		// finding that out
+		d.diffSubtrees(a, b)
+		return
+	}
+
+	posA, posB := 0, 0
+	for _, s := range commonSpans(a, b, 0, 0, nil) {
+		d.diffSubtrees(a[posA:s.a], b[posB:s.b])
+		for _, node := range a[s.a : s.a+s.n] {
+			d.retain(node.Length())
+		}
+		posA, posB = s.a+s.n, s.b+s.n
+	}
+	d.diffSubtrees(a[posA:], b[posB:])
+}
+
+// sharesNode reports whether a node of b is also in a.
+func sharesNode(a, b []RopeNode) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	nodes := make(map[RopeNode]bool, len(a))
+	for _, node := range a {
+		nodes[node] = true
+	}
+	for _, node := range b {
+		if nodes[node] {
+			return true
+		}
+	}
+	return false
+}
+
+// diffSubtrees diffs runs of subtrees that did not match as a whole,
+// replacing internal nodes by their children until only leaves are left.
+func (d *differ) diffSubtrees(a, b []RopeNode) {
+	switch {
+	case len(a) == 0:
+		for _, node := range b {
+			d.insert(node.Slice(0, node.Length()))
+		}
+		return
+	case len(b) == 0:
+		for _, node := range a {
+			d.delete(node.Length())
+		}
+		return
+	}
+
+	childrenA, openedA := openNodes(a)
+	childrenB, openedB := openNodes(b)
+	if !openedA && !openedB {
+		d.diffChunks(asLeaves(a), asLeaves(b))
+		return
+	}
+	d.diffNodes(childrenA, childrenB)
+}
+
+// openNodes replaces the internal nodes of a list by their children.
+// Returns false if all nodes are leaves.
+func openNodes(nodes []RopeNode) ([]RopeNode, bool) {
+	opened := false
+	children := make([]RopeNode, 0, 2*len(nodes))
+	for _, node := range nodes {
+		if internal, ok := node.(*InternalNode); ok {
+			children = append(children, internal.left, internal.right)
+			opened = true
+			continue
+		}
+		children = append(children, node)
+	}
+	return children, opened
+}
+
+// asLeaves converts a list of leaf nodes.
+func asLeaves(nodes []RopeNode) []*LeafNode {
+	leaves := make([]*LeafNode, len(nodes))
+	for i, node := range nodes {
+		leaves[i] = node.(*LeafNode)
+	}
+	return leaves
+}
+
+// chunkKey identifies chunk content for matching.
+type chunkKey struct {
+	hash   uint32
+	length int
+}
+
+// diffChunks matches chunks by hash and diffs the characters of the
+// chunks that did not match. Equal chunks at either end are compared
+// directly, which is cheaper than hashing them.
+func (d *differ) diffChunks(a, b []*LeafNode) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix].text == b[prefix].text {
+		d.retain(a[prefix].Length())
+		prefix++
+	}
+	a, b = a[prefix:], b[prefix:]
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix].text == b[len(b)-1-suffix].text {
+		suffix++
+	}
+
+	d.matchChunks(a[:len(a)-suffix], b[:len(b)-suffix])
+	for _, leaf := range a[len(a)-suffix:] {
+		d.retain(leaf.Length())
+	}
+}
+
+// matchChunks matches chunks by hash and diffs the characters of the
+// chunks in between.
+func (d *differ) matchChunks(a, b []*LeafNode) {
+	keysA, keysB := chunkKeys(a), chunkKeys(b)
+
+	posA, posB := 0, 0
+	for _, s := range commonSpans(keysA, keysB, 0, 0, nil) {
+		d.diffText(joinLeaves(a[posA:s.a]), joinLeaves(b[posB:s.b]))
+		for i := 0; i < s.n; i++ {
+			// Equal hashes are checked against the text
+			d.diffText(a[s.a+i].text, b[s.b+i].text)
+		}
+		posA, posB = s.a+s.n, s.b+s.n
+	}
+	d.diffText(joinLeaves(a[posA:]), joinLeaves(b[posB:]))
+}
+
+// diffText runs a Myers diff on the characters of two texts.
+func (d *differ) diffText(a, b string) {
+	if a == b {
+		d.retain(utf8.RuneCountInString(a))
+		return
+	}
+	runesA, runesB := []rune(a), []rune(b)
+
+	posA, posB := 0, 0
+	for _, s := range commonSpans(runesA, runesB, 0, 0, nil) {
+		d.delete(s.a - posA)
+		d.insert(string(runesB[posB:s.b]))
+		d.retain(s.n)
+		posA, posB = s.a+s.n, s.b+s.n
+	}
+	d.delete(len(runesA) - posA)
+	d.insert(string(runesB[posB:]))
+}
+
+// chunkKeys hashes each leaf with the chunk hash of ChunkHashes.
+func chunkKeys(leaves []*LeafNode) []chunkKey {
+	keys := make([]chunkKey, len(leaves))
+	for i, leaf := range leaves {
+		keys[i] = chunkKey{hash: chunkHash(leaf.text), length: len(leaf.text)}
+	}
+	return keys
+}
+
+// joinLeaves concatenates the text of leaves.
+func joinLeaves(leaves []*LeafNode) string {
+	if len(leaves) == 1 {
+		return leaves[0].text
+	}
+	var sb strings.Builder
+	for _, leaf := range leaves {
+		sb.WriteString(leaf.text)
+	}
+	return sb.String()
+}
+
+// ---------- Myers diff ----------
+
+// span is a run of n equal elements at a[a:] and b[b:].
+type span struct {
+	a, b, n int
+}
+
+// commonSpans appends the equal runs of a longest common subsequence of
+// a and b, in order. aOff and bOff are the positions of a and b in the
+// original sequences.
+//
+// This is Myers' O(ND) algorithm in linear space: the middle snake splits
+// the problem in two, recursively.
+func commonSpans[T comparable](a, b []T, aOff, bOff int, spans []span) []span {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	if prefix > 0 {
+		spans = appendSpan(spans, span{aOff, bOff, prefix})
+		a, b = a[prefix:], b[prefix:]
+		aOff, bOff = aOff+prefix, bOff+prefix
+	}
+
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	if len(a) > 0 && len(b) > 0 {
+		if x, y := middleSnake(a, b); x >= 0 {
+			spans = commonSpans(a[:x], b[:y], aOff, bOff, spans)
+			spans = commonSpans(a[x:], b[y:], aOff+x, bOff+y, spans)
+		}
+	}
+
+	if suffix > 0 {
+		spans = appendSpan(spans, span{aOff + len(a), bOff + len(b), suffix})
+	}
+	return spans
+}
+
+// appendSpan appends s, merging it with the previous span if they touch.
+func appendSpan(spans []span, s span) []span {
+	if n := len(spans); n > 0 {
+		last := &spans[n-1]
+		if last.a+last.n == s.a && last.b+last.n == s.b {
+			last.n += s.n
+			return spans
+		}
+	}
+	return append(spans, s)
+}
+
+// middleSnake finds the point where the forward and reverse searches of
+// Myers' algorithm meet, or (-1, -1) if a and b have nothing in common.
+// a and b must be non-empty.
+func middleSnake[T comparable](a, b []T) (int, int) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	size := 2*maxD + 2
+
+	forward := make([]int, size)
+	reverse := make([]int, size)
+	for i := range forward {
+		forward[i] = -1
+		reverse[i] = -1
+	}
+	forward[offset+1] = 0
+	reverse[offset+1] = 0
+
+	delta := n - m
+	// With an odd delta the forward search detects the overlap
+	front := delta%2 != 0
+
+	// Diagonals that ran off the edge of the grid are skipped
+	k1start, k1end, k2start, k2end := 0, 0, 0, 0
+
+	for d := 0; d < maxD; d++ {
+		for k1 := -d + k1start; k1 <= d-k1end; k1 += 2 {
+			i := offset + k1
+			var x1 int
+			if k1 == -d || (k1 != d && forward[i-1] < forward[i+1]) {
+				x1 = forward[i+1]
+			} else {
+				x1 = forward[i-1] + 1
+			}
+			y1 := x1 - k1
+			for x1 < n && y1 < m && a[x1] == b[y1] {
+				x1++
+				y1++
+			}
+			forward[i] = x1
+
+			switch {
+			case x1 > n:
+				k1end += 2
+			case y1 > m:
+				k1start += 2
+			case front:
+				j := offset + delta - k1
+				if j >= 0 && j < size && reverse[j] != -1 && x1 >= n-reverse[j] {
+					return x1, y1
+				}
+			}
+		}
+
+		for k2 := -d + k2start; k2 <= d-k2end; k2 += 2 {
+			i := offset + k2
+			var x2 int
+			if k2 == -d || (k2 != d && reverse[i-1] < reverse[i+1]) {
+				x2 = reverse[i+1]
+			} else {
+				x2 = reverse[i-1] + 1
+			}
+			y2 := x2 - k2
+			for x2 < n && y2 < m && a[n-x2-1] == b[m-y2-1] {
+				x2++
+				y2++
+			}
+			reverse[i] = x2
+
+			switch {
+			case x2 > n:
+				k2end += 2
+			case y2 > m:
+				k2start += 2
+			case !front:
+				j := offset + delta - k2
+				if j >= 0 && j < size && forward[j] != -1 {
+					x1 := forward[j]
+					y1 := offset + x1 - j
+					if x1 >= n-x2 {
+						return x1, y1
+					}
+				}
+			}
+		}
+	}
+
+	return -1, -1
+}
@@ -0,0 +1,242 @@
+package rope
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// assertDiff checks that Diff(a, b) turns a into b.
+func assertDiff(t *testing.T, a, b *Rope) *ChangeSet {
+	t.Helper()
+	cs := Diff(a, b)
+	assert.Equal(t, a.Length(), cs.LenBefore())
+	assert.Equal(t, b.Length(), cs.LenAfter())
+	result, err := cs.Apply(a)
+	require.NoError(t, err)
+	assert.Equal(t, b.String(), result.String())
+	return cs
+}
+
+func TestDiff_Strings(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+	}{
+		{"identical", "Hello", "Hello"},
+		{"both empty", "", ""},
+		{"from empty", "", "Hello"},
+		{"to empty", "Hello", ""},
+		{"replace word", "Hello World", "Hello Gophers"},
+		{"disjoint", "abc", "xyz"},
+		{"interleaved", "abcabba", "cbabac"},
+		{"unicode", "héllo wörld", "hello wörld!"},
+		{"cjk", "你好世界", "你们好世界"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertDiff(t, New(tt.a), New(tt.b))
+		})
+	}
+}
+
+// editSize returns the number of characters deleted and inserted by cs.
+func editSize(cs *ChangeSet) (deleted, inserted int) {
+	for _, op := range cs.operations {
+		switch op.OpType {
+		case OpDelete:
+			deleted += op.Length
+		case OpInsert:
+			inserted += len([]rune(op.Text))
+		}
+	}
+	return deleted, inserted
+}
+
+func TestDiff_MinimalEdit(t *testing.T) {
+	cs := assertDiff(t, New("The quick brown fox"), New("The quick red fox"))
+
+	// "brown" -> "red" shares the "r"
+	deleted, inserted := editSize(cs)
+	assert.Equal(t, 4, deleted)
+	assert.Equal(t, 2, inserted)
+}
+
+func TestDiff_SharedStructure(t *testing.T) {
+	b := NewBuilder()
+	for i := 0; i < 200; i++ {
+		b.Append(strings.Repeat(string(rune('a'+i%26)), 100))
+	}
+	original, err := b.Build()
+	require.NoError(t, err)
+
+	assert.Equal(t, []Operation{{OpType: OpRetain, Length: original.Length()}},
+		Diff(original, original).operations)
+
+	// Two distant edits: only the chunks around them are diffed
+	edited, err := original.Insert(150, "XYZ")
+	require.NoError(t, err)
+	edited, err = edited.Delete(15000, 15010)
+	require.NoError(t, err)
+
+	cs := assertDiff(t, original, edited)
+	assert.Equal(t, []Operation{
+		{OpType: OpRetain, Length: 150},
+		{OpType: OpInsert, Text: "XYZ"},
+	}, cs.operations[:2])
+	deleted, inserted := editSize(cs)
+	assert.Equal(t, 10, deleted)
+	assert.Equal(t, 3, inserted)
+
+	// Same text, different chunk boundaries
+	assertDiff(t, New(original.String()), edited)
+}
+
+func TestDiff_RandomEdits(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	alphabet := []rune("ab cdé\n")
+	randomText := func(n int) string {
+		runes := make([]rune, n)
+		for i := range runes {
+			runes[i] = alphabet[rng.Intn(len(alphabet))]
+		}
+		return string(runes)
+	}
+
+	for i := 0; i < 100; i++ {
+		a := New(randomText(rng.Intn(300)))
+		b := a
+		for j := rng.Intn(5); j >= 0; j-- {
+			pos := rng.Intn(b.Length() + 1)
+			var err error
+			if rng.Intn(2) == 0 || b.Length() == pos {
+				b, err = b.Insert(pos, randomText(rng.Intn(20)+1))
+			} else {
+				b, err = b.Delete(pos, pos+rng.Intn(b.Length()-pos)+1)
+			}
+			require.NoError(t, err)
+		}
+		assertDiff(t, a, b)
+
+		cs := DiffLines(a, b)
+		result, err := cs.Apply(a)
+		require.NoError(t, err)
+		assert.Equal(t, b.String(), result.String())
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	a := New("one\ntwo\nthree\n")
+	b := New("one\ntwo!\nthree\nfour\n")
+
+	cs := DiffLines(a, b)
+	assert.Equal(t, []Operation{
+		{OpType: OpRetain, Length: 7},
+		{OpType: OpInsert, Text: "!"},
+		{OpType: OpRetain, Length: 7},
+		{OpType: OpInsert, Text: "four\n"},
+	}, cs.operations)
+
+	// Characters are not matched across lines
+	cs = DiffLines(New("ab\ncd\n"), New("xy\nab\n"))
+	assert.Equal(t, []Operation{
+		{OpType: OpInsert, Text: "xy\n"},
+		{OpType: OpRetain, Length: 3},
+		{OpType: OpDelete, Length: 3},
+	}, cs.operations)
+}
+
+// proseText returns about n bytes of random words, which unlike repeated
+// text has chunk boundaries that depend on the content.
+func proseText(rng *rand.Rand, n int) string {
+	words := strings.Fields("the quick brown fox jumps over a lazy dog héllo wörld rope diff chunk leaf tree node edit")
+	var sb strings.Builder
+	for sb.Len() < n {
+		sb.WriteString(words[rng.Intn(len(words))])
+		if rng.Intn(12) == 0 {
+			sb.WriteString(".\n")
+		} else {
+			sb.WriteByte(' ')
+		}
+	}
+	return sb.String()
+}
+
+func TestNewChunked_Resynchronizes(t *testing.T) {
+	text := proseText(rand.New(rand.NewSource(1)), 40000)
+
+	tests := []struct {
+		name, text string
+	}{
+		{"unchanged", text},
+		{"insert", text[:600] + "inserted" + text[600:]},
+		{"multi-byte edge", strings.Replace(text, "wörld", "wårld", 1)},
+		{"delete all", ""},
+		{"prepend", ">" + text},
+		{"append", text + "ö"},
+		{"truncate", text[:len(text)-1]},
+	}
+	original := NewChunked(text)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edited := NewChunked(tt.text)
+			assert.Equal(t, tt.text, edited.String())
+			assertDiff(t, original, edited)
+			for _, leaf := range collectLeaves(edited.root) {
+				assert.LessOrEqual(t, len(leaf.text), DefaultMaxLeafSize)
+			}
+		})
+	}
+
+	// Leaves away from the edit have the same text
+	edited := NewChunked(text[:len(text)/2] + "inserted" + text[len(text)/2:])
+	chunks := make(map[string]bool)
+	for _, leaf := range collectLeaves(original.root) {
+		chunks[leaf.text] = true
+	}
+	leaves := collectLeaves(edited.root)
+	kept := 0
+	for _, leaf := range leaves {
+		if chunks[leaf.text] {
+			kept++
+		}
+	}
+	assert.Greater(t, kept, len(leaves)-3)
+}
+
+// BenchmarkDiff_LargeDocument diffs a 4 MB document against a copy with
+// one edit in the middle, and applies the result.
+func BenchmarkDiff_LargeDocument(b *testing.B) {
+	text := proseText(rand.New(rand.NewSource(1)), 4<<20)
+	edit := text[:len(text)/2] + "edit" + text[len(text)/2:]
+	doc := NewChunked(text)
+	shared, _ := doc.Insert(doc.Length()/2, "edit")
+	chunked := NewChunked(edit)
+
+	b.Run("shared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			Diff(doc, shared)
+		}
+	})
+	b.Run("chunked", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			Diff(doc, chunked)
+		}
+	})
+	b.Run("chunk and diff", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			Diff(NewChunked(text), NewChunked(edit))
+		}
+	})
+	b.Run("apply", func(b *testing.B) {
+		cs := Diff(doc, chunked)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			cs.Apply(doc)
+		}
+	})
+}
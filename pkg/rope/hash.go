@@ -2,6 +2,7 @@ package rope
 
 import (
 	"hash/fnv"
+	"unicode/utf8"
 )
 
 // ========== Hash Support ==========
@@ -108,21 +109,71 @@ func (r *Rope) ChunkHashes() []uint32 {
 	hashes := make([]uint32, 0, it.Count())
 
 	for it.Next() {
-		chunk := it.Current()
-		h := fnv.New32a()
-		h.Write([]byte(chunk))
-		hashes = append(hashes, h.Sum32())
+		hashes = append(hashes, chunkHash(it.Current()))
 	}
 
 	return hashes
 }
 
+// chunkHash returns the hash of a chunk's text.
+func chunkHash(text string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(text))
+	return h.Sum32()
+}
+
 // CombinedChunkHash combines all chunk hashes into a single hash.
 func (r *Rope) CombinedChunkHash() uint32 {
 	hashes := r.ChunkHashes()
 	return CombineHash(hashes...)
 }
 
+// ========== Content-defined Chunking ==========
+
+// chunkMask selects boundaries after DefaultMinLeafSize bytes with a
+// probability of 1/256 per byte, for leaves of about 512 bytes.
+const chunkMask = 1<<8 - 1
+
+// gearTable maps bytes to the random values of the gear hash.
+var gearTable = func() (table [256]uint32) {
+	// splitmix64 with a fixed seed, so boundaries never change
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = uint32(z ^ (z >> 31))
+	}
+	return table
+}()
+
+// nextChunk returns the length of the first chunk of text, cut where a
+// gear hash of the preceding bytes matches chunkMask. The hash shifts out
+// each byte after 32 more, so a boundary depends only on the 32 bytes
+// before it and chunking resynchronizes shortly after an edit. Chunks are
+// DefaultMinLeafSize to DefaultMaxLeafSize bytes and end on a rune
+// boundary.
+func nextChunk(text string) int {
+	if len(text) <= DefaultMaxLeafSize {
+		return len(text)
+	}
+
+	var hash uint32
+	for i := 0; i < DefaultMaxLeafSize; i++ {
+		hash = hash<<1 + gearTable[text[i]]
+		if i+1 >= DefaultMinLeafSize && hash&chunkMask == 0 && utf8.RuneStart(text[i+1]) {
+			return i + 1
+		}
+	}
+
+	n := DefaultMaxLeafSize
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return n
+}
+
 // ========== Rolling Hash ==========
 
 // RollingHasher supports incremental rolling hash computation.
@@ -176,7 +227,6 @@ func (rh *RollingHasher) Roll() bool {
 	// This is a simplified rolling hash implementation
 	// For a true rolling hash, you'd need to remove the outgoing
 	// character and add the incoming character
-	h := fnv.New32a()
 	start := rh.rope.CharToByte(rh.window)
 	end := rh.rope.CharToByte(rh.window + 1)
 	if end > start {
@@ -184,8 +234,7 @@ func (rh *RollingHasher) Roll() bool {
 		if err != nil {
 			return false
 		}
-		h.Write([]byte(slice))
-		rh.hash = rh.hash ^ h.Sum32()
+		rh.hash = rh.hash ^ chunkHash(slice)
 	}
 
 	return true
@@ -0,0 +1,617 @@
+package rope
+
+import (
+	"sort"
+	"sync"
+)
+
+// ============================================================================
+// Markers (sticky anchors)
+// ============================================================================
+
+// MarkerID uniquely identifies a marker within a MarkerTree.
+type MarkerID uint64
+
+// MarkerKind classifies what a marker is used for.
+type MarkerKind string
+
+const (
+	// MarkerBookmark is a point (or range) the user wants to jump back to.
+	MarkerBookmark MarkerKind = "bookmark"
+	// MarkerDiagnostic is a range reported by a linter or compiler.
+	MarkerDiagnostic MarkerKind = "diagnostic"
+	// MarkerComment is a range that a comment thread is anchored to.
+	MarkerComment MarkerKind = "comment"
+)
+
+// Marker is a long-lived range [Start, End) in a document that is kept up to
+// date as the document is edited.
+//
+// StartAssoc and EndAssoc control how each end of the range moves when text
+// is inserted exactly at it, using the same semantics as Helix:
+//   - AssocBefore / AssocBeforeSticky stay in front of the inserted text
+//   - AssocAfter / AssocAfterSticky move behind the inserted text
+//   - AssocAfterWord moves past the leading word characters of the insert
+//   - AssocBeforeWord stays in front of the trailing word characters
+//
+// The sticky variants additionally keep their offset inside exact-size
+// replacements.
+type Marker struct {
+	ID         MarkerID
+	Kind       MarkerKind
+	Start      int
+	End        int
+	StartAssoc Assoc
+	EndAssoc   Assoc
+	Data       interface{}
+}
+
+// IsPoint returns true if the marker covers no characters.
+func (m *Marker) IsPoint() bool {
+	return m.Start == m.End
+}
+
+// Len returns the number of characters covered by the marker.
+func (m *Marker) Len() int {
+	return m.End - m.Start
+}
+
+// Overlaps returns true if the marker intersects [start, end).
+// A point marker overlaps a range if it lies within [start, end], and a
+// point query (start == end) matches ranges containing that position.
+func (m *Marker) Overlaps(start, end int) bool {
+	switch {
+	case m.IsPoint() && start == end:
+		return m.Start == start
+	case m.IsPoint():
+		return start <= m.Start && m.Start <= end
+	case start == end:
+		return m.Start <= start && start < m.End
+	default:
+		return m.Start < end && start < m.End
+	}
+}
+
+// markerNode is a node of the treap backing MarkerTree.
+// Nodes are ordered by (Start, ID) and augmented with the maximum End
+// of their subtree for interval queries.
+type markerNode struct {
+	marker   *Marker
+	priority uint64
+	maxEnd   int
+	left     *markerNode
+	right    *markerNode
+}
+
+func (n *markerNode) update() {
+	n.maxEnd = n.marker.End
+	if n.left != nil && n.left.maxEnd > n.maxEnd {
+		n.maxEnd = n.left.maxEnd
+	}
+	if n.right != nil && n.right.maxEnd > n.maxEnd {
+		n.maxEnd = n.right.maxEnd
+	}
+}
+
+func markerLess(a, b *Marker) bool {
+	if a.Start != b.Start {
+		return a.Start < b.Start
+	}
+	return a.ID < b.ID
+}
+
+// markerPriority derives a well-mixed treap priority from a marker ID.
+func markerPriority(id MarkerID) uint64 {
+	x := uint64(id) + 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// MarkerTree is a registry of markers stored in an interval tree.
+//
+// Markers are adjusted in place whenever a ChangeSet is applied through
+// ApplyChangeSet. Markers whose covered text is deleted entirely are removed
+// from the tree and reported to the caller.
+//
+// MarkerTree is safe for concurrent use.
+type MarkerTree struct {
+	mu     sync.RWMutex
+	root   *markerNode
+	byID   map[MarkerID]*Marker
+	nextID MarkerID
+}
+
+// NewMarkerTree creates an empty marker tree.
+func NewMarkerTree() *MarkerTree {
+	return &MarkerTree{
+		byID:   make(map[MarkerID]*Marker),
+		nextID: 1,
+	}
+}
+
+// Add registers a new range marker and returns a copy of it.
+// Start and end are swapped if given in reverse order.
+// Use Get with the returned ID to read the marker's current position.
+func (t *MarkerTree) Add(kind MarkerKind, start, end int, startAssoc, endAssoc Assoc, data interface{}) *Marker {
+	if start > end {
+		start, end = end, start
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m := &Marker{
+		ID:         t.nextID,
+		Kind:       kind,
+		Start:      start,
+		End:        end,
+		StartAssoc: startAssoc,
+		EndAssoc:   endAssoc,
+		Data:       data,
+	}
+	t.nextID++
+	t.byID[m.ID] = m
+	t.root = t.insert(t.root, &markerNode{marker: m, priority: markerPriority(m.ID)})
+
+	cp := *m
+	return &cp
+}
+
+// AddPoint registers a marker that covers no characters, such as a bookmark.
+func (t *MarkerTree) AddPoint(kind MarkerKind, pos int, assoc Assoc, data interface{}) *Marker {
+	return t.Add(kind, pos, pos, assoc, assoc, data)
+}
+
+// Get returns the marker with the given ID, or nil if it does not exist.
+// The returned value is a copy and is not updated by later edits.
+func (t *MarkerTree) Get(id MarkerID) *Marker {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	m, ok := t.byID[id]
+	if !ok {
+		return nil
+	}
+	cp := *m
+	return &cp
+}
+
+// Remove removes the marker with the given ID.
+// Returns false if no such marker exists.
+func (t *MarkerTree) Remove(id MarkerID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m, ok := t.byID[id]
+	if !ok {
+		return false
+	}
+	t.root = t.remove(t.root, m)
+	delete(t.byID, id)
+	return true
+}
+
+// Len returns the number of markers in the tree.
+func (t *MarkerTree) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.byID)
+}
+
+// All returns copies of all markers ordered by start position.
+func (t *MarkerTree) All() []*Marker {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	result := make([]*Marker, 0, len(t.byID))
+	walkMarkers(t.root, func(m *Marker) {
+		cp := *m
+		result = append(result, &cp)
+	})
+	return result
+}
+
+// ByKind returns copies of all markers of the given kind ordered by start position.
+func (t *MarkerTree) ByKind(kind MarkerKind) []*Marker {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	result := make([]*Marker, 0)
+	walkMarkers(t.root, func(m *Marker) {
+		if m.Kind == kind {
+			cp := *m
+			result = append(result, &cp)
+		}
+	})
+	return result
+}
+
+// Overlapping returns copies of all markers intersecting [start, end),
+// ordered by start position.
+func (t *MarkerTree) Overlapping(start, end int) []*Marker {
+	if start > end {
+		start, end = end, start
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	result := make([]*Marker, 0)
+	queryMarkers(t.root, start, end, &result)
+	return result
+}
+
+// At returns copies of all markers that contain the given position.
+func (t *MarkerTree) At(pos int) []*Marker {
+	return t.Overlapping(pos, pos)
+}
+
+// Clear removes all markers.
+func (t *MarkerTree) Clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.root = nil
+	t.byID = make(map[MarkerID]*Marker)
+}
+
+// ApplyChangeSet maps every marker through the changeset.
+//
+// Only markers reaching into the edited span are remapped and reinserted;
+// markers before it are left alone and markers after it are shifted in place.
+//
+// Markers whose entire range was deleted (or, for point markers, whose
+// position fell strictly inside a deletion) are removed from the tree and
+// returned with their last valid position before the edit.
+func (t *MarkerTree) ApplyChangeSet(cs *ChangeSet) []*Marker {
+	if cs == nil || cs.IsEmpty() {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	changes := changesOf(cs)
+	if len(t.byID) == 0 || len(changes) == 0 {
+		return nil
+	}
+
+	from := changes[0].from
+	to := changes[len(changes)-1].to
+	delta := 0
+	for _, ch := range changes {
+		delta += len([]rune(ch.text)) - (ch.to - ch.from)
+	}
+
+	// Markers starting after the edited span only move by delta, and markers
+	// ending before it do not move at all.
+	head, tail := splitMarkers(t.root, &Marker{Start: to + 1})
+	var affected []*Marker
+	head = extractMarkers(head, from, &affected)
+	shiftMarkers(tail, delta)
+	t.root = mergeMarkers(head, tail)
+
+	deleted := mapMarkers(changes, affected)
+	for _, m := range deleted {
+		delete(t.byID, m.ID)
+	}
+	for _, m := range affected {
+		if _, ok := t.byID[m.ID]; ok {
+			t.root = t.insert(t.root, &markerNode{marker: m, priority: markerPriority(m.ID)})
+		}
+	}
+
+	return deleted
+}
+
+// ========== Treap Internals ==========
+
+func (t *MarkerTree) insert(n, node *markerNode) *markerNode {
+	if n == nil {
+		node.update()
+		return node
+	}
+	if node.priority > n.priority {
+		node.left, node.right = splitMarkers(n, node.marker)
+		node.update()
+		return node
+	}
+	if markerLess(node.marker, n.marker) {
+		n.left = t.insert(n.left, node)
+	} else {
+		n.right = t.insert(n.right, node)
+	}
+	n.update()
+	return n
+}
+
+func (t *MarkerTree) remove(n *markerNode, m *Marker) *markerNode {
+	if n == nil {
+		return nil
+	}
+	if n.marker == m {
+		return mergeMarkers(n.left, n.right)
+	}
+	if markerLess(m, n.marker) {
+		n.left = t.remove(n.left, m)
+	} else {
+		n.right = t.remove(n.right, m)
+	}
+	n.update()
+	return n
+}
+
+// splitMarkers splits a treap into nodes ordered before key and the rest.
+func splitMarkers(n *markerNode, key *Marker) (*markerNode, *markerNode) {
+	if n == nil {
+		return nil, nil
+	}
+	if markerLess(n.marker, key) {
+		l, r := splitMarkers(n.right, key)
+		n.right = l
+		n.update()
+		return n, r
+	}
+	l, r := splitMarkers(n.left, key)
+	n.left = r
+	n.update()
+	return l, n
+}
+
+// mergeMarkers joins two treaps where every node of a orders before b.
+func mergeMarkers(a, b *markerNode) *markerNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.priority > b.priority {
+		a.right = mergeMarkers(a.right, b)
+		a.update()
+		return a
+	}
+	b.left = mergeMarkers(a, b.left)
+	b.update()
+	return b
+}
+
+// extractMarkers removes every node whose marker ends at or after pos,
+// appending the markers to out in order, and returns the remaining treap.
+func extractMarkers(n *markerNode, pos int, out *[]*Marker) *markerNode {
+	if n == nil || n.maxEnd < pos {
+		return n
+	}
+	n.left = extractMarkers(n.left, pos, out)
+	if n.marker.End >= pos {
+		*out = append(*out, n.marker)
+		return mergeMarkers(n.left, extractMarkers(n.right, pos, out))
+	}
+	n.right = extractMarkers(n.right, pos, out)
+	n.update()
+	return n
+}
+
+// shiftMarkers moves every marker of a treap by delta. The relative order
+// of the nodes is unchanged, so the shape of the treap is kept.
+func shiftMarkers(n *markerNode, delta int) {
+	if n == nil || delta == 0 {
+		return
+	}
+	n.marker.Start += delta
+	n.marker.End += delta
+	n.maxEnd += delta
+	shiftMarkers(n.left, delta)
+	shiftMarkers(n.right, delta)
+}
+
+func walkMarkers(n *markerNode, fn func(*Marker)) {
+	if n == nil {
+		return
+	}
+	walkMarkers(n.left, fn)
+	fn(n.marker)
+	walkMarkers(n.right, fn)
+}
+
+func queryMarkers(n *markerNode, start, end int, result *[]*Marker) {
+	if n == nil || n.maxEnd < start {
+		return
+	}
+	queryMarkers(n.left, start, end, result)
+	if n.marker.Start > end {
+		return
+	}
+	if n.marker.Overlaps(start, end) {
+		cp := *n.marker
+		*result = append(*result, &cp)
+	}
+	queryMarkers(n.right, start, end, result)
+}
+
+// ========== Position Mapping ==========
+
+// markerChange is a single replacement of old text [from, to) with text,
+// expressed in coordinates of the document before the changeset.
+type markerChange struct {
+	from int
+	to   int
+	text string
+}
+
+// changesOf converts a changeset into an ordered list of replacements.
+func changesOf(cs *ChangeSet) []markerChange {
+	changes := make([]markerChange, 0, len(cs.operations))
+	pos := 0
+	var cur *markerChange
+
+	flush := func() {
+		if cur != nil {
+			changes = append(changes, *cur)
+			cur = nil
+		}
+	}
+
+	for _, op := range cs.operations {
+		switch op.OpType {
+		case OpRetain:
+			flush()
+			pos += op.Length
+		case OpDelete:
+			if cur == nil {
+				cur = &markerChange{from: pos, to: pos}
+			}
+			cur.to += op.Length
+			pos += op.Length
+		case OpInsert:
+			if cur == nil {
+				cur = &markerChange{from: pos, to: pos}
+			}
+			cur.text += op.Text
+		}
+	}
+	flush()
+
+	return changes
+}
+
+// markerWords classifies word characters for the word associations.
+var markerWords = &WordBoundary{}
+
+// insertOffset returns where a position associated with assoc ends up
+// relative to the start of inserted text.
+func insertOffset(assoc Assoc, text string) int {
+	runes := []rune(text)
+	switch assoc {
+	case AssocAfter, AssocAfterSticky:
+		return len(runes)
+	case AssocAfterWord:
+		n := 0
+		for n < len(runes) && markerWords.IsWordChar(runes[n]) {
+			n++
+		}
+		return n
+	case AssocBeforeWord:
+		n := 0
+		for n < len(runes) && markerWords.IsWordChar(runes[len(runes)-1-n]) {
+			n++
+		}
+		return len(runes) - n
+	default:
+		return 0
+	}
+}
+
+func isSticky(assoc Assoc) bool {
+	return assoc == AssocBeforeSticky || assoc == AssocAfterSticky
+}
+
+// markerEndpoint is one end of a marker queued for mapping.
+type markerEndpoint struct {
+	marker  *Marker
+	isEnd   bool
+	pos     int
+	assoc   Assoc
+	newPos  int
+	deleted int // Old characters deleted before pos
+	inside  bool
+}
+
+// mapMarkers maps markers through changes in O((N+M) log M) and returns
+// the markers whose text was deleted entirely. Deleted markers keep their
+// positions from before the edit.
+func mapMarkers(changes []markerChange, markers []*Marker) []*Marker {
+	endpoints := make([]*markerEndpoint, 0, len(markers)*2)
+	for _, m := range markers {
+		endpoints = append(endpoints,
+			&markerEndpoint{marker: m, pos: m.Start, assoc: m.StartAssoc},
+			&markerEndpoint{marker: m, isEnd: true, pos: m.End, assoc: m.EndAssoc},
+		)
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return endpoints[i].pos < endpoints[j].pos
+	})
+
+	delta := 0
+	deletedSoFar := 0
+	ci := 0
+
+	for _, ep := range endpoints {
+		// Skip changes that end before this endpoint. A change ending exactly
+		// at pos is still relevant when it is a pure insert at pos.
+		for ci < len(changes) {
+			ch := changes[ci]
+			if ch.to < ep.pos || (ch.to == ep.pos && ch.from < ch.to) {
+				delta += len([]rune(ch.text)) - (ch.to - ch.from)
+				deletedSoFar += ch.to - ch.from
+				ci++
+				continue
+			}
+			break
+		}
+
+		if ci >= len(changes) || ep.pos < changes[ci].from {
+			ep.newPos = ep.pos + delta
+			ep.deleted = deletedSoFar
+			continue
+		}
+
+		ch := changes[ci]
+		base := ch.from + delta
+		ep.deleted = deletedSoFar + (ep.pos - ch.from)
+		ep.inside = ch.from < ep.pos && ep.pos < ch.to
+
+		switch {
+		case ch.text == "":
+			ep.newPos = base
+		case isSticky(ep.assoc) && len([]rune(ch.text)) == ch.to-ch.from:
+			// Exact-size replacement: the position survives at the same offset
+			ep.newPos = base + (ep.pos - ch.from)
+			ep.inside = false
+		default:
+			ep.newPos = base + insertOffset(ep.assoc, ch.text)
+		}
+	}
+
+	type pair struct{ start, end *markerEndpoint }
+	pairs := make(map[MarkerID]*pair, len(markers))
+	for _, ep := range endpoints {
+		p := pairs[ep.marker.ID]
+		if p == nil {
+			p = &pair{}
+			pairs[ep.marker.ID] = p
+		}
+		if ep.isEnd {
+			p.end = ep
+		} else {
+			p.start = ep
+		}
+	}
+
+	var deleted []*Marker
+	for _, m := range markers {
+		p := pairs[m.ID]
+
+		wasDeleted := false
+		if m.IsPoint() {
+			wasDeleted = p.start.inside
+		} else {
+			surviving := m.Len() - (p.end.deleted - p.start.deleted)
+			wasDeleted = surviving <= 0
+		}
+
+		if wasDeleted {
+			deleted = append(deleted, m)
+			continue
+		}
+
+		m.Start = p.start.newPos
+		m.End = p.end.newPos
+		if m.End < m.Start {
+			m.End = m.Start
+		}
+	}
+
+	return deleted
+}
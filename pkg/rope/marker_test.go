@@ -0,0 +1,246 @@
+package rope
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ========== Basic Registry Tests ==========
+
+func TestMarkerTree_AddGetRemove(t *testing.T) {
+	tree := NewMarkerTree()
+
+	a := tree.Add(MarkerDiagnostic, 5, 2, AssocAfter, AssocBefore, "swapped")
+	b := tree.AddPoint(MarkerBookmark, 7, AssocBefore, nil)
+
+	assert.Equal(t, 2, tree.Len())
+	assert.Equal(t, 2, a.Start, "start and end should be swapped")
+	assert.Equal(t, 5, a.End)
+	assert.True(t, b.IsPoint())
+
+	got := tree.Get(a.ID)
+	require.NotNil(t, got)
+	assert.Equal(t, "swapped", got.Data)
+
+	assert.True(t, tree.Remove(a.ID))
+	assert.False(t, tree.Remove(a.ID))
+	assert.Nil(t, tree.Get(a.ID))
+	assert.Equal(t, 1, tree.Len())
+}
+
+func TestMarkerTree_Overlapping(t *testing.T) {
+	tree := NewMarkerTree()
+	tree.Add(MarkerComment, 0, 5, AssocAfter, AssocBefore, nil)
+	tree.Add(MarkerComment, 3, 10, AssocAfter, AssocBefore, nil)
+	tree.Add(MarkerComment, 12, 20, AssocAfter, AssocBefore, nil)
+	tree.AddPoint(MarkerBookmark, 10, AssocBefore, nil)
+
+	assert.Len(t, tree.Overlapping(4, 6), 2)
+	assert.Len(t, tree.Overlapping(10, 12), 1, "only the bookmark touches [10, 12)")
+	assert.Len(t, tree.At(10), 1, "ranges are half-open; only the bookmark is at 10")
+	assert.Len(t, tree.Overlapping(21, 30), 0)
+	assert.Len(t, tree.ByKind(MarkerComment), 3)
+}
+
+// ========== Mapping Tests ==========
+
+func TestMarkerTree_InsertBeforeAndAfter(t *testing.T) {
+	doc := New("Hello World")
+	tree := NewMarkerTree()
+	word := tree.Add(MarkerComment, 6, 11, AssocAfter, AssocBefore, nil)
+
+	// Insert before the range shifts it
+	cs := NewChangeSet(doc.Length()).Insert(">> ")
+	deleted := tree.ApplyChangeSet(cs)
+	assert.Empty(t, deleted)
+
+	got := tree.Get(word.ID)
+	assert.Equal(t, 9, got.Start)
+	assert.Equal(t, 14, got.End)
+
+	// Insert after the range leaves it alone
+	cs = NewChangeSet(14).Retain(14).Insert("!")
+	tree.ApplyChangeSet(cs)
+	got = tree.Get(word.ID)
+	assert.Equal(t, 9, got.Start)
+	assert.Equal(t, 14, got.End)
+}
+
+func TestMarkerTree_AssocAtInsertion(t *testing.T) {
+	tree := NewMarkerTree()
+	before := tree.AddPoint(MarkerBookmark, 5, AssocBefore, nil)
+	after := tree.AddPoint(MarkerBookmark, 5, AssocAfter, nil)
+	afterWord := tree.AddPoint(MarkerBookmark, 5, AssocAfterWord, nil)
+	beforeWord := tree.AddPoint(MarkerBookmark, 5, AssocBeforeWord, nil)
+
+	// Insert "ab cd" at 5 in a 10 character document
+	cs := NewChangeSet(10).Retain(5).Insert("ab cd")
+	tree.ApplyChangeSet(cs)
+
+	assert.Equal(t, 5, tree.Get(before.ID).Start)
+	assert.Equal(t, 10, tree.Get(after.ID).Start)
+	assert.Equal(t, 7, tree.Get(afterWord.ID).Start, "skips leading word 'ab'")
+	assert.Equal(t, 8, tree.Get(beforeWord.ID).Start, "stays before trailing word 'cd'")
+}
+
+func TestMarkerTree_StickyReplacement(t *testing.T) {
+	tree := NewMarkerTree()
+	sticky := tree.AddPoint(MarkerBookmark, 7, AssocBeforeSticky, nil)
+	plain := tree.AddPoint(MarkerBookmark, 7, AssocBefore, nil)
+
+	// Replace "World" (6..11) with "Earth" - exact size
+	cs := NewChangeSet(11).Retain(6).Delete(5).Insert("Earth")
+	deleted := tree.ApplyChangeSet(cs)
+
+	assert.Equal(t, 7, tree.Get(sticky.ID).Start, "sticky keeps its offset")
+	assert.Len(t, deleted, 1, "non-sticky point inside a replacement is reported")
+	assert.Equal(t, plain.ID, deleted[0].ID)
+}
+
+func TestMarkerTree_ReportsDeletedRanges(t *testing.T) {
+	doc := New("one two three")
+	tree := NewMarkerTree()
+	two := tree.Add(MarkerComment, 4, 7, AssocAfter, AssocBefore, "two")
+	three := tree.Add(MarkerComment, 8, 13, AssocAfter, AssocBefore, "three")
+	span := tree.Add(MarkerDiagnostic, 2, 9, AssocAfter, AssocBefore, nil)
+
+	// Delete "two " (4..8)
+	cs := NewChangeSet(doc.Length()).Retain(4).Delete(4)
+	deleted := tree.ApplyChangeSet(cs)
+
+	require.Len(t, deleted, 1)
+	assert.Equal(t, two.ID, deleted[0].ID)
+	assert.Equal(t, 4, deleted[0].Start, "deleted markers keep their last position")
+	assert.Nil(t, tree.Get(two.ID))
+
+	got := tree.Get(three.ID)
+	assert.Equal(t, 4, got.Start)
+	assert.Equal(t, 9, got.End)
+
+	got = tree.Get(span.ID)
+	assert.Equal(t, 2, got.Start)
+	assert.Equal(t, 5, got.End, "partially deleted range shrinks")
+}
+
+func TestMarkerTree_MatchesRopeEdits(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	doc := New("The quick brown fox jumps over the lazy dog")
+	tree := NewMarkerTree()
+
+	// Anchor a marker to every word and check it still covers the same word
+	// after unrelated edits elsewhere.
+	words := map[MarkerID]string{}
+	pos := 0
+	for _, w := range []string{"The", "quick", "brown", "fox", "jumps", "over", "the", "lazy", "dog"} {
+		m := tree.Add(MarkerComment, pos, pos+len(w), AssocAfter, AssocBefore, nil)
+		words[m.ID] = w
+		pos += len(w) + 1
+	}
+
+	for i := 0; i < 50; i++ {
+		// Insert a space-padded token at a random word boundary
+		spaces := []int{}
+		for j, r := range doc.Runes() {
+			if r == ' ' {
+				spaces = append(spaces, j)
+			}
+		}
+		at := spaces[rng.Intn(len(spaces))]
+		cs := NewChangeSet(doc.Length()).Retain(at).Insert(" x")
+
+		var err error
+		doc, err = cs.Apply(doc)
+		require.NoError(t, err)
+		tree.ApplyChangeSet(cs)
+	}
+
+	for id, w := range words {
+		m := tree.Get(id)
+		require.NotNil(t, m)
+		text, err := doc.Slice(m.Start, m.End)
+		require.NoError(t, err)
+		assert.Equal(t, w, text)
+	}
+}
+
+func TestMarkerTree_IncrementalMatchesFullRemap(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	assocs := []Assoc{AssocBefore, AssocAfter, AssocBeforeWord, AssocAfterWord, AssocBeforeSticky, AssocAfterSticky}
+	length := 500
+	tree := NewMarkerTree()
+	var reference []*Marker
+
+	for i := 0; i < 200; i++ {
+		start := rng.Intn(length + 1)
+		end := start + rng.Intn(20)
+		if end > length {
+			end = length
+		}
+		m := tree.Add(MarkerBookmark, start, end, assocs[rng.Intn(len(assocs))], assocs[rng.Intn(len(assocs))], nil)
+		reference = append(reference, m)
+	}
+
+	for i := 0; i < 100; i++ {
+		// A changeset with a few scattered edits
+		cs := NewChangeSet(length)
+		pos := 0
+		for pos < length {
+			step := rng.Intn(80) + 1
+			if pos+step > length {
+				step = length - pos
+			}
+			cs.Retain(step)
+			pos += step
+			if pos < length && rng.Intn(2) == 0 {
+				del := rng.Intn(5)
+				if pos+del > length {
+					del = length - pos
+				}
+				if del > 0 {
+					cs.Delete(del)
+					pos += del
+				}
+				if rng.Intn(2) == 0 {
+					cs.Insert([]string{"ab", " x ", "_y", "--"}[rng.Intn(4)])
+				}
+			}
+		}
+		length = cs.LenAfter()
+
+		deleted := mapMarkers(changesOf(cs), reference)
+		gone := map[MarkerID]bool{}
+		for _, m := range deleted {
+			gone[m.ID] = true
+		}
+		alive := reference[:0]
+		for _, m := range reference {
+			if !gone[m.ID] {
+				alive = append(alive, m)
+			}
+		}
+		reference = alive
+
+		removed := tree.ApplyChangeSet(cs)
+		require.Len(t, removed, len(deleted))
+		require.Equal(t, len(reference), tree.Len())
+
+		for _, want := range reference {
+			got := tree.Get(want.ID)
+			require.NotNil(t, got)
+			assert.Equal(t, want.Start, got.Start)
+			assert.Equal(t, want.End, got.End)
+		}
+
+		q := rng.Intn(length + 1)
+		expected := 0
+		for _, m := range reference {
+			if m.Overlaps(q, q+10) {
+				expected++
+			}
+		}
+		assert.Len(t, tree.Overlapping(q, q+10), expected)
+	}
+}
@@ -2,6 +2,7 @@ package rope
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 // ========== Node Pools for Memory Reuse ==========
@@ -12,10 +13,19 @@ type NodePool struct {
 	internalPool sync.Pool
 }
 
+// Pool counters: acquires counts Get calls, allocations counts Gets the
+// pool could not serve from a released object.
+var (
+	leafAcquires, leafAllocations         atomic.Uint64
+	internalAcquires, internalAllocations atomic.Uint64
+	bufferAcquires, bufferAllocations     atomic.Uint64
+)
+
 // globalNodePool is the global node pool instance.
 var globalNodePool = &NodePool{
 	leafPool: sync.Pool{
 		New: func() interface{} {
+			leafAllocations.Add(1)
 			return &LeafNode{
 				text: "",
 			}
@@ -23,6 +33,7 @@ var globalNodePool = &NodePool{
 	},
 	internalPool: sync.Pool{
 		New: func() interface{} {
+			internalAllocations.Add(1)
 			return &InternalNode{
 				left:  nil,
 				right: nil,
@@ -33,6 +44,7 @@ var globalNodePool = &NodePool{
 
 // AcquireLeaf acquires a leaf node from the pool.
 func AcquireLeaf() *LeafNode {
+	leafAcquires.Add(1)
 	node := globalNodePool.leafPool.Get().(*LeafNode)
 	// Reset text to empty
 	node.text = ""
@@ -48,6 +60,7 @@ func ReleaseLeaf(node *LeafNode) {
 
 // AcquireInternal acquires an internal node from the pool.
 func AcquireInternal() *InternalNode {
+	internalAcquires.Add(1)
 	node := globalNodePool.internalPool.Get().(*InternalNode)
 	// Reset fields
 	node.left = nil
@@ -69,12 +82,14 @@ func ReleaseInternal(node *InternalNode) {
 // BufferPool manages reusable byte buffers.
 var bufferPool = sync.Pool{
 	New: func() interface{} {
+		bufferAllocations.Add(1)
 		return make([]byte, 0, 1024) // 1KB initial buffer
 	},
 }
 
 // AcquireBuffer acquires a buffer from the pool.
 func AcquireBuffer() []byte {
+	bufferAcquires.Add(1)
 	return bufferPool.Get().([]byte)[:0]
 }
 
@@ -115,15 +130,35 @@ func ReleaseBuilder(builder *RopeBuilder) {
 
 // ========== Pool Statistics ==========
 
-// PoolStats contains statistics about pool usage.
+// PoolStats contains statistics about pool usage. Acquires counts objects
+// taken from a pool and Allocations those the pool had to allocate, so
+// Acquires - Allocations were reused.
 type PoolStats struct {
+	LeafAcquires        uint64
 	LeafAllocations     uint64
+	InternalAcquires    uint64
 	InternalAllocations uint64
+	BufferAcquires      uint64
 	BufferAllocations   uint64
 }
 
-// GetPoolStats returns current pool statistics.
-// Note: This requires instrumenting the pools, which is not done by default.
+// GetPoolStats returns current pool statistics since the process started.
 func GetPoolStats() PoolStats {
-	return PoolStats{}
+	return PoolStats{
+		LeafAcquires:        leafAcquires.Load(),
+		LeafAllocations:     leafAllocations.Load(),
+		InternalAcquires:    internalAcquires.Load(),
+		InternalAllocations: internalAllocations.Load(),
+		BufferAcquires:      bufferAcquires.Load(),
+		BufferAllocations:   bufferAllocations.Load(),
+	}
+}
+
+// HitRate returns the fraction of acquires served from a pool, or 0 if
+// nothing was acquired.
+func HitRate(acquires, allocations uint64) float64 {
+	if acquires == 0 || allocations >= acquires {
+		return 0
+	}
+	return float64(acquires-allocations) / float64(acquires)
 }
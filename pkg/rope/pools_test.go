@@ -3,6 +3,8 @@ package rope
 import (
 	"sync"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 // ========== Iterator Pooling ==========
@@ -163,3 +165,28 @@ func BenchmarkBytesIterator_WithPool(b *testing.B) {
 		}
 	})
 }
+
+// ========== Pool Statistics ==========
+
+// TestGetPoolStats tests that acquiring from the pools is counted.
+func TestGetPoolStats(t *testing.T) {
+	before := GetPoolStats()
+
+	leaf := AcquireLeaf()
+	ReleaseLeaf(leaf)
+	AcquireLeaf()
+	buf := AcquireBuffer()
+	ReleaseBuffer(buf)
+
+	after := GetPoolStats()
+	assert.Equal(t, uint64(2), after.LeafAcquires-before.LeafAcquires)
+	assert.Equal(t, uint64(1), after.BufferAcquires-before.BufferAcquires)
+	assert.LessOrEqual(t, after.LeafAllocations, after.LeafAcquires)
+}
+
+// TestHitRate tests the HitRate function.
+func TestHitRate(t *testing.T) {
+	assert.Equal(t, 0.0, HitRate(0, 0))
+	assert.Equal(t, 0.75, HitRate(4, 1))
+	assert.Equal(t, 0.0, HitRate(2, 2))
+}
@@ -239,6 +239,40 @@ func New(text string) *Rope {
 	}
 }
 
+// NewChunked creates a Rope from the given string split into leaves at
+// content-defined boundaries, of DefaultMinLeafSize to DefaultMaxLeafSize
+// bytes.
+//
+// A boundary depends only on the few bytes before it, so two chunked
+// versions of a document have the same leaves everywhere except around
+// the edits between them, and Diff matches those leaves by hash. Edits of
+// a chunked rope copy only the path to the leaves they touch, so the
+// result shares the rest of the tree with the original and Diff skips it.
+//
+// Performance: O(len(text)) time and space
+//
+// Example:
+//
+//	cs := rope.Diff(rope.NewChunked(saved), rope.NewChunked(edited))
+func NewChunked(text string) *Rope {
+	if len(text) <= DefaultMaxLeafSize {
+		return New(text)
+	}
+
+	leaves := make([]*LeafNode, 0, len(text)/DefaultMinLeafSize+1)
+	for rest := text; rest != ""; {
+		n := nextChunk(rest)
+		leaves = append(leaves, &LeafNode{text: rest[:n]})
+		rest = rest[n:]
+	}
+
+	return &Rope{
+		root:   buildBalancedTree(leaves, 0, len(leaves)),
+		length: utf8.RuneCountInString(text),
+		size:   len(text),
+	}
+}
+
 // Empty returns an empty Rope.
 //
 // Returns an empty rope that can be used as a starting point for
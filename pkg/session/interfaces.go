@@ -18,7 +18,8 @@ type UserInfo struct {
 	Username     string
 	Name         string
 	Email        string
-	AuthProvider string // e.g., "token", "oauth"
+	AuthProvider string // e.g., "token", "oauth", "jwt"
+	Roles        []string
 	Permissions  []string
 	Metadata     map[string]interface{}
 }
@@ -59,7 +60,7 @@ type Authenticator interface {
 type TokenAuthenticator struct {
 	mu     sync.RWMutex
 	tokens map[string]*TokenInfo // token -> token info
-	users  map[string]*UserInfo   // userID -> user info
+	users  map[string]*UserInfo  // userID -> user info
 }
 
 // NewTokenAuthenticator creates a new token authenticator.
@@ -122,7 +123,7 @@ func (a *TokenAuthenticator) GenerateToken(ctx context.Context, userID string) (
 		UserID:    userID,
 		CreatedAt: time.Now(),
 		// No expiration by default (like Jupyter)
-		Metadata:  make(map[string]interface{}),
+		Metadata: make(map[string]interface{}),
 	}
 
 	a.tokens[token] = tokenInfo
@@ -214,17 +215,17 @@ func (a *TokenAuthenticator) ListTokens() []*TokenInfo {
 
 // ContentModel represents a document/content.
 type ContentModel struct {
-	Name        string
-	Type        string // "file", "directory", "notebook"
-	Content     string
-	Format      string // "json", "text", etc.
-	MimeType    string
-	Size        int64
-	Created     string
-	Modified    string
-	Path        string
-	ReadOnly    bool
-	Metadata    map[string]interface{}
+	Name     string
+	Type     string // "file", "directory", "notebook"
+	Content  string
+	Format   string // "json", "text", etc.
+	MimeType string
+	Size     int64
+	Created  string
+	Modified string
+	Path     string
+	ReadOnly bool
+	Metadata map[string]interface{}
 }
 
 // GetOptions specifies options for getting content.
@@ -493,6 +494,8 @@ func (e *SessionError) IsRetryable() bool {
 // StatusCode returns the HTTP status code for this error.
 func (e *SessionError) StatusCode() int {
 	switch e.Code {
+	case "bad_request":
+		return 400
 	case "invalid_token", "unauthorized":
 		return 401
 	case "forbidden", "permission_denied":
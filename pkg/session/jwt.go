@@ -0,0 +1,841 @@
+package session
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ========== JWT Authentication ==========
+
+// Signing algorithms supported by JWTAuthenticator.
+const (
+	AlgHS256 = "HS256" // HMAC with SHA-256, shared secret
+	AlgRS256 = "RS256" // RSASSA-PKCS1-v1_5 with SHA-256
+	AlgEdDSA = "EdDSA" // Ed25519
+)
+
+// ErrTokenRevoked is returned when a token was revoked with RevokeToken.
+var ErrTokenRevoked = &SessionError{Code: "invalid_token", Message: "token revoked"}
+
+// JWTConfig configures a JWTAuthenticator.
+type JWTConfig struct {
+	// KeyFile is a JSON Web Key Set file. It is reloaded when it changes,
+	// so keys can be rotated by adding the new key, switching
+	// SigningKeyID, and removing the old key once its tokens expired.
+	KeyFile string
+
+	// Keys is used instead of KeyFile if set.
+	Keys *KeySet
+
+	// SigningKeyID is the "kid" of the key used to issue tokens.
+	// Empty uses the first key that can sign.
+	SigningKeyID string
+
+	// Issuer is checked against "iss" and set on issued tokens.
+	// Empty accepts any issuer.
+	Issuer string
+
+	// Audience lists accepted "aud" values; a token must name one of them.
+	// Issued tokens get the first. Empty accepts any audience.
+	Audience []string
+
+	// TokenTTL is the lifetime of issued tokens (default 1 hour).
+	TokenTTL time.Duration
+
+	// Leeway allows for clock skew when checking exp and nbf
+	// (default 1 minute).
+	Leeway time.Duration
+
+	// AllowNoExpiry accepts tokens without an "exp" claim. They never
+	// expire, so they can only be stopped by revoking them; leave it off
+	// unless the issuer can't set exp.
+	AllowNoExpiry bool
+
+	// ReloadInterval is how often KeyFile is checked for changes
+	// (default 1 minute).
+	ReloadInterval time.Duration
+
+	// RevocationFile persists revoked tokens across restarts.
+	// Empty keeps them in memory only.
+	RevocationFile string
+
+	// Claims maps token claims to UserInfo fields.
+	Claims ClaimMapping
+}
+
+// ClaimMapping names the claims UserInfo fields are read from.
+// Empty names use the defaults in parentheses.
+type ClaimMapping struct {
+	UserID      string // ("sub")
+	Username    string // ("preferred_username")
+	Name        string // ("name")
+	Email       string // ("email")
+	Roles       string // ("roles")
+	Permissions string // ("permissions"); a space-separated "scope" is used if missing
+}
+
+// JWTAuthenticator authenticates signed JSON Web Tokens.
+//
+// Unlike TokenAuthenticator it keeps no per-token state: a token is valid
+// if its signature verifies against the key set and its exp, nbf, iss and
+// aud claims check out, so tokens survive restarts and can be issued by
+// an SSO gateway sharing the key set. Only revoked tokens are remembered,
+// until they expire.
+//
+// Example:
+//
+//	auth, err := session.NewJWTAuthenticator(session.JWTConfig{
+//		KeyFile:  "/etc/texere/jwks.json",
+//		Issuer:   "https://sso.example.com",
+//		Audience: []string{"texere"},
+//	})
+//	user, err := auth.Authenticate(ctx, token)
+type JWTAuthenticator struct {
+	mu      sync.RWMutex
+	config  JWTConfig
+	keys    *KeySet
+	modTime time.Time            // Modification time of the loaded key file
+	checked time.Time            // Last time the key file was checked
+	revoked map[string]time.Time // jti (or token hash) -> expiry
+	now     func() time.Time
+}
+
+// NewJWTAuthenticator creates an authenticator from config.
+func NewJWTAuthenticator(config JWTConfig) (*JWTAuthenticator, error) {
+	if config.TokenTTL <= 0 {
+		config.TokenTTL = time.Hour
+	}
+	if config.Leeway <= 0 {
+		config.Leeway = time.Minute
+	}
+	if config.ReloadInterval <= 0 {
+		config.ReloadInterval = time.Minute
+	}
+	config.Claims = config.Claims.withDefaults()
+
+	a := &JWTAuthenticator{
+		config:  config,
+		keys:    config.Keys,
+		revoked: make(map[string]time.Time),
+		now:     time.Now,
+	}
+	if a.keys == nil {
+		if config.KeyFile == "" {
+			return nil, errors.New("jwt: no key set configured")
+		}
+		if err := a.ReloadKeys(); err != nil {
+			return nil, err
+		}
+	}
+	if err := a.loadRevocations(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Authenticate validates a token and returns the user its claims describe.
+func (a *JWTAuthenticator) Authenticate(ctx context.Context, token string) (*UserInfo, error) {
+	claims, err := a.verify(token, true)
+	if err != nil {
+		return nil, err
+	}
+	return a.userInfo(claims), nil
+}
+
+// GenerateToken issues a signed token for a user.
+func (a *JWTAuthenticator) GenerateToken(ctx context.Context, userID string) (string, error) {
+	return a.IssueToken(&UserInfo{UserID: userID})
+}
+
+// IssueToken issues a signed token carrying the user's profile, roles and
+// permissions.
+func (a *JWTAuthenticator) IssueToken(user *UserInfo) (string, error) {
+	m := a.config.Claims
+	claims := map[string]interface{}{m.UserID: user.UserID}
+	setClaim(claims, m.Username, user.Username)
+	setClaim(claims, m.Name, user.Name)
+	setClaim(claims, m.Email, user.Email)
+	if len(user.Roles) > 0 {
+		claims[m.Roles] = user.Roles
+	}
+	if len(user.Permissions) > 0 {
+		claims[m.Permissions] = user.Permissions
+	}
+	return a.sign(claims)
+}
+
+// ValidateToken checks if a token is valid and returns user info.
+func (a *JWTAuthenticator) ValidateToken(ctx context.Context, token string) (bool, *UserInfo) {
+	user, err := a.Authenticate(ctx, token)
+	if err != nil {
+		return false, nil
+	}
+	return true, user
+}
+
+// RevokeToken adds a token to the revocation list. The token must have a
+// valid signature; it is remembered until it expires.
+func (a *JWTAuthenticator) RevokeToken(ctx context.Context, token string) error {
+	claims, err := a.verify(token, false)
+	if err != nil {
+		return err
+	}
+	return a.revoke(token, claims)
+}
+
+// RefreshToken issues a new token with the claims of a valid token and
+// revokes the old one.
+func (a *JWTAuthenticator) RefreshToken(ctx context.Context, token string) (string, error) {
+	claims, err := a.verify(token, true)
+	if err != nil {
+		return "", err
+	}
+	refreshed, err := a.sign(claims)
+	if err != nil {
+		return "", err
+	}
+	if err := a.revoke(token, claims); err != nil {
+		return "", err
+	}
+	return refreshed, nil
+}
+
+// ReloadKeys reads the key file again. It is called automatically when
+// the file changes; a failed reload keeps the previous keys.
+func (a *JWTAuthenticator) ReloadKeys() error {
+	info, err := os.Stat(a.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("jwt: %w", err)
+	}
+	keys, err := LoadKeySet(a.config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = keys
+	a.modTime = info.ModTime()
+	a.checked = a.now()
+	return nil
+}
+
+// RevokedCount returns the number of tokens on the revocation list.
+// Expired entries are dropped on the next revocation.
+func (a *JWTAuthenticator) RevokedCount() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.revoked)
+}
+
+// keySet returns the current keys, reloading the key file if it changed.
+func (a *JWTAuthenticator) keySet() *KeySet {
+	a.mu.RLock()
+	keys, checked := a.keys, a.checked
+	a.mu.RUnlock()
+
+	if a.config.KeyFile == "" || a.config.Keys != nil || a.now().Sub(checked) < a.config.ReloadInterval {
+		return keys
+	}
+
+	a.mu.Lock()
+	a.checked = a.now()
+	modTime := a.modTime
+	a.mu.Unlock()
+
+	if info, err := os.Stat(a.config.KeyFile); err == nil && !info.ModTime().Equal(modTime) {
+		if a.ReloadKeys() == nil {
+			a.mu.RLock()
+			keys = a.keys
+			a.mu.RUnlock()
+		}
+	}
+	return keys
+}
+
+// ---------- Verification ----------
+
+// jwtHeader is the JOSE header of a token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// verify checks the signature and claims of a token. Expiry is only
+// checked if checkTime is set.
+func (a *JWTAuthenticator) verify(token string, checkTime bool) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range a.keySet().candidates(header.Kid, header.Alg) {
+		if key.verify(signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrInvalidToken
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if err := a.checkClaims(claims, checkTime); err != nil {
+		return nil, err
+	}
+
+	if checkTime {
+		a.mu.RLock()
+		_, revoked := a.revoked[revocationID(token, claims)]
+		a.mu.RUnlock()
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+	return claims, nil
+}
+
+// checkClaims checks the registered claims.
+func (a *JWTAuthenticator) checkClaims(claims map[string]interface{}, checkTime bool) error {
+	if sub, _ := claims[a.config.Claims.UserID].(string); sub == "" {
+		return ErrInvalidToken
+	}
+	if a.config.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != a.config.Issuer {
+			return ErrInvalidToken
+		}
+	}
+	if len(a.config.Audience) > 0 && !containsAny(stringList(claims["aud"]), a.config.Audience) {
+		return ErrInvalidToken
+	}
+
+	exp, hasExp := numericDate(claims["exp"])
+	if !hasExp && !a.config.AllowNoExpiry {
+		return ErrInvalidToken
+	}
+
+	if !checkTime {
+		return nil
+	}
+	now := a.now()
+	if hasExp && now.After(exp.Add(a.config.Leeway)) {
+		return ErrTokenExpired
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Before(nbf.Add(-a.config.Leeway)) {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// userInfo maps claims to a UserInfo. All claims are kept in Metadata.
+func (a *JWTAuthenticator) userInfo(claims map[string]interface{}) *UserInfo {
+	m := a.config.Claims
+	user := &UserInfo{
+		AuthProvider: "jwt",
+		Roles:        stringList(claims[m.Roles]),
+		Permissions:  stringList(claims[m.Permissions]),
+		Metadata:     claims,
+	}
+	user.UserID, _ = claims[m.UserID].(string)
+	user.Username, _ = claims[m.Username].(string)
+	user.Name, _ = claims[m.Name].(string)
+	user.Email, _ = claims[m.Email].(string)
+	if user.Username == "" {
+		user.Username = user.UserID
+	}
+	if _, ok := claims[m.Permissions]; !ok {
+		if scope, ok := claims["scope"].(string); ok {
+			user.Permissions = strings.Fields(scope)
+		}
+	}
+	return user
+}
+
+// ---------- Signing ----------
+
+// sign issues a token with the given claims, replacing the registered
+// time, issuer, audience and ID claims.
+func (a *JWTAuthenticator) sign(claims map[string]interface{}) (string, error) {
+	key := a.keySet().signingKey(a.config.SigningKeyID)
+	if key == nil {
+		return "", errors.New("jwt: no signing key")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	now := a.now()
+	out := make(map[string]interface{}, len(claims)+6)
+	for name, value := range claims {
+		out[name] = value
+	}
+	out["iat"] = now.Unix()
+	out["nbf"] = now.Unix()
+	out["exp"] = now.Add(a.config.TokenTTL).Unix()
+	out["jti"] = hex.EncodeToString(id)
+	if a.config.Issuer != "" {
+		out["iss"] = a.config.Issuer
+	}
+	if len(a.config.Audience) > 0 {
+		out["aud"] = a.config.Audience[0]
+	}
+
+	header, err := encodeSegment(jwtHeader{Alg: key.Algorithm, Kid: key.ID, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := encodeSegment(out)
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + payload
+	signature, err := key.sign([]byte(signed))
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// ---------- Revocation ----------
+
+// revocationRecord is an entry of the revocation file.
+type revocationRecord struct {
+	ID      string `json:"id"`
+	Expires int64  `json:"expires"` // Unix seconds
+}
+
+// revoke adds a verified token to the revocation list and drops entries
+// that have expired.
+func (a *JWTAuthenticator) revoke(token string, claims map[string]interface{}) error {
+	expires := a.now().Add(a.config.TokenTTL)
+	if exp, ok := numericDate(claims["exp"]); ok {
+		expires = exp.Add(a.config.Leeway)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	for id, exp := range a.revoked {
+		if now.After(exp) {
+			delete(a.revoked, id)
+		}
+	}
+	a.revoked[revocationID(token, claims)] = expires
+	return a.saveRevocations()
+}
+
+// loadRevocations reads the revocation file, if configured and present.
+func (a *JWTAuthenticator) loadRevocations() error {
+	if a.config.RevocationFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(a.config.RevocationFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("jwt: %w", err)
+	}
+
+	var records []revocationRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("jwt: invalid revocation file: %w", err)
+	}
+	now := a.now()
+	for _, r := range records {
+		if expires := time.Unix(r.Expires, 0); expires.After(now) {
+			a.revoked[r.ID] = expires
+		}
+	}
+	return nil
+}
+
+// saveRevocations writes the revocation file, if configured.
+// Caller must hold the write lock.
+func (a *JWTAuthenticator) saveRevocations() error {
+	if a.config.RevocationFile == "" {
+		return nil
+	}
+	records := make([]revocationRecord, 0, len(a.revoked))
+	for id, expires := range a.revoked {
+		records = append(records, revocationRecord{ID: id, Expires: expires.Unix()})
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	// Write and rename, so a crash never leaves a truncated file
+	tmp := a.config.RevocationFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("jwt: %w", err)
+	}
+	return os.Rename(tmp, a.config.RevocationFile)
+}
+
+// revocationID identifies a token in the revocation list: its "jti", or
+// a hash of the token if it has none.
+func revocationID(token string, claims map[string]interface{}) string {
+	if jti, _ := claims["jti"].(string); jti != "" {
+		return jti
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ---------- Key sets ----------
+
+// JWK is a JSON Web Key (RFC 7517). Private parameters are only needed
+// for keys that issue tokens.
+type JWK struct {
+	Kty string `json:"kty"`           // "oct", "RSA" or "OKP"
+	Kid string `json:"kid,omitempty"` // Key ID
+	Alg string `json:"alg,omitempty"` // Defaults by key type
+	Use string `json:"use,omitempty"` // "sig"; "enc" keys are ignored
+	Crv string `json:"crv,omitempty"` // "Ed25519" for OKP keys
+
+	K string `json:"k,omitempty"` // oct: secret
+	N string `json:"n,omitempty"` // RSA: modulus
+	E string `json:"e,omitempty"` // RSA: public exponent
+	X string `json:"x,omitempty"` // OKP: public key
+	D string `json:"d,omitempty"` // RSA private exponent, OKP private seed
+	P string `json:"p,omitempty"` // RSA: first prime
+	Q string `json:"q,omitempty"` // RSA: second prime
+}
+
+// SigningKey is a parsed key of a KeySet.
+type SigningKey struct {
+	ID        string
+	Algorithm string
+
+	secret  []byte
+	public  crypto.PublicKey
+	private crypto.Signer
+}
+
+// CanSign returns true if the key has private (or secret) material.
+func (k *SigningKey) CanSign() bool {
+	return k.secret != nil || k.private != nil
+}
+
+// verify checks a signature.
+func (k *SigningKey) verify(signed, signature []byte) bool {
+	switch k.Algorithm {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(signed)
+		return subtle.ConstantTimeCompare(mac.Sum(nil), signature) == 1
+	case AlgRS256:
+		pub, ok := k.public.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	case AlgEdDSA:
+		pub, ok := k.public.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, signed, signature)
+	}
+	return false
+}
+
+// sign signs data.
+func (k *SigningKey) sign(data []byte) ([]byte, error) {
+	switch {
+	case k.Algorithm == AlgHS256 && k.secret != nil:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	case k.Algorithm == AlgRS256 && k.private != nil:
+		digest := sha256.Sum256(data)
+		return k.private.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case k.Algorithm == AlgEdDSA && k.private != nil:
+		return k.private.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	return nil, fmt.Errorf("jwt: key %q cannot sign", k.ID)
+}
+
+// KeySet holds the keys tokens are verified (and issued) with.
+type KeySet struct {
+	Keys []*SigningKey
+}
+
+// LoadKeySet reads a JSON Web Key Set file: {"keys": [...]}.
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: %w", err)
+	}
+	return ParseKeySet(data)
+}
+
+// ParseKeySet parses a JSON Web Key Set.
+func ParseKeySet(data []byte) (*KeySet, error) {
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("jwt: invalid key set: %w", err)
+	}
+
+	keys := &KeySet{}
+	for i, jwk := range set.Keys {
+		if jwk.Use == "enc" {
+			continue
+		}
+		key, err := jwk.Parse()
+		if err != nil {
+			return nil, fmt.Errorf("jwt: key %d (%q): %w", i, jwk.Kid, err)
+		}
+		keys.Keys = append(keys.Keys, key)
+	}
+	if len(keys.Keys) == 0 {
+		return nil, errors.New("jwt: key set has no signing keys")
+	}
+	return keys, nil
+}
+
+// Parse parses the key material of a JWK.
+func (j JWK) Parse() (*SigningKey, error) {
+	key := &SigningKey{ID: j.Kid, Algorithm: j.Alg}
+	switch j.Kty {
+	case "oct":
+		if key.Algorithm == "" {
+			key.Algorithm = AlgHS256
+		}
+		secret, err := base64.RawURLEncoding.DecodeString(j.K)
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("invalid secret")
+		}
+		key.secret = secret
+
+	case "RSA":
+		if key.Algorithm == "" {
+			key.Algorithm = AlgRS256
+		}
+		n, e := decodeInt(j.N), decodeInt(j.E)
+		if n == nil || e == nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA public key")
+		}
+		pub := &rsa.PublicKey{N: n, E: int(e.Int64())}
+		key.public = pub
+		if j.D != "" {
+			priv := &rsa.PrivateKey{
+				PublicKey: *pub,
+				D:         decodeInt(j.D),
+				Primes:    []*big.Int{decodeInt(j.P), decodeInt(j.Q)},
+			}
+			if priv.D == nil || priv.Primes[0] == nil || priv.Primes[1] == nil {
+				return nil, errors.New("invalid RSA private key")
+			}
+			if err := priv.Validate(); err != nil {
+				return nil, err
+			}
+			priv.Precompute()
+			key.private = priv
+		}
+
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		if key.Algorithm == "" {
+			key.Algorithm = AlgEdDSA
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key")
+		}
+		key.public = ed25519.PublicKey(x)
+		if j.D != "" {
+			seed, err := base64.RawURLEncoding.DecodeString(j.D)
+			if err != nil || len(seed) != ed25519.SeedSize {
+				return nil, errors.New("invalid Ed25519 private key")
+			}
+			key.private = ed25519.NewKeyFromSeed(seed)
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+	}
+
+	switch key.Algorithm {
+	case AlgHS256, AlgRS256, AlgEdDSA:
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", key.Algorithm)
+	}
+	return key, nil
+}
+
+// candidates returns the keys that may have signed a token with the
+// given key ID and algorithm. The algorithm must match the key's, so a
+// public RSA key can never be used as an HMAC secret.
+func (s *KeySet) candidates(kid, alg string) []*SigningKey {
+	if s == nil {
+		return nil
+	}
+	var keys []*SigningKey
+	for _, key := range s.Keys {
+		if key.Algorithm == alg && (kid == "" || key.ID == kid) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// signingKey returns the key with the given ID, or the first key that
+// can sign if id is empty.
+func (s *KeySet) signingKey(id string) *SigningKey {
+	if s == nil {
+		return nil
+	}
+	for _, key := range s.Keys {
+		if key.CanSign() && (id == "" || key.ID == id) {
+			return key
+		}
+	}
+	return nil
+}
+
+// ---------- Helpers ----------
+
+func (m ClaimMapping) withDefaults() ClaimMapping {
+	defaults := ClaimMapping{
+		UserID:      "sub",
+		Username:    "preferred_username",
+		Name:        "name",
+		Email:       "email",
+		Roles:       "roles",
+		Permissions: "permissions",
+	}
+	if m.UserID == "" {
+		m.UserID = defaults.UserID
+	}
+	if m.Username == "" {
+		m.Username = defaults.Username
+	}
+	if m.Name == "" {
+		m.Name = defaults.Name
+	}
+	if m.Email == "" {
+		m.Email = defaults.Email
+	}
+	if m.Roles == "" {
+		m.Roles = defaults.Roles
+	}
+	if m.Permissions == "" {
+		m.Permissions = defaults.Permissions
+	}
+	return m
+}
+
+// setClaim sets a string claim unless it is empty.
+func setClaim(claims map[string]interface{}, name, value string) {
+	if value != "" {
+		claims[name] = value
+	}
+}
+
+func encodeSegment(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// decodeInt decodes a base64url big-endian integer, or returns nil.
+func decodeInt(s string) *big.Int {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	return new(big.Int).SetBytes(data)
+}
+
+// numericDate reads a NumericDate claim.
+func numericDate(v interface{}) (time.Time, bool) {
+	switch n := v.(type) {
+	case float64:
+		return time.Unix(int64(n), 0), true
+	case int64:
+		return time.Unix(n, 0), true
+	case json.Number:
+		i, err := n.Int64()
+		return time.Unix(i, 0), err == nil
+	}
+	return time.Time{}, false
+}
+
+// stringList reads a claim that is a string or a list of strings.
+func stringList(v interface{}) []string {
+	switch s := v.(type) {
+	case string:
+		return []string{s}
+	case []string:
+		return s
+	case []interface{}:
+		list := make([]string, 0, len(s))
+		for _, item := range s {
+			if str, ok := item.(string); ok {
+				list = append(list, str)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// containsAny returns true if list contains any of values.
+func containsAny(list, values []string) bool {
+	for _, item := range list {
+		for _, value := range values {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,310 @@
+package session
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// b64 encodes bytes as base64url without padding.
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// testKeys returns one JWK of each supported algorithm, with private
+// material.
+func testKeys(t *testing.T) (hs, rs, ed JWK) {
+	t.Helper()
+	hs = JWK{Kty: "oct", Kid: "hs", K: b64([]byte("a shared secret of thirty-two by"))}
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	rs = JWK{
+		Kty: "RSA", Kid: "rs",
+		N: b64(priv.N.Bytes()), E: b64(big.NewInt(int64(priv.E)).Bytes()),
+		D: b64(priv.D.Bytes()), P: b64(priv.Primes[0].Bytes()), Q: b64(priv.Primes[1].Bytes()),
+	}
+
+	pub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	ed = JWK{Kty: "OKP", Kid: "ed", Crv: "Ed25519", X: b64(pub), D: b64(edPriv.Seed())}
+	return hs, rs, ed
+}
+
+// keySetOf parses JWKs into a key set.
+func keySetOf(t *testing.T, keys ...JWK) *KeySet {
+	t.Helper()
+	data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	set, err := ParseKeySet(data)
+	if err != nil {
+		t.Fatalf("ParseKeySet failed: %v", err)
+	}
+	return set
+}
+
+// writeKeySet writes JWKs to a key set file.
+func writeKeySet(t *testing.T, path string, keys ...JWK) {
+	t.Helper()
+	data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+}
+
+// newTestAuthenticator creates an authenticator with a controllable clock.
+func newTestAuthenticator(t *testing.T, config JWTConfig, now *time.Time) *JWTAuthenticator {
+	t.Helper()
+	a, err := NewJWTAuthenticator(config)
+	if err != nil {
+		t.Fatalf("NewJWTAuthenticator failed: %v", err)
+	}
+	a.now = func() time.Time { return *now }
+	return a
+}
+
+// rawToken signs a token with an arbitrary header and claims.
+func rawToken(t *testing.T, key *SigningKey, header jwtHeader, claims map[string]interface{}) string {
+	t.Helper()
+	h, _ := encodeSegment(header)
+	c, _ := encodeSegment(claims)
+	signature, err := key.sign([]byte(h + "." + c))
+	if err != nil {
+		t.Fatalf("sign failed: %v", err)
+	}
+	return h + "." + c + "." + b64(signature)
+}
+
+// TestJWTAuthenticator_RoundTrip tests issuing and authenticating tokens
+// with each algorithm.
+func TestJWTAuthenticator_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	hs, rs, ed := testKeys(t)
+	for _, jwk := range []JWK{hs, rs, ed} {
+		t.Run(jwk.Kid, func(t *testing.T) {
+			now := time.Now()
+			a := newTestAuthenticator(t, JWTConfig{Keys: keySetOf(t, jwk)}, &now)
+
+			token, err := a.IssueToken(&UserInfo{UserID: "u1", Name: "Alice", Roles: []string{"admin"}})
+			if err != nil {
+				t.Fatalf("IssueToken failed: %v", err)
+			}
+			user, err := a.Authenticate(ctx, token)
+			if err != nil {
+				t.Fatalf("Authenticate failed: %v", err)
+			}
+			if user.UserID != "u1" || user.Name != "Alice" || len(user.Roles) != 1 || user.Roles[0] != "admin" {
+				t.Errorf("Expected the issued user, got %+v", user)
+			}
+
+			// A tampered payload fails the signature
+			parts := []byte(token)
+			parts[len(parts)/2] ^= 1
+			if _, err := a.Authenticate(ctx, string(parts)); err == nil {
+				t.Error("Expected a tampered token to be rejected")
+			}
+		})
+	}
+}
+
+// TestJWTAuthenticator_Algorithms tests that tokens must use the
+// algorithm of their key.
+func TestJWTAuthenticator_Algorithms(t *testing.T) {
+	ctx := context.Background()
+	hs, rs, _ := testKeys(t)
+	now := time.Now()
+	a := newTestAuthenticator(t, JWTConfig{Keys: keySetOf(t, hs, rs)}, &now)
+	claims := map[string]interface{}{"sub": "u1", "exp": now.Add(time.Hour).Unix()}
+
+	// The RSA public key used as an HMAC secret
+	rsaPublic := &SigningKey{ID: "rs", Algorithm: AlgHS256, secret: []byte(rs.N)}
+	if _, err := a.Authenticate(ctx, rawToken(t, rsaPublic, jwtHeader{Alg: AlgHS256, Kid: "rs"}, claims)); err == nil {
+		t.Error("Expected an HS256 token for an RSA key to be rejected")
+	}
+
+	// The HMAC key claimed to be RS256
+	secret := keySetOf(t, hs).Keys[0]
+	if _, err := a.Authenticate(ctx, rawToken(t, secret, jwtHeader{Alg: AlgRS256, Kid: "hs"}, claims)); err == nil {
+		t.Error("Expected an RS256 header on an HMAC signature to be rejected")
+	}
+
+	h, _ := encodeSegment(jwtHeader{Alg: "none"})
+	c, _ := encodeSegment(claims)
+	if _, err := a.Authenticate(ctx, h+"."+c+"."); err == nil {
+		t.Error("Expected an unsigned token to be rejected")
+	}
+
+	if _, err := a.Authenticate(ctx, rawToken(t, secret, jwtHeader{Alg: AlgHS256, Kid: "hs"}, claims)); err != nil {
+		t.Errorf("Expected a correctly signed token to be accepted, got %v", err)
+	}
+}
+
+// TestJWTAuthenticator_Claims tests exp, nbf, iss and aud.
+func TestJWTAuthenticator_Claims(t *testing.T) {
+	ctx := context.Background()
+	hs, _, _ := testKeys(t)
+	keys := keySetOf(t, hs)
+	start := time.Now()
+	now := start
+	a := newTestAuthenticator(t, JWTConfig{
+		Keys:     keys,
+		Issuer:   "https://sso.example.com",
+		Audience: []string{"texere"},
+		TokenTTL: time.Hour,
+		Leeway:   time.Minute,
+	}, &now)
+
+	token, _ := a.IssueToken(&UserInfo{UserID: "u1"})
+	now = start.Add(time.Hour + 30*time.Second)
+	if _, err := a.Authenticate(ctx, token); err != nil {
+		t.Errorf("Expected a token within the leeway to be accepted, got %v", err)
+	}
+	now = start.Add(time.Hour + 2*time.Minute)
+	if _, err := a.Authenticate(ctx, token); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Expected an expired token, got %v", err)
+	}
+
+	// Issued in the future
+	now = start.Add(10 * time.Minute)
+	token, _ = a.IssueToken(&UserInfo{UserID: "u1"})
+	now = start.Add(10*time.Minute - 30*time.Second)
+	if _, err := a.Authenticate(ctx, token); err != nil {
+		t.Errorf("Expected nbf within the leeway to be accepted, got %v", err)
+	}
+	now = start
+	if _, err := a.Authenticate(ctx, token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected a token that is not valid yet to be rejected, got %v", err)
+	}
+
+	secret := keys.Keys[0]
+	header := jwtHeader{Alg: AlgHS256, Kid: "hs"}
+	exp := now.Add(time.Hour).Unix()
+	for name, claims := range map[string]map[string]interface{}{
+		"issuer":   {"sub": "u1", "exp": exp, "iss": "https://evil.example.com", "aud": "texere"},
+		"audience": {"sub": "u1", "exp": exp, "iss": "https://sso.example.com", "aud": "other"},
+		"subject":  {"exp": exp, "iss": "https://sso.example.com", "aud": "texere"},
+		"expiry":   {"sub": "u1", "iss": "https://sso.example.com", "aud": "texere"},
+	} {
+		if _, err := a.Authenticate(ctx, rawToken(t, secret, header, claims)); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Expected a token with a wrong %s to be rejected, got %v", name, err)
+		}
+	}
+	valid := map[string]interface{}{"sub": "u1", "exp": exp, "iss": "https://sso.example.com", "aud": []string{"other", "texere"}}
+	if _, err := a.Authenticate(ctx, rawToken(t, secret, header, valid)); err != nil {
+		t.Errorf("Expected a token for one of several audiences to be accepted, got %v", err)
+	}
+
+	// Tokens without exp only with AllowNoExpiry
+	lenient := newTestAuthenticator(t, JWTConfig{Keys: keys, AllowNoExpiry: true}, &now)
+	if _, err := lenient.Authenticate(ctx, rawToken(t, secret, header, map[string]interface{}{"sub": "u1"})); err != nil {
+		t.Errorf("Expected a token without exp to be accepted with AllowNoExpiry, got %v", err)
+	}
+}
+
+// TestJWTAuthenticator_KeyRotation tests that a changed key file is
+// picked up after the reload interval.
+func TestJWTAuthenticator_KeyRotation(t *testing.T) {
+	ctx := context.Background()
+	hs, _, ed := testKeys(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeKeySet(t, path, hs)
+
+	now := time.Now()
+	a := newTestAuthenticator(t, JWTConfig{KeyFile: path, ReloadInterval: time.Minute}, &now)
+	old, _ := a.IssueToken(&UserInfo{UserID: "u1"})
+
+	writeKeySet(t, path, ed)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(path, future, future)
+
+	// Not checked again before the reload interval
+	if _, err := a.Authenticate(ctx, old); err != nil {
+		t.Errorf("Expected the old key to be used until the next check, got %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := a.Authenticate(ctx, old); err == nil {
+		t.Error("Expected tokens of the removed key to be rejected")
+	}
+	rotated, err := a.IssueToken(&UserInfo{UserID: "u1"})
+	if err != nil {
+		t.Fatalf("IssueToken failed: %v", err)
+	}
+	if _, err := a.Authenticate(ctx, rotated); err != nil {
+		t.Errorf("Expected tokens of the new key to be accepted, got %v", err)
+	}
+
+	// A broken file keeps the current keys
+	os.WriteFile(path, []byte("{"), 0600)
+	future = future.Add(time.Hour)
+	os.Chtimes(path, future, future)
+	now = now.Add(2 * time.Minute)
+	if _, err := a.Authenticate(ctx, rotated); err != nil {
+		t.Errorf("Expected a broken key file to keep the current keys, got %v", err)
+	}
+}
+
+// TestJWTAuthenticator_Revocation tests revoking and refreshing tokens,
+// and that revocations survive a restart.
+func TestJWTAuthenticator_Revocation(t *testing.T) {
+	ctx := context.Background()
+	hs, _, _ := testKeys(t)
+	config := JWTConfig{
+		Keys:           keySetOf(t, hs),
+		RevocationFile: filepath.Join(t.TempDir(), "revoked.json"),
+	}
+	now := time.Now()
+	a := newTestAuthenticator(t, config, &now)
+
+	token, _ := a.IssueToken(&UserInfo{UserID: "u1"})
+	other, _ := a.IssueToken(&UserInfo{UserID: "u2"})
+	if err := a.RevokeToken(ctx, token); err != nil {
+		t.Fatalf("RevokeToken failed: %v", err)
+	}
+	if _, err := a.Authenticate(ctx, token); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("Expected a revoked token, got %v", err)
+	}
+	if _, err := a.Authenticate(ctx, other); err != nil {
+		t.Errorf("Expected other tokens to stay valid, got %v", err)
+	}
+
+	restarted := newTestAuthenticator(t, config, &now)
+	if _, err := restarted.Authenticate(ctx, token); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("Expected the revocation to survive a restart, got %v", err)
+	}
+
+	refreshed, err := restarted.RefreshToken(ctx, other)
+	if err != nil {
+		t.Fatalf("RefreshToken failed: %v", err)
+	}
+	if _, err := restarted.Authenticate(ctx, other); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("Expected the refreshed token to be revoked, got %v", err)
+	}
+	user, err := restarted.Authenticate(ctx, refreshed)
+	if err != nil || user.UserID != "u2" {
+		t.Errorf("Expected the new token to carry the user, got %+v, %v", user, err)
+	}
+	if _, err := restarted.RefreshToken(ctx, token); err == nil {
+		t.Error("Expected a revoked token not to be refreshed")
+	}
+
+	// Entries are dropped once their token expired
+	now = now.Add(2 * time.Hour)
+	fresh, _ := restarted.IssueToken(&UserInfo{UserID: "u3"})
+	restarted.RevokeToken(ctx, fresh)
+	if count := restarted.RevokedCount(); count != 1 {
+		t.Errorf("Expected only the new revocation to be kept, got %d", count)
+	}
+}
@@ -2,11 +2,16 @@ package session
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/coreseekdev/texere/pkg/concordia"
 	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/rope"
 )
 
 // DocumentType represents the type of document to use.
@@ -63,17 +68,29 @@ type Session interface {
 	Close() error
 }
 
+// HistoryNavigator is implemented by sessions that can move through their
+// undo history by steps or by time, like Vim's :earlier and :later.
+type HistoryNavigator interface {
+	Earlier(req *rope.UndoRequest) error
+	Later(req *rope.UndoRequest) error
+	ExecuteUndoCommand(command string) error
+}
+
 // ========== SimpleSession Implementation ==========
 
-// SimpleSession is a session using UndoableDocument.
+// SimpleSession is a session whose undo history is a concordia.History.
+// The content is kept as a rope that every change edits in place of the
+// changed ranges; documents of the configured type are made from it.
 type SimpleSession struct {
-	id   string
-	ctx  context.Context
+	id     string
+	ctx    context.Context
 	cancel context.CancelFunc
 
-	mu     sync.RWMutex
-	doc    ot.UndoableDocument
-	config *SessionConfig
+	mu      sync.RWMutex
+	text    *rope.Rope
+	doc     ot.Document        // text as the configured type; nil until asked for
+	history *concordia.History // Undo tree, navigated by Undo/Redo/Earlier/Later
+	config  *SessionConfig
 
 	// Event publishing
 	subscribers map[chan *SessionEvent]bool
@@ -84,32 +101,21 @@ type SimpleSession struct {
 func NewSimpleSession(ctx context.Context, config SessionConfig) (*SimpleSession, error) {
 	ctx, cancel := context.WithCancel(ctx)
 
-	var doc ot.UndoableDocument
-	var err error
-
-	switch config.DocType {
-	case DocTypeString:
-		doc = ot.NewStringDocument(config.InitialContent)
-	case DocTypeRope:
-		// TODO: Use RopeDocument when available
-		doc = ot.NewStringDocument(config.InitialContent)
-	default:
-		doc = ot.NewStringDocument(config.InitialContent)
+	history := concordia.NewHistory()
+	if config.MaxHistory > 0 {
+		history.SetMaxSize(config.MaxHistory)
 	}
 
-	if err != nil {
-		cancel()
-		return nil, err
-	}
-
-	return &SimpleSession{
+	s := &SimpleSession{
 		id:          config.DocID,
 		ctx:         ctx,
 		cancel:      cancel,
-		doc:         doc,
+		history:     history,
 		config:      &config,
 		subscribers: make(map[chan *SessionEvent]bool),
-	}, nil
+		text:        rope.New(config.InitialContent),
+	}
+	return s, nil
 }
 
 // ID returns the session ID.
@@ -122,24 +128,43 @@ func (s *SimpleSession) Type() string {
 	return "simple"
 }
 
-// GetDocument returns the document.
+// GetDocument returns the content as a document of the configured type.
+// The document is a snapshot: later changes don't modify it.
 func (s *SimpleSession) GetDocument() ot.Document {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.doc == nil {
+		s.doc = s.newDocument()
+	}
 	return s.doc
 }
 
-// SetDocument sets the document.
+// SetDocument replaces the content with that of doc and clears the undo
+// history. doc must be of the configured type. The session keeps its own
+// copy of the content, so doc itself is never modified and GetDocument
+// returns a new document after the next change.
 func (s *SimpleSession) SetDocument(doc ot.Document) error {
+	var text *rope.Rope
+	switch d := doc.(type) {
+	case *concordia.RopeDocument:
+		if s.config.DocType == DocTypeRope {
+			text = d.Rope()
+		}
+	case *ot.StringDocument:
+		if s.config.DocType != DocTypeRope {
+			text = rope.New(d.String())
+		}
+	}
+	if text == nil {
+		return fmt.Errorf("%w: %T is not a document of the session's type", ErrInvalidRequest, doc)
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	undoableDoc, ok := doc.(ot.UndoableDocument)
-	if !ok {
-		return fmt.Errorf("document must implement UndoableDocument")
-	}
-
-	s.doc = undoableDoc
+	s.text, s.doc = text, doc
+	s.history.Clear()
 	return nil
 }
 
@@ -147,7 +172,7 @@ func (s *SimpleSession) SetDocument(doc ot.Document) error {
 func (s *SimpleSession) GetContent() string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.doc.String()
+	return s.text.String()
 }
 
 // SetContent sets the document content.
@@ -155,19 +180,20 @@ func (s *SimpleSession) SetContent(content string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	var doc ot.UndoableDocument
+	s.text, s.doc = rope.New(content), nil
+	s.history.Clear()
+	return nil
+}
+
+// newDocument creates a document of the configured type from the content.
+// The caller holds s.mu.
+func (s *SimpleSession) newDocument() ot.Document {
 	switch s.config.DocType {
-	case DocTypeString:
-		doc = ot.NewStringDocument(content)
 	case DocTypeRope:
-		// TODO: Use RopeDocument when available
-		doc = ot.NewStringDocument(content)
+		return concordia.NewRopeDocumentFromRope(s.text)
 	default:
-		doc = ot.NewStringDocument(content)
+		return ot.NewStringDocument(s.text.String())
 	}
-
-	s.doc = doc
-	return nil
 }
 
 // ApplyOperation applies an operation to the document.
@@ -175,12 +201,12 @@ func (s *SimpleSession) ApplyOperation(op *ot.Operation) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Apply operation with history recording
-	var err error
-	s.doc, err = s.doc.ApplyOperationWithHistory(op)
-	if err != nil {
+	// Ropes are immutable, so the content before the change is kept as is
+	original := s.text
+	if err := s.apply(op); err != nil {
 		return fmt.Errorf("failed to apply operation: %w", err)
 	}
+	s.history.CommitRevision(op, original)
 
 	// Publish event
 	s.publishEvent(&SessionEvent{
@@ -193,66 +219,139 @@ func (s *SimpleSession) ApplyOperation(op *ot.Operation) error {
 	return nil
 }
 
-// Undo performs an undo operation using the document's undo capability.
+// Undo reverts the current revision of the undo tree.
 func (s *SimpleSession) Undo() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s.navigate(EventUndo, nil, func(h *concordia.History) *ot.Operation {
+		return h.Undo()
+	}, "cannot undo")
+}
 
-	if !s.doc.CanUndo() {
-		return fmt.Errorf("cannot undo")
-	}
+// Redo reapplies the most recently committed child of the current revision.
+func (s *SimpleSession) Redo() error {
+	return s.navigate(EventRedo, nil, func(h *concordia.History) *ot.Operation {
+		return h.Redo()
+	}, "cannot redo")
+}
 
-	err := s.doc.Undo()
+// Earlier moves back in the undo tree by steps or by time, like Vim's
+// :earlier. A time request may switch to another branch.
+func (s *SimpleSession) Earlier(req *rope.UndoRequest) error {
+	return s.navigate(EventUndo, req, func(h *concordia.History) *ot.Operation {
+		return h.EarlierBy(req)
+	}, "cannot go earlier")
+}
+
+// Later moves forward in the undo tree by steps or by time, like Vim's
+// :later. A time request may switch to another branch.
+func (s *SimpleSession) Later(req *rope.UndoRequest) error {
+	return s.navigate(EventRedo, req, func(h *concordia.History) *ot.Operation {
+		return h.LaterBy(req)
+	}, "cannot go later")
+}
+
+// ExecuteUndoCommand runs a Vim-style history command, see ParseUndoCommand.
+func (s *SimpleSession) ExecuteUndoCommand(command string) error {
+	req, earlier, err := ParseUndoCommand(command)
 	if err != nil {
 		return err
 	}
-
-	// Publish event
-	s.publishEvent(&SessionEvent{
-		Type:      EventUndo,
-		DocID:     s.id,
-		Timestamp: time.Now().Unix(),
-	})
-
-	return nil
+	if earlier {
+		return s.Earlier(req)
+	}
+	return s.Later(req)
 }
 
-// Redo performs a redo operation using the document's redo capability.
-func (s *SimpleSession) Redo() error {
+// navigate moves through the undo tree and applies the resulting operation.
+func (s *SimpleSession) navigate(eventType SessionEventType, data interface{}, move func(h *concordia.History) *ot.Operation, failure string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if !s.doc.CanRedo() {
-		return fmt.Errorf("cannot redo")
+	op := move(s.history)
+	if op == nil {
+		return errors.New(failure)
 	}
 
-	err := s.doc.Redo()
-	if err != nil {
+	if err := s.apply(op); err != nil {
 		return err
 	}
 
 	// Publish event
 	s.publishEvent(&SessionEvent{
-		Type:      EventRedo,
+		Type:      eventType,
 		DocID:     s.id,
 		Timestamp: time.Now().Unix(),
+		Data:      data,
 	})
 
 	return nil
 }
 
+// apply edits the content with op, touching only the changed ranges of
+// the rope. It is the only way the content changes, so it never drifts
+// from the history. The caller holds s.mu.
+func (s *SimpleSession) apply(op *ot.Operation) error {
+	text, err := concordia.ChangeSetFromOperation(op).Apply(s.text)
+	if err != nil {
+		return err
+	}
+	s.text, s.doc = text, nil
+	return nil
+}
+
 // CanUndo returns true if undo is possible.
 func (s *SimpleSession) CanUndo() bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.doc.CanUndo()
+	return s.history.CanUndo()
 }
 
 // CanRedo returns true if redo is possible.
 func (s *SimpleSession) CanRedo() bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.doc.CanRedo()
+	return s.history.CanRedo()
+}
+
+// ParseUndoCommand parses a Vim-style history command:
+//
+//	:earlier 10m   -> 10 minutes back
+//	earlier 3      -> 3 steps back
+//	:later 1h      -> 1 hour forward
+//
+// A bare count means steps; anything else is parsed by rope.ParseDuration.
+// Returns the request and true for earlier, false for later.
+func ParseUndoCommand(command string) (*rope.UndoRequest, bool, error) {
+	fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(command), ":"))
+	if len(fields) == 0 {
+		return nil, false, fmt.Errorf("empty undo command")
+	}
+
+	var earlier bool
+	switch strings.ToLower(fields[0]) {
+	case "earlier", "ea":
+		earlier = true
+	case "later", "lat":
+		earlier = false
+	default:
+		return nil, false, fmt.Errorf("unknown undo command: %s", fields[0])
+	}
+
+	arg := strings.Join(fields[1:], " ")
+	if arg == "" {
+		return rope.NewUndoSteps(1), earlier, nil
+	}
+	if steps, err := strconv.Atoi(arg); err == nil {
+		if steps < 0 {
+			return nil, false, fmt.Errorf("invalid step count: %d", steps)
+		}
+		return rope.NewUndoSteps(steps), earlier, nil
+	}
+
+	duration, err := rope.ParseDuration(arg)
+	if err != nil {
+		return nil, false, err
+	}
+	return rope.NewUndoTimePeriod(duration), earlier, nil
 }
 
 // Subscribe subscribes to session events.
@@ -0,0 +1,263 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coreseekdev/texere/pkg/concordia"
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/rope"
+)
+
+// SimpleSession must keep satisfying both interfaces.
+var (
+	_ Session          = (*SimpleSession)(nil)
+	_ HistoryNavigator = (*SimpleSession)(nil)
+)
+
+// newTestSession returns a session holding "a" after appending "b" and "c"
+// as two revisions, so it reads "abc".
+func newTestSession(t *testing.T, docType DocumentType) *SimpleSession {
+	t.Helper()
+	s, err := NewSimpleSession(context.Background(), SessionConfig{
+		DocID:          "doc",
+		InitialContent: "a",
+		DocType:        docType,
+	})
+	if err != nil {
+		t.Fatalf("NewSimpleSession: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	for _, text := range []string{"b", "c"} {
+		n := len(s.GetContent())
+		if err := s.ApplyOperation(ot.NewOperation().Retain(n).Insert(text)); err != nil {
+			t.Fatalf("ApplyOperation(%q): %v", text, err)
+		}
+	}
+	if got := s.GetContent(); got != "abc" {
+		t.Fatalf("content = %q, want abc", got)
+	}
+	return s
+}
+
+// TestParseUndoCommand tests parsing Vim-style history commands.
+func TestParseUndoCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		earlier bool
+		want    *rope.UndoRequest
+	}{
+		{":earlier 10m", true, rope.NewUndoTimePeriod(10 * time.Minute)},
+		{"earlier 3", true, rope.NewUndoSteps(3)},
+		{"ea", true, rope.NewUndoSteps(1)},
+		{" :later 1h ", false, rope.NewUndoTimePeriod(time.Hour)},
+		{"LATER", false, rope.NewUndoSteps(1)},
+		{"lat 2", false, rope.NewUndoSteps(2)},
+		{"later 0", false, rope.NewUndoSteps(0)},
+	}
+	for _, tt := range tests {
+		req, earlier, err := ParseUndoCommand(tt.command)
+		if err != nil {
+			t.Errorf("ParseUndoCommand(%q): %v", tt.command, err)
+			continue
+		}
+		if earlier != tt.earlier || *req != *tt.want {
+			t.Errorf("ParseUndoCommand(%q) = %+v, %v, want %+v, %v", tt.command, *req, earlier, *tt.want, tt.earlier)
+		}
+	}
+
+	for _, command := range []string{"", ":", "undo 3", "earlier -1", "later soon"} {
+		if _, _, err := ParseUndoCommand(command); err == nil {
+			t.Errorf("ParseUndoCommand(%q) succeeded, want an error", command)
+		}
+	}
+}
+
+// TestSimpleSession_UndoRedo tests undo and redo, and that the document
+// follows the history.
+func TestSimpleSession_UndoRedo(t *testing.T) {
+	for _, docType := range []DocumentType{DocTypeString, DocTypeRope} {
+		s := newTestSession(t, docType)
+
+		if s.CanRedo() {
+			t.Error("CanRedo before undoing")
+		}
+		if err := s.Undo(); err != nil {
+			t.Fatalf("Undo: %v", err)
+		}
+		if err := s.Undo(); err != nil {
+			t.Fatalf("Undo: %v", err)
+		}
+		if got := s.GetContent(); got != "a" {
+			t.Errorf("content after undoing twice = %q, want a", got)
+		}
+		if got := s.GetDocument().String(); got != "a" {
+			t.Errorf("document after undoing twice = %q, want a", got)
+		}
+		if s.CanUndo() {
+			t.Error("CanUndo at the initial content")
+		}
+		if err := s.Undo(); err == nil {
+			t.Error("Undo at the initial content succeeded")
+		}
+
+		if err := s.Redo(); err != nil {
+			t.Fatalf("Redo: %v", err)
+		}
+		if got := s.GetContent(); got != "ab" {
+			t.Errorf("content after redo = %q, want ab", got)
+		}
+
+		// A new change after undo starts a branch that still applies to
+		// the current content.
+		if err := s.ApplyOperation(ot.NewOperation().Retain(2).Insert("x")); err != nil {
+			t.Fatalf("ApplyOperation: %v", err)
+		}
+		if err := s.Undo(); err != nil {
+			t.Fatalf("Undo: %v", err)
+		}
+		if got := s.GetContent(); got != "ab" {
+			t.Errorf("content after undoing the branch = %q, want ab", got)
+		}
+	}
+}
+
+// TestSimpleSession_EarlierLater tests navigating the history by steps and
+// by time.
+func TestSimpleSession_EarlierLater(t *testing.T) {
+	s := newTestSession(t, DocTypeString)
+
+	if err := s.Earlier(rope.NewUndoSteps(2)); err != nil {
+		t.Fatalf("Earlier(2 steps): %v", err)
+	}
+	if got := s.GetContent(); got != "a" {
+		t.Errorf("content after Earlier(2 steps) = %q, want a", got)
+	}
+	if err := s.Earlier(rope.NewUndoSteps(1)); err == nil {
+		t.Error("Earlier at the initial content succeeded")
+	}
+
+	if err := s.Later(rope.NewUndoSteps(1)); err != nil {
+		t.Fatalf("Later(1 step): %v", err)
+	}
+	if got := s.GetContent(); got != "ab" {
+		t.Errorf("content after Later(1 step) = %q, want ab", got)
+	}
+
+	// Both revisions were made within the last hour.
+	if err := s.Later(rope.NewUndoTimePeriod(time.Hour)); err != nil {
+		t.Fatalf("Later(1h): %v", err)
+	}
+	if got := s.GetContent(); got != "abc" {
+		t.Errorf("content after Later(1h) = %q, want abc", got)
+	}
+	if err := s.Earlier(rope.NewUndoTimePeriod(time.Hour)); err != nil {
+		t.Fatalf("Earlier(1h): %v", err)
+	}
+	if got := s.GetContent(); got != "a" {
+		t.Errorf("content after Earlier(1h) = %q, want a", got)
+	}
+
+	if err := s.Earlier(nil); err == nil {
+		t.Error("Earlier(nil) succeeded")
+	}
+}
+
+// TestSimpleSession_ExecuteUndoCommand tests running history commands and
+// the events they publish.
+func TestSimpleSession_ExecuteUndoCommand(t *testing.T) {
+	s := newTestSession(t, DocTypeString)
+	events := s.Subscribe()
+
+	if err := s.ExecuteUndoCommand(":earlier 2"); err != nil {
+		t.Fatalf(":earlier 2: %v", err)
+	}
+	if got := s.GetContent(); got != "a" {
+		t.Errorf("content after :earlier 2 = %q, want a", got)
+	}
+	event := <-events
+	if event.Type != EventUndo || event.DocID != "doc" {
+		t.Errorf("event = %+v, want an undo event for doc", event)
+	}
+	if req, ok := event.Data.(*rope.UndoRequest); !ok || *req != *rope.NewUndoSteps(2) {
+		t.Errorf("event data = %#v, want the request", event.Data)
+	}
+
+	if err := s.ExecuteUndoCommand("later"); err != nil {
+		t.Fatalf("later: %v", err)
+	}
+	if got := s.GetContent(); got != "ab" {
+		t.Errorf("content after later = %q, want ab", got)
+	}
+	if event := <-events; event.Type != EventRedo {
+		t.Errorf("event type = %v, want EventRedo", event.Type)
+	}
+
+	if err := s.ExecuteUndoCommand("redo"); err == nil {
+		t.Error("unknown command succeeded")
+	}
+	if got := s.GetContent(); got != "ab" {
+		t.Errorf("content after a bad command = %q, want ab", got)
+	}
+}
+
+// TestSimpleSession_ResetHistory tests that replacing the content clears
+// the history.
+func TestSimpleSession_ResetHistory(t *testing.T) {
+	s := newTestSession(t, DocTypeString)
+
+	if err := s.SetContent("new"); err != nil {
+		t.Fatalf("SetContent: %v", err)
+	}
+	if s.CanUndo() {
+		t.Error("CanUndo after SetContent")
+	}
+
+	s = newTestSession(t, DocTypeString)
+	if err := s.SetDocument(ot.NewStringDocument("doc")); err != nil {
+		t.Fatalf("SetDocument: %v", err)
+	}
+	if s.CanUndo() {
+		t.Error("CanUndo after SetDocument")
+	}
+	if err := s.ApplyOperation(ot.NewOperation().Retain(3).Insert("!")); err != nil {
+		t.Fatalf("ApplyOperation: %v", err)
+	}
+	if err := s.Undo(); err != nil {
+		t.Fatalf("Undo: %v", err)
+	}
+	if got := s.GetContent(); got != "doc" {
+		t.Errorf("content after undo = %q, want doc", got)
+	}
+
+	if err := s.SetDocument(concordia.NewRopeDocument("rope")); err == nil {
+		t.Error("SetDocument with a rope document succeeded on a string session")
+	}
+	if got := s.GetContent(); got != "doc" {
+		t.Errorf("content after a rejected SetDocument = %q, want doc", got)
+	}
+}
+
+// TestSimpleSession_DocumentSnapshot tests that documents handed out are
+// not changed by later operations.
+func TestSimpleSession_DocumentSnapshot(t *testing.T) {
+	for _, docType := range []DocumentType{DocTypeString, DocTypeRope} {
+		s := newTestSession(t, docType)
+
+		doc := s.GetDocument()
+		if err := s.ApplyOperation(ot.NewOperation().Retain(3).Insert("d")); err != nil {
+			t.Fatalf("ApplyOperation: %v", err)
+		}
+		if got := doc.String(); got != "abc" {
+			t.Errorf("earlier document = %q, want abc", got)
+		}
+		if got := s.GetDocument().String(); got != "abcd" {
+			t.Errorf("document = %q, want abcd", got)
+		}
+		if got := concordia.IsRopeDocument(s.GetDocument()); got != (docType == DocTypeRope) {
+			t.Errorf("IsRopeDocument = %v for type %v", got, docType)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package transport
+
+import (
+	"time"
+)
+
+// ========== Administration ==========
+
+var (
+	// ErrSessionNotFound is returned when administering a session that is
+	// not open on this node.
+	ErrSessionNotFound = &TransportError{Code: "session_not_found", Message: "session not found"}
+
+	// ErrClientNotFound is returned when kicking a client that is not in
+	// the session.
+	ErrClientNotFound = &TransportError{Code: "client_not_found", Message: "client not in session"}
+)
+
+// OpLogEntry is an operation in the op log of a session.
+type OpLogEntry struct {
+	Revision  int64       `json:"revision"`
+	ClientID  string      `json:"client_id"`
+	Timestamp int64       `json:"timestamp"`
+	Operation interface{} `json:"operation"`
+}
+
+// Sessions returns the sessions open on this node.
+func (h *ProtocolHandler) Sessions() []*EditSession {
+	return h.sessionManager.ListSessions()
+}
+
+// Session returns an open session, or nil.
+func (h *ProtocolHandler) Session(sessionID string) *EditSession {
+	return h.sessionManager.GetSession(sessionID)
+}
+
+// BackpressureStats returns the send queue metrics of the clients
+// connected to this node, or empty stats without a server.
+func (h *ProtocolHandler) BackpressureStats() *BackpressureStats {
+	h.mu.RLock()
+	server := h.server
+	h.mu.RUnlock()
+	if server == nil {
+		return &BackpressureStats{Clients: []QueueStats{}}
+	}
+	return server.BackpressureStats()
+}
+
+// SnapshotSession snapshots the changes made since the last snapshot of a
+// session to the history listener, and returns the new snapshot state.
+func (h *ProtocolHandler) SnapshotSession(sessionID, createdBy string) (*SnapshotInfo, error) {
+	sessionInfo := h.sessionManager.GetSession(sessionID)
+	if sessionInfo == nil {
+		return nil, ErrSessionNotFound
+	}
+	sessionInfo.Snapshot(createdBy)
+	return sessionInfo.GetSnapshotInfo(), nil
+}
+
+// SaveSession snapshots a session and saves its content to storage,
+// whether or not it changed since the last save.
+func (h *ProtocolHandler) SaveSession(sessionID string) error {
+	sessionInfo := h.sessionManager.GetSession(sessionID)
+	if sessionInfo == nil {
+		return ErrSessionNotFound
+	}
+	version, _ := sessionInfo.Flush()
+	if err := h.sessionManager.saveContent(sessionInfo); err != nil {
+		return err
+	}
+	sessionInfo.markFlushed(version)
+	return nil
+}
+
+// KickClient removes a client from a session. The other clients receive
+// user_left, and the client a "kicked" error with the reason, after which
+// its connection is closed so it can't rejoin without reconnecting.
+func (h *ProtocolHandler) KickClient(sessionID, clientID, reason string) error {
+	sessionInfo := h.sessionManager.GetSession(sessionID)
+	if sessionInfo == nil {
+		return ErrSessionNotFound
+	}
+	client := sessionInfo.RemoveClient(clientID)
+	if client == nil {
+		return ErrClientNotFound
+	}
+	if client.ReadOnly {
+		sessionInfo.RefCount.RemoveReader()
+	} else {
+		sessionInfo.RefCount.RemoveWriter()
+	}
+
+	h.notifyUserLeft(sessionInfo, clientID)
+	h.notifySessionInfo(sessionInfo)
+	if reason == "" {
+		reason = "Removed from the session by an administrator"
+	}
+	h.sendError(clientID, sessionID, "kicked", reason)
+
+	h.mu.RLock()
+	server := h.server
+	h.mu.RUnlock()
+	if server != nil {
+		server.Disconnect(clientID)
+	}
+	return nil
+}
+
+// CloseSession saves a session, tells its clients with session_closed and
+// destroys it. The session is kept if it can't be saved.
+func (h *ProtocolHandler) CloseSession(sessionID, reason string) error {
+	if err := h.SaveSession(sessionID); err != nil {
+		return err
+	}
+	sessionInfo := h.sessionManager.GetSession(sessionID)
+	if sessionInfo == nil {
+		return ErrSessionNotFound
+	}
+
+	h.broadcastToSession(sessionID, "", MessageTypeSessionClosed, &SessionClosedData{
+		SessionID: sessionID,
+		FilePath:  sessionInfo.FilePath,
+		Reason:    reason,
+	})
+	h.sessionManager.DestroySession(sessionID)
+	return nil
+}
+
+// ---------- EditSession ----------
+
+// logOperation appends an operation to the op log, dropping the oldest
+// beyond OpLogSize. The caller holds es.mu.
+func (es *EditSession) logOperation(operation interface{}, clientID string) {
+	if len(es.opLog) == OpLogSize {
+		copy(es.opLog, es.opLog[1:])
+		es.opLog = es.opLog[:OpLogSize-1]
+	}
+	es.opLog = append(es.opLog, OpLogEntry{
+		Revision:  es.currentVersion,
+		ClientID:  clientID,
+		Timestamp: time.Now().UnixMilli(),
+		Operation: operation,
+	})
+}
+
+// OpLog returns up to limit of the last operations, oldest first. Unlike
+// GetRecentOperations it is not cleared by snapshots, and records who
+// made each operation. limit <= 0 returns the whole log.
+func (es *EditSession) OpLog(limit int) []OpLogEntry {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	entries := es.opLog
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return append([]OpLogEntry(nil), entries...)
+}
+
+// GetClients returns copies of the clients in the session.
+func (es *EditSession) GetClients() []SessionClient {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	clients := make([]SessionClient, 0, len(es.Clients))
+	for _, client := range es.Clients {
+		clients = append(clients, *client)
+	}
+	return clients
+}
+
+// Snapshot snapshots the changes made since the last snapshot to the
+// history listener. It returns false if there were none.
+func (es *EditSession) Snapshot(createdBy string) bool {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if len(es.recentChanges) == 0 {
+		return false
+	}
+	es.createSnapshot(createdBy, "")
+	return true
+}
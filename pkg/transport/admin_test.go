@@ -0,0 +1,77 @@
+package transport
+
+import (
+	"testing"
+)
+
+// TestEditSession_OpLog tests that the op log keeps authors across snapshots and drops the oldest entries.
+func TestEditSession_OpLog(t *testing.T) {
+	es := NewEditSession("op-log", "/op-log.txt", "")
+	es.SetMaxChangesBeforeSnapshot(10)
+	for i := 0; i < OpLogSize+5; i++ {
+		clientID := "alice"
+		if i%2 == 1 {
+			clientID = "bob"
+		}
+		es.AddOperation([]interface{}{i, "x"}, clientID)
+	}
+
+	if recent := es.GetRecentOperations(); len(recent) >= 10 {
+		t.Errorf("Expected snapshots to clear recent operations, got %d", len(recent))
+	}
+	log := es.OpLog(0)
+	if len(log) != OpLogSize {
+		t.Fatalf("Expected %d entries, got %d", OpLogSize, len(log))
+	}
+	if log[0].Revision != 6 || log[len(log)-1].Revision != OpLogSize+5 {
+		t.Errorf("Expected revisions 6 to %d, got %d to %d", OpLogSize+5, log[0].Revision, log[len(log)-1].Revision)
+	}
+
+	last := es.OpLog(2)
+	if len(last) != 2 || last[1].ClientID != "alice" || last[0].ClientID != "bob" {
+		t.Errorf("Expected the last two operations by bob and alice, got %+v", last)
+	}
+}
+
+// TestProtocolHandler_KickClient tests removing a client and telling the others.
+func TestProtocolHandler_KickClient(t *testing.T) {
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	node := &clusterNode{handler: handler, server: server}
+	node.connect("alice")
+	node.connect("bob")
+
+	var snapshot SnapshotData
+	node.send(t, "alice", MessageTypeStartEditing, &StartEditingData{FilePath: "/kick.txt"})
+	node.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+	node.send(t, "bob", MessageTypeStartEditing, &StartEditingData{FilePath: "/kick.txt"})
+	node.receive(t, "bob", MessageTypeSnapshot, &snapshot)
+
+	if err := handler.KickClient(snapshot.SessionID, "bob", "spam"); err != nil {
+		t.Fatalf("KickClient failed: %v", err)
+	}
+	var left UserLeftData
+	node.receive(t, "alice", MessageTypeUserLeft, &left)
+	if left.ClientID != "bob" {
+		t.Errorf("Expected bob to leave, got %s", left.ClientID)
+	}
+	var kicked ErrorData
+	node.receive(t, "bob", MessageTypeError, &kicked)
+	if kicked.Code != "kicked" || kicked.Message != "spam" {
+		t.Errorf("Expected a kicked error with the reason, got %+v", kicked)
+	}
+	if !node.server.clients["bob"].queue.isClosed() {
+		t.Error("Expected bob to be disconnected")
+	}
+	if info := handler.Session(snapshot.SessionID).GetSessionInfo(); info.WriterCount != 1 {
+		t.Errorf("Expected 1 writer, got %d", info.WriterCount)
+	}
+
+	if err := handler.KickClient(snapshot.SessionID, "bob", ""); err != ErrClientNotFound {
+		t.Errorf("Expected ErrClientNotFound, got %v", err)
+	}
+	if err := handler.KickClient("missing", "alice", ""); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound, got %v", err)
+	}
+}
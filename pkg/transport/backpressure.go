@@ -0,0 +1,469 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+)
+
+// ========== Backpressure ==========
+
+// OverflowPolicy is what a connection does when its send queue exceeds
+// the limits of its BackpressureConfig.
+type OverflowPolicy int
+
+const (
+	// OverflowDisconnect closes the connection. The client reconnects
+	// and resubscribes.
+	OverflowDisconnect OverflowPolicy = iota
+
+	// OverflowCoalesce composes queued remote text operations of the same
+	// session with ot.Compose, and disconnects if that's not enough.
+	OverflowCoalesce
+
+	// OverflowSnapshot replaces the queue with fresh snapshots of the
+	// client's sessions, and disconnects if there is no SnapshotFunc or
+	// the snapshots exceed the limits.
+	OverflowSnapshot
+)
+
+// String returns the name of the policy.
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDisconnect:
+		return "disconnect"
+	case OverflowCoalesce:
+		return "coalesce"
+	case OverflowSnapshot:
+		return "snapshot"
+	default:
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+}
+
+const (
+	// DefaultMaxQueueMessages is the default message limit of a send queue.
+	DefaultMaxQueueMessages = 256
+
+	// DefaultMaxQueueBytes is the default byte limit of a send queue.
+	DefaultMaxQueueBytes = 4 << 20
+)
+
+// ErrSlowConsumer is returned when a message is sent to a client whose
+// send queue overflowed and was disconnected.
+var ErrSlowConsumer = &TransportError{Code: "slow_consumer", Message: "client is not reading fast enough"}
+
+// BackpressureConfig limits the send queue of each connection.
+// Zero limits use the defaults.
+type BackpressureConfig struct {
+	MaxQueueMessages int
+	MaxQueueBytes    int
+	Policy           OverflowPolicy
+}
+
+// DefaultBackpressureConfig returns the default limits, coalescing
+// operations on overflow.
+func DefaultBackpressureConfig() BackpressureConfig {
+	return BackpressureConfig{
+		MaxQueueMessages: DefaultMaxQueueMessages,
+		MaxQueueBytes:    DefaultMaxQueueBytes,
+		Policy:           OverflowCoalesce,
+	}
+}
+
+// SnapshotFunc returns encoded messages that bring a client up to date
+// with all its sessions, used by OverflowSnapshot.
+type SnapshotFunc func(clientID string) ([][]byte, error)
+
+// QueueStats are the metrics of one connection's send queue.
+type QueueStats struct {
+	ClientID  string `json:"client_id"`
+	Messages  int    `json:"messages"`   // Queued messages
+	Bytes     int    `json:"bytes"`      // Queued bytes
+	HighWater int    `json:"high_water"` // Most messages ever queued
+	Dropped   uint64 `json:"dropped"`    // Messages dropped by snapshots or disconnects
+	Coalesced uint64 `json:"coalesced"`  // Operations merged into an earlier one
+	Snapshots uint64 `json:"snapshots"`  // Times the queue was replaced by snapshots
+}
+
+// BackpressureStats are the send queue metrics of a WebSocketServer.
+type BackpressureStats struct {
+	Clients     []QueueStats `json:"clients"`
+	Messages    int          `json:"messages"`
+	Bytes       int          `json:"bytes"`
+	Dropped     uint64       `json:"dropped"`
+	Coalesced   uint64       `json:"coalesced"`
+	Snapshots   uint64       `json:"snapshots"`
+	Disconnects uint64       `json:"disconnects"` // Including disconnected clients
+}
+
+// addQueue adds the counters of a queue to the totals.
+func (s *BackpressureStats) addQueue(queue QueueStats) {
+	s.Dropped += queue.Dropped
+	s.Coalesced += queue.Coalesced
+	s.Snapshots += queue.Snapshots
+}
+
+// outbound is a queued message. Protocol messages are parsed lazily, when
+// the queue overflows.
+type outbound struct {
+	msg  *Message
+	size int
+
+	parsed    bool
+	envelope  map[string]json.RawMessage
+	metadata  map[string]json.RawMessage
+	pm        *ProtocolMessage
+	sessionID string
+	remote    *RemoteOperationData
+	textOp    *ot.Operation // Set for remote text operations
+}
+
+// newOutbound wraps a message for the queue.
+func newOutbound(msg *Message) *outbound {
+	if raw, ok := msg.Metadata["raw_json"].(string); ok {
+		return &outbound{msg: msg, size: len(raw)}
+	}
+	data, _ := json.Marshal(msg)
+	return &outbound{msg: msg, size: len(data)}
+}
+
+// rawOutbound wraps encoded JSON for the queue.
+func rawOutbound(data []byte) *outbound {
+	return newOutbound(&Message{
+		Type:     LegacyMsgOperation, // Placeholder
+		Metadata: map[string]interface{}{"raw_json": string(data)},
+	})
+}
+
+// parse decodes the protocol message, if the message is one.
+func (o *outbound) parse() {
+	if o.parsed {
+		return
+	}
+	o.parsed = true
+
+	raw, ok := o.msg.Metadata["raw_json"].(string)
+	if !ok || json.Unmarshal([]byte(raw), &o.envelope) != nil {
+		return
+	}
+	if json.Unmarshal(o.envelope["metadata"], &o.metadata) != nil {
+		return
+	}
+	var pm ProtocolMessage
+	if json.Unmarshal(o.metadata["protocol_message"], &pm) != nil {
+		return
+	}
+	o.pm = &pm
+
+	var target struct {
+		SessionID string `json:"session_id"`
+	}
+	json.Unmarshal(pm.Data, &target)
+	o.sessionID = target.SessionID
+	if o.sessionID == "" {
+		o.sessionID = pm.SessionID
+	}
+
+	if pm.Type != MessageTypeRemoteOperation {
+		return
+	}
+	var remote RemoteOperationData
+	if json.Unmarshal(pm.Data, &remote) != nil {
+		return
+	}
+	o.remote = &remote
+	if ops, ok := remote.Operation.([]interface{}); ok && remote.Delta == nil && remote.CellID == "" {
+		o.textOp, _ = operationFromJSON(ops)
+	}
+}
+
+// compose returns a message with the text operations of o and next
+// composed, or nil if they can't be composed.
+func (o *outbound) compose(next *outbound) *outbound {
+	combined, err := ot.Compose(o.textOp, next.textOp)
+	if err != nil {
+		return nil
+	}
+
+	remote := *next.remote
+	remote.Operation = combined.ToJSON()
+	pm := *next.pm
+	if pm.Data, err = json.Marshal(&remote); err != nil {
+		return nil
+	}
+
+	metadata := make(map[string]json.RawMessage, len(next.metadata))
+	for k, v := range next.metadata {
+		metadata[k] = v
+	}
+	envelope := make(map[string]json.RawMessage, len(next.envelope))
+	for k, v := range next.envelope {
+		envelope[k] = v
+	}
+	if metadata["protocol_message"], err = json.Marshal(&pm); err != nil {
+		return nil
+	}
+	if envelope["metadata"], err = json.Marshal(metadata); err != nil {
+		return nil
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return nil
+	}
+
+	merged := rawOutbound(data)
+	merged.parsed = true
+	merged.envelope, merged.metadata, merged.pm = envelope, metadata, &pm
+	merged.sessionID, merged.remote, merged.textOp = next.sessionID, &remote, combined
+	return merged
+}
+
+// operationFromJSON decodes a text operation from JSON, where numbers
+// are float64.
+func operationFromJSON(ops []interface{}) (*ot.Operation, error) {
+	builder := ot.NewBuilder()
+	for _, op := range ops {
+		switch v := op.(type) {
+		case float64:
+			if v > 0 {
+				builder.Retain(int(v))
+			} else if v < 0 {
+				builder.Delete(-int(v))
+			}
+		case int:
+			if v > 0 {
+				builder.Retain(v)
+			} else if v < 0 {
+				builder.Delete(-v)
+			}
+		case string:
+			builder.Insert(v)
+		default:
+			return nil, fmt.Errorf("unknown operation type: %T", op)
+		}
+	}
+	return builder.Build(), nil
+}
+
+// sendQueue is the bounded send queue of a connection. Pushing never
+// blocks; a full queue applies the overflow policy instead.
+type sendQueue struct {
+	mu       sync.Mutex
+	config   BackpressureConfig
+	snapshot func() ([][]byte, error)
+	items    []*outbound
+	bytes    int
+	closed   bool
+	ready    chan struct{}
+
+	// Latest snapshot revision per session; older remote operations
+	// queued after a snapshot are already part of it
+	synced map[string]int64
+
+	highWater int
+	dropped   uint64
+	coalesced uint64
+	snapshots uint64
+}
+
+// newSendQueue creates a queue. snapshot may be nil.
+func newSendQueue(config BackpressureConfig, snapshot func() ([][]byte, error)) *sendQueue {
+	if config.MaxQueueMessages <= 0 {
+		config.MaxQueueMessages = DefaultMaxQueueMessages
+	}
+	if config.MaxQueueBytes <= 0 {
+		config.MaxQueueBytes = DefaultMaxQueueBytes
+	}
+	return &sendQueue{
+		config:   config,
+		snapshot: snapshot,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// push queues a message. It returns ErrTransportClosed if the queue is
+// closed, and ErrSlowConsumer if the overflow policy gave up on the
+// client; the queue is closed then.
+func (q *sendQueue) push(msg *Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrTransportClosed
+	}
+	item := newOutbound(msg)
+	if q.stale(item) {
+		q.dropped++
+		return nil
+	}
+
+	q.items = append(q.items, item)
+	q.bytes += item.size
+	if q.overflowing() {
+		switch q.config.Policy {
+		case OverflowCoalesce:
+			q.coalesce()
+		case OverflowSnapshot:
+			q.replaceWithSnapshot()
+		}
+	}
+	if q.overflowing() {
+		q.dropped += uint64(len(q.items))
+		q.items, q.bytes = nil, 0
+		q.closeLocked()
+		return ErrSlowConsumer
+	}
+
+	if len(q.items) > q.highWater {
+		q.highWater = len(q.items)
+	}
+	q.signal()
+	return nil
+}
+
+// pop removes the next message. It returns false if the queue is empty.
+func (q *sendQueue) pop() (*Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	item := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	q.bytes -= item.size
+	return item.msg, true
+}
+
+// close closes the queue. Queued messages can still be popped.
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closeLocked()
+}
+
+// closeLocked closes the queue; the caller holds the lock.
+func (q *sendQueue) closeLocked() {
+	if !q.closed {
+		q.closed = true
+		q.signal()
+	}
+}
+
+// isClosed returns true if the queue is closed.
+func (q *sendQueue) isClosed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+// signal wakes up the writer.
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// stats returns the queue metrics.
+func (q *sendQueue) stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{
+		Messages:  len(q.items),
+		Bytes:     q.bytes,
+		HighWater: q.highWater,
+		Dropped:   q.dropped,
+		Coalesced: q.coalesced,
+		Snapshots: q.snapshots,
+	}
+}
+
+// overflowing returns true if the queue exceeds its limits.
+func (q *sendQueue) overflowing() bool {
+	return len(q.items) > q.config.MaxQueueMessages || q.bytes > q.config.MaxQueueBytes
+}
+
+// stale returns true if item is a remote operation that a snapshot
+// queued earlier already contains.
+func (q *sendQueue) stale(item *outbound) bool {
+	if len(q.synced) == 0 {
+		return false
+	}
+	item.parse()
+	if item.remote == nil {
+		return false
+	}
+	revision, ok := q.synced[item.sessionID]
+	return ok && item.remote.Revision <= revision
+}
+
+// coalesce composes remote text operations of the same session. An
+// operation is only merged into an earlier one if no other message of
+// its session is queued in between, so acks stay in order.
+func (q *sendQueue) coalesce() {
+	merged := make([]*outbound, 0, len(q.items))
+	open := make(map[string]int) // Session -> index in merged of an operation to compose into
+	for _, item := range q.items {
+		item.parse()
+		if item.textOp != nil {
+			if i, ok := open[item.sessionID]; ok {
+				if combined := merged[i].compose(item); combined != nil {
+					merged[i] = combined
+					q.coalesced++
+					continue
+				}
+			}
+			merged = append(merged, item)
+			open[item.sessionID] = len(merged) - 1
+			continue
+		}
+
+		if item.sessionID == "" {
+			open = make(map[string]int)
+		} else {
+			delete(open, item.sessionID)
+		}
+		merged = append(merged, item)
+	}
+
+	q.items = merged
+	q.bytes = 0
+	for _, item := range merged {
+		q.bytes += item.size
+	}
+}
+
+// replaceWithSnapshot replaces the queue with fresh snapshots.
+func (q *sendQueue) replaceWithSnapshot() {
+	if q.snapshot == nil {
+		return
+	}
+	snapshots, err := q.snapshot()
+	if err != nil {
+		return
+	}
+
+	q.dropped += uint64(len(q.items))
+	q.snapshots++
+	q.items, q.bytes = nil, 0
+	for _, data := range snapshots {
+		item := rawOutbound(data)
+		item.parse()
+		if item.pm != nil && item.pm.Type == MessageTypeSnapshot {
+			var snapshot SnapshotData
+			if json.Unmarshal(item.pm.Data, &snapshot) == nil {
+				if q.synced == nil {
+					q.synced = make(map[string]int64)
+				}
+				q.synced[snapshot.SessionID] = snapshot.Revision
+			}
+		}
+		q.items = append(q.items, item)
+		q.bytes += item.size
+	}
+}
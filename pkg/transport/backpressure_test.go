@@ -0,0 +1,136 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// encodeFor encodes a server message the way ProtocolHandler sends it.
+func encodeFor(t *testing.T, msgType MessageType, data interface{}) []byte {
+	t.Helper()
+	raw, err := (&ProtocolHandler{}).encode("client-1", "", "", msgType, data)
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	return raw
+}
+
+// remoteOp encodes a remote text operation of session s1.
+func remoteOp(t *testing.T, revision int64, op ...interface{}) *Message {
+	return rawOutbound(encodeFor(t, MessageTypeRemoteOperation, &RemoteOperationData{
+		SessionID: "s1",
+		ClientID:  "client-2",
+		Revision:  revision,
+		Operation: op,
+	})).msg
+}
+
+// popProtocol pops the next message of a queue as a protocol message.
+func popProtocol(t *testing.T, q *sendQueue) ProtocolMessage {
+	t.Helper()
+	msg, ok := q.pop()
+	if !ok {
+		t.Fatal("Expected a queued message")
+	}
+	item := newOutbound(msg)
+	item.parse()
+	return *item.pm
+}
+
+// TestSendQueue_Coalesce tests composing queued remote operations on overflow.
+func TestSendQueue_Coalesce(t *testing.T) {
+	q := newSendQueue(BackpressureConfig{MaxQueueMessages: 3, Policy: OverflowCoalesce}, nil)
+	ack := rawOutbound(encodeFor(t, MessageTypeAck, &AckData{SessionID: "s1", Revision: 3})).msg
+
+	for _, msg := range []*Message{remoteOp(t, 1, "a"), remoteOp(t, 2, 1, "b"), ack, remoteOp(t, 4, 3, "c")} {
+		if err := q.push(msg); err != nil {
+			t.Fatalf("push failed: %v", err)
+		}
+	}
+
+	stats := q.stats()
+	if stats.Messages != 3 || stats.Coalesced != 1 {
+		t.Fatalf("Expected 3 messages and 1 coalesced, got %+v", stats)
+	}
+
+	var remote RemoteOperationData
+	json.Unmarshal(popProtocol(t, q).Data, &remote)
+	if !reflect.DeepEqual(remote.Operation, []interface{}{"ab"}) || remote.Revision != 2 {
+		t.Errorf("Expected [\"ab\"] at revision 2, got %v at %d", remote.Operation, remote.Revision)
+	}
+	// The ack keeps operations before and after it apart
+	if pm := popProtocol(t, q); pm.Type != MessageTypeAck {
+		t.Errorf("Expected ack, got %s", pm.Type)
+	}
+	json.Unmarshal(popProtocol(t, q).Data, &remote)
+	if !reflect.DeepEqual(remote.Operation, []interface{}{float64(3), "c"}) {
+		t.Errorf("Expected [3, \"c\"], got %v", remote.Operation)
+	}
+}
+
+// TestSendQueue_Snapshot tests replacing an overflowing queue with snapshots.
+func TestSendQueue_Snapshot(t *testing.T) {
+	snapshot := func() ([][]byte, error) {
+		return [][]byte{encodeFor(t, MessageTypeSnapshot, &SnapshotData{SessionID: "s1", Content: "abc", Revision: 3})}, nil
+	}
+	q := newSendQueue(BackpressureConfig{MaxQueueMessages: 2, Policy: OverflowSnapshot}, snapshot)
+
+	q.push(remoteOp(t, 1, "a"))
+	q.push(remoteOp(t, 2, 1, "b"))
+	if err := q.push(remoteOp(t, 3, 2, "c")); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	// Operations the snapshot already contains are dropped
+	q.push(remoteOp(t, 3, 2, "c"))
+	q.push(remoteOp(t, 4, 3, "d"))
+
+	stats := q.stats()
+	if stats.Messages != 2 || stats.Snapshots != 1 || stats.Dropped != 4 {
+		t.Fatalf("Expected 2 messages, 1 snapshot and 4 dropped, got %+v", stats)
+	}
+	if pm := popProtocol(t, q); pm.Type != MessageTypeSnapshot {
+		t.Errorf("Expected snapshot, got %s", pm.Type)
+	}
+	var remote RemoteOperationData
+	json.Unmarshal(popProtocol(t, q).Data, &remote)
+	if remote.Revision != 4 {
+		t.Errorf("Expected the operation at revision 4, got %d", remote.Revision)
+	}
+}
+
+// TestWebSocketServer_DisconnectSlowConsumer tests disconnecting a client that overflows its queue.
+func TestWebSocketServer_DisconnectSlowConsumer(t *testing.T) {
+	server := NewWebSocketServer("")
+	server.SetBackpressureConfig(BackpressureConfig{MaxQueueMessages: 2, Policy: OverflowDisconnect})
+	server.clients["slow"] = newWebSocketConn("slow", nil, server)
+	server.clients["fast"] = newWebSocketConn("fast", nil, server)
+
+	data := encodeFor(t, MessageTypeUserLeft, &UserLeftData{SessionID: "s1", ClientID: "client-2"})
+	for i := 0; i < 2; i++ {
+		if err := server.SendJSON("slow", data); err != nil {
+			t.Fatalf("SendJSON failed: %v", err)
+		}
+	}
+	server.SendJSON("fast", data)
+
+	if err := server.SendJSON("slow", data); !errors.Is(err, ErrSlowConsumer) {
+		t.Fatalf("Expected ErrSlowConsumer, got %v", err)
+	}
+	if err := server.SendJSON("slow", data); !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("Expected ErrTransportClosed after the disconnect, got %v", err)
+	}
+	if err := server.SendJSON("fast", data); err != nil {
+		t.Errorf("Expected other clients to be unaffected, got %v", err)
+	}
+
+	stats := server.BackpressureStats()
+	if stats.Disconnects != 1 || stats.Dropped != 3 || stats.Messages != 2 {
+		t.Errorf("Expected 1 disconnect, 3 dropped and 2 queued, got %+v", stats)
+	}
+	if len(stats.Clients) != 2 || stats.Clients[0].ClientID != "fast" || stats.Clients[0].Messages != 2 {
+		t.Errorf("Expected per-client stats, got %+v", stats.Clients)
+	}
+}
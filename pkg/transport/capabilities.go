@@ -0,0 +1,116 @@
+package transport
+
+import (
+	"fmt"
+)
+
+// ========== Capabilities ==========
+
+// Features a client and the server can agree on in the hello/welcome
+// handshake.
+const (
+	FeatureSSE         = "sse"         // Read-only subscriptions pushed over SSE
+	FeatureUndo        = "undo"        // Server-side undo/redo
+	FeaturePresence    = "presence"    // user_joined, user_left and session_info messages
+	FeatureBinaryOps   = "binary-ops"  // Binary operation encoding
+	FeatureCompression = "compression" // permessage-deflate compressed messages
+)
+
+// ProtocolVersionMin is the oldest protocol version the server speaks.
+const ProtocolVersionMin = ProtocolVersion1
+
+// ErrUnsupportedVersion is returned when a client and the server have no
+// protocol version in common.
+var ErrUnsupportedVersion = &TransportError{Code: "unsupported_version", Message: "no common protocol version"}
+
+// DefaultFeatures returns the features the server implements.
+func DefaultFeatures() []string {
+	return []string{FeatureSSE, FeaturePresence, FeatureCompression}
+}
+
+// featureMessages maps message types to the feature a client must have
+// negotiated to receive them.
+var featureMessages = map[MessageType]string{
+	MessageTypeUserJoined:  FeaturePresence,
+	MessageTypeUserLeft:    FeaturePresence,
+	MessageTypeSessionInfo: FeaturePresence,
+}
+
+// Capabilities are what a client and the server agreed on: the protocol
+// version and the features both support. Clients that don't send a
+// hello get the version of their connection URL and all server features.
+type Capabilities struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+}
+
+// Has returns true if the feature was negotiated.
+func (c *Capabilities) Has(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts returns true if a client with these capabilities receives
+// messages of msgType.
+func (c *Capabilities) accepts(msgType MessageType) bool {
+	feature, ok := featureMessages[msgType]
+	return !ok || c.Has(feature)
+}
+
+// acceptsAll returns true if the client receives messages of all types.
+func (c *Capabilities) acceptsAll() bool {
+	for _, feature := range featureMessages {
+		if !c.Has(feature) {
+			return false
+		}
+	}
+	return true
+}
+
+// negotiate picks the newest version in both the client's and the
+// server's range, and the features both support, in server order.
+func negotiate(hello *HelloData, serverFeatures []string) (*Capabilities, error) {
+	minVersion, maxVersion := hello.MinVersion, hello.MaxVersion
+	if minVersion < ProtocolVersionMin {
+		minVersion = ProtocolVersionMin
+	}
+	if maxVersion == 0 || maxVersion > ProtocolVersionLatest {
+		maxVersion = ProtocolVersionLatest
+	}
+	if maxVersion < minVersion {
+		return nil, fmt.Errorf("%w: client speaks %d-%d, server %d-%d", ErrUnsupportedVersion,
+			hello.MinVersion, hello.MaxVersion, ProtocolVersionMin, ProtocolVersionLatest)
+	}
+
+	client := &Capabilities{Features: hello.Features}
+	features := make([]string, 0, len(serverFeatures))
+	for _, feature := range serverFeatures {
+		if client.Has(feature) {
+			features = append(features, feature)
+		}
+	}
+	return &Capabilities{Version: maxVersion, Features: features}, nil
+}
+
+// ========== Version Adapters ==========
+
+// VersionAdapter lets the server keep serving clients of an older
+// protocol version after message formats change. Handlers only deal with
+// the current format; the connection converts messages at the edge.
+//
+// Example, after operations became objects in a newer version:
+//
+//	server.SetAdapter(ProtocolVersion2, adapter)
+type VersionAdapter interface {
+	// Outgoing converts a server message for the client. Returning nil
+	// drops the message.
+	Outgoing(pm *ProtocolMessage) *ProtocolMessage
+
+	// Incoming converts a client message to the current format.
+	// Returning nil drops the message.
+	Incoming(pm *ProtocolMessage) *ProtocolMessage
+}
@@ -0,0 +1,151 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestNegotiate tests picking the common protocol version and features.
+func TestNegotiate(t *testing.T) {
+	server := []string{FeatureSSE, FeaturePresence, FeatureCompression}
+
+	caps, err := negotiate(&HelloData{MinVersion: 1, MaxVersion: 9, Features: []string{FeatureUndo, FeaturePresence, FeatureSSE}}, server)
+	if err != nil {
+		t.Fatalf("negotiate failed: %v", err)
+	}
+	if caps.Version != ProtocolVersionLatest {
+		t.Errorf("Expected version %d, got %d", ProtocolVersionLatest, caps.Version)
+	}
+	if !reflect.DeepEqual(caps.Features, []string{FeatureSSE, FeaturePresence}) {
+		t.Errorf("Expected [sse presence], got %v", caps.Features)
+	}
+
+	if caps, _ := negotiate(&HelloData{MinVersion: 1, MaxVersion: 1}, server); caps.Version != ProtocolVersion1 {
+		t.Errorf("Expected version 1, got %d", caps.Version)
+	}
+	if _, err := negotiate(&HelloData{MinVersion: 7, MaxVersion: 9}, server); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+// TestProtocolHandler_Hello tests the handshake and branching on its result.
+func TestProtocolHandler_Hello(t *testing.T) {
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	node := &clusterNode{handler: handler, server: server}
+	node.connect("c1")
+
+	node.request(t, "c1", "req-1", MessageTypeHello, &HelloData{MinVersion: 7, MaxVersion: 9})
+	reply := node.next(t, "c1")
+	var errData ErrorData
+	json.Unmarshal(reply.Data, &errData)
+	if errData.Code != "unsupported_version" {
+		t.Errorf("Expected unsupported_version, got %q", errData.Code)
+	}
+
+	node.request(t, "c1", "req-2", MessageTypeHello, &HelloData{MinVersion: 1, MaxVersion: 2, Features: []string{FeatureSSE}})
+	reply = node.next(t, "c1")
+	var welcome WelcomeData
+	json.Unmarshal(reply.Data, &welcome)
+	if reply.Type != MessageTypeWelcome || reply.RequestID != "req-2" {
+		t.Fatalf("Expected a welcome for req-2, got %s for %q", reply.Type, reply.RequestID)
+	}
+	if welcome.ProtocolVersion != 2 || !reflect.DeepEqual(welcome.Features, []string{FeatureSSE}) {
+		t.Errorf("Expected version 2 with [sse], got %d with %v", welcome.ProtocolVersion, welcome.Features)
+	}
+
+	// Without presence the client gets no client lists or presence events
+	caps := server.Capabilities("c1")
+	if caps.Has(FeaturePresence) {
+		t.Fatal("Expected presence not to be negotiated")
+	}
+	node.send(t, "c1", MessageTypeSubscribe, &SubscribeData{FilePath: "/hello.txt"})
+	var snapshot SnapshotData
+	node.receive(t, "c1", MessageTypeSnapshot, &snapshot)
+	if snapshot.Clients != nil {
+		t.Errorf("Expected no clients in the snapshot, got %v", snapshot.Clients)
+	}
+	conn := server.clients["c1"]
+	joined := encodeFor(t, MessageTypeUserJoined, &UserJoinedData{SessionID: snapshot.SessionID, ClientID: "c2"})
+	if conn.outgoing(joined, caps) != nil {
+		t.Error("Expected user_joined to be dropped")
+	}
+	ack := encodeFor(t, MessageTypeAck, &AckData{SessionID: snapshot.SessionID})
+	if conn.outgoing(ack, caps) == nil {
+		t.Error("Expected ack to be sent")
+	}
+}
+
+// legacyAdapter is a VersionAdapter for a version that called operations
+// "edit".
+type legacyAdapter struct{}
+
+func (legacyAdapter) Outgoing(pm *ProtocolMessage) *ProtocolMessage {
+	if pm.Type == MessageTypeCommentEvent {
+		return nil
+	}
+	if pm.Type == MessageTypeRemoteOperation {
+		pm.Type = "remote_edit"
+	}
+	return pm
+}
+
+func (legacyAdapter) Incoming(pm *ProtocolMessage) *ProtocolMessage {
+	if pm.Type == "edit" {
+		pm.Type = MessageTypeOperation
+	}
+	return pm
+}
+
+// TestWebSocketConn_Adapter tests converting messages of older versions at the connection.
+func TestWebSocketConn_Adapter(t *testing.T) {
+	server := NewWebSocketServer("")
+	server.SetAdapter(ProtocolVersion1, legacyAdapter{})
+	conn := newWebSocketConn("c1", nil, server)
+	caps := conn.Capabilities()
+
+	received, err := parseEnvelope(conn.outgoing(encodeFor(t, MessageTypeRemoteOperation, &RemoteOperationData{SessionID: "s1"}), caps))
+	if err != nil || received.Protocol.Type != "remote_edit" {
+		t.Errorf("Expected remote_edit, got %v (%v)", received, err)
+	}
+	if conn.outgoing(encodeFor(t, MessageTypeCommentEvent, &CommentEventData{SessionID: "s1"}), caps) != nil {
+		t.Error("Expected comment_event to be dropped")
+	}
+
+	pm, _ := NewProtocolMessage("edit", "", &OperationData{SessionID: "s1"})
+	raw, _ := json.Marshal(pm)
+	received, err = parseEnvelope(conn.incoming(raw))
+	if err != nil || received.Protocol.Type != MessageTypeOperation || received.ClientID != "c1" {
+		t.Errorf("Expected an operation from c1, got %v (%v)", received, err)
+	}
+
+	// Other versions are untouched
+	server.clients["c2"] = newWebSocketConn("c2", nil, server)
+	server.Negotiate("c2", &HelloData{MinVersion: 2, MaxVersion: 2})
+	if data := server.clients["c2"].incoming(raw); string(data) != string(raw) {
+		t.Errorf("Expected version 2 messages unchanged, got %s", data)
+	}
+}
+
+// TestMultiDocWebSocketTransport_Hello tests the client side of the handshake.
+func TestMultiDocWebSocketTransport_Hello(t *testing.T) {
+	_, url := protocolServer(t)
+	transport := NewMultiDocWebSocketTransport("hello-client", url)
+	if err := transport.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer transport.Close()
+
+	expected := &Capabilities{Version: ProtocolVersionLatest, Features: []string{FeaturePresence, FeatureCompression}}
+	for i := 0; i < 100 && !reflect.DeepEqual(transport.Capabilities(), expected); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if caps := transport.Capabilities(); !reflect.DeepEqual(caps, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, caps)
+	}
+}
@@ -0,0 +1,531 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ========== Cluster Mode ==========
+//
+// In cluster mode several server replicas share the editing sessions.
+// Every file has exactly one owner node, chosen by consistent hashing of
+// its path. The owner hosts the EditSession; other nodes forward the
+// messages of their clients to it over a ClusterBus, and the owner sends
+// replies and broadcasts for those clients back to the node they are
+// connected to.
+
+// DefaultVirtualNodes is the number of points each node has on a HashRing.
+const DefaultVirtualNodes = 128
+
+// ErrNoClusterNodes is returned when a file cannot be routed because the
+// hash ring is empty.
+var ErrNoClusterNodes = errors.New("cluster has no nodes")
+
+// HashRing assigns file paths to nodes by consistent hashing.
+// Adding or removing a node only moves the files that hash next to it.
+type HashRing struct {
+	mu       sync.RWMutex
+	replicas int
+	points   []uint64          // Sorted hashes of virtual nodes
+	owners   map[uint64]string // Virtual node hash -> node ID
+	nodes    map[string]bool
+	version  uint64 // Incremented by every change of the nodes
+}
+
+// NewHashRing creates a hash ring with the given nodes.
+// replicas is the number of virtual nodes per node; 0 means DefaultVirtualNodes.
+func NewHashRing(replicas int, nodes ...string) *HashRing {
+	if replicas <= 0 {
+		replicas = DefaultVirtualNodes
+	}
+	r := &HashRing{
+		replicas: replicas,
+		owners:   make(map[uint64]string),
+		nodes:    make(map[string]bool),
+	}
+	for _, node := range nodes {
+		r.Add(node)
+	}
+	return r
+}
+
+// Add adds a node to the ring.
+func (r *HashRing) Add(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+	r.version++
+	for i := 0; i < r.replicas; i++ {
+		h := ringHash(node + "#" + strconv.Itoa(i))
+		r.owners[h] = node
+		r.points = append(r.points, h)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+// Remove removes a node from the ring.
+func (r *HashRing) Remove(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+	r.version++
+	points := r.points[:0]
+	for _, h := range r.points {
+		if r.owners[h] == node {
+			delete(r.owners, h)
+			continue
+		}
+		points = append(points, h)
+	}
+	r.points = points
+}
+
+// Nodes returns the nodes on the ring, sorted.
+func (r *HashRing) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Version returns a number that changes whenever a node is added or
+// removed, and with it possibly the owner of any file.
+func (r *HashRing) Version() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.version
+}
+
+// Owner returns the node that owns filePath, or "" if the ring is empty.
+func (r *HashRing) Owner(filePath string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(filePath)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// ringHash hashes a key onto the ring.
+func ringHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// clusterSessionNamespace scopes the session IDs derived from file paths.
+var clusterSessionNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("texere:session"))
+
+// ClusterSessionID returns the session ID of filePath in cluster mode.
+// It is derived from the path, so every node agrees on it without
+// asking the owner.
+func ClusterSessionID(filePath string) string {
+	return uuid.NewSHA1(clusterSessionNamespace, []byte(filePath)).String()
+}
+
+// ========== Cluster Bus ==========
+
+// ClusterBus carries messages between the nodes of a cluster.
+//
+// Implementations:
+// - RedisBus: Redis pub/sub, for multi-process deployments
+// - MemoryBus: In-process, for testing
+type ClusterBus interface {
+	// Publish sends payload to every subscriber of channel.
+	Publish(channel string, payload []byte) error
+
+	// Subscribe calls handler for every payload published to channel.
+	Subscribe(channel string, handler func(payload []byte)) error
+
+	// Close stops delivering messages and releases resources.
+	Close() error
+}
+
+// MemoryBus is an in-process ClusterBus.
+// Messages are delivered synchronously, in publish order, so tests can
+// run several nodes in one process without waiting.
+type MemoryBus struct {
+	mu       sync.RWMutex
+	handlers map[string][]func([]byte)
+	closed   bool
+}
+
+// NewMemoryBus creates an in-process bus.
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{handlers: make(map[string][]func([]byte))}
+}
+
+// Publish calls the handlers subscribed to channel.
+func (b *MemoryBus) Publish(channel string, payload []byte) error {
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return ErrTransportClosed
+	}
+	handlers := append([]func([]byte){}, b.handlers[channel]...)
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(append([]byte(nil), payload...))
+	}
+	return nil
+}
+
+// Subscribe registers handler for channel.
+func (b *MemoryBus) Subscribe(channel string, handler func(payload []byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrTransportClosed
+	}
+	b.handlers[channel] = append(b.handlers[channel], handler)
+	return nil
+}
+
+// Close drops all subscriptions.
+func (b *MemoryBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	b.handlers = make(map[string][]func([]byte))
+	return nil
+}
+
+// RedisBus is a ClusterBus on Redis pub/sub.
+type RedisBus struct {
+	client RedisClient
+	wg     sync.WaitGroup
+}
+
+// NewRedisBus creates a bus that publishes and subscribes through client.
+//
+// Example:
+//
+//	bus := NewRedisBus(redisClient)
+//	router := NewClusterRouter("node-a", NewHashRing(0, "node-a", "node-b"), bus)
+func NewRedisBus(client RedisClient) *RedisBus {
+	return &RedisBus{client: client}
+}
+
+// Publish publishes payload, which must be JSON, to channel.
+func (b *RedisBus) Publish(channel string, payload []byte) error {
+	return b.client.Publish(channel, json.RawMessage(payload))
+}
+
+// Subscribe subscribes to channel and calls handler from a goroutine
+// until the subscription channel is closed.
+func (b *RedisBus) Subscribe(channel string, handler func(payload []byte)) error {
+	messages := b.client.Subscribe(channel)
+	if messages == nil {
+		return fmt.Errorf("subscribe %s failed", channel)
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for message := range messages {
+			handler([]byte(message))
+		}
+	}()
+	return nil
+}
+
+// Close closes the Redis client and waits for the subscribers to stop.
+func (b *RedisBus) Close() error {
+	err := b.client.Close()
+	b.wg.Wait()
+	return err
+}
+
+// ========== Cluster Router ==========
+
+// Cluster envelope kinds.
+const (
+	clusterForward    = "forward"    // Client message for the owner of its file
+	clusterDeliver    = "deliver"    // Server message for a client on another node
+	clusterDisconnect = "disconnect" // Client disconnected from the sending node
+)
+
+// clusterEnvelope is the message format on the cluster bus.
+type clusterEnvelope struct {
+	Kind     string          `json:"kind"`
+	From     string          `json:"from"`      // Sending node
+	ClientID string          `json:"client_id"` // Client the message is from or for
+	Message  json.RawMessage `json:"message"`   // Raw client or server message
+}
+
+// ClusterRouter routes messages between the nodes of a cluster.
+//
+// Each node listens on its own bus channel. A node forwards the messages
+// of a local client to the owner of the file, and remembers the sessions
+// it forwarded so later messages follow them until the ring moves the
+// file to another node. The owner remembers which node each remote client
+// is connected to and delivers its messages there, until the client
+// disconnects from that node.
+type ClusterRouter struct {
+	mu     sync.RWMutex
+	nodeID string
+	ring   *HashRing
+	bus    ClusterBus
+	prefix string
+
+	remote      map[string]string       // Remote client ID -> node ID
+	routes      map[string]clusterRoute // Forwarded session ID -> route
+	ringVersion uint64                  // Ring version the routes were checked at
+
+	handle  func(clientID string, message []byte)       // Handles a forwarded message
+	deliver func(clientID string, message []byte) error // Sends to a local client
+
+	logger *slog.Logger
+}
+
+// NewClusterRouter creates a router for node nodeID.
+func NewClusterRouter(nodeID string, ring *HashRing, bus ClusterBus) *ClusterRouter {
+	return &ClusterRouter{
+		nodeID: nodeID,
+		ring:   ring,
+		bus:    bus,
+		prefix: "texere:cluster:",
+		remote: make(map[string]string),
+		routes: make(map[string]clusterRoute),
+		logger: componentLogger(nil, "cluster").With("node_id", nodeID),
+	}
+}
+
+// SetLogger sets the logger of the router. It defaults to slog.Default().
+func (r *ClusterRouter) SetLogger(logger *slog.Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logger = componentLogger(logger, "cluster").With("node_id", r.nodeID)
+}
+
+// NodeID returns the ID of this node.
+func (r *ClusterRouter) NodeID() string {
+	return r.nodeID
+}
+
+// Ring returns the hash ring used to find owners.
+func (r *ClusterRouter) Ring() *HashRing {
+	return r.ring
+}
+
+// Start subscribes to this node's channel. handle is called for messages
+// forwarded by other nodes, deliver for messages to local clients.
+func (r *ClusterRouter) Start(handle func(clientID string, message []byte), deliver func(clientID string, message []byte) error) error {
+	r.mu.Lock()
+	r.handle = handle
+	r.deliver = deliver
+	r.mu.Unlock()
+
+	return r.bus.Subscribe(r.channel(r.nodeID), r.receive)
+}
+
+// Owner returns the node that owns filePath.
+func (r *ClusterRouter) Owner(filePath string) string {
+	return r.ring.Owner(filePath)
+}
+
+// IsOwner returns true if this node owns filePath.
+func (r *ClusterRouter) IsOwner(filePath string) bool {
+	return r.ring.Owner(filePath) == r.nodeID
+}
+
+// clusterRoute is the owner a forwarded session was routed to.
+type clusterRoute struct {
+	filePath string
+	owner    string
+}
+
+// SessionOwner returns the owner of a session that local clients joined
+// through another node, or "" if the session is not forwarded or the
+// ring has since moved its file to another node.
+func (r *ClusterRouter) SessionOwner(sessionID string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checkRoutes()
+	return r.routes[sessionID].owner
+}
+
+// checkRoutes drops the routes of sessions whose file changed owner since
+// the ring was last checked. Caller must hold r.mu.
+func (r *ClusterRouter) checkRoutes() {
+	version := r.ring.Version()
+	if version == r.ringVersion {
+		return
+	}
+	r.ringVersion = version
+	for sessionID, route := range r.routes {
+		if r.ring.Owner(route.filePath) != route.owner {
+			delete(r.routes, sessionID)
+		}
+	}
+}
+
+// ForwardFile forwards a client message about filePath to its owner and
+// routes later messages for the file's session there too.
+// Returns false if this node owns the file.
+func (r *ClusterRouter) ForwardFile(filePath, clientID string, message []byte) (bool, error) {
+	owner := r.ring.Owner(filePath)
+	if owner == "" {
+		return false, ErrNoClusterNodes
+	}
+	if owner == r.nodeID {
+		return false, nil
+	}
+
+	r.mu.Lock()
+	r.checkRoutes()
+	r.routes[ClusterSessionID(filePath)] = clusterRoute{filePath: filePath, owner: owner}
+	r.mu.Unlock()
+
+	return true, r.publish(owner, clusterForward, clientID, message)
+}
+
+// ForwardSession forwards a client message about a session to the owner
+// it was routed to by ForwardFile.
+// Returns false if the session is hosted here.
+func (r *ClusterRouter) ForwardSession(sessionID, clientID string, message []byte) (bool, error) {
+	owner := r.SessionOwner(sessionID)
+	if owner == "" || owner == r.nodeID {
+		return false, nil
+	}
+	return true, r.publish(owner, clusterForward, clientID, message)
+}
+
+// Deliver sends a message to a client connected to another node.
+// Returns false if the client is not a known remote client.
+func (r *ClusterRouter) Deliver(clientID string, message []byte) (bool, error) {
+	r.mu.RLock()
+	node, ok := r.remote[clientID]
+	r.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	return true, r.publish(node, clusterDeliver, clientID, message)
+}
+
+// IsRemoteClient returns true if clientID is connected to another node.
+func (r *ClusterRouter) IsRemoteClient(clientID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.remote[clientID]
+	return ok
+}
+
+// ForgetClient drops the routing state of a client.
+func (r *ClusterRouter) ForgetClient(clientID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.remote, clientID)
+}
+
+// ClientDisconnected forgets a client that disconnected from this node,
+// and tells the other nodes to forget it too.
+func (r *ClusterRouter) ClientDisconnected(clientID string) error {
+	r.ForgetClient(clientID)
+
+	var firstErr error
+	for _, node := range r.ring.Nodes() {
+		if node == r.nodeID {
+			continue
+		}
+		if err := r.publish(node, clusterDisconnect, clientID, nil); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close closes the bus.
+func (r *ClusterRouter) Close() error {
+	return r.bus.Close()
+}
+
+// channel returns the bus channel of a node.
+func (r *ClusterRouter) channel(nodeID string) string {
+	return r.prefix + nodeID
+}
+
+// publish sends an envelope to a node.
+func (r *ClusterRouter) publish(nodeID, kind, clientID string, message []byte) error {
+	payload, err := json.Marshal(&clusterEnvelope{
+		Kind:     kind,
+		From:     r.nodeID,
+		ClientID: clientID,
+		Message:  message,
+	})
+	if err != nil {
+		return err
+	}
+	return r.bus.Publish(r.channel(nodeID), payload)
+}
+
+// receive handles an envelope published to this node.
+func (r *ClusterRouter) receive(payload []byte) {
+	r.mu.Lock()
+	handle, deliver, logger := r.handle, r.deliver, r.logger
+	r.mu.Unlock()
+
+	var env clusterEnvelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		logger.Warn("invalid envelope", LogKeyError, err)
+		return
+	}
+
+	if env.Kind == clusterForward {
+		r.mu.Lock()
+		r.remote[env.ClientID] = env.From
+		r.mu.Unlock()
+	}
+
+	switch env.Kind {
+	case clusterForward:
+		if handle != nil {
+			handle(env.ClientID, env.Message)
+		}
+	case clusterDeliver:
+		if deliver != nil {
+			if err := deliver(env.ClientID, env.Message); err != nil {
+				logger.Warn("failed to deliver message", LogKeyClient, env.ClientID, "from", env.From, LogKeyError, err)
+			}
+		}
+	case clusterDisconnect:
+		// The client may have reconnected through another node since
+		r.mu.Lock()
+		if r.remote[env.ClientID] == env.From {
+			delete(r.remote, env.ClientID)
+		}
+		r.mu.Unlock()
+	default:
+		logger.Warn("unknown envelope kind", "kind", env.Kind, "from", env.From)
+	}
+}
@@ -0,0 +1,258 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// TestHashRing_Owner tests that ownership is deterministic and balanced.
+func TestHashRing_Owner(t *testing.T) {
+	ring := NewHashRing(0, "node-a", "node-b", "node-c")
+	other := NewHashRing(0, "node-c", "node-a", "node-b")
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		path := fmt.Sprintf("/docs/file-%d.txt", i)
+		owner := ring.Owner(path)
+		if owner != other.Owner(path) {
+			t.Fatalf("Owner of %s depends on node order", path)
+		}
+		counts[owner]++
+	}
+
+	for _, node := range ring.Nodes() {
+		if counts[node] < 600 {
+			t.Errorf("Expected node %s to own about a third of the files, got %d", node, counts[node])
+		}
+	}
+
+	if owner := NewHashRing(0).Owner("/a.txt"); owner != "" {
+		t.Errorf("Expected no owner on an empty ring, got %s", owner)
+	}
+}
+
+// TestHashRing_Remove tests that removing a node only moves its files.
+func TestHashRing_Remove(t *testing.T) {
+	ring := NewHashRing(0, "node-a", "node-b", "node-c")
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		path := fmt.Sprintf("/file-%d", i)
+		before[path] = ring.Owner(path)
+	}
+
+	ring.Remove("node-b")
+	for path, owner := range before {
+		after := ring.Owner(path)
+		if after == "node-b" {
+			t.Fatalf("Removed node still owns %s", path)
+		}
+		if owner != "node-b" && after != owner {
+			t.Errorf("File %s moved from %s to %s", path, owner, after)
+		}
+	}
+}
+
+// TestClusterSessionID tests that session IDs are derived from file paths.
+func TestClusterSessionID(t *testing.T) {
+	if ClusterSessionID("/a.txt") != ClusterSessionID("/a.txt") {
+		t.Error("Expected the same session ID for the same path")
+	}
+	if ClusterSessionID("/a.txt") == ClusterSessionID("/b.txt") {
+		t.Error("Expected different session IDs for different paths")
+	}
+}
+
+// TestRedisBus tests publishing through a Redis client.
+func TestRedisBus(t *testing.T) {
+	bus := NewRedisBus(NewMiniRedis())
+
+	received := make(chan string, 1)
+	if err := bus.Subscribe("node-a", func(payload []byte) {
+		received <- string(payload)
+	}); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if err := bus.Publish("node-a", []byte(`{"kind":"deliver"}`)); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	if payload := <-received; payload != `{"kind":"deliver"}` {
+		t.Errorf("Expected the published payload, got %s", payload)
+	}
+	if err := bus.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
+
+// clusterNode is a protocol handler with fake WebSocket clients.
+type clusterNode struct {
+	handler *ProtocolHandler
+	server  *WebSocketServer
+}
+
+func newClusterNode(t *testing.T, nodeID string, ring *HashRing, bus ClusterBus) *clusterNode {
+	t.Helper()
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	if err := handler.SetCluster(NewClusterRouter(nodeID, ring, bus)); err != nil {
+		t.Fatalf("SetCluster failed: %v", err)
+	}
+	return &clusterNode{handler: handler, server: server}
+}
+
+// connect registers a client connection without a socket.
+func (n *clusterNode) connect(clientID string) {
+	n.server.clients[clientID] = newWebSocketConn(clientID, nil, n.server)
+}
+
+// send handles a protocol message from a client.
+func (n *clusterNode) send(t *testing.T, clientID string, msgType MessageType, data interface{}) {
+	t.Helper()
+	pm, err := NewProtocolMessage(msgType, "", data)
+	if err != nil {
+		t.Fatalf("NewProtocolMessage failed: %v", err)
+	}
+	raw, _ := json.Marshal(map[string]interface{}{
+		"type":      string(msgType),
+		"client_id": clientID,
+		"metadata":  map[string]interface{}{"protocol_message": pm},
+	})
+	n.handler.handleRawMessage(clientID, raw)
+}
+
+// receive returns the next message sent to a client.
+func (n *clusterNode) receive(t *testing.T, clientID string, msgType MessageType, data interface{}) {
+	t.Helper()
+	for {
+		msg, ok := n.server.clients[clientID].queue.pop()
+		if !ok {
+			t.Fatalf("Client %s did not receive %s", clientID, msgType)
+		}
+		var response struct {
+			Metadata struct {
+				ProtocolMessage ProtocolMessage `json:"protocol_message"`
+			} `json:"metadata"`
+		}
+		json.Unmarshal([]byte(msg.Metadata["raw_json"].(string)), &response)
+		pm := response.Metadata.ProtocolMessage
+		if pm.Type != msgType {
+			continue
+		}
+		if err := json.Unmarshal(pm.Data, data); err != nil {
+			t.Fatalf("Failed to parse %s: %v", msgType, err)
+		}
+		return
+	}
+}
+
+// TestCluster_ForwardToOwner tests two clients editing the same file
+// through different nodes.
+func TestCluster_ForwardToOwner(t *testing.T) {
+	ring := NewHashRing(0, "node-a", "node-b")
+	bus := NewMemoryBus()
+	nodeA := newClusterNode(t, "node-a", ring, bus)
+	nodeB := newClusterNode(t, "node-b", ring, bus)
+
+	path := ""
+	for i := 0; ring.Owner(path) != "node-b"; i++ {
+		path = fmt.Sprintf("/shared-%d.txt", i)
+	}
+
+	nodeA.connect("alice")
+	nodeB.connect("bob")
+	nodeA.send(t, "alice", MessageTypeSubscribe, &SubscribeData{FilePath: path})
+	nodeB.send(t, "bob", MessageTypeSubscribe, &SubscribeData{FilePath: path})
+
+	var snapshot SnapshotData
+	nodeA.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+	if snapshot.SessionID != ClusterSessionID(path) {
+		t.Errorf("Expected session %s, got %s", ClusterSessionID(path), snapshot.SessionID)
+	}
+	if nodeA.handler.sessionManager.GetSessionByPath(path) != nil {
+		t.Error("Expected the session to be hosted by the owner only")
+	}
+
+	// Alice's edit goes through node-b and reaches Bob
+	nodeA.send(t, "alice", MessageTypeOperation, &OperationData{
+		SessionID: snapshot.SessionID,
+		Operation: []interface{}{"Hello"},
+	})
+
+	var ack AckData
+	nodeA.receive(t, "alice", MessageTypeAck, &ack)
+	if ack.Revision != 1 {
+		t.Errorf("Expected revision 1, got %d", ack.Revision)
+	}
+
+	var remote RemoteOperationData
+	nodeB.receive(t, "bob", MessageTypeRemoteOperation, &remote)
+	if remote.ClientID != "alice" {
+		t.Errorf("Expected operation from alice, got %s", remote.ClientID)
+	}
+
+	// Bob's edit reaches Alice on the other node
+	nodeB.send(t, "bob", MessageTypeOperation, &OperationData{
+		SessionID: snapshot.SessionID,
+		Revision:  1,
+		Operation: []interface{}{5, "!"},
+	})
+	nodeA.receive(t, "alice", MessageTypeRemoteOperation, &remote)
+	if remote.ClientID != "bob" {
+		t.Errorf("Expected operation from bob, got %s", remote.ClientID)
+	}
+
+	session := nodeB.handler.sessionManager.GetSession(snapshot.SessionID)
+	if session.GetContent() != "Hello!" {
+		t.Errorf("Expected content 'Hello!', got '%s'", session.GetContent())
+	}
+}
+
+// TestCluster_RoutingState tests that owners forget disconnected clients
+// and that forwarding nodes drop the routes of files that changed owner.
+func TestCluster_RoutingState(t *testing.T) {
+	ring := NewHashRing(0, "node-a", "node-b")
+	bus := NewMemoryBus()
+	nodeA := newClusterNode(t, "node-a", ring, bus)
+	nodeB := newClusterNode(t, "node-b", ring, bus)
+
+	// One file stays on node-b when node-c joins, the other moves to it
+	future := NewHashRing(0, "node-a", "node-b", "node-c")
+	stays, moves := "", ""
+	for i := 0; stays == "" || moves == ""; i++ {
+		path := fmt.Sprintf("/routed-%d.txt", i)
+		if ring.Owner(path) != "node-b" {
+			continue
+		}
+		if future.Owner(path) == "node-b" {
+			stays = path
+		} else if future.Owner(path) == "node-c" {
+			moves = path
+		}
+	}
+
+	nodeA.connect("alice")
+	var snapshot SnapshotData
+	for _, path := range []string{stays, moves} {
+		nodeA.send(t, "alice", MessageTypeSubscribe, &SubscribeData{FilePath: path})
+		nodeA.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+	}
+	routerA, routerB := nodeA.handler.cluster, nodeB.handler.cluster
+	if !routerB.IsRemoteClient("alice") {
+		t.Fatal("Expected the owner to know alice is on node-a")
+	}
+
+	ring.Add("node-c")
+	if owner := routerA.SessionOwner(ClusterSessionID(stays)); owner != "node-b" {
+		t.Errorf("Expected the route of %s to stay on node-b, got %q", stays, owner)
+	}
+	if owner := routerA.SessionOwner(ClusterSessionID(moves)); owner != "" {
+		t.Errorf("Expected the route of %s to be dropped, got %q", moves, owner)
+	}
+
+	nodeA.server.removeClient(nodeA.server.clients["alice"])
+	if routerB.IsRemoteClient("alice") {
+		t.Error("Expected the owner to forget alice after she disconnected")
+	}
+}
@@ -0,0 +1,390 @@
+package transport
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coreseekdev/texere/pkg/concordia"
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/rope"
+	"github.com/google/uuid"
+)
+
+// ========== Comment Threads ==========
+
+// Comment actions reported in CommentEventData and stored in history.
+const (
+	CommentActionCreated  = "created"
+	CommentActionReplied  = "replied"
+	CommentActionResolved = "resolved"
+	CommentActionReopened = "reopened"
+	CommentActionDeleted  = "deleted"
+	CommentActionOrphaned = "orphaned"
+)
+
+// Comment is a single message in a comment thread.
+type Comment struct {
+	CommentID string `json:"comment_id"`
+	Author    string `json:"author"`
+	Body      string `json:"body"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// CommentThread is a discussion anchored to a character range of a document.
+// The range is kept up to date as operations are applied to the session.
+type CommentThread struct {
+	ThreadID   string     `json:"thread_id"`
+	SessionID  string     `json:"session_id"`
+	Start      int        `json:"start"`
+	End        int        `json:"end"`
+	Quote      string     `json:"quote,omitempty"` // Anchored text when the thread was created
+	Resolved   bool       `json:"resolved"`
+	ResolvedBy string     `json:"resolved_by,omitempty"`
+	Orphaned   bool       `json:"orphaned"` // Anchored text was deleted entirely
+	Comments   []*Comment `json:"comments"`
+	CreatedBy  string     `json:"created_by"` // User ID, or client ID without authentication
+	CreatedAt  int64      `json:"created_at"`
+	UpdatedAt  int64      `json:"updated_at"`
+}
+
+// commentAuthor returns who a client comments as: the owner compared when
+// deleting threads and the name shown on its comments. Authenticated
+// clients comment as their user, so all connections of a user share its
+// threads; others comment as the client.
+func commentAuthor(client *SessionClient) (owner, name string) {
+	if client.UserID == "" {
+		return client.ClientID, client.ClientID
+	}
+	return client.UserID, client.Name
+}
+
+// clone returns a copy of the thread that is safe to hand out.
+func (t *CommentThread) clone() *CommentThread {
+	cp := *t
+	cp.Comments = make([]*Comment, len(t.Comments))
+	for i, c := range t.Comments {
+		cc := *c
+		cp.Comments[i] = &cc
+	}
+	return &cp
+}
+
+// CommentStore keeps the comment threads of an edit session.
+//
+// Thread anchors are stored as markers in a rope.MarkerTree and are
+// transformed through every applied operation. When the anchored text is
+// deleted entirely the thread is kept but marked as orphaned.
+type CommentStore struct {
+	mu        sync.RWMutex
+	sessionID string
+	markers   *rope.MarkerTree
+	threads   map[string]*CommentThread // threadID -> thread
+	anchors   map[string]rope.MarkerID  // threadID -> marker
+	byMarker  map[rope.MarkerID]string  // marker -> threadID
+}
+
+// NewCommentStore creates an empty comment store for a session.
+func NewCommentStore(sessionID string) *CommentStore {
+	return &CommentStore{
+		sessionID: sessionID,
+		markers:   rope.NewMarkerTree(),
+		threads:   make(map[string]*CommentThread),
+		anchors:   make(map[string]rope.MarkerID),
+		byMarker:  make(map[rope.MarkerID]string),
+	}
+}
+
+// Create starts a new thread anchored to [start, end) with an initial comment.
+// The thread belongs to owner, the ID compared on deletion; author is the
+// name shown on the comment. Text inserted at either edge of the range does
+// not extend the anchor.
+func (s *CommentStore) Create(start, end int, quote, owner, author, body string) *CommentThread {
+	if start > end {
+		start, end = end, start
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().Unix()
+	thread := &CommentThread{
+		ThreadID:  uuid.New().String(),
+		SessionID: s.sessionID,
+		Start:     start,
+		End:       end,
+		Quote:     quote,
+		Comments: []*Comment{{
+			CommentID: uuid.New().String(),
+			Author:    author,
+			Body:      body,
+			CreatedAt: now,
+		}},
+		CreatedBy: owner,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	marker := s.markers.Add(rope.MarkerComment, start, end, rope.AssocAfter, rope.AssocBefore, thread.ThreadID)
+	s.threads[thread.ThreadID] = thread
+	s.anchors[thread.ThreadID] = marker.ID
+	s.byMarker[marker.ID] = thread.ThreadID
+
+	return thread.clone()
+}
+
+// Restore adds threads read back from history to the store, anchored in
+// a document of length characters. Threads whose range no longer fits the
+// document are restored as orphaned.
+func (s *CommentStore) Restore(threads []*CommentThread, length int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range threads {
+		thread := t.clone()
+		thread.SessionID = s.sessionID
+		if thread.Start < 0 || thread.End < thread.Start || thread.End > length {
+			thread.Orphaned = true
+		}
+		s.threads[thread.ThreadID] = thread
+		if thread.Orphaned {
+			continue
+		}
+
+		marker := s.markers.Add(rope.MarkerComment, thread.Start, thread.End, rope.AssocAfter, rope.AssocBefore, thread.ThreadID)
+		s.anchors[thread.ThreadID] = marker.ID
+		s.byMarker[marker.ID] = thread.ThreadID
+	}
+}
+
+// Reply appends a comment to an existing thread.
+func (s *CommentStore) Reply(threadID, author, body string) (*CommentThread, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	thread, ok := s.threads[threadID]
+	if !ok {
+		return nil, ErrCommentNotFound
+	}
+
+	now := time.Now().Unix()
+	thread.Comments = append(thread.Comments, &Comment{
+		CommentID: uuid.New().String(),
+		Author:    author,
+		Body:      body,
+		CreatedAt: now,
+	})
+	thread.UpdatedAt = now
+
+	return s.snapshot(thread), nil
+}
+
+// Resolve marks a thread as resolved, or reopens it if resolved is false.
+func (s *CommentStore) Resolve(threadID string, resolved bool, by string) (*CommentThread, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	thread, ok := s.threads[threadID]
+	if !ok {
+		return nil, ErrCommentNotFound
+	}
+
+	thread.Resolved = resolved
+	thread.ResolvedBy = ""
+	if resolved {
+		thread.ResolvedBy = by
+	}
+	thread.UpdatedAt = time.Now().Unix()
+
+	return s.snapshot(thread), nil
+}
+
+// Delete removes a thread and its anchor.
+func (s *CommentStore) Delete(threadID string) (*CommentThread, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	thread, ok := s.threads[threadID]
+	if !ok {
+		return nil, ErrCommentNotFound
+	}
+
+	result := s.snapshot(thread)
+
+	if markerID, ok := s.anchors[threadID]; ok {
+		s.markers.Remove(markerID)
+		delete(s.byMarker, markerID)
+		delete(s.anchors, threadID)
+	}
+	delete(s.threads, threadID)
+
+	return result, nil
+}
+
+// Get returns a thread by ID.
+func (s *CommentStore) Get(threadID string) (*CommentThread, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	thread, ok := s.threads[threadID]
+	if !ok {
+		return nil, ErrCommentNotFound
+	}
+	return s.snapshot(thread), nil
+}
+
+// Threads returns all threads ordered by anchor position.
+// Orphaned threads are listed last.
+func (s *CommentStore) Threads() []*CommentThread {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	threads := make([]*CommentThread, 0, len(s.threads))
+	for _, thread := range s.threads {
+		threads = append(threads, s.snapshot(thread))
+	}
+
+	sort.SliceStable(threads, func(i, j int) bool {
+		if threads[i].Orphaned != threads[j].Orphaned {
+			return !threads[i].Orphaned
+		}
+		if threads[i].Start != threads[j].Start {
+			return threads[i].Start < threads[j].Start
+		}
+		return threads[i].CreatedAt < threads[j].CreatedAt
+	})
+	return threads
+}
+
+// Orphaned returns the threads whose anchored text has been deleted.
+func (s *CommentStore) Orphaned() []*CommentThread {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	threads := make([]*CommentThread, 0)
+	for _, thread := range s.threads {
+		if thread.Orphaned {
+			threads = append(threads, thread.clone())
+		}
+	}
+	return threads
+}
+
+// Len returns the number of threads, including orphaned ones.
+func (s *CommentStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.threads)
+}
+
+// ApplyOperation transforms all thread anchors through an applied operation.
+// Returns the threads that became orphaned by this operation.
+func (s *CommentStore) ApplyOperation(op *ot.Operation) []*CommentThread {
+	if op == nil || op.IsNoop() {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := s.markers.ApplyChangeSet(concordia.ChangeSetFromOperation(op))
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	now := time.Now().Unix()
+	orphaned := make([]*CommentThread, 0, len(deleted))
+	for _, m := range deleted {
+		threadID, ok := s.byMarker[m.ID]
+		if !ok {
+			continue
+		}
+		delete(s.byMarker, m.ID)
+		delete(s.anchors, threadID)
+
+		thread := s.threads[threadID]
+		thread.Start = m.Start
+		thread.End = m.End
+		thread.Orphaned = true
+		thread.UpdatedAt = now
+		orphaned = append(orphaned, thread.clone())
+	}
+	return orphaned
+}
+
+// snapshot copies a thread and fills in its current anchor position.
+// Must be called with s.mu held.
+func (s *CommentStore) snapshot(thread *CommentThread) *CommentThread {
+	cp := thread.clone()
+	if markerID, ok := s.anchors[thread.ThreadID]; ok {
+		if m := s.markers.Get(markerID); m != nil {
+			cp.Start = m.Start
+			cp.End = m.End
+		}
+	}
+	return cp
+}
+
+// ErrCommentNotFound is returned when a comment thread does not exist.
+var ErrCommentNotFound = &TransportError{Code: "comment_not_found", Message: "comment thread not found"}
+
+// ErrCommentNotAuthor is returned when a client deletes a thread it did
+// not start.
+var ErrCommentNotAuthor = &TransportError{Code: "forbidden", Message: "only the author can delete a comment thread"}
+
+// CommentThreadsFromEvents replays comment history events, oldest first,
+// and returns the latest state of each thread. Deleted threads are omitted.
+func CommentThreadsFromEvents(events []*HistoryEvent) []*CommentThread {
+	latest := make(map[string]*CommentThread)
+	order := make([]string, 0)
+
+	for _, event := range events {
+		if event == nil || event.Metadata == nil {
+			continue
+		}
+		thread := commentThreadFromMetadata(event.Metadata["thread"])
+		if thread == nil {
+			continue
+		}
+
+		if action, _ := event.Metadata["action"].(string); action == CommentActionDeleted {
+			delete(latest, thread.ThreadID)
+			continue
+		}
+		if _, ok := latest[thread.ThreadID]; !ok {
+			order = append(order, thread.ThreadID)
+		}
+		latest[thread.ThreadID] = thread
+	}
+
+	threads := make([]*CommentThread, 0, len(latest))
+	for _, threadID := range order {
+		if thread, ok := latest[threadID]; ok {
+			threads = append(threads, thread)
+			delete(latest, threadID) // a recreated ID is listed once
+		}
+	}
+	return threads
+}
+
+// commentThreadFromMetadata decodes a thread stored in event metadata.
+// Events read back from Redis carry a generic map instead of a *CommentThread.
+func commentThreadFromMetadata(value interface{}) *CommentThread {
+	switch v := value.(type) {
+	case *CommentThread:
+		return v.clone()
+	case nil:
+		return nil
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil
+		}
+		var thread CommentThread
+		if err := json.Unmarshal(data, &thread); err != nil || thread.ThreadID == "" {
+			return nil
+		}
+		return &thread
+	}
+}
@@ -0,0 +1,335 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/session"
+)
+
+// TestCommentStore_CreateReplyResolve tests the basic thread lifecycle.
+func TestCommentStore_CreateReplyResolve(t *testing.T) {
+	store := NewCommentStore("test-session")
+
+	thread := store.Create(6, 11, "World", "alice", "alice", "Typo?")
+	if thread.ThreadID == "" {
+		t.Fatal("Expected thread ID to be set")
+	}
+	if len(thread.Comments) != 1 || thread.Comments[0].Body != "Typo?" {
+		t.Errorf("Expected initial comment 'Typo?', got %+v", thread.Comments)
+	}
+
+	replied, err := store.Reply(thread.ThreadID, "bob", "Looks fine")
+	if err != nil {
+		t.Fatalf("Failed to reply: %v", err)
+	}
+	if len(replied.Comments) != 2 {
+		t.Errorf("Expected 2 comments, got %d", len(replied.Comments))
+	}
+
+	resolved, err := store.Resolve(thread.ThreadID, true, "alice")
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if !resolved.Resolved || resolved.ResolvedBy != "alice" {
+		t.Errorf("Expected thread resolved by alice, got %+v", resolved)
+	}
+
+	reopened, err := store.Resolve(thread.ThreadID, false, "bob")
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	if reopened.Resolved || reopened.ResolvedBy != "" {
+		t.Errorf("Expected thread reopened, got %+v", reopened)
+	}
+
+	if _, err := store.Reply("missing", "bob", "hi"); err != ErrCommentNotFound {
+		t.Errorf("Expected ErrCommentNotFound, got %v", err)
+	}
+
+	if _, err := store.Delete(thread.ThreadID); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if store.Len() != 0 {
+		t.Errorf("Expected 0 threads after delete, got %d", store.Len())
+	}
+}
+
+// TestCommentStore_AnchorsFollowEdits tests that anchors move with operations.
+func TestCommentStore_AnchorsFollowEdits(t *testing.T) {
+	store := NewCommentStore("test-session")
+	thread := store.Create(6, 11, "World", "alice", "alice", "Typo?")
+
+	// Insert "Big " before "World": "Hello Big World"
+	store.ApplyOperation(ot.NewBuilder().Retain(6).Insert("Big ").Retain(5).Build())
+
+	got, err := store.Get(thread.ThreadID)
+	if err != nil {
+		t.Fatalf("Failed to get thread: %v", err)
+	}
+	if got.Start != 10 || got.End != 15 {
+		t.Errorf("Expected anchor [10, 15), got [%d, %d)", got.Start, got.End)
+	}
+
+	// Text typed at the end of the range does not extend the anchor
+	store.ApplyOperation(ot.NewBuilder().Retain(15).Insert("!").Build())
+
+	got, _ = store.Get(thread.ThreadID)
+	if got.Start != 10 || got.End != 15 {
+		t.Errorf("Expected anchor [10, 15), got [%d, %d)", got.Start, got.End)
+	}
+}
+
+// TestCommentStore_Orphaned tests that deleting the anchored text orphans a thread.
+func TestCommentStore_Orphaned(t *testing.T) {
+	store := NewCommentStore("test-session")
+	hello := store.Create(0, 5, "Hello", "alice", "alice", "Greeting")
+	world := store.Create(6, 11, "World", "bob", "bob", "Planet")
+
+	// Delete "World"
+	orphaned := store.ApplyOperation(ot.NewBuilder().Retain(6).Delete(5).Build())
+	if len(orphaned) != 1 || orphaned[0].ThreadID != world.ThreadID {
+		t.Fatalf("Expected world thread to be orphaned, got %+v", orphaned)
+	}
+
+	// Further edits do not orphan it again
+	orphaned = store.ApplyOperation(ot.NewBuilder().Insert(">").Retain(6).Build())
+	if len(orphaned) != 0 {
+		t.Errorf("Expected no newly orphaned threads, got %d", len(orphaned))
+	}
+
+	threads := store.Threads()
+	if len(threads) != 2 {
+		t.Fatalf("Expected 2 threads, got %d", len(threads))
+	}
+	if threads[0].ThreadID != hello.ThreadID || threads[0].Start != 1 {
+		t.Errorf("Expected hello thread first at 1, got %+v", threads[0])
+	}
+	if !threads[1].Orphaned {
+		t.Error("Expected orphaned thread to be listed last")
+	}
+	if len(store.Orphaned()) != 1 {
+		t.Errorf("Expected 1 orphaned thread, got %d", len(store.Orphaned()))
+	}
+}
+
+// TestCommentThreadsFromEvents tests replaying stored comment events.
+func TestCommentThreadsFromEvents(t *testing.T) {
+	store := NewCommentStore("test-session")
+	a := store.Create(0, 5, "Hello", "alice", "alice", "first")
+	b := store.Create(6, 11, "World", "bob", "bob", "second")
+	a2, _ := store.Reply(a.ThreadID, "bob", "reply")
+	bDeleted, _ := store.Delete(b.ThreadID)
+
+	// Events read back from Redis carry generic maps
+	raw, _ := json.Marshal(a2)
+	var generic map[string]interface{}
+	json.Unmarshal(raw, &generic)
+
+	events := []*HistoryEvent{
+		{EventType: "comment", Metadata: map[string]interface{}{"action": CommentActionCreated, "thread": a}},
+		{EventType: "comment", Metadata: map[string]interface{}{"action": CommentActionCreated, "thread": b}},
+		{EventType: "comment", Metadata: map[string]interface{}{"action": CommentActionReplied, "thread": generic}},
+		{EventType: "comment", Metadata: map[string]interface{}{"action": CommentActionDeleted, "thread": bDeleted}},
+	}
+
+	threads := CommentThreadsFromEvents(events)
+	if len(threads) != 1 {
+		t.Fatalf("Expected 1 thread, got %d", len(threads))
+	}
+	if threads[0].ThreadID != a.ThreadID || len(threads[0].Comments) != 2 {
+		t.Errorf("Expected latest state of thread a, got %+v", threads[0])
+	}
+}
+
+// TestEditSession_RecordCommentEvent tests that comment events reach the history service.
+func TestEditSession_RecordCommentEvent(t *testing.T) {
+	history := NewMemoryHistoryService(false)
+	defer history.Close()
+
+	es := NewEditSession("test-session", "/test.txt", "Hello World")
+	es.SetHistoryListener(history)
+
+	thread := es.Comments().Create(0, 5, "Hello", "alice", "alice", "Greeting")
+	es.RecordCommentEvent(CommentActionCreated, thread, "alice")
+
+	var threads []*CommentThread
+	for i := 0; i < 50; i++ {
+		threads, _ = history.GetComments(context.Background(), "test-session")
+		if len(threads) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(threads) != 1 || threads[0].ThreadID != thread.ThreadID {
+		t.Errorf("Expected stored thread %s, got %+v", thread.ThreadID, threads)
+	}
+}
+
+// TestProtocolHandler_CommentPermissions tests who may create, resolve and
+// delete comment threads.
+func TestProtocolHandler_CommentPermissions(t *testing.T) {
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	node := &clusterNode{handler: handler, server: server}
+	for _, id := range []string{"alice", "bob", "carol", "mallory"} {
+		node.connect(id)
+	}
+
+	var snapshot SnapshotData
+	node.send(t, "alice", MessageTypeSubscribe, &SubscribeData{FilePath: "/comments.txt"})
+	node.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+	node.send(t, "carol", MessageTypeSubscribe, &SubscribeData{FilePath: "/comments.txt"})
+	node.receive(t, "carol", MessageTypeSnapshot, &snapshot)
+	node.send(t, "bob", MessageTypeSubscribe, &SubscribeData{FilePath: "/comments.txt", ReadOnly: true})
+	node.receive(t, "bob", MessageTypeSnapshot, &snapshot)
+	sessionID := snapshot.SessionID
+	node.send(t, "alice", MessageTypeOperation, &OperationData{SessionID: sessionID, Operation: []interface{}{"Hello"}})
+
+	expectError := func(clientID, code string) {
+		t.Helper()
+		var errorData ErrorData
+		node.receive(t, clientID, MessageTypeError, &errorData)
+		if errorData.Code != code {
+			t.Errorf("Expected %s for %s, got %+v", code, clientID, errorData)
+		}
+	}
+
+	node.send(t, "mallory", MessageTypeCommentCreate, &CommentCreateData{SessionID: sessionID, Start: 0, End: 5, Body: "spam"})
+	expectError("mallory", "not_subscribed")
+	node.send(t, "alice", MessageTypeCommentCreate, &CommentCreateData{SessionID: sessionID, Start: 0, End: 9, Body: "too long"})
+	expectError("alice", "invalid_comment_data")
+
+	var event CommentEventData
+	node.send(t, "alice", MessageTypeCommentCreate, &CommentCreateData{SessionID: sessionID, Start: 0, End: 5, Body: "Greeting"})
+	node.receive(t, "alice", MessageTypeCommentEvent, &event)
+	threadID := event.Thread.ThreadID
+	if event.Thread.Quote != "Hello" {
+		t.Errorf("Expected the quote Hello, got %q", event.Thread.Quote)
+	}
+
+	// Read-only clients can reply, but not change the thread
+	node.send(t, "bob", MessageTypeCommentReply, &CommentReplyData{SessionID: sessionID, ThreadID: threadID, Body: "Hi"})
+	node.receive(t, "bob", MessageTypeCommentEvent, &event)
+	node.send(t, "bob", MessageTypeCommentResolve, &CommentResolveData{SessionID: sessionID, ThreadID: threadID, Resolved: true})
+	expectError("bob", "read_only")
+	node.send(t, "bob", MessageTypeCommentDelete, &CommentDeleteData{SessionID: sessionID, ThreadID: threadID})
+	expectError("bob", "read_only")
+
+	node.send(t, "carol", MessageTypeCommentDelete, &CommentDeleteData{SessionID: sessionID, ThreadID: threadID})
+	expectError("carol", "forbidden")
+	node.send(t, "alice", MessageTypeCommentDelete, &CommentDeleteData{SessionID: sessionID, ThreadID: threadID})
+	for event.Action != CommentActionDeleted {
+		node.receive(t, "alice", MessageTypeCommentEvent, &event)
+	}
+	if handler.sessionManager.GetSession(sessionID).Comments().Len() != 0 {
+		t.Error("Expected the thread to be deleted")
+	}
+}
+
+// TestProtocolHandler_CommentOwnership tests that threads of authenticated
+// clients belong to their user and show the user's name.
+func TestProtocolHandler_CommentOwnership(t *testing.T) {
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	node := &clusterNode{handler: handler, server: server}
+	users := map[string]*session.UserInfo{
+		"laptop": {UserID: "alice", Name: "Alice"},
+		"phone":  {UserID: "alice", Name: "Alice"},
+		"desk":   {UserID: "bob", Name: "Bob"},
+	}
+	var snapshot SnapshotData
+	for _, id := range []string{"laptop", "phone", "desk"} {
+		node.connect(id)
+		server.clients[id].user = users[id]
+		node.send(t, id, MessageTypeSubscribe, &SubscribeData{FilePath: "/owned.txt"})
+		node.receive(t, id, MessageTypeSnapshot, &snapshot)
+	}
+	sessionID := snapshot.SessionID
+	node.send(t, "laptop", MessageTypeOperation, &OperationData{SessionID: sessionID, Operation: []interface{}{"Hello"}})
+
+	var event CommentEventData
+	node.send(t, "laptop", MessageTypeCommentCreate, &CommentCreateData{SessionID: sessionID, Start: 0, End: 5, Body: "Greeting"})
+	node.receive(t, "laptop", MessageTypeCommentEvent, &event)
+	thread := event.Thread
+	if thread.CreatedBy != "alice" || thread.Comments[0].Author != "Alice" {
+		t.Errorf("Expected a thread by alice shown as Alice, got %s and %s", thread.CreatedBy, thread.Comments[0].Author)
+	}
+
+	var errorData ErrorData
+	node.send(t, "desk", MessageTypeCommentDelete, &CommentDeleteData{SessionID: sessionID, ThreadID: thread.ThreadID})
+	node.receive(t, "desk", MessageTypeError, &errorData)
+	if errorData.Code != "forbidden" {
+		t.Errorf("Expected forbidden for bob, got %+v", errorData)
+	}
+
+	// Another connection of alice can delete it
+	node.send(t, "phone", MessageTypeCommentDelete, &CommentDeleteData{SessionID: sessionID, ThreadID: thread.ThreadID})
+	for event.Action != CommentActionDeleted {
+		node.receive(t, "phone", MessageTypeCommentEvent, &event)
+	}
+}
+
+// TestSessionManager_RestoresComments tests that new sessions load the
+// threads stored for their file, and that comment events are stored in
+// the order they were made.
+func TestSessionManager_RestoresComments(t *testing.T) {
+	history := NewMemoryHistoryService(false)
+	defer history.Close()
+
+	storage := session.NewMemoryContentStorage()
+	storage.Save(context.Background(), "/restore.txt", &session.ContentModel{Name: "restore.txt", Type: "file", Content: "Hello World"}, nil)
+	sm := NewSessionManagerWithHistory(history)
+	sm.SetSessionIDFunc(ClusterSessionID)
+	sm.SetContentStorage(storage)
+	es, _ := sm.GetOrCreateSession("/restore.txt")
+
+	thread, _ := es.CreateComment(6, 11, "alice", "alice", "Planet")
+	es.RecordCommentEvent(CommentActionCreated, thread, "alice")
+	for i := 0; i < 20; i++ {
+		thread, _ = es.Comments().Reply(thread.ThreadID, "bob", "Reply")
+		es.RecordCommentEvent(CommentActionReplied, thread, "bob")
+	}
+
+	var stored []*CommentThread
+	for i := 0; i < 50; i++ {
+		stored, _ = history.GetComments(context.Background(), es.SessionID)
+		if len(stored) == 1 && len(stored[0].Comments) == 21 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(stored) != 1 || len(stored[0].Comments) != 21 {
+		t.Fatalf("Expected the last reply to be stored last, got %+v", stored)
+	}
+
+	restarted := NewSessionManagerWithHistory(history)
+	restarted.SetSessionIDFunc(ClusterSessionID)
+	restarted.SetContentStorage(storage)
+	es, _ = restarted.GetOrCreateSession("/restore.txt")
+	threads := es.Comments().Threads()
+	if len(threads) != 1 || threads[0].ThreadID != thread.ThreadID || threads[0].Orphaned {
+		t.Fatalf("Expected the stored thread, got %+v", threads)
+	}
+
+	// Restored anchors follow edits
+	if orphaned := es.CommitContent("World", ot.NewBuilder().Delete(6).Retain(5).Build()); len(orphaned) != 0 {
+		t.Errorf("Expected no orphaned threads, got %+v", orphaned)
+	}
+	if got, _ := es.Comments().Get(thread.ThreadID); got.Start != 0 || got.End != 5 {
+		t.Errorf("Expected the anchor to move to [0, 5), got [%d, %d)", got.Start, got.End)
+	}
+
+	// Anchors that don't fit the document are orphaned
+	empty := NewEditSession("empty", "/empty.txt", "")
+	empty.Comments().Restore(threads, 0)
+	if got, _ := empty.Comments().Get(thread.ThreadID); !got.Orphaned {
+		t.Errorf("Expected the thread to be orphaned in an empty document, got %+v", got)
+	}
+}
@@ -0,0 +1,140 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// ========== Wire Envelope ==========
+
+// Wire formats of protocol messages, negotiated with the "protocol" query
+// parameter of the WebSocket URL and confirmed in the welcome message.
+const (
+	// ProtocolVersion1 wraps each ProtocolMessage in a transport Message:
+	//
+	//	{"type": "operation", "client_id": "c1", "timestamp": 1706745600,
+	//	 "metadata": {"protocol_message": {"type": "operation", "data": {...}}}}
+	ProtocolVersion1 = 1
+
+	// ProtocolVersion2 sends the ProtocolMessage itself:
+	//
+	//	{"type": "operation", "timestamp": 1706745600, "data": {...}}
+	ProtocolVersion2 = 2
+
+	// ProtocolVersionLatest is the newest version the server speaks.
+	ProtocolVersionLatest = ProtocolVersion2
+)
+
+// negotiateVersion returns the version to speak with a client that asked
+// for requested. Clients that don't ask get ProtocolVersion1.
+func negotiateVersion(requested string) int {
+	version, err := strconv.Atoi(requested)
+	if err != nil || version < ProtocolVersion1 {
+		return ProtocolVersion1
+	}
+	if version > ProtocolVersionLatest {
+		return ProtocolVersionLatest
+	}
+	return version
+}
+
+// encodeEnvelope encodes a protocol message to a client in the
+// ProtocolVersion1 format. Connections convert it to the version they
+// negotiated when writing it.
+func encodeEnvelope(clientID string, pm *ProtocolMessage) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"type":      string(pm.Type),
+		"client_id": clientID,
+		"timestamp": pm.Timestamp,
+		"metadata": map[string]interface{}{
+			"protocol_message": pm,
+		},
+	})
+}
+
+// flattenEnvelope converts a ProtocolVersion1 message to ProtocolVersion2.
+// Messages that are not wrapped protocol messages are returned unchanged.
+func flattenEnvelope(data []byte) []byte {
+	var v1 struct {
+		Metadata struct {
+			ProtocolMessage json.RawMessage `json:"protocol_message"`
+		} `json:"metadata"`
+	}
+	if json.Unmarshal(data, &v1) != nil || len(v1.Metadata.ProtocolMessage) == 0 {
+		return data
+	}
+	return v1.Metadata.ProtocolMessage
+}
+
+// envelope is a protocol message decoded from either version.
+type envelope struct {
+	ClientID  string // Set by ProtocolVersion1 messages
+	DocID     string
+	Timestamp int64
+	Metadata  map[string]interface{}
+	Protocol  *ProtocolMessage
+}
+
+// parseEnvelope decodes a message in either version. Servers accept both
+// whatever the connection negotiated, so clients can switch after the
+// welcome message.
+func parseEnvelope(data []byte) (*envelope, error) {
+	// The type of the wrapper is ignored; transport Messages encode it as
+	// a number
+	var v1 struct {
+		ClientID  string                 `json:"client_id"`
+		DocID     string                 `json:"doc_id,omitempty"`
+		Timestamp int64                  `json:"timestamp"`
+		Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	}
+	if err := json.Unmarshal(data, &v1); err != nil {
+		return nil, fmt.Errorf("failed to parse message: %w", err)
+	}
+
+	wrapped, ok := v1.Metadata["protocol_message"]
+	if !ok {
+		// ProtocolVersion2
+		var pm ProtocolMessage
+		if err := json.Unmarshal(data, &pm); err != nil {
+			return nil, fmt.Errorf("failed to parse protocol message: %w", err)
+		}
+		if pm.Type == "" {
+			return nil, fmt.Errorf("no protocol message type")
+		}
+		return &envelope{Timestamp: pm.Timestamp, Metadata: pm.Metadata, Protocol: &pm}, nil
+	}
+
+	pm, err := decodeProtocolMessage(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return &envelope{
+		ClientID:  v1.ClientID,
+		DocID:     v1.DocID,
+		Timestamp: v1.Timestamp,
+		Metadata:  v1.Metadata,
+		Protocol:  pm,
+	}, nil
+}
+
+// decodeProtocolMessage decodes a protocol message held in Message
+// metadata, whether it was decoded from JSON or set in memory.
+func decodeProtocolMessage(value interface{}) (*ProtocolMessage, error) {
+	switch v := value.(type) {
+	case *ProtocolMessage:
+		return v, nil
+	case string:
+		value = json.RawMessage(v)
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal protocol message: %w", err)
+	}
+	var pm ProtocolMessage
+	if err := json.Unmarshal(data, &pm); err != nil {
+		return nil, fmt.Errorf("failed to parse protocol message: %w", err)
+	}
+	return &pm, nil
+}
@@ -0,0 +1,123 @@
+package transport
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// protocolServer starts a protocol handler behind a WebSocket server.
+func protocolServer(t *testing.T) (*ProtocolHandler, string) {
+	t.Helper()
+	handler := NewProtocolHandler(nil, nil)
+	t.Cleanup(handler.Close)
+	server, url := authServer(t, nil)
+	handler.SetServer(server)
+	return handler, url
+}
+
+// TestWebSocketServer_Welcome tests negotiating the envelope version and compression.
+func TestWebSocketServer_Welcome(t *testing.T) {
+	_, url := protocolServer(t)
+	dialer := websocket.Dialer{EnableCompression: true}
+
+	conn, resp, err := dialer.Dial(url+"?client_id=c2&protocol=2", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	if !strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		t.Errorf("Expected permessage-deflate to be negotiated, got %q", resp.Header.Get("Sec-Websocket-Extensions"))
+	}
+
+	// ProtocolVersion2 messages are protocol messages
+	var welcome ProtocolMessage
+	if err := conn.ReadJSON(&welcome); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	var data WelcomeData
+	json.Unmarshal(welcome.Data, &data)
+	if welcome.Type != MessageTypeWelcome || data.ProtocolVersion != ProtocolVersion2 || data.ClientID != "c2" {
+		t.Fatalf("Expected a version 2 welcome for c2, got %s %+v", welcome.Type, data)
+	}
+
+	pm, _ := NewProtocolMessage(MessageTypeSubscribe, "", &SubscribeData{FilePath: "/flat.txt"})
+	if err := conn.WriteJSON(pm); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	var snapshot ProtocolMessage
+	if err := conn.ReadJSON(&snapshot); err != nil || snapshot.Type != MessageTypeSnapshot {
+		t.Errorf("Expected a flat snapshot, got %s (%v)", snapshot.Type, err)
+	}
+
+	// Clients that don't ask keep the wrapped envelope
+	conn, _, err = dialer.Dial(url+"?client_id=c1", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	_, raw, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	received, err := parseEnvelope(raw)
+	if err != nil || received.ClientID != "c1" {
+		t.Fatalf("Expected a version 1 envelope for c1, got %s (%v)", raw, err)
+	}
+	json.Unmarshal(received.Protocol.Data, &data)
+	if data.ProtocolVersion != ProtocolVersion1 {
+		t.Errorf("Expected protocol version 1, got %d", data.ProtocolVersion)
+	}
+}
+
+// TestProtocolHandler_CatchUp tests resubscribing with one composed operation instead of the content.
+func TestProtocolHandler_CatchUp(t *testing.T) {
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	node := &clusterNode{handler: handler, server: server}
+	for _, clientID := range []string{"alice", "bob", "carol", "dave"} {
+		node.connect(clientID)
+	}
+
+	node.send(t, "alice", MessageTypeSubscribe, &SubscribeData{FilePath: "/catch-up.txt"})
+	var snapshot SnapshotData
+	node.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+	for i, op := range [][]interface{}{{"Hello"}, {5, " world"}, {11, "!"}} {
+		node.send(t, "alice", MessageTypeOperation, &OperationData{
+			SessionID: snapshot.SessionID,
+			Revision:  int64(i),
+			Operation: op,
+		})
+	}
+
+	node.send(t, "bob", MessageTypeSubscribe, &SubscribeData{FilePath: "/catch-up.txt", Revision: 1})
+	var catchUp SnapshotData
+	node.receive(t, "bob", MessageTypeSnapshot, &catchUp)
+	expected := []interface{}{float64(5), " world!"}
+	if !reflect.DeepEqual(catchUp.CatchUp, expected) || catchUp.BaseRevision != 1 || catchUp.Revision != 3 {
+		t.Errorf("Expected %v from revision 1 to 3, got %v from %d to %d",
+			expected, catchUp.CatchUp, catchUp.BaseRevision, catchUp.Revision)
+	}
+	if catchUp.Content != "" || catchUp.Operations != nil {
+		t.Errorf("Expected no content or operations with a catch-up, got %q and %v", catchUp.Content, catchUp.Operations)
+	}
+
+	// Up to date clients get an empty operation
+	node.send(t, "carol", MessageTypeSubscribe, &SubscribeData{FilePath: "/catch-up.txt", Revision: 3})
+	node.receive(t, "carol", MessageTypeSnapshot, &catchUp)
+	if !reflect.DeepEqual(catchUp.CatchUp, []interface{}{}) {
+		t.Errorf("Expected an empty catch-up, got %v", catchUp.CatchUp)
+	}
+
+	// Unknown revisions get the content
+	node.send(t, "dave", MessageTypeSubscribe, &SubscribeData{FilePath: "/catch-up.txt", Revision: 7})
+	var full SnapshotData
+	node.receive(t, "dave", MessageTypeSnapshot, &full)
+	if full.CatchUp != nil || full.Content != "Hello world!" {
+		t.Errorf("Expected the full content, got %q and catch-up %v", full.Content, full.CatchUp)
+	}
+}
@@ -2,22 +2,35 @@ package transport
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"sync"
+	"time"
 	"unicode/utf8"
 
-	"github.com/coreseekdev/texere/pkg/session"
+	"github.com/coreseekdev/texere/pkg/concordia"
+	"github.com/coreseekdev/texere/pkg/crdt"
+	"github.com/coreseekdev/texere/pkg/metrics"
 	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/ot/json0"
+	"github.com/coreseekdev/texere/pkg/rope"
+	"github.com/coreseekdev/texere/pkg/session"
 )
 
 // ProtocolHandler handles WebSocket protocol messages.
 type ProtocolHandler struct {
-	mu               sync.RWMutex
-	sessionManager   *SessionManager
-	contentStorage   session.ContentStorage
-	authenticator    session.Authenticator
-	server           *WebSocketServer
+	mu             sync.RWMutex
+	sessionManager *SessionManager
+	contentStorage session.ContentStorage
+	authenticator  session.Authenticator
+	server         *WebSocketServer
+	cluster        *ClusterRouter
+	registry       *MessageRegistry
+	meter          metrics.Recorder
+	edits          *rope.EditMetrics
+	logger         *slog.Logger
+	limiter        *rateLimiter // nil without rate limits
 }
 
 // NewProtocolHandler creates a new protocol handler.
@@ -25,128 +38,261 @@ func NewProtocolHandler(storage session.ContentStorage, auth session.Authenticat
 	sm := NewSessionManager()
 	sm.SetContentStorage(storage)
 
-	return &ProtocolHandler{
+	h := &ProtocolHandler{
 		sessionManager: sm,
 		contentStorage: storage,
 		authenticator:  auth,
+		registry:       NewMessageRegistry(),
+		edits:          &rope.EditMetrics{},
+		logger:         componentLogger(nil, "handler"),
+	}
+	h.registry.Use(RecoverMiddleware(), h.limitMessages)
+	h.registerBuiltins()
+	return h
+}
+
+// registerBuiltins registers the handlers of the collaboration protocol.
+func (h *ProtocolHandler) registerBuiltins() {
+	builtins := map[MessageType]func(*Message, *ProtocolMessage){
+		MessageTypeSubscribe:      h.handleSubscribe,
+		MessageTypeUnsubscribe:    h.handleUnsubscribe,
+		MessageTypeStartEditing:   h.handleStartEditing,
+		MessageTypeStopEditing:    h.handleStopEditing,
+		MessageTypeOperation:      h.handleOperation,
+		MessageTypeCursor:         h.handleCursor,
+		MessageTypeHeartbeat:      h.handleHeartbeat,
+		MessageTypeCommentCreate:  h.handleCommentCreate,
+		MessageTypeCommentReply:   h.handleCommentReply,
+		MessageTypeCommentResolve: h.handleCommentResolve,
+		MessageTypeCommentDelete:  h.handleCommentDelete,
+		MessageTypeCellOperation:  h.handleCellOperation,
+		MessageTypeMerge:          h.handleMerge,
+		MessageTypeCRDTSync:       h.handleCRDTSync,
+		MessageTypeCRDTUpdate:     h.handleCRDTUpdate,
+	}
+	for msgType, handle := range builtins {
+		handle := handle
+		h.registry.Register(msgType, func(c *MessageContext) error {
+			handle(c.Message, c.Protocol)
+			return nil
+		})
 	}
+	h.registry.Register(MessageTypeHello, HandleTyped(h.handleHello))
 }
 
-// SetServer sets the WebSocket server.
+// SetLogger sets the logger of the handler and its sessions. It defaults
+// to slog.Default().
+func (h *ProtocolHandler) SetLogger(logger *slog.Logger) {
+	h.mu.Lock()
+	h.logger = componentLogger(logger, "handler")
+	h.mu.Unlock()
+	h.sessionManager.SetLogger(logger)
+}
+
+// log returns the logger of the handler.
+func (h *ProtocolHandler) log() *slog.Logger {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.logger == nil {
+		return componentLogger(nil, "handler")
+	}
+	return h.logger
+}
+
+// Registry returns the message registry. Applications register handlers
+// for their own message types and add middleware to it.
+//
+// Example:
+//
+//	registry := handler.Registry()
+//	registry.Use(authMiddleware, metricsMiddleware)
+//	registry.Register("chat", HandleTyped(func(c *MessageContext, data *ChatData) error {
+//	    return c.Reply("chat_ack", &ChatAck{ID: data.ID})
+//	}))
+func (h *ProtocolHandler) Registry() *MessageRegistry {
+	return h.registry
+}
+
+// SetServer sets the WebSocket server. If the handler has an
+// authenticator, connections must authenticate during the upgrade.
 func (h *ProtocolHandler) SetServer(server *WebSocketServer) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	h.server = server
 
+	if h.authenticator != nil {
+		server.SetAuthenticator(h.authenticator)
+	}
+	server.SetSnapshotFunc(h.resyncSnapshots)
+	if h.limiter != nil {
+		server.SetReadLimit(h.limiter.config.MaxMessageBytes)
+	}
+
 	// Set raw message handler (for new protocol)
 	server.SetRawMessageHandler(h.handleRawMessage)
+	server.SetDisconnectHandler(h.handleDisconnect)
+	server.SetClientHeldFunc(h.sessionManager.HoldsClient)
+}
+
+// SetCluster enables cluster mode: sessions get IDs derived from their
+// file path, messages for files owned by other nodes are forwarded to
+// them, and messages forwarded by other nodes are handled here.
+//
+// Example:
+//
+//	ring := NewHashRing(0, "node-a", "node-b")
+//	router := NewClusterRouter("node-a", ring, NewRedisBus(redisClient))
+//	if err := handler.SetCluster(router); err != nil {
+//	    log.Fatal(err)
+//	}
+func (h *ProtocolHandler) SetCluster(router *ClusterRouter) error {
+	h.mu.Lock()
+	h.cluster = router
+	h.mu.Unlock()
+
+	h.sessionManager.SetSessionIDFunc(ClusterSessionID)
+	return router.Start(h.handleForwardedMessage, h.deliverLocal)
+}
+
+// handleDisconnect drops the cluster routing state of a client whose
+// connection closed. Its sessions keep it until the heartbeat timeout.
+func (h *ProtocolHandler) handleDisconnect(clientID string) {
+	h.mu.RLock()
+	cluster := h.cluster
+	h.mu.RUnlock()
+	if cluster == nil {
+		return
+	}
+	if err := cluster.ClientDisconnected(clientID); err != nil {
+		h.log().Warn("failed to tell the cluster about a disconnect", LogKeyClient, clientID, LogKeyError, err)
+	}
 }
 
 // handleRawMessage handles incoming raw WebSocket messages (new protocol).
 func (h *ProtocolHandler) handleRawMessage(clientID string, messageBytes []byte) {
-	// Parse client message format
-	var clientMsg struct {
-		Type      string                 `json:"type"`
-		ClientID  string                 `json:"client_id"`
-		DocID     string                 `json:"doc_id,omitempty"`
-		Timestamp int64                  `json:"timestamp"`
-		Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	msg, protocolMsg := h.parseRawMessage(clientID, messageBytes)
+	if msg == nil {
+		return
 	}
-
-	if err := json.Unmarshal(messageBytes, &clientMsg); err != nil {
-		log.Printf("[Handler] Failed to parse client message: %v", err)
+	if h.forwardToOwner(clientID, messageBytes, protocolMsg) {
 		return
 	}
+	h.dispatch(msg, protocolMsg)
+}
 
-	// Extract protocol message from metadata
-	protocolMsgBytes, ok := clientMsg.Metadata["protocol_message"]
-	if !ok {
-		log.Printf("[Handler] No protocol_message in metadata")
+// handleForwardedMessage handles a client message forwarded by another
+// cluster node. This node owns the message's file.
+func (h *ProtocolHandler) handleForwardedMessage(clientID string, messageBytes []byte) {
+	msg, protocolMsg := h.parseRawMessage(clientID, messageBytes)
+	if msg == nil {
 		return
 	}
+	h.dispatch(msg, protocolMsg)
+}
 
-	protocolMsgJSON, err := json.Marshal(protocolMsgBytes)
+// parseRawMessage parses a raw client message in either envelope version.
+// Returns nil if the message is invalid.
+func (h *ProtocolHandler) parseRawMessage(clientID string, messageBytes []byte) (*Message, *ProtocolMessage) {
+	clientMsg, err := parseEnvelope(messageBytes)
 	if err != nil {
-		log.Printf("[Handler] Failed to marshal protocol message: %v", err)
-		return
+		h.log().Warn("invalid message", LogKeyClient, clientID, LogKeyError, err)
+		return nil, nil
 	}
-
-	var protocolMsg ProtocolMessage
-	if err := json.Unmarshal(protocolMsgJSON, &protocolMsg); err != nil {
-		log.Printf("[Handler] Failed to parse protocol message: %v", err)
-		return
+	protocolMsg := clientMsg.Protocol
+	if protocolMsg.TraceID == "" {
+		protocolMsg.TraceID = newTraceID()
 	}
 
-	log.Printf("[Handler] %s: Received %s", clientID, protocolMsg.Type)
+	h.log().Debug("received message", LogKeyClient, clientID, LogKeyType, protocolMsg.Type,
+		LogKeySession, protocolMsg.SessionID, LogKeyTrace, protocolMsg.TraceID)
+
+	// The connection determines who sent the message, not its body
+	if clientMsg.ClientID != "" && clientMsg.ClientID != clientID {
+		h.log().Warn("rejected message from another client ID", LogKeyClient, clientID, "claimed_client_id", clientMsg.ClientID,
+			LogKeyTrace, protocolMsg.TraceID)
+		h.replyError(&Message{ClientID: clientID, RequestID: protocolMsg.RequestID, TraceID: protocolMsg.TraceID}, protocolMsg.SessionID,
+			"client_id_mismatch", "client_id does not match the connection")
+		return nil, nil
+	}
 
 	// Create a simple Message wrapper for compatibility
 	msg := &Message{
 		Type:      0, // Not used in new protocol
 		DocID:     clientMsg.DocID,
-		ClientID:  clientMsg.ClientID,
+		ClientID:  clientID,
 		Timestamp: clientMsg.Timestamp,
+		RequestID: protocolMsg.RequestID,
+		TraceID:   protocolMsg.TraceID,
 		Metadata:  clientMsg.Metadata,
 	}
 
-	// Handle based on protocol message type
-	switch protocolMsg.Type {
-	case MessageTypeSubscribe:
-		h.handleSubscribe(msg, &protocolMsg)
-	case MessageTypeUnsubscribe:
-		h.handleUnsubscribe(msg, &protocolMsg)
-	case MessageTypeStartEditing:
-		h.handleStartEditing(msg, &protocolMsg)
-	case MessageTypeStopEditing:
-		h.handleStopEditing(msg, &protocolMsg)
-	case MessageTypeOperation:
-		h.handleOperation(msg, &protocolMsg)
-	case MessageTypeCursor:
-		h.handleCursor(msg, &protocolMsg)
-	case MessageTypeHeartbeat:
-		h.handleHeartbeat(msg, &protocolMsg)
-	default:
-		log.Printf("[Handler] Unknown message type: %s", protocolMsg.Type)
+	return msg, protocolMsg
+}
+
+// dispatch handles a protocol message with its registered handler.
+// Handler errors are sent to the client.
+func (h *ProtocolHandler) dispatch(msg *Message, protocolMsg *ProtocolMessage) {
+	if protocolMsg.TraceID == "" {
+		protocolMsg.TraceID = newTraceID()
+	}
+	msg.TraceID = protocolMsg.TraceID
+
+	c := &MessageContext{Handler: h, Message: msg, Protocol: protocolMsg}
+	if err := h.registry.Dispatch(c); err != nil {
+		var limitErr *LimitError
+		if errors.As(err, &limitErr) {
+			h.rejectLimit(msg, limitErr)
+			return
+		}
+		c.Logger().Warn("message failed", LogKeySession, protocolMsg.SessionID, LogKeyError, err)
+		h.replyError(msg, protocolMsg.SessionID, errorCode(err), err.Error())
 	}
 }
 
 // handleMessage handles incoming WebSocket messages (legacy).
 func (h *ProtocolHandler) handleMessage(msg *Message) {
-	var protocolMsg ProtocolMessage
-	if err := json.Unmarshal([]byte(fmt.Sprintf("%v", msg.Metadata)), &protocolMsg); err != nil {
-		log.Printf("Failed to parse protocol message: %v", err)
-		return
-	}
-
-	switch protocolMsg.Type {
-	case MessageTypeSubscribe:
-		h.handleSubscribe(msg, &protocolMsg)
-	case MessageTypeUnsubscribe:
-		h.handleUnsubscribe(msg, &protocolMsg)
-	case MessageTypeStartEditing:
-		h.handleStartEditing(msg, &protocolMsg)
-	case MessageTypeStopEditing:
-		h.handleStopEditing(msg, &protocolMsg)
-	case MessageTypeOperation:
-		h.handleOperation(msg, &protocolMsg)
-	case MessageTypeCursor:
-		h.handleCursor(msg, &protocolMsg)
-	case MessageTypeHeartbeat:
-		h.handleHeartbeat(msg, &protocolMsg)
-	default:
-		log.Printf("Unknown message type: %s", protocolMsg.Type)
+	protocolMsg, err := decodeProtocolMessage(msg.Metadata["protocol_message"])
+	if err != nil {
+		h.log().Warn("invalid legacy message", LogKeyClient, msg.ClientID, LogKeyError, err)
+		return
 	}
+
+	h.dispatch(msg, protocolMsg)
+}
+
+// handleHello negotiates the protocol version and features with a client
+// and replies with a welcome carrying the result.
+func (h *ProtocolHandler) handleHello(c *MessageContext, data *HelloData) error {
+	caps, err := h.server.Negotiate(c.ClientID(), data)
+	if err != nil {
+		return err
+	}
+	c.Logger().Info("negotiated capabilities", "client", data.Client, "version", caps.Version, "features", caps.Features)
+
+	return c.Reply(MessageTypeWelcome, &WelcomeData{
+		ClientID:        c.ClientID(),
+		ServerID:        h.server.ServerID(),
+		Timestamp:       time.Now().Unix(),
+		ProtocolVersion: caps.Version,
+		MinVersion:      ProtocolVersionMin,
+		MaxVersion:      ProtocolVersionLatest,
+		Features:        caps.Features,
+	})
 }
 
 // handleSubscribe handles file subscription.
 func (h *ProtocolHandler) handleSubscribe(msg *Message, pm *ProtocolMessage) {
 	var data SubscribeData
 	if err := json.Unmarshal(pm.Data, &data); err != nil {
-		h.sendError(msg.ClientID, pm.SessionID, "invalid_subscribe_data", err.Error())
+		h.replyError(msg, pm.SessionID, "invalid_subscribe_data", err.Error())
 		return
 	}
 
 	// Get or create edit session
-	sessionInfo, isNew := h.sessionManager.GetOrCreateSession(data.FilePath)
+	sessionInfo, isNew, ok := h.openSession(msg, data.FilePath, false)
+	if !ok {
+		return
+	}
 
 	// Add client to session
 	client := &SessionClient{
@@ -155,6 +301,7 @@ func (h *ProtocolHandler) handleSubscribe(msg *Message, pm *ProtocolMessage) {
 		ReadOnly:  data.ReadOnly,
 		Connected: true,
 	}
+	client.SetUser(h.userOf(msg.ClientID))
 
 	if data.ReadOnly {
 		sessionInfo.RefCount.AddReader()
@@ -165,42 +312,111 @@ func (h *ProtocolHandler) handleSubscribe(msg *Message, pm *ProtocolMessage) {
 	sessionInfo.AddClient(msg.ClientID, client)
 
 	// Send snapshot to client
-	snapshotData := &SnapshotData{
-		SessionID:  sessionInfo.SessionID,
-		FilePath:   data.FilePath,
-		Content:    sessionInfo.GetContent(),
-		Revision:   sessionInfo.GetCurrentVersion(),
-		CreatedAt:  sessionInfo.CreatedAt,
-		UpdatedAt:  sessionInfo.UpdatedAt,
-		Clients:    sessionInfo.GetClientInfos(),
-		ReadOnly:   data.ReadOnly,
+	snapshotData := h.newSnapshot(sessionInfo, data.FilePath, data.ReadOnly)
+	if !h.capabilitiesOf(msg.ClientID).Has(FeaturePresence) {
+		snapshotData.Clients = nil
 	}
 
 	if isNew {
 		// New session, no operations yet
 		snapshotData.Operations = nil
-	} else {
+	} else if !h.catchUp(sessionInfo, snapshotData, data.Revision) {
 		// Existing session, send recent operations
 		snapshotData.Operations = sessionInfo.GetRecentOperations()
 	}
 
-	h.sendMessage(msg.ClientID, MessageTypeSnapshot, snapshotData)
+	h.reply(msg, MessageTypeSnapshot, snapshotData)
 
 	// Notify other clients
 	h.notifyUserJoined(sessionInfo, msg.ClientID)
 }
 
+// newSnapshot returns the current state of a session for a client.
+func (h *ProtocolHandler) newSnapshot(sessionInfo *EditSession, filePath string, readOnly bool) *SnapshotData {
+	return &SnapshotData{
+		SessionID:   sessionInfo.SessionID,
+		FilePath:    filePath,
+		Content:     sessionInfo.GetContent(),
+		Revision:    sessionInfo.GetCurrentVersion(),
+		CreatedAt:   sessionInfo.CreatedAt,
+		UpdatedAt:   sessionInfo.UpdatedAt,
+		Clients:     sessionInfo.GetClientInfos(),
+		ReadOnly:    readOnly,
+		Comments:    sessionInfo.Comments().Threads(),
+		Delta:       sessionInfo.GetFormattedContent(),
+		ContentType: sessionInfo.ContentType(),
+	}
+}
+
+// resendSnapshots sends a new snapshot to every client of a session, after
+// its document model changed.
+func (h *ProtocolHandler) resendSnapshots(sessionInfo *EditSession) {
+	for _, clientID := range sessionInfo.ClientIDs() {
+		client := sessionInfo.GetClient(clientID)
+		if client == nil {
+			continue
+		}
+		snapshot := h.newSnapshot(sessionInfo, client.FilePath, client.ReadOnly)
+		if !h.capabilitiesOf(clientID).Has(FeaturePresence) {
+			snapshot.Clients = nil
+		}
+		h.sendMessage(clientID, MessageTypeSnapshot, snapshot)
+	}
+}
+
+// catchUp replaces the content of a snapshot with one operation composed
+// of all operations since revision, for clients resubscribing to a text
+// document they already have. Returns false if the client needs the full
+// snapshot.
+func (h *ProtocolHandler) catchUp(sessionInfo *EditSession, snapshot *SnapshotData, revision int64) bool {
+	if revision <= 0 || snapshot.ContentType != ContentTypeText || snapshot.Delta != nil {
+		return false
+	}
+	ops, current, ok := sessionInfo.OperationsSince(revision)
+	if !ok {
+		return false
+	}
+
+	// An empty operation tells the client nothing changed
+	catchUp := []interface{}{}
+	var composed *ot.Operation
+	for _, opData := range ops {
+		data, isText := opData.([]interface{})
+		if !isText {
+			return false
+		}
+		op, err := operationFromJSON(data)
+		if err != nil {
+			return false
+		}
+		if composed == nil {
+			composed = op
+		} else if composed, err = ot.Compose(composed, op); err != nil {
+			return false
+		}
+	}
+	if composed != nil {
+		catchUp = composed.ToJSON()
+	}
+
+	snapshot.Content = ""
+	snapshot.Revision = current
+	snapshot.BaseRevision = revision
+	snapshot.CatchUp = catchUp
+	return true
+}
+
 // handleUnsubscribe handles file unsubscription.
 func (h *ProtocolHandler) handleUnsubscribe(msg *Message, pm *ProtocolMessage) {
 	var data UnsubscribeData
 	if err := json.Unmarshal(pm.Data, &data); err != nil {
-		h.sendError(msg.ClientID, pm.SessionID, "invalid_unsubscribe_data", err.Error())
+		h.replyError(msg, pm.SessionID, "invalid_unsubscribe_data", err.Error())
 		return
 	}
 
 	sessionInfo := h.sessionManager.GetSession(data.SessionID)
 	if sessionInfo == nil {
-		h.sendError(msg.ClientID, data.SessionID, "session_not_found", "Session not found")
+		h.replyError(msg, data.SessionID, "session_not_found", "Session not found")
 		return
 	}
 
@@ -230,12 +446,36 @@ func (h *ProtocolHandler) handleUnsubscribe(msg *Message, pm *ProtocolMessage) {
 func (h *ProtocolHandler) handleStartEditing(msg *Message, pm *ProtocolMessage) {
 	var data StartEditingData
 	if err := json.Unmarshal(pm.Data, &data); err != nil {
-		h.sendError(msg.ClientID, pm.SessionID, "invalid_start_editing_data", err.Error())
+		h.replyError(msg, pm.SessionID, "invalid_start_editing_data", err.Error())
 		return
 	}
 
 	// Get or create edit session
-	sessionInfo, _ := h.sessionManager.GetOrCreateSession(data.FilePath)
+	sessionInfo, isNew, ok := h.openSession(msg, data.FilePath, true)
+	if !ok {
+		return
+	}
+
+	// Select the document model: the first editor of a session takes the
+	// requested type, later editors cannot edit a JSON session as text and
+	// vice versa
+	changed, err := sessionInfo.ClaimContentType(data.ContentType)
+	var mismatch *TransportError
+	if errors.As(err, &mismatch) {
+		h.replyError(msg, sessionInfo.SessionID, mismatch.Code, mismatch.Message)
+		return
+	}
+	if err != nil {
+		if isNew {
+			h.sessionManager.DestroySession(sessionInfo.SessionID)
+		}
+		h.replyError(msg, "", "invalid_content_type", err.Error())
+		return
+	}
+	if changed && !isNew {
+		// Subscribers got the document as text
+		h.resendSnapshots(sessionInfo)
+	}
 
 	// Add as writer
 	sessionInfo.RefCount.AddWriter()
@@ -248,22 +488,14 @@ func (h *ProtocolHandler) handleStartEditing(msg *Message, pm *ProtocolMessage)
 		IsEditing: true,
 		Connected: true,
 	}
+	client.SetUser(h.userOf(msg.ClientID))
 
 	sessionInfo.AddClient(msg.ClientID, client)
 
 	// Send snapshot
-	snapshotData := &SnapshotData{
-		SessionID: sessionInfo.SessionID,
-		FilePath:  data.FilePath,
-		Content:   sessionInfo.GetContent(),
-		Revision:  sessionInfo.GetCurrentVersion(),
-		CreatedAt: sessionInfo.CreatedAt,
-		UpdatedAt: sessionInfo.UpdatedAt,
-		Clients:   sessionInfo.GetClientInfos(),
-		ReadOnly:  false,
-	}
+	snapshotData := h.newSnapshot(sessionInfo, data.FilePath, false)
 
-	h.sendMessage(msg.ClientID, MessageTypeSnapshot, snapshotData)
+	h.reply(msg, MessageTypeSnapshot, snapshotData)
 
 	// Notify other clients
 	h.notifySessionInfo(sessionInfo)
@@ -273,13 +505,13 @@ func (h *ProtocolHandler) handleStartEditing(msg *Message, pm *ProtocolMessage)
 func (h *ProtocolHandler) handleStopEditing(msg *Message, pm *ProtocolMessage) {
 	var data StopEditingData
 	if err := json.Unmarshal(pm.Data, &data); err != nil {
-		h.sendError(msg.ClientID, pm.SessionID, "invalid_stop_editing_data", err.Error())
+		h.replyError(msg, pm.SessionID, "invalid_stop_editing_data", err.Error())
 		return
 	}
 
 	sessionInfo := h.sessionManager.GetSession(data.SessionID)
 	if sessionInfo == nil {
-		h.sendError(msg.ClientID, data.SessionID, "session_not_found", "Session not found")
+		h.replyError(msg, data.SessionID, "session_not_found", "Session not found")
 		return
 	}
 
@@ -305,54 +537,542 @@ func (h *ProtocolHandler) handleStopEditing(msg *Message, pm *ProtocolMessage) {
 func (h *ProtocolHandler) handleOperation(msg *Message, pm *ProtocolMessage) {
 	var data OperationData
 	if err := json.Unmarshal(pm.Data, &data); err != nil {
-		h.sendError(msg.ClientID, pm.SessionID, "invalid_operation_data", err.Error())
+		h.replyError(msg, pm.SessionID, "invalid_operation_data", err.Error())
 		return
 	}
 
 	sessionInfo := h.sessionManager.GetSession(data.SessionID)
 	if sessionInfo == nil {
-		h.sendError(msg.ClientID, data.SessionID, "session_not_found", "Session not found")
+		h.replyError(msg, data.SessionID, "session_not_found", "Session not found")
 		return
 	}
 
-	// Parse operation
-	opData, err := ParseOperationData(data.Operation)
-	if err != nil {
-		h.sendError(msg.ClientID, data.SessionID, "invalid_operation", err.Error())
+	switch sessionInfo.ContentType() {
+	case ContentTypeJSON:
+		h.handleJSONOperation(msg, pm, &data, sessionInfo)
+		return
+	case ContentTypeNotebook:
+		h.handleCellTextOperation(msg, pm, &data, sessionInfo)
 		return
 	}
 
-	// Convert array format to OT operation
-	op := h.arrayToOperation(opData)
-	if op == nil {
-		h.sendError(msg.ClientID, data.SessionID, "invalid_operation", "operation is nil")
-		return
+	sessionInfo.applyMu.Lock()
+	defer sessionInfo.applyMu.Unlock()
+
+	var opData []interface{}
+	var op *ot.Operation
+	if data.Delta != nil {
+		// Rich-text operation: derive the plain-text edit for content and history
+		var err error
+		op, err = data.Delta.ToOperation(utf8.RuneCountInString(sessionInfo.GetContent()))
+		if err != nil {
+			h.replyError(msg, data.SessionID, "invalid_operation", err.Error())
+			return
+		}
+		opData = op.ToJSON()
+	} else {
+		// Parse operation
+		var err error
+		opData, err = ParseOperationData(data.Operation)
+		if err != nil {
+			h.replyError(msg, data.SessionID, "invalid_operation", err.Error())
+			return
+		}
+
+		// Convert array format to OT operation
+		op = h.arrayToOperation(opData)
+		if op == nil {
+			h.replyError(msg, data.SessionID, "invalid_operation", "operation is nil")
+			return
+		}
 	}
 
-	// Debug: log operation details
-	docContent := sessionInfo.GetContent()
-	maxPreview := 50
-	if len(docContent) < maxPreview {
-		maxPreview = len(docContent)
+	h.log().Debug("operation received", LogKeyClient, msg.ClientID, LogKeySession, data.SessionID,
+		LogKeyRevision, data.Revision, LogKeyTrace, msg.TraceID, "base_length", op.BaseLength(),
+		"operation", redactedValue{opData})
+
+	h.commitTextOperation(msg, pm, sessionInfo, op, opData, data.Delta, data.Selection)
+}
+
+// commitTextOperation applies a text operation to a session, records it
+// in the history, acknowledges it and broadcasts it to the other clients.
+// Returns false if the operation was rejected; an error has been sent.
+// The caller holds the apply lock of the session.
+func (h *ProtocolHandler) commitTextOperation(msg *Message, pm *ProtocolMessage, sessionInfo *EditSession, op *ot.Operation, opData []interface{}, delta *ot.Delta, selection *CursorData) bool {
+	sessionID := sessionInfo.SessionID
+	if err := h.checkInserts(sessionID, opData); err != nil {
+		h.rejectLimit(msg, err)
+		return false
+	}
+
+	// Edits of CRDT peers are already in the CRDT replica
+	syncCRDT := pm.Type != MessageTypeCRDTSync && pm.Type != MessageTypeCRDTUpdate
+	change, code, err := h.applyTextOperation(sessionInfo, op, opData, delta, msg.ClientID, msg.TraceID, syncCRDT)
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		h.rejectLimit(msg, limitErr)
+		return false
+	}
+	if err != nil {
+		h.replyError(msg, sessionID, code, err.Error())
+		return false
 	}
-	log.Printf("[Handler] Operation details: op.BaseLength()=%d, doc rune count=%d, doc byte len=%d, preview=%q",
-		op.BaseLength(), utf8.RuneCountInString(docContent), len(docContent), docContent[:maxPreview])
+
+	// Send acknowledgment with new version
+	ackData := &AckData{
+		SessionID: sessionID,
+		Revision:  sessionInfo.GetCurrentVersion(),
+		Timestamp: pm.Timestamp,
+	}
+	h.reply(msg, MessageTypeAck, ackData)
+
+	h.publishTextOperation(sessionInfo, msg.ClientID, msg.TraceID, opData, delta, selection, change)
+	return true
+}
+
+// textChange is what applying a text operation produced for the other
+// clients of a session.
+type textChange struct {
+	crdtUpdate []byte           // Update for the CRDT peers, if any
+	orphaned   []*CommentThread // Threads whose text was deleted
+}
+
+// applyTextOperation applies a text operation to the content, formatting,
+// comment anchors and CRDT replica of a session and records it in the
+// history under the trace of its message. On error it returns the error
+// code to report. The caller holds the apply lock of the session.
+func (h *ProtocolHandler) applyTextOperation(sessionInfo *EditSession, op *ot.Operation, opData []interface{}, delta *ot.Delta, author, traceID string, syncCRDT bool) (*textChange, string, error) {
+	start := time.Now()
 
 	// Apply operation to document
 	newContent, err := op.Apply(sessionInfo.GetContent())
 	if err != nil {
-		h.sendError(msg.ClientID, data.SessionID, "operation_failed", err.Error())
+		return nil, "operation_failed", err
+	}
+	if err := h.checkDocumentSize(sessionInfo.SessionID, newContent); err != nil {
+		return nil, err.Err.Code, err
+	}
+
+	// Keep the CRDT replica in sync. It goes first, as it can reject an
+	// operation the formatting runs have already taken.
+	var crdtUpdate []byte
+	if syncCRDT {
+		if crdtUpdate, err = sessionInfo.ApplyCRDTOperation(op); err != nil {
+			return nil, "operation_failed", err
+		}
+	}
+
+	// Keep formatting runs in sync with the text
+	if err := sessionInfo.ApplyFormatting(op, delta); err != nil {
+		return nil, "operation_failed", err
+	}
+
+	// Update session content snapshot and move comment anchors with it
+	orphaned := sessionInfo.CommitContent(newContent, op)
+
+	// Add operation to history (creates new version)
+	if err := sessionInfo.AddTracedOperation(opData, author, traceID); err != nil {
+		return nil, "history_error", err
+	}
+	h.recordEdits(op)
+	h.recordOperation(sessionInfo, start)
+	return &textChange{crdtUpdate: crdtUpdate, orphaned: orphaned}, "", nil
+}
+
+// publishTextOperation broadcasts an applied text operation to the clients
+// of a session other than its author, and the threads it orphaned to all.
+func (h *ProtocolHandler) publishTextOperation(sessionInfo *EditSession, author, traceID string, opData []interface{}, delta *ot.Delta, selection *CursorData, change *textChange) {
+	sessionID := sessionInfo.SessionID
+
+	// Broadcast to other clients
+	remoteOpData := &RemoteOperationData{
+		SessionID: sessionID,
+		ClientID:  author,
+		Revision:  sessionInfo.GetCurrentVersion(),
+		Operation: opData,
+		Delta:     delta,
+		Selection: selection,
+	}
+
+	h.broadcastTraced(sessionID, author, traceID, MessageTypeRemoteOperation, remoteOpData)
+	if change.crdtUpdate != nil {
+		h.broadcastCRDTUpdate(sessionInfo, author, traceID, change.crdtUpdate)
+	}
+
+	// Threads whose text was deleted become orphaned
+	for _, thread := range change.orphaned {
+		h.notifyComment(sessionInfo, CommentActionOrphaned, thread, author)
+	}
+}
+
+// ReadContent returns the content of a file's live session. live is
+// false if the file has no live session.
+func (h *ProtocolHandler) ReadContent(filePath string) (content string, live bool) {
+	sessionInfo := h.sessionManager.GetSessionByPath(filePath)
+	if sessionInfo == nil {
+		return "", false
+	}
+	return sessionInfo.GetContent(), true
+}
+
+// WriteContent turns a write of a whole file into an operation on its live
+// session, so that connected editors receive the change instead of having
+// it overwritten by their next save. live is false if the file has no live
+// session; the caller then writes to storage itself.
+func (h *ProtocolHandler) WriteContent(filePath, content, author string) (revision int64, live bool, err error) {
+	sessionInfo := h.sessionManager.GetSessionByPath(filePath)
+	if sessionInfo == nil {
+		return 0, false, nil
+	}
+	if sessionInfo.ContentType() != ContentTypeText {
+		return 0, true, fmt.Errorf("%w: %s is open in a %s session", session.ErrConflict, filePath, sessionInfo.ContentType())
+	}
+	sessionInfo.applyMu.Lock()
+	defer sessionInfo.applyMu.Unlock()
+
+	// Both versions are chunked at content-defined boundaries, so the diff
+	// matches the unchanged leaves by hash and only reads the edited ones
+	op := concordia.DiffOperation(rope.NewChunked(sessionInfo.GetContent()), rope.NewChunked(content))
+	if op.IsNoop() {
+		return sessionInfo.GetCurrentVersion(), true, nil
+	}
+	opData := op.ToJSON()
+	traceID := newTraceID()
+	change, _, err := h.applyTextOperation(sessionInfo, op, opData, nil, author, traceID, true)
+	if err != nil {
+		return 0, true, err
+	}
+	h.publishTextOperation(sessionInfo, author, traceID, opData, nil, nil, change)
+	return sessionInfo.GetCurrentVersion(), true, nil
+}
+
+// handleMerge merges an offline copy into a text session. Changes that do
+// not overlap live edits are applied as one operation; overlapping ones
+// are reported back as conflicts. Only writers subscribed to the session
+// can merge, and the merge is computed under its apply lock so it applies
+// to the content it was computed against.
+func (h *ProtocolHandler) handleMerge(msg *Message, pm *ProtocolMessage) {
+	var data MergeData
+	if err := json.Unmarshal(pm.Data, &data); err != nil {
+		h.replyError(msg, pm.SessionID, "invalid_merge_data", err.Error())
+		return
+	}
+
+	sessionInfo := h.sessionManager.GetSession(data.SessionID)
+	if sessionInfo == nil {
+		h.replyError(msg, data.SessionID, "session_not_found", "Session not found")
+		return
+	}
+	if sessionInfo.ContentType() != ContentTypeText {
+		h.replyError(msg, data.SessionID, "unsupported_content_type", "merge is only supported for text sessions")
+		return
+	}
+	client := sessionInfo.GetClient(msg.ClientID)
+	if client == nil {
+		h.replyError(msg, data.SessionID, "not_subscribed", "Client is not subscribed to the session")
+		return
+	}
+	if client.ReadOnly {
+		h.replyError(msg, data.SessionID, "read_only", "Read-only clients cannot merge")
+		return
+	}
+
+	sessionInfo.applyMu.Lock()
+	defer sessionInfo.applyMu.Unlock()
+
+	start := time.Now()
+	result := concordia.Merge3(rope.New(data.Base), rope.New(data.Content), rope.New(sessionInfo.GetContent()))
+	h.recordTransform("merge", start)
+	if !result.Operation.IsNoop() {
+		if !h.commitTextOperation(msg, pm, sessionInfo, result.Operation, result.Operation.ToJSON(), nil, nil) {
+			return
+		}
+	}
+
+	h.reply(msg, MessageTypeMergeResult, &MergeResultData{
+		SessionID: data.SessionID,
+		Revision:  sessionInfo.GetCurrentVersion(),
+		Conflicts: result.Conflicts,
+	})
+}
+
+// handleCRDTSync syncs a CRDT peer with a text session: the peer's offline
+// changes are applied like an operation, and the peer gets everything it
+// is missing. From then on it receives every edit as a crdt_update.
+func (h *ProtocolHandler) handleCRDTSync(msg *Message, pm *ProtocolMessage) {
+	var data CRDTSyncData
+	if err := json.Unmarshal(pm.Data, &data); err != nil {
+		h.replyError(msg, pm.SessionID, "invalid_crdt_data", err.Error())
+		return
+	}
+
+	sessionInfo := h.crdtSession(msg, data.SessionID)
+	if sessionInfo == nil {
+		return
+	}
+	sessionInfo.applyMu.Lock()
+	defer sessionInfo.applyMu.Unlock()
+
+	var sv crdt.StateVector
+	if len(data.StateVector) > 0 {
+		var err error
+		if sv, err = crdt.DecodeStateVector(data.StateVector); err != nil {
+			h.replyError(msg, data.SessionID, "invalid_crdt_data", err.Error())
+			return
+		}
+	}
+
+	sessionInfo.MarkCRDTPeer(msg.ClientID)
+	if len(data.Update) > 0 && !h.applyCRDTUpdate(msg, pm, sessionInfo, data.Update) {
+		return
+	}
+
+	h.reply(msg, MessageTypeCRDTUpdate, &CRDTUpdateData{
+		SessionID: data.SessionID,
+		Revision:  sessionInfo.GetCurrentVersion(),
+		Update:    sessionInfo.CRDTBridge().Doc().EncodeStateAsUpdate(sv),
+	})
+}
+
+// handleCRDTUpdate applies an edit of a CRDT peer.
+func (h *ProtocolHandler) handleCRDTUpdate(msg *Message, pm *ProtocolMessage) {
+	var data CRDTUpdateData
+	if err := json.Unmarshal(pm.Data, &data); err != nil {
+		h.replyError(msg, pm.SessionID, "invalid_crdt_data", err.Error())
+		return
+	}
+
+	sessionInfo := h.crdtSession(msg, data.SessionID)
+	if sessionInfo == nil {
+		return
+	}
+	sessionInfo.applyMu.Lock()
+	defer sessionInfo.applyMu.Unlock()
+	h.applyCRDTUpdate(msg, pm, sessionInfo, data.Update)
+}
+
+// crdtSession returns the text session a CRDT message is for, or sends an
+// error if there is none or the sender is not subscribed to it.
+func (h *ProtocolHandler) crdtSession(msg *Message, sessionID string) *EditSession {
+	sessionInfo := h.sessionManager.GetSession(sessionID)
+	if sessionInfo == nil {
+		h.replyError(msg, sessionID, "session_not_found", "Session not found")
+		return nil
+	}
+	if sessionInfo.ContentType() != ContentTypeText {
+		h.replyError(msg, sessionID, "unsupported_content_type", "CRDT editing is only supported for text sessions")
+		return nil
+	}
+	if sessionInfo.GetClient(msg.ClientID) == nil {
+		h.replyError(msg, sessionID, "not_subscribed", "Client is not subscribed to the session")
+		return nil
+	}
+	return sessionInfo
+}
+
+// applyCRDTUpdate applies a CRDT update to the replica, commits the
+// resulting operation for OT clients and forwards the update to the other
+// CRDT peers. Returns false if the update was rejected. The caller holds
+// the apply lock of the session.
+func (h *ProtocolHandler) applyCRDTUpdate(msg *Message, pm *ProtocolMessage, sessionInfo *EditSession, update []byte) bool {
+	start := time.Now()
+	op, err := sessionInfo.CRDTBridge().ApplyUpdate(update)
+	h.recordTransform("crdt", start)
+	if err != nil {
+		h.replyError(msg, sessionInfo.SessionID, "invalid_crdt_update", err.Error())
+		return false
+	}
+
+	if op != nil && !h.commitTextOperation(msg, pm, sessionInfo, op, op.ToJSON(), nil, nil) {
+		return false
+	}
+	h.broadcastCRDTUpdate(sessionInfo, msg.ClientID, msg.TraceID, update)
+	return true
+}
+
+// broadcastCRDTUpdate sends an update to the CRDT peers of a session except sender.
+func (h *ProtocolHandler) broadcastCRDTUpdate(sessionInfo *EditSession, excludeClientID, traceID string, update []byte) {
+	data := &CRDTUpdateData{
+		SessionID: sessionInfo.SessionID,
+		ClientID:  excludeClientID,
+		Revision:  sessionInfo.GetCurrentVersion(),
+		Update:    update,
+	}
+	for _, client := range sessionInfo.GetClients() {
+		if client.ClientID == excludeClientID || !client.CRDT {
+			continue
+		}
+		h.send(client.ClientID, "", traceID, MessageTypeCRDTUpdate, data)
+	}
+}
+
+// handleCommentCreate starts a comment thread on a range of the document.
+func (h *ProtocolHandler) handleCommentCreate(msg *Message, pm *ProtocolMessage) {
+	var data CommentCreateData
+	if err := json.Unmarshal(pm.Data, &data); err != nil {
+		h.replyError(msg, pm.SessionID, "invalid_comment_data", err.Error())
+		return
+	}
+
+	sessionInfo, client := h.commentSession(msg, data.SessionID, false)
+	if sessionInfo == nil {
+		return
+	}
+	if data.Body == "" {
+		h.replyError(msg, data.SessionID, "invalid_comment_data", "comment body is empty")
+		return
+	}
+
+	owner, author := commentAuthor(client)
+	thread, err := sessionInfo.CreateComment(data.Start, data.End, owner, author, data.Body)
+	if err != nil {
+		h.replyError(msg, data.SessionID, "invalid_comment_data", err.Error())
+		return
+	}
+
+	h.notifyComment(sessionInfo, CommentActionCreated, thread, msg.ClientID)
+}
+
+// handleCommentReply appends a reply to a comment thread.
+func (h *ProtocolHandler) handleCommentReply(msg *Message, pm *ProtocolMessage) {
+	var data CommentReplyData
+	if err := json.Unmarshal(pm.Data, &data); err != nil {
+		h.replyError(msg, pm.SessionID, "invalid_comment_data", err.Error())
+		return
+	}
+
+	sessionInfo, client := h.commentSession(msg, data.SessionID, false)
+	if sessionInfo == nil {
+		return
+	}
+
+	if data.Body == "" {
+		h.replyError(msg, data.SessionID, "invalid_comment_data", "comment body is empty")
+		return
+	}
+
+	_, author := commentAuthor(client)
+	thread, err := sessionInfo.Comments().Reply(data.ThreadID, author, data.Body)
+	if err != nil {
+		h.replyError(msg, data.SessionID, ErrCommentNotFound.Code, err.Error())
+		return
+	}
+
+	h.notifyComment(sessionInfo, CommentActionReplied, thread, msg.ClientID)
+}
+
+// commentSession returns the session of a comment message and the sender
+// in it, or sends an error if there is none or the sender is not
+// subscribed to it. Changing a thread's state also needs a client that is
+// not read-only.
+func (h *ProtocolHandler) commentSession(msg *Message, sessionID string, changesState bool) (*EditSession, *SessionClient) {
+	sessionInfo := h.sessionManager.GetSession(sessionID)
+	if sessionInfo == nil {
+		h.replyError(msg, sessionID, "session_not_found", "Session not found")
+		return nil, nil
+	}
+	client := sessionInfo.GetClient(msg.ClientID)
+	if client == nil {
+		h.replyError(msg, sessionID, "not_subscribed", "Client is not subscribed to the session")
+		return nil, nil
+	}
+	if changesState && client.ReadOnly {
+		h.replyError(msg, sessionID, "read_only", "Read-only clients cannot resolve or delete comments")
+		return nil, nil
+	}
+	return sessionInfo, client
+}
+
+// handleCommentResolve resolves or reopens a comment thread.
+func (h *ProtocolHandler) handleCommentResolve(msg *Message, pm *ProtocolMessage) {
+	var data CommentResolveData
+	if err := json.Unmarshal(pm.Data, &data); err != nil {
+		h.replyError(msg, pm.SessionID, "invalid_comment_data", err.Error())
+		return
+	}
+
+	sessionInfo, client := h.commentSession(msg, data.SessionID, true)
+	if sessionInfo == nil {
+		return
+	}
+
+	_, author := commentAuthor(client)
+	thread, err := sessionInfo.Comments().Resolve(data.ThreadID, data.Resolved, author)
+	if err != nil {
+		h.replyError(msg, data.SessionID, ErrCommentNotFound.Code, err.Error())
+		return
+	}
+
+	action := CommentActionResolved
+	if !data.Resolved {
+		action = CommentActionReopened
+	}
+	h.notifyComment(sessionInfo, action, thread, msg.ClientID)
+}
+
+// handleCommentDelete deletes a comment thread. Only the user that created
+// a thread, or the client without authentication, can delete it.
+func (h *ProtocolHandler) handleCommentDelete(msg *Message, pm *ProtocolMessage) {
+	var data CommentDeleteData
+	if err := json.Unmarshal(pm.Data, &data); err != nil {
+		h.replyError(msg, pm.SessionID, "invalid_comment_data", err.Error())
+		return
+	}
+
+	sessionInfo, client := h.commentSession(msg, data.SessionID, true)
+	if sessionInfo == nil {
+		return
+	}
+
+	owner, _ := commentAuthor(client)
+	thread, err := sessionInfo.Comments().Get(data.ThreadID)
+	if err == nil && thread.CreatedBy != owner {
+		h.replyError(msg, data.SessionID, ErrCommentNotAuthor.Code, ErrCommentNotAuthor.Message)
+		return
+	}
+	if err == nil {
+		thread, err = sessionInfo.Comments().Delete(data.ThreadID)
+	}
+	if err != nil {
+		h.replyError(msg, data.SessionID, ErrCommentNotFound.Code, err.Error())
+		return
+	}
+
+	h.notifyComment(sessionInfo, CommentActionDeleted, thread, msg.ClientID)
+}
+
+// handleJSONOperation handles a json0 operation for a JSON session.
+func (h *ProtocolHandler) handleJSONOperation(msg *Message, pm *ProtocolMessage, data *OperationData, sessionInfo *EditSession) {
+	raw, err := json.Marshal(data.Operation)
+	if err != nil {
+		h.replyError(msg, data.SessionID, "invalid_operation", err.Error())
+		return
+	}
+
+	var op json0.Operation
+	if err := json.Unmarshal(raw, &op); err != nil {
+		h.replyError(msg, data.SessionID, "invalid_operation", err.Error())
+		return
+	}
+
+	if err := h.checkJSONInserts(data.SessionID, &op); err != nil {
+		h.rejectLimit(msg, err)
 		return
 	}
 
-	// Update session content snapshot
-	sessionInfo.SetContent(newContent)
+	// Apply operation to document
+	start := time.Now()
+	if err := sessionInfo.applyJSONOperation(&op, h.documentSizeCheck(data.SessionID)); err != nil {
+		h.rejectApply(msg, data.SessionID, err)
+		return
+	}
 
 	// Add operation to history (creates new version)
-	if err := sessionInfo.AddOperation(opData, msg.ClientID); err != nil {
-		h.sendError(msg.ClientID, data.SessionID, "history_error", err.Error())
+	if err := sessionInfo.AddTracedOperation(&op, msg.ClientID, msg.TraceID); err != nil {
+		h.replyError(msg, data.SessionID, "history_error", err.Error())
 		return
 	}
+	h.recordOperation(sessionInfo, start)
 
 	// Send acknowledgment with new version
 	ackData := &AckData{
@@ -360,18 +1080,188 @@ func (h *ProtocolHandler) handleOperation(msg *Message, pm *ProtocolMessage) {
 		Revision:  sessionInfo.GetCurrentVersion(),
 		Timestamp: pm.Timestamp,
 	}
-	h.sendMessage(msg.ClientID, MessageTypeAck, ackData)
+	h.reply(msg, MessageTypeAck, ackData)
 
 	// Broadcast to other clients
 	remoteOpData := &RemoteOperationData{
+		SessionID: data.SessionID,
+		ClientID:  msg.ClientID,
+		Revision:  sessionInfo.GetCurrentVersion(),
+		Operation: &op,
+		Selection: data.Selection,
+	}
+
+	h.broadcastTraced(data.SessionID, msg.ClientID, msg.TraceID, MessageTypeRemoteOperation, remoteOpData)
+}
+
+// rejectApply reports a change a JSON or notebook session did not take,
+// as a limit violation if it would have exceeded a limit.
+func (h *ProtocolHandler) rejectApply(msg *Message, sessionID string, err error) {
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		h.rejectLimit(msg, limitErr)
+		return
+	}
+	h.replyError(msg, sessionID, "operation_failed", err.Error())
+}
+
+// handleCellTextOperation handles a text operation on a notebook cell.
+func (h *ProtocolHandler) handleCellTextOperation(msg *Message, pm *ProtocolMessage, data *OperationData, sessionInfo *EditSession) {
+	if data.CellID == "" {
+		h.replyError(msg, data.SessionID, "invalid_operation", "cell_id is required for notebook sessions")
+		return
+	}
+
+	opData, err := ParseOperationData(data.Operation)
+	if err != nil {
+		h.replyError(msg, data.SessionID, "invalid_operation", err.Error())
+		return
+	}
+	op := h.arrayToOperation(opData)
+	if op == nil {
+		h.replyError(msg, data.SessionID, "invalid_operation", "Failed to parse operation")
+		return
+	}
+	if err := h.checkInserts(data.SessionID, opData); err != nil {
+		h.rejectLimit(msg, err)
+		return
+	}
+
+	// Apply operation to the cell source
+	start := time.Now()
+	err = sessionInfo.applyNotebookChange(func(nb *concordia.Notebook) error {
+		return nb.ApplyCellOperation(data.CellID, op)
+	}, h.documentSizeCheck(data.SessionID))
+	if err != nil {
+		h.rejectApply(msg, data.SessionID, err)
+		return
+	}
+
+	change := map[string]interface{}{"cell_id": data.CellID, "operation": opData}
+	if !h.commitCellChange(msg, pm, data.SessionID, sessionInfo, change, start) {
+		return
+	}
+
+	h.broadcastTraced(data.SessionID, msg.ClientID, msg.TraceID, MessageTypeRemoteOperation, &RemoteOperationData{
 		SessionID: data.SessionID,
 		ClientID:  msg.ClientID,
 		Revision:  sessionInfo.GetCurrentVersion(),
 		Operation: opData,
+		CellID:    data.CellID,
 		Selection: data.Selection,
+	})
+}
+
+// handleCellOperation handles cell list and output changes in a notebook session.
+func (h *ProtocolHandler) handleCellOperation(msg *Message, pm *ProtocolMessage) {
+	var data CellOperationData
+	if err := json.Unmarshal(pm.Data, &data); err != nil {
+		h.replyError(msg, pm.SessionID, "invalid_cell_operation", err.Error())
+		return
+	}
+
+	sessionInfo := h.sessionManager.GetSession(data.SessionID)
+	if sessionInfo == nil {
+		h.replyError(msg, data.SessionID, "session_not_found", "Session not found")
+		return
+	}
+	if !sessionInfo.IsNotebook() {
+		h.replyError(msg, data.SessionID, "invalid_cell_operation", "session does not host a notebook")
+		return
+	}
+
+	remote := &RemoteCellOperationData{
+		SessionID: data.SessionID,
+		ClientID:  msg.ClientID,
+		Action:    data.Action,
+		CellID:    data.CellID,
+	}
+	applied := true
+
+	// The source of a new cell is inserted text
+	if data.Action == CellActionInsert && data.Cell != nil {
+		if err := h.checkInserts(data.SessionID, []interface{}{data.Cell.Source}); err != nil {
+			h.rejectLimit(msg, err)
+			return
+		}
+	}
+
+	start := time.Now()
+	err := sessionInfo.applyNotebookChange(func(nb *concordia.Notebook) error {
+		var err error
+		switch data.Action {
+		case CellActionInsert:
+			if data.Cell == nil {
+				return fmt.Errorf("cell is required for insert")
+			}
+			if remote.CellID, err = nb.InsertCell(data.Index, *data.Cell); err != nil {
+				return err
+			}
+			cell, _ := nb.Cell(remote.CellID)
+			remote.Cell = &cell
+		case CellActionDelete:
+			remote.Index = nb.CellIndex(data.CellID)
+			return nb.DeleteCell(data.CellID)
+		case CellActionMove:
+			err = nb.MoveCell(data.CellID, data.Index)
+		case CellActionOutputs:
+			if data.Outputs == nil {
+				return fmt.Errorf("outputs are required")
+			}
+			update := *data.Outputs
+			update.ClientID = msg.ClientID
+			if update.Timestamp == 0 {
+				update.Timestamp = time.Now().UnixMilli()
+			}
+			applied, err = nb.SetOutputs(data.CellID, update)
+			remote.Outputs = &update
+		default:
+			return fmt.Errorf("unknown cell action %q", data.Action)
+		}
+		remote.Index = nb.CellIndex(remote.CellID)
+		return err
+	}, h.documentSizeCheck(data.SessionID))
+	if err != nil {
+		h.rejectApply(msg, data.SessionID, err)
+		return
+	}
+
+	if !applied {
+		// Outputs from an older execution lost to newer ones, nothing changed
+		h.reply(msg, MessageTypeAck, &AckData{
+			SessionID: data.SessionID,
+			Revision:  sessionInfo.GetCurrentVersion(),
+			Timestamp: pm.Timestamp,
+		})
+		return
+	}
+
+	if !h.commitCellChange(msg, pm, data.SessionID, sessionInfo, &data, start) {
+		return
+	}
+
+	remote.Revision = sessionInfo.GetCurrentVersion()
+	h.broadcastTraced(data.SessionID, msg.ClientID, msg.TraceID, MessageTypeRemoteCellOperation, remote)
+}
+
+// commitCellChange records a notebook change applied since start in
+// history and acknowledges it. Returns false if the change could not be
+// recorded.
+func (h *ProtocolHandler) commitCellChange(msg *Message, pm *ProtocolMessage, sessionID string, sessionInfo *EditSession, change interface{}, start time.Time) bool {
+	// Add operation to history (creates new version)
+	if err := sessionInfo.AddTracedOperation(change, msg.ClientID, msg.TraceID); err != nil {
+		h.replyError(msg, sessionID, "history_error", err.Error())
+		return false
 	}
+	h.recordOperation(sessionInfo, start)
 
-	h.broadcastToSession(data.SessionID, msg.ClientID, MessageTypeRemoteOperation, remoteOpData)
+	// Send acknowledgment with new version
+	h.reply(msg, MessageTypeAck, &AckData{
+		SessionID: sessionID,
+		Revision:  sessionInfo.GetCurrentVersion(),
+		Timestamp: pm.Timestamp,
+	})
+	return true
 }
 
 // handleCursor handles cursor position updates.
@@ -382,7 +1272,7 @@ func (h *ProtocolHandler) handleCursor(msg *Message, pm *ProtocolMessage) {
 	}
 
 	// TODO: Broadcast cursor position to other clients in session
-	log.Printf("Client %s cursor moved to %d", msg.ClientID, data.Position)
+	h.log().Debug("cursor moved", LogKeyClient, msg.ClientID, "position", data.Position)
 }
 
 // handleHeartbeat handles heartbeat messages.
@@ -392,78 +1282,240 @@ func (h *ProtocolHandler) handleHeartbeat(msg *Message, pm *ProtocolMessage) {
 		return
 	}
 
-	// Update client last seen time
+	// Update client last seen time. Server time is used, as the janitor
+	// compares it with server time.
 	for _, sessionID := range data.SessionIDs {
 		sessionInfo := h.sessionManager.GetSession(sessionID)
 		if sessionInfo != nil {
-			client := sessionInfo.GetClient(msg.ClientID)
-			if client != nil {
-				client.LastSeen = pm.Timestamp
-			}
+			sessionInfo.Touch(msg.ClientID)
 		}
 	}
 }
 
-// ========== Helper Methods ==========
+// ========== Session Lifecycle ==========
+
+// SetLifecycleConfig sets client eviction timeouts and limits, and
+// (re)starts the janitor that applies them.
+//
+// Example:
+//
+//	config := transport.DefaultLifecycleConfig()
+//	config.MaxClientsPerSession = 50
+//	handler.SetLifecycleConfig(config)
+func (h *ProtocolHandler) SetLifecycleConfig(config LifecycleConfig) {
+	h.sessionManager.StopJanitor()
+	h.sessionManager.SetLifecycleConfig(config)
+	h.sessionManager.StartJanitor(h.handleSweep)
+}
 
-// sendMessage sends a message to a specific client.
-func (h *ProtocolHandler) sendMessage(clientID string, msgType MessageType, data interface{}) error {
-	log.Printf("[Handler] Sending %s to %s", msgType, clientID)
+// Close stops the janitor.
+func (h *ProtocolHandler) Close() {
+	h.sessionManager.StopJanitor()
+}
 
-	pm, err := NewProtocolMessage(msgType, "", data)
+// openSession gets or creates the session for a file and checks that the
+// client may join it, and edit it if editing. Errors are sent to the client.
+func (h *ProtocolHandler) openSession(msg *Message, filePath string, editing bool) (*EditSession, bool, bool) {
+	sessionInfo, isNew, err := h.sessionManager.OpenSession(filePath)
 	if err != nil {
-		log.Printf("[Handler] Failed to create protocol message: %v", err)
-		return err
+		h.replyError(msg, "", "session_limit", err.Error())
+		return nil, false, false
+	}
+	if err := h.sessionManager.AdmitClient(sessionInfo, msg.ClientID); err != nil {
+		if isNew {
+			h.sessionManager.DestroySession(sessionInfo.SessionID)
+		}
+		h.replyError(msg, sessionInfo.SessionID, "client_limit", err.Error())
+		return nil, false, false
+	}
+	if err := h.admitUser(sessionInfo, msg.ClientID, editing); err != nil {
+		if isNew {
+			h.sessionManager.DestroySession(sessionInfo.SessionID)
+		}
+		h.rejectLimit(msg, err)
+		return nil, false, false
 	}
+	return sessionInfo, isNew, true
+}
 
-	// Create response message in new protocol format
-	response := map[string]interface{}{
-		"type":      string(msgType),
-		"client_id": clientID,
-		"timestamp": pm.Timestamp,
-		"metadata": map[string]interface{}{
-			"protocol_message": pm,
-		},
+// handleSweep tells the remaining clients about evicted ones.
+func (h *ProtocolHandler) handleSweep(result *SweepResult) {
+	for _, evicted := range result.Evicted {
+		h.notifyUserLeft(evicted.Session, evicted.Client.ClientID)
+		// In case the client is still connected but stopped heartbeating
+		h.sendError(evicted.Client.ClientID, evicted.Session.SessionID, "heartbeat_timeout", "No heartbeat received, left the session")
+		if h.server != nil {
+			// Other users may connect with the client ID again
+			h.server.ReleaseClient(evicted.Client.ClientID)
+		}
 	}
+	for _, err := range result.Errors {
+		h.log().Error("session janitor failed", LogKeyError, err)
+	}
+}
+
+// ========== Helper Methods ==========
+
+// sendMessage sends a message to a specific client.
+func (h *ProtocolHandler) sendMessage(clientID string, msgType MessageType, data interface{}) error {
+	return h.send(clientID, "", "", msgType, data)
+}
+
+// reply sends a message to the sender of msg, correlated with its request
+// and trace.
+func (h *ProtocolHandler) reply(msg *Message, msgType MessageType, data interface{}) error {
+	return h.send(msg.ClientID, msg.RequestID, msg.TraceID, msgType, data)
+}
 
-	// Marshal to JSON
-	jsonData, err := json.Marshal(response)
+// send sends a message to a specific client. A non-empty requestID
+// marks the message as a reply to that request; traceID is the trace of
+// the message that caused it.
+func (h *ProtocolHandler) send(clientID, requestID, traceID string, msgType MessageType, data interface{}) error {
+	jsonData, err := h.encode(clientID, requestID, traceID, msgType, data)
 	if err != nil {
-		log.Printf("[Handler] Failed to marshal response: %v", err)
 		return err
 	}
 
-	log.Printf("[Handler] Sending JSON: %s", string(jsonData))
+	h.log().Debug("sending message", LogKeyClient, clientID, LogKeyType, msgType, LogKeyTrace, traceID,
+		"bytes", len(jsonData), "body", redactedBytes(jsonData))
+
+	// Clients of forwarded sessions are connected to another node
+	if h.cluster != nil {
+		if remote, err := h.cluster.Deliver(clientID, jsonData); remote {
+			return err
+		}
+	}
 
 	// Send via WebSocket server using new SendJSON method
 	if err := h.server.SendJSON(clientID, jsonData); err != nil {
-		log.Printf("[Handler] Failed to send: %v", err)
+		h.log().Warn("send failed", LogKeyClient, clientID, LogKeyType, msgType, LogKeyTrace, traceID, LogKeyError, err)
 		return err
 	}
 
 	return nil
 }
 
+// encode encodes a message to a client in the wire format.
+func (h *ProtocolHandler) encode(clientID, requestID, traceID string, msgType MessageType, data interface{}) ([]byte, error) {
+	pm, err := NewProtocolMessage(msgType, "", data)
+	if err != nil {
+		h.log().Error("failed to create protocol message", LogKeyType, msgType, LogKeyError, err)
+		return nil, err
+	}
+	pm.RequestID = requestID
+	pm.TraceID = traceID
+
+	jsonData, err := encodeEnvelope(clientID, pm)
+	if err != nil {
+		h.log().Error("failed to encode message", LogKeyType, msgType, LogKeyError, err)
+		return nil, err
+	}
+	return jsonData, nil
+}
+
+// resyncSnapshots encodes snapshots of all sessions of a client, for
+// clients whose send queue overflowed.
+func (h *ProtocolHandler) resyncSnapshots(clientID string) ([][]byte, error) {
+	var snapshots [][]byte
+	for _, sessionInfo := range h.sessionManager.ListSessions() {
+		client := sessionInfo.GetClient(clientID)
+		if client == nil {
+			continue
+		}
+		data, err := h.encode(clientID, "", "", MessageTypeSnapshot, h.newSnapshot(sessionInfo, client.FilePath, client.ReadOnly))
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, data)
+	}
+	return snapshots, nil
+}
+
+// forwardToOwner forwards a client message to the cluster node that owns
+// its file. Returns false if the message is handled on this node.
+func (h *ProtocolHandler) forwardToOwner(clientID string, messageBytes []byte, pm *ProtocolMessage) bool {
+	if h.cluster == nil {
+		return false
+	}
+
+	var target struct {
+		SessionID string `json:"session_id"`
+		FilePath  string `json:"file_path"`
+	}
+	json.Unmarshal(pm.Data, &target)
+	if target.SessionID == "" {
+		target.SessionID = pm.SessionID
+	}
+
+	var forwarded bool
+	var err error
+	switch pm.Type {
+	case MessageTypeSubscribe, MessageTypeStartEditing:
+		forwarded, err = h.cluster.ForwardFile(target.FilePath, clientID, messageBytes)
+	default:
+		forwarded, err = h.cluster.ForwardSession(target.SessionID, clientID, messageBytes)
+	}
+	if err != nil {
+		h.log().Error("failed to forward message to owner", LogKeyClient, clientID, LogKeyType, pm.Type,
+			LogKeySession, target.SessionID, LogKeyTrace, pm.TraceID, LogKeyError, err)
+		h.sendError(clientID, target.SessionID, "cluster_unavailable", err.Error())
+		return true
+	}
+	return forwarded
+}
+
+// capabilitiesOf returns what was negotiated with a client. Clients
+// connected to other cluster nodes get the latest version and all server
+// features.
+func (h *ProtocolHandler) capabilitiesOf(clientID string) *Capabilities {
+	if h.server == nil {
+		return &Capabilities{Version: ProtocolVersionLatest, Features: DefaultFeatures()}
+	}
+	if caps := h.server.Capabilities(clientID); caps != nil {
+		return caps
+	}
+	return &Capabilities{Version: ProtocolVersionLatest, Features: h.server.Features()}
+}
+
+// userOf returns the authenticated user of a client connected to this
+// node, or nil.
+func (h *ProtocolHandler) userOf(clientID string) *session.UserInfo {
+	if h.server == nil {
+		return nil
+	}
+	return h.server.User(clientID)
+}
+
+// deliverLocal sends a message from the owner of a session to a client
+// connected to this node.
+func (h *ProtocolHandler) deliverLocal(clientID string, data []byte) error {
+	return h.server.SendJSON(clientID, data)
+}
+
 // broadcastToSession broadcasts a message to all clients in a session except sender.
 func (h *ProtocolHandler) broadcastToSession(sessionID, excludeClientID string, msgType MessageType, data interface{}) {
+	h.broadcastTraced(sessionID, excludeClientID, "", msgType, data)
+}
+
+// broadcastTraced broadcasts a message caused by the message with the
+// given trace ID, which the recipients receive with it.
+func (h *ProtocolHandler) broadcastTraced(sessionID, excludeClientID, traceID string, msgType MessageType, data interface{}) {
 	sessionInfo := h.sessionManager.GetSession(sessionID)
 	if sessionInfo == nil {
 		return
 	}
 
-	_, err := NewProtocolMessage(msgType, sessionID, data)
-	if err != nil {
-		log.Printf("Failed to create protocol message: %v", err)
-		return
-	}
-
-	for clientID := range sessionInfo.Clients {
+	recipients := 0
+	for _, clientID := range sessionInfo.ClientIDs() {
 		if clientID == excludeClientID {
 			continue
 		}
 
-		h.sendMessage(clientID, msgType, data)
+		h.send(clientID, "", traceID, msgType, data)
+		recipients++
 	}
+	h.recorder().Observe(MetricBroadcastRecipients, float64(recipients), metrics.L("type", string(msgType)))
+	h.log().Debug("broadcast", LogKeySession, sessionID, LogKeyType, msgType, LogKeyTrace, traceID, "recipients", recipients)
 }
 
 // sendError sends an error message to client.
@@ -476,6 +1528,16 @@ func (h *ProtocolHandler) sendError(clientID, sessionID, code, message string) {
 	h.sendMessage(clientID, MessageTypeError, errorData)
 }
 
+// replyError sends an error to the sender of msg, correlated with its request.
+func (h *ProtocolHandler) replyError(msg *Message, sessionID, code, message string) {
+	errorData := &ErrorData{
+		SessionID: sessionID,
+		Code:      code,
+		Message:   message,
+	}
+	h.reply(msg, MessageTypeError, errorData)
+}
+
 // notifyUserJoined notifies other clients that a user joined.
 func (h *ProtocolHandler) notifyUserJoined(sessionInfo *EditSession, clientID string) {
 	client := sessionInfo.GetClient(clientID)
@@ -488,6 +1550,7 @@ func (h *ProtocolHandler) notifyUserJoined(sessionInfo *EditSession, clientID st
 		ClientID:  clientID,
 		Client: ClientInfo{
 			ClientID:  clientID,
+			Name:      client.Name,
 			IsEditing: client.IsEditing,
 			UpdatedAt: sessionInfo.UpdatedAt,
 		},
@@ -506,6 +1569,20 @@ func (h *ProtocolHandler) notifyUserLeft(sessionInfo *EditSession, clientID stri
 	h.broadcastToSession(sessionInfo.SessionID, clientID, MessageTypeUserLeft, leftData)
 }
 
+// notifyComment records a comment change and broadcasts it to all clients,
+// including the one that made it.
+func (h *ProtocolHandler) notifyComment(sessionInfo *EditSession, action string, thread *CommentThread, clientID string) {
+	sessionInfo.RecordCommentEvent(action, thread, clientID)
+
+	eventData := &CommentEventData{
+		SessionID: sessionInfo.SessionID,
+		Action:    action,
+		ClientID:  clientID,
+		Thread:    thread,
+	}
+	h.broadcastToSession(sessionInfo.SessionID, "", MessageTypeCommentEvent, eventData)
+}
+
 // notifySessionInfo broadcasts session info to all clients.
 func (h *ProtocolHandler) notifySessionInfo(sessionInfo *EditSession) {
 	infoData := &SessionInfoData{
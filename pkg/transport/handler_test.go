@@ -0,0 +1,239 @@
+package transport
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreseekdev/texere/pkg/crdt"
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/session"
+)
+
+// TestProtocolHandler_WriteContent tests applying a whole-file write to a live session as an operation.
+func TestProtocolHandler_WriteContent(t *testing.T) {
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	node := &clusterNode{handler: handler, server: server}
+	node.connect("alice")
+
+	if _, live, err := handler.WriteContent("/write.txt", "offline", "rest"); live || err != nil {
+		t.Fatalf("Expected no live session, got live=%v (%v)", live, err)
+	}
+
+	node.send(t, "alice", MessageTypeSubscribe, &SubscribeData{FilePath: "/write.txt"})
+	var snapshot SnapshotData
+	node.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+	node.send(t, "alice", MessageTypeOperation, &OperationData{
+		SessionID: snapshot.SessionID,
+		Operation: []interface{}{"Hello world"},
+	})
+
+	revision, live, err := handler.WriteContent("/write.txt", "Hello there world", "rest")
+	if err != nil || !live || revision != 2 {
+		t.Fatalf("Expected revision 2 of a live session, got %d, live=%v (%v)", revision, live, err)
+	}
+	if content, _ := handler.ReadContent("/write.txt"); content != "Hello there world" {
+		t.Errorf("Expected the written content, got %q", content)
+	}
+
+	var remote RemoteOperationData
+	node.receive(t, "alice", MessageTypeRemoteOperation, &remote)
+	expected := []interface{}{float64(6), "there ", float64(5)}
+	if remote.ClientID != "rest" || remote.Revision != 2 || !reflect.DeepEqual(remote.Operation, expected) {
+		t.Errorf("Expected %v at revision 2 from rest, got %v at %d from %s",
+			expected, remote.Operation, remote.Revision, remote.ClientID)
+	}
+
+	// Other content types can't take whole-file writes
+	node.send(t, "alice", MessageTypeStartEditing, &StartEditingData{FilePath: "/write.json", ContentType: ContentTypeJSON})
+	if _, _, err := handler.WriteContent("/write.json", "{}", "rest"); !errors.Is(err, session.ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+}
+
+// TestProtocolHandler_TextEditsSerialized tests that operations, merges,
+// CRDT updates and whole-file writes wait for the apply lock of the
+// session, so they never apply to the same base content.
+func TestProtocolHandler_TextEditsSerialized(t *testing.T) {
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	node := &clusterNode{handler: handler, server: server}
+	var snapshot SnapshotData
+	for _, clientID := range []string{"alice", "carol"} {
+		node.connect(clientID)
+		node.send(t, clientID, MessageTypeSubscribe, &SubscribeData{FilePath: "/serial.txt"})
+		node.receive(t, clientID, MessageTypeSnapshot, &snapshot)
+	}
+	node.send(t, "carol", MessageTypeCRDTSync, &CRDTSyncData{SessionID: snapshot.SessionID})
+	es := handler.sessionManager.GetSession(snapshot.SessionID)
+
+	peer := crdt.NewBridge("")
+	peer.Doc().ApplyUpdate(es.CRDTBridge().Doc().EncodeStateAsUpdate(nil))
+	update, err := peer.ApplyOperation(ot.NewOperation().Insert("c"))
+	if err != nil {
+		t.Fatalf("Failed to make a CRDT update: %v", err)
+	}
+
+	edits := map[string]func(){
+		"operation": func() {
+			node.send(t, "alice", MessageTypeOperation, &OperationData{SessionID: snapshot.SessionID, Delta: ot.NewDelta().Insert("o", nil)})
+		},
+		"merge": func() {
+			node.send(t, "alice", MessageTypeMerge, &MergeData{SessionID: snapshot.SessionID, Base: es.GetContent(), Content: es.GetContent() + "m"})
+		},
+		"crdt_update": func() {
+			node.send(t, "carol", MessageTypeCRDTUpdate, &CRDTUpdateData{SessionID: snapshot.SessionID, Update: update})
+		},
+		"write": func() {
+			handler.WriteContent("/serial.txt", es.GetContent()+"w", "rest")
+		},
+	}
+	for name, edit := range edits {
+		es.applyMu.Lock()
+		before := es.GetCurrentVersion()
+		done := make(chan struct{})
+		go func() {
+			edit()
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Errorf("Expected %s to wait for the apply lock", name)
+		case <-time.After(20 * time.Millisecond):
+		}
+		es.applyMu.Unlock()
+		<-done
+		if es.GetCurrentVersion() != before+1 {
+			t.Errorf("Expected %s to apply once the lock was released, got revision %d after %d", name, es.GetCurrentVersion(), before)
+		}
+	}
+}
+
+// TestProtocolHandler_MergeAccess tests that only writers subscribed to a
+// session can merge into it.
+func TestProtocolHandler_MergeAccess(t *testing.T) {
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	node := &clusterNode{handler: handler, server: server}
+	node.connect("alice")
+	node.connect("reader")
+	node.connect("mallory")
+
+	var snapshot SnapshotData
+	node.send(t, "alice", MessageTypeSubscribe, &SubscribeData{FilePath: "/merge.txt"})
+	node.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+	node.send(t, "reader", MessageTypeSubscribe, &SubscribeData{FilePath: "/merge.txt", ReadOnly: true})
+	node.receive(t, "reader", MessageTypeSnapshot, &snapshot)
+
+	merge := &MergeData{SessionID: snapshot.SessionID, Content: "offline"}
+	for clientID, code := range map[string]string{"mallory": "not_subscribed", "reader": "read_only"} {
+		var errorData ErrorData
+		node.send(t, clientID, MessageTypeMerge, merge)
+		node.receive(t, clientID, MessageTypeError, &errorData)
+		if errorData.Code != code {
+			t.Errorf("Expected %s for %s, got %+v", code, clientID, errorData)
+		}
+	}
+	if content, _ := handler.ReadContent("/merge.txt"); content != "" {
+		t.Errorf("Expected the rejected merges not to change the content, got %q", content)
+	}
+
+	var result MergeResultData
+	node.send(t, "alice", MessageTypeMerge, merge)
+	node.receive(t, "alice", MessageTypeMergeResult, &result)
+	if content, _ := handler.ReadContent("/merge.txt"); content != "offline" || result.Revision != 1 {
+		t.Errorf("Expected the merge at revision 1, got %q at %d", content, result.Revision)
+	}
+}
+
+// TestProtocolHandler_FirstEditorContentType tests that the first editor
+// of a session opened by a subscriber selects its content type.
+func TestProtocolHandler_FirstEditorContentType(t *testing.T) {
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	node := &clusterNode{handler: handler, server: server}
+	node.connect("alice")
+	node.connect("bob")
+	node.connect("carol")
+
+	var snapshot SnapshotData
+	node.send(t, "bob", MessageTypeSubscribe, &SubscribeData{FilePath: "/first.json", ReadOnly: true})
+	node.receive(t, "bob", MessageTypeSnapshot, &snapshot)
+	if snapshot.ContentType != ContentTypeText {
+		t.Fatalf("Expected a text session, got %q", snapshot.ContentType)
+	}
+
+	node.send(t, "alice", MessageTypeStartEditing, &StartEditingData{FilePath: "/first.json", ContentType: ContentTypeJSON})
+	node.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+	if snapshot.ContentType != ContentTypeJSON || snapshot.Content != "{}" {
+		t.Errorf("Expected the editor to get a JSON session, got %q with %q", snapshot.ContentType, snapshot.Content)
+	}
+	node.receive(t, "bob", MessageTypeSnapshot, &snapshot)
+	if snapshot.ContentType != ContentTypeJSON || !snapshot.ReadOnly {
+		t.Errorf("Expected the subscriber to get the JSON session read-only, got %+v", snapshot)
+	}
+
+	// Later editors can't change it
+	var errorData ErrorData
+	node.send(t, "carol", MessageTypeStartEditing, &StartEditingData{FilePath: "/first.json"})
+	node.receive(t, "carol", MessageTypeError, &errorData)
+	if errorData.Code != "content_type_mismatch" {
+		t.Errorf("Expected content_type_mismatch, got %+v", errorData)
+	}
+	if es := handler.sessionManager.GetSessionByPath("/first.json"); es.ContentType() != ContentTypeJSON {
+		t.Errorf("Expected the session to stay JSON, got %q", es.ContentType())
+	}
+}
+
+// TestProtocolHandler_CRDTSync tests that only subscribed clients can sync
+// as CRDT peers, and that sweeps compact the server's replica.
+func TestProtocolHandler_CRDTSync(t *testing.T) {
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	node := &clusterNode{handler: handler, server: server}
+	node.connect("alice")
+	node.connect("bob")
+	node.connect("mallory")
+
+	var snapshot SnapshotData
+	node.send(t, "alice", MessageTypeSubscribe, &SubscribeData{FilePath: "/crdt.txt"})
+	node.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+	node.send(t, "bob", MessageTypeSubscribe, &SubscribeData{FilePath: "/crdt.txt"})
+	node.receive(t, "bob", MessageTypeSnapshot, &snapshot)
+
+	var errorData ErrorData
+	node.send(t, "mallory", MessageTypeCRDTSync, &CRDTSyncData{SessionID: snapshot.SessionID})
+	node.receive(t, "mallory", MessageTypeError, &errorData)
+	if errorData.Code != "not_subscribed" {
+		t.Errorf("Expected not_subscribed, got %+v", errorData)
+	}
+
+	var update CRDTUpdateData
+	node.send(t, "alice", MessageTypeCRDTSync, &CRDTSyncData{SessionID: snapshot.SessionID})
+	node.receive(t, "alice", MessageTypeCRDTUpdate, &update)
+	es := handler.sessionManager.GetSession(snapshot.SessionID)
+	if client := es.GetClient("alice"); client == nil || !client.CRDT {
+		t.Fatal("Expected alice to be a CRDT peer")
+	}
+
+	// Deleting characters inserted together leaves tombstones
+	for _, op := range [][]interface{}{{"abc"}, {-1, 2}, {-1, 1}} {
+		node.send(t, "bob", MessageTypeOperation, &OperationData{SessionID: snapshot.SessionID, Operation: op})
+		node.receive(t, "bob", MessageTypeAck, &AckData{})
+	}
+	before := es.CRDTBridge().Doc().ItemCount()
+	handler.sessionManager.Sweep(time.Now())
+	if after := es.CRDTBridge().Doc().ItemCount(); after >= before {
+		t.Errorf("Expected the sweep to compact the replica, got %d items before and %d after", before, after)
+	}
+	if content := es.CRDTBridge().Doc().String(); content != "c" {
+		t.Errorf("Expected the replica to keep its content, got %q", content)
+	}
+}
@@ -53,6 +53,14 @@ type HistoryService interface {
 	// Returns metadata for each snapshot (version, time, creator).
 	ListSnapshots(ctx context.Context, sessionID string) ([]*SnapshotInfo, error)
 
+	// OnComment handles comment thread events from edit sessions.
+	// Called when a thread is created, replied to, resolved, deleted or orphaned.
+	OnComment(event *HistoryEvent) error
+
+	// GetComments retrieves the latest state of all comment threads for a session.
+	// Deleted threads are omitted; orphaned threads are included.
+	GetComments(ctx context.Context, sessionID string) ([]*CommentThread, error)
+
 	// Close closes the history service and releases resources.
 	Close() error
 }
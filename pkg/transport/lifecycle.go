@@ -0,0 +1,380 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreseekdev/texere/pkg/session"
+)
+
+// ========== Session Lifecycle ==========
+
+const (
+	// DefaultHeartbeatTimeout is how long a client may go without a
+	// heartbeat before it is evicted (three missed 30-second heartbeats).
+	DefaultHeartbeatTimeout = 90 * time.Second
+
+	// DefaultSessionIdleTTL is how long a session without clients is kept
+	// before it is flushed and destroyed.
+	DefaultSessionIdleTTL = 10 * time.Minute
+)
+
+var (
+	// ErrSessionLimit is returned when opening a document would exceed
+	// LifecycleConfig.MaxSessions.
+	ErrSessionLimit = &TransportError{Code: "session_limit", Message: "too many open documents"}
+
+	// ErrClientLimit is returned when a client would exceed
+	// LifecycleConfig.MaxClientsPerSession or MaxClients.
+	ErrClientLimit = &TransportError{Code: "client_limit", Message: "too many clients"}
+)
+
+// LifecycleConfig configures client eviction, idle session cleanup and
+// limits of a SessionManager. Zero values disable the setting.
+type LifecycleConfig struct {
+	// HeartbeatTimeout evicts clients that sent no heartbeat for this long.
+	HeartbeatTimeout time.Duration
+
+	// SessionIdleTTL flushes and destroys sessions that had no clients for
+	// this long.
+	SessionIdleTTL time.Duration
+
+	// JanitorInterval is how often the janitor runs. Zero runs it at half
+	// the shorter of HeartbeatTimeout and SessionIdleTTL.
+	JanitorInterval time.Duration
+
+	MaxClientsPerSession int // Clients in one session
+	MaxClients           int // Distinct clients in all sessions
+	MaxSessions          int // Open documents
+}
+
+// DefaultLifecycleConfig returns the default timeouts and no limits.
+func DefaultLifecycleConfig() LifecycleConfig {
+	return LifecycleConfig{
+		HeartbeatTimeout: DefaultHeartbeatTimeout,
+		SessionIdleTTL:   DefaultSessionIdleTTL,
+	}
+}
+
+// interval returns how often the janitor runs, or 0 if it has nothing
+// to do.
+func (c LifecycleConfig) interval() time.Duration {
+	if c.JanitorInterval > 0 {
+		return c.JanitorInterval
+	}
+	shortest := c.HeartbeatTimeout
+	if shortest <= 0 || (c.SessionIdleTTL > 0 && c.SessionIdleTTL < shortest) {
+		shortest = c.SessionIdleTTL
+	}
+	if shortest <= 0 {
+		return 0
+	}
+	if shortest/2 < time.Second {
+		return time.Second
+	}
+	return shortest / 2
+}
+
+// EvictedClient is a client removed from a session by the janitor.
+type EvictedClient struct {
+	Session *EditSession
+	Client  *SessionClient
+}
+
+// SweepResult reports what a janitor run did.
+type SweepResult struct {
+	Evicted   []EvictedClient
+	Destroyed []string // IDs of destroyed sessions
+	Errors    []error  // Sessions that failed to flush; they are kept
+}
+
+// ContentSaver is implemented by content storages that can save files;
+// idle sessions are flushed to it before they are destroyed.
+type ContentSaver interface {
+	Save(ctx context.Context, contentPath string, model *session.ContentModel, options *session.SaveOptions) (*session.ContentModel, error)
+}
+
+// janitor runs Sweep periodically.
+type janitor struct {
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// SetLifecycleConfig sets the eviction timeouts and limits.
+// A running janitor picks up the new timeouts on its next run.
+func (sm *SessionManager) SetLifecycleConfig(config LifecycleConfig) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.lifecycle = config
+}
+
+// LifecycleConfig returns the eviction timeouts and limits.
+func (sm *SessionManager) LifecycleConfig() LifecycleConfig {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.lifecycle
+}
+
+// OpenSession gets the session for a file, creating it unless that would
+// exceed MaxSessions.
+func (sm *SessionManager) OpenSession(filePath string) (*EditSession, bool, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if es := sm.sessionByPath(filePath); es != nil {
+		return es, false, nil
+	}
+	if max := sm.lifecycle.MaxSessions; max > 0 && len(sm.sessions) >= max {
+		return nil, false, ErrSessionLimit
+	}
+	return sm.createSession(filePath), true, nil
+}
+
+// AdmitClient checks that a client may join a session without exceeding
+// the client limits. Clients already in the session are always admitted.
+func (sm *SessionManager) AdmitClient(es *EditSession, clientID string) error {
+	if es.GetClient(clientID) != nil {
+		return nil
+	}
+
+	sm.mu.RLock()
+	config := sm.lifecycle
+	sm.mu.RUnlock()
+
+	if config.MaxClientsPerSession > 0 && es.ClientCount() >= config.MaxClientsPerSession {
+		return fmt.Errorf("%w: %d in %s", ErrClientLimit, config.MaxClientsPerSession, es.FilePath)
+	}
+	if config.MaxClients > 0 {
+		clients := sm.clientIDs()
+		if _, ok := clients[clientID]; !ok && len(clients) >= config.MaxClients {
+			return fmt.Errorf("%w: %d connected", ErrClientLimit, config.MaxClients)
+		}
+	}
+	return nil
+}
+
+// ClientCount returns the number of distinct clients in all sessions.
+func (sm *SessionManager) ClientCount() int {
+	return len(sm.clientIDs())
+}
+
+// clientIDs returns the IDs of the clients in all sessions.
+func (sm *SessionManager) clientIDs() map[string]struct{} {
+	ids := make(map[string]struct{})
+	for _, es := range sm.ListSessions() {
+		es.mu.RLock()
+		for id := range es.Clients {
+			ids[id] = struct{}{}
+		}
+		es.mu.RUnlock()
+	}
+	return ids
+}
+
+// Sweep compacts the CRDT replicas, evicts clients whose last heartbeat
+// is older than HeartbeatTimeout, then flushes and destroys sessions that
+// have had no clients for SessionIdleTTL. It is called by the janitor,
+// and can be called directly, e.g. in tests.
+func (sm *SessionManager) Sweep(now time.Time) *SweepResult {
+	sm.mu.RLock()
+	config := sm.lifecycle
+	sm.mu.RUnlock()
+
+	result := &SweepResult{}
+	for _, es := range sm.ListSessions() {
+		es.CompactCRDT()
+
+		if config.HeartbeatTimeout > 0 {
+			deadline := now.Add(-config.HeartbeatTimeout).Unix()
+			for _, client := range es.evictClients(deadline, now.Unix()) {
+				result.Evicted = append(result.Evicted, EvictedClient{Session: es, Client: client})
+			}
+		}
+
+		if config.SessionIdleTTL > 0 && es.idleSince(now.Add(-config.SessionIdleTTL).Unix()) {
+			if err := sm.flushSession(es); err != nil {
+				result.Errors = append(result.Errors, fmt.Errorf("flush %s: %w", es.FilePath, err))
+				continue
+			}
+			if sm.destroyIdleSession(es) {
+				result.Destroyed = append(result.Destroyed, es.SessionID)
+			}
+		}
+	}
+	return result
+}
+
+// StartJanitor runs Sweep in the background at the configured interval
+// and passes each result with evictions or destroyed sessions to
+// onSweep, which may be nil. It does nothing if the janitor is already
+// running or the configuration disables it.
+func (sm *SessionManager) StartJanitor(onSweep func(*SweepResult)) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	interval := sm.lifecycle.interval()
+	if sm.janitor != nil || interval <= 0 {
+		return
+	}
+	j := &janitor{stop: make(chan struct{})}
+	sm.janitor = j
+
+	j.done.Add(1)
+	go func() {
+		defer j.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-j.stop:
+				return
+			case now := <-ticker.C:
+				result := sm.Sweep(now)
+				if onSweep != nil && (len(result.Evicted) > 0 || len(result.Destroyed) > 0 || len(result.Errors) > 0) {
+					onSweep(result)
+				}
+			}
+		}
+	}()
+}
+
+// StopJanitor stops the janitor and waits for a running sweep to finish.
+func (sm *SessionManager) StopJanitor() {
+	sm.mu.Lock()
+	j := sm.janitor
+	sm.janitor = nil
+	sm.mu.Unlock()
+
+	if j != nil {
+		close(j.stop)
+		j.done.Wait()
+	}
+}
+
+// flushSession snapshots unsaved changes to the history listener and
+// saves the content if the storage can save. The changes count as saved
+// only once the save succeeded, so a failed save is retried.
+func (sm *SessionManager) flushSession(es *EditSession) error {
+	version, changed := es.Flush()
+	if !changed {
+		return nil
+	}
+	if err := sm.saveContent(es); err != nil {
+		return err
+	}
+	es.markFlushed(version)
+	return nil
+}
+
+// saveContent saves the content of a session if the storage can save.
+func (sm *SessionManager) saveContent(es *EditSession) error {
+	sm.mu.RLock()
+	saver, ok := sm.contentStorage.(ContentSaver)
+	sm.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	ctx := context.Background()
+	model := &session.ContentModel{Type: "file", Format: "text"}
+	if getter, ok := saver.(ContentStorage); ok {
+		if existing, err := getter.Get(ctx, es.FilePath, nil); err == nil && existing != nil {
+			copied := *existing
+			model = &copied
+		}
+	}
+	model.Content = es.GetContent()
+	model.Size = int64(len(model.Content))
+	_, err := saver.Save(ctx, es.FilePath, model, &session.SaveOptions{Overwrite: true})
+	return err
+}
+
+// destroyIdleSession destroys a session unless a client joined it since
+// it was found idle.
+func (sm *SessionManager) destroyIdleSession(es *EditSession) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.sessions[es.SessionID] != es || es.ClientCount() > 0 {
+		return false
+	}
+	delete(sm.byPath, es.FilePath)
+	delete(sm.sessions, es.SessionID)
+	es.log().Info("idle session destroyed", LogKeyRevision, es.GetCurrentVersion())
+	return true
+}
+
+// ---------- EditSession ----------
+
+// ClientCount returns the number of clients in the session.
+func (es *EditSession) ClientCount() int {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	return len(es.Clients)
+}
+
+// Touch records activity of a client, like a heartbeat.
+func (es *EditSession) Touch(clientID string) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if client := es.Clients[clientID]; client != nil {
+		client.LastSeen = time.Now().Unix()
+	}
+}
+
+// Flush snapshots changes made since the last snapshot, forwarding them
+// to the history listener. It returns the current version, and true if
+// the content changed since the version last passed to markFlushed.
+func (es *EditSession) Flush() (int64, bool) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if len(es.recentChanges) > 0 {
+		es.createSnapshot("", "")
+	}
+	return es.currentVersion, es.currentVersion != es.flushedVersion
+}
+
+// markFlushed records that the content up to version has been saved.
+func (es *EditSession) markFlushed(version int64) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if version > es.flushedVersion {
+		es.flushedVersion = version
+	}
+}
+
+// evictClients removes the clients last seen before deadline and
+// returns them. Their reader or writer references are released.
+func (es *EditSession) evictClients(deadline, now int64) []*SessionClient {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	var evicted []*SessionClient
+	for id, client := range es.Clients {
+		if client.LastSeen >= deadline {
+			continue
+		}
+		delete(es.Clients, id)
+		if client.ReadOnly {
+			es.RefCount.RemoveReader()
+		} else {
+			es.RefCount.RemoveWriter()
+		}
+		evicted = append(evicted, client)
+	}
+	if len(evicted) > 0 {
+		es.UpdatedAt = now
+	}
+	return evicted
+}
+
+// idleSince returns true if the session has no clients and has not been
+// updated since the given time.
+func (es *EditSession) idleSince(t int64) bool {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	return len(es.Clients) == 0 && es.UpdatedAt <= t
+}
@@ -0,0 +1,231 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coreseekdev/texere/pkg/session"
+)
+
+// TestSessionManager_SweepEvictsStaleClients tests evicting clients after a heartbeat timeout.
+func TestSessionManager_SweepEvictsStaleClients(t *testing.T) {
+	sm := NewSessionManager()
+	sm.SetLifecycleConfig(LifecycleConfig{HeartbeatTimeout: time.Minute})
+	es, _ := sm.GetOrCreateSession("/test.txt")
+
+	now := time.Now()
+	es.RefCount.AddWriter()
+	es.AddClient("alive", &SessionClient{ClientID: "alive"})
+	es.RefCount.AddReader()
+	es.AddClient("crashed", &SessionClient{ClientID: "crashed", ReadOnly: true, LastSeen: now.Add(-2 * time.Minute).Unix()})
+
+	result := sm.Sweep(now)
+	if len(result.Evicted) != 1 || result.Evicted[0].Client.ClientID != "crashed" {
+		t.Fatalf("Expected crashed client to be evicted, got %+v", result.Evicted)
+	}
+	if es.GetClient("crashed") != nil || es.GetClient("alive") == nil {
+		t.Error("Expected only the crashed client to be removed")
+	}
+	if es.RefCount.ReaderCount != 0 || es.RefCount.WriterCount != 1 {
+		t.Errorf("Expected 0 readers and 1 writer, got %d and %d", es.RefCount.ReaderCount, es.RefCount.WriterCount)
+	}
+	if len(result.Destroyed) != 0 {
+		t.Error("Expected no session to be destroyed without an idle TTL")
+	}
+}
+
+// TestSessionManager_SweepDestroysIdleSessions tests flushing and destroying idle sessions.
+func TestSessionManager_SweepDestroysIdleSessions(t *testing.T) {
+	storage := session.NewMemoryContentStorage()
+	ctx := context.Background()
+	storage.Save(ctx, "/idle.txt", &session.ContentModel{Name: "idle.txt", Type: "file", Content: "Hello"}, nil)
+
+	sm := NewSessionManager()
+	sm.SetContentStorage(storage)
+	sm.SetLifecycleConfig(LifecycleConfig{HeartbeatTimeout: time.Minute, SessionIdleTTL: 10 * time.Minute})
+
+	idle, _ := sm.GetOrCreateSession("/idle.txt")
+	idle.SetContent("Hello World")
+	idle.AddOperation([]interface{}{5, " World"}, "client-1")
+	busy, _ := sm.GetOrCreateSession("/busy.txt")
+	busy.AddClient("client-2", &SessionClient{ClientID: "client-2"})
+
+	// Not idle for long enough yet; client-2 stopped heartbeating
+	result := sm.Sweep(time.Now().Add(5 * time.Minute))
+	if len(result.Destroyed) != 0 {
+		t.Fatalf("Expected no session to be destroyed yet, got %v", result.Destroyed)
+	}
+	if len(result.Evicted) != 1 || result.Evicted[0].Client.ClientID != "client-2" {
+		t.Fatalf("Expected client-2 to be evicted, got %+v", result.Evicted)
+	}
+
+	result = sm.Sweep(time.Now().Add(11 * time.Minute))
+	if len(result.Destroyed) != 1 || result.Destroyed[0] != idle.SessionID {
+		t.Fatalf("Expected the idle session to be destroyed, got %v", result.Destroyed)
+	}
+	if sm.GetSessionByPath("/idle.txt") != nil || sm.GetSessionByPath("/busy.txt") == nil {
+		t.Error("Expected only the idle session to be destroyed")
+	}
+
+	model, err := storage.Get(ctx, "/idle.txt", nil)
+	if err != nil || model.Content != "Hello World" || model.Name != "idle.txt" {
+		t.Errorf("Expected the idle session to be saved, got %+v, %v", model, err)
+	}
+
+	// The session client-2 was evicted from has been idle since the eviction
+	result = sm.Sweep(time.Now().Add(16 * time.Minute))
+	if len(result.Destroyed) != 1 || result.Destroyed[0] != busy.SessionID {
+		t.Errorf("Expected the evicted session to be destroyed after the TTL, got %v", result.Destroyed)
+	}
+}
+
+// flakySaver is a content storage whose first saves fail.
+type flakySaver struct {
+	*session.MemoryContentStorage
+	failures int
+	saved    []string
+}
+
+func (f *flakySaver) Save(ctx context.Context, contentPath string, model *session.ContentModel, options *session.SaveOptions) (*session.ContentModel, error) {
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("disk full")
+	}
+	f.saved = append(f.saved, model.Content)
+	return model, nil
+}
+
+// TestSessionManager_SweepRetriesFailedSaves tests that an idle session
+// whose save failed is kept and saved on the next sweep.
+func TestSessionManager_SweepRetriesFailedSaves(t *testing.T) {
+	saver := &flakySaver{MemoryContentStorage: session.NewMemoryContentStorage(), failures: 1}
+	sm := NewSessionManager()
+	sm.SetContentStorage(saver)
+	sm.SetLifecycleConfig(LifecycleConfig{SessionIdleTTL: time.Minute})
+
+	es, _ := sm.GetOrCreateSession("/flaky.txt")
+	es.SetContent("unsaved")
+	es.AddOperation([]interface{}{"unsaved"}, "client-1")
+
+	result := sm.Sweep(time.Now().Add(2 * time.Minute))
+	if len(result.Errors) != 1 || len(result.Destroyed) != 0 {
+		t.Fatalf("Expected the failed save to keep the session, got %+v", result)
+	}
+
+	result = sm.Sweep(time.Now().Add(3 * time.Minute))
+	if len(result.Errors) != 0 || len(result.Destroyed) != 1 {
+		t.Fatalf("Expected the session to be saved and destroyed, got %+v", result)
+	}
+	if len(saver.saved) != 1 || saver.saved[0] != "unsaved" {
+		t.Errorf("Expected the content to be saved on retry, got %v", saver.saved)
+	}
+}
+
+// TestSessionManager_Limits tests document and client limits.
+func TestSessionManager_Limits(t *testing.T) {
+	sm := NewSessionManager()
+	sm.SetLifecycleConfig(LifecycleConfig{MaxSessions: 2, MaxClientsPerSession: 2, MaxClients: 3})
+
+	a, isNew, err := sm.OpenSession("/a.txt")
+	if err != nil || !isNew {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	b, _, _ := sm.OpenSession("/b.txt")
+	if _, _, err := sm.OpenSession("/c.txt"); !errors.Is(err, ErrSessionLimit) {
+		t.Errorf("Expected ErrSessionLimit, got %v", err)
+	}
+	if again, isNew, err := sm.OpenSession("/a.txt"); err != nil || isNew || again != a {
+		t.Errorf("Expected to reopen the existing session, got %v", err)
+	}
+
+	join := func(es *EditSession, clientID string) error {
+		if err := sm.AdmitClient(es, clientID); err != nil {
+			return err
+		}
+		es.AddClient(clientID, &SessionClient{ClientID: clientID})
+		return nil
+	}
+	join(a, "c1")
+	join(a, "c2")
+	if err := join(a, "c3"); !errors.Is(err, ErrClientLimit) {
+		t.Errorf("Expected per-session ErrClientLimit, got %v", err)
+	}
+	if err := sm.AdmitClient(a, "c1"); err != nil {
+		t.Errorf("Expected a client already in the session to be admitted, got %v", err)
+	}
+
+	join(b, "c3")
+	if err := join(b, "c4"); !errors.Is(err, ErrClientLimit) {
+		t.Errorf("Expected global ErrClientLimit, got %v", err)
+	}
+	if err := join(b, "c1"); err != nil {
+		t.Errorf("Expected a connected client to join another session, got %v", err)
+	}
+}
+
+// TestProtocolHandler_EvictionBroadcastsUserLeft tests that evicted clients are announced.
+func TestProtocolHandler_EvictionBroadcastsUserLeft(t *testing.T) {
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	handler.sessionManager.SetLifecycleConfig(LifecycleConfig{HeartbeatTimeout: time.Minute, MaxClientsPerSession: 2})
+	node := &clusterNode{handler: handler, server: server}
+
+	for _, clientID := range []string{"alice", "bob", "carol"} {
+		node.connect(clientID)
+		node.send(t, clientID, MessageTypeSubscribe, &SubscribeData{FilePath: "/shared.txt"})
+	}
+	var errData ErrorData
+	node.receive(t, "carol", MessageTypeError, &errData)
+	if errData.Code != "client_limit" {
+		t.Fatalf("Expected client_limit error for carol, got %q", errData.Code)
+	}
+
+	// Only alice keeps heartbeating
+	es := handler.sessionManager.GetSessionByPath("/shared.txt")
+	later := time.Now().Add(2 * time.Minute)
+	es.GetClient("alice").LastSeen = later.Unix()
+	handler.handleSweep(handler.sessionManager.Sweep(later))
+
+	var left UserLeftData
+	node.receive(t, "alice", MessageTypeUserLeft, &left)
+	if left.ClientID != "bob" || left.SessionID != es.SessionID {
+		t.Errorf("Expected bob to leave %s, got %+v", es.SessionID, left)
+	}
+	node.receive(t, "bob", MessageTypeError, &errData)
+	if errData.Code != "heartbeat_timeout" {
+		t.Errorf("Expected heartbeat_timeout error for bob, got %q", errData.Code)
+	}
+}
+
+// TestProtocolHandler_BroadcastDuringEviction tests that broadcasts don't
+// race with the janitor removing clients; run it with -race.
+func TestProtocolHandler_BroadcastDuringEviction(t *testing.T) {
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	handler.sessionManager.SetLifecycleConfig(LifecycleConfig{HeartbeatTimeout: time.Minute})
+	node := &clusterNode{handler: handler, server: server}
+
+	var snapshot SnapshotData
+	node.connect("alice")
+	node.send(t, "alice", MessageTypeSubscribe, &SubscribeData{FilePath: "/race.txt"})
+	node.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+	es := handler.sessionManager.GetSession(snapshot.SessionID)
+	for i := 0; i < 50; i++ {
+		es.AddClient(fmt.Sprintf("stale-%d", i), &SessionClient{ClientID: fmt.Sprintf("stale-%d", i)})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.sessionManager.Sweep(time.Now().Add(2 * time.Minute))
+	}()
+	for i := 0; i < 50; i++ {
+		handler.broadcastToSession(snapshot.SessionID, "", MessageTypeSessionInfo, &SessionInfoData{SessionID: snapshot.SessionID})
+	}
+	<-done
+}
@@ -0,0 +1,91 @@
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+)
+
+// ========== Logging ==========
+
+// Attribute keys of structured log records, so logs of all components can
+// be queried the same way.
+const (
+	LogKeyComponent = "component"
+	LogKeyClient    = "client_id"
+	LogKeySession   = "session_id"
+	LogKeyFile      = "file_path"
+	LogKeyRevision  = "revision"
+	LogKeyTrace     = "trace_id"
+	LogKeyType      = "type"
+	LogKeyError     = "error"
+)
+
+// logContent is set to log document content and message bodies verbatim.
+var logContent atomic.Bool
+
+// SetLogContent sets whether logs include document content and message
+// bodies. They are redacted by default, since documents may hold anything;
+// enable it only to debug locally.
+func SetLogContent(enabled bool) {
+	logContent.Store(enabled)
+}
+
+// redacted is content that is logged as its size unless SetLogContent
+// is enabled.
+type redacted string
+
+// LogValue implements slog.LogValuer.
+func (r redacted) LogValue() slog.Value {
+	if logContent.Load() {
+		return slog.StringValue(string(r))
+	}
+	return slog.StringValue(fmt.Sprintf("[redacted %d bytes]", len(r)))
+}
+
+// redactedBytes is a message body logged like redacted. It is only
+// converted to a string when a record is handled.
+type redactedBytes []byte
+
+// LogValue implements slog.LogValuer.
+func (r redactedBytes) LogValue() slog.Value {
+	if logContent.Load() {
+		return slog.StringValue(string(r))
+	}
+	return slog.StringValue(fmt.Sprintf("[redacted %d bytes]", len(r)))
+}
+
+// redactedValue is a value logged like redacted. It is only formatted
+// with fmt.Sprint when a record is handled.
+type redactedValue struct {
+	value interface{}
+}
+
+// LogValue implements slog.LogValuer.
+func (r redactedValue) LogValue() slog.Value {
+	return redacted(fmt.Sprint(r.value)).LogValue()
+}
+
+// Redact returns a log value for document content or a message body.
+func Redact(content string) slog.LogValuer {
+	return redacted(content)
+}
+
+// componentLogger returns logger, or the default logger if it is nil,
+// tagged with a component.
+func componentLogger(logger *slog.Logger, component string) *slog.Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger.With(LogKeyComponent, component)
+}
+
+// newTraceID returns a random ID correlating the log records of one
+// message from its receipt to the broadcast of its result.
+func newTraceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
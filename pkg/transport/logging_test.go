@@ -0,0 +1,147 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingHistory is a history listener that passes operation events to a channel.
+type recordingHistory struct {
+	operations chan *HistoryEvent
+}
+
+func (r *recordingHistory) OnSnapshot(*HistoryEvent) error { return nil }
+func (r *recordingHistory) OnOperation(event *HistoryEvent) error {
+	r.operations <- event
+	return nil
+}
+func (r *recordingHistory) Close() error { return nil }
+
+// nextProtocolMessage returns the next message of a type queued for a client.
+func nextProtocolMessage(t *testing.T, node *clusterNode, clientID string, msgType MessageType) ProtocolMessage {
+	t.Helper()
+	for {
+		msg, ok := node.server.clients[clientID].queue.pop()
+		if !ok {
+			t.Fatalf("Client %s did not receive %s", clientID, msgType)
+		}
+		pm := ProtocolMessage{}
+		json.Unmarshal(flattenEnvelope([]byte(msg.Metadata["raw_json"].(string))), &pm)
+		if pm.Type == msgType {
+			return pm
+		}
+	}
+}
+
+// TestProtocolHandler_TraceID tests that the trace ID of an operation
+// reaches its ack, history event, broadcast and logs, and that content is
+// redacted from the logs.
+func TestProtocolHandler_TraceID(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	handler := NewProtocolHandler(nil, nil)
+	handler.SetLogger(logger)
+	history := &recordingHistory{operations: make(chan *HistoryEvent, 1)}
+	handler.SetHistoryListener(history)
+	server := NewWebSocketServer("")
+	server.SetLogger(logger)
+	handler.SetServer(server)
+
+	node := &clusterNode{handler: handler, server: server}
+	node.connect("alice")
+	node.connect("bob")
+	var snapshot SnapshotData
+	node.send(t, "alice", MessageTypeSubscribe, &SubscribeData{FilePath: "/trace.txt"})
+	node.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+	node.send(t, "bob", MessageTypeSubscribe, &SubscribeData{FilePath: "/trace.txt"})
+	node.receive(t, "bob", MessageTypeSnapshot, &snapshot)
+
+	pm, _ := NewProtocolMessage(MessageTypeOperation, "", &OperationData{
+		SessionID: snapshot.SessionID,
+		Operation: []interface{}{"top secret"},
+	})
+	pm.TraceID = "trace-1"
+	raw, _ := json.Marshal(pm)
+	handler.handleRawMessage("alice", raw)
+
+	if ack := nextProtocolMessage(t, node, "alice", MessageTypeAck); ack.TraceID != "trace-1" {
+		t.Errorf("Expected the ack to carry trace-1, got %q", ack.TraceID)
+	}
+	if remote := nextProtocolMessage(t, node, "bob", MessageTypeRemoteOperation); remote.TraceID != "trace-1" {
+		t.Errorf("Expected the broadcast to carry trace-1, got %q", remote.TraceID)
+	}
+	select {
+	case event := <-history.operations:
+		if event.TraceID != "trace-1" {
+			t.Errorf("Expected the history event to carry trace-1, got %q", event.TraceID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a history event")
+	}
+
+	var applied map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]interface{}
+		json.Unmarshal([]byte(line), &record)
+		if record["msg"] == "operation applied" {
+			applied = record
+		}
+	}
+	if applied == nil || applied[LogKeyTrace] != "trace-1" || applied[LogKeySession] != snapshot.SessionID ||
+		applied[LogKeyRevision] != float64(1) || applied[LogKeyClient] != "alice" {
+		t.Errorf("Expected an operation applied record with trace, session, revision and client, got %v", applied)
+	}
+	if strings.Contains(logs.String(), "top secret") {
+		t.Errorf("Expected content to be redacted, got:\n%s", logs.String())
+	}
+
+	// Messages without a trace ID get one
+	logs.Reset()
+	node.send(t, "alice", MessageTypeOperation, &OperationData{SessionID: snapshot.SessionID, Operation: []interface{}{10, "!"}})
+	if ack := nextProtocolMessage(t, node, "alice", MessageTypeAck); ack.TraceID == "" {
+		t.Error("Expected a generated trace ID")
+	}
+}
+
+// countingStringer counts how often it is formatted.
+type countingStringer struct {
+	calls *int
+}
+
+func (c countingStringer) String() string {
+	*c.calls++
+	return "hello"
+}
+
+// TestRedact tests that content is only logged when enabled, and only
+// formatted when a record is handled.
+func TestRedact(t *testing.T) {
+	calls := 0
+	values := []slog.LogValuer{Redact("hello"), redactedBytes("hello"), redactedValue{countingStringer{&calls}}}
+	for _, value := range values {
+		if got := value.LogValue().String(); got != "[redacted 5 bytes]" {
+			t.Errorf("Expected a redacted value, got %q", got)
+		}
+	}
+
+	calls = 0
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	logger.Debug("operation received", "operation", redactedValue{countingStringer{&calls}})
+	if calls != 0 || logs.Len() != 0 {
+		t.Errorf("Expected a disabled record not to format its content, got %d calls", calls)
+	}
+
+	SetLogContent(true)
+	defer SetLogContent(false)
+	for _, value := range values {
+		if got := value.LogValue().String(); got != "hello" {
+			t.Errorf("Expected the content, got %q", got)
+		}
+	}
+}
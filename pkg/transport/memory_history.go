@@ -3,33 +3,62 @@ package transport
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"sync"
+
+	"github.com/coreseekdev/texere/pkg/rope"
 )
 
 // MemoryHistoryService provides an in-memory history service implementation.
 // Useful for testing and single-instance deployments.
 type MemoryHistoryService struct {
-	mu            sync.RWMutex
-	snapshots     map[string]map[int64]*HistoryEvent // sessionID -> versionID -> event
-	operations    map[string][]*HistoryEvent         // sessionID -> operations
-	eventChan     chan *HistoryEvent
-	closed        bool
-	wg            sync.WaitGroup
-	closeChan     chan struct{}
-	usePatchMode  bool
-	patchManager  *PatchManager
+	mu           sync.RWMutex
+	snapshots    map[string]map[int64]*HistoryEvent // sessionID -> versionID -> event
+	operations   map[string][]*HistoryEvent         // sessionID -> operations
+	comments     map[string][]*HistoryEvent         // sessionID -> comment events
+	eventChan    chan *HistoryEvent
+	closed       bool
+	wg           sync.WaitGroup
+	closeChan    chan struct{}
+	usePatchMode bool
+	patchManager *PatchManager
+	logger       *slog.Logger
 }
 
 // NewMemoryHistoryService creates a new in-memory history service.
 func NewMemoryHistoryService(usePatchMode bool) *MemoryHistoryService {
-	return &MemoryHistoryService{
+	service := &MemoryHistoryService{
 		snapshots:    make(map[string]map[int64]*HistoryEvent),
 		operations:   make(map[string][]*HistoryEvent),
+		comments:     make(map[string][]*HistoryEvent),
 		eventChan:    make(chan *HistoryEvent, 1000),
 		closeChan:    make(chan struct{}),
 		usePatchMode: usePatchMode,
 		patchManager: NewPatchManager(),
+		logger:       componentLogger(nil, "history"),
 	}
+
+	// Start event processor
+	service.wg.Add(1)
+	go service.processEvents()
+
+	return service
+}
+
+// SetLogger sets the logger of the service. It defaults to slog.Default().
+func (s *MemoryHistoryService) SetLogger(logger *slog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger = componentLogger(logger, "history")
+}
+
+// dropEvent logs an event that did not fit in the event channel.
+func (s *MemoryHistoryService) dropEvent(event *HistoryEvent) error {
+	s.mu.RLock()
+	s.logger.Warn("event channel full, dropping event", LogKeySession, event.SessionID,
+		LogKeyRevision, event.VersionID, LogKeyTrace, event.TraceID, "event", event.EventType)
+	s.mu.RUnlock()
+	return fmt.Errorf("event channel full")
 }
 
 // OnSnapshot handles snapshot events.
@@ -42,7 +71,7 @@ func (s *MemoryHistoryService) OnSnapshot(event *HistoryEvent) error {
 	case s.eventChan <- event:
 		return nil
 	default:
-		return fmt.Errorf("event channel full")
+		return s.dropEvent(event)
 	}
 }
 
@@ -56,7 +85,21 @@ func (s *MemoryHistoryService) OnOperation(event *HistoryEvent) error {
 	case s.eventChan <- event:
 		return nil
 	default:
-		return fmt.Errorf("event channel full")
+		return s.dropEvent(event)
+	}
+}
+
+// OnComment handles comment thread events.
+func (s *MemoryHistoryService) OnComment(event *HistoryEvent) error {
+	if s.closed {
+		return fmt.Errorf("history service is closed")
+	}
+
+	select {
+	case s.eventChan <- event:
+		return nil
+	default:
+		return s.dropEvent(event)
 	}
 }
 
@@ -96,7 +139,7 @@ func (s *MemoryHistoryService) handleEvent(event *HistoryEvent) {
 			lastVersion := s.findLastSnapshotVersion(event.SessionID)
 			if lastSnapshot, ok := s.snapshots[event.SessionID][lastVersion]; ok {
 				// Compute and store patch
-				patchResult := s.patchManager.ComputePatch(lastSnapshot.Content, event.Content)
+				patchResult := s.patchManager.ComputeRopePatch(rope.NewChunked(lastSnapshot.Content), rope.NewChunked(event.Content))
 				event.Content = "" // Clear content
 				// Store patch in metadata
 				if event.Metadata == nil {
@@ -111,7 +154,12 @@ func (s *MemoryHistoryService) handleEvent(event *HistoryEvent) {
 
 	case "operation":
 		s.operations[event.SessionID] = append(s.operations[event.SessionID], event)
+
+	case "comment":
+		s.comments[event.SessionID] = append(s.comments[event.SessionID], event)
 	}
+	s.logger.Debug("stored event", LogKeySession, event.SessionID, LogKeyRevision, event.VersionID,
+		LogKeyTrace, event.TraceID, "event", event.EventType)
 }
 
 // findLastSnapshotVersion finds the last snapshot version for a session.
@@ -207,6 +255,14 @@ func (s *MemoryHistoryService) ReconstructSnapshot(ctx context.Context, sessionI
 	return content, nil
 }
 
+// GetComments retrieves the latest state of all comment threads for a session.
+func (s *MemoryHistoryService) GetComments(ctx context.Context, sessionID string) ([]*CommentThread, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return CommentThreadsFromEvents(s.comments[sessionID]), nil
+}
+
 // ListSnapshots lists all snapshots for a session.
 func (s *MemoryHistoryService) ListSnapshots(ctx context.Context, sessionID string) ([]*SnapshotInfo, error) {
 	s.mu.RLock()
@@ -220,7 +276,7 @@ func (s *MemoryHistoryService) ListSnapshots(ctx context.Context, sessionID stri
 	infos := make([]*SnapshotInfo, 0, len(snapshots))
 	for _, event := range snapshots {
 		infos = append(infos, &SnapshotInfo{
-			SnapshotVersion: event.VersionID,
+			SnapshotVersion:  event.VersionID,
 			LastSnapshotTime: event.CreatedAt,
 		})
 	}
@@ -0,0 +1,236 @@
+package transport
+
+import (
+	"context"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coreseekdev/texere/pkg/metrics"
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/rope"
+)
+
+// ========== Metrics ==========
+
+// Metric names recorded by the protocol handler and the WebSocket server.
+const (
+	MetricOperations          = "texere_operations_total"                 // Counter by file and content_type
+	MetricApplySeconds        = "texere_operation_apply_seconds"          // Histogram by content_type
+	MetricTransformSeconds    = "texere_operation_transform_seconds"      // Histogram by kind (merge, crdt)
+	MetricMessages            = "texere_messages_total"                   // Counter by type
+	MetricHandleSeconds       = "texere_message_handle_seconds"           // Histogram by type
+	MetricBroadcastRecipients = "texere_broadcast_recipients"             // Histogram by type
+	MetricSessions            = "texere_sessions"                         // Gauge
+	MetricSessionClients      = "texere_session_clients"                  // Gauge by file
+	MetricQueueMessages       = "texere_websocket_queue_messages"         // Gauge, all queues
+	MetricQueueBytes          = "texere_websocket_queue_bytes"            // Gauge, all queues
+	MetricQueueMaxMessages    = "texere_websocket_queue_max_messages"     // Gauge, deepest queue
+	MetricQueueDropped        = "texere_websocket_dropped_total"          // Counter
+	MetricQueueCoalesced      = "texere_websocket_coalesced_total"        // Counter
+	MetricQueueSnapshots      = "texere_websocket_queue_snapshots_total"  // Counter
+	MetricQueueDisconnects    = "texere_websocket_slow_disconnects_total" // Counter
+	MetricHistoryWriteSeconds = "texere_history_write_seconds"            // Histogram by event
+	MetricHistoryFailures     = "texere_history_write_failures_total"     // Counter by event
+	MetricSnapshotBytes       = "texere_snapshot_bytes"                   // Histogram
+	MetricLimitViolations     = "texere_limit_violations_total"           // Counter by limit
+	MetricLimitDisconnects    = "texere_limit_disconnects_total"          // Counter
+)
+
+// DescribeMetrics sets the help text and buckets of the transport metrics
+// in a registry.
+func DescribeMetrics(r *metrics.Registry) {
+	r.Describe(MetricOperations, "Operations applied to live sessions. rate() gives operations per second per session.")
+	r.Describe(MetricApplySeconds, "Time to apply an operation to a session and record it.", metrics.LatencyBuckets...)
+	r.Describe(MetricTransformSeconds, "Time to rebase offline merges and CRDT updates onto the live document.", metrics.LatencyBuckets...)
+	r.Describe(MetricMessages, "Protocol messages handled, by type.")
+	r.Describe(MetricHandleSeconds, "Time to handle a protocol message, by type.", metrics.LatencyBuckets...)
+	r.Describe(MetricBroadcastRecipients, "Clients a broadcast was sent to, by message type.", metrics.CountBuckets...)
+	r.Describe(MetricSessions, "Live edit sessions.")
+	r.Describe(MetricSessionClients, "Clients of a live edit session.")
+	r.Describe(MetricQueueMessages, "Messages waiting in WebSocket send queues.")
+	r.Describe(MetricQueueBytes, "Bytes waiting in WebSocket send queues.")
+	r.Describe(MetricQueueMaxMessages, "Messages in the deepest WebSocket send queue.")
+	r.Describe(MetricQueueDropped, "Messages dropped by send queue overflow.")
+	r.Describe(MetricQueueCoalesced, "Operations merged into an earlier queued operation.")
+	r.Describe(MetricQueueSnapshots, "Send queues replaced by session snapshots.")
+	r.Describe(MetricQueueDisconnects, "Clients disconnected for a full send queue.")
+	r.Describe(MetricHistoryWriteSeconds, "Time to write a history event, by event type.", metrics.LatencyBuckets...)
+	r.Describe(MetricHistoryFailures, "History events that failed to be written, by event type.")
+	r.Describe(MetricSnapshotBytes, "Content size of history snapshots.", metrics.SizeBuckets...)
+	r.Describe(MetricLimitViolations, "Messages rejected by rate limits and quotas, by limit.")
+	r.Describe(MetricLimitDisconnects, "Clients disconnected for repeated limit violations.")
+}
+
+// SetMetrics sets the recorder of the handler's metrics. Call it before
+// serving; the default discards everything.
+func (h *ProtocolHandler) SetMetrics(recorder metrics.Recorder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.meter = recorder
+}
+
+// recorder returns the recorder of the handler's metrics.
+func (h *ProtocolHandler) recorder() metrics.Recorder {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.meter == nil {
+		return metrics.Nop
+	}
+	return h.meter
+}
+
+// EditMetrics returns the insert and delete statistics of the text
+// operations applied by the handler.
+func (h *ProtocolHandler) EditMetrics() *rope.EditMetrics {
+	return h.edits
+}
+
+// SetHistoryListener sets the history listener of all sessions.
+func (h *ProtocolHandler) SetHistoryListener(listener HistoryListener) {
+	h.sessionManager.SetHistoryListener(listener)
+}
+
+// Collect reports the sessions and send queues of the handler. Register
+// it with a metrics.Registry to have them read on every scrape.
+func (h *ProtocolHandler) Collect(r metrics.Recorder) {
+	sessions := h.sessionManager.ListSessions()
+	r.Set(MetricSessions, float64(len(sessions)))
+	for _, es := range sessions {
+		r.Set(MetricSessionClients, float64(es.ClientCount()), metrics.L("file", es.FilePath))
+	}
+
+	h.mu.RLock()
+	server := h.server
+	h.mu.RUnlock()
+	if server == nil {
+		return
+	}
+	stats := server.BackpressureStats()
+	deepest := 0
+	for _, queue := range stats.Clients {
+		if queue.Messages > deepest {
+			deepest = queue.Messages
+		}
+	}
+	r.Set(MetricQueueMessages, float64(stats.Messages))
+	r.Set(MetricQueueBytes, float64(stats.Bytes))
+	r.Set(MetricQueueMaxMessages, float64(deepest))
+	r.Add(MetricQueueDropped, float64(stats.Dropped))
+	r.Add(MetricQueueCoalesced, float64(stats.Coalesced))
+	r.Add(MetricQueueSnapshots, float64(stats.Snapshots))
+	r.Add(MetricQueueDisconnects, float64(stats.Disconnects))
+}
+
+// recordOperation counts an operation applied to a session and the time
+// it took since start.
+func (h *ProtocolHandler) recordOperation(es *EditSession, start time.Time) {
+	rec := h.recorder()
+	contentType := metrics.L("content_type", es.ContentType())
+	rec.Add(MetricOperations, 1, metrics.L("file", es.FilePath), contentType)
+	rec.Observe(MetricApplySeconds, time.Since(start).Seconds(), contentType)
+}
+
+// recordTransform records the time since start spent rebasing a change of
+// the given kind onto the live document.
+func (h *ProtocolHandler) recordTransform(kind string, start time.Time) {
+	h.recorder().Observe(MetricTransformSeconds, time.Since(start).Seconds(), metrics.L("kind", kind))
+}
+
+// recordEdits adds the inserts and deletes of a text operation to the
+// edit metrics.
+func (h *ProtocolHandler) recordEdits(op *ot.Operation) {
+	pos := 0
+	for _, component := range op.ToJSON() {
+		switch c := component.(type) {
+		case string:
+			length := utf8.RuneCountInString(c)
+			h.edits.RecordEdit(&rope.EditInfo{Operation: "insert", StartPos: pos, EndPos: pos, Text: c, Length: length})
+			pos += length
+		case int:
+			if c >= 0 {
+				pos += c
+				continue
+			}
+			h.edits.RecordEdit(&rope.EditInfo{Operation: "delete", StartPos: pos, EndPos: pos - c, Length: -c})
+		}
+	}
+}
+
+// MetricsMiddleware returns middleware that counts the messages handled
+// by type and records how long handling them took.
+func MetricsMiddleware(recorder metrics.Recorder) Middleware {
+	return func(next MessageHandlerFunc) MessageHandlerFunc {
+		return func(c *MessageContext) error {
+			start := time.Now()
+			err := next(c)
+			msgType := metrics.L("type", string(c.Type()))
+			recorder.Add(MetricMessages, 1, msgType)
+			recorder.Observe(MetricHandleSeconds, time.Since(start).Seconds(), msgType)
+			return err
+		}
+	}
+}
+
+// ========== History Instrumentation ==========
+
+// instrumentedHistory is a HistoryListener that records the latency and
+// failures of the listener it wraps.
+type instrumentedHistory struct {
+	listener HistoryListener
+	recorder metrics.Recorder
+}
+
+// InstrumentHistory wraps a history listener to record how long writes
+// take, how many fail and the size of snapshots. Comments are forwarded
+// if the listener is a CommentListener, and read back if it is a
+// CommentLoader.
+func InstrumentHistory(listener HistoryListener, recorder metrics.Recorder) HistoryListener {
+	return &instrumentedHistory{listener: listener, recorder: recorder}
+}
+
+// OnSnapshot records and forwards a snapshot event.
+func (ih *instrumentedHistory) OnSnapshot(event *HistoryEvent) error {
+	ih.recorder.Observe(MetricSnapshotBytes, float64(len(event.Content)))
+	return ih.observe("snapshot", func() error { return ih.listener.OnSnapshot(event) })
+}
+
+// OnOperation records and forwards an operation event.
+func (ih *instrumentedHistory) OnOperation(event *HistoryEvent) error {
+	return ih.observe("operation", func() error { return ih.listener.OnOperation(event) })
+}
+
+// OnComment records and forwards a comment event.
+func (ih *instrumentedHistory) OnComment(event *HistoryEvent) error {
+	listener, ok := ih.listener.(CommentListener)
+	if !ok {
+		return nil
+	}
+	return ih.observe("comment", func() error { return listener.OnComment(event) })
+}
+
+// GetComments reads comment threads from the wrapped listener, if it is
+// a CommentLoader.
+func (ih *instrumentedHistory) GetComments(ctx context.Context, sessionID string) ([]*CommentThread, error) {
+	loader, ok := ih.listener.(CommentLoader)
+	if !ok {
+		return nil, nil
+	}
+	return loader.GetComments(ctx, sessionID)
+}
+
+// Close closes the wrapped listener.
+func (ih *instrumentedHistory) Close() error {
+	return ih.listener.Close()
+}
+
+// observe times a write and counts it if it fails.
+func (ih *instrumentedHistory) observe(event string, write func() error) error {
+	start := time.Now()
+	err := write()
+	label := metrics.L("event", event)
+	ih.recorder.Observe(MetricHistoryWriteSeconds, time.Since(start).Seconds(), label)
+	if err != nil {
+		ih.recorder.Add(MetricHistoryFailures, 1, label)
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package transport
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/coreseekdev/texere/pkg/metrics"
+)
+
+// scrape returns the Prometheus text of a registry.
+func scrape(t *testing.T, r *metrics.Registry) string {
+	t.Helper()
+	var out strings.Builder
+	if err := r.WritePrometheus(&out); err != nil {
+		t.Fatalf("WritePrometheus failed: %v", err)
+	}
+	return out.String()
+}
+
+// TestProtocolHandler_Metrics tests the operation, broadcast and session metrics.
+func TestProtocolHandler_Metrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	handler := NewProtocolHandler(nil, nil)
+	handler.SetMetrics(registry)
+	handler.Registry().Use(MetricsMiddleware(registry))
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	registry.Register(handler.Collect, metrics.RopeEditStats(handler.EditMetrics()))
+
+	node := &clusterNode{handler: handler, server: server}
+	node.connect("alice")
+	node.connect("bob")
+	var snapshot SnapshotData
+	node.send(t, "alice", MessageTypeSubscribe, &SubscribeData{FilePath: "/m.txt"})
+	node.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+	node.send(t, "bob", MessageTypeSubscribe, &SubscribeData{FilePath: "/m.txt"})
+	node.receive(t, "bob", MessageTypeSnapshot, &snapshot)
+
+	node.send(t, "alice", MessageTypeOperation, &OperationData{SessionID: snapshot.SessionID, Operation: []interface{}{"hello"}})
+	node.send(t, "alice", MessageTypeOperation, &OperationData{SessionID: snapshot.SessionID, Operation: []interface{}{2, -3}})
+	node.receive(t, "bob", MessageTypeRemoteOperation, &RemoteOperationData{})
+
+	text := scrape(t, registry)
+	for _, line := range []string{
+		`texere_operations_total{content_type="text",file="/m.txt"} 2`,
+		`texere_operation_apply_seconds_count{content_type="text"} 2`,
+		`texere_broadcast_recipients_count{type="remote_operation"} 2`,
+		`texere_broadcast_recipients_sum{type="remote_operation"} 2`,
+		`texere_messages_total{type="operation"} 2`,
+		`texere_sessions 1`,
+		`texere_session_clients{file="/m.txt"} 2`,
+		`texere_websocket_queue_messages `,
+		`texere_rope_edits_total{kind="insert"} 1`,
+		`texere_rope_edit_chars_total{kind="delete"} 3`,
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("Expected %q in:\n%s", line, text)
+		}
+	}
+}
+
+// failingHistory is a history listener whose operation writes fail.
+type failingHistory struct{}
+
+func (failingHistory) OnSnapshot(*HistoryEvent) error  { return nil }
+func (failingHistory) OnOperation(*HistoryEvent) error { return errors.New("unavailable") }
+func (failingHistory) Close() error                    { return nil }
+
+// TestInstrumentHistory tests the history write metrics.
+func TestInstrumentHistory(t *testing.T) {
+	registry := metrics.NewRegistry()
+	DescribeMetrics(registry)
+	history := InstrumentHistory(failingHistory{}, registry)
+
+	history.OnSnapshot(&HistoryEvent{Content: strings.Repeat("x", 100)})
+	if err := history.OnOperation(&HistoryEvent{}); err == nil {
+		t.Error("Expected the operation write to fail")
+	}
+	if err := history.(CommentListener).OnComment(&HistoryEvent{}); err != nil {
+		t.Errorf("Expected comments to be ignored, got %v", err)
+	}
+
+	text := scrape(t, registry)
+	for _, line := range []string{
+		`texere_history_write_seconds_count{event="snapshot"} 1`,
+		`texere_history_write_seconds_count{event="operation"} 1`,
+		`texere_history_write_failures_total{event="operation"} 1`,
+		`texere_snapshot_bytes_bucket{le="256"} 1`,
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("Expected %q in:\n%s", line, text)
+		}
+	}
+	if strings.Contains(text, `texere_history_write_failures_total{event="snapshot"}`) {
+		t.Error("Expected no snapshot failures")
+	}
+}
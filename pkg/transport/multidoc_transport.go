@@ -5,33 +5,56 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/coreseekdev/texere/pkg/ot"
 	"github.com/gorilla/websocket"
 )
 
+// DefaultBatchWindow is a batch window that composes the keystrokes of a
+// fast typist into one message, see SetBatchWindow.
+const DefaultBatchWindow = 20 * time.Millisecond
+
 // MultiDocWebSocketTransport handles multiple documents over a single WebSocket connection.
 // This is more efficient than creating separate connections for each document.
 //
 // Example usage:
-//   transport := NewMultiDocWebSocketTransport("client-1", "ws://localhost:8080/ws")
-//   transport.Connect(ctx)
 //
-//   // Subscribe to documents
-//   transport.Subscribe("/doc1.txt", doc1Handler)
-//   transport.Subscribe("/doc2.txt", doc2Handler)
+//	transport := NewMultiDocWebSocketTransport("client-1", "ws://localhost:8080/ws")
+//	transport.Connect(ctx)
+//
+//	// Subscribe to documents
+//	transport.Subscribe("/doc1.txt", doc1Handler)
+//	transport.Subscribe("/doc2.txt", doc2Handler)
+//
+//	// Send operation for specific document
+//	transport.SendOperation("/doc1.txt", operation)
 //
-//   // Send operation for specific document
-//   transport.SendOperation("/doc1.txt", operation)
+// With a batch window set, text operations sent within the window of each
+// other are composed and sent as one operation, so fast typists don't send
+// a message per keystroke.
 type MultiDocWebSocketTransport struct {
 	id       string
 	clientID string
 	endpoint string
 
-	mu     sync.RWMutex
-	conn   *websocket.Conn
-	closed bool
+	mu       sync.RWMutex
+	conn     *websocket.Conn
+	closed   bool
+	version  int      // Envelope version confirmed by the welcome message
+	features []string // Features negotiated in the handshake
+
+	writeMu sync.Mutex // Serializes writes to conn
+
+	// Operations waiting for the batch window to end
+	// docPath -> pendingOperation
+	batchMu     sync.Mutex
+	batchWindow time.Duration
+	pending     map[string]*pendingOperation
+	onFlushErr  func(docPath string, err error) // Reports failed batch sends
 
 	// Document subscriptions
 	// docPath -> DocumentSubscription
@@ -48,9 +71,9 @@ type MultiDocWebSocketTransport struct {
 
 // DocumentSubscription represents a subscription to a document.
 type DocumentSubscription struct {
-	DocPath  string
+	DocPath   string
 	SessionID string
-	ReadOnly bool
+	ReadOnly  bool
 
 	// Message handlers
 	onOperation   func(*RemoteOperationData)
@@ -62,9 +85,16 @@ type DocumentSubscription struct {
 	onError       func(*ErrorData)
 
 	// Channels for document-specific messages
-	opCh    chan *Message
+	opCh       chan *Message
 	snapshotCh chan *Message
-	eventCh  chan *Message
+	eventCh    chan *Message
+}
+
+// pendingOperation is the composition of the operations sent for a
+// document during the current batch window.
+type pendingOperation struct {
+	op    *ot.Operation
+	timer *time.Timer
 }
 
 // TransportMessageHandler handles messages for a transport.
@@ -82,9 +112,31 @@ func NewMultiDocWebSocketTransport(clientID, endpoint string) *MultiDocWebSocket
 		documents: make(map[string]*DocumentSubscription),
 		recvCh:    make(chan *Message, 1000),
 		closeCh:   make(chan struct{}),
+		version:   ProtocolVersion1,
+
+		pending: make(map[string]*pendingOperation),
 	}
 }
 
+// SetBatchWindow sets how long operations are composed before they are
+// sent. Zero, the default, sends each operation immediately. Batched
+// operations are sent after SendOperation returned, so failures are
+// reported to the handler set with SetFlushErrorHandler.
+func (t *MultiDocWebSocketTransport) SetBatchWindow(window time.Duration) {
+	t.batchMu.Lock()
+	defer t.batchMu.Unlock()
+	t.batchWindow = window
+}
+
+// SetFlushErrorHandler sets the function called when operations batched
+// for a document fail to be sent at the end of the batch window. By
+// default the error is logged.
+func (t *MultiDocWebSocketTransport) SetFlushErrorHandler(fn func(docPath string, err error)) {
+	t.batchMu.Lock()
+	defer t.batchMu.Unlock()
+	t.onFlushErr = fn
+}
+
 // Connect establishes a single WebSocket connection for all documents.
 func (t *MultiDocWebSocketTransport) Connect(ctx context.Context) error {
 	t.mu.Lock()
@@ -98,9 +150,15 @@ func (t *MultiDocWebSocketTransport) Connect(ctx context.Context) error {
 		return fmt.Errorf("no endpoint set")
 	}
 
-	// Connect to WebSocket server
-	dialer := websocket.Dialer{}
-	conn, _, err := dialer.DialContext(ctx, t.endpoint, nil)
+	endpoint, err := t.connectURL()
+	if err != nil {
+		return err
+	}
+
+	// Connect to WebSocket server, compressing messages if the server
+	// supports permessage-deflate
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, _, err := dialer.DialContext(ctx, endpoint, nil)
 	if err != nil {
 		return fmt.Errorf("failed to connect: %w", err)
 	}
@@ -112,12 +170,61 @@ func (t *MultiDocWebSocketTransport) Connect(ctx context.Context) error {
 	go t.receiveLoop(ctx)
 	go t.dispatchLoop()
 
+	// Agree on the protocol version and features; the welcome reply
+	// updates them
+	hello, err := NewProtocolMessage(MessageTypeHello, "", &HelloData{
+		MinVersion: ProtocolVersionMin,
+		MaxVersion: ProtocolVersionLatest,
+		Features:   []string{FeaturePresence, FeatureCompression},
+		Client:     "texere-go",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create hello message: %w", err)
+	}
+	if err := t.write("", hello); err != nil {
+		return fmt.Errorf("failed to send hello: %w", err)
+	}
+
 	return nil
 }
 
+// Capabilities returns the protocol version and features negotiated with
+// the server.
+func (t *MultiDocWebSocketTransport) Capabilities() *Capabilities {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return &Capabilities{Version: t.version, Features: t.features}
+}
+
+// connectURL returns the endpoint with the client ID and the envelope
+// version to negotiate.
+func (t *MultiDocWebSocketTransport) connectURL() (string, error) {
+	u, err := url.Parse(t.endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint: %w", err)
+	}
+	query := u.Query()
+	if query.Get("client_id") == "" {
+		query.Set("client_id", t.clientID)
+	}
+	if query.Get("protocol") == "" {
+		query.Set("protocol", strconv.Itoa(ProtocolVersionLatest))
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
 // Subscribe subscribes to a document and sets up message handlers.
 // Returns the DocumentSubscription for further configuration.
 func (t *MultiDocWebSocketTransport) Subscribe(docPath string) (*DocumentSubscription, error) {
+	return t.SubscribeAt(docPath, 0)
+}
+
+// SubscribeAt subscribes to a document the client already has at
+// revision, e.g. after reconnecting. If the server still has the
+// operations since, the snapshot carries them composed in CatchUp
+// instead of the content.
+func (t *MultiDocWebSocketTransport) SubscribeAt(docPath string, revision int64) (*DocumentSubscription, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
@@ -132,11 +239,11 @@ func (t *MultiDocWebSocketTransport) Subscribe(docPath string) (*DocumentSubscri
 
 	// Create subscription
 	sub := &DocumentSubscription{
-		DocPath:  docPath,
-		ReadOnly: false,
-		opCh:     make(chan *Message, 100),
+		DocPath:    docPath,
+		ReadOnly:   false,
+		opCh:       make(chan *Message, 100),
 		snapshotCh: make(chan *Message, 10),
-		eventCh:   make(chan *Message, 100),
+		eventCh:    make(chan *Message, 100),
 	}
 
 	t.documents[docPath] = sub
@@ -146,6 +253,7 @@ func (t *MultiDocWebSocketTransport) Subscribe(docPath string) (*DocumentSubscri
 		subscribeData := &SubscribeData{
 			FilePath: docPath,
 			ReadOnly: false,
+			Revision: revision,
 		}
 
 		protocolMsg, err := NewProtocolMessage(MessageTypeSubscribe, "", subscribeData)
@@ -153,17 +261,7 @@ func (t *MultiDocWebSocketTransport) Subscribe(docPath string) (*DocumentSubscri
 			return nil, fmt.Errorf("failed to create subscribe message: %w", err)
 		}
 
-		msg := &Message{
-			Type:      LegacyMsgOperation,
-			ClientID:  t.clientID,
-			DocID:     docPath,
-			Timestamp: protocolMsg.Timestamp,
-			Metadata: map[string]interface{}{
-				"protocol_message": protocolMsg,
-			},
-		}
-
-		if err := t.conn.WriteJSON(msg); err != nil {
+		if err := t.write(docPath, protocolMsg); err != nil {
 			return nil, fmt.Errorf("failed to send subscribe: %w", err)
 		}
 
@@ -173,8 +271,13 @@ func (t *MultiDocWebSocketTransport) Subscribe(docPath string) (*DocumentSubscri
 	return sub, nil
 }
 
-// Unsubscribe unsubscribes from a document.
+// Unsubscribe unsubscribes from a document, after sending its pending
+// operation.
 func (t *MultiDocWebSocketTransport) Unsubscribe(docPath string) error {
+	if err := t.flush(docPath); err != nil {
+		log.Printf("[MultiDoc] Failed to send pending operation of %s: %v", docPath, err)
+	}
+
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
@@ -194,17 +297,7 @@ func (t *MultiDocWebSocketTransport) Unsubscribe(docPath string) error {
 			return fmt.Errorf("failed to create unsubscribe message: %w", err)
 		}
 
-		msg := &Message{
-			Type:      LegacyMsgOperation,
-			ClientID:  t.clientID,
-			DocID:     docPath,
-			Timestamp: protocolMsg.Timestamp,
-			Metadata: map[string]interface{}{
-				"protocol_message": protocolMsg,
-			},
-		}
-
-		if err := t.conn.WriteJSON(msg); err != nil {
+		if err := t.write(docPath, protocolMsg); err != nil {
 			return fmt.Errorf("failed to send unsubscribe: %w", err)
 		}
 	}
@@ -227,8 +320,111 @@ func (t *MultiDocWebSocketTransport) SendOperation(docPath string, operation []i
 	return t.SendOperationWithContext(context.Background(), docPath, operation)
 }
 
-// SendOperationWithContext sends an OT operation with context.
+// SendOperationWithContext sends an OT operation with context. The
+// context's deadline bounds the write. With a batch window, text
+// operations are composed with the document's pending operation and sent
+// when the window ends, no longer bound by ctx; other operations are sent
+// immediately, after the pending operation.
 func (t *MultiDocWebSocketTransport) SendOperationWithContext(ctx context.Context, docPath string, operation []interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := t.checkSubscribed(docPath); err != nil {
+		return err
+	}
+
+	t.batchMu.Lock()
+	defer t.batchMu.Unlock()
+
+	op, parseErr := operationFromJSON(operation)
+	if pending := t.pending[docPath]; parseErr == nil && pending != nil {
+		if composed, err := ot.Compose(pending.op, op); err == nil {
+			pending.op = composed
+			return nil
+		}
+		// The operation doesn't follow the pending one, e.g. because the
+		// client transformed it; send them separately
+	}
+
+	if err := t.flushLocked(docPath); err != nil {
+		return err
+	}
+	if parseErr != nil || t.batchWindow <= 0 {
+		return t.sendOperation(ctx, docPath, operation)
+	}
+
+	pending := &pendingOperation{op: op}
+	pending.timer = time.AfterFunc(t.batchWindow, func() {
+		t.batchMu.Lock()
+		defer t.batchMu.Unlock()
+
+		// A later operation may have flushed this one already
+		if t.pending[docPath] != pending {
+			return
+		}
+		if err := t.flushLocked(docPath); err != nil {
+			if t.onFlushErr != nil {
+				t.onFlushErr(docPath, err)
+				return
+			}
+			log.Printf("[MultiDoc] Failed to send operation of %s: %v", docPath, err)
+		}
+	})
+	t.pending[docPath] = pending
+	return nil
+}
+
+// Flush sends the pending operations of all documents without waiting for
+// the batch window to end.
+func (t *MultiDocWebSocketTransport) Flush() error {
+	t.batchMu.Lock()
+	defer t.batchMu.Unlock()
+
+	var firstErr error
+	for docPath := range t.pending {
+		if err := t.flushLocked(docPath); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// flush sends the pending operation of a document.
+func (t *MultiDocWebSocketTransport) flush(docPath string) error {
+	t.batchMu.Lock()
+	defer t.batchMu.Unlock()
+	return t.flushLocked(docPath)
+}
+
+// flushLocked sends the pending operation of a document, if any. The
+// caller holds t.batchMu.
+func (t *MultiDocWebSocketTransport) flushLocked(docPath string) error {
+	pending, ok := t.pending[docPath]
+	if !ok {
+		return nil
+	}
+	pending.timer.Stop()
+	delete(t.pending, docPath)
+	return t.sendOperation(context.Background(), docPath, pending.op.ToJSON())
+}
+
+// checkSubscribed returns an error if operations of a document can't be
+// sent.
+func (t *MultiDocWebSocketTransport) checkSubscribed(docPath string) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.closed || t.conn == nil {
+		return ErrTransportClosed
+	}
+	if _, exists := t.documents[docPath]; !exists {
+		return fmt.Errorf("not subscribed to %s", docPath)
+	}
+	return nil
+}
+
+// sendOperation sends an operation message within the deadline of ctx.
+func (t *MultiDocWebSocketTransport) sendOperation(ctx context.Context, docPath string, operation []interface{}) error {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
@@ -253,19 +449,7 @@ func (t *MultiDocWebSocketTransport) SendOperationWithContext(ctx context.Contex
 		return fmt.Errorf("failed to create operation message: %w", err)
 	}
 
-	msg := &Message{
-		Type:      LegacyMsgOperation,
-		ClientID:  t.clientID,
-		DocID:     docPath,
-		Timestamp: protocolMsg.Timestamp,
-		Metadata: map[string]interface{}{
-			"protocol_message": protocolMsg,
-		},
-	}
-
-	// Send with timeout
-	t.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-	return t.conn.WriteJSON(msg)
+	return t.writeContext(ctx, docPath, protocolMsg)
 }
 
 // SendHeartbeat sends heartbeat for multiple sessions.
@@ -286,16 +470,40 @@ func (t *MultiDocWebSocketTransport) SendHeartbeat(sessionIDs []string) error {
 		return fmt.Errorf("failed to create heartbeat message: %w", err)
 	}
 
-	msg := &Message{
-		Type:      LegacyMsgHello, // Use Hello for heartbeat
-		ClientID:  t.clientID,
-		Timestamp: protocolMsg.Timestamp,
-		Metadata: map[string]interface{}{
-			"protocol_message": protocolMsg,
-		},
+	return t.write("", protocolMsg)
+}
+
+// write sends a protocol message in the negotiated envelope version. The
+// caller holds t.mu.
+func (t *MultiDocWebSocketTransport) write(docPath string, pm *ProtocolMessage) error {
+	return t.writeContext(context.Background(), docPath, pm)
+}
+
+// writeContext sends a protocol message like write, giving up at the
+// deadline of ctx if it is earlier than the write timeout.
+func (t *MultiDocWebSocketTransport) writeContext(ctx context.Context, docPath string, pm *ProtocolMessage) error {
+	var msg interface{} = pm
+	if t.version < ProtocolVersion2 {
+		msg = &Message{
+			Type:      LegacyMsgOperation,
+			ClientID:  t.clientID,
+			DocID:     docPath,
+			Timestamp: pm.Timestamp,
+			Metadata: map[string]interface{}{
+				"protocol_message": pm,
+			},
+		}
 	}
 
-	t.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	// Send with timeout
+	deadline := time.Now().Add(10 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	t.conn.SetWriteDeadline(deadline)
 	return t.conn.WriteJSON(msg)
 }
 
@@ -332,29 +540,74 @@ func (t *MultiDocWebSocketTransport) receiveLoop(ctx context.Context) {
 		default:
 		}
 
-		var msg Message
-		err := conn.ReadJSON(&msg)
+		_, data, err := conn.ReadMessage()
 		if err != nil {
 			log.Printf("[MultiDoc] Read error: %v", err)
 			return
 		}
 
-		// Route message based on SessionID/DocID
-		t.routeMessage(&msg)
+		// Messages are routed as ProtocolVersion1, whatever the version
+		received, err := parseEnvelope(data)
+		if err != nil {
+			log.Printf("[MultiDoc] %v", err)
+			continue
+		}
+		t.routeMessage(&Message{
+			Type:      LegacyMsgOperation,
+			ClientID:  received.ClientID,
+			DocID:     received.DocID,
+			Timestamp: received.Timestamp,
+			Metadata: map[string]interface{}{
+				"protocol_message": received.Protocol,
+			},
+		})
 	}
 }
 
-// routeRoute routes incoming messages to the appropriate document subscription.
+// routeMessage routes incoming messages to the appropriate document subscription.
 func (t *MultiDocWebSocketTransport) routeMessage(msg *Message) {
 	// Extract protocol message
-	protocolMsgBytes, ok := msg.Metadata["protocol_message"]
-	if !ok {
+	protocolMsg, err := decodeProtocolMessage(msg.Metadata["protocol_message"])
+	if err != nil {
+		log.Printf("[MultiDoc] Failed to parse protocol message: %v", err)
 		return
 	}
 
-	var protocolMsg ProtocolMessage
-	if err := json.Unmarshal([]byte(fmt.Sprintf("%v", protocolMsgBytes)), &protocolMsg); err != nil {
-		log.Printf("[MultiDoc] Failed to parse protocol message: %v", err)
+	// Server messages name their session in the data
+	var target struct {
+		SessionID string `json:"session_id"`
+		FilePath  string `json:"file_path"`
+	}
+	json.Unmarshal(protocolMsg.Data, &target)
+	sessionID := target.SessionID
+	if sessionID == "" {
+		sessionID = protocolMsg.SessionID
+	}
+
+	switch protocolMsg.Type {
+	case MessageTypeWelcome:
+		// Sent on connect and in reply to the hello
+		var welcome WelcomeData
+		json.Unmarshal(protocolMsg.Data, &welcome)
+		t.mu.Lock()
+		if welcome.ProtocolVersion >= ProtocolVersion1 {
+			t.version = welcome.ProtocolVersion
+		}
+		t.features = welcome.Features
+		t.mu.Unlock()
+		return
+
+	case MessageTypeSnapshot:
+		// The snapshot tells which session hosts a subscribed document
+		t.mu.Lock()
+		if sub, ok := t.documents[target.FilePath]; ok && sessionID != "" {
+			sub.SessionID = sessionID
+		}
+		t.mu.Unlock()
+	}
+
+	if sessionID == "" {
+		log.Printf("[MultiDoc] Unhandled message type: %s", protocolMsg.Type)
 		return
 	}
 
@@ -364,7 +617,7 @@ func (t *MultiDocWebSocketTransport) routeMessage(msg *Message) {
 
 	var sub *DocumentSubscription
 	for _, s := range t.documents {
-		if s.SessionID == protocolMsg.SessionID {
+		if s.SessionID == sessionID {
 			sub = s
 			break
 		}
@@ -372,7 +625,7 @@ func (t *MultiDocWebSocketTransport) routeMessage(msg *Message) {
 
 	if sub == nil {
 		// No subscription found, might be for an unknown document
-		log.Printf("[MultiDoc] No subscription found for session %s", protocolMsg.SessionID)
+		log.Printf("[MultiDoc] No subscription found for session %s", sessionID)
 		return
 	}
 
@@ -446,8 +699,13 @@ func (t *MultiDocWebSocketTransport) IsConnected() bool {
 	return t.connected
 }
 
-// Close closes the transport and all subscriptions.
+// Close sends pending operations, then closes the transport and all
+// subscriptions.
 func (t *MultiDocWebSocketTransport) Close() error {
+	if err := t.Flush(); err != nil {
+		log.Printf("[MultiDoc] Failed to send pending operations: %v", err)
+	}
+
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
@@ -543,13 +801,8 @@ func (s *DocumentSubscription) handleSnapshot(msg *Message) {
 		return
 	}
 
-	protocolMsgBytes, ok := msg.Metadata["protocol_message"]
-	if !ok {
-		return
-	}
-
-	var protocolMsg ProtocolMessage
-	if err := json.Unmarshal([]byte(fmt.Sprintf("%v", protocolMsgBytes)), &protocolMsg); err != nil {
+	protocolMsg, err := decodeProtocolMessage(msg.Metadata["protocol_message"])
+	if err != nil {
 		log.Printf("Failed to parse snapshot message: %v", err)
 		return
 	}
@@ -565,13 +818,8 @@ func (s *DocumentSubscription) handleSnapshot(msg *Message) {
 
 // handleOperation handles operation messages.
 func (s *DocumentSubscription) handleOperation(msg *Message) {
-	protocolMsgBytes, ok := msg.Metadata["protocol_message"]
-	if !ok {
-		return
-	}
-
-	var protocolMsg ProtocolMessage
-	if err := json.Unmarshal([]byte(fmt.Sprintf("%v", protocolMsgBytes)), &protocolMsg); err != nil {
+	protocolMsg, err := decodeProtocolMessage(msg.Metadata["protocol_message"])
+	if err != nil {
 		log.Printf("Failed to parse operation message: %v", err)
 		return
 	}
@@ -590,13 +838,8 @@ func (s *DocumentSubscription) handleOperation(msg *Message) {
 
 // handleEvent handles event messages (user joined/left, session info, errors).
 func (s *DocumentSubscription) handleEvent(msg *Message) {
-	protocolMsgBytes, ok := msg.Metadata["protocol_message"]
-	if !ok {
-		return
-	}
-
-	var protocolMsg ProtocolMessage
-	if err := json.Unmarshal([]byte(fmt.Sprintf("%v", protocolMsgBytes)), &protocolMsg); err != nil {
+	protocolMsg, err := decodeProtocolMessage(msg.Metadata["protocol_message"])
+	if err != nil {
 		log.Printf("Failed to parse event message: %v", err)
 		return
 	}
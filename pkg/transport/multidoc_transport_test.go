@@ -1,8 +1,10 @@
 package transport
 
 import (
+	"context"
 	"fmt"
 	"testing"
+	"time"
 )
 
 // TestMultiDocWebSocketTransport_BasicSubscription tests basic subscription functionality.
@@ -398,3 +400,95 @@ func BenchmarkMultiDocWebSocketTransport_ListSubscriptions(b *testing.B) {
 		transport.ListSubscriptions()
 	}
 }
+
+// TestMultiDocWebSocketTransport_BatchOperations tests composing operations typed within the batch window.
+func TestMultiDocWebSocketTransport_BatchOperations(t *testing.T) {
+	handler, url := protocolServer(t)
+
+	transport := NewMultiDocWebSocketTransport("writer", url)
+	transport.SetBatchWindow(time.Second)
+	if err := transport.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer transport.Close()
+
+	sub, err := transport.Subscribe("/batch.txt")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	snapshots := make(chan *SnapshotData, 1)
+	sub.OnSnapshot(func(data *SnapshotData) { snapshots <- data })
+	sub.StartMessageHandler(transport)
+
+	select {
+	case snapshot := <-snapshots:
+		if snapshot.FilePath != "/batch.txt" {
+			t.Fatalf("Expected the snapshot of /batch.txt, got %s", snapshot.FilePath)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No snapshot received")
+	}
+
+	for i, c := range "Hello" {
+		op := []interface{}{string(c)}
+		if i > 0 {
+			op = []interface{}{i, string(c)}
+		}
+		if err := transport.SendOperation("/batch.txt", op); err != nil {
+			t.Fatalf("SendOperation failed: %v", err)
+		}
+	}
+	if err := transport.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	var es *EditSession
+	for i := 0; i < 100; i++ {
+		if es = handler.sessionManager.GetSessionByPath("/batch.txt"); es != nil && es.GetContent() == "Hello" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if es == nil || es.GetContent() != "Hello" {
+		t.Fatal("Expected the server to receive 'Hello'")
+	}
+	if version := es.GetCurrentVersion(); version != 1 {
+		t.Errorf("Expected one composed operation, got %d operations", version)
+	}
+}
+
+// TestMultiDocWebSocketTransport_BatchErrors tests that batching is off by
+// default and that failed batch sends are reported.
+func TestMultiDocWebSocketTransport_BatchErrors(t *testing.T) {
+	_, url := protocolServer(t)
+
+	transport := NewMultiDocWebSocketTransport("writer", url)
+	if err := transport.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer transport.Close()
+	if _, err := transport.Subscribe("/errors.txt"); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	// Without a batch window a failed write is returned
+	transport.conn.Close()
+	if err := transport.SendOperation("/errors.txt", []interface{}{"a"}); err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+
+	failures := make(chan string, 1)
+	transport.SetFlushErrorHandler(func(docPath string, err error) { failures <- docPath })
+	transport.SetBatchWindow(10 * time.Millisecond)
+	if err := transport.SendOperation("/errors.txt", []interface{}{"a"}); err != nil {
+		t.Fatalf("Expected the operation to be batched, got %v", err)
+	}
+	select {
+	case docPath := <-failures:
+		if docPath != "/errors.txt" {
+			t.Errorf("Expected a failure for /errors.txt, got %s", docPath)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the failed flush to be reported")
+	}
+}
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"github.com/coreseekdev/texere/pkg/rope"
 	"github.com/sergi/go-diff/diffmatchpatch"
 )
 
@@ -28,9 +29,9 @@ type PatchResult struct {
 
 // ApplyPatchResult represents the result of applying a patch.
 type ApplyPatchResult struct {
-	Content     string // Reconstructed content
-	Success     bool   // Whether patch application succeeded
-	PatchesApplied int  // Number of patches applied
+	Content        string // Reconstructed content
+	Success        bool   // Whether patch application succeeded
+	PatchesApplied int    // Number of patches applied
 }
 
 // ComputePatch computes a patch from oldText to newText.
@@ -59,6 +60,48 @@ func (pm *PatchManager) ComputePatch(oldText, newText string) *PatchResult {
 	}
 }
 
+// ComputeRopePatch computes a patch from oldDoc to newDoc.
+// It produces the same patch format as ComputePatch, but finds the changes
+// with rope.Diff, which skips the parts both versions share instead of
+// diffing the full texts.
+func (pm *PatchManager) ComputeRopePatch(oldDoc, newDoc *rope.Rope) *PatchResult {
+	diffs := pm.RopeDiff(oldDoc, newDoc)
+	patch := pm.dmp.PatchMake(diffs)
+	patchText := pm.dmp.PatchToText(patch)
+
+	return &PatchResult{
+		Patch:      patchText,
+		PatchSize:  len(patchText),
+		OldSize:    oldDoc.Size(),
+		NewSize:    newDoc.Size(),
+		SavedBytes: newDoc.Size() - len(patchText),
+	}
+}
+
+// RopeDiff computes differences between two ropes with rope.Diff, in the
+// diff-match-patch format returned by ComputeDiff.
+func (pm *PatchManager) RopeDiff(oldDoc, newDoc *rope.Rope) []diffmatchpatch.Diff {
+	var diffs []diffmatchpatch.Diff
+	pos := 0
+	it := rope.Diff(oldDoc, newDoc).ChangesIterator()
+	for info := it.Next(); info != nil; info = it.Next() {
+		op := info.Operation
+		switch op.OpType {
+		case rope.OpRetain:
+			text, _ := oldDoc.Slice(pos, pos+op.Length)
+			diffs = append(diffs, diffmatchpatch.Diff{Type: diffmatchpatch.DiffEqual, Text: text})
+			pos += op.Length
+		case rope.OpDelete:
+			text, _ := oldDoc.Slice(pos, pos+op.Length)
+			diffs = append(diffs, diffmatchpatch.Diff{Type: diffmatchpatch.DiffDelete, Text: text})
+			pos += op.Length
+		case rope.OpInsert:
+			diffs = append(diffs, diffmatchpatch.Diff{Type: diffmatchpatch.DiffInsert, Text: op.Text})
+		}
+	}
+	return diffs
+}
+
 // ApplyPatch applies a patch to oldText to reconstruct newText.
 // Returns ApplyPatchResult with the reconstructed content.
 func (pm *PatchManager) ApplyPatch(oldText, patchText string) *ApplyPatchResult {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"testing"
 
+	"github.com/coreseekdev/texere/pkg/rope"
 	"github.com/sergi/go-diff/diffmatchpatch"
 )
 
@@ -67,9 +68,9 @@ func TestPatchManager_RoundTrip(t *testing.T) {
 	pm := NewPatchManager()
 
 	testCases := []struct {
-		name     string
-		oldText  string
-		newText  string
+		name    string
+		oldText string
+		newText string
 	}{
 		{
 			name:    "Simple insertion",
@@ -241,12 +242,12 @@ func TestRedisHistoryService_ReconstructSnapshot(t *testing.T) {
 
 	// Create multiple versions with patches
 	versions := []struct {
-		version  int64
-		content  string
+		version int64
+		content string
 	}{
-		{0, "Hello"},           // First snapshot (full content)
-		{1, "Hello World"},     // Patch 1
-		{2, "Hello Beautiful World"}, // Patch 2
+		{0, "Hello"},                  // First snapshot (full content)
+		{1, "Hello World"},            // Patch 1
+		{2, "Hello Beautiful World"},  // Patch 2
 		{3, "Hello Beautiful World!"}, // Patch 3
 	}
 
@@ -380,3 +381,25 @@ func BenchmarkPatchManager_ApplyPatch(b *testing.B) {
 		pm.ApplyPatch(oldText, patchResult.Patch)
 	}
 }
+
+// TestPatchManager_ComputeRopePatch tests patches computed from ropes.
+func TestPatchManager_ComputeRopePatch(t *testing.T) {
+	pm := NewPatchManager()
+
+	oldDoc := rope.New("The quick brown fox jumps over the lazy dog")
+	newDoc, _ := oldDoc.Replace(10, 15, "red")
+	newDoc, _ = newDoc.Insert(newDoc.Length(), "!")
+
+	result := pm.ComputeRopePatch(oldDoc, newDoc)
+	if result.OldSize != oldDoc.Size() || result.NewSize != newDoc.Size() {
+		t.Errorf("Expected sizes %d/%d, got %d/%d", oldDoc.Size(), newDoc.Size(), result.OldSize, result.NewSize)
+	}
+
+	applied := pm.ApplyPatch(oldDoc.String(), result.Patch)
+	if !applied.Success {
+		t.Fatal("Expected rope patch to apply")
+	}
+	if applied.Content != newDoc.String() {
+		t.Errorf("Expected %q, got %q", newDoc.String(), applied.Content)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"time"
 
+	"github.com/coreseekdev/texere/pkg/concordia"
+	"github.com/coreseekdev/texere/pkg/ot"
 	"github.com/google/uuid"
 )
 
@@ -14,45 +16,70 @@ type MessageType string
 
 const (
 	// Client → Server messages
-	MessageTypeSubscribe         MessageType = "subscribe"          // 关注文件
-	MessageTypeUnsubscribe       MessageType = "unsubscribe"        // 取消关注
-	MessageTypeStartEditing      MessageType = "start_editing"     // 开始编辑
-	MessageTypeStopEditing       MessageType = "stop_editing"      // 停止编辑
-	MessageTypeOperation         MessageType = "operation"          // 发送 OT 操作
-	MessageTypeCursor            MessageType = "cursor"             // 光标位置
-	MessageTypeHeartbeat         MessageType = "heartbeat"          // 心跳
+	MessageTypeHello          MessageType = "hello"           // 协商协议版本与特性
+	MessageTypeSubscribe      MessageType = "subscribe"       // 关注文件
+	MessageTypeUnsubscribe    MessageType = "unsubscribe"     // 取消关注
+	MessageTypeStartEditing   MessageType = "start_editing"   // 开始编辑
+	MessageTypeStopEditing    MessageType = "stop_editing"    // 停止编辑
+	MessageTypeOperation      MessageType = "operation"       // 发送 OT 操作
+	MessageTypeCursor         MessageType = "cursor"          // 光标位置
+	MessageTypeHeartbeat      MessageType = "heartbeat"       // 心跳
+	MessageTypeCommentCreate  MessageType = "comment_create"  // 创建评论
+	MessageTypeCommentReply   MessageType = "comment_reply"   // 回复评论
+	MessageTypeCommentResolve MessageType = "comment_resolve" // 解决/重新打开评论
+	MessageTypeCommentDelete  MessageType = "comment_delete"  // 删除评论
+	MessageTypeCellOperation  MessageType = "cell_operation"  // Notebook 单元格操作
+	MessageTypeMerge          MessageType = "merge"           // 合并离线编辑
+	MessageTypeCRDTSync       MessageType = "crdt_sync"       // CRDT 客户端同步
+	MessageTypeCRDTUpdate     MessageType = "crdt_update"     // CRDT 更新（双向）
 
 	// Server → Client messages
-	MessageTypeWelcome           MessageType = "welcome"            // 连接成功
-	MessageTypeSnapshot          MessageType = "snapshot"           // 文档快照
-	MessageTypeSnapshotCreated   MessageType = "snapshot_created"  // 快照已创建（通知Redis）
-	MessageTypeRemoteOperation   MessageType = "remote_operation"   // 远程操作
-	MessageTypeAck               MessageType = "ack"                // 操作确认
-	MessageTypeError             MessageType = "error"              // 错误
-	MessageTypeUserJoined        MessageType = "user_joined"        // 用户加入
-	MessageTypeUserLeft          MessageType = "user_left"          // 用户离开
-	MessageTypeSessionInfo       MessageType = "session_info"       // 会话信息
+	MessageTypeWelcome             MessageType = "welcome"               // 连接成功
+	MessageTypeSnapshot            MessageType = "snapshot"              // 文档快照
+	MessageTypeSnapshotCreated     MessageType = "snapshot_created"      // 快照已创建（通知Redis）
+	MessageTypeRemoteOperation     MessageType = "remote_operation"      // 远程操作
+	MessageTypeAck                 MessageType = "ack"                   // 操作确认
+	MessageTypeError               MessageType = "error"                 // 错误
+	MessageTypeUserJoined          MessageType = "user_joined"           // 用户加入
+	MessageTypeUserLeft            MessageType = "user_left"             // 用户离开
+	MessageTypeSessionInfo         MessageType = "session_info"          // 会话信息
+	MessageTypeCommentEvent        MessageType = "comment_event"         // 评论变更
+	MessageTypeRemoteCellOperation MessageType = "remote_cell_operation" // 远程单元格操作
+	MessageTypeMergeResult         MessageType = "merge_result"          // 合并结果（冲突区域）
+	MessageTypeSessionClosed       MessageType = "session_closed"        // 会话被管理员关闭
 )
 
 // ========== Protocol Messages ==========
 
 // ProtocolMessage is the base structure for all WebSocket messages.
 type ProtocolMessage struct {
-	Type      MessageType          `json:"type"`
-	SessionID string               `json:"session_id,omitempty"` // Edit session UUID
-	Timestamp int64                `json:"timestamp"`
-	Data      json.RawMessage      `json:"data,omitempty"`
+	Type      MessageType            `json:"type"`
+	SessionID string                 `json:"session_id,omitempty"` // Edit session UUID
+	Timestamp int64                  `json:"timestamp"`
+	Data      json.RawMessage        `json:"data,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"` // Set by clients; echoed in replies
+	TraceID   string                 `json:"trace_id,omitempty"`   // Correlates logs; set by clients or the server
 	Metadata  map[string]interface{} `json:"metadata,omitempty"`
 }
 
 // ========== Client Messages ==========
 
+// HelloData represents the handshake a client sends after connecting:
+// the protocol versions it speaks and the features it supports.
+type HelloData struct {
+	MinVersion int      `json:"min_version"`
+	MaxVersion int      `json:"max_version"`
+	Features   []string `json:"features,omitempty"`
+	Client     string   `json:"client,omitempty"` // Client name and version, for logs
+}
+
 // SubscribeData represents subscribe request data.
 type SubscribeData struct {
-	FilePath   string `json:"file_path"`
-	ReadOnly   bool   `json:"read_only"`   // true = 只读（可用SSE）
-	UseSSE     bool   `json:"use_sse"`     // true = 优先使用SSE推送
-	ClientID   string `json:"client_id,omitempty"`
+	FilePath string `json:"file_path"`
+	ReadOnly bool   `json:"read_only"` // true = 只读（可用SSE）
+	UseSSE   bool   `json:"use_sse"`   // true = 优先使用SSE推送
+	ClientID string `json:"client_id,omitempty"`
+	Revision int64  `json:"revision,omitempty"` // Revision the client already has, to catch up from
 }
 
 // UnsubscribeData represents unsubscribe request data.
@@ -63,10 +90,10 @@ type UnsubscribeData struct {
 
 // StartEditingData represents start editing request data.
 type StartEditingData struct {
-	FilePath    string  `json:"file_path"`
-	ContentType string  `json:"content_type,omitempty"` // "text", "markdown", etc.
-	InitialText string  `json:"initial_text,omitempty"` // 如果文件不存在，创建时的初始内容
-	ClientID    string  `json:"client_id,omitempty"`
+	FilePath    string `json:"file_path"`
+	ContentType string `json:"content_type,omitempty"` // "text", "markdown", "json", etc.
+	InitialText string `json:"initial_text,omitempty"` // 如果文件不存在，创建时的初始内容
+	ClientID    string `json:"client_id,omitempty"`
 }
 
 // StopEditingData represents stop editing request data.
@@ -76,9 +103,11 @@ type StopEditingData struct {
 
 // OperationData represents OT operation data.
 type OperationData struct {
-	SessionID string      `json:"session_id"` // Edit session UUID
-	Revision  int64       `json:"revision"`    // Document version
-	Operation interface{} `json:"operation"`   // OT operation: [5, "Hello", 10, -3]
+	SessionID string      `json:"session_id"`        // Edit session UUID
+	Revision  int64       `json:"revision"`          // Document version
+	Operation interface{} `json:"operation"`         // OT operation: [5, "Hello", 10, -3], or json0 components for JSON sessions
+	Delta     *ot.Delta   `json:"delta,omitempty"`   // Rich-text operation (Quill Delta); replaces Operation when set
+	CellID    string      `json:"cell_id,omitempty"` // Target cell of a text operation in a notebook session
 	Selection *CursorData `json:"selection,omitempty"`
 }
 
@@ -88,6 +117,83 @@ type CursorData struct {
 	SelectionEnd int `json:"selection_end"`
 }
 
+// CommentCreateData represents a request to start a comment thread on a range.
+type CommentCreateData struct {
+	SessionID string `json:"session_id"` // Edit session UUID
+	Start     int    `json:"start"`      // Anchor start (character offset)
+	End       int    `json:"end"`        // Anchor end (exclusive)
+	Body      string `json:"body"`
+}
+
+// CommentReplyData represents a reply to an existing comment thread.
+type CommentReplyData struct {
+	SessionID string `json:"session_id"`
+	ThreadID  string `json:"thread_id"`
+	Body      string `json:"body"`
+}
+
+// CommentResolveData represents a request to resolve or reopen a thread.
+type CommentResolveData struct {
+	SessionID string `json:"session_id"`
+	ThreadID  string `json:"thread_id"`
+	Resolved  bool   `json:"resolved"` // false = reopen
+}
+
+// CommentDeleteData represents a request to delete a thread.
+type CommentDeleteData struct {
+	SessionID string `json:"session_id"`
+	ThreadID  string `json:"thread_id"`
+}
+
+// Cell operation actions.
+const (
+	CellActionInsert  = "insert"  // Insert Cell at Index
+	CellActionDelete  = "delete"  // Delete CellID
+	CellActionMove    = "move"    // Move CellID to Index
+	CellActionOutputs = "outputs" // Replace outputs of CellID (last writer wins)
+)
+
+// CellOperationData represents a change to the cell list or cell outputs
+// of a notebook session. Text edits inside a cell use OperationData.CellID.
+type CellOperationData struct {
+	SessionID string                  `json:"session_id"`
+	Action    string                  `json:"action"`            // One of the CellAction* constants
+	CellID    string                  `json:"cell_id,omitempty"` // Target cell (delete, move, outputs)
+	Index     int                     `json:"index,omitempty"`   // Target position (insert, move)
+	Cell      *concordia.NotebookCell `json:"cell,omitempty"`    // New cell (insert)
+	Outputs   *concordia.OutputUpdate `json:"outputs,omitempty"` // New outputs (outputs)
+}
+
+// MergeData represents an offline copy to merge into a text session.
+// Base is the content the copy was downloaded with; Content is the
+// edited copy. Changes since Base are merged three-way with the live
+// document and applied as a regular operation.
+type MergeData struct {
+	SessionID string `json:"session_id"`
+	Base      string `json:"base"`    // Content when the copy was taken
+	Content   string `json:"content"` // Edited offline copy
+}
+
+// CRDTSyncData starts or resumes syncing a CRDT peer with a text session.
+// The server applies the peer's offline changes and replies with a
+// crdt_update holding everything the peer is missing.
+type CRDTSyncData struct {
+	SessionID   string `json:"session_id"`
+	StateVector []byte `json:"state_vector,omitempty"` // Encoded crdt.StateVector of the peer; empty for a new peer
+	Update      []byte `json:"update,omitempty"`       // Changes the peer made offline
+}
+
+// CRDTUpdateData carries a CRDT update, see crdt.Doc.ApplyUpdate.
+// Peers send their edits as updates; the server sends every edit of the
+// session, including those of OT clients, to the CRDT peers. CRDT peers
+// can ignore remote_operation messages.
+type CRDTUpdateData struct {
+	SessionID string `json:"session_id"`
+	ClientID  string `json:"client_id,omitempty"` // Who made the change; empty for sync replies
+	Revision  int64  `json:"revision"`            // Document version after the update
+	Update    []byte `json:"update"`
+}
+
 // HeartbeatData represents heartbeat data.
 type HeartbeatData struct {
 	SessionIDs []string `json:"session_ids"` // All sessions client is subscribed to
@@ -97,63 +203,74 @@ type HeartbeatData struct {
 
 // WelcomeData represents welcome message data.
 type WelcomeData struct {
-	ClientID  string `json:"client_id"`
-	ServerID  string `json:"server_id"`
-	Timestamp int64  `json:"timestamp"`
+	ClientID        string   `json:"client_id"`
+	ServerID        string   `json:"server_id"`
+	Timestamp       int64    `json:"timestamp"`
+	ProtocolVersion int      `json:"protocol_version"` // Envelope version of all later messages
+	MinVersion      int      `json:"min_version"`      // Versions the server speaks
+	MaxVersion      int      `json:"max_version"`
+	Features        []string `json:"features"` // Server features, or the negotiated ones in reply to hello
 }
 
 // SnapshotData represents document snapshot data.
 type SnapshotData struct {
-	SessionID   string      `json:"session_id"`           // Edit session UUID
-	FilePath    string      `json:"file_path"`
-	Content     string      `json:"content"`               // Current document content
-	Revision    int64       `json:"revision"`              // Current version
-	CreatedAt   int64       `json:"created_at"`
-	UpdatedAt   int64       `json:"updated_at"`
-	Operations  interface{} `json:"operations,omitempty"`  // Recent OT operations since last sync
-	Clients     []ClientInfo `json:"clients"`               // Other clients in this session
-	ReadOnly    bool        `json:"read_only"`             // Whether client has write permission
+	SessionID    string           `json:"session_id"` // Edit session UUID
+	FilePath     string           `json:"file_path"`
+	Content      string           `json:"content"`  // Current document content
+	Revision     int64            `json:"revision"` // Current version
+	CreatedAt    int64            `json:"created_at"`
+	UpdatedAt    int64            `json:"updated_at"`
+	Operations   interface{}      `json:"operations,omitempty"`   // Recent OT operations since last sync
+	Clients      []ClientInfo     `json:"clients"`                // Other clients in this session
+	ReadOnly     bool             `json:"read_only"`              // Whether client has write permission
+	Comments     []*CommentThread `json:"comments,omitempty"`     // Comment threads, orphaned last
+	Delta        *ot.Delta        `json:"delta,omitempty"`        // Formatted content, if any text is formatted
+	ContentType  string           `json:"content_type,omitempty"` // "text", "json" or "notebook"
+	CatchUp      interface{}      `json:"catch_up,omitempty"`     // Composed operation from BaseRevision to Revision, instead of Content
+	BaseRevision int64            `json:"base_revision,omitempty"`
 }
 
 // RemoteOperationData represents remote operation data.
 type RemoteOperationData struct {
-	SessionID   string      `json:"session_id"`   // Edit session UUID
-	ClientID    string      `json:"client_id"`    // Who sent this operation
-	Revision    int64       `json:"revision"`     // New document version
-	Operation   interface{} `json:"operation"`    // OT operation: [5, "Hello", 10, -3]
-	Selection   *CursorData `json:"selection,omitempty"`
+	SessionID string      `json:"session_id"`        // Edit session UUID
+	ClientID  string      `json:"client_id"`         // Who sent this operation
+	Revision  int64       `json:"revision"`          // New document version
+	Operation interface{} `json:"operation"`         // OT operation: [5, "Hello", 10, -3]
+	Delta     *ot.Delta   `json:"delta,omitempty"`   // Rich-text operation, if the client sent one
+	CellID    string      `json:"cell_id,omitempty"` // Target cell in a notebook session
+	Selection *CursorData `json:"selection,omitempty"`
 }
 
 // AckData represents acknowledgment data.
 type AckData struct {
 	SessionID string `json:"session_id"` // Edit session UUID
-	Revision  int64 `json:"revision"`    // Acknowledged revision
-	Timestamp int64 `json:"timestamp"`
+	Revision  int64  `json:"revision"`   // Acknowledged revision
+	Timestamp int64  `json:"timestamp"`
 }
 
 // ErrorData represents error data.
 type ErrorData struct {
-	SessionID string `json:"session_id,omitempty"`
-	Code      string `json:"code"`       // Error code
-	Message   string `json:"message"`    // Human-readable message
+	SessionID string                 `json:"session_id,omitempty"`
+	Code      string                 `json:"code"`    // Error code
+	Message   string                 `json:"message"` // Human-readable message
 	Details   map[string]interface{} `json:"details,omitempty"`
 }
 
 // ClientInfo represents information about a connected client.
 type ClientInfo struct {
-	ClientID   string     `json:"client_id"`
-	Name       string     `json:"name,omitempty"`
-	Color      string     `json:"color,omitempty"`
-	IsEditing  bool       `json:"is_editing"`  // Whether this client is editing (vs just viewing)
-	Selection  *CursorData `json:"selection,omitempty"`
-	UpdatedAt  int64      `json:"updated_at"`
+	ClientID  string      `json:"client_id"`
+	Name      string      `json:"name,omitempty"`
+	Color     string      `json:"color,omitempty"`
+	IsEditing bool        `json:"is_editing"` // Whether this client is editing (vs just viewing)
+	Selection *CursorData `json:"selection,omitempty"`
+	UpdatedAt int64       `json:"updated_at"`
 }
 
 // UserJoinedData represents user joined notification.
 type UserJoinedData struct {
-	SessionID string      `json:"session_id"`
-	ClientID  string      `json:"client_id"`
-	Client    ClientInfo  `json:"client"`
+	SessionID string     `json:"session_id"`
+	ClientID  string     `json:"client_id"`
+	Client    ClientInfo `json:"client"`
 }
 
 // UserLeftData represents user left notification.
@@ -162,25 +279,64 @@ type UserLeftData struct {
 	ClientID  string `json:"client_id"`
 }
 
+// SessionClosedData tells the clients of a session that it was closed by
+// an administrator. The content was saved; clients may subscribe again.
+type SessionClosedData struct {
+	SessionID string `json:"session_id"`
+	FilePath  string `json:"file_path"`
+	Reason    string `json:"reason,omitempty"`
+}
+
 // SessionInfoData represents session information.
 type SessionInfoData struct {
-	SessionID    string       `json:"session_id"`
-	FilePath     string       `json:"file_path"`
-	ReaderCount  int          `json:"reader_count"`  // Number of read-only subscribers
-	WriterCount  int          `json:"writer_count"`  // Number of editors
-	Clients      []ClientInfo `json:"clients"`       // All connected clients
-	IsEditing    bool         `json:"is_editing"`    // Whether this file is being edited
+	SessionID   string       `json:"session_id"`
+	FilePath    string       `json:"file_path"`
+	ReaderCount int          `json:"reader_count"` // Number of read-only subscribers
+	WriterCount int          `json:"writer_count"` // Number of editors
+	Clients     []ClientInfo `json:"clients"`      // All connected clients
+	IsEditing   bool         `json:"is_editing"`   // Whether this file is being edited
+}
+
+// CommentEventData notifies clients that a comment thread changed.
+// Action is one of the CommentAction* constants.
+type CommentEventData struct {
+	SessionID string         `json:"session_id"`
+	Action    string         `json:"action"`
+	ClientID  string         `json:"client_id,omitempty"` // Who triggered the change (empty for orphaned)
+	Thread    *CommentThread `json:"thread"`
+}
+
+// RemoteCellOperationData notifies clients of a cell operation.
+// CellID and Index are the resolved cell and position after the change.
+type RemoteCellOperationData struct {
+	SessionID string                  `json:"session_id"`
+	ClientID  string                  `json:"client_id"`
+	Revision  int64                   `json:"revision"`
+	Action    string                  `json:"action"`
+	CellID    string                  `json:"cell_id"`
+	Index     int                     `json:"index"`
+	Cell      *concordia.NotebookCell `json:"cell,omitempty"`
+	Outputs   *concordia.OutputUpdate `json:"outputs,omitempty"`
+}
+
+// MergeResultData reports the outcome of a merge to the client that sent it.
+// Conflicting regions keep the live text; their positions refer to the
+// document at Revision.
+type MergeResultData struct {
+	SessionID string                    `json:"session_id"`
+	Revision  int64                     `json:"revision"`
+	Conflicts []concordia.MergeConflict `json:"conflicts"`
 }
 
 // SnapshotCreatedData represents snapshot creation notification (sent to Redis/History service).
 type SnapshotCreatedData struct {
-	SessionID   string       `json:"session_id"`   // Edit session UUID
-	FilePath    string       `json:"file_path"`    // File path
-	VersionID   int64        `json:"version_id"`   // Snapshot version ID
-	Content     string       `json:"content"`      // Full text content at snapshot
-	Operations  []interface{} `json:"operations"`  // Operations since last snapshot
-	CreatedAt   int64        `json:"created_at"`   // Creation timestamp
-	CreatedBy   string       `json:"created_by"`   // Client ID who triggered snapshot
+	SessionID  string        `json:"session_id"` // Edit session UUID
+	FilePath   string        `json:"file_path"`  // File path
+	VersionID  int64         `json:"version_id"` // Snapshot version ID
+	Content    string        `json:"content"`    // Full text content at snapshot
+	Operations []interface{} `json:"operations"` // Operations since last snapshot
+	CreatedAt  int64         `json:"created_at"` // Creation timestamp
+	CreatedBy  string        `json:"created_by"` // Client ID who triggered snapshot
 }
 
 // ========== Helper Functions ==========
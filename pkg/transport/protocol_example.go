@@ -179,7 +179,7 @@ func TestProtocolMessages(t *testing.T) {
 
 // TestSessionRefCount tests reference counting logic.
 func TestSessionRefCount(t *testing.T) {
-	rc := & SessionRefCount{
+	rc := &SessionRefCount{
 		SessionID:   "test-session",
 		FilePath:    "/test.txt",
 		ReaderCount: 0,
@@ -240,7 +240,7 @@ func TestParseOperationData(t *testing.T) {
 			expected: []interface{}{5, "Hello", 10, -3},
 		},
 		{
-			name:  "Object format",
+			name: "Object format",
 			input: map[string]interface{}{
 				"retain": 5,
 				"insert": "Hello",
@@ -252,7 +252,7 @@ func TestParseOperationData(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result, err :=  ParseOperationData(tt.input)
+			result, err := ParseOperationData(tt.input)
 			if err != nil {
 				t.Fatalf("Failed to parse: %v", err)
 			}
@@ -272,7 +272,7 @@ func TestParseOperationData(t *testing.T) {
 
 // TestSessionManager tests session management.
 func TestSessionManager(t *testing.T) {
-	sm :=  NewSessionManager()
+	sm := NewSessionManager()
 
 	// Test: Create new session
 	session, isNew := sm.GetOrCreateSession("/test.txt")
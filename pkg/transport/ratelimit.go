@@ -0,0 +1,500 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coreseekdev/texere/pkg/metrics"
+	"github.com/coreseekdev/texere/pkg/ot/json0"
+)
+
+// ========== Rate Limiting ==========
+
+var (
+	// ErrRateLimited is returned when a client or session sends messages
+	// faster than RateLimitConfig allows.
+	ErrRateLimited = &TransportError{Code: "rate_limited", Message: "too many messages"}
+
+	// ErrOperationTooLarge is returned when an operation exceeds
+	// RateLimitConfig.MaxOperationBytes or MaxInsertLength.
+	ErrOperationTooLarge = &TransportError{Code: "operation_too_large", Message: "operation too large"}
+
+	// ErrDocumentTooLarge is returned when an operation would grow a
+	// document beyond RateLimitConfig.MaxDocumentBytes.
+	ErrDocumentTooLarge = &TransportError{Code: "document_too_large", Message: "document too large"}
+
+	// ErrQuotaExceeded is returned when a user would exceed
+	// RateLimitConfig.MaxSubscriptionsPerUser or MaxSessionsPerUser.
+	ErrQuotaExceeded = &TransportError{Code: "quota_exceeded", Message: "quota exceeded"}
+)
+
+// Names of the limits in LimitError.Limit and the limit label of
+// MetricLimitViolations.
+const (
+	LimitMessageRate   = "messages_per_second"
+	LimitOperationRate = "operations_per_second"
+	LimitOperationSize = "max_operation_bytes"
+	LimitInsertLength  = "max_insert_length"
+	LimitDocumentSize  = "max_document_bytes"
+	LimitSubscriptions = "max_subscriptions_per_user"
+	LimitSessions      = "max_sessions_per_user"
+)
+
+// violationWindow is how long a client has to behave for its violations
+// to be forgotten.
+const violationWindow = time.Minute
+
+// RateLimitConfig configures the limits that protect the server from
+// misbehaving clients. Zero values disable the setting.
+type RateLimitConfig struct {
+	// MessagesPerSecond and MessageBurst limit the messages of one
+	// connection with a token bucket.
+	MessagesPerSecond float64
+	MessageBurst      int
+
+	// OperationsPerSecond and OperationBurst limit the operations, merges
+	// and CRDT updates applied to one session by all its clients.
+	OperationsPerSecond float64
+	OperationBurst      int
+
+	MaxMessageBytes   int64 // Encoded client message; larger ones close the connection
+	MaxOperationBytes int   // Encoded data of an operation, merge or CRDT update
+	MaxInsertLength   int   // Characters inserted by one operation, text or JSON
+	MaxDocumentBytes  int   // Content of a document of any content type
+
+	MaxSubscriptionsPerUser int // Sessions the clients of a user are in
+	MaxSessionsPerUser      int // Sessions a user is editing
+
+	// DisconnectAfter closes the connection of a client at its Nth
+	// violation. Violations are forgotten after a minute without any.
+	DisconnectAfter int
+}
+
+// DefaultRateLimitConfig returns limits that leave room for fast typists,
+// pastes and large files, but stop floods.
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		MessagesPerSecond:       100,
+		MessageBurst:            200,
+		OperationsPerSecond:     200,
+		OperationBurst:          400,
+		MaxMessageBytes:         8 << 20,
+		MaxOperationBytes:       4 << 20,
+		MaxInsertLength:         1 << 20,
+		MaxDocumentBytes:        16 << 20,
+		MaxSubscriptionsPerUser: 100,
+		MaxSessionsPerUser:      20,
+		DisconnectAfter:         50,
+	}
+}
+
+// LimitError is a violated rate limit or quota. It is sent to the client
+// as an error with the limit in its details.
+type LimitError struct {
+	Err        *TransportError // ErrRateLimited, ErrOperationTooLarge, ...
+	Limit      string          // One of the Limit* names
+	Max        float64         // Value of the limit
+	SessionID  string          // Session the message was for, if any
+	RetryAfter time.Duration   // When the client may retry, for rate limits
+}
+
+// Error implements error.
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: %s is %v", e.Err.Message, e.Limit, e.Max)
+}
+
+// Unwrap returns the transport error, so errors.Is and errorCode work.
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// details returns the ErrorData details of the error.
+func (e *LimitError) details() map[string]interface{} {
+	details := map[string]interface{}{
+		"limit": e.Limit,
+		"max":   e.Max,
+	}
+	if e.RetryAfter > 0 {
+		details["retry_after_ms"] = e.RetryAfter.Milliseconds()
+	}
+	return details
+}
+
+// tokenBucket holds up to burst tokens and refills at rate per second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket.
+func newTokenBucket(burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: float64(max(burst, 1)), last: now}
+}
+
+// take takes a token. If there is none, it returns false and how long
+// until there is one.
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) (bool, time.Duration) {
+	b.refill(now, rate, burst)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// refill adds the tokens earned since the last call.
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens = math.Min(float64(max(burst, 1)), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+// full returns true if the bucket would be full at now.
+func (b *tokenBucket) full(now time.Time, rate float64, burst int) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= float64(max(burst, 1))
+}
+
+// clientLimits is the rate limiting state of a connection.
+type clientLimits struct {
+	messages      *tokenBucket
+	violations    int
+	lastViolation time.Time
+}
+
+// rateLimiter holds the token buckets of connections and sessions.
+type rateLimiter struct {
+	mu       sync.Mutex
+	config   RateLimitConfig
+	clients  map[string]*clientLimits
+	sessions map[string]*tokenBucket
+	pruneAt  int // Buckets at which idle ones are pruned
+}
+
+// minPruneAt is the number of buckets below which none are pruned.
+const minPruneAt = 1024
+
+// newRateLimiter creates a rate limiter.
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		config:   config,
+		clients:  make(map[string]*clientLimits),
+		sessions: make(map[string]*tokenBucket),
+		pruneAt:  minPruneAt,
+	}
+}
+
+// allowMessage takes a message token of a client.
+func (rl *rateLimiter) allowMessage(clientID string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rate, burst := rl.config.MessagesPerSecond, rl.config.MessageBurst
+	if rate <= 0 {
+		return true, 0
+	}
+	client := rl.client(clientID, now)
+	return client.messages.take(now, rate, burst)
+}
+
+// allowOperation takes an operation token of a session.
+func (rl *rateLimiter) allowOperation(sessionID string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rate, burst := rl.config.OperationsPerSecond, rl.config.OperationBurst
+	if rate <= 0 {
+		return true, 0
+	}
+	bucket, ok := rl.sessions[sessionID]
+	if !ok {
+		rl.prune(now)
+		bucket = newTokenBucket(burst, now)
+		rl.sessions[sessionID] = bucket
+	}
+	return bucket.take(now, rate, burst)
+}
+
+// violation counts a violation of a client. Returns true if the client
+// should be disconnected; its state is dropped then.
+func (rl *rateLimiter) violation(clientID string, now time.Time) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	client := rl.client(clientID, now)
+	if now.Sub(client.lastViolation) > violationWindow {
+		client.violations = 0
+	}
+	client.violations++
+	client.lastViolation = now
+
+	if after := rl.config.DisconnectAfter; after > 0 && client.violations >= after {
+		delete(rl.clients, clientID)
+		return true
+	}
+	return false
+}
+
+// client returns the state of a client, creating it if needed. The
+// caller holds rl.mu.
+func (rl *rateLimiter) client(clientID string, now time.Time) *clientLimits {
+	client, ok := rl.clients[clientID]
+	if !ok {
+		rl.prune(now)
+		client = &clientLimits{messages: newTokenBucket(rl.config.MessageBurst, now)}
+		rl.clients[clientID] = client
+	}
+	return client
+}
+
+// prune drops the state of idle connections and sessions once there are
+// many, so that clients and sessions that are gone don't pile up. The
+// caller holds rl.mu.
+func (rl *rateLimiter) prune(now time.Time) {
+	if len(rl.clients)+len(rl.sessions) < rl.pruneAt {
+		return
+	}
+	for id, client := range rl.clients {
+		if now.Sub(client.lastViolation) > violationWindow &&
+			client.messages.full(now, rl.config.MessagesPerSecond, rl.config.MessageBurst) {
+			delete(rl.clients, id)
+		}
+	}
+	for id, bucket := range rl.sessions {
+		if bucket.full(now, rl.config.OperationsPerSecond, rl.config.OperationBurst) {
+			delete(rl.sessions, id)
+		}
+	}
+	rl.pruneAt = max(minPruneAt, 2*(len(rl.clients)+len(rl.sessions)))
+}
+
+// rateLimitedTypes are the message types that change a document. They
+// count against the operation rate of their session.
+var rateLimitedTypes = map[MessageType]bool{
+	MessageTypeOperation:     true,
+	MessageTypeCellOperation: true,
+	MessageTypeMerge:         true,
+	MessageTypeCRDTSync:      true,
+	MessageTypeCRDTUpdate:    true,
+}
+
+// SetRateLimitConfig sets the rate limits and quotas, and resets the
+// token buckets. The message size limit applies to connections accepted
+// from now on.
+//
+// Example:
+//
+//	config := transport.DefaultRateLimitConfig()
+//	config.MaxDocumentBytes = 64 << 20
+//	handler.SetRateLimitConfig(config)
+func (h *ProtocolHandler) SetRateLimitConfig(config RateLimitConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.limiter = newRateLimiter(config)
+	if h.server != nil {
+		h.server.SetReadLimit(config.MaxMessageBytes)
+	}
+}
+
+// RateLimitConfig returns the rate limits and quotas.
+func (h *ProtocolHandler) RateLimitConfig() RateLimitConfig {
+	limiter := h.rateLimiter()
+	if limiter == nil {
+		return RateLimitConfig{}
+	}
+	return limiter.config
+}
+
+// rateLimiter returns the rate limiter, or nil if no limits are set.
+func (h *ProtocolHandler) rateLimiter() *rateLimiter {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.limiter
+}
+
+// limitMessages is middleware that enforces the message rate of
+// connections, and the operation size and rate of sessions.
+func (h *ProtocolHandler) limitMessages(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(c *MessageContext) error {
+		limiter := h.rateLimiter()
+		if limiter == nil {
+			return next(c)
+		}
+		config := limiter.config
+		now := time.Now()
+
+		if ok, retry := limiter.allowMessage(c.ClientID(), now); !ok {
+			return &LimitError{Err: ErrRateLimited, Limit: LimitMessageRate, Max: config.MessagesPerSecond,
+				SessionID: c.Protocol.SessionID, RetryAfter: retry}
+		}
+		if !rateLimitedTypes[c.Type()] {
+			return next(c)
+		}
+
+		var target struct {
+			SessionID string `json:"session_id"`
+		}
+		json.Unmarshal(c.Protocol.Data, &target)
+		if max := config.MaxOperationBytes; max > 0 && len(c.Protocol.Data) > max {
+			return &LimitError{Err: ErrOperationTooLarge, Limit: LimitOperationSize, Max: float64(max), SessionID: target.SessionID}
+		}
+		if ok, retry := limiter.allowOperation(target.SessionID, now); !ok {
+			return &LimitError{Err: ErrRateLimited, Limit: LimitOperationRate, Max: config.OperationsPerSecond,
+				SessionID: target.SessionID, RetryAfter: retry}
+		}
+		return next(c)
+	}
+}
+
+// checkInserts checks the inserts of a client's text operation against
+// MaxInsertLength.
+func (h *ProtocolHandler) checkInserts(sessionID string, opData []interface{}) *LimitError {
+	limiter := h.rateLimiter()
+	if limiter == nil || limiter.config.MaxInsertLength <= 0 {
+		return nil
+	}
+	max := limiter.config.MaxInsertLength
+	for _, component := range opData {
+		if insert, ok := component.(string); ok && utf8.RuneCountInString(insert) > max {
+			return &LimitError{Err: ErrOperationTooLarge, Limit: LimitInsertLength, Max: float64(max), SessionID: sessionID}
+		}
+	}
+	return nil
+}
+
+// checkJSONInserts checks the inserts of a client's json0 operation
+// against MaxInsertLength. Inserted values count the characters of their
+// JSON encoding, text subtype operations the characters they insert.
+func (h *ProtocolHandler) checkJSONInserts(sessionID string, op *json0.Operation) *LimitError {
+	limiter := h.rateLimiter()
+	if limiter == nil || limiter.config.MaxInsertLength <= 0 {
+		return nil
+	}
+	max := limiter.config.MaxInsertLength
+	for _, c := range op.Components() {
+		if c.O != nil {
+			if err := h.checkInserts(sessionID, c.O.ToJSON()); err != nil {
+				return err
+			}
+		}
+		for _, value := range []*json0.Value{c.LI, c.OI} {
+			if value == nil {
+				continue
+			}
+			encoded, err := json.Marshal(value.V)
+			if err == nil && utf8.RuneCount(encoded) <= max {
+				continue
+			}
+			return &LimitError{Err: ErrOperationTooLarge, Limit: LimitInsertLength, Max: float64(max), SessionID: sessionID}
+		}
+	}
+	return nil
+}
+
+// checkDocumentSize checks the new content of a document against
+// MaxDocumentBytes.
+func (h *ProtocolHandler) checkDocumentSize(sessionID, content string) *LimitError {
+	limiter := h.rateLimiter()
+	if limiter == nil || limiter.config.MaxDocumentBytes <= 0 || len(content) <= limiter.config.MaxDocumentBytes {
+		return nil
+	}
+	return &LimitError{Err: ErrDocumentTooLarge, Limit: LimitDocumentSize, Max: float64(limiter.config.MaxDocumentBytes), SessionID: sessionID}
+}
+
+// documentSizeCheck returns a check of new session content against
+// MaxDocumentBytes, for the JSON and notebook apply functions.
+func (h *ProtocolHandler) documentSizeCheck(sessionID string) func(content string) error {
+	return func(content string) error {
+		if err := h.checkDocumentSize(sessionID, content); err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+// admitUser checks that the user of a client may join a session, and
+// edit it if editing, without exceeding its quotas. Sessions the client
+// is already in, or already editing, are always admitted.
+func (h *ProtocolHandler) admitUser(es *EditSession, clientID string, editing bool) *LimitError {
+	limiter := h.rateLimiter()
+	if limiter == nil {
+		return nil
+	}
+	config := limiter.config
+	if config.MaxSubscriptionsPerUser <= 0 && config.MaxSessionsPerUser <= 0 {
+		return nil
+	}
+
+	client := es.GetClient(clientID)
+	if client != nil && (!editing || client.IsEditing) {
+		return nil
+	}
+
+	// Clients of unauthenticated connections are their own users
+	userID := ""
+	if user := h.userOf(clientID); user != nil {
+		userID = user.UserID
+	}
+	subscribed, edited := h.userSessions(userID, clientID)
+
+	if max := config.MaxSubscriptionsPerUser; client == nil && max > 0 && subscribed >= max {
+		return &LimitError{Err: ErrQuotaExceeded, Limit: LimitSubscriptions, Max: float64(max), SessionID: es.SessionID}
+	}
+	if max := config.MaxSessionsPerUser; editing && max > 0 && edited >= max {
+		return &LimitError{Err: ErrQuotaExceeded, Limit: LimitSessions, Max: float64(max), SessionID: es.SessionID}
+	}
+	return nil
+}
+
+// userSessions returns the number of sessions the clients of a user are
+// in, and are editing. Without a user ID, only the client counts.
+func (h *ProtocolHandler) userSessions(userID, clientID string) (subscribed, editing int) {
+	for _, es := range h.sessionManager.ListSessions() {
+		in, edits := false, false
+		es.mu.RLock()
+		for _, client := range es.Clients {
+			if (userID != "" && client.UserID == userID) || client.ClientID == clientID {
+				in = true
+				edits = edits || client.IsEditing
+			}
+		}
+		es.mu.RUnlock()
+		if in {
+			subscribed++
+		}
+		if edits {
+			editing++
+		}
+	}
+	return subscribed, editing
+}
+
+// rejectLimit sends a violated limit to the client, and disconnects the
+// client if it violated too many.
+func (h *ProtocolHandler) rejectLimit(msg *Message, err *LimitError) {
+	h.recorder().Add(MetricLimitViolations, 1, metrics.L("limit", err.Limit))
+	h.log().Warn("limit exceeded", LogKeyClient, msg.ClientID, LogKeySession, err.SessionID, LogKeyTrace, msg.TraceID,
+		"limit", err.Limit, "max", err.Max)
+
+	h.reply(msg, MessageTypeError, &ErrorData{
+		SessionID: err.SessionID,
+		Code:      err.Err.Code,
+		Message:   err.Error(),
+		Details:   err.details(),
+	})
+
+	limiter := h.rateLimiter()
+	if limiter == nil || !limiter.violation(msg.ClientID, time.Now()) {
+		return
+	}
+	h.log().Warn("disconnecting client for repeated violations", LogKeyClient, msg.ClientID, LogKeyTrace, msg.TraceID)
+	h.recorder().Add(MetricLimitDisconnects, 1)
+	h.mu.RLock()
+	server := h.server
+	h.mu.RUnlock()
+	if server != nil {
+		server.Disconnect(msg.ClientID)
+	}
+}
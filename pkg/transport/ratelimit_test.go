@@ -0,0 +1,195 @@
+package transport
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/coreseekdev/texere/pkg/concordia"
+	"github.com/coreseekdev/texere/pkg/ot/json0"
+)
+
+// limitedNode returns a node with two subscribed clients, alice and bob,
+// and the rate limits set after they subscribed.
+func limitedNode(t *testing.T, config RateLimitConfig) (*clusterNode, string) {
+	t.Helper()
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+
+	node := &clusterNode{handler: handler, server: server}
+	node.connect("alice")
+	node.connect("bob")
+	var snapshot SnapshotData
+	node.send(t, "alice", MessageTypeSubscribe, &SubscribeData{FilePath: "/limits.txt"})
+	node.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+	node.send(t, "bob", MessageTypeSubscribe, &SubscribeData{FilePath: "/limits.txt"})
+	node.receive(t, "bob", MessageTypeSnapshot, &snapshot)
+
+	handler.SetRateLimitConfig(config)
+	return node, snapshot.SessionID
+}
+
+// expectLimit checks that a client received an error for a limit.
+func expectLimit(t *testing.T, node *clusterNode, clientID, code, limit string) *ErrorData {
+	t.Helper()
+	var errorData ErrorData
+	node.receive(t, clientID, MessageTypeError, &errorData)
+	if errorData.Code != code || errorData.Details["limit"] != limit {
+		t.Errorf("Expected %s for %s, got %+v", code, limit, errorData)
+	}
+	return &errorData
+}
+
+// TestRateLimit_Messages tests the message rate of a connection and the
+// disconnect after repeated violations.
+func TestRateLimit_Messages(t *testing.T) {
+	node, sessionID := limitedNode(t, RateLimitConfig{
+		MessagesPerSecond: 0.001,
+		MessageBurst:      2,
+		DisconnectAfter:   2,
+	})
+	heartbeat := &HeartbeatData{SessionIDs: []string{sessionID}}
+
+	node.send(t, "alice", MessageTypeHeartbeat, heartbeat)
+	node.send(t, "alice", MessageTypeHeartbeat, heartbeat)
+	node.send(t, "alice", MessageTypeHeartbeat, heartbeat)
+	errorData := expectLimit(t, node, "alice", "rate_limited", LimitMessageRate)
+	if retry, _ := errorData.Details["retry_after_ms"].(float64); retry <= 0 {
+		t.Errorf("Expected retry_after_ms, got %v", errorData.Details)
+	}
+	if node.server.clients["alice"].queue.isClosed() {
+		t.Fatal("Expected alice to stay connected after one violation")
+	}
+
+	// Other connections have their own bucket
+	node.send(t, "bob", MessageTypeHeartbeat, heartbeat)
+	if _, ok := node.server.clients["bob"].queue.pop(); ok {
+		t.Error("Expected bob's heartbeat to be accepted")
+	}
+
+	node.send(t, "alice", MessageTypeHeartbeat, heartbeat)
+	expectLimit(t, node, "alice", "rate_limited", LimitMessageRate)
+	if !node.server.clients["alice"].queue.isClosed() {
+		t.Error("Expected alice to be disconnected")
+	}
+}
+
+// TestRateLimit_Operations tests the operation rate of a session and the
+// size limits of operations and documents.
+func TestRateLimit_Operations(t *testing.T) {
+	node, sessionID := limitedNode(t, RateLimitConfig{
+		OperationsPerSecond: 0.001,
+		OperationBurst:      3,
+		MaxOperationBytes:   100,
+		MaxInsertLength:     5,
+		MaxDocumentBytes:    8,
+	})
+	operation := func(clientID string, op ...interface{}) {
+		node.send(t, clientID, MessageTypeOperation, &OperationData{SessionID: sessionID, Operation: op})
+	}
+
+	operation("alice", "hello world")
+	expectLimit(t, node, "alice", "operation_too_large", LimitInsertLength)
+
+	operation("alice", "hello")
+	node.receive(t, "alice", MessageTypeAck, &AckData{})
+	operation("bob", 5, "!!!!")
+	errorData := expectLimit(t, node, "bob", "document_too_large", LimitDocumentSize)
+	if errorData.SessionID != sessionID {
+		t.Errorf("Expected the error for session %s, got %q", sessionID, errorData.SessionID)
+	}
+
+	// Rejected operations cost tokens too, and the session's tokens are
+	// shared by its clients
+	operation("alice", 5, "!")
+	expectLimit(t, node, "alice", "rate_limited", LimitOperationRate)
+
+	node.send(t, "bob", MessageTypeMerge, &MergeData{SessionID: sessionID, Content: string(make([]byte, 200))})
+	expectLimit(t, node, "bob", "operation_too_large", LimitOperationSize)
+
+	if content, _ := node.handler.ReadContent("/limits.txt"); content != "hello" {
+		t.Errorf("Expected only the first operation to be applied, got %q", content)
+	}
+}
+
+// TestRateLimit_JSONAndNotebook tests that the insert and document size
+// limits apply to JSON and notebook sessions.
+func TestRateLimit_JSONAndNotebook(t *testing.T) {
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	node := &clusterNode{handler: handler, server: server}
+	node.connect("alice")
+
+	var jsonSnapshot, notebookSnapshot SnapshotData
+	node.send(t, "alice", MessageTypeStartEditing, &StartEditingData{FilePath: "/limits.json", ContentType: ContentTypeJSON})
+	node.receive(t, "alice", MessageTypeSnapshot, &jsonSnapshot)
+	node.send(t, "alice", MessageTypeStartEditing, &StartEditingData{FilePath: "/limits.ipynb", ContentType: ContentTypeNotebook})
+	node.receive(t, "alice", MessageTypeSnapshot, &notebookSnapshot)
+
+	handler.SetRateLimitConfig(RateLimitConfig{
+		MaxInsertLength:  10,
+		MaxDocumentBytes: len(notebookSnapshot.Content) + 20,
+	})
+	jsonOperation := func(op ...interface{}) {
+		node.send(t, "alice", MessageTypeOperation, &OperationData{SessionID: jsonSnapshot.SessionID, Operation: op})
+	}
+	insertCell := func(source string) {
+		node.send(t, "alice", MessageTypeCellOperation, &CellOperationData{SessionID: notebookSnapshot.SessionID,
+			Action: CellActionInsert, Cell: &concordia.NotebookCell{CellType: concordia.CellTypeCode, Source: source}})
+	}
+
+	jsonOperation(map[string]interface{}{"p": []interface{}{"key"}, "oi": "a long inserted value"})
+	expectLimit(t, node, "alice", "operation_too_large", LimitInsertLength)
+
+	jsonOperation(map[string]interface{}{"p": []interface{}{"key"}, "oi": "value"})
+	node.receive(t, "alice", MessageTypeAck, &AckData{})
+	jsonOperation(map[string]interface{}{"p": []interface{}{"key"}, "t": json0.SubtypeText, "o": []interface{}{5, "a longer text"}})
+	expectLimit(t, node, "alice", "operation_too_large", LimitInsertLength)
+
+	// Each insert is small, all of them grow the document beyond the limit
+	var inserts []interface{}
+	for i := 0; i < 6; i++ {
+		inserts = append(inserts, map[string]interface{}{"p": []interface{}{fmt.Sprint("key", i)}, "oi": "12345678"})
+	}
+	jsonOperation(inserts...)
+	expectLimit(t, node, "alice", "document_too_large", LimitDocumentSize)
+	if content, _ := handler.ReadContent("/limits.json"); content != `{"key":"value"}` {
+		t.Errorf("Expected the rejected operation not to be applied, got %q", content)
+	}
+
+	insertCell("a long cell source")
+	expectLimit(t, node, "alice", "operation_too_large", LimitInsertLength)
+	insertCell("x = 1")
+	expectLimit(t, node, "alice", "document_too_large", LimitDocumentSize)
+	if cells := handler.sessionManager.GetSession(notebookSnapshot.SessionID).GetNotebook().Len(); cells != 0 {
+		t.Errorf("Expected the rejected cell not to be kept, got %d cells", cells)
+	}
+}
+
+// TestRateLimit_Quotas tests the subscription and editing quotas of users.
+func TestRateLimit_Quotas(t *testing.T) {
+	node, _ := limitedNode(t, RateLimitConfig{MaxSubscriptionsPerUser: 2, MaxSessionsPerUser: 1})
+
+	var snapshot SnapshotData
+	node.send(t, "alice", MessageTypeSubscribe, &SubscribeData{FilePath: "/second.txt"})
+	node.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+	node.send(t, "alice", MessageTypeSubscribe, &SubscribeData{FilePath: "/third.txt"})
+	expectLimit(t, node, "alice", "quota_exceeded", LimitSubscriptions)
+	if node.handler.sessionManager.GetSessionByPath("/third.txt") != nil {
+		t.Error("Expected the rejected session not to be kept")
+	}
+
+	// Resubscribing and editing a subscribed file need no new subscription
+	node.send(t, "alice", MessageTypeSubscribe, &SubscribeData{FilePath: "/second.txt"})
+	node.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+	node.send(t, "alice", MessageTypeStartEditing, &StartEditingData{FilePath: "/second.txt"})
+	node.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+
+	node.send(t, "alice", MessageTypeStartEditing, &StartEditingData{FilePath: "/limits.txt"})
+	expectLimit(t, node, "alice", "quota_exceeded", LimitSessions)
+
+	// Quotas are per user
+	node.send(t, "bob", MessageTypeStartEditing, &StartEditingData{FilePath: "/limits.txt"})
+	node.receive(t, "bob", MessageTypeSnapshot, &snapshot)
+}
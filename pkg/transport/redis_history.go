@@ -4,9 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"sync"
 	"time"
+
+	"github.com/coreseekdev/texere/pkg/rope"
 )
 
 // ========== Redis History Service ==========
@@ -15,14 +17,15 @@ import (
 // Falls back to MiniRedis if Redis is not available.
 type RedisHistoryService struct {
 	mu            sync.RWMutex
-	redisClient   RedisClient // Can be real Redis or MiniRedis
+	redisClient   RedisClient                // Can be real Redis or MiniRedis
 	sessionEvents map[string][]*HistoryEvent // sessionID -> events
 	eventChan     chan *HistoryEvent
 	closed        bool
 	wg            sync.WaitGroup
 	closeChan     chan struct{}
-	usePatchMode  bool // If true, use patch-based storage (like HedgeDoc)
+	usePatchMode  bool          // If true, use patch-based storage (like HedgeDoc)
 	patchManager  *PatchManager // Handles diff-match-patch operations
+	logger        *slog.Logger
 }
 
 // RedisClient defines the interface for Redis operations.
@@ -42,6 +45,10 @@ type RedisClient interface {
 	// Publish publishes a message to a channel.
 	Publish(channel string, message interface{}) error
 
+	// Subscribe subscribes to a channel. The returned channel receives
+	// published messages until the client is closed.
+	Subscribe(channel string) <-chan string
+
 	// Close closes the Redis connection.
 	Close() error
 }
@@ -62,6 +69,7 @@ func NewRedisHistoryService(redisClient RedisClient) *RedisHistoryService {
 		closeChan:     make(chan struct{}),
 		usePatchMode:  false, // Default: full content mode
 		patchManager:  NewPatchManager(),
+		logger:        componentLogger(nil, "history"),
 	}
 
 	// Start event processor
@@ -84,6 +92,7 @@ func NewRedisHistoryServiceWithOpts(redisClient RedisClient, usePatchMode bool)
 		closeChan:     make(chan struct{}),
 		usePatchMode:  usePatchMode,
 		patchManager:  NewPatchManager(),
+		logger:        componentLogger(nil, "history"),
 	}
 
 	// Start event processor
@@ -93,6 +102,35 @@ func NewRedisHistoryServiceWithOpts(redisClient RedisClient, usePatchMode bool)
 	return service
 }
 
+// SetLogger sets the logger of the service. It defaults to slog.Default().
+func (s *RedisHistoryService) SetLogger(logger *slog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger = componentLogger(logger, "history")
+}
+
+// eventLogger returns a logger tagged with the session, version and trace
+// of an event. Must be called with the lock held.
+func (s *RedisHistoryService) eventLogger(event *HistoryEvent) *slog.Logger {
+	return s.logger.With(LogKeySession, event.SessionID, LogKeyRevision, event.VersionID,
+		LogKeyTrace, event.TraceID, "event", event.EventType)
+}
+
+// dropEvent logs an event that did not fit in the event channel.
+func (s *RedisHistoryService) dropEvent(event *HistoryEvent) error {
+	s.mu.RLock()
+	s.eventLogger(event).Warn("event channel full, dropping event")
+	s.mu.RUnlock()
+	return fmt.Errorf("event channel full")
+}
+
+// log returns the logger of the service.
+func (s *RedisHistoryService) log() *slog.Logger {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.logger
+}
+
 // OnSnapshot handles snapshot events from edit sessions.
 func (s *RedisHistoryService) OnSnapshot(event *HistoryEvent) error {
 	if s.closed {
@@ -104,8 +142,7 @@ func (s *RedisHistoryService) OnSnapshot(event *HistoryEvent) error {
 	case s.eventChan <- event:
 		return nil
 	default:
-		log.Printf("Warning: history service event channel full, dropping snapshot event for session %s", event.SessionID)
-		return fmt.Errorf("event channel full")
+		return s.dropEvent(event)
 	}
 }
 
@@ -120,8 +157,22 @@ func (s *RedisHistoryService) OnOperation(event *HistoryEvent) error {
 	case s.eventChan <- event:
 		return nil
 	default:
-		log.Printf("Warning: history service event channel full, dropping operation event for session %s", event.SessionID)
-		return fmt.Errorf("event channel full")
+		return s.dropEvent(event)
+	}
+}
+
+// OnComment handles comment thread events from edit sessions.
+func (s *RedisHistoryService) OnComment(event *HistoryEvent) error {
+	if s.closed {
+		return fmt.Errorf("history service is closed")
+	}
+
+	// Send to event channel for async processing
+	select {
+	case s.eventChan <- event:
+		return nil
+	default:
+		return s.dropEvent(event)
 	}
 }
 
@@ -158,8 +209,10 @@ func (s *RedisHistoryService) handleEvent(event *HistoryEvent) {
 		}
 	case "operation":
 		s.storeOperation(event)
+	case "comment":
+		s.storeComment(event)
 	default:
-		log.Printf("Warning: unknown event type: %s", event.EventType)
+		s.eventLogger(event).Warn("unknown event type")
 	}
 }
 
@@ -169,34 +222,34 @@ func (s *RedisHistoryService) storeSnapshot(event *HistoryEvent) {
 	snapshotKey := fmt.Sprintf("snapshot:%s:%d", event.SessionID, event.VersionID)
 
 	snapshotData := map[string]interface{}{
-		"version_id":  event.VersionID,
-		"content":     event.Content,
-		"operations":  event.Operations,
-		"created_at":  event.CreatedAt,
-		"created_by":  event.CreatedBy,
+		"version_id": event.VersionID,
+		"content":    event.Content,
+		"operations": event.Operations,
+		"created_at": event.CreatedAt,
+		"created_by": event.CreatedBy,
 	}
 
 	if err := s.redisClient.Set(snapshotKey, snapshotData, 0); err != nil {
-		log.Printf("Error storing snapshot in Redis: %v", err)
+		s.eventLogger(event).Error("failed storing snapshot in Redis", LogKeyError, err)
 		return
 	}
 
 	// Add to session's snapshot list
 	listKey := fmt.Sprintf("snapshots:%s", event.SessionID)
 	if err := s.redisClient.LPush(listKey, snapshotData); err != nil {
-		log.Printf("Error adding snapshot to list: %v", err)
+		s.eventLogger(event).Error("failed adding snapshot to list", LogKeyError, err)
 	}
 
 	// Publish snapshot event for real-time notifications
 	pubKey := fmt.Sprintf("session:%s:snapshots", event.SessionID)
 	if err := s.redisClient.Publish(pubKey, snapshotData); err != nil {
-		log.Printf("Error publishing snapshot event: %v", err)
+		s.eventLogger(event).Error("failed publishing snapshot event", LogKeyError, err)
 	}
 
 	// Store in memory for quick access
 	s.sessionEvents[event.SessionID] = append(s.sessionEvents[event.SessionID], event)
 
-	log.Printf("Stored snapshot for session %s, version %d", event.SessionID, event.VersionID)
+	s.eventLogger(event).Debug("stored snapshot", "bytes", len(event.Content))
 }
 
 // storeSnapshotWithPatch stores a snapshot using patch-based storage (HedgeDoc-style).
@@ -227,12 +280,13 @@ func (s *RedisHistoryService) storeSnapshotWithPatch(event *HistoryEvent) {
 		}
 	}
 
-	// 2. Compute patch using diff-match-patch if we have previous content
+	// 2. Compute patch from the previous content if we have it
 	var patch string
 	var savedBytes int
 	if lastContent != "" && lastContent != event.Content {
-		// Use real diff-match-patch algorithm
-		patchResult := s.patchManager.ComputePatch(lastContent, event.Content)
+		// Chunked ropes have equal leaves outside the edits, which the
+		// diff matches by hash
+		patchResult := s.patchManager.ComputeRopePatch(rope.NewChunked(lastContent), rope.NewChunked(event.Content))
 		patch = patchResult.Patch
 		savedBytes = patchResult.SavedBytes
 	} else if event.Content != "" {
@@ -243,13 +297,13 @@ func (s *RedisHistoryService) storeSnapshotWithPatch(event *HistoryEvent) {
 
 	// 3. Store snapshot with patch or full content
 	snapshotData := map[string]interface{}{
-		"version_id":  event.VersionID,
-		"patch":       patch,
-		"content":     "", // Don't store full content in patch mode (except first snapshot)
+		"version_id":   event.VersionID,
+		"patch":        patch,
+		"content":      "",          // Don't store full content in patch mode (except first snapshot)
 		"last_content": lastContent, // Keep reference to previous content
-		"operations":  event.Operations,
-		"created_at":  event.CreatedAt,
-		"created_by":  event.CreatedBy,
+		"operations":   event.Operations,
+		"created_at":   event.CreatedAt,
+		"created_by":   event.CreatedBy,
 	}
 
 	// If this is the first snapshot or we don't have previous content, store full content
@@ -262,7 +316,7 @@ func (s *RedisHistoryService) storeSnapshotWithPatch(event *HistoryEvent) {
 	snapshotKey := fmt.Sprintf("snapshot:%s:%d", event.SessionID, event.VersionID)
 
 	if err := s.redisClient.Set(snapshotKey, snapshotData, 0); err != nil {
-		log.Printf("Error storing patch-based snapshot in Redis: %v", err)
+		s.eventLogger(event).Error("failed storing patch-based snapshot in Redis", LogKeyError, err)
 		return
 	}
 
@@ -270,20 +324,19 @@ func (s *RedisHistoryService) storeSnapshotWithPatch(event *HistoryEvent) {
 	listKey := fmt.Sprintf("snapshots:%s", event.SessionID)
 	snapshotJSON, _ := json.Marshal(snapshotData)
 	if err := s.redisClient.LPush(listKey, snapshotJSON); err != nil {
-		log.Printf("Error adding snapshot to list: %v", err)
+		s.eventLogger(event).Error("failed adding snapshot to list", LogKeyError, err)
 	}
 
 	// Publish snapshot event
 	pubKey := fmt.Sprintf("session:%s:snapshots", event.SessionID)
 	if err := s.redisClient.Publish(pubKey, snapshotData); err != nil {
-		log.Printf("Error publishing snapshot event: %v", err)
+		s.eventLogger(event).Error("failed publishing snapshot event", LogKeyError, err)
 	}
 
 	// Store in memory
 	s.sessionEvents[event.SessionID] = append(s.sessionEvents[event.SessionID], event)
 
-	log.Printf("Stored patch-based snapshot for session %s, version %d (patch: %d bytes, saved ~%d bytes)",
-		event.SessionID, event.VersionID, len(patch), savedBytes)
+	s.eventLogger(event).Debug("stored patch-based snapshot", "patch_bytes", len(patch), "saved_bytes", savedBytes)
 }
 
 // storeOperation stores an operation in Redis.
@@ -299,26 +352,68 @@ func (s *RedisHistoryService) storeOperation(event *HistoryEvent) {
 	}
 
 	if err := s.redisClient.Set(opKey, opData, 0); err != nil {
-		log.Printf("Error storing operation in Redis: %v", err)
+		s.eventLogger(event).Error("failed storing operation in Redis", LogKeyError, err)
 		return
 	}
 
 	// Add to session's operation list
 	listKey := fmt.Sprintf("operations:%s", event.SessionID)
 	if err := s.redisClient.LPush(listKey, opData); err != nil {
-		log.Printf("Error adding operation to list: %v", err)
+		s.eventLogger(event).Error("failed adding operation to list", LogKeyError, err)
 	}
 
 	// Publish operation event for real-time notifications
 	pubKey := fmt.Sprintf("session:%s:operations", event.SessionID)
 	if err := s.redisClient.Publish(pubKey, opData); err != nil {
-		log.Printf("Error publishing operation event: %v", err)
+		s.eventLogger(event).Error("failed publishing operation event", LogKeyError, err)
 	}
 
 	// Store in memory for quick access
 	s.sessionEvents[event.SessionID] = append(s.sessionEvents[event.SessionID], event)
 }
 
+// storeComment stores a comment thread event in Redis.
+// The event log is kept per session; the latest state is rebuilt by replaying it.
+func (s *RedisHistoryService) storeComment(event *HistoryEvent) {
+	listKey := fmt.Sprintf("comments:%s", event.SessionID)
+	if err := s.redisClient.LPush(listKey, event); err != nil {
+		s.eventLogger(event).Error("failed adding comment event to list", LogKeyError, err)
+		return
+	}
+
+	// Publish comment event for real-time notifications
+	pubKey := fmt.Sprintf("session:%s:comments", event.SessionID)
+	if err := s.redisClient.Publish(pubKey, event); err != nil {
+		s.eventLogger(event).Error("failed publishing comment event", LogKeyError, err)
+	}
+
+	// Store in memory for quick access
+	s.sessionEvents[event.SessionID] = append(s.sessionEvents[event.SessionID], event)
+}
+
+// GetComments retrieves the latest state of all comment threads for a session.
+func (s *RedisHistoryService) GetComments(ctx context.Context, sessionID string) ([]*CommentThread, error) {
+	listKey := fmt.Sprintf("comments:%s", sessionID)
+
+	values, err := s.redisClient.LRange(listKey, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get comments: %w", err)
+	}
+
+	// LPush stores newest first; replay oldest first
+	events := make([]*HistoryEvent, 0, len(values))
+	for i := len(values) - 1; i >= 0; i-- {
+		var event HistoryEvent
+		if err := json.Unmarshal([]byte(values[i]), &event); err != nil {
+			s.log().Warn("failed to decode stored comment event", LogKeyError, err)
+			continue
+		}
+		events = append(events, &event)
+	}
+
+	return CommentThreadsFromEvents(events), nil
+}
+
 // GetSessionHistory retrieves history for a session from Redis.
 func (s *RedisHistoryService) GetSessionHistory(ctx context.Context, sessionID string, limit int64) ([]*HistoryEvent, error) {
 	listKey := fmt.Sprintf("operations:%s", sessionID)
@@ -332,7 +427,7 @@ func (s *RedisHistoryService) GetSessionHistory(ctx context.Context, sessionID s
 	for _, value := range values {
 		var event HistoryEvent
 		if err := json.Unmarshal([]byte(value), &event); err != nil {
-			log.Printf("Error unmarshaling history event: %v", err)
+			s.log().Warn("failed to decode stored history event", LogKeyError, err)
 			continue
 		}
 		events = append(events, &event)
@@ -409,7 +504,7 @@ func (s *RedisHistoryService) ListSnapshots(ctx context.Context, sessionID strin
 	for _, value := range values {
 		var event HistoryEvent
 		if err := json.Unmarshal([]byte(value), &event); err != nil {
-			log.Printf("Error unmarshaling snapshot: %v", err)
+			s.log().Warn("failed to decode stored snapshot", LogKeyError, err)
 			continue
 		}
 
@@ -448,7 +543,7 @@ func (s *RedisHistoryService) Close() error {
 
 	// Close Redis connection
 	if err := s.redisClient.Close(); err != nil {
-		log.Printf("Error closing Redis connection: %v", err)
+		s.logger.Error("failed to close Redis connection", LogKeyError, err)
 	}
 
 	close(s.eventChan)
@@ -460,11 +555,11 @@ func (s *RedisHistoryService) Close() error {
 
 // MiniRedis is an in-memory implementation of RedisClient for testing/fallback.
 type MiniRedis struct {
-	mu       sync.RWMutex
-	data     map[string]string              // String values
-	lists    map[string][]string            // List values
-	subs     map[string][]chan string       // Pub/Sub subscribers
-	closed   bool
+	mu     sync.RWMutex
+	data   map[string]string        // String values
+	lists  map[string][]string      // List values
+	subs   map[string][]chan string // Pub/Sub subscribers
+	closed bool
 }
 
 // NewMiniRedis creates a new MiniRedis instance.
@@ -559,7 +654,7 @@ func (m *MiniRedis) LRange(key string, start, stop int64) ([]string, error) {
 		return []string{}, nil
 	}
 
-	return list[start:stop+1], nil
+	return list[start : stop+1], nil
 }
 
 // Publish publishes a message to a channel.
@@ -594,7 +689,7 @@ func (m *MiniRedis) Publish(channel string, message interface{}) error {
 	return nil
 }
 
-// Subscribe subscribes to a channel (MiniRedis extension).
+// Subscribe subscribes to a channel.
 func (m *MiniRedis) Subscribe(channel string) <-chan string {
 	m.mu.Lock()
 	defer m.mu.Unlock()
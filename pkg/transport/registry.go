@@ -0,0 +1,276 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/coreseekdev/texere/pkg/session"
+)
+
+// ========== Message Registry ==========
+
+var (
+	// ErrUnknownMessageType is returned when no handler is registered for
+	// a message type.
+	ErrUnknownMessageType = &TransportError{Code: "unknown_message_type", Message: "unknown message type"}
+
+	// ErrInvalidMessageData is returned when message data can't be decoded.
+	ErrInvalidMessageData = &TransportError{Code: "invalid_data", Message: "invalid message data"}
+)
+
+// MessageContext is a client message being handled. Replies sent through
+// it carry the request ID of the message, so clients can match them to
+// their requests.
+type MessageContext struct {
+	Handler  *ProtocolHandler
+	Message  *Message
+	Protocol *ProtocolMessage
+
+	values map[string]interface{}
+}
+
+// ClientID returns the ID of the client that sent the message.
+func (c *MessageContext) ClientID() string {
+	return c.Message.ClientID
+}
+
+// User returns the user the client authenticated as when it connected,
+// or nil if the server has no authenticator or the client is connected
+// to another cluster node.
+func (c *MessageContext) User() *session.UserInfo {
+	return c.Handler.userOf(c.Message.ClientID)
+}
+
+// Capabilities returns the protocol version and features negotiated
+// with the client, for handlers that behave differently per client.
+func (c *MessageContext) Capabilities() *Capabilities {
+	return c.Handler.capabilitiesOf(c.Message.ClientID)
+}
+
+// Type returns the message type.
+func (c *MessageContext) Type() MessageType {
+	return c.Protocol.Type
+}
+
+// RequestID returns the correlation ID set by the client, if any.
+func (c *MessageContext) RequestID() string {
+	return c.Protocol.RequestID
+}
+
+// TraceID returns the ID correlating the log records of this message.
+func (c *MessageContext) TraceID() string {
+	return c.Protocol.TraceID
+}
+
+// Logger returns a logger tagged with the client, type and trace ID of
+// the message.
+func (c *MessageContext) Logger() *slog.Logger {
+	logger := componentLogger(nil, "handler")
+	if c.Handler != nil {
+		logger = c.Handler.log()
+	}
+	return logger.With(LogKeyClient, c.ClientID(), LogKeyType, c.Type(), LogKeyTrace, c.TraceID())
+}
+
+// Decode unmarshals the message data into v.
+func (c *MessageContext) Decode(v interface{}) error {
+	if len(c.Protocol.Data) == 0 {
+		return fmt.Errorf("%w: %s has no data", ErrInvalidMessageData, c.Protocol.Type)
+	}
+	if err := json.Unmarshal(c.Protocol.Data, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMessageData, err)
+	}
+	return nil
+}
+
+// Reply sends a message to the client, correlated with this message.
+func (c *MessageContext) Reply(msgType MessageType, data interface{}) error {
+	return c.Handler.reply(c.Message, msgType, data)
+}
+
+// ReplyError sends an error to the client, correlated with this message.
+func (c *MessageContext) ReplyError(code, message string) {
+	c.Handler.replyError(c.Message, c.Protocol.SessionID, code, message)
+}
+
+// Set stores a value for later middleware and the handler, e.g. the
+// authenticated user.
+func (c *MessageContext) Set(key string, value interface{}) {
+	if c.values == nil {
+		c.values = make(map[string]interface{})
+	}
+	c.values[key] = value
+}
+
+// Get returns a value stored with Set.
+func (c *MessageContext) Get(key string) (interface{}, bool) {
+	value, ok := c.values[key]
+	return value, ok
+}
+
+// MessageHandlerFunc handles a message. A returned error is sent to the
+// client; *TransportError codes are kept, other errors are sent as
+// "handler_error".
+type MessageHandlerFunc func(c *MessageContext) error
+
+// Middleware wraps a handler, e.g. to authenticate, validate, log or
+// measure messages. It may return without calling next to reject a
+// message.
+type Middleware func(next MessageHandlerFunc) MessageHandlerFunc
+
+// HandleTyped returns a handler that decodes the message data into a T
+// before calling fn.
+//
+// Example:
+//
+//	registry.Register("chat", HandleTyped(func(c *MessageContext, data *ChatData) error {
+//	    return c.Reply("chat_ack", &ChatAck{ID: data.ID})
+//	}))
+func HandleTyped[T any](fn func(c *MessageContext, data *T) error) MessageHandlerFunc {
+	return func(c *MessageContext) error {
+		data := new(T)
+		if err := c.Decode(data); err != nil {
+			return err
+		}
+		return fn(c, data)
+	}
+}
+
+// registration is a handler with its own middleware.
+type registration struct {
+	handler    MessageHandlerFunc
+	middleware []Middleware
+}
+
+// MessageRegistry maps message types to handlers and runs them through a
+// middleware chain. It is safe for concurrent use.
+type MessageRegistry struct {
+	mu         sync.RWMutex
+	handlers   map[MessageType]registration
+	middleware []Middleware
+}
+
+// NewMessageRegistry creates an empty registry.
+func NewMessageRegistry() *MessageRegistry {
+	return &MessageRegistry{
+		handlers: make(map[MessageType]registration),
+	}
+}
+
+// Register sets the handler for a message type, replacing any existing
+// one. The middleware runs only for this type, inside the global chain.
+func (r *MessageRegistry) Register(msgType MessageType, handler MessageHandlerFunc, middleware ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[msgType] = registration{handler: handler, middleware: middleware}
+}
+
+// Unregister removes the handler for a message type.
+func (r *MessageRegistry) Unregister(msgType MessageType) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.handlers, msgType)
+}
+
+// Handles returns true if a handler is registered for the message type.
+func (r *MessageRegistry) Handles(msgType MessageType) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.handlers[msgType]
+	return ok
+}
+
+// Types returns the registered message types, sorted.
+func (r *MessageRegistry) Types() []MessageType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	types := make([]MessageType, 0, len(r.handlers))
+	for msgType := range r.handlers {
+		types = append(types, msgType)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// Use appends middleware to the global chain. Middleware added first
+// runs first. The global chain also runs for unknown message types, so
+// it sees every message.
+func (r *MessageRegistry) Use(middleware ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Dispatch runs the handler for the message through the middleware
+// chain. It returns ErrUnknownMessageType if no handler is registered.
+func (r *MessageRegistry) Dispatch(c *MessageContext) error {
+	r.mu.RLock()
+	reg, ok := r.handlers[c.Protocol.Type]
+	global := r.middleware
+	r.mu.RUnlock()
+
+	handler := reg.handler
+	if !ok {
+		handler = func(c *MessageContext) error {
+			return fmt.Errorf("%w: %s", ErrUnknownMessageType, c.Protocol.Type)
+		}
+	}
+	handler = chain(handler, reg.middleware)
+	return chain(handler, global)(c)
+}
+
+// chain wraps handler in middleware, the first being the outermost.
+func chain(handler MessageHandlerFunc, middleware []Middleware) MessageHandlerFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// errorCode returns the code to report a handler error to the client.
+func errorCode(err error) string {
+	var transportErr *TransportError
+	if errors.As(err, &transportErr) {
+		return transportErr.Code
+	}
+	return "handler_error"
+}
+
+// ========== Middleware ==========
+
+// RecoverMiddleware turns a panicking handler into an error, so one bad
+// message doesn't take down the connection's read loop.
+func RecoverMiddleware() Middleware {
+	return func(next MessageHandlerFunc) MessageHandlerFunc {
+		return func(c *MessageContext) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					c.Logger().Error("handler panicked", "panic", r)
+					err = fmt.Errorf("internal error handling %s", c.Type())
+				}
+			}()
+			return next(c)
+		}
+	}
+}
+
+// RequireData rejects messages of the given types that have no data.
+func RequireData(types ...MessageType) Middleware {
+	required := make(map[MessageType]bool, len(types))
+	for _, msgType := range types {
+		required[msgType] = true
+	}
+	return func(next MessageHandlerFunc) MessageHandlerFunc {
+		return func(c *MessageContext) error {
+			if required[c.Type()] && len(c.Protocol.Data) == 0 {
+				return fmt.Errorf("%w: %s has no data", ErrInvalidMessageData, c.Type())
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// request handles a protocol message with a request ID from a client.
+func (n *clusterNode) request(t *testing.T, clientID, requestID string, msgType MessageType, data interface{}) {
+	t.Helper()
+	pm, err := NewProtocolMessage(msgType, "", data)
+	if err != nil {
+		t.Fatalf("NewProtocolMessage failed: %v", err)
+	}
+	pm.RequestID = requestID
+	raw, _ := json.Marshal(map[string]interface{}{
+		"type":      string(msgType),
+		"client_id": clientID,
+		"metadata":  map[string]interface{}{"protocol_message": pm},
+	})
+	n.handler.handleRawMessage(clientID, raw)
+}
+
+// next returns the next protocol message sent to a client.
+func (n *clusterNode) next(t *testing.T, clientID string) ProtocolMessage {
+	t.Helper()
+	msg, ok := n.server.clients[clientID].queue.pop()
+	if !ok {
+		t.Fatalf("Client %s received nothing", clientID)
+	}
+	var response struct {
+		Metadata struct {
+			ProtocolMessage ProtocolMessage `json:"protocol_message"`
+		} `json:"metadata"`
+	}
+	json.Unmarshal([]byte(msg.Metadata["raw_json"].(string)), &response)
+	return response.Metadata.ProtocolMessage
+}
+
+// TestMessageRegistry_Middleware tests the order of global and per-type middleware.
+func TestMessageRegistry_Middleware(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next MessageHandlerFunc) MessageHandlerFunc {
+			return func(c *MessageContext) error {
+				calls = append(calls, name)
+				return next(c)
+			}
+		}
+	}
+	deny := func(next MessageHandlerFunc) MessageHandlerFunc {
+		return func(c *MessageContext) error {
+			return &TransportError{Code: "forbidden", Message: "denied"}
+		}
+	}
+
+	registry := NewMessageRegistry()
+	registry.Use(trace("first"), trace("second"))
+	registry.Register("ping", func(c *MessageContext) error {
+		calls = append(calls, "handler")
+		return nil
+	}, trace("ping"))
+	registry.Register("admin", func(c *MessageContext) error {
+		t.Error("Expected the denied handler not to run")
+		return nil
+	}, deny)
+
+	newContext := func(msgType MessageType) *MessageContext {
+		return &MessageContext{Message: &Message{ClientID: "client-1"}, Protocol: &ProtocolMessage{Type: msgType}}
+	}
+
+	if err := registry.Dispatch(newContext("ping")); err != nil {
+		t.Fatalf("Dispatch failed: %v", err)
+	}
+	if got := strings.Join(calls, ","); got != "first,second,ping,handler" {
+		t.Errorf("Expected first,second,ping,handler, got %s", got)
+	}
+
+	calls = nil
+	if err := registry.Dispatch(newContext("admin")); errorCode(err) != "forbidden" {
+		t.Errorf("Expected forbidden, got %v", err)
+	}
+	if err := registry.Dispatch(newContext("missing")); !errors.Is(err, ErrUnknownMessageType) {
+		t.Errorf("Expected ErrUnknownMessageType, got %v", err)
+	}
+	if got := strings.Join(calls, ","); got != "first,second,first,second" {
+		t.Errorf("Expected the global chain to run for every message, got %s", got)
+	}
+
+	registry.Unregister("admin")
+	if registry.Handles("admin") || len(registry.Types()) != 1 {
+		t.Errorf("Expected only ping to be registered, got %v", registry.Types())
+	}
+}
+
+// TestProtocolHandler_CustomMessage tests custom message types and request IDs.
+func TestProtocolHandler_CustomMessage(t *testing.T) {
+	type chatData struct {
+		Text string `json:"text"`
+	}
+
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	node := &clusterNode{handler: handler, server: server}
+	node.connect("alice")
+
+	handler.Registry().Register("chat", HandleTyped(func(c *MessageContext, data *chatData) error {
+		return c.Reply("chat_ack", &chatData{Text: strings.ToUpper(data.Text)})
+	}))
+
+	node.request(t, "alice", "req-1", "chat", &chatData{Text: "hi"})
+	reply := node.next(t, "alice")
+	var ack chatData
+	json.Unmarshal(reply.Data, &ack)
+	if reply.Type != "chat_ack" || reply.RequestID != "req-1" || ack.Text != "HI" {
+		t.Errorf("Expected chat_ack HI for req-1, got %s %q for %q", reply.Type, ack.Text, reply.RequestID)
+	}
+
+	var errData ErrorData
+	node.request(t, "alice", "req-2", "chat", nil)
+	reply = node.next(t, "alice")
+	json.Unmarshal(reply.Data, &errData)
+	if reply.RequestID != "req-2" || errData.Code != "invalid_data" {
+		t.Errorf("Expected invalid_data for req-2, got %q for %q", errData.Code, reply.RequestID)
+	}
+
+	node.request(t, "alice", "req-3", "poll", nil)
+	reply = node.next(t, "alice")
+	json.Unmarshal(reply.Data, &errData)
+	if reply.RequestID != "req-3" || errData.Code != "unknown_message_type" {
+		t.Errorf("Expected unknown_message_type for req-3, got %q for %q", errData.Code, reply.RequestID)
+	}
+
+	// Replies of built-in handlers are correlated too
+	node.request(t, "alice", "req-4", MessageTypeSubscribe, &SubscribeData{FilePath: "/test.txt"})
+	reply = node.next(t, "alice")
+	if reply.Type != MessageTypeSnapshot || reply.RequestID != "req-4" {
+		t.Errorf("Expected snapshot for req-4, got %s for %q", reply.Type, reply.RequestID)
+	}
+}
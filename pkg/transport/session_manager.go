@@ -2,11 +2,20 @@ package transport
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
 	"sync"
 	"time"
+	"unicode/utf8"
 
-	"github.com/google/uuid"
+	"github.com/coreseekdev/texere/pkg/concordia"
+	"github.com/coreseekdev/texere/pkg/crdt"
+	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/ot/json0"
+	"github.com/coreseekdev/texere/pkg/rope"
 	"github.com/coreseekdev/texere/pkg/session"
+	"github.com/google/uuid"
 )
 
 // ContentStorage interface for loading file contents.
@@ -18,15 +27,22 @@ type ContentStorage interface {
 
 // HistoryEvent represents a history event that can be sent to Redis/History service.
 type HistoryEvent struct {
-	SessionID  string        `json:"session_id"`
-	FilePath   string        `json:"file_path"`
-	EventType  string        `json:"event_type"` // "snapshot" or "operation"
-	VersionID  int64         `json:"version_id"`
-	Content    string        `json:"content,omitempty"`      // Full content for snapshot
-	Operations []interface{} `json:"operations,omitempty"`  // OT operations
-	CreatedAt  int64         `json:"created_at"`
-	CreatedBy  string        `json:"created_by"`
+	SessionID  string                 `json:"session_id"`
+	FilePath   string                 `json:"file_path"`
+	EventType  string                 `json:"event_type"` // "snapshot", "operation" or "comment"
+	VersionID  int64                  `json:"version_id"`
+	Content    string                 `json:"content,omitempty"`    // Full content for snapshot
+	Operations []interface{}          `json:"operations,omitempty"` // OT operations
+	CreatedAt  int64                  `json:"created_at"`
+	CreatedBy  string                 `json:"created_by"`
 	Metadata   map[string]interface{} `json:"metadata,omitempty"` // Additional metadata (patches, etc.)
+	TraceID    string                 `json:"trace_id,omitempty"` // Trace of the message that caused the event
+
+	// Causality: HLC time of the event, and the operations of each client
+	// the session had applied, this one included. Set on operations and
+	// snapshots.
+	HLC     *concordia.HLCTime      `json:"hlc,omitempty"`
+	Version concordia.VersionVector `json:"version_vector,omitempty"`
 }
 
 // HistoryListener listens to edit session events and forwards to Redis/History service.
@@ -41,49 +57,110 @@ type HistoryListener interface {
 	Close() error
 }
 
+// CommentListener is implemented by history listeners that also persist
+// comment threads next to the document history.
+type CommentListener interface {
+	// OnComment is called when a comment thread is created, changed or orphaned.
+	OnComment(event *HistoryEvent) error
+}
+
+// CommentLoader is implemented by history listeners that can read stored
+// comment threads back; new sessions start with the threads of their file.
+type CommentLoader interface {
+	// GetComments returns the latest state of the threads of a session.
+	GetComments(ctx context.Context, sessionID string) ([]*CommentThread, error)
+}
+
 // ========== Edit Session ==========
 
 // EditSession represents an active editing session for a file.
 // Only keeps: 1 snapshot + recent changes (older history forwarded to Redis).
 type EditSession struct {
-	SessionID   string                       // UUID
-	FilePath    string                       // File path
-	RefCount    *SessionRefCount              // Reader/Writer counts
-	CreatedAt   int64                        // Session creation time
-	UpdatedAt   int64                        // Last update time
-	Clients     map[string]*SessionClient    // Connected clients (clientID -> client)
-	mu          sync.RWMutex
+	SessionID string                    // UUID
+	FilePath  string                    // File path
+	RefCount  *SessionRefCount          // Reader/Writer counts
+	CreatedAt int64                     // Session creation time
+	UpdatedAt int64                     // Last update time
+	Clients   map[string]*SessionClient // Connected clients (clientID -> client)
+	mu        sync.RWMutex
+
+	// Serializes text edits, from reading the base content until the
+	// operation is logged, so that operations, merges, CRDT updates and
+	// writes through the contents API never apply to the same base
+	applyMu sync.Mutex
 
 	// Current snapshot (always exactly 1)
-	snapshotContent string   // Current full content snapshot
-	snapshotVersion int64    // Version ID of current snapshot
+	snapshotContent string // Current full content snapshot
+	snapshotVersion int64  // Version ID of current snapshot
 
 	// Recent changes (in-memory only, forwarded to Redis)
-	recentChanges []interface{} // Recent OT operations since last snapshot
-	currentVersion int64        // Current version number
+	recentChanges  []interface{} // Recent OT operations since last snapshot
+	currentVersion int64         // Current version number
+	flushedVersion int64         // Version saved by the last successful save
 
 	// History listener (forwards to Redis/History service)
 	historyListener HistoryListener
 
+	// Events waiting to be written to the history listener, in order
+	historyMu    sync.Mutex
+	historyQueue []historyWrite
+	forwarding   bool // Whether a goroutine is writing the queue
+
+	// Tagged with the session ID and file path
+	logger *slog.Logger
+
+	// Comment threads anchored to ranges of the document
+	comments *CommentStore
+
+	// Formatting runs, created by the first rich-text operation
+	rich *concordia.RichDocument
+
+	// CRDT replica, created when the first CRDT peer syncs
+	crdt *crdt.Bridge
+
+	// Hybrid logical clock and per-client version vector of the session,
+	// stamped on history events
+	clock   *concordia.HybridClock
+	version concordia.VersionVector
+
+	// Document model: text (default) or JSON
+	contentType string
+	jsonDoc     interface{}         // Parsed document for JSON sessions
+	notebook    *concordia.Notebook // Cells for notebook sessions
+
+	// Last operations with their authors, kept across snapshots for
+	// debugging, see OpLog
+	opLog []OpLogEntry
+
 	// Snapshot creation settings
-	maxChangesBeforeSnapshot int // Max changes before forcing snapshot creation
-	lastSnapshotTime          int64 // Timestamp of last snapshot
-	maxSnapshotInterval       int64 // Max time between snapshots (seconds)
+	maxChangesBeforeSnapshot int   // Max changes before forcing snapshot creation
+	lastSnapshotTime         int64 // Timestamp of last snapshot
+	maxSnapshotInterval      int64 // Max time between snapshots (seconds)
 }
 
+// Content types an edit session can host.
+// Any other StartEditingData.ContentType ("markdown", ...) is edited as text.
+const (
+	ContentTypeText     = "text"     // Plain text, edited with ot.Operation
+	ContentTypeJSON     = "json"     // JSON document, edited with json0.Operation
+	ContentTypeNotebook = "notebook" // Jupyter notebook, see concordia.Notebook
+)
+
 const (
 	// DefaultMaxChangesBeforeSnapshot is the default max changes before creating a new snapshot.
 	DefaultMaxChangesBeforeSnapshot = 200
 	// DefaultMaxSnapshotInterval is the default max time between snapshots (5 minutes)
 	DefaultMaxSnapshotInterval = 300 // 5 minutes = 300 seconds
+	// OpLogSize is how many operations a session keeps in its op log.
+	OpLogSize = 100
 )
 
 // NewEditSession creates a new edit session with snapshot + changes structure.
 func NewEditSession(sessionID, filePath string, initialContent string) *EditSession {
 	now := time.Now().Unix()
 	return &EditSession{
-		SessionID:                 sessionID,
-		FilePath:                  filePath,
+		SessionID: sessionID,
+		FilePath:  filePath,
 		RefCount: &SessionRefCount{
 			SessionID:   sessionID,
 			FilePath:    filePath,
@@ -92,16 +169,21 @@ func NewEditSession(sessionID, filePath string, initialContent string) *EditSess
 			CreatedAt:   now,
 			UpdatedAt:   now,
 		},
-		CreatedAt:                 now,
-		UpdatedAt:                 now,
-		Clients:                   make(map[string]*SessionClient),
-		snapshotContent:           initialContent,
-		snapshotVersion:           0,
-		recentChanges:             make([]interface{}, 0),
-		currentVersion:            0,
-		maxChangesBeforeSnapshot:  DefaultMaxChangesBeforeSnapshot,
-		lastSnapshotTime:          now,
-		maxSnapshotInterval:       DefaultMaxSnapshotInterval,
+		CreatedAt:                now,
+		UpdatedAt:                now,
+		Clients:                  make(map[string]*SessionClient),
+		snapshotContent:          initialContent,
+		snapshotVersion:          0,
+		recentChanges:            make([]interface{}, 0),
+		currentVersion:           0,
+		maxChangesBeforeSnapshot: DefaultMaxChangesBeforeSnapshot,
+		lastSnapshotTime:         now,
+		maxSnapshotInterval:      DefaultMaxSnapshotInterval,
+		comments:                 NewCommentStore(sessionID),
+		clock:                    concordia.NewHybridClock(nil),
+		version:                  make(concordia.VersionVector),
+		contentType:              ContentTypeText,
+		logger:                   componentLogger(nil, "session").With(LogKeySession, sessionID, LogKeyFile, filePath),
 	}
 }
 
@@ -120,6 +202,18 @@ func (es *EditSession) SetContent(content string) {
 	es.UpdatedAt = time.Now().Unix()
 }
 
+// CommitContent sets the content an operation produced and moves the
+// comment anchors through the operation under the same lock, so comments
+// are always anchored in the content they were created on. Returns the
+// threads whose text the operation deleted.
+func (es *EditSession) CommitContent(content string, op *ot.Operation) []*CommentThread {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.snapshotContent = content
+	es.UpdatedAt = time.Now().Unix()
+	return es.comments.ApplyOperation(op)
+}
+
 // SetHistoryListener sets the history listener for forwarding to Redis.
 func (es *EditSession) SetHistoryListener(listener HistoryListener) {
 	es.mu.Lock()
@@ -127,16 +221,39 @@ func (es *EditSession) SetHistoryListener(listener HistoryListener) {
 	es.historyListener = listener
 }
 
+// SetLogger sets the logger of the session. It defaults to slog.Default().
+func (es *EditSession) SetLogger(logger *slog.Logger) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.logger = componentLogger(logger, "session").With(LogKeySession, es.SessionID, LogKeyFile, es.FilePath)
+}
+
+// log returns the logger of the session.
+func (es *EditSession) log() *slog.Logger {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	return es.logger
+}
+
 // AddOperation adds an operation to recent changes and forwards to history listener.
 func (es *EditSession) AddOperation(operation interface{}, clientID string) error {
+	return es.AddTracedOperation(operation, clientID, "")
+}
+
+// AddTracedOperation adds an operation like AddOperation, tagging its log
+// records and history event with the trace ID of the message it came from.
+func (es *EditSession) AddTracedOperation(operation interface{}, clientID, traceID string) error {
 	es.mu.Lock()
 	defer es.mu.Unlock()
 
 	es.currentVersion++
 	es.UpdatedAt = time.Now().Unix()
+	es.version.Increment(clientID)
+	hlc := es.clock.Now()
 
 	// Add to recent changes
 	es.recentChanges = append(es.recentChanges, operation)
+	es.logOperation(operation, clientID)
 
 	// Forward to history listener (Redis/History service)
 	if es.historyListener != nil {
@@ -148,22 +265,420 @@ func (es *EditSession) AddOperation(operation interface{}, clientID string) erro
 			Operations: []interface{}{operation},
 			CreatedAt:  es.UpdatedAt,
 			CreatedBy:  clientID,
+			HLC:        &hlc,
+			Version:    es.version.Clone(),
+			TraceID:    traceID,
 		}
 		// Non-blocking send to avoid blocking the editing operation
-		go es.historyListener.OnOperation(event)
+		es.enqueueHistory(event, es.historyListener.OnOperation)
 	}
+	es.logger.Debug("operation applied", LogKeyClient, clientID, LogKeyRevision, es.currentVersion, LogKeyTrace, traceID)
 
 	// Check if we need to create a new snapshot
 	// Condition 1: Operation count threshold
 	// Condition 2: Time threshold (timeout snapshot)
 	if len(es.recentChanges) >= es.maxChangesBeforeSnapshot ||
 		es.shouldCreateTimeoutSnapshot() {
-		es.createSnapshot(clientID)
+		es.createSnapshot(clientID, traceID)
+	}
+
+	return nil
+}
+
+// Version returns the version vector of the session: the number of
+// operations applied from each client.
+func (es *EditSession) Version() concordia.VersionVector {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	return es.version.Clone()
+}
+
+// Comments returns the comment threads of this session.
+func (es *EditSession) Comments() *CommentStore {
+	return es.comments
+}
+
+// CreateComment starts a comment thread on [start, end) of the current
+// content. The range is checked and the thread anchored without an
+// operation being applied in between.
+func (es *EditSession) CreateComment(start, end int, owner, author, body string) (*CommentThread, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	content := []rune(es.snapshotContent)
+	if start < 0 || end < start || end > len(content) {
+		return nil, &TransportError{
+			Code:    "invalid_comment_data",
+			Message: fmt.Sprintf("range [%d, %d) out of bounds for length %d", start, end, len(content)),
+		}
+	}
+	return es.comments.Create(start, end, string(content[start:end]), owner, author, body), nil
+}
+
+// ContentType returns the document model hosted by this session.
+func (es *EditSession) ContentType() string {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	return es.contentType
+}
+
+// IsJSON returns true if this session hosts a JSON document.
+func (es *EditSession) IsJSON() bool {
+	return es.ContentType() == ContentTypeJSON
+}
+
+// NormalizeContentType maps a StartEditingData.ContentType to the
+// document model hosting it: "json" and "notebook" have their own models,
+// everything else is edited as text.
+func NormalizeContentType(contentType string) string {
+	switch contentType {
+	case ContentTypeJSON, ContentTypeNotebook:
+		return contentType
+	default:
+		return ContentTypeText
+	}
+}
+
+// SetContentType selects the document model of a new session.
+// For JSON the current content is parsed; empty content starts as {}.
+// For notebooks the content is parsed as .ipynb; empty content starts
+// as an empty notebook.
+// The content type cannot change once operations have been applied.
+func (es *EditSession) SetContentType(contentType string) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.setContentType(contentType)
+}
+
+// ClaimContentType selects the document model for a client starting to
+// edit. The first editor of a session without operations sets it, even if
+// subscribers opened the session as text; later editors must ask for the
+// model the session hosts. Returns true if the content type changed.
+func (es *EditSession) ClaimContentType(contentType string) (bool, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	contentType = NormalizeContentType(contentType)
+	if contentType == es.contentType {
+		return false, nil
+	}
+	editing := false
+	for _, client := range es.Clients {
+		editing = editing || client.IsEditing
+	}
+	if editing || es.currentVersion > 0 {
+		return false, &TransportError{
+			Code:    "content_type_mismatch",
+			Message: fmt.Sprintf("session hosts a %s document", es.contentType),
+		}
+	}
+	if err := es.setContentType(contentType); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// setContentType is SetContentType. Caller must hold es.mu.
+func (es *EditSession) setContentType(contentType string) error {
+	contentType = NormalizeContentType(contentType)
+	if contentType == es.contentType {
+		return nil
+	}
+	if es.currentVersion > 0 {
+		return fmt.Errorf("cannot change content type from %s to %s after editing started", es.contentType, contentType)
+	}
+
+	es.jsonDoc = nil
+	es.notebook = nil
+
+	switch contentType {
+	case ContentTypeJSON:
+		if es.snapshotContent == "" {
+			es.snapshotContent = "{}"
+		}
+		var doc interface{}
+		if err := json.Unmarshal([]byte(es.snapshotContent), &doc); err != nil {
+			return fmt.Errorf("content is not valid JSON: %w", err)
+		}
+		es.jsonDoc = doc
+
+	case ContentTypeNotebook:
+		var nb *concordia.Notebook
+		if es.snapshotContent == "" {
+			nb = concordia.NewNotebook()
+			content, err := nb.Marshal()
+			if err != nil {
+				return err
+			}
+			es.snapshotContent = string(content)
+		} else {
+			var err error
+			if nb, err = concordia.ParseNotebook([]byte(es.snapshotContent)); err != nil {
+				return err
+			}
+		}
+		es.notebook = nb
+	}
+
+	es.contentType = contentType
+	return nil
+}
+
+// ApplyJSONOperation applies a json0 operation to a JSON session and
+// updates the content snapshot with the re-encoded document.
+func (es *EditSession) ApplyJSONOperation(op *json0.Operation) error {
+	return es.applyJSONOperation(op, nil)
+}
+
+// applyJSONOperation is ApplyJSONOperation with a check of the re-encoded
+// document; the session is left unchanged if check returns an error.
+func (es *EditSession) applyJSONOperation(op *json0.Operation, check func(content string) error) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.contentType != ContentTypeJSON {
+		return fmt.Errorf("session does not host a JSON document")
+	}
+
+	doc, err := op.Apply(es.jsonDoc)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if check != nil {
+		if err := check(string(content)); err != nil {
+			return err
+		}
+	}
+
+	es.jsonDoc = doc
+	es.snapshotContent = string(content)
+	es.UpdatedAt = time.Now().Unix()
+	return nil
+}
+
+// GetJSONDocument returns the parsed document of a JSON session.
+// The returned value must not be modified.
+func (es *EditSession) GetJSONDocument() interface{} {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	return es.jsonDoc
+}
+
+// IsNotebook returns true if this session hosts a Jupyter notebook.
+func (es *EditSession) IsNotebook() bool {
+	return es.ContentType() == ContentTypeNotebook
+}
+
+// ApplyNotebookChange runs change against a copy of the notebook of a
+// notebook session, then replaces the notebook with the copy and updates
+// the content snapshot with the serialized notebook. If change returns an
+// error, neither the notebook nor the snapshot is changed.
+func (es *EditSession) ApplyNotebookChange(change func(nb *concordia.Notebook) error) error {
+	return es.applyNotebookChange(change, nil)
+}
+
+// applyNotebookChange is ApplyNotebookChange with a check of the
+// serialized notebook; the session is left unchanged if check returns an
+// error.
+func (es *EditSession) applyNotebookChange(change func(nb *concordia.Notebook) error, check func(content string) error) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.notebook == nil {
+		return fmt.Errorf("session does not host a notebook")
+	}
+	notebook := es.notebook.Clone()
+	if err := change(notebook); err != nil {
+		return err
 	}
 
+	content, err := notebook.Marshal()
+	if err != nil {
+		return err
+	}
+	if check != nil {
+		if err := check(string(content)); err != nil {
+			return err
+		}
+	}
+	es.notebook = notebook
+	es.snapshotContent = string(content)
+	es.UpdatedAt = time.Now().Unix()
 	return nil
 }
 
+// GetNotebook returns the notebook of a notebook session, or nil.
+// Changes must go through ApplyNotebookChange.
+func (es *EditSession) GetNotebook() *concordia.Notebook {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	return es.notebook
+}
+
+// ApplyFormatting updates the formatting runs for an operation about to be
+// applied to the content. delta is the rich-text form of op, or nil for
+// plain-text operations. Must be called before SetContent.
+func (es *EditSession) ApplyFormatting(op *ot.Operation, delta *ot.Delta) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if delta == nil {
+		if es.rich == nil {
+			// Plain text session, nothing to track
+			return nil
+		}
+		return es.rich.ApplyOperation(op)
+	}
+
+	if es.rich == nil {
+		es.rich = concordia.NewRichDocument(rope.New(es.snapshotContent))
+	}
+	return es.rich.ApplyDelta(delta)
+}
+
+// CRDTBridge returns the CRDT replica of the content, creating it on
+// first use. Only text sessions can have CRDT peers.
+func (es *EditSession) CRDTBridge() *crdt.Bridge {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.crdt == nil {
+		es.crdt = crdt.NewBridge(es.snapshotContent)
+	}
+	return es.crdt
+}
+
+// ApplyCRDTOperation updates the CRDT replica for an operation about to be
+// applied to the content, and returns the update for the CRDT peers.
+// Returns nil if no CRDT peer has synced yet. Must be called before SetContent.
+func (es *EditSession) ApplyCRDTOperation(op *ot.Operation) ([]byte, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.crdt == nil {
+		return nil, nil
+	}
+	return es.crdt.ApplyOperation(op)
+}
+
+// MarkCRDTPeer records that a client edits with CRDT updates. Returns
+// false if the client is not in the session.
+func (es *EditSession) MarkCRDTPeer(clientID string) bool {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	client := es.Clients[clientID]
+	if client == nil {
+		return false
+	}
+	client.CRDT = true
+	return true
+}
+
+// CompactCRDT merges the tombstones of the CRDT replica, if there is one.
+// Returns the number of items removed.
+func (es *EditSession) CompactCRDT() int {
+	es.mu.RLock()
+	bridge := es.crdt
+	es.mu.RUnlock()
+
+	if bridge == nil {
+		return 0
+	}
+	return bridge.Doc().GC()
+}
+
+// GetFormattedContent returns the content with formatting as a document Delta.
+// Returns nil if no text in the session is formatted.
+func (es *EditSession) GetFormattedContent() *ot.Delta {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if es.rich == nil || !es.rich.IsFormatted() {
+		return nil
+	}
+	return es.rich.ToDelta()
+}
+
+// RecordCommentEvent forwards a comment thread change to the history listener,
+// if it stores comments.
+func (es *EditSession) RecordCommentEvent(action string, thread *CommentThread, clientID string) {
+	es.mu.RLock()
+	listener, ok := es.historyListener.(CommentListener)
+	version := es.currentVersion
+	es.mu.RUnlock()
+
+	if !ok || thread == nil {
+		return
+	}
+
+	event := &HistoryEvent{
+		SessionID: es.SessionID,
+		FilePath:  es.FilePath,
+		EventType: "comment",
+		VersionID: version,
+		CreatedAt: time.Now().Unix(),
+		CreatedBy: clientID,
+		Metadata: map[string]interface{}{
+			"action": action,
+			"thread": thread,
+		},
+	}
+	// Non-blocking send, same as operations
+	es.enqueueHistory(event, listener.OnComment)
+}
+
+// historyWrite is an event queued for the history listener.
+type historyWrite struct {
+	event *HistoryEvent
+	write func(*HistoryEvent) error
+}
+
+// enqueueHistory queues an event for the history listener without
+// waiting for it. Events are written one at a time in the order they were
+// queued, so a thread's changes are stored in the order they were made.
+func (es *EditSession) enqueueHistory(event *HistoryEvent, write func(*HistoryEvent) error) {
+	es.historyMu.Lock()
+	es.historyQueue = append(es.historyQueue, historyWrite{event: event, write: write})
+	start := !es.forwarding
+	es.forwarding = true
+	es.historyMu.Unlock()
+
+	if start {
+		go es.drainHistory()
+	}
+}
+
+// drainHistory writes queued events until the queue is empty.
+func (es *EditSession) drainHistory() {
+	for {
+		es.historyMu.Lock()
+		if len(es.historyQueue) == 0 {
+			es.forwarding = false
+			es.historyMu.Unlock()
+			return
+		}
+		next := es.historyQueue[0]
+		es.historyQueue[0] = historyWrite{}
+		es.historyQueue = es.historyQueue[1:]
+		es.historyMu.Unlock()
+
+		es.forward(next.event, next.write)
+	}
+}
+
+// forward writes an event to the history listener, logging failures.
+func (es *EditSession) forward(event *HistoryEvent, write func(*HistoryEvent) error) {
+	if err := write(event); err != nil {
+		es.log().Error("history write failed", "event", event.EventType, LogKeyRevision, event.VersionID,
+			LogKeyTrace, event.TraceID, LogKeyError, err)
+	}
+}
+
 // shouldCreateTimeoutSnapshot checks if enough time has passed to create a timeout snapshot.
 func (es *EditSession) shouldCreateTimeoutSnapshot() bool {
 	if es.lastSnapshotTime == 0 {
@@ -174,8 +689,9 @@ func (es *EditSession) shouldCreateTimeoutSnapshot() bool {
 	return elapsed >= es.maxSnapshotInterval
 }
 
-// createSnapshot creates a new snapshot from the current content and clears recent changes.
-func (es *EditSession) createSnapshot(clientID string) {
+// createSnapshot creates a new snapshot from the current content and clears
+// recent changes. traceID is the trace of the operation that caused it, if any.
+func (es *EditSession) createSnapshot(clientID, traceID string) {
 	// Current snapshot content becomes the new snapshot
 	es.snapshotVersion = es.currentVersion
 	es.lastSnapshotTime = time.Now().Unix()
@@ -187,6 +703,7 @@ func (es *EditSession) createSnapshot(clientID string) {
 
 	// Forward snapshot event to history listener with FULL TEXT CONTENT
 	if es.historyListener != nil {
+		hlc := es.clock.Now()
 		event := &HistoryEvent{
 			SessionID:  es.SessionID,
 			FilePath:   es.FilePath,
@@ -196,9 +713,14 @@ func (es *EditSession) createSnapshot(clientID string) {
 			Operations: operationsSinceSnapshot,
 			CreatedAt:  es.lastSnapshotTime,
 			CreatedBy:  clientID,
+			HLC:        &hlc,
+			Version:    es.version.Clone(),
+			TraceID:    traceID,
 		}
-		go es.historyListener.OnSnapshot(event)
+		es.enqueueHistory(event, es.historyListener.OnSnapshot)
 	}
+	es.logger.Info("snapshot created", LogKeyRevision, es.snapshotVersion, "operations", len(operationsSinceSnapshot),
+		"bytes", len(snapshotContent), LogKeyTrace, traceID)
 
 	// Clear recent changes after snapshot
 	es.recentChanges = make([]interface{}, 0)
@@ -214,6 +736,22 @@ func (es *EditSession) GetRecentOperations() []interface{} {
 	return ops
 }
 
+// OperationsSince returns the operations applied after revision, oldest
+// first, and the current version. ok is false if some of them are no
+// longer kept, because a snapshot was taken since.
+func (es *EditSession) OperationsSince(revision int64) (ops []interface{}, current int64, ok bool) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if revision < es.snapshotVersion || revision > es.currentVersion {
+		return nil, es.currentVersion, false
+	}
+	// recentChanges[i] is the operation that made version snapshotVersion+i+1
+	ops = make([]interface{}, es.currentVersion-revision)
+	copy(ops, es.recentChanges[revision-es.snapshotVersion:])
+	return ops, es.currentVersion, true
+}
+
 // GetSnapshotVersion returns the current snapshot version ID.
 func (es *EditSession) GetSnapshotVersion() int64 {
 	es.mu.RLock()
@@ -266,12 +804,12 @@ func (es *EditSession) GetSnapshotInfo() *SnapshotInfo {
 	}
 
 	return &SnapshotInfo{
-		SnapshotVersion:        es.snapshotVersion,
-		LastSnapshotTime:      es.lastSnapshotTime,
-		RecentChangeCount:      len(es.recentChanges),
+		SnapshotVersion:          es.snapshotVersion,
+		LastSnapshotTime:         es.lastSnapshotTime,
+		RecentChangeCount:        len(es.recentChanges),
 		MaxChangesBeforeSnapshot: es.maxChangesBeforeSnapshot,
-		MaxSnapshotInterval:    es.maxSnapshotInterval,
-		TimeUntilSnapshot:      timeUntilSnapshot,
+		MaxSnapshotInterval:      es.maxSnapshotInterval,
+		TimeUntilSnapshot:        timeUntilSnapshot,
 	}
 }
 
@@ -316,6 +854,9 @@ func (es *EditSession) AddClient(clientID string, client *SessionClient) {
 	defer es.mu.Unlock()
 	es.Clients[clientID] = client
 	es.UpdatedAt = time.Now().Unix()
+	if client.LastSeen == 0 {
+		client.LastSeen = es.UpdatedAt
+	}
 }
 
 // RemoveClient removes a client from the session.
@@ -338,6 +879,19 @@ func (es *EditSession) GetClient(clientID string) *SessionClient {
 	return es.Clients[clientID]
 }
 
+// ClientIDs returns the IDs of the clients in the session, so callers
+// can send to them while clients join, leave or are evicted.
+func (es *EditSession) ClientIDs() []string {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	ids := make([]string, 0, len(es.Clients))
+	for id := range es.Clients {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
 // GetClientInfos returns information about all connected clients.
 func (es *EditSession) GetClientInfos() []ClientInfo {
 	es.mu.RLock()
@@ -347,6 +901,7 @@ func (es *EditSession) GetClientInfos() []ClientInfo {
 	for _, client := range es.Clients {
 		infos = append(infos, ClientInfo{
 			ClientID:  client.ClientID,
+			Name:      client.Name,
 			IsEditing: client.IsEditing,
 			UpdatedAt: client.LastSeen,
 		})
@@ -367,6 +922,16 @@ type SessionManager struct {
 
 	// Global history listener for all sessions
 	historyListener HistoryListener
+
+	// Generates the ID of a new session; nil means a random UUID
+	sessionIDFunc func(filePath string) string
+
+	// Eviction timeouts and limits, see lifecycle.go
+	lifecycle LifecycleConfig
+	janitor   *janitor
+
+	// Logger of the manager and its sessions; nil means slog.Default()
+	logger *slog.Logger
 }
 
 // NewSessionManager creates a new session manager.
@@ -388,20 +953,21 @@ func (sm *SessionManager) SetContentStorage(storage ContentStorage) {
 // This is the preferred way to create a session manager with history support.
 //
 // Example:
-//   // Using Redis history service with patch mode
-//   historySvc := NewRedisHistoryServiceWithOpts(redisClient, true)
-//   sm := NewSessionManagerWithHistory(historySvc)
 //
-//   // Using in-memory history service
-//   historySvc := NewMemoryHistoryService(false)
-//   sm := NewSessionManagerWithHistory(historySvc)
+//	// Using Redis history service with patch mode
+//	historySvc := NewRedisHistoryServiceWithOpts(redisClient, true)
+//	sm := NewSessionManagerWithHistory(historySvc)
+//
+//	// Using in-memory history service
+//	historySvc := NewMemoryHistoryService(false)
+//	sm := NewSessionManagerWithHistory(historySvc)
 //
-//   // Using history service factory
-//   historySvc := NewHistoryService(&HistoryOptions{
-//       StorageBackend: "redis",
-//       UsePatchMode: true,
-//   })
-//   sm := NewSessionManagerWithHistory(historySvc)
+//	// Using history service factory
+//	historySvc := NewHistoryService(&HistoryOptions{
+//	    StorageBackend: "redis",
+//	    UsePatchMode: true,
+//	})
+//	sm := NewSessionManagerWithHistory(historySvc)
 func NewSessionManagerWithHistory(history HistoryListener) *SessionManager {
 	return &SessionManager{
 		sessions:        make(map[string]*EditSession),
@@ -422,20 +988,52 @@ func (sm *SessionManager) SetHistoryListener(listener HistoryListener) {
 	}
 }
 
+// SetLogger sets the logger of the manager and its sessions. It defaults
+// to slog.Default().
+func (sm *SessionManager) SetLogger(logger *slog.Logger) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.logger = logger
+	for _, session := range sm.sessions {
+		session.SetLogger(logger)
+	}
+}
+
+// SetSessionIDFunc sets how session IDs are derived from file paths.
+// In cluster mode every node must derive the same ID, see ClusterSessionID.
+func (sm *SessionManager) SetSessionIDFunc(fn func(filePath string) string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.sessionIDFunc = fn
+}
+
 // GetOrCreateSession gets an existing session or creates a new one.
 func (sm *SessionManager) GetOrCreateSession(filePath string) (*EditSession, bool) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	// Check if session exists for this file
+	if session := sm.sessionByPath(filePath); session != nil {
+		return session, false
+	}
+	return sm.createSession(filePath), true
+}
+
+// sessionByPath returns the session for a file, or nil.
+// Caller must hold the write lock.
+func (sm *SessionManager) sessionByPath(filePath string) *EditSession {
 	if sessionID, ok := sm.byPath[filePath]; ok {
 		if session, ok := sm.sessions[sessionID]; ok {
-			return session, false
+			return session
 		}
 		// Cleanup orphaned byPath entry
 		delete(sm.byPath, filePath)
 	}
+	return nil
+}
 
+// createSession creates the session for a file, loading its content.
+// Caller must hold the write lock.
+func (sm *SessionManager) createSession(filePath string) *EditSession {
 	// Load content from storage if available
 	content := ""
 	if sm.contentStorage != nil {
@@ -449,17 +1047,32 @@ func (sm *SessionManager) GetOrCreateSession(filePath string) (*EditSession, boo
 
 	// Create new session with UUID
 	sessionID := uuid.New().String()
+	if sm.sessionIDFunc != nil {
+		sessionID = sm.sessionIDFunc(filePath)
+	}
 	session := NewEditSession(sessionID, filePath, content)
+	session.SetLogger(sm.logger)
+	session.log().Info("session created", "bytes", len(content))
 
 	// Set history listener if available
 	if sm.historyListener != nil {
 		session.SetHistoryListener(sm.historyListener)
 	}
 
+	// Restore the comment threads stored for the file
+	if loader, ok := sm.historyListener.(CommentLoader); ok {
+		threads, err := loader.GetComments(context.Background(), sessionID)
+		if err != nil {
+			session.log().Error("loading comments failed", LogKeyError, err)
+		} else if len(threads) > 0 {
+			session.Comments().Restore(threads, utf8.RuneCountInString(content))
+		}
+	}
+
 	sm.sessions[sessionID] = session
 	sm.byPath[filePath] = sessionID
 
-	return session, true
+	return session
 }
 
 // GetSession retrieves a session by ID.
@@ -495,6 +1108,7 @@ func (sm *SessionManager) DestroySession(sessionID string) {
 
 	// Remove from sessions
 	delete(sm.sessions, sessionID)
+	session.log().Info("session destroyed", LogKeyRevision, session.GetCurrentVersion())
 }
 
 // ListSessions returns all active sessions.
@@ -509,17 +1123,47 @@ func (sm *SessionManager) ListSessions() []*EditSession {
 	return sessions
 }
 
+// HoldsClient reports whether any session still has the client, which
+// keeps its client ID bound to its user while it is disconnected.
+func (sm *SessionManager) HoldsClient(clientID string) bool {
+	for _, session := range sm.ListSessions() {
+		if session.GetClient(clientID) != nil {
+			return true
+		}
+	}
+	return false
+}
+
 // ========== Session Client ==========
 
 // SessionClient represents a client in an edit session.
 type SessionClient struct {
-	ClientID  string       // Client ID
-	FilePath  string       // File path
-	ReadOnly  bool         // Whether client is read-only
-	IsEditing bool         // Whether client is actively editing
-	Connected bool         // Whether client is connected
+	ClientID  string      // Client ID
+	FilePath  string      // File path
+	ReadOnly  bool        // Whether client is read-only
+	CRDT      bool        // Whether client edits with CRDT updates
+	IsEditing bool        // Whether client is actively editing
+	Connected bool        // Whether client is connected
 	Selection *CursorData // Current cursor/selection
-	LastSeen  int64        // Last activity timestamp
+	LastSeen  int64       // Last activity timestamp
+	UserID    string      // Authenticated user, if any
+	Name      string      // Display name of the user
+}
+
+// SetUser records the authenticated user of the client. A nil user is
+// ignored.
+func (sc *SessionClient) SetUser(user *session.UserInfo) {
+	if user == nil {
+		return
+	}
+	sc.UserID = user.UserID
+	sc.Name = user.Name
+	if sc.Name == "" {
+		sc.Name = user.Username
+	}
+	if sc.Name == "" {
+		sc.Name = user.UserID
+	}
 }
 
 // GetClientID returns the client ID.
@@ -4,7 +4,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/coreseekdev/texere/pkg/concordia"
+	"github.com/coreseekdev/texere/pkg/crdt"
 	"github.com/coreseekdev/texere/pkg/ot"
+	"github.com/coreseekdev/texere/pkg/ot/json0"
 )
 
 // TestEditSession_BasicOperations tests basic edit session operations.
@@ -401,3 +404,230 @@ func TestOTIntegration(t *testing.T) {
 		t.Errorf("Expected version 1, got %d", es.GetCurrentVersion())
 	}
 }
+
+// TestEditSession_ApplyFormatting tests that formatting follows rich and plain operations.
+func TestEditSession_ApplyFormatting(t *testing.T) {
+	es := NewEditSession("test-session", "/test.md", "Hello World")
+
+	// Plain-text sessions do not track formatting
+	plain := ot.NewBuilder().Retain(11).Insert("!").Build()
+	if err := es.ApplyFormatting(plain, nil); err != nil {
+		t.Fatalf("Failed to apply plain operation: %v", err)
+	}
+	if es.GetFormattedContent() != nil {
+		t.Error("Expected no formatted content for plain session")
+	}
+
+	// Bold "World"
+	delta := ot.NewDelta().Retain(6, nil).Retain(5, ot.AttributeMap{"bold": true})
+	op, err := delta.ToOperation(11)
+	if err != nil {
+		t.Fatalf("Failed to convert delta: %v", err)
+	}
+	if err := es.ApplyFormatting(op, delta); err != nil {
+		t.Fatalf("Failed to apply delta: %v", err)
+	}
+
+	// Plain insert after the first rich operation keeps formatting in sync
+	if err := es.ApplyFormatting(plain, nil); err != nil {
+		t.Fatalf("Failed to apply plain operation: %v", err)
+	}
+
+	expected := ot.NewDelta().Insert("Hello ", nil).Insert("World", ot.AttributeMap{"bold": true}).Insert("!", nil)
+	if got := es.GetFormattedContent(); got == nil || !got.Equals(expected) {
+		t.Errorf("Expected formatted content %s, got %v", expected, got)
+	}
+}
+
+// TestEditSession_JSONDocument tests json0 operations on a JSON session.
+func TestEditSession_JSONDocument(t *testing.T) {
+	es := NewEditSession("test-session", "/test.json", `{"tags":["a"]}`)
+	if es.IsJSON() {
+		t.Fatal("Expected new session to host text")
+	}
+
+	if err := es.SetContentType(ContentTypeJSON); err != nil {
+		t.Fatalf("Failed to set content type: %v", err)
+	}
+
+	op := json0.NewOperation(
+		json0.ListInsert(json0.Path{"tags", 1}, "b"),
+		json0.ObjectInsert(json0.Path{"count"}, 1.0),
+	)
+	if err := es.ApplyJSONOperation(op); err != nil {
+		t.Fatalf("Failed to apply operation: %v", err)
+	}
+	if err := es.AddOperation(op, "client-1"); err != nil {
+		t.Fatalf("Failed to add operation: %v", err)
+	}
+
+	if got := es.GetContent(); got != `{"count":1,"tags":["a","b"]}` {
+		t.Errorf("Unexpected content %s", got)
+	}
+
+	// Invalid paths leave the document untouched
+	bad := json0.NewOperation(json0.ListDelete(json0.Path{"missing", 0}, "x"))
+	if err := es.ApplyJSONOperation(bad); err == nil {
+		t.Error("Expected error for invalid path")
+	}
+	if got := es.GetContent(); got != `{"count":1,"tags":["a","b"]}` {
+		t.Errorf("Document changed after failed operation: %s", got)
+	}
+
+	// Content type is fixed once editing has started
+	if err := es.SetContentType(ContentTypeText); err == nil {
+		t.Error("Expected error changing content type after editing")
+	}
+
+	text := NewEditSession("text-session", "/test.txt", "not json")
+	if err := text.SetContentType(ContentTypeJSON); err == nil {
+		t.Error("Expected error for invalid JSON content")
+	}
+}
+
+// TestEditSession_Notebook tests cell edits on a notebook session.
+func TestEditSession_Notebook(t *testing.T) {
+	es := NewEditSession("test-session", "/test.ipynb", "")
+	if err := es.SetContentType(ContentTypeNotebook); err != nil {
+		t.Fatalf("Failed to set content type: %v", err)
+	}
+
+	var cellID string
+	err := es.ApplyNotebookChange(func(nb *concordia.Notebook) error {
+		var err error
+		cellID, err = nb.InsertCell(0, concordia.NotebookCell{CellType: concordia.CellTypeCode, Source: "x = 1"})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to insert cell: %v", err)
+	}
+
+	op := ot.NewBuilder().Retain(5).Insert("\nprint(x)").Build()
+	err = es.ApplyNotebookChange(func(nb *concordia.Notebook) error {
+		return nb.ApplyCellOperation(cellID, op)
+	})
+	if err != nil {
+		t.Fatalf("Failed to edit cell: %v", err)
+	}
+
+	// Content is the serialized notebook
+	nb, err := concordia.ParseNotebook([]byte(es.GetContent()))
+	if err != nil {
+		t.Fatalf("Content is not a notebook: %v", err)
+	}
+	cell, ok := nb.Cell(cellID)
+	if !ok || cell.Source != "x = 1\nprint(x)" {
+		t.Errorf("Unexpected cell %+v", cell)
+	}
+
+	// Failed changes leave the content untouched
+	content := es.GetContent()
+	err = es.ApplyNotebookChange(func(nb *concordia.Notebook) error {
+		return nb.DeleteCell("missing")
+	})
+	if err == nil {
+		t.Error("Expected error for missing cell")
+	}
+	if es.GetContent() != content {
+		t.Error("Content changed after failed change")
+	}
+
+	// So do changes that fail after changing the notebook
+	err = es.ApplyNotebookChange(func(nb *concordia.Notebook) error {
+		if err := nb.DeleteCell(cellID); err != nil {
+			return err
+		}
+		return nb.DeleteCell("missing")
+	})
+	if err == nil {
+		t.Error("Expected error for missing cell")
+	}
+	if _, ok := es.GetNotebook().Cell(cellID); !ok {
+		t.Error("Notebook changed after failed change")
+	}
+
+	text := NewEditSession("text-session", "/test.ipynb", "not a notebook")
+	if err := text.SetContentType(ContentTypeNotebook); err == nil {
+		t.Error("Expected error for invalid notebook content")
+	}
+}
+
+// TestEditSession_CRDTBridge tests keeping CRDT peers in sync with OT edits.
+func TestEditSession_CRDTBridge(t *testing.T) {
+	es := NewEditSession("test-session", "/test.txt", "Hello")
+	op := ot.NewBuilder().Retain(5).Insert(" World").Build()
+
+	// No CRDT peer yet: nothing to send
+	if update, err := es.ApplyCRDTOperation(op); err != nil || update != nil {
+		t.Fatalf("Expected no update without CRDT peers, got %v, %v", update, err)
+	}
+
+	peer := crdt.NewDoc(1)
+	if _, err := peer.ApplyUpdate(es.CRDTBridge().Doc().EncodeStateAsUpdate(nil)); err != nil {
+		t.Fatalf("Failed to sync peer: %v", err)
+	}
+	if peer.String() != "Hello" {
+		t.Fatalf("Expected peer content 'Hello', got '%s'", peer.String())
+	}
+
+	update, err := es.ApplyCRDTOperation(op)
+	if err != nil {
+		t.Fatalf("Failed to apply operation: %v", err)
+	}
+	if _, err := peer.ApplyUpdate(update); err != nil {
+		t.Fatalf("Failed to apply update: %v", err)
+	}
+	if peer.String() != "Hello World" {
+		t.Errorf("Expected peer content 'Hello World', got '%s'", peer.String())
+	}
+}
+
+// eventRecorder is a HistoryListener that records events.
+type eventRecorder struct {
+	events chan *HistoryEvent
+}
+
+func (r *eventRecorder) OnSnapshot(event *HistoryEvent) error {
+	r.events <- event
+	return nil
+}
+
+func (r *eventRecorder) OnOperation(event *HistoryEvent) error {
+	r.events <- event
+	return nil
+}
+
+func (r *eventRecorder) Close() error {
+	return nil
+}
+
+// TestEditSession_HistoryEventStamps tests HLC times and version vectors on history events.
+func TestEditSession_HistoryEventStamps(t *testing.T) {
+	recorder := &eventRecorder{events: make(chan *HistoryEvent, 10)}
+	es := NewEditSession("test-session", "/test.txt", "Hello")
+	es.SetHistoryListener(recorder)
+
+	es.AddOperation([]interface{}{5, "!"}, "alice")
+	es.AddOperation([]interface{}{6, "?"}, "bob")
+
+	// Events are sent from goroutines: order them by HLC time
+	first, second := <-recorder.events, <-recorder.events
+	if first.HLC == nil || second.HLC == nil {
+		t.Fatal("Expected HLC times on operation events")
+	}
+	if second.HLC.Before(*first.HLC) {
+		first, second = second, first
+	}
+	if !first.HLC.Before(*second.HLC) {
+		t.Fatalf("Expected increasing HLC times, got %v and %v", first.HLC, second.HLC)
+	}
+	if first.CreatedBy != "alice" || first.Version.Get("alice") != 1 || first.Version.Get("bob") != 0 {
+		t.Errorf("Unexpected first event: %s %v", first.CreatedBy, first.Version)
+	}
+	if second.Version.Compare(first.Version) != concordia.CausalAfter {
+		t.Errorf("Expected second event after first, got %v and %v", first.Version, second.Version)
+	}
+	if got := es.Version(); got.Get("alice") != 1 || got.Get("bob") != 1 {
+		t.Errorf("Expected session version {alice:1 bob:1}, got %v", got)
+	}
+}
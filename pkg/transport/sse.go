@@ -235,9 +235,9 @@ func (s *SSEServer) handleEvents(w http.ResponseWriter, r *http.Request) {
 	closeCh := make(chan struct{})
 
 	client := &SSEClient{
-		id:       clientID,
-		msgChan:  msgChan,
-		closeCh:  closeCh,
+		id:      clientID,
+		msgChan: msgChan,
+		closeCh: closeCh,
 	}
 
 	s.mu.Lock()
@@ -31,6 +31,8 @@ type Message struct {
 	Version   int64  // Document version
 	SeqNum    int64  // Sequence number
 	Error     string
+	RequestID string // Correlates replies with the request
+	TraceID   string // Correlates the log records of the message
 	Metadata  map[string]interface{}
 }
 
@@ -3,20 +3,33 @@ package transport
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/coreseekdev/texere/pkg/session"
 	"github.com/gorilla/websocket"
 )
 
+// TokenSubprotocolPrefix marks a WebSocket subprotocol that carries an
+// auth token, for browsers that can't set headers on the upgrade request.
+// The server accepts that subprotocol:
+//
+//	new WebSocket(url, ["texere", "texere.token." + token])
+const TokenSubprotocolPrefix = "texere.token."
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Allow all origins for testing
 	},
+	EnableCompression: true, // permessage-deflate, if the client offers it
 }
 
 // WebSocketTransport implements Transport using WebSocket.
@@ -169,23 +182,237 @@ type WebSocketServer struct {
 	server     *http.Server
 	handler    func(*Message)
 	rawHandler func(clientID string, message []byte)
+	onClose    func(clientID string)
+	auth       session.Authenticator
+	owners     map[string]*clientOwner // Client ID -> user it is bound to
+	held       func(clientID string) bool
+	serverID   string
+	features   []string
+	adapters   map[int]VersionAdapter // Protocol version -> adapter
+
+	backpressure BackpressureConfig
+	snapshots    SnapshotFunc
+	retired      BackpressureStats // Totals of closed connections
+	disconnects  uint64            // Slow consumers disconnected; atomic
+	readLimit    int64             // Max bytes of a client message; 0 is unlimited
+
+	logger *slog.Logger
+}
+
+// clientOwner binds a client ID to the user that connected with it.
+type clientOwner struct {
+	userID     string
+	connecting int // Handshakes of the user that are still in progress
 }
 
 // WebSocketConn represents a WebSocket client connection.
 type WebSocketConn struct {
-	id   string
-	conn *websocket.Conn
-	send chan *Message
-	hub  *WebSocketServer
+	id    string
+	conn  *websocket.Conn
+	queue *sendQueue
+	hub   *WebSocketServer
+	user  *session.UserInfo // Authenticated user; nil without an authenticator
+
+	mu   sync.RWMutex
+	caps *Capabilities // Replaced when the client sends a hello
+
+	logger *slog.Logger // Tagged with the client ID
+}
+
+// newWebSocketConn creates a connection with a send queue configured by
+// the server.
+func newWebSocketConn(id string, conn *websocket.Conn, hub *WebSocketServer) *WebSocketConn {
+	hub.mu.RLock()
+	config, snapshots := hub.backpressure, hub.snapshots
+	features := append([]string(nil), hub.features...)
+	logger, readLimit := hub.logger, hub.readLimit
+	hub.mu.RUnlock()
+
+	if conn != nil && readLimit > 0 {
+		// Larger messages close the connection with CloseMessageTooBig
+		conn.SetReadLimit(readLimit)
+	}
+
+	var snapshot func() ([][]byte, error)
+	if snapshots != nil {
+		snapshot = func() ([][]byte, error) { return snapshots(id) }
+	}
+	return &WebSocketConn{
+		id:     id,
+		conn:   conn,
+		queue:  newSendQueue(config, snapshot),
+		hub:    hub,
+		caps:   &Capabilities{Version: ProtocolVersion1, Features: features},
+		logger: logger.With(LogKeyClient, id),
+	}
+}
+
+// ID returns the client ID of the connection.
+func (c *WebSocketConn) ID() string {
+	return c.id
+}
+
+// User returns the user authenticated during the upgrade, or nil.
+func (c *WebSocketConn) User() *session.UserInfo {
+	return c.user
+}
+
+// Version returns the protocol version negotiated with the client.
+func (c *WebSocketConn) Version() int {
+	return c.Capabilities().Version
+}
+
+// Capabilities returns what was negotiated with the client.
+func (c *WebSocketConn) Capabilities() *Capabilities {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.caps
 }
 
 // NewWebSocketServer creates a new WebSocket server.
 func NewWebSocketServer(addr string) *WebSocketServer {
+	serverID, _ := os.Hostname()
 	return &WebSocketServer{
-		addr:    addr,
-		clients: make(map[string]*WebSocketConn),
-		closeCh: make(chan struct{}),
+		addr:         addr,
+		serverID:     serverID,
+		features:     DefaultFeatures(),
+		adapters:     make(map[int]VersionAdapter),
+		clients:      make(map[string]*WebSocketConn),
+		owners:       make(map[string]*clientOwner),
+		closeCh:      make(chan struct{}),
+		backpressure: DefaultBackpressureConfig(),
+		logger:       componentLogger(nil, "websocket"),
+	}
+}
+
+// SetLogger sets the logger of the server and connections opened from
+// now on. It defaults to slog.Default().
+func (s *WebSocketServer) SetLogger(logger *slog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger = componentLogger(logger, "websocket")
+}
+
+// SetServerID sets the server ID sent in welcome messages. It defaults to
+// the hostname.
+func (s *WebSocketServer) SetServerID(serverID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serverID = serverID
+}
+
+// ServerID returns the server ID sent in welcome messages.
+func (s *WebSocketServer) ServerID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.serverID
+}
+
+// SetFeatures sets the features the server offers in the handshake. It
+// defaults to DefaultFeatures; applications that implement more, e.g.
+// undo with custom message handlers, add them here.
+func (s *WebSocketServer) SetFeatures(features ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.features = features
+}
+
+// Features returns the features the server offers.
+func (s *WebSocketServer) Features() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.features...)
+}
+
+// SetAdapter converts the messages of clients that negotiated version.
+func (s *WebSocketServer) SetAdapter(version int, adapter VersionAdapter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.adapters[version] = adapter
+}
+
+// adapter returns the adapter of a protocol version, or nil.
+func (s *WebSocketServer) adapter(version int) VersionAdapter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.adapters[version]
+}
+
+// Capabilities returns what was negotiated with a connected client, or
+// nil.
+func (s *WebSocketServer) Capabilities(clientID string) *Capabilities {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if client, ok := s.clients[clientID]; ok {
+		return client.Capabilities()
+	}
+	return nil
+}
+
+// Negotiate agrees on capabilities with a client that sent a hello.
+// Messages written to the client from now on use them, including those
+// already queued.
+func (s *WebSocketServer) Negotiate(clientID string, hello *HelloData) (*Capabilities, error) {
+	s.mu.RLock()
+	client, ok := s.clients[clientID]
+	features := s.features
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("client not found: %s", clientID)
+	}
+
+	caps, err := negotiate(hello, features)
+	if err != nil {
+		return nil, err
+	}
+	client.mu.Lock()
+	client.caps = caps
+	client.mu.Unlock()
+	return caps, nil
+}
+
+// SetBackpressureConfig sets the send queue limits and overflow policy
+// of connections accepted from now on.
+func (s *WebSocketServer) SetBackpressureConfig(config BackpressureConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backpressure = config
+}
+
+// SetReadLimit sets the max size of a client message on connections
+// accepted from now on. Zero is unlimited.
+func (s *WebSocketServer) SetReadLimit(bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readLimit = bytes
+}
+
+// SetSnapshotFunc sets how OverflowSnapshot brings a client up to date.
+func (s *WebSocketServer) SetSnapshotFunc(snapshots SnapshotFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots = snapshots
+}
+
+// BackpressureStats returns the send queue metrics of the connected
+// clients, and totals that include closed connections.
+func (s *WebSocketServer) BackpressureStats() *BackpressureStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := s.retired
+	stats.Clients = make([]QueueStats, 0, len(s.clients))
+	for id, client := range s.clients {
+		queue := client.queue.stats()
+		queue.ClientID = id
+		stats.Clients = append(stats.Clients, queue)
+		stats.addQueue(queue)
+		stats.Messages += queue.Messages
+		stats.Bytes += queue.Bytes
 	}
+	stats.Disconnects = atomic.LoadUint64(&s.disconnects)
+	sort.Slice(stats.Clients, func(i, j int) bool { return stats.Clients[i].ClientID < stats.Clients[j].ClientID })
+	return &stats
 }
 
 // SetMessageHandler sets the message handler for incoming messages.
@@ -198,6 +425,45 @@ func (s *WebSocketServer) SetRawMessageHandler(handler func(clientID string, mes
 	s.rawHandler = handler
 }
 
+// SetDisconnectHandler sets a function called after a client's connection
+// closes, unless the client has already reconnected.
+func (s *WebSocketServer) SetDisconnectHandler(handler func(clientID string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onClose = handler
+}
+
+// SetAuthenticator requires connections to authenticate during the
+// upgrade. The token is taken from an "Authorization: Bearer" header, a
+// TokenSubprotocolPrefix subprotocol, or the "token" or "access_token"
+// query parameter. Connections without a valid token are refused with
+// 401 Unauthorized.
+func (s *WebSocketServer) SetAuthenticator(auth session.Authenticator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auth = auth
+}
+
+// SetClientHeldFunc sets a function that reports whether a client is
+// still held by a session after its connection closed. With an
+// authenticator, a held client ID stays bound to its user, so other users
+// can't connect with it until it is released.
+func (s *WebSocketServer) SetClientHeldFunc(held func(clientID string) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.held = held
+}
+
+// User returns the authenticated user of a connected client, or nil.
+func (s *WebSocketServer) User(clientID string) *session.UserInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if client, ok := s.clients[clientID]; ok {
+		return client.user
+	}
+	return nil
+}
+
 // RegisterHandler registers the WebSocket handler with the given mux.
 func (s *WebSocketServer) RegisterHandler(mux *http.ServeMux) {
 	mux.HandleFunc("/ws", s.handleWebSocket)
@@ -222,57 +488,213 @@ func (s *WebSocketServer) Start(ctx context.Context) error {
 
 // handleWebSocket handles WebSocket connections.
 func (s *WebSocketServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[WebSocket] Incoming connection from %s", r.RemoteAddr)
-
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("[WebSocket] Upgrade failed: %v", err)
-		return
+	s.mu.RLock()
+	auth, serverID, logger := s.auth, s.serverID, s.logger
+	s.mu.RUnlock()
+	logger = logger.With("remote_addr", r.RemoteAddr)
+	logger.Debug("incoming connection")
+
+	var user *session.UserInfo
+	var responseHeader http.Header
+	if auth != nil {
+		token, subprotocol := requestToken(r)
+		if token == "" {
+			http.Error(w, "missing auth token", http.StatusUnauthorized)
+			return
+		}
+		var err error
+		user, err = auth.Authenticate(r.Context(), token)
+		if err != nil {
+			logger.Warn("authentication failed", LogKeyError, err)
+			http.Error(w, "invalid auth token", http.StatusUnauthorized)
+			return
+		}
+		if subprotocol != "" {
+			responseHeader = http.Header{"Sec-Websocket-Protocol": {subprotocol}}
+		}
 	}
 
-	log.Printf("[WebSocket] Connection established for %s", r.URL.String())
-
 	clientID := r.URL.Query().Get("client_id")
 	if clientID == "" {
 		clientID = fmt.Sprintf("client-%d", time.Now().UnixNano())
 	}
 
-	wsConn := &WebSocketConn{
-		id:   clientID,
-		conn: conn,
-		send: make(chan *Message, 256),
-		hub:  s,
+	// An authenticated user can only reconnect as its own client
+	if auth != nil && !s.bindClient(clientID, user.UserID) {
+		logger.Warn("client ID already used by another user", LogKeyClient, clientID)
+		http.Error(w, "client_id is in use", http.StatusConflict)
+		return
 	}
 
-	s.mu.Lock()
-	s.clients[clientID] = wsConn
-	s.mu.Unlock()
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		logger.Warn("upgrade failed", LogKeyClient, clientID, LogKeyError, err)
+		s.finishBind(clientID, auth != nil, nil)
+		s.ReleaseClient(clientID)
+		return
+	}
+
+	wsConn := newWebSocketConn(clientID, conn, s)
+	wsConn.user = user
+	wsConn.caps.Version = negotiateVersion(r.URL.Query().Get("protocol"))
+	userID := ""
+	if user != nil {
+		userID = user.UserID
+	}
+	wsConn.logger.Info("connection established", "remote_addr", r.RemoteAddr, "user_id", userID, "version", wsConn.caps.Version)
+
+	// The welcome is queued first, so it precedes any other message
+	if err := wsConn.welcome(serverID); err != nil {
+		wsConn.logger.Error("failed to queue welcome", LogKeyError, err)
+		conn.Close()
+		s.finishBind(clientID, auth != nil, nil)
+		s.ReleaseClient(clientID)
+		return
+	}
+
+	s.finishBind(clientID, auth != nil, wsConn)
 
 	// Start reading from connection
 	go wsConn.readPump()
 	go wsConn.writePump()
 }
 
+// bindClient binds a client ID to userID for a handshake, unless it is
+// bound to another user that is connected, connecting, or still held by a
+// session. The check and the binding happen under one lock.
+func (s *WebSocketServer) bindClient(clientID, userID string) bool {
+	// Sessions are asked first: the handler may send while holding their
+	// locks, so s.mu is never held while calling into it
+	s.mu.RLock()
+	heldFn := s.held
+	s.mu.RUnlock()
+	held := heldFn != nil && heldFn(clientID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	owner := s.owners[clientID]
+	if existing := s.clients[clientID]; existing != nil && (existing.user == nil || existing.user.UserID != userID) {
+		return false
+	}
+	if owner != nil && owner.userID != userID {
+		if owner.connecting > 0 || s.clients[clientID] != nil || held {
+			return false
+		}
+		// The client left all sessions; its ID is free again
+		owner = nil
+	}
+	if owner == nil {
+		owner = &clientOwner{userID: userID}
+		s.owners[clientID] = owner
+	}
+	owner.connecting++
+	return true
+}
+
+// finishBind ends a handshake started by bindClient and registers conn,
+// which is nil if the handshake failed.
+func (s *WebSocketServer) finishBind(clientID string, bound bool, conn *WebSocketConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conn != nil {
+		s.clients[clientID] = conn
+	}
+	if owner := s.owners[clientID]; bound && owner != nil {
+		owner.connecting--
+	}
+}
+
+// ReleaseClient unbinds a client ID from its user once the client is
+// disconnected and no session holds it any more. It is called when a
+// connection closes, and should be called when sessions drop a client.
+func (s *WebSocketServer) ReleaseClient(clientID string) {
+	s.mu.RLock()
+	heldFn := s.held
+	s.mu.RUnlock()
+	if heldFn != nil && heldFn(clientID) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if owner := s.owners[clientID]; owner != nil && owner.connecting == 0 && s.clients[clientID] == nil {
+		delete(s.owners, clientID)
+	}
+}
+
+// welcome queues the welcome message, which tells the client its ID, the
+// envelope version of its connection URL and what the server offers for
+// a hello.
+func (c *WebSocketConn) welcome(serverID string) error {
+	pm, err := NewProtocolMessage(MessageTypeWelcome, "", &WelcomeData{
+		ClientID:        c.id,
+		ServerID:        serverID,
+		Timestamp:       time.Now().Unix(),
+		ProtocolVersion: c.caps.Version,
+		MinVersion:      ProtocolVersionMin,
+		MaxVersion:      ProtocolVersionLatest,
+		Features:        c.caps.Features,
+	})
+	if err != nil {
+		return err
+	}
+	data, err := encodeEnvelope(c.id, pm)
+	if err != nil {
+		return err
+	}
+	return c.queue.push(rawOutbound(data).msg)
+}
+
+// requestToken returns the auth token of an upgrade request, and the
+// TokenSubprotocolPrefix subprotocol to accept if the client sent its
+// token that way. Browsers fail the handshake unless the server accepts
+// one of the offered subprotocols; no other subprotocol is accepted.
+func requestToken(r *http.Request) (token, subprotocol string) {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, TokenSubprotocolPrefix) {
+			if token == "" {
+				token = strings.TrimPrefix(protocol, TokenSubprotocolPrefix)
+			}
+			if subprotocol == "" {
+				subprotocol = protocol
+			}
+		}
+	}
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		token = r.URL.Query().Get("access_token")
+	}
+	return token, subprotocol
+}
+
 // readPump pumps messages from the WebSocket connection to the hub.
 func (c *WebSocketConn) readPump() {
 	defer func() {
-		log.Printf("[WebSocket] %s: readPump closing", c.id)
+		c.logger.Info("connection closed")
 		c.conn.Close()
-		c.hub.mu.Lock()
-		delete(c.hub.clients, c.id)
-		c.hub.mu.Unlock()
-		close(c.send)
+		c.hub.removeClient(c)
 	}()
 
 	for {
 		// Read raw message
 		_, messageBytes, err := c.conn.ReadMessage()
 		if err != nil {
-			log.Printf("[WebSocket] %s: Read error: %v", c.id, err)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.logger.Warn("read failed", LogKeyError, err)
+			}
 			break
 		}
 
-		log.Printf("[WebSocket] %s: Received raw message: %s", c.id, string(messageBytes))
+		c.logger.Debug("received message", "bytes", len(messageBytes), "body", redactedBytes(messageBytes))
+
+		if messageBytes = c.incoming(messageBytes); messageBytes == nil {
+			continue
+		}
 
 		// Call message handler if set
 		if c.hub.rawHandler != nil {
@@ -281,44 +703,35 @@ func (c *WebSocketConn) readPump() {
 	}
 }
 
-// writePump pumps messages from the hub to the WebSocket connection.
+// writePump pumps messages from the send queue to the WebSocket connection.
 func (c *WebSocketConn) writePump() {
 	ticker := time.NewTicker(54 * time.Second)
 	defer func() {
-		log.Printf("[WebSocket] %s: writePump closing", c.id)
 		ticker.Stop()
 		c.conn.Close()
 	}()
 
 	for {
 		select {
-		case msg, ok := <-c.send:
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			// Check if message contains raw JSON
-			if rawJSON, ok := msg.Metadata["raw_json"].(string); ok {
-				log.Printf("[WebSocket] %s: Sending raw JSON", c.id)
-				c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-				if err := c.conn.WriteMessage(websocket.TextMessage, []byte(rawJSON)); err != nil {
-					log.Printf("[WebSocket] %s: Write error: %v", c.id, err)
-					return
+		case <-c.queue.ready:
+			for {
+				msg, ok := c.queue.pop()
+				if !ok {
+					break
 				}
-			} else {
-				log.Printf("[WebSocket] %s: Sending message type=%v", c.id, msg.Type)
-				c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-				err := c.conn.WriteJSON(msg)
-				if err != nil {
-					log.Printf("[WebSocket] %s: Write error: %v", c.id, err)
+				if err := c.write(msg); err != nil {
+					c.logger.Warn("write failed", LogKeyError, err)
 					return
 				}
 			}
+			if c.queue.isClosed() {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.Printf("[WebSocket] %s: Ping error: %v", c.id, err)
+				c.logger.Warn("ping failed", LogKeyError, err)
 				return
 			}
 		case <-c.hub.closeCh:
@@ -327,17 +740,138 @@ func (c *WebSocketConn) writePump() {
 	}
 }
 
+// write writes one message to the connection. Messages are queued in
+// the ProtocolVersion1 envelope and converted to the negotiated version
+// here, so queues and cluster nodes only deal with one format.
+func (c *WebSocketConn) write(msg *Message) error {
+	caps := c.Capabilities()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	c.conn.EnableWriteCompression(caps.Has(FeatureCompression))
+
+	// Check if message contains raw JSON
+	if rawJSON, ok := msg.Metadata["raw_json"].(string); ok {
+		data := c.outgoing([]byte(rawJSON), caps)
+		if data == nil {
+			return nil
+		}
+		if caps.Version >= ProtocolVersion2 {
+			data = flattenEnvelope(data)
+		}
+		return c.conn.WriteMessage(websocket.TextMessage, data)
+	}
+	c.logger.Debug("sending legacy message", LogKeyType, msg.Type)
+	return c.conn.WriteJSON(msg)
+}
+
+// outgoing applies the capabilities of the client to a server message:
+// messages of features it didn't negotiate are dropped, and the adapter
+// of its version converts the rest. Returns nil to drop the message.
+func (c *WebSocketConn) outgoing(data []byte, caps *Capabilities) []byte {
+	adapter := c.hub.adapter(caps.Version)
+	if adapter == nil && caps.acceptsAll() {
+		return data
+	}
+
+	item := rawOutbound(data)
+	item.parse()
+	if item.pm == nil {
+		return data
+	}
+	if !caps.accepts(item.pm.Type) {
+		return nil
+	}
+	if adapter == nil {
+		return data
+	}
+
+	pm := adapter.Outgoing(item.pm)
+	if pm == nil {
+		return nil
+	}
+	encoded, err := encodeEnvelope(c.id, pm)
+	if err != nil {
+		c.logger.Error("failed to encode adapted message", LogKeyType, pm.Type, LogKeyError, err)
+		return nil
+	}
+	return encoded
+}
+
+// incoming converts a client message with the adapter of the client's
+// version, if any. Returns nil to drop the message.
+func (c *WebSocketConn) incoming(data []byte) []byte {
+	adapter := c.hub.adapter(c.Version())
+	if adapter == nil {
+		return data
+	}
+
+	received, err := parseEnvelope(data)
+	if err != nil {
+		// Left to the message handler to report
+		return data
+	}
+	pm := adapter.Incoming(received.Protocol)
+	if pm == nil {
+		return nil
+	}
+	encoded, err := encodeEnvelope(c.id, pm)
+	if err != nil {
+		c.logger.Error("failed to encode adapted message", LogKeyType, pm.Type, LogKeyError, err)
+		return nil
+	}
+	return encoded
+}
+
+// enqueue queues a message for a client, and disconnects the client if
+// its queue overflowed. The caller holds s.mu.
+func (s *WebSocketServer) enqueue(client *WebSocketConn, msg *Message) error {
+	select {
+	case <-s.closeCh:
+		return ErrTransportClosed
+	default:
+	}
+
+	err := client.queue.push(msg)
+	if err == ErrSlowConsumer {
+		client.logger.Warn("send queue overflowed, disconnecting")
+		atomic.AddUint64(&s.disconnects, 1)
+		// readPump fails and removes the client
+		if client.conn != nil {
+			client.conn.Close()
+		}
+	}
+	return err
+}
+
+// removeClient removes a closed connection, keeping its queue metrics in
+// the totals.
+func (s *WebSocketServer) removeClient(c *WebSocketConn) {
+	c.queue.close()
+
+	s.mu.Lock()
+	// The client may have reconnected on a new connection
+	current := s.clients[c.id] == c
+	if current {
+		delete(s.clients, c.id)
+	}
+	s.retired.addQueue(c.queue.stats())
+	onClose := s.onClose
+	s.mu.Unlock()
+
+	if current && onClose != nil {
+		onClose(c.id)
+	}
+	if current {
+		s.ReleaseClient(c.id)
+	}
+}
+
 // Broadcast sends a message to all connected clients.
 func (s *WebSocketServer) Broadcast(msg *Message) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	for _, client := range s.clients {
-		select {
-		case client.send <- msg:
-		case <-s.closeCh:
-			return
-		}
+		s.enqueue(client, msg)
 	}
 }
 
@@ -350,13 +884,23 @@ func (s *WebSocketServer) Send(clientID string, msg *Message) error {
 	if !ok {
 		return fmt.Errorf("client not found: %s", clientID)
 	}
+	return s.enqueue(client, msg)
+}
 
-	select {
-	case client.send <- msg:
-		return nil
-	case <-s.closeCh:
-		return ErrTransportClosed
+// Disconnect closes the connection of a client after the messages queued
+// for it are sent. Returns false if the client is not connected to this
+// server.
+func (s *WebSocketServer) Disconnect(clientID string) bool {
+	s.mu.RLock()
+	client, ok := s.clients[clientID]
+	s.mu.RUnlock()
+	if !ok {
+		return false
 	}
+	client.logger.Info("disconnecting")
+	// writePump drains the queue, then closes the connection
+	client.queue.close()
+	return true
 }
 
 // SendJSON sends raw JSON data to a specific client.
@@ -376,13 +920,7 @@ func (s *WebSocketServer) SendJSON(clientID string, data []byte) error {
 			"raw_json": string(data),
 		},
 	}
-
-	select {
-	case client.send <- msg:
-		return nil
-	case <-s.closeCh:
-		return ErrTransportClosed
-	}
+	return s.enqueue(client, msg)
 }
 
 // Close closes the WebSocket server.
@@ -402,8 +940,10 @@ func (s *WebSocketServer) Close() error {
 	defer s.mu.Unlock()
 
 	for _, client := range s.clients {
-		close(client.send)
-		client.conn.Close()
+		client.queue.close()
+		if client.conn != nil {
+			client.conn.Close()
+		}
 	}
 
 	s.clients = make(map[string]*WebSocketConn)
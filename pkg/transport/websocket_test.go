@@ -0,0 +1,191 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreseekdev/texere/pkg/session"
+	"github.com/gorilla/websocket"
+)
+
+// authServer starts a WebSocket server that requires tokens of auth.
+func authServer(t *testing.T, auth session.Authenticator) (*WebSocketServer, string) {
+	t.Helper()
+	server := NewWebSocketServer("")
+	server.SetAuthenticator(auth)
+	mux := http.NewServeMux()
+	server.RegisterHandler(mux)
+	httpServer := httptest.NewServer(mux)
+	t.Cleanup(httpServer.Close)
+	return server, "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/ws"
+}
+
+// waitForClient waits until the server registered a connection.
+func waitForClient(t *testing.T, server *WebSocketServer, clientID string) *session.UserInfo {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if user := server.User(clientID); user != nil {
+			return user
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Client %s was not registered", clientID)
+	return nil
+}
+
+// TestWebSocketServer_UpgradeAuth tests authenticating connections during the upgrade.
+func TestWebSocketServer_UpgradeAuth(t *testing.T) {
+	ctx := context.Background()
+	auth := session.NewTokenAuthenticator()
+	aliceToken, _ := auth.GenerateToken(ctx, "alice")
+	bobToken, _ := auth.GenerateToken(ctx, "bob")
+	server, url := authServer(t, auth)
+
+	_, resp, err := websocket.DefaultDialer.Dial(url+"?client_id=c1", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without a token, got %v", err)
+	}
+	_, resp, err = websocket.DefaultDialer.Dial(url+"?client_id=c1&token=wrong", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 with an invalid token, got %v", err)
+	}
+
+	// Header
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?client_id=c1", http.Header{"Authorization": {"Bearer " + aliceToken}})
+	if err != nil {
+		t.Fatalf("Dial with a bearer token failed: %v", err)
+	}
+	defer conn.Close()
+	if user := waitForClient(t, server, "c1"); user.UserID != "alice" {
+		t.Errorf("Expected c1 to be alice, got %s", user.UserID)
+	}
+
+	// Subprotocol, as browsers send it
+	dialer := websocket.Dialer{Subprotocols: []string{"texere", TokenSubprotocolPrefix + bobToken}}
+	conn, _, err = dialer.Dial(url+"?client_id=c2", nil)
+	if err != nil {
+		t.Fatalf("Dial with a token subprotocol failed: %v", err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != TokenSubprotocolPrefix+bobToken {
+		t.Errorf("Expected the token subprotocol to be accepted, got %q", conn.Subprotocol())
+	}
+	if user := waitForClient(t, server, "c2"); user.UserID != "bob" {
+		t.Errorf("Expected c2 to be bob, got %s", user.UserID)
+	}
+
+	// Bob can't take over alice's client ID
+	_, resp, err = websocket.DefaultDialer.Dial(url+"?client_id=c1&token="+bobToken, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 for another user's client ID, got %v", err)
+	}
+
+	// Other subprotocols are never accepted
+	dialer = websocket.Dialer{Subprotocols: []string{"texere", "other"}}
+	conn, _, err = dialer.Dial(url+"?client_id=c3", http.Header{"Authorization": {"Bearer " + aliceToken}})
+	if err != nil {
+		t.Fatalf("Dial with a bearer token and subprotocols failed: %v", err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != "" {
+		t.Errorf("Expected no subprotocol to be accepted, got %q", conn.Subprotocol())
+	}
+}
+
+// waitForDisconnect waits until the server removed a client's connection.
+func waitForDisconnect(t *testing.T, server *WebSocketServer, clientID string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if server.User(clientID) == nil {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Client %s is still registered", clientID)
+}
+
+// TestWebSocketServer_ClientIDBinding tests that a client ID stays bound
+// to its user while a session holds the disconnected client.
+func TestWebSocketServer_ClientIDBinding(t *testing.T) {
+	ctx := context.Background()
+	auth := session.NewTokenAuthenticator()
+	bobToken, _ := auth.GenerateToken(ctx, "bob")
+	malloryToken, _ := auth.GenerateToken(ctx, "mallory")
+	server, url := authServer(t, auth)
+	var held atomic.Bool
+	server.SetClientHeldFunc(func(clientID string) bool { return clientID == "c1" && held.Load() })
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?client_id=c1&token="+bobToken, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	waitForClient(t, server, "c1")
+	held.Store(true)
+	conn.Close()
+	waitForDisconnect(t, server, "c1")
+
+	_, resp, err := websocket.DefaultDialer.Dial(url+"?client_id=c1&token="+malloryToken, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected 409 for a held client ID, got %v", err)
+	}
+
+	// Bob can reconnect
+	conn, _, err = websocket.DefaultDialer.Dial(url+"?client_id=c1&token="+bobToken, nil)
+	if err != nil {
+		t.Fatalf("Reconnect failed: %v", err)
+	}
+	waitForClient(t, server, "c1")
+	conn.Close()
+	waitForDisconnect(t, server, "c1")
+
+	// The session evicted bob
+	held.Store(false)
+	server.ReleaseClient("c1")
+	conn, _, err = websocket.DefaultDialer.Dial(url+"?client_id=c1&token="+malloryToken, nil)
+	if err != nil {
+		t.Fatalf("Dial with a released client ID failed: %v", err)
+	}
+	defer conn.Close()
+	if user := waitForClient(t, server, "c1"); user.UserID != "mallory" {
+		t.Errorf("Expected c1 to be mallory, got %s", user.UserID)
+	}
+}
+
+// TestProtocolHandler_RejectsSpoofedClientID tests that messages can't claim another client ID.
+func TestProtocolHandler_RejectsSpoofedClientID(t *testing.T) {
+	handler := NewProtocolHandler(nil, nil)
+	server := NewWebSocketServer("")
+	handler.SetServer(server)
+	node := &clusterNode{handler: handler, server: server}
+	node.connect("alice")
+	node.connect("mallory")
+
+	node.send(t, "alice", MessageTypeSubscribe, &SubscribeData{FilePath: "/test.txt"})
+	var snapshot SnapshotData
+	node.receive(t, "alice", MessageTypeSnapshot, &snapshot)
+
+	pm, _ := NewProtocolMessage(MessageTypeStopEditing, "", &StopEditingData{SessionID: snapshot.SessionID})
+	pm.RequestID = "req-1"
+	raw, _ := json.Marshal(map[string]interface{}{
+		"type":      string(MessageTypeStopEditing),
+		"client_id": "alice",
+		"metadata":  map[string]interface{}{"protocol_message": pm},
+	})
+	handler.handleRawMessage("mallory", raw)
+
+	reply := node.next(t, "mallory")
+	var errData ErrorData
+	json.Unmarshal(reply.Data, &errData)
+	if errData.Code != "client_id_mismatch" || reply.RequestID != "req-1" {
+		t.Errorf("Expected client_id_mismatch for req-1, got %q for %q", errData.Code, reply.RequestID)
+	}
+	if es := handler.sessionManager.GetSession(snapshot.SessionID); es == nil || es.GetClient("alice") == nil {
+		t.Error("Expected alice to stay in the session")
+	}
+}